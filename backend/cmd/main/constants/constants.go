@@ -1,7 +0,0 @@
-package constants
-
-const (
-	// Protocol identification
-	DOMAIN_NAME  = "quillmail.xyz"
-	DOMAIN_NAME2 = "gmail.com"
-)
@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http" // Import the net/http package
@@ -12,12 +12,15 @@ import (
 	"syscall" // For graceful shutdown
 	"time"
 
-	"github.com/joho/godotenv"
-
+	"quill/pkg/certs"
+	"quill/pkg/config"
 	"quill/pkg/db"
 	"quill/pkg/domain"
-	"quill/pkg/models"
+	"quill/pkg/hosting"
+	"quill/pkg/transport/httpapi"
+	"quill/pkg/transport/imap"
 	"quill/pkg/transport/quill"
+	"quill/pkg/transport/smtp"
 )
 
 func main() {
@@ -27,35 +30,42 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel() // Ensure cancel is called on exit
 
-	// Set up OS signal handling for graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	// --- Existing Quill Server Setup ---
-	// Auth Service needs its own context for initialization which might be short-lived
-	authSvcCtx, authSvcCancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer authSvcCancel()
+	configPath := flag.String("config", envOr("QUILL_CONFIG", "quill.yaml"), "path to the YAML configuration file")
+	envPath := flag.String("env", "../.env", "path to a .env file with environment overrides")
+	flag.Parse()
 
-	authSvc, err := quill.InitAuthServiceFromEnv(authSvcCtx, "../.env") // Pass context
+	cfg, err := config.Load(*configPath, *envPath)
 	if err != nil {
-		log.Fatalf("auth init failed: %v", err)
+		log.Fatalf("Invalid configuration: %v", err)
 	}
+	hosts, err := hosting.NewRegistry(hosting.FromConfig(cfg.Domains)...)
+	if err != nil {
+		log.Fatalf("Failed to load hosted domains: %v", err)
+	}
+	log.Printf("Serving %s", strings.Join(hosts.Names(), ", "))
 
-	mongoURI := getEnvWithDefault("MONGODB_URI", "mongodb://localhost:27017")
-	mongoPassword := getEnvWithDefault("mongodb_password", "")
-	mongoDatabase := getEnvWithDefault("MONGODB_DATABASE", "quill")
-
-	if mongoPassword != "" && strings.Contains(mongoURI, "<db_password>") {
-		mongoURI = strings.Replace(mongoURI, "<db_password>", mongoPassword, 1)
+	certMgr, err := certs.NewManager(cfg)
+	if err != nil {
+		log.Fatalf("Failed to load certificates: %v", err)
 	}
+	go func() {
+		if err := certMgr.Watch(ctx); err != nil {
+			log.Printf("ERROR: certificate files are not watched for changes: %v", err)
+		}
+	}()
+
+	// Set up OS signal handling for graceful shutdown and config reloads
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
+	mongoURI := cfg.Storage.ConnectionURI()
 	mongoConfig := db.MongoConfig{
 		URI:      mongoURI,
-		Database: mongoDatabase,
-		Timeout:  10 * time.Second,
+		Database: cfg.Storage.Database,
+		Timeout:  cfg.Storage.Timeout,
 	}
 
-	log.Printf("Connecting to MongoDB: %s (database: %s)", maskConnectionString(mongoURI), mongoDatabase)
+	log.Printf("Connecting to MongoDB: %s (database: %s)", maskConnectionString(mongoURI), cfg.Storage.Database)
 
 	mongoDB, err := db.NewMongoDB(mongoConfig)
 	if err != nil {
@@ -75,12 +85,35 @@ func main() {
 	log.Println("MongoDB unique user indexes ensured successfully.")
 	// ======================================
 
-	msgSvc := domain.NewMongoMessageService(mongoDB.GetDatabase())
+	msgSvc := domain.NewMongoMessageService(mongoDB.GetDatabase(), hosts)
+	msgSvc.SetLimits(domainLimits(cfg.Limits))
 	log.Println("Created MongoDB-backed message service")
 
-	messageHandler := quill.NewMessageHandler(authSvc, msgSvc)
+	// --- Existing Quill Server Setup ---
+	// Auth Service needs its own context for initialization which might be short-lived.
+	// The message service doubles as the store for API keys and app passwords.
+	authSvcCtx, authSvcCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer authSvcCancel()
+
+	authSvc, err := quill.InitAuthServiceFromConfig(authSvcCtx, cfg.Auth, msgSvc)
+	if err != nil {
+		log.Fatalf("auth init failed: %v", err)
+	}
 
-	quillServerAddr := "localhost:9876"
+	userSvc := domain.NewMongoUserService(mongoDB.GetDatabase(), cfg.ExportDir, hosts)
+	if len(cfg.Admins) > 0 {
+		if err := userSvc.EnsureAdmins(indexCtx, cfg.Admins); err != nil {
+			log.Fatalf("Failed to bootstrap admins: %v", err)
+		}
+	}
+
+	messageHandler := quill.NewMessageHandler(authSvc, msgSvc, userSvc, hosts, certMgr)
+	messageHandler.SetFederation(cfg.Federation)
+	messageHandler.SetAuthBackends(cfg.Auth.Backends)
+
+	go runAccountJanitor(ctx, userSvc, messageHandler.Sessions(), time.Hour)
+
+	quillServerAddr := cfg.Listen.Quill
 	quillServer := quill.NewServer(quillServerAddr, messageHandler)
 
 	// --- Start Quill Server in a Goroutine ---
@@ -88,7 +121,7 @@ func main() {
 		log.Printf("INFO: starting Quill protocol TLS server on %s", quillServerAddr)
 		// Assuming quill.Server has a StartTLS method. You might want to pass the context
 		// to it if you want to cleanly shut it down.
-		if err := quillServer.StartTLS("../certificate/quill.crt", "../certificate/quill.key"); err != nil {
+		if err := quillServer.StartTLS(certMgr.ServerTLSConfig(true)); err != nil {
 			// Don't use log.Fatalf here, as it exits the whole program.
 			// Instead, log the error and signal main to shut down.
 			log.Printf("FATAL: Quill server failed: %v", err)
@@ -97,7 +130,7 @@ func main() {
 	}()
 
 	// --- Add HTTP Server Setup ---
-	httpServerAddr := "localhost:8080"
+	httpServerAddr := cfg.Listen.HTTP
 	httpMux := http.NewServeMux()
 	httpMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Hello, Omer! This is the HTTP server speaking from %s\n", r.Host)
@@ -106,77 +139,15 @@ func main() {
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintln(w, "OK")
 	})
-	httpMux.HandleFunc("/createUser", func(w http.ResponseWriter, r *http.Request) {
-		log.Println("[/createUser] Received request")
-		// Only allow POST method
-		if r.Method != http.MethodPost {
-			log.Printf("[/createUser] Invalid method: %s", r.Method)
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		// Parse the JSON request body
-		var req models.CreateUserRequest
-		decoder := json.NewDecoder(r.Body)
-		if err := decoder.Decode(&req); err != nil {
-			log.Printf("[/createUser] Error decoding request body: %v", err)
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
-			return
-		}
-		log.Printf("[/createUser] Request body: %+v", req)
-
-		// Validate request fields
-		if req.UserQuillMail == "" || req.UserEmail == "" || req.UsersUID == "" {
-			log.Printf("[/createUser] Missing required fields: UserQuillMail=%q, UserEmail=%q, UsersUID=%q", req.UserQuillMail, req.UserEmail, req.UsersUID)
-			http.Error(w, "Missing required fields", http.StatusBadRequest)
-			return
-		}
-
-		// Create a new User object
-		now := time.Now()
-		user := &models.User{
-			UserQuillMail: req.UserQuillMail,
-			UserEmail:     req.UserEmail,
-			UsersUID:      req.UsersUID,
-			CreatedAt:     now,
-			LastLogin:     now,
-		}
-		log.Printf("[/createUser] Creating user: %+v", user)
-
-		// Insert the user into MongoDB
-		// Use r.Context() for the request-scoped context
-		created, err := mongoDB.CreateUserDoc(r.Context(), user, req.AuthToken, authSvc)
-		if err != nil {
-			log.Printf("[/createUser] Error creating user: %v", err)
-			http.Error(w, "Failed to create user", http.StatusInternalServerError)
-			return
-		}
-
-		// Prepare response
-		resp := models.CreateUserResponse{
-			Success: created,
-		}
-
-		if created {
-			resp.Message = "User created successfully"
-			resp.UserID = user.UsersUID
-			log.Printf("[/createUser] User created successfully: UID=%s, Email=%s, QuillMail=%s", user.UsersUID, user.UserEmail, user.UserQuillMail)
-		} else {
-			// This branch is hit if mongo.IsDuplicateKeyError(err) was true in CreateUserDoc
-			resp.Message = "User with this UID, email, or Quill mail already exists"
-			w.WriteHeader(http.StatusConflict) // 409 Conflict
-			log.Printf("[/createUser] User already exists: UID=%s, Email=%s, QuillMail=%s", user.UsersUID, user.UserEmail, user.UserQuillMail)
-		}
-
-		// Send JSON response
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			log.Printf("[/createUser] Error encoding response: %v", err)
-			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
-			return
-		}
-		log.Printf("[/createUser] Response sent: %+v", resp)
-	})
+	httpMux.Handle("/admin/", httpapi.NewAdminHandler(authSvc, msgSvc, userSvc, messageHandler.Sessions()))
+	userHandler := httpapi.NewUserHandler(authSvc, msgSvc, userSvc, messageHandler.Sessions())
+	httpMux.Handle("/createUser", userHandler)
+	httpMux.Handle("/me", userHandler)
+	httpMux.Handle("/me/", userHandler)
+	jmapHandler := httpapi.NewJMAPHandler(authSvc, msgSvc, messageHandler)
+	httpMux.Handle("/jmap", jmapHandler)
+	httpMux.Handle("/.well-known/jmap", jmapHandler)
+	httpMux.Handle("/ws", quill.NewWebSocketHandler(messageHandler, cfg.WebSocketOrigins))
 
 	httpServer := &http.Server{
 		Addr:    httpServerAddr,
@@ -186,29 +157,93 @@ func main() {
 		ReadTimeout:       10 * time.Second,
 		WriteTimeout:      10 * time.Second,
 		IdleTimeout:       120 * time.Second,
+		TLSConfig:         certMgr.ServerTLSConfig(false, "h2", "http/1.1"),
 	}
 
 	// --- Start HTTP Server in a Goroutine ---
 	// Inside the goroutine for the HTTP server
 	go func() {
 		log.Printf("INFO: starting HTTPS server on %s", httpServerAddr)
-		// This serves HTTPS (encrypted)
-		// You need to provide paths to your TLS certificate and private key files
-		certFile := "../certificate/quill.crt" // Reusing your existing certificate path for demonstration
-		keyFile := "../certificate/quill.key"  // Reusing your existing key path for demonstration
-
-		if err := httpServer.ListenAndServeTLS(certFile, keyFile); err != nil && err != http.ErrServerClosed {
+		// This serves HTTPS (encrypted) with the hosted domains' certificates
+		if err := httpServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
 			log.Printf("FATAL: HTTPS server failed: %v", err)
 			cancel()
 		}
 	}()
 
-	// --- Graceful Shutdown Logic ---
-	select {
-	case sig := <-sigChan:
-		log.Printf("INFO: Received signal %s. Shutting down...", sig)
-	case <-ctx.Done():
-		log.Println("INFO: A server goroutine signalled shutdown.")
+	// --- Outbound queue for regular email ---
+	smtpSender := smtp.NewSender(msgSvc)
+	if err := smtpSender.Configure(cfg); err != nil {
+		log.Fatalf("Failed to configure outbound mail: %v", err)
+	}
+	go smtpSender.Run(ctx)
+
+	// --- SMTP gateway for regular email, if enabled ---
+	if addr := cfg.SMTP.Listen; addr != "" {
+		hostname := cfg.SMTP.Hostname
+		if hostname == "" {
+			hostname = hosts.Primary()
+		}
+		gateway := smtp.NewGateway(msgSvc, hosts, cfg.SMTP.RejectSPFFail)
+		smtpServer := smtp.NewServer(addr, hostname, certMgr.ServerTLSConfig(false), gateway)
+		go func() {
+			log.Printf("INFO: starting SMTP gateway on %s as %s", addr, hostname)
+			if err := smtpServer.ListenAndServe(); err != nil {
+				log.Printf("ERROR: SMTP gateway failed: %v", err)
+			}
+		}()
+		defer smtpServer.Close()
+	}
+
+	// --- Read-only IMAP access, if enabled ---
+	if addr := cfg.IMAP.Listen; addr != "" {
+		imapServer := imap.NewServer(addr, certMgr.ServerTLSConfig(false), imap.NewBackend(authSvc, msgSvc, hosts))
+		go func() {
+			var err error
+			if cfg.IMAP.ImplicitTLS {
+				log.Printf("INFO: starting IMAP server on %s (TLS)", addr)
+				err = imapServer.ListenAndServeTLS()
+			} else {
+				log.Printf("INFO: starting IMAP server on %s (STARTTLS)", addr)
+				err = imapServer.ListenAndServe()
+			}
+			if err != nil {
+				log.Printf("ERROR: IMAP server failed: %v", err)
+			}
+		}()
+		defer imapServer.Close()
+	}
+
+	// --- ACME http-01 challenges, if enabled ---
+	if addr := cfg.TLS.ACME.HTTPChallengeListen; addr != "" {
+		challengeServer := &http.Server{
+			Addr:              addr,
+			Handler:           certMgr.HTTPHandler(nil),
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		go func() {
+			log.Printf("INFO: answering ACME http-01 challenges on %s", addr)
+			if err := challengeServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("ERROR: ACME challenge server failed: %v", err)
+			}
+		}()
+		defer challengeServer.Close()
+	}
+
+	// --- Reload and Graceful Shutdown Logic ---
+wait:
+	for {
+		select {
+		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				cfg = reloadConfig(ctx, cfg, *configPath, *envPath, hosts, certMgr, smtpSender, msgSvc, userSvc, messageHandler)
+				continue
+			}
+			log.Printf("INFO: Received signal %s. Shutting down...", sig)
+		case <-ctx.Done():
+			log.Println("INFO: A server goroutine signalled shutdown.")
+		}
+		break wait
 	}
 
 	// Create a shutdown context with a timeout
@@ -234,14 +269,91 @@ func main() {
 	log.Println("INFO: All servers shut down. Exiting.")
 }
 
-// Helper function to get environment variable with fallback default
-func getEnvWithDefault(key, defaultValue string) string {
-	_ = godotenv.Load("../.env") // Loads .env file if present, ignores error if not
-	value := os.Getenv(key)
-	if value == "" {
-		return defaultValue
+// runAccountJanitor purges accounts whose deletion grace period has ended
+// and data exports past their retention, once per interval until ctx ends.
+func runAccountJanitor(ctx context.Context, users *domain.MongoUserService, sessions quill.SessionStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		purged, err := users.PurgeExpiredAccounts(ctx)
+		if err != nil {
+			log.Printf("ERROR: purging deleted accounts failed: %v", err)
+		}
+		for _, id := range purged {
+			sessions.RevokeUser(id)
+		}
+		if err := users.PurgeExpiredExports(ctx); err != nil {
+			log.Printf("ERROR: purging expired exports failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reloadConfig re-reads the configuration and applies the settings that
+// can change at runtime: hosted domains, certificates and DKIM keys,
+// limits, federation peers, outbound mail and admins. Changes to anything
+// else are logged and wait for a restart. An invalid file leaves the
+// running configuration in place.
+func reloadConfig(ctx context.Context, current *config.Config, path, envPath string, hosts *hosting.Registry, certMgr *certs.Manager, sender *smtp.Sender,
+	msgSvc *domain.MongoMessageService, userSvc *domain.MongoUserService, handler *quill.MessageHandler) *config.Config {
+	next, err := config.Load(path, envPath)
+	if err != nil {
+		log.Printf("ERROR: config reload failed, keeping the current configuration: %v", err)
+		return current
+	}
+	// Certificates first: a domain must not be served before they load.
+	if err := certMgr.Configure(next); err != nil {
+		log.Printf("ERROR: config reload failed, keeping the current configuration: %v", err)
+		return current
+	}
+	if err := sender.Configure(next); err != nil {
+		log.Printf("ERROR: config reload failed, keeping the current configuration: %v", err)
+		return current
+	}
+	if err := hosts.Replace(hosting.FromConfig(next.Domains)...); err != nil {
+		log.Printf("ERROR: config reload failed, keeping the current configuration: %v", err)
+		return current
+	}
+	if changed := next.RestartRequired(current); len(changed) > 0 {
+		log.Printf("WARN: changes to %s take effect after a restart", strings.Join(changed, ", "))
+	}
+
+	msgSvc.SetLimits(domainLimits(next.Limits))
+	handler.SetFederation(next.Federation)
+	if len(next.Admins) > 0 {
+		if err := userSvc.EnsureAdmins(ctx, next.Admins); err != nil {
+			log.Printf("ERROR: bootstrapping admins on reload failed: %v", err)
+		}
+	}
+	log.Println("INFO: configuration reloaded")
+	return next
+}
+
+// domainLimits fills the limits left at zero with the server defaults.
+func domainLimits(l config.LimitsConfig) domain.Limits {
+	limits := domain.DefaultLimits
+	if l.MaxMessageBytes > 0 {
+		limits.MaxMessageBytes = l.MaxMessageBytes
+	}
+	if l.MaxAttachments > 0 {
+		limits.MaxAttachments = l.MaxAttachments
+	}
+	if l.DefaultQuotaBytes > 0 {
+		limits.DefaultQuotaBytes = l.DefaultQuotaBytes
+	}
+	return limits
+}
+
+func envOr(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
 	}
-	return value
+	return defaultValue
 }
 
 // Helper function to mask sensitive parts of the connection string for logging
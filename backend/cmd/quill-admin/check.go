@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"quill/pkg/certs"
+	"quill/pkg/client"
+	"quill/pkg/transport/quill"
+	"quill/pkg/transport/smtp"
+)
+
+// certWarning is how close to expiry a certificate gets reported.
+const certWarning = 30 * 24 * time.Hour
+
+type checkResult struct {
+	Config   string   `json:"config"`
+	Domains  []string `json:"domains"`
+	Warnings []string `json:"warnings"`
+	// PendingMigrations is only filled in with -db.
+	PendingMigrations []int `json:"pendingMigrations,omitempty"`
+}
+
+// runConfigCheck loads the configuration as the server would on start or
+// reload: validation, certificates and federation trust, DKIM keys.
+func runConfigCheck(a *app, args []string) error {
+	fs := a.flags("config check", "[-db]")
+	checkDB := fs.Bool("db", false, "also connect to the database and look for pending migrations")
+	parse(fs, args, 0, 0)
+
+	cfg, err := a.config()
+	if err != nil {
+		return fmt.Errorf("%s is invalid:\n  %s", a.configPath, strings.ReplaceAll(err.Error(), "\n", "\n  "))
+	}
+	certMgr, err := certs.NewManager(cfg)
+	if err != nil {
+		return err
+	}
+	if err := smtp.NewSender(nil).Configure(cfg); err != nil {
+		return err
+	}
+
+	result := checkResult{Config: a.configPath, Warnings: []string{}}
+	for _, d := range cfg.Domains {
+		result.Domains = append(result.Domains, d.Name)
+		if d.ACME {
+			continue // obtained and renewed by the server
+		}
+		cert, err := certMgr.GetCertificate(&tls.ClientHelloInfo{ServerName: d.Name})
+		if err != nil {
+			return fmt.Errorf("domain %s: %w", d.Name, err)
+		}
+		result.Warnings = append(result.Warnings, checkCertificate(d.Name, cert)...)
+	}
+	if len(cfg.Admins) == 0 {
+		result.Warnings = append(result.Warnings, "no admins are configured; the admin API is only usable by accounts given the role with quill-admin user roles")
+	}
+
+	if *checkDB {
+		if err := a.open(); err != nil {
+			return err
+		}
+		pending, err := a.db.PendingMigrations(context.Background())
+		if err != nil {
+			return err
+		}
+		for _, m := range pending {
+			result.PendingMigrations = append(result.PendingMigrations, m.ID)
+		}
+		if len(pending) > 0 {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%d database migration(s) pending; run quill-admin migrate", len(pending)))
+		}
+	}
+
+	return a.print(result, func(w io.Writer) {
+		fmt.Fprintf(w, "%s is valid for %s\n", a.configPath, strings.Join(result.Domains, ", "))
+		for _, warning := range result.Warnings {
+			fmt.Fprintf(w, "warning: %s\n", warning)
+		}
+	})
+}
+
+// checkCertificate reports a serving certificate that will not do for
+// domain, or will not for much longer.
+func checkCertificate(domain string, cert *tls.Certificate) []string {
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return []string{fmt.Sprintf("%s: unreadable certificate: %v", domain, err)}
+		}
+	}
+	var warnings []string
+	if err := leaf.VerifyHostname(domain); err != nil {
+		warnings = append(warnings, fmt.Sprintf("%s: %v", domain, err))
+	}
+	switch left := time.Until(leaf.NotAfter); {
+	case left <= 0:
+		warnings = append(warnings, fmt.Sprintf("%s: certificate expired on %s", domain, formatTime(leaf.NotAfter)))
+	case left < certWarning:
+		warnings = append(warnings, fmt.Sprintf("%s: certificate expires on %s", domain, formatTime(leaf.NotAfter)))
+	}
+	return warnings
+}
+
+type peerResult struct {
+	Domain  string `json:"domain"`
+	Address string `json:"address"`
+	Remote  string `json:"remote"`
+	TLS     string `json:"tls"`
+	Cipher  string `json:"cipher"`
+	// Certificate is the peer's, verified against federation.ca_file and
+	// the system roots.
+	Certificate struct {
+		Subject  string    `json:"subject"`
+		Issuer   string    `json:"issuer"`
+		DNSNames []string  `json:"dnsNames"`
+		NotAfter time.Time `json:"notAfter"`
+	} `json:"certificate"`
+	// ClientCertRequested reports whether the peer asked for the relaying
+	// domain's certificate, which it checks before accepting relayed mail.
+	ClientCertRequested bool                       `json:"clientCertRequested"`
+	Capabilities        *quill.CapabilitiesPayload `json:"capabilities,omitempty"`
+}
+
+// runPeerTest connects to a peer the way a relay from this server does,
+// without sending anything.
+func runPeerTest(a *app, args []string) error {
+	fs := a.flags("peer test", "[-from domain] <domain>")
+	from := fs.String("from", "", "hosted `domain` to relay as; default the primary domain")
+	parse(fs, args, 1, 1)
+	cfg, err := a.config()
+	if err != nil {
+		return err
+	}
+	certMgr, err := certs.NewManager(cfg)
+	if err != nil {
+		return err
+	}
+	peer := strings.ToLower(fs.Arg(0))
+	origin := cfg.Domains[0].Name
+	if *from != "" {
+		origin = strings.ToLower(*from)
+	}
+
+	result := peerResult{Domain: peer, Address: cfg.Federation.PeerAddress(peer)}
+	var fedCertErr error
+	if cfg.Federation.MutualTLS {
+		_, fedCertErr = certMgr.FederationCertificate(origin)
+	}
+	tlsCfg := certMgr.ClientTLSConfig(origin, peer)
+	if present := tlsCfg.GetClientCertificate; present != nil {
+		tlsCfg.GetClientCertificate = func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			result.ClientCertRequested = true
+			return present(info)
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: cfg.Federation.DialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", result.Address, tlsCfg)
+	if err != nil {
+		return fmt.Errorf("connecting to %s at %s: %w", peer, result.Address, err)
+	}
+	state := conn.ConnectionState()
+	result.Remote = conn.RemoteAddr().String()
+	_ = conn.Close()
+	result.TLS = tls.VersionName(state.Version)
+	result.Cipher = tls.CipherSuiteName(state.CipherSuite)
+	leaf := state.PeerCertificates[0]
+	result.Certificate.Subject = leaf.Subject.String()
+	result.Certificate.Issuer = leaf.Issuer.String()
+	result.Certificate.DNSNames = leaf.DNSNames
+	result.Certificate.NotAfter = leaf.NotAfter
+
+	// Then speak the protocol. Servers before HELLO answer UNKNOWN_TYPE.
+	c, err := client.New(client.Options{
+		Addr:        result.Address,
+		TLSConfig:   tlsCfg,
+		ClientName:  "quill-admin",
+		PoolSize:    1,
+		DialTimeout: cfg.Federation.DialTimeout,
+	})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	var caps quill.CapabilitiesPayload
+	err = c.Do(context.Background(), quill.PacketTypeHello, quill.HelloPayload{
+		Versions: []string{quill.ProtocolVersion},
+		Client:   "quill-admin",
+	}, &caps)
+	var qe *client.Error
+	switch {
+	case err == nil:
+		result.Capabilities = &caps
+	case errors.As(err, &qe) && qe.Code == quill.ErrorCodeUnknownType:
+	default:
+		return fmt.Errorf("%s accepted TLS but not the Quill protocol: %w", peer, err)
+	}
+
+	return a.print(result, func(w io.Writer) {
+		fmt.Fprintf(w, "Peer:         %s at %s (%s)\n", peer, result.Address, result.Remote)
+		fmt.Fprintf(w, "TLS:          %s, %s\n", result.TLS, result.Cipher)
+		fmt.Fprintf(w, "Certificate:  %s, issued by %s\n", result.Certificate.Subject, result.Certificate.Issuer)
+		fmt.Fprintf(w, "Names:        %s\n", strings.Join(result.Certificate.DNSNames, ", "))
+		fmt.Fprintf(w, "Expires:      %s\n", formatTime(result.Certificate.NotAfter))
+		switch {
+		case !cfg.Federation.MutualTLS:
+			fmt.Fprintln(w, "Mutual TLS:   off here; peers refuse mail relayed from this server")
+		case fedCertErr != nil:
+			fmt.Fprintf(w, "Mutual TLS:   no certificate to present: %v\n", fedCertErr)
+		case result.ClientCertRequested:
+			fmt.Fprintf(w, "Mutual TLS:   presented %s's certificate; the peer needs mutual_tls on to accept it\n", origin)
+		default:
+			fmt.Fprintln(w, "Mutual TLS:   the peer asked for no certificate and will refuse relayed mail")
+		}
+		if result.Capabilities == nil {
+			fmt.Fprintln(w, "Protocol:     the peer predates HELLO (protocol 1.0)")
+			return
+		}
+		fmt.Fprintf(w, "Protocol:     %s, server %s\n", caps.Version, caps.ServerVersion)
+		fmt.Fprintf(w, "Limits:       %s per message, %d attachments\n", formatSize(caps.Limits.MaxMessageBytes), caps.Limits.MaxAttachments)
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCertificate(t *testing.T, notAfter time.Time, names ...string) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCheckCertificate(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		domain string
+		cert   *tls.Certificate
+		want   []string // substrings, one per warning
+	}{
+		{"good", "example.com", testCertificate(t, now.Add(90*24*time.Hour), "example.com"), nil},
+		{"wrong name", "example.org", testCertificate(t, now.Add(90*24*time.Hour), "example.com"), []string{"example.org"}},
+		{"expiring", "example.com", testCertificate(t, now.Add(10*24*time.Hour), "example.com"), []string{"expires on"}},
+		{"expired", "example.com", testCertificate(t, now.Add(-time.Hour), "example.com"), []string{"expired on"}},
+		{"unreadable", "example.com", &tls.Certificate{Certificate: [][]byte{[]byte("junk")}}, []string{"unreadable certificate"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := checkCertificate(tt.domain, tt.cert)
+			if len(got) != len(tt.want) {
+				t.Fatalf("warnings = %q, want %d", got, len(tt.want))
+			}
+			for i, w := range tt.want {
+				if !strings.Contains(got[i], w) {
+					t.Errorf("warning %q does not mention %q", got[i], w)
+				}
+			}
+		})
+	}
+}
+
+func TestFormatTime(t *testing.T) {
+	if got := formatTime(time.Time{}); got != "-" {
+		t.Errorf("formatTime(zero) = %q, want -", got)
+	}
+	at := time.Date(2026, 10, 19, 8, 30, 0, 0, time.Local)
+	if got := formatTime(at); got != "2026-10-19 08:30" {
+		t.Errorf("formatTime() = %q", got)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// listFlag collects a flag given more than once.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, strings.ToLower(v))
+	return nil
+}
+
+type tlsKeyView struct {
+	Domains  []string  `json:"domains"`
+	CertFile string    `json:"certFile"`
+	KeyFile  string    `json:"keyFile"`
+	NotAfter time.Time `json:"notAfter"`
+}
+
+// runKeygenTLS writes a self-signed certificate, for a test server or for
+// federation peers that trust each other through federation.ca_file.
+func runKeygenTLS(a *app, args []string) error {
+	fs := a.flags("keygen tls", "-domain D [-out prefix] [-days N]")
+	var domains listFlag
+	fs.Var(&domains, "domain", "`name` the certificate is for; repeat for more")
+	out := fs.String("out", "", "write `prefix`.crt and prefix.key; default the first domain")
+	days := fs.Int("days", 365, "valid for `N` days")
+	force := fs.Bool("force", false, "overwrite existing files")
+	parse(fs, args, 0, 0)
+	if len(domains) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *days <= 0 {
+		return fmt.Errorf("-days must be positive")
+	}
+	if *out == "" {
+		*out = domains[0]
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: domains[0]},
+		DNSNames:     domains,
+		NotBefore:    now.Add(-time.Hour), // tolerate clocks a little behind
+		NotAfter:     now.AddDate(0, 0, *days),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		// Client authentication too, so the certificate can relay.
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	v := tlsKeyView{Domains: domains, CertFile: *out + ".crt", KeyFile: *out + ".key", NotAfter: tmpl.NotAfter}
+	if _, err := os.Stat(v.CertFile); err == nil && !*force {
+		return fmt.Errorf("%s exists; use -force to replace it", v.CertFile)
+	}
+	if err := writePEM(v.KeyFile, "PRIVATE KEY", keyDER, 0o600, *force); err != nil {
+		return err
+	}
+	if err := writePEM(v.CertFile, "CERTIFICATE", der, 0o644, *force); err != nil {
+		return err
+	}
+	return a.print(v, func(w io.Writer) {
+		fmt.Fprintf(w, "Wrote %s and %s for %s, valid until %s.\n\n", v.CertFile, v.KeyFile, strings.Join(domains, ", "), formatTime(v.NotAfter))
+		fmt.Fprintf(w, "In quill.yaml, under tls or the domain:\n  cert_file: %s\n  key_file: %s\n", v.CertFile, v.KeyFile)
+		fmt.Fprintf(w, "Peers relaying with this server add %s to their federation ca_file.\n", v.CertFile)
+	})
+}
+
+type dkimKeyView struct {
+	Domain   string `json:"domain"`
+	Selector string `json:"selector"`
+	KeyFile  string `json:"keyFile"`
+	// Record is the TXT record to publish at Name.
+	Name   string `json:"name"`
+	Record string `json:"record"`
+}
+
+// runKeygenDKIM writes an RSA key for signing a domain's outbound email and
+// prints the DNS record publishing its public half.
+func runKeygenDKIM(a *app, args []string) error {
+	fs := a.flags("keygen dkim", "-domain D [-selector S] [-bits N] [-out file]")
+	domainName := fs.String("domain", "", "the sending `domain`")
+	selector := fs.String("selector", "quill", "DKIM `selector`, the record's name under _domainkey")
+	bits := fs.Int("bits", 2048, "RSA key size in `bits`")
+	out := fs.String("out", "", "key `file`; default <domain>.<selector>.dkim.key")
+	force := fs.Bool("force", false, "overwrite an existing file")
+	parse(fs, args, 0, 0)
+	if *domainName == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *bits < 1024 {
+		return fmt.Errorf("-bits must be at least 1024; receivers ignore shorter DKIM keys")
+	}
+	v := dkimKeyView{Domain: strings.ToLower(*domainName), Selector: *selector, KeyFile: *out}
+	if v.KeyFile == "" {
+		v.KeyFile = fmt.Sprintf("%s.%s.dkim.key", v.Domain, v.Selector)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, *bits)
+	if err != nil {
+		return err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(v.KeyFile, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), 0o600, *force); err != nil {
+		return err
+	}
+	v.Name = fmt.Sprintf("%s._domainkey.%s", v.Selector, v.Domain)
+	v.Record = "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)
+
+	return a.print(v, func(w io.Writer) {
+		fmt.Fprintf(w, "Wrote %s.\n\nPublish in DNS:\n  %s. IN TXT %s\n\n", v.KeyFile, v.Name, txtStrings(v.Record))
+		fmt.Fprintf(w, "In quill.yaml, under the domain %s:\n  dkim_selector: %s\n  dkim_key_file: %s\n", v.Domain, v.Selector, v.KeyFile)
+	})
+}
+
+// txtStrings quotes a TXT record value, split into the 255-byte strings DNS
+// allows.
+func txtStrings(s string) string {
+	var parts []string
+	for len(s) > 255 {
+		parts = append(parts, `"`+s[:255]+`"`)
+		s = s[255:]
+	}
+	parts = append(parts, `"`+s+`"`)
+	return "( " + strings.Join(parts, " ") + " )"
+}
+
+// writePEM writes a single PEM block, refusing to replace a file unless
+// force is set.
+func writePEM(path, blockType string, der []byte, mode os.FileMode, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !force {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(path, flags, mode)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s exists; use -force to replace it", path)
+	}
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
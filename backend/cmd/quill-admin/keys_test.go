@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTXTStrings(t *testing.T) {
+	long := strings.Repeat("a", 255) + strings.Repeat("b", 10)
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"short", "v=DKIM1; p=abc", `( "v=DKIM1; p=abc" )`},
+		{"exactly 255", strings.Repeat("a", 255), `( "` + strings.Repeat("a", 255) + `" )`},
+		{"split", long, `( "` + strings.Repeat("a", 255) + `" "bbbbbbbbbb" )`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := txtStrings(tt.in); got != tt.want {
+				t.Errorf("txtStrings() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWritePEM(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := writePEM(path, "PRIVATE KEY", []byte("first"), 0o600, false); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("mode = %o, want 600", perm)
+	}
+
+	if err := writePEM(path, "PRIVATE KEY", []byte("second"), 0o600, false); err == nil || !strings.Contains(err.Error(), "-force") {
+		t.Errorf("overwrite without force = %v, want a refusal", err)
+	}
+	if err := writePEM(path, "PRIVATE KEY", []byte("second"), 0o600, true); err != nil {
+		t.Fatalf("overwrite with force: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	block, rest := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" || string(block.Bytes) != "second" || len(rest) != 0 {
+		t.Errorf("file holds %q", data)
+	}
+
+	if err := writePEM(filepath.Join(path, "nested"), "CERTIFICATE", nil, 0o644, true); err == nil {
+		t.Error("writePEM into a file succeeded")
+	}
+}
+
+func TestListFlagLowercases(t *testing.T) {
+	var l listFlag
+	l.Set("Example.COM")
+	l.Set("mail.example.com")
+	if got := l.String(); got != "example.com,mail.example.com" {
+		t.Errorf("listFlag = %q", got)
+	}
+}
@@ -0,0 +1,257 @@
+// Command quill-admin operates a Quill server: accounts and aliases, the
+// outbound queue, messages and mailboxes, database migrations, the
+// configuration, federation peers and keys.
+//
+//	quill-admin -config /etc/quill/quill.yaml user create -address ada~example.com
+//	quill-admin queue list -status failed
+//	quill-admin peer test example.org
+//	quill-admin keygen dkim -domain example.com
+//
+// It reads the server's configuration and works on its database directly,
+// so it runs on the server host, or anywhere the database is reachable.
+// Changes are recorded in the audit log as made by local:<OS user>.
+// Every command takes -json to print JSON instead of text.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"quill/pkg/config"
+	"quill/pkg/db"
+	"quill/pkg/domain"
+	"quill/pkg/hosting"
+	"quill/pkg/identity"
+)
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(a *app, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"user list", "[-q prefix] [-suspended | -active] [-limit N] [-offset N]", "list accounts", runUserList},
+		{"user show", "<id|address>", "show an account", runUserShow},
+		{"user create", "-address A [-id ID] [-email E] [-admin]", "create an account", runUserCreate},
+		{"user update", "[-address A] [-email E] <id|address>", "change an account's address or email", runUserUpdate},
+		{"user delete", "-yes <id|address>", "delete an account and its mail at once", runUserDelete},
+		{"user suspend", "[-reason R] <id|address>", "block sign-in", runUserSuspend},
+		{"user unsuspend", "<id|address>", "allow sign-in again", runUserUnsuspend},
+		{"user roles", "<id|address> [role...]", "set an account's roles", runUserRoles},
+		{"user quota", "<id|address> <size>", "set the storage quota, e.g. 5G; 0 is the default", runUserQuota},
+		{"user reset", "<id|address>", "revoke every API key and app password", runUserReset},
+		{"alias list", "[<id|address>]", "list aliases, of one account or all", runAliasList},
+		{"alias add", "<id|address> <alias>", "deliver mail for another address to an account", runAliasAdd},
+		{"alias remove", "<alias>", "remove an alias", runAliasRemove},
+		{"audit", "[-target id|address] [-limit N]", "show the audit log", runAudit},
+		{"queue list", "[-status S] [-domain D] [-limit N]", "list outbound email", runQueueList},
+		{"queue retry", "[-status S] [-domain D] [id...]", "deliver queued or failed email now", runQueueRetry},
+		{"queue purge", "[-status S] [-domain D] [-all] [id...]", "drop outbound email", runQueuePurge},
+		{"message", "<message-id>", "find a message in every mailbox and the queue", runMessage},
+		{"reindex", "[-uids] <address>...", "recount a mailbox, optionally renumbering IMAP UIDs", runReindex},
+		{"migrate", "[-status]", "run pending database migrations", runMigrate},
+		{"config check", "[-db]", "validate the configuration and load its files", runConfigCheck},
+		{"peer test", "[-from domain] <domain>", "connect to a federation peer as a relay would", runPeerTest},
+		{"keygen tls", "-domain D [-out prefix] [-days N]", "generate a self-signed TLS certificate", runKeygenTLS},
+		{"keygen dkim", "-domain D [-selector S] [-bits N] [-out file]", "generate a DKIM key and its DNS record", runKeygenDKIM},
+	}
+}
+
+func main() {
+	a := &app{out: os.Stdout}
+	flag.StringVar(&a.configPath, "config", envOr("QUILL_CONFIG", "quill.yaml"), "path to the server's YAML configuration file")
+	flag.StringVar(&a.envPath, "env", "../.env", "path to the server's .env file")
+	flag.BoolVar(&a.json, "json", false, "print JSON instead of text")
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 || args[0] == "help" {
+		usage()
+		os.Exit(2)
+	}
+
+	// Commands are one or two words.
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(args) < len(words) || strings.Join(args[:len(words)], " ") != cmd.name {
+			continue
+		}
+		err := cmd.run(a, args[len(words):])
+		a.close()
+		if err != nil {
+			a.fail(err)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "quill-admin: unknown command %q\n", strings.Join(args, " "))
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: quill-admin [-config file] [-env file] [-json] <command> [flags] [args]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-15s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun quill-admin <command> -h for the flags of a command.\n")
+}
+
+// app is what the commands share: the configuration, the store and how to
+// print.
+type app struct {
+	configPath, envPath string
+	json                bool
+	out                 io.Writer
+
+	cfg   *config.Config
+	db    *db.MongoDB
+	hosts *hosting.Registry
+	msgs  *domain.MongoMessageService
+	users *domain.MongoUserService
+}
+
+// flags returns a flag set for a command, with -json.
+func (a *app) flags(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.BoolVar(&a.json, "json", a.json, "print JSON instead of text")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: quill-admin %s %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses args and checks the number of positional arguments, exiting
+// with the usage on a mismatch. max < 0 means no limit.
+func parse(fs *flag.FlagSet, args []string, min, max int) {
+	_ = fs.Parse(args)
+	if fs.NArg() < min || (max >= 0 && fs.NArg() > max) {
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+func (a *app) config() (*config.Config, error) {
+	if a.cfg == nil {
+		cfg, err := config.Load(a.configPath, a.envPath)
+		if err != nil {
+			return nil, err
+		}
+		a.cfg = cfg
+	}
+	return a.cfg, nil
+}
+
+// open connects to the store the configuration names.
+func (a *app) open() error {
+	if a.db != nil {
+		return nil
+	}
+	cfg, err := a.config()
+	if err != nil {
+		return err
+	}
+	hosts, err := hosting.NewRegistry(hosting.FromConfig(cfg.Domains)...)
+	if err != nil {
+		return err
+	}
+	mongoDB, err := db.NewMongoDB(db.MongoConfig{
+		URI:      cfg.Storage.ConnectionURI(),
+		Database: cfg.Storage.Database,
+		Timeout:  cfg.Storage.Timeout,
+	})
+	if err != nil {
+		return fmt.Errorf("connecting to %s: %w", cfg.Storage.Database, err)
+	}
+	a.db = mongoDB
+	a.hosts = hosts
+	a.msgs = domain.NewMongoMessageService(mongoDB.GetDatabase(), hosts)
+	a.users = domain.NewMongoUserService(mongoDB.GetDatabase(), cfg.ExportDir, hosts)
+	return nil
+}
+
+func (a *app) close() {
+	if a.db != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = a.db.Close(ctx)
+	}
+}
+
+// ctx is the context commands run in: an admin principal naming the OS
+// user, for the audit log.
+func (a *app) ctx() context.Context {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	return identity.WithPrincipal(context.Background(), &identity.Principal{
+		AccountID: "local:" + name,
+		Roles:     []string{identity.RoleUser, identity.RoleAdmin},
+		Method:    identity.AuthMethodLocal,
+	})
+}
+
+// print writes v as JSON, or calls text to describe it.
+func (a *app) print(v interface{}, text func(w io.Writer)) error {
+	if a.json {
+		enc := json.NewEncoder(a.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	text(a.out)
+	return nil
+}
+
+// table writes rows under a header, in aligned columns.
+func table(w io.Writer, header string, rows [][]string) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, header)
+	for _, r := range rows {
+		fmt.Fprintln(tw, strings.Join(r, "\t"))
+	}
+	_ = tw.Flush()
+}
+
+// fail reports err and exits.
+func (a *app) fail(err error) {
+	if a.json {
+		_ = json.NewEncoder(os.Stderr).Encode(map[string]string{"error": err.Error()})
+	} else {
+		fmt.Fprintln(os.Stderr, "quill-admin:", err)
+	}
+	os.Exit(1)
+}
+
+// liveSessions warns that a change made in the store does not reach the
+// sessions the server already holds.
+func liveSessions() {
+	fmt.Fprintln(os.Stderr, "note: sessions open on the server last until they expire; the admin API ends them at once")
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+func envOr(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
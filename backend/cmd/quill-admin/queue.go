@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"quill/pkg/domain"
+)
+
+// outboundView is a queue entry without the message itself.
+type outboundView struct {
+	ID          string    `json:"id"`
+	MessageID   string    `json:"messageId"`
+	Sender      string    `json:"sender"`
+	Domain      string    `json:"domain"`
+	Recipients  []string  `json:"recipients"`
+	Subject     string    `json:"subject"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+func newOutboundView(o *domain.OutboundMessage) outboundView {
+	return outboundView{
+		ID:          o.ID.Hex(),
+		MessageID:   o.MessageID,
+		Sender:      o.Sender(),
+		Domain:      o.Domain,
+		Recipients:  o.Recipients,
+		Subject:     o.Request.Subject,
+		Status:      string(o.Status),
+		Attempts:    o.Attempts,
+		NextAttempt: o.NextAttempt,
+		LastError:   o.LastError,
+		CreatedAt:   o.CreatedAt,
+	}
+}
+
+// queueFlags adds the filters shared by the queue commands.
+func queueFlags(fs *flag.FlagSet, q *domain.OutboundQuery) *string {
+	status := fs.String("status", "", "only entries that are `queued`, sending or failed")
+	fs.StringVar(&q.Domain, "domain", "", "only entries for this recipient `domain`")
+	return status
+}
+
+// queueQuery completes q from the status flag and the entry IDs given as
+// arguments.
+func queueQuery(fs *flag.FlagSet, q *domain.OutboundQuery, status string) error {
+	switch s := domain.OutboundStatus(status); s {
+	case "", domain.OutboundStatusQueued, domain.OutboundStatusSending, domain.OutboundStatusFailed:
+		q.Status = s
+	default:
+		return fmt.Errorf("unknown status %q", status)
+	}
+	for _, arg := range fs.Args() {
+		id, err := primitive.ObjectIDFromHex(arg)
+		if err != nil {
+			return fmt.Errorf("%q is not a queue entry ID", arg)
+		}
+		q.IDs = append(q.IDs, id)
+	}
+	return nil
+}
+
+func runQueueList(a *app, args []string) error {
+	fs := a.flags("queue list", "[-status S] [-domain D] [-limit N]")
+	var q domain.OutboundQuery
+	status := queueFlags(fs, &q)
+	fs.IntVar(&q.Limit, "limit", 100, "at most `N` entries, those due first")
+	parse(fs, args, 0, 0)
+	if err := queueQuery(fs, &q, *status); err != nil {
+		return err
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+
+	msgs, total, err := a.msgs.ListOutbound(a.ctx(), q)
+	if err != nil {
+		return err
+	}
+	views := make([]outboundView, len(msgs))
+	for i := range msgs {
+		views[i] = newOutboundView(&msgs[i])
+	}
+	return a.print(map[string]interface{}{"entries": views, "total": total}, func(w io.Writer) {
+		rows := make([][]string, len(views))
+		for i, v := range views {
+			next := formatTime(v.NextAttempt)
+			if v.Status == string(domain.OutboundStatusFailed) {
+				next = "-"
+			}
+			rows[i] = []string{v.ID, v.Status, strconv.Itoa(v.Attempts), next, v.Sender,
+				strings.Join(v.Recipients, ","), truncate(v.LastError, 60)}
+		}
+		table(w, "ID\tSTATUS\tTRIES\tNEXT\tFROM\tTO\tLAST ERROR", rows)
+		if len(views) < total {
+			fmt.Fprintf(w, "Showing %d of %d.\n", len(views), total)
+		}
+	})
+}
+
+func runQueueRetry(a *app, args []string) error {
+	fs := a.flags("queue retry", "[-status S] [-domain D] [id...]")
+	var q domain.OutboundQuery
+	status := queueFlags(fs, &q)
+	parse(fs, args, 0, -1)
+	if err := queueQuery(fs, &q, *status); err != nil {
+		return err
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+
+	n, err := a.msgs.RetryOutbound(a.ctx(), q)
+	if err != nil {
+		return err
+	}
+	return a.print(map[string]int{"retried": n}, func(w io.Writer) {
+		fmt.Fprintf(w, "%d entr%s due now\n", n, plural(n, "y", "ies"))
+	})
+}
+
+var errNoFilter = errors.New("give entry IDs, -status or -domain, or -all for the whole queue")
+
+func runQueuePurge(a *app, args []string) error {
+	fs := a.flags("queue purge", "[-status S] [-domain D] [-all] [id...]")
+	var q domain.OutboundQuery
+	status := queueFlags(fs, &q)
+	all := fs.Bool("all", false, "purge the whole queue")
+	parse(fs, args, 0, -1)
+	if err := queueQuery(fs, &q, *status); err != nil {
+		return err
+	}
+	if len(q.IDs) == 0 && q.Status == "" && q.Domain == "" && !*all {
+		return errNoFilter
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+
+	n, err := a.msgs.PurgeOutbound(a.ctx(), q)
+	if err != nil {
+		return err
+	}
+	return a.print(map[string]int{"purged": n}, func(w io.Writer) {
+		fmt.Fprintf(w, "Purged %d entr%s; their senders are not notified\n", n, plural(n, "y", "ies"))
+	})
+}
+
+func truncate(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
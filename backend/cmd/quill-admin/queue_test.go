@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"quill/pkg/domain"
+)
+
+func TestQueueQuery(t *testing.T) {
+	id := primitive.NewObjectID()
+	tests := []struct {
+		name   string
+		status string
+		args   []string
+		want   domain.OutboundQuery
+		ok     bool
+	}{
+		{"everything", "", nil, domain.OutboundQuery{}, true},
+		{"failed entries", "failed", nil, domain.OutboundQuery{Status: domain.OutboundStatusFailed}, true},
+		{"by id", "queued", []string{id.Hex()}, domain.OutboundQuery{Status: domain.OutboundStatusQueued, IDs: []primitive.ObjectID{id}}, true},
+		{"unknown status", "sent", nil, domain.OutboundQuery{}, false},
+		{"bad id", "", []string{"m1"}, domain.OutboundQuery{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("queue", flag.ContinueOnError)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			var q domain.OutboundQuery
+			err := queueQuery(fs, &q, tt.status)
+			if (err == nil) != tt.ok {
+				t.Fatalf("queueQuery() = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && !reflect.DeepEqual(q, tt.want) {
+				t.Errorf("query = %+v, want %+v", q, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"line one\n  line two", 40, "line one line two"},
+		{"a long subject line", 10, "a long ..."},
+	}
+	for _, tt := range tests {
+		if got := truncate(tt.in, tt.n); got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.in, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestPlural(t *testing.T) {
+	for n, want := range map[int]string{0: "ies", 1: "y", 2: "ies"} {
+		if got := plural(n, "y", "ies"); got != want {
+			t.Errorf("plural(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"quill/pkg/db"
+	"quill/pkg/domain"
+)
+
+type messageView struct {
+	MessageID   string         `json:"messageId"`
+	ThreadID    string         `json:"threadId,omitempty"`
+	From        string         `json:"from,omitempty"`
+	To          []string       `json:"to,omitempty"`
+	CC          []string       `json:"cc,omitempty"`
+	Subject     string         `json:"subject,omitempty"`
+	SentAt      time.Time      `json:"sentAt,omitempty"`
+	Attachments int            `json:"attachments"`
+	Stored      bool           `json:"stored"` // false when the message document is gone
+	Copies      []copyView     `json:"copies"`
+	Outbound    []outboundView `json:"outbound"`
+}
+
+type copyView struct {
+	Owner      string    `json:"owner"`
+	Folder     string    `json:"folder"`
+	Labels     []string  `json:"labels,omitempty"`
+	Flags      []string  `json:"flags,omitempty"`
+	Read       bool      `json:"read"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+func runMessage(a *app, args []string) error {
+	fs := a.flags("message", "<message-id>")
+	parse(fs, args, 1, 1)
+	if err := a.open(); err != nil {
+		return err
+	}
+	found, err := a.msgs.LookupMessage(a.ctx(), fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	v := messageView{MessageID: fs.Arg(0), Copies: []copyView{}, Outbound: []outboundView{}}
+	if m := found.Message; m != nil {
+		v.Stored = true
+		v.ThreadID, v.From, v.To, v.CC = m.ThreadID, m.From, m.To, m.CC
+		v.Subject, v.SentAt, v.Attachments = m.Subject, m.SentAt, len(m.Attachments)
+	}
+	for _, c := range found.Copies {
+		v.Copies = append(v.Copies, copyView(c))
+	}
+	for i := range found.Outbound {
+		v.Outbound = append(v.Outbound, newOutboundView(&found.Outbound[i]))
+	}
+
+	return a.print(v, func(w io.Writer) {
+		if !v.Stored {
+			fmt.Fprintf(w, "Message %s: the message itself is gone; entries remain\n", v.MessageID)
+		} else {
+			fmt.Fprintf(w, "Message:  %s (thread %s)\n", v.MessageID, v.ThreadID)
+			fmt.Fprintf(w, "From:     %s\n", v.From)
+			fmt.Fprintf(w, "To:       %s\n", strings.Join(v.To, ", "))
+			if len(v.CC) > 0 {
+				fmt.Fprintf(w, "Cc:       %s\n", strings.Join(v.CC, ", "))
+			}
+			fmt.Fprintf(w, "Subject:  %s\n", v.Subject)
+			fmt.Fprintf(w, "Sent:     %s\n", formatTime(v.SentAt))
+			if v.Attachments > 0 {
+				fmt.Fprintf(w, "Files:    %d attachment(s)\n", v.Attachments)
+			}
+		}
+		if len(v.Copies) > 0 {
+			fmt.Fprintln(w)
+			rows := make([][]string, len(v.Copies))
+			for i, c := range v.Copies {
+				read := "unread"
+				if c.Read {
+					read = "read"
+				}
+				rows[i] = []string{c.Owner, c.Folder, strings.Join(c.Labels, ","), read, formatTime(c.ReceivedAt)}
+			}
+			table(w, "MAILBOX\tFOLDER\tLABELS\tSTATE\tRECEIVED", rows)
+		}
+		if len(v.Outbound) > 0 {
+			fmt.Fprintln(w)
+			rows := make([][]string, len(v.Outbound))
+			for i, o := range v.Outbound {
+				rows[i] = []string{o.ID, o.Domain, o.Status, strconv.Itoa(o.Attempts), truncate(o.LastError, 60)}
+			}
+			table(w, "QUEUED\tDOMAIN\tSTATUS\tTRIES\tLAST ERROR", rows)
+		}
+	})
+}
+
+func runReindex(a *app, args []string) error {
+	fs := a.flags("reindex", "[-uids] <address>...")
+	uids := fs.Bool("uids", false, "also renumber IMAP UIDs; clients download the mailbox again")
+	parse(fs, args, 1, -1)
+	if err := a.open(); err != nil {
+		return err
+	}
+
+	ctx := a.ctx()
+	var results []domain.MailboxReindex
+	for _, addr := range fs.Args() {
+		r, err := a.msgs.ReindexMailbox(ctx, strings.ToLower(addr), *uids)
+		if err != nil {
+			return fmt.Errorf("%s: %w", addr, err)
+		}
+		results = append(results, r)
+	}
+	return a.print(results, func(w io.Writer) {
+		for _, r := range results {
+			fmt.Fprintf(w, "%s: %d message(s), %s", r.Address, r.Messages, formatSize(r.Bytes))
+			if *uids {
+				fmt.Fprintf(w, ", %d UID(s) dropped", r.Renumbered)
+			}
+			fmt.Fprintln(w)
+		}
+	})
+}
+
+type migrationView struct {
+	ID          int       `json:"id"`
+	Description string    `json:"description"`
+	AppliedAt   time.Time `json:"appliedAt,omitempty"`
+}
+
+func runMigrate(a *app, args []string) error {
+	fs := a.flags("migrate", "[-status]")
+	status := fs.Bool("status", false, "list applied and pending migrations without running any")
+	parse(fs, args, 0, 0)
+	if err := a.open(); err != nil {
+		return err
+	}
+	ctx := a.ctx()
+
+	if *status {
+		applied, err := a.db.AppliedMigrations(ctx)
+		if err != nil {
+			return err
+		}
+		pending, err := a.db.PendingMigrations(ctx)
+		if err != nil {
+			return err
+		}
+		out := struct {
+			Applied []migrationView `json:"applied"`
+			Pending []migrationView `json:"pending"`
+		}{[]migrationView{}, migrationViews(pending)}
+		for _, m := range applied {
+			out.Applied = append(out.Applied, migrationView(m))
+		}
+		return a.print(out, func(w io.Writer) {
+			rows := make([][]string, 0, len(out.Applied)+len(out.Pending))
+			for _, m := range out.Applied {
+				rows = append(rows, []string{strconv.Itoa(m.ID), m.Description, formatTime(m.AppliedAt)})
+			}
+			for _, m := range out.Pending {
+				rows = append(rows, []string{strconv.Itoa(m.ID), m.Description, "pending"})
+			}
+			table(w, "ID\tMIGRATION\tAPPLIED", rows)
+		})
+	}
+
+	applied, err := a.db.Migrate(ctx)
+	// Report what did run even when a later migration failed.
+	for _, m := range applied {
+		if !a.json {
+			fmt.Fprintf(a.out, "Applied %d: %s\n", m.ID, m.Description)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return a.print(map[string]interface{}{"applied": migrationViews(applied)}, func(w io.Writer) {
+		if len(applied) == 0 {
+			fmt.Fprintln(w, "The database is up to date")
+		}
+	})
+}
+
+func migrationViews(ms []db.Migration) []migrationView {
+	views := make([]migrationView, len(ms))
+	for i, m := range ms {
+		views[i] = migrationView{ID: m.ID, Description: m.Description}
+	}
+	return views
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"quill/pkg/domain"
+	"quill/pkg/identity"
+	"quill/pkg/models"
+)
+
+// user finds an account by ID or by Quill address.
+func (a *app) user(ctx context.Context, ref string) (*models.User, error) {
+	if !strings.Contains(ref, "~") {
+		return a.users.GetUser(ctx, ref)
+	}
+	addr := strings.ToLower(ref)
+	users, _, err := a.users.ListUsers(ctx, domain.UserQuery{Search: addr, Limit: 10})
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		if users[i].UserQuillMail == addr {
+			return &users[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", domain.ErrUserNotFound, ref)
+}
+
+// userArg opens the store and finds the account named by the first
+// argument.
+func (a *app) userArg(ctx context.Context, ref string) (*models.User, error) {
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a.user(ctx, ref)
+}
+
+func userStatus(u *models.User) string {
+	switch {
+	case u.Suspended:
+		return "suspended"
+	case !u.DeleteAfter.IsZero():
+		return "deleting " + u.DeleteAfter.Local().Format("2006-01-02")
+	}
+	return "active"
+}
+
+func (a *app) printUser(u *models.User) error {
+	return a.print(u, func(w io.Writer) {
+		fmt.Fprintf(w, "ID:       %s\n", u.UsersUID)
+		fmt.Fprintf(w, "Address:  %s\n", u.UserQuillMail)
+		if u.UserEmail != "" {
+			fmt.Fprintf(w, "Email:    %s\n", u.UserEmail)
+		}
+		if u.DisplayName != "" {
+			fmt.Fprintf(w, "Name:     %s\n", u.DisplayName)
+		}
+		fmt.Fprintf(w, "Roles:    %s\n", strings.Join(append([]string{identity.RoleUser}, u.Roles...), ", "))
+		fmt.Fprintf(w, "Status:   %s\n", userStatus(u))
+		if u.Suspended && u.SuspendReason != "" {
+			fmt.Fprintf(w, "Reason:   %s\n", u.SuspendReason)
+		}
+		quota := "server default"
+		if u.QuotaBytes > 0 {
+			quota = formatSize(u.QuotaBytes)
+		}
+		fmt.Fprintf(w, "Quota:    %s\n", quota)
+		fmt.Fprintf(w, "Created:  %s\n", formatTime(u.CreatedAt))
+		fmt.Fprintf(w, "Login:    %s\n", formatTime(u.LastLogin))
+	})
+}
+
+func runUserList(a *app, args []string) error {
+	fs := a.flags("user list", "[-q prefix] [-suspended | -active] [-limit N] [-offset N]")
+	var q domain.UserQuery
+	fs.StringVar(&q.Search, "q", "", "only addresses or emails starting with `prefix`")
+	suspended := fs.Bool("suspended", false, "only suspended accounts")
+	active := fs.Bool("active", false, "only accounts that are not suspended")
+	fs.IntVar(&q.Limit, "limit", 50, "at most `N` accounts")
+	fs.IntVar(&q.Offset, "offset", 0, "skip the first `N` accounts")
+	parse(fs, args, 0, 0)
+	if *suspended || *active {
+		q.Suspended = suspended
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+
+	users, total, err := a.users.ListUsers(a.ctx(), q)
+	if err != nil {
+		return err
+	}
+	if users == nil {
+		users = []models.User{}
+	}
+	return a.print(map[string]interface{}{"users": users, "total": total}, func(w io.Writer) {
+		rows := make([][]string, len(users))
+		for i := range users {
+			u := &users[i]
+			rows[i] = []string{u.UsersUID, u.UserQuillMail, u.UserEmail, strings.Join(u.Roles, ","), userStatus(u), formatTime(u.CreatedAt)}
+		}
+		table(w, "ID\tADDRESS\tEMAIL\tROLES\tSTATUS\tCREATED", rows)
+		if q.Offset+len(users) < total {
+			fmt.Fprintf(w, "Showing %d-%d of %d; use -offset %d for more.\n", q.Offset+1, q.Offset+len(users), total, q.Offset+len(users))
+		}
+	})
+}
+
+func runUserShow(a *app, args []string) error {
+	fs := a.flags("user show", "<id|address>")
+	parse(fs, args, 1, 1)
+	u, err := a.userArg(a.ctx(), fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return a.printUser(u)
+}
+
+func runUserCreate(a *app, args []string) error {
+	fs := a.flags("user create", "-address A [-id ID] [-email E] [-admin]")
+	var u models.User
+	fs.StringVar(&u.UserQuillMail, "address", "", "the account's Quill `address`, name~domain")
+	fs.StringVar(&u.UsersUID, "id", "", "account `ID`: the Firebase UID or JWT subject it signs in as; empty generates one")
+	fs.StringVar(&u.UserEmail, "email", "", "contact `email`")
+	admin := fs.Bool("admin", false, "grant the admin role")
+	parse(fs, args, 0, 0)
+	if u.UserQuillMail == "" {
+		fs.Usage()
+		return errors.New("-address is required")
+	}
+	if *admin {
+		u.Roles = []string{identity.RoleAdmin}
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+
+	created, err := a.users.AdminCreateUser(a.ctx(), u)
+	if err != nil {
+		return err
+	}
+	return a.printUser(created)
+}
+
+func runUserUpdate(a *app, args []string) error {
+	fs := a.flags("user update", "[-address A] [-email E] <id|address>")
+	address := fs.String("address", "", "move the account to this Quill `address`; the old one redirects for 30 days")
+	email := fs.String("email", "", "contact `email`")
+	parse(fs, args, 1, 1)
+	ctx := a.ctx()
+	u, err := a.userArg(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var update domain.UserUpdate
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "address":
+			update.UserQuillMail = address
+		case "email":
+			update.UserEmail = email
+		}
+	})
+	updated, err := a.users.UpdateUser(ctx, u.UsersUID, update)
+	if err != nil {
+		return err
+	}
+	return a.printUser(updated)
+}
+
+func runUserDelete(a *app, args []string) error {
+	fs := a.flags("user delete", "-yes <id|address>")
+	yes := fs.Bool("yes", false, "confirm: the account and its mail are gone for good")
+	parse(fs, args, 1, 1)
+	ctx := a.ctx()
+	u, err := a.userArg(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if !*yes {
+		return fmt.Errorf("add -yes to delete %s (%s) and all its mail", u.UserQuillMail, u.UsersUID)
+	}
+
+	if err := a.users.DeleteUser(ctx, u.UsersUID); err != nil {
+		return err
+	}
+	liveSessions()
+	return a.print(map[string]string{"deleted": u.UsersUID}, func(w io.Writer) {
+		fmt.Fprintf(w, "Deleted %s (%s)\n", u.UserQuillMail, u.UsersUID)
+	})
+}
+
+func runUserSuspend(a *app, args []string) error {
+	fs := a.flags("user suspend", "[-reason R] <id|address>")
+	reason := fs.String("reason", "", "why, for the audit log and the account record")
+	parse(fs, args, 1, 1)
+	return a.setSuspended(fs.Arg(0), true, *reason)
+}
+
+func runUserUnsuspend(a *app, args []string) error {
+	fs := a.flags("user unsuspend", "<id|address>")
+	parse(fs, args, 1, 1)
+	return a.setSuspended(fs.Arg(0), false, "")
+}
+
+func (a *app) setSuspended(ref string, suspended bool, reason string) error {
+	ctx := a.ctx()
+	u, err := a.userArg(ctx, ref)
+	if err != nil {
+		return err
+	}
+	updated, err := a.users.SetSuspended(ctx, u.UsersUID, suspended, reason)
+	if err != nil {
+		return err
+	}
+	if suspended {
+		liveSessions()
+	}
+	return a.printUser(updated)
+}
+
+func runUserRoles(a *app, args []string) error {
+	fs := a.flags("user roles", "<id|address> [role...]")
+	parse(fs, args, 1, -1)
+	ctx := a.ctx()
+	u, err := a.userArg(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	roles := []string{}
+	for _, r := range fs.Args()[1:] {
+		if r != identity.RoleUser { // implicit
+			roles = append(roles, r)
+		}
+	}
+	updated, err := a.users.SetRoles(ctx, u.UsersUID, roles)
+	if err != nil {
+		return err
+	}
+	liveSessions()
+	return a.printUser(updated)
+}
+
+func runUserQuota(a *app, args []string) error {
+	fs := a.flags("user quota", "<id|address> <size>")
+	parse(fs, args, 2, 2)
+	size, err := parseSize(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	ctx := a.ctx()
+	u, err := a.userArg(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	updated, err := a.users.SetQuota(ctx, u.UsersUID, size)
+	if err != nil {
+		return err
+	}
+	return a.printUser(updated)
+}
+
+func runUserReset(a *app, args []string) error {
+	fs := a.flags("user reset", "<id|address>")
+	parse(fs, args, 1, 1)
+	ctx := a.ctx()
+	u, err := a.userArg(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	revoked, err := a.users.ResetCredentials(ctx, u.UsersUID)
+	if err != nil {
+		return err
+	}
+	liveSessions()
+	return a.print(map[string]int{"revoked": revoked}, func(w io.Writer) {
+		fmt.Fprintf(w, "Revoked %d credential(s) of %s\n", revoked, u.UserQuillMail)
+	})
+}
+
+type aliasView struct {
+	Address   string    `json:"address"`
+	Target    string    `json:"target"`
+	Owner     string    `json:"owner"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func newAliasView(r domain.AddressRedirect) aliasView {
+	return aliasView{Address: r.Address, Target: r.Target, Owner: r.Owner, CreatedAt: r.CreatedAt}
+}
+
+func runAliasList(a *app, args []string) error {
+	fs := a.flags("alias list", "[<id|address>]")
+	parse(fs, args, 0, 1)
+	ctx := a.ctx()
+	if err := a.open(); err != nil {
+		return err
+	}
+	var owner string
+	if fs.NArg() == 1 {
+		u, err := a.user(ctx, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		owner = u.UsersUID
+	}
+
+	aliases, err := a.users.ListAliases(ctx, owner)
+	if err != nil {
+		return err
+	}
+	views := make([]aliasView, len(aliases))
+	rows := make([][]string, len(aliases))
+	for i, al := range aliases {
+		views[i] = newAliasView(al)
+		rows[i] = []string{al.Address, al.Target, al.Owner, formatTime(al.CreatedAt)}
+	}
+	return a.print(map[string]interface{}{"aliases": views}, func(w io.Writer) {
+		table(w, "ALIAS\tDELIVERS TO\tACCOUNT\tCREATED", rows)
+	})
+}
+
+func runAliasAdd(a *app, args []string) error {
+	fs := a.flags("alias add", "<id|address> <alias>")
+	parse(fs, args, 2, 2)
+	ctx := a.ctx()
+	u, err := a.userArg(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	alias, err := a.users.AddAlias(ctx, u.UsersUID, fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	return a.print(newAliasView(*alias), func(w io.Writer) {
+		fmt.Fprintf(w, "Mail for %s is delivered to %s\n", alias.Address, alias.Target)
+	})
+}
+
+func runAliasRemove(a *app, args []string) error {
+	fs := a.flags("alias remove", "<alias>")
+	parse(fs, args, 1, 1)
+	if err := a.open(); err != nil {
+		return err
+	}
+	if err := a.users.RemoveAlias(a.ctx(), fs.Arg(0)); err != nil {
+		return err
+	}
+	return a.print(map[string]string{"removed": fs.Arg(0)}, func(w io.Writer) {
+		fmt.Fprintf(w, "Removed alias %s\n", fs.Arg(0))
+	})
+}
+
+func runAudit(a *app, args []string) error {
+	fs := a.flags("audit", "[-target id|address] [-limit N]")
+	target := fs.String("target", "", "only actions on this account")
+	var q domain.AuditQuery
+	fs.IntVar(&q.Limit, "limit", 50, "at most `N` entries, newest first")
+	parse(fs, args, 0, 0)
+	ctx := a.ctx()
+	if err := a.open(); err != nil {
+		return err
+	}
+	if *target != "" {
+		u, err := a.user(ctx, *target)
+		if err != nil {
+			return err
+		}
+		q.Target = u.UsersUID
+	}
+
+	entries, err := a.users.AuditLog(ctx, q)
+	if err != nil {
+		return err
+	}
+	if entries == nil {
+		entries = []domain.AuditEntry{}
+	}
+	return a.print(map[string]interface{}{"entries": entries}, func(w io.Writer) {
+		rows := make([][]string, len(entries))
+		for i, e := range entries {
+			actor := e.Actor
+			if e.ActorAddress != "" {
+				actor = e.ActorAddress
+			}
+			details := ""
+			if len(e.Details) > 0 {
+				details = fmt.Sprint(e.Details)
+			}
+			rows[i] = []string{formatTime(e.At), actor, e.Action, e.Target, details}
+		}
+		table(w, "AT\tBY\tACTION\tTARGET\tDETAILS", rows)
+	})
+}
+
+// parseSize reads a byte count with an optional K, M, G or T suffix, in
+// powers of 1024.
+func parseSize(s string) (int64, error) {
+	units := map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+	num := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := int64(1)
+	if num != "" {
+		if m, ok := units[num[len(num)-1]]; ok {
+			mult = m
+			num = num[:len(num)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
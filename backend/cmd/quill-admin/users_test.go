@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"quill/pkg/models"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"512", 512, true},
+		{"10M", 10 << 20, true},
+		{"1.5k", 1536, true},
+		{" 2GB ", 2 << 30, true},
+		{"1T", 1 << 40, true},
+		{"0", 0, true},
+		{"", 0, false},
+		{"KB", 0, false},
+		{"-1M", 0, false},
+		{"10X", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseSize(tt.in)
+			if (err == nil) != tt.ok {
+				t.Fatalf("parseSize(%q) error = %v, want ok %v", tt.in, err, tt.ok)
+			}
+			if got != tt.want {
+				t.Errorf("parseSize(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1536, "1.5 KiB"},
+		{1 << 20, "1.0 MiB"},
+		{5 << 30, "5.0 GiB"},
+	}
+	for _, tt := range tests {
+		if got := formatSize(tt.n); got != tt.want {
+			t.Errorf("formatSize(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestUserStatus(t *testing.T) {
+	deleteAfter := time.Date(2026, 11, 1, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		name string
+		user models.User
+		want string
+	}{
+		{"active", models.User{}, "active"},
+		{"suspended", models.User{Suspended: true, DeleteAfter: deleteAfter}, "suspended"},
+		{"deleting", models.User{DeleteAfter: deleteAfter}, "deleting 2026-11-01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := userStatus(&tt.user); got != tt.want {
+				t.Errorf("userStatus() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"quill/pkg/domain"
+	"quill/pkg/transport/quill"
+)
+
+func runLogin(a *app, args []string) error {
+	cfg, err := a.config()
+	if err != nil {
+		return err
+	}
+	fs := a.flags("login", "[-addr host:port] [-token T]")
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "`host:port` of the server's Quill listener")
+	token := fs.String("token", "", "API key, app password or identity token; prompted for when empty")
+	fs.StringVar(&cfg.CAFile, "ca", cfg.CAFile, "PEM `file` of the certificate authority to trust")
+	fs.BoolVar(&cfg.Insecure, "insecure", cfg.Insecure, "do not verify the server's certificate")
+	fs.BoolVar(&cfg.Plaintext, "plaintext", cfg.Plaintext, "connect without TLS")
+	_ = fs.Parse(args)
+
+	if *token == "" {
+		fmt.Fprint(os.Stderr, "Token: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return err
+		}
+		*token = strings.TrimSpace(line)
+	}
+	if *token == "" {
+		return errors.New("a token is needed to sign in")
+	}
+	cfg.Token = *token
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+	var resp quill.ProfileResponsePayload
+	if err := c.Do(context.Background(), quill.PacketTypeProfile, quill.ProfilePayload{Action: quill.ProfileActionGet}, &resp); err != nil {
+		return err
+	}
+	cfg.Address = resp.Profile.QuillMail
+	if err := cfg.save(); err != nil {
+		return err
+	}
+	return a.print(resp.Profile, func(w io.Writer) {
+		fmt.Fprintf(w, "Signed in to %s as %s\n", cfg.Addr, cfg.Address)
+	})
+}
+
+func runLogout(a *app, args []string) error {
+	_ = a.flags("logout", "").Parse(args)
+	cfg, err := a.config()
+	if err != nil {
+		return err
+	}
+	cfg.Token, cfg.Address = "", ""
+	if err := cfg.save(); err != nil {
+		return err
+	}
+	return a.print(map[string]string{"status": quill.StatusOK}, func(w io.Writer) {
+		fmt.Fprintln(w, "Signed out")
+	})
+}
+
+func runFolders(a *app, args []string) error {
+	_ = a.flags("folders", "").Parse(args)
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+	var resp quill.ListFoldersResponsePayload
+	if err := c.Do(context.Background(), quill.PacketTypeListFolders, nil, &resp); err != nil {
+		return err
+	}
+	return a.print(resp, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "FOLDER\tUNREAD\tTOTAL")
+		for _, f := range resp.Folders {
+			fmt.Fprintf(tw, "%s\t%d\t%d\n", f.Path, f.Unread, f.Total)
+		}
+		if len(resp.Labels) > 0 {
+			fmt.Fprintln(tw, "\nLABEL\tUNREAD\tTOTAL")
+			for _, l := range resp.Labels {
+				fmt.Fprintf(tw, "%s\t%d\t%d\n", l.Path, l.Unread, l.Total)
+			}
+		}
+		_ = tw.Flush()
+	})
+}
+
+// fetchFlags adds the flags that choose what to list.
+func fetchFlags(fs *flag.FlagSet, req *quill.FetchPayload, limit int) {
+	fs.StringVar(&req.Folder, "folder", string(domain.FolderInbox), "folder to list")
+	fs.StringVar(&req.Label, "label", "", "label to list instead of a folder")
+	fs.IntVar(&req.Limit, "limit", limit, "number of messages")
+}
+
+func (a *app) fetchList(req *quill.FetchPayload) (*quill.FetchResponsePayload, error) {
+	req.Mode = string(domain.FetchModeFolder)
+	if req.Label != "" {
+		req.Mode = string(domain.FetchModeLabel)
+	}
+	c, err := a.client()
+	if err != nil {
+		return nil, err
+	}
+	return c.Fetch(context.Background(), req)
+}
+
+func runList(a *app, args []string) error {
+	var req quill.FetchPayload
+	fs := a.flags("list", "[-folder F | -label L] [-limit N] [-cursor C]")
+	fetchFlags(fs, &req, 20)
+	fs.StringVar(&req.Cursor, "cursor", "", "continue after a previous page")
+	_ = fs.Parse(args)
+
+	resp, err := a.fetchList(&req)
+	if err != nil {
+		return err
+	}
+	return a.print(resp, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, " \tID\tDATE\tFROM\tSUBJECT")
+		for _, m := range resp.Messages {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", marker(m), m.MessageID, formatTime(m.SentAt), m.From, m.Subject)
+		}
+		_ = tw.Flush()
+		if resp.NextCursor != "" {
+			fmt.Fprintf(w, "\nMore: quillctl list -cursor %s\n", resp.NextCursor)
+		}
+	})
+}
+
+// threadSummary describes a conversation by its newest message.
+type threadSummary struct {
+	ThreadID string           `json:"thread_id"`
+	Subject  string           `json:"subject"`
+	Messages int              `json:"messages"`
+	Unread   int              `json:"unread"`
+	Latest   quill.MessageDTO `json:"latest"`
+}
+
+func runThreads(a *app, args []string) error {
+	var req quill.FetchPayload
+	fs := a.flags("threads", "[-folder F | -label L] [-limit N]")
+	fetchFlags(fs, &req, 100)
+	_ = fs.Parse(args)
+
+	resp, err := a.fetchList(&req)
+	if err != nil {
+		return err
+	}
+	// Messages come newest first, so the first of a thread is its latest.
+	var threads []*threadSummary
+	byID := make(map[string]*threadSummary)
+	for _, m := range resp.Messages {
+		t, ok := byID[m.ThreadID]
+		if !ok {
+			t = &threadSummary{ThreadID: m.ThreadID, Subject: m.Subject, Latest: m}
+			byID[m.ThreadID] = t
+			threads = append(threads, t)
+		}
+		t.Messages++
+		if !m.Read {
+			t.Unread++
+		}
+	}
+	return a.print(threads, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, " \tTHREAD\tDATE\tFROM\tSUBJECT")
+		for _, t := range threads {
+			unread := " "
+			if t.Unread > 0 {
+				unread = "*"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s (%d)\n", unread, t.ThreadID, formatTime(t.Latest.SentAt), t.Latest.From, t.Subject, t.Messages)
+		}
+		_ = tw.Flush()
+	})
+}
+
+func runThread(a *app, args []string) error {
+	fs := a.flags("thread", "<thread-id>")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+	resp, err := c.Fetch(context.Background(), &quill.FetchPayload{
+		Mode:     string(domain.FetchModeThread),
+		ThreadID: fs.Arg(0),
+		Limit:    100,
+	})
+	if err != nil {
+		return err
+	}
+	if len(resp.Messages) == 0 {
+		return fmt.Errorf("thread %s not found", fs.Arg(0))
+	}
+	return a.print(resp, func(w io.Writer) {
+		for i := len(resp.Messages) - 1; i >= 0; i-- {
+			printMessage(w, &resp.Messages[i])
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+		}
+	})
+}
+
+func runRead(a *app, args []string) error {
+	fs := a.flags("read", "[-keep-unread] <message-id>")
+	keepUnread := fs.Bool("keep-unread", false, "do not mark the message read")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	m, err := a.message(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if !m.Read && !*keepUnread {
+		read := true
+		if _, err := a.flag(&quill.FlagPayload{MessageIDs: []string{m.MessageID}, Read: &read}); err != nil {
+			return err
+		}
+		m.Read = true
+	}
+	return a.print(m, func(w io.Writer) {
+		printMessage(w, m)
+	})
+}
+
+// message fetches one message of the caller's mailbox.
+func (a *app) message(id string) (*quill.MessageDTO, error) {
+	c, err := a.client()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Fetch(context.Background(), &quill.FetchPayload{
+		Mode:      string(domain.FetchModeMessage),
+		MessageID: id,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Messages) == 0 {
+		return nil, fmt.Errorf("message %s not found", id)
+	}
+	return &resp.Messages[0], nil
+}
+
+func runMove(a *app, args []string) error {
+	fs := a.flags("move", "<folder> <message-id>...")
+	_ = fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+	var resp quill.MoveResponsePayload
+	if err := c.Do(context.Background(), quill.PacketTypeMove, quill.MovePayload{
+		Folder:     fs.Arg(0),
+		MessageIDs: fs.Args()[1:],
+	}, &resp); err != nil {
+		return err
+	}
+	return a.print(resp, func(w io.Writer) {
+		fmt.Fprintf(w, "Moved %d message(s) to %s\n", resp.Moved, resp.Folder)
+	})
+}
+
+func runFlag(a *app, args []string) error {
+	var req quill.FlagPayload
+	fs := a.flags("flag", "[-read|-unread] [-star|-unstar] [-add F] [-remove F] <message-id>...")
+	read := fs.Bool("read", false, "mark read")
+	unread := fs.Bool("unread", false, "mark unread")
+	star := fs.Bool("star", false, "add the starred flag")
+	unstar := fs.Bool("unstar", false, "remove the starred flag")
+	fs.Var((*listFlag)(&req.AddFlags), "add", "flags to add")
+	fs.Var((*listFlag)(&req.RemoveFlags), "remove", "flags to remove")
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 || (*read && *unread) || (*star && *unstar) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	req.MessageIDs = fs.Args()
+	if *read || *unread {
+		req.Read = read
+	}
+	if *star {
+		req.AddFlags = append(req.AddFlags, flagStarred)
+	}
+	if *unstar {
+		req.RemoveFlags = append(req.RemoveFlags, flagStarred)
+	}
+	resp, err := a.flag(&req)
+	if err != nil {
+		return err
+	}
+	return a.print(resp, func(w io.Writer) {
+		fmt.Fprintf(w, "Updated %d message(s)\n", resp.Updated)
+	})
+}
+
+// Flags other clients know by name.
+const (
+	flagStarred  = "starred"
+	flagAnswered = "answered"
+)
+
+func (a *app) flag(req *quill.FlagPayload) (*quill.FlagResponsePayload, error) {
+	c, err := a.client()
+	if err != nil {
+		return nil, err
+	}
+	var resp quill.FlagResponsePayload
+	if err := c.Do(context.Background(), quill.PacketTypeFlag, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func runTail(a *app, args []string) error {
+	_ = a.flags("tail", "").Parse(args)
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	sub, err := c.Subscribe(ctx, func(m *quill.NewMailPayload) {
+		if a.json {
+			// One object per line, for piping into other tools.
+			_ = jsonLine(a.out, m)
+			return
+		}
+		if msg := m.Change.Message; msg != nil {
+			fmt.Fprintf(a.out, "%s  %s  %s  %s\n", formatTime(msg.SentAt), msg.MessageID, msg.From, msg.Subject)
+		} else {
+			fmt.Fprintf(a.out, "new message %s in %s\n", m.Change.MessageID, m.Change.Folder)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	if !a.json {
+		fmt.Fprintln(os.Stderr, "Waiting for new mail; press Ctrl-C to stop.")
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// marker shows * for unread messages.
+func marker(m quill.MessageDTO) string {
+	if !m.Read {
+		return "*"
+	}
+	return " "
+}
+
+func printMessage(w io.Writer, m *quill.MessageDTO) {
+	fmt.Fprintf(w, "From:    %s\n", m.From)
+	fmt.Fprintf(w, "To:      %s\n", strings.Join(m.To, ", "))
+	if len(m.CC) > 0 {
+		fmt.Fprintf(w, "Cc:      %s\n", strings.Join(m.CC, ", "))
+	}
+	fmt.Fprintf(w, "Date:    %s\n", m.SentAt.Local().Format("Mon, 2 Jan 2006 15:04"))
+	fmt.Fprintf(w, "Subject: %s\n", m.Subject)
+	fmt.Fprintf(w, "ID:      %s (thread %s)\n", m.MessageID, m.ThreadID)
+	if len(m.Flags) > 0 || len(m.Labels) > 0 {
+		fmt.Fprintf(w, "Flags:   %s\n", strings.Join(append(append([]string{}, m.Flags...), m.Labels...), ", "))
+	}
+	for _, att := range m.Attachments {
+		fmt.Fprintf(w, "Attach:  %s (%s)\n", att.Filename, att.Mimetype)
+	}
+	fmt.Fprintf(w, "\n%s\n", strings.TrimRight(plainText(m.Body), "\n"))
+}
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// plainText is the text part of a body, or its HTML without tags.
+func plainText(b quill.BodyPayload) string {
+	for _, part := range b.Content {
+		if part.Type == string(domain.ContentTypePlainText) {
+			return part.Value
+		}
+	}
+	for _, part := range b.Content {
+		if part.Type == string(domain.ContentTypeHTML) {
+			return htmlTag.ReplaceAllString(part.Value, "")
+		}
+	}
+	return ""
+}
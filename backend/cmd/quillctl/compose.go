@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"quill/pkg/domain"
+	"quill/pkg/transport/quill"
+)
+
+// draft is a message being composed.
+type draft struct {
+	to, cc, bcc listFlag
+	subject     string
+	body        string
+	bodyFile    string
+	attach      listFlag
+	edit        bool
+
+	threadID    string
+	attachments []quill.Attachment // carried over when forwarding
+}
+
+// composeFlags adds the flags every way of composing shares; send and
+// forward add the recipients as well.
+func (d *draft) composeFlags(fs *flag.FlagSet) {
+	fs.StringVar(&d.body, "body", "", "message text")
+	fs.StringVar(&d.bodyFile, "body-file", "", "read the message text from `file`, - for stdin")
+	fs.Var(&d.attach, "attach", "attach a `file`; may be repeated")
+	fs.BoolVar(&d.edit, "edit", false, "open $EDITOR even though a body was given")
+}
+
+func (d *draft) recipientFlags(fs *flag.FlagSet) {
+	fs.Var(&d.to, "to", "recipients, comma-separated or repeated")
+	fs.Var(&d.cc, "cc", "carbon-copy recipients")
+	fs.Var(&d.bcc, "bcc", "blind carbon-copy recipients")
+}
+
+func runSend(a *app, args []string) error {
+	var d draft
+	fs := a.flags("send", "-to A [-cc A] [-subject S] [-body B | -body-file F] [-attach F]")
+	d.recipientFlags(fs)
+	fs.StringVar(&d.subject, "subject", "", "subject")
+	d.composeFlags(fs)
+	_ = fs.Parse(args)
+	return a.send(&d, "")
+}
+
+func runReply(a *app, args []string) error {
+	var d draft
+	fs := a.flags("reply", "[-all] [-body B | -body-file F] <message-id>")
+	all := fs.Bool("all", false, "reply to every recipient, not just the sender")
+	d.composeFlags(fs)
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	orig, err := a.message(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	self, err := a.address()
+	if err != nil {
+		return err
+	}
+
+	sender := orig.From
+	if orig.ReplyTo != "" {
+		sender = orig.ReplyTo
+	}
+	d.to = listFlag{sender}
+	if *all {
+		for _, addr := range append(append([]string{}, orig.To...), orig.CC...) {
+			if !strings.EqualFold(addr, self) && !strings.EqualFold(addr, sender) {
+				d.cc = append(d.cc, addr)
+			}
+		}
+	}
+	d.subject = prefixed("Re: ", orig.Subject)
+	d.threadID = orig.ThreadID
+	quote := fmt.Sprintf("On %s, %s wrote:\n%s",
+		orig.SentAt.Local().Format("Mon, 2 Jan 2006 at 15:04"), orig.From, quoted(plainText(orig.Body)))
+	return a.send(&d, quote, func() error {
+		_, err := a.flag(&quill.FlagPayload{MessageIDs: []string{orig.MessageID}, AddFlags: []string{flagAnswered}})
+		return err
+	})
+}
+
+func runForward(a *app, args []string) error {
+	var d draft
+	fs := a.flags("forward", "-to A [-body B] <message-id>")
+	d.recipientFlags(fs)
+	d.composeFlags(fs)
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	orig, err := a.message(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	d.subject = prefixed("Fwd: ", orig.Subject)
+	// The forward stays in the conversation it came from.
+	d.threadID = orig.ThreadID
+	d.attachments = orig.Attachments
+	forwarded := fmt.Sprintf("---------- Forwarded message ----------\nFrom: %s\nDate: %s\nSubject: %s\nTo: %s\n\n%s",
+		orig.From, orig.SentAt.Local().Format("Mon, 2 Jan 2006 at 15:04"), orig.Subject,
+		strings.Join(orig.To, ", "), plainText(orig.Body))
+	return a.send(&d, forwarded)
+}
+
+// send completes the draft, in the editor when no body was given, and
+// sends it. quote follows the text written; after runs once it is sent.
+func (a *app) send(d *draft, quote string, after ...func() error) error {
+	if d.bodyFile != "" {
+		var data []byte
+		var err error
+		if d.bodyFile == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(d.bodyFile)
+		}
+		if err != nil {
+			return err
+		}
+		d.body = string(data)
+	}
+	written := d.body != "" || d.bodyFile != ""
+	if quote != "" {
+		d.body = strings.TrimRight(d.body, "\n") + "\n\n" + quote
+	}
+	if d.edit || !written {
+		if err := d.editInteractively(); err != nil {
+			return err
+		}
+	}
+	if len(d.to)+len(d.cc)+len(d.bcc) == 0 {
+		return errors.New("no recipients")
+	}
+
+	from, err := a.address()
+	if err != nil {
+		return err
+	}
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+	req := &quill.SendPayload{
+		From:    from,
+		To:      d.to,
+		CC:      d.cc,
+		BCC:     d.bcc,
+		Subject: d.subject,
+		Body: quill.BodyPayload{Content: []quill.ContentPart{
+			{Type: string(domain.ContentTypePlainText), Value: d.body},
+		}},
+		Attachments: d.attachments,
+		Options:     quill.SendOptions{ThreadID: d.threadID},
+	}
+	for _, path := range d.attach {
+		att, err := attachment(path)
+		if err != nil {
+			return err
+		}
+		req.Attachments = append(req.Attachments, att)
+	}
+
+	resp, err := c.Send(context.Background(), req)
+	if err != nil {
+		return err
+	}
+	for _, fn := range after {
+		if err := fn(); err != nil {
+			fmt.Fprintln(os.Stderr, "quillctl: sent, but:", err)
+		}
+	}
+	return a.print(resp, func(w io.Writer) {
+		fmt.Fprintf(w, "Sent %s in thread %s\n", resp.MessageID, resp.ThreadID)
+		if len(resp.QueuedFor) > 0 {
+			fmt.Fprintf(w, "Queued for %s\n", strings.Join(resp.QueuedFor, ", "))
+		}
+		if len(resp.HeldFor) > 0 {
+			fmt.Fprintf(w, "Held for %s\n", strings.Join(resp.HeldFor, ", "))
+		}
+		if len(resp.BouncedFor) > 0 {
+			fmt.Fprintf(w, "Bounced for %s: mailbox full\n", strings.Join(resp.BouncedFor, ", "))
+		}
+	})
+}
+
+// address is the account's Quill address, remembered by login or looked
+// up when the credential came from the environment.
+func (a *app) address() (string, error) {
+	cfg, err := a.config()
+	if err != nil {
+		return "", err
+	}
+	if cfg.Address != "" {
+		return cfg.Address, nil
+	}
+	c, err := a.client()
+	if err != nil {
+		return "", err
+	}
+	var resp quill.ProfileResponsePayload
+	if err := c.Do(context.Background(), quill.PacketTypeProfile, quill.ProfilePayload{Action: quill.ProfileActionGet}, &resp); err != nil {
+		return "", err
+	}
+	cfg.Address = resp.Profile.QuillMail
+	return cfg.Address, nil
+}
+
+// editInteractively opens $VISUAL or $EDITOR on the draft, headers first,
+// and reads back what was saved. An empty body cancels.
+func (d *draft) editInteractively() error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	f, err := os.CreateTemp("", "quillctl-*.txt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "To: %s\nCc: %s\nBcc: %s\nSubject: %s\n\n%s",
+		d.to.String(), d.cc.String(), d.bcc.String(), d.subject, d.body)
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// EDITOR may carry arguments, e.g. "code --wait".
+	argv := append(strings.Fields(editor), f.Name())
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("editor: %w", err)
+	}
+
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		return err
+	}
+	return d.parse(string(data))
+}
+
+// parse reads a draft back from the editor.
+func (d *draft) parse(text string) error {
+	d.to, d.cc, d.bcc = nil, nil, nil
+	header, body, _ := strings.Cut(text, "\n\n")
+	for _, line := range strings.Split(header, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("bad header line %q; leave a blank line before the text", line)
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "to":
+			_ = d.to.Set(value)
+		case "cc":
+			_ = d.cc.Set(value)
+		case "bcc":
+			_ = d.bcc.Set(value)
+		case "subject":
+			d.subject = value
+		default:
+			return fmt.Errorf("unknown header %q", name)
+		}
+	}
+	d.body = body
+	if strings.TrimSpace(d.body) == "" {
+		return errors.New("empty message, not sent")
+	}
+	return nil
+}
+
+func attachment(path string) (quill.Attachment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return quill.Attachment{}, err
+	}
+	mimetype := mime.TypeByExtension(filepath.Ext(path))
+	if mimetype == "" {
+		mimetype = "application/octet-stream"
+	}
+	return quill.Attachment{
+		Filename:      filepath.Base(path),
+		Mimetype:      mimetype,
+		ContentBase64: base64.StdEncoding.EncodeToString(data),
+	}, nil
+}
+
+// prefixed adds prefix to a subject unless it is there already.
+func prefixed(prefix, subject string) string {
+	if strings.HasPrefix(strings.ToLower(subject), strings.ToLower(prefix)) {
+		return subject
+	}
+	return prefix + subject
+}
+
+func quoted(text string) string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	for i, l := range lines {
+		lines[i] = "> " + l
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"quill/pkg/transport/quill"
+)
+
+func TestDraftParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    draft
+		wantErr bool
+	}{
+		{
+			name: "headers and body",
+			text: "To: ada~example.com, bob~example.com\nCc: \nBcc: eve@example.net\nSubject:  Lunch \n\nAt noon?\n",
+			want: draft{to: listFlag{"ada~example.com", "bob~example.com"}, bcc: listFlag{"eve@example.net"}, subject: "Lunch", body: "At noon?\n"},
+		},
+		{
+			name: "header names in any case",
+			text: "TO: ada~example.com\nsubject: Hi\n\nHello",
+			want: draft{to: listFlag{"ada~example.com"}, subject: "Hi", body: "Hello"},
+		},
+		{name: "unknown header", text: "From: me\n\nHello", wantErr: true},
+		{name: "no blank line", text: "To: ada~example.com\nHello", wantErr: true},
+		{name: "empty body", text: "To: ada~example.com\n\n  \n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := draft{to: listFlag{"old~example.com"}}
+			err := d.parse(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parse() = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(d, tt.want) {
+				t.Errorf("draft = %+v, want %+v", d, tt.want)
+			}
+		})
+	}
+}
+
+func TestListFlag(t *testing.T) {
+	var l listFlag
+	l.Set("ada~example.com, bob~example.com")
+	l.Set(" ,carl~example.com,")
+	if want := (listFlag{"ada~example.com", "bob~example.com", "carl~example.com"}); !reflect.DeepEqual(l, want) {
+		t.Errorf("listFlag = %v, want %v", l, want)
+	}
+	if got := l.String(); got != "ada~example.com,bob~example.com,carl~example.com" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+func TestPrefixed(t *testing.T) {
+	tests := []struct {
+		prefix, subject, want string
+	}{
+		{"Re: ", "Lunch", "Re: Lunch"},
+		{"Re: ", "Re: Lunch", "Re: Lunch"},
+		{"Re: ", "RE: Lunch", "RE: Lunch"},
+		{"Fwd: ", "Re: Lunch", "Fwd: Re: Lunch"},
+		{"Re: ", "", "Re: "},
+	}
+	for _, tt := range tests {
+		if got := prefixed(tt.prefix, tt.subject); got != tt.want {
+			t.Errorf("prefixed(%q, %q) = %q, want %q", tt.prefix, tt.subject, got, tt.want)
+		}
+	}
+}
+
+func TestQuoted(t *testing.T) {
+	if got, want := quoted("one\n\ntwo\n\n"), "> one\n> \n> two\n"; got != want {
+		t.Errorf("quoted() = %q, want %q", got, want)
+	}
+}
+
+func TestPlainText(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []quill.ContentPart
+		want    string
+	}{
+		{"plain preferred", []quill.ContentPart{{Type: "text/html", Value: "<b>hi</b>"}, {Type: "text/plain", Value: "hi"}}, "hi"},
+		{"html stripped", []quill.ContentPart{{Type: "text/html", Value: "<p>hi <b>there</b></p>"}}, "hi there"},
+		{"nothing readable", []quill.ContentPart{{Type: "image/png", Value: "..."}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := plainText(quill.BodyPayload{Content: tt.content}); got != tt.want {
+				t.Errorf("plainText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttachment(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		file     string
+		wantType string
+	}{
+		{"photo.png", "image/png"},
+		{"blob", "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			path := filepath.Join(dir, tt.file)
+			if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			att, err := attachment(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := quill.Attachment{Filename: tt.file, Mimetype: tt.wantType, ContentBase64: base64.StdEncoding.EncodeToString([]byte("data"))}
+			if att != want {
+				t.Errorf("attachment = %+v, want %+v", att, want)
+			}
+		})
+	}
+	if _, err := attachment(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("attachment of a missing file = %v", err)
+	}
+}
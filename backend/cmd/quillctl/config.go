@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+
+	"quill/pkg/client"
+)
+
+// config is what login remembers. QUILLCTL_ADDR and QUILLCTL_TOKEN override
+// it, e.g. for scripts that should not touch the stored file.
+type config struct {
+	Addr  string `json:"addr"`
+	Token string `json:"token,omitempty"`
+	// Address is the account's Quill address, used as the sender.
+	Address   string `json:"address,omitempty"`
+	CAFile    string `json:"ca_file,omitempty"`
+	Insecure  bool   `json:"insecure,omitempty"`
+	Plaintext bool   `json:"plaintext,omitempty"`
+}
+
+// configPath is QUILLCTL_CONFIG, or quillctl/config.json in the user's
+// configuration directory.
+func configPath() (string, error) {
+	if p := os.Getenv("QUILLCTL_CONFIG"); p != "" {
+		return p, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "quillctl", "config.json"), nil
+}
+
+func loadConfig() (*config, error) {
+	cfg := &config{Addr: "localhost:9876"}
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if v := os.Getenv("QUILLCTL_ADDR"); v != "" {
+		cfg.Addr = v
+	}
+	if v := os.Getenv("QUILLCTL_TOKEN"); v != "" {
+		cfg.Token = v
+	}
+	return cfg, nil
+}
+
+// save writes the configuration readable by the user only, as it holds
+// the credential.
+func (c *config) save() error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o600)
+}
+
+func (c *config) dial() (*client.Client, error) {
+	opts := client.Options{
+		Addr:       c.Addr,
+		Token:      client.StaticToken(c.Token),
+		ClientName: "quillctl",
+	}
+	if !c.Plaintext {
+		tlsCfg, err := c.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts.TLSConfig = tlsCfg
+	}
+	return client.New(opts)
+}
+
+func (c *config) tlsConfig() (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("server address %q: %w", c.Addr, err)
+	}
+	cfg := &tls.Config{ServerName: host, InsecureSkipVerify: c.Insecure}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", c.CAFile)
+		}
+		cfg.RootCAs = roots
+	}
+	return cfg, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quillctl", "config.json")
+	t.Setenv("QUILLCTL_CONFIG", path)
+	t.Setenv("QUILLCTL_ADDR", "")
+	t.Setenv("QUILLCTL_TOKEN", "")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != "localhost:9876" || cfg.Token != "" {
+		t.Errorf("config without a file = %+v", cfg)
+	}
+
+	cfg = &config{Addr: "mail.example.com:9876", Token: "secret", Address: "ada~example.com"}
+	if err := cfg.save(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("config saved with mode %o, want 600", perm)
+	}
+	got, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *cfg {
+		t.Errorf("loaded %+v, want %+v", got, cfg)
+	}
+
+	t.Setenv("QUILLCTL_ADDR", "other.example.com:9876")
+	t.Setenv("QUILLCTL_TOKEN", "from-env")
+	if got, err = loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got.Addr != "other.example.com:9876" || got.Token != "from-env" || got.Address != "ada~example.com" {
+		t.Errorf("environment not applied: %+v", got)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig accepted a broken file")
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		cfg  config
+		ok   bool
+	}{
+		{"system roots", config{Addr: "mail.example.com:9876"}, true},
+		{"no port", config{Addr: "mail.example.com"}, false},
+		{"missing CA file", config{Addr: "mail.example.com:9876", CAFile: filepath.Join(dir, "missing.pem")}, false},
+		{"CA file without certificates", config{Addr: "mail.example.com:9876", CAFile: empty}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsCfg, err := tt.cfg.tlsConfig()
+			if (err == nil) != tt.ok {
+				t.Fatalf("tlsConfig() = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && tlsCfg.ServerName != "mail.example.com" {
+				t.Errorf("ServerName = %q", tlsCfg.ServerName)
+			}
+		})
+	}
+	if _, err := (&config{Addr: "mail.example.com"}).dial(); err == nil {
+		t.Error("dial() accepted an address without a port")
+	}
+	if _, err := (&config{Addr: "mail.example.com", Plaintext: true}).dial(); err != nil {
+		t.Errorf("plaintext dial() = %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+// Command quillctl reads and sends Quill mail from the terminal.
+//
+//	quillctl login -addr mail.example.com:9876
+//	quillctl list -folder inbox
+//	quillctl read <message-id>
+//	quillctl reply <message-id>
+//
+// Every command takes -json to print the server's answer as JSON instead of
+// text, for scripts. Run quillctl help for the list of commands.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"quill/pkg/client"
+)
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(a *app, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"login", "[-addr host:port] [-token T]", "sign in and remember the server and credential", runLogin},
+		{"logout", "", "forget the stored credential", runLogout},
+		{"folders", "", "list folders and labels with their counts", runFolders},
+		{"list", "[-folder F | -label L] [-limit N] [-cursor C]", "list messages, newest first", runList},
+		{"threads", "[-folder F | -label L] [-limit N]", "list conversations, newest first", runThreads},
+		{"thread", "<thread-id>", "show every message of a conversation", runThread},
+		{"read", "[-keep-unread] <message-id>", "show a message and mark it read", runRead},
+		{"send", "-to A [-cc A] [-subject S] [-body B | -body-file F] [-attach F]", "compose and send a message", runSend},
+		{"reply", "[-all] [-body B | -body-file F] <message-id>", "reply in the message's thread", runReply},
+		{"forward", "-to A [-body B] <message-id>", "forward a message with its attachments", runForward},
+		{"move", "<folder> <message-id>...", "move messages to a folder", runMove},
+		{"flag", "[-read|-unread] [-star|-unstar] [-add F] [-remove F] <message-id>...", "change read state and flags", runFlag},
+		{"tail", "", "print new mail as it arrives", runTail},
+	}
+}
+
+func main() {
+	a := &app{out: os.Stdout}
+	flag.BoolVar(&a.json, "json", false, "print JSON instead of text")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 || flag.Arg(0) == "help" {
+		usage()
+		os.Exit(2)
+	}
+
+	name := flag.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name == name {
+			err := cmd.run(a, flag.Args()[1:])
+			a.close()
+			if err != nil {
+				a.fail(err)
+			}
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "quillctl: unknown command %q\n", name)
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: quillctl [-json] <command> [flags] [args]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun quillctl <command> -h for the flags of a command.\n")
+}
+
+// app is what the commands share: the stored configuration, the connection
+// and how to print.
+type app struct {
+	json bool
+	out  io.Writer
+
+	cfg *config
+	c   *client.Client
+}
+
+// flags returns a flag set for a command, with -json.
+func (a *app) flags(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.BoolVar(&a.json, "json", a.json, "print JSON instead of text")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: quillctl %s %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func (a *app) config() (*config, error) {
+	if a.cfg == nil {
+		cfg, err := loadConfig()
+		if err != nil {
+			return nil, err
+		}
+		a.cfg = cfg
+	}
+	return a.cfg, nil
+}
+
+// client connects with the stored credential.
+func (a *app) client() (*client.Client, error) {
+	if a.c != nil {
+		return a.c, nil
+	}
+	cfg, err := a.config()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Token == "" {
+		return nil, errors.New("not signed in; run quillctl login")
+	}
+	a.c, err = cfg.dial()
+	return a.c, err
+}
+
+func (a *app) close() {
+	if a.c != nil {
+		_ = a.c.Close()
+	}
+}
+
+// print writes v as JSON, or calls text to describe it.
+func (a *app) print(v interface{}, text func(w io.Writer)) error {
+	if a.json {
+		enc := json.NewEncoder(a.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	text(a.out)
+	return nil
+}
+
+// jsonLine writes v as one line of JSON.
+func jsonLine(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// fail reports err and exits. With -json the error is JSON as well, with
+// the server's error code when there is one.
+func (a *app) fail(err error) {
+	if a.json {
+		out := map[string]string{"error": err.Error()}
+		var qe *client.Error
+		if errors.As(err, &qe) {
+			out["code"] = qe.Code
+			out["error"] = qe.Message
+		}
+		_ = json.NewEncoder(os.Stderr).Encode(out)
+	} else {
+		fmt.Fprintln(os.Stderr, "quillctl:", err)
+	}
+	os.Exit(1)
+}
+
+// listFlag collects a flag given several times or as a comma-separated list.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	t = t.Local()
+	if y, m, d := time.Now().Date(); t.Year() == y && t.Month() == m && t.Day() == d {
+		return t.Format("15:04")
+	}
+	return t.Format("2006-01-02")
+}
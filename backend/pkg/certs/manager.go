@@ -0,0 +1,427 @@
+// Package certs manages the server's TLS certificates: one per hosted
+// domain, selected by SNI, reloaded when their files change or obtained
+// from an ACME CA, plus the trust used to authenticate peer servers.
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"quill/pkg/config"
+)
+
+var (
+	ErrMutualTLSDisabled = errors.New("mutual TLS for federation is disabled")
+	ErrNoPeerCertificate = errors.New("peer presented no client certificate")
+)
+
+// keyPair is a certificate loaded from disk.
+type keyPair struct {
+	certFile, keyFile string
+	cert              *tls.Certificate
+}
+
+// domainCerts are the certificates of one hosted domain.
+type domainCerts struct {
+	serving    *keyPair // nil for ACME domains
+	federation *keyPair // nil to use the serving certificate
+	acme       bool
+}
+
+// Manager hands out certificates for the hosted domains and verifies peer
+// servers. It is safe for concurrent use; Configure may be called again on
+// reload.
+type Manager struct {
+	mu        sync.RWMutex
+	primary   string
+	domains   map[string]*domainCerts
+	pairs     map[[2]string]*keyPair // shared by domains using the same files
+	acmeCfg   config.ACMEConfig
+	acme      *autocert.Manager // nil when no domain uses ACME
+	peerRoots *x509.CertPool
+	mutualTLS bool
+}
+
+func NewManager(cfg *config.Config) (*Manager, error) {
+	m := &Manager{}
+	if err := m.Configure(cfg); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Configure loads the certificates for cfg's domains and federation trust.
+// On error the previous configuration stays in place.
+func (m *Manager) Configure(cfg *config.Config) error {
+	peerRoots, err := loadRoots(cfg.Federation.CAFile)
+	if err != nil {
+		return fmt.Errorf("federation.ca_file: %w", err)
+	}
+
+	m.mu.RLock()
+	previous := m.pairs
+	m.mu.RUnlock()
+	pairs := make(map[[2]string]*keyPair)
+	load := func(certFile, keyFile string) (*keyPair, error) {
+		key := [2]string{certFile, keyFile}
+		if p, ok := pairs[key]; ok {
+			return p, nil
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			// Keep serving a certificate that loaded before, e.g. while
+			// a renewal is being written.
+			if p, ok := previous[key]; ok {
+				log.Printf("WARN: reloading %s failed, keeping the loaded certificate: %v", certFile, err)
+				pairs[key] = p
+				return p, nil
+			}
+			return nil, fmt.Errorf("loading %s: %w", certFile, err)
+		}
+		p := &keyPair{certFile: certFile, keyFile: keyFile, cert: &cert}
+		pairs[key] = p
+		return p, nil
+	}
+
+	domains := make(map[string]*domainCerts, len(cfg.Domains))
+	var acmeDomains []string
+	for _, d := range cfg.Domains {
+		dc := &domainCerts{acme: d.ACME}
+		switch {
+		case d.ACME:
+			acmeDomains = append(acmeDomains, d.Name)
+		case d.CertFile != "":
+			if dc.serving, err = load(d.CertFile, d.KeyFile); err != nil {
+				return fmt.Errorf("domain %s: %w", d.Name, err)
+			}
+		default:
+			if dc.serving, err = load(cfg.TLS.CertFile, cfg.TLS.KeyFile); err != nil {
+				return fmt.Errorf("domain %s: %w", d.Name, err)
+			}
+		}
+		if d.FederationCertFile != "" {
+			if dc.federation, err = load(d.FederationCertFile, d.FederationKeyFile); err != nil {
+				return fmt.Errorf("domain %s: %w", d.Name, err)
+			}
+		}
+		domains[d.Name] = dc
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(acmeDomains) == 0 {
+		m.acme = nil
+	} else if m.acme == nil || m.acmeCfg != cfg.TLS.ACME {
+		if m.acme, err = newACMEManager(cfg.TLS.ACME, m.isACMEDomain); err != nil {
+			return err
+		}
+	}
+	m.acmeCfg = cfg.TLS.ACME
+	m.primary = cfg.Domains[0].Name
+	m.domains = domains
+	m.pairs = pairs
+	m.peerRoots = peerRoots
+	m.mutualTLS = cfg.Federation.MutualTLS
+	return nil
+}
+
+func newACMEManager(cfg config.ACMEConfig, hostPolicy autocert.HostPolicy) (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	if cfg.RootCAFile != "" {
+		roots, err := loadRoots(cfg.RootCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls.acme.root_ca_file: %w", err)
+		}
+		client.HTTPClient = &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		}
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.CacheDir),
+		HostPolicy: hostPolicy,
+		Client:     client,
+		Email:      cfg.Email,
+	}, nil
+}
+
+// loadRoots returns the system roots plus the PEM certificates in caFile.
+func loadRoots(caFile string) (*x509.CertPool, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if caFile == "" {
+		return roots, nil
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+	return roots, nil
+}
+
+func (m *Manager) isACMEDomain(_ context.Context, host string) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if d, ok := m.domains[host]; ok && d.acme {
+		return nil
+	}
+	return fmt.Errorf("certs: %q is not an ACME domain", host)
+}
+
+// GetCertificate selects the certificate for the domain a client asked for
+// via SNI. Clients that send no or an unknown name get the primary
+// domain's. ACME challenges are answered here too.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	m.mu.RLock()
+	acmeMgr := m.acme
+	d, ok := m.domains[name]
+	if !ok {
+		name, d = m.primary, m.domains[m.primary]
+	}
+	var cert *tls.Certificate
+	if d.serving != nil {
+		cert = d.serving.cert
+	}
+	m.mu.RUnlock()
+
+	if acmeMgr != nil && (d.acme || isALPNChallenge(hello)) {
+		if hello.ServerName != name {
+			h := *hello
+			h.ServerName = name
+			hello = &h
+		}
+		return acmeMgr.GetCertificate(hello)
+	}
+	if cert == nil {
+		return nil, fmt.Errorf("certs: no certificate for %q", hello.ServerName)
+	}
+	return cert, nil
+}
+
+func isALPNChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// ServerTLSConfig is the TLS configuration for a listener. Peer servers
+// are asked for a client certificate; it is checked per relayed message
+// with VerifyPeer, so ordinary clients need none.
+func (m *Manager) ServerTLSConfig(requestPeerCerts bool, nextProtos ...string) *tls.Config {
+	cfg := &tls.Config{
+		GetCertificate: m.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     append(nextProtos, acme.ALPNProto),
+	}
+	if requestPeerCerts {
+		cfg.ClientAuth = tls.RequestClientCert
+	}
+	return cfg
+}
+
+// HTTPHandler answers ACME http-01 challenges and hands everything else to
+// fallback (nil redirects to HTTPS).
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.mu.RLock()
+		acmeMgr := m.acme
+		m.mu.RUnlock()
+		if acmeMgr == nil {
+			if fallback == nil {
+				http.NotFound(w, r)
+				return
+			}
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		acmeMgr.HTTPHandler(fallback).ServeHTTP(w, r)
+	})
+}
+
+// ClientTLSConfig is the TLS configuration for relaying mail from the
+// hosted domain origin to peerDomain. The peer's certificate must be valid
+// for peerDomain; with mutual TLS, origin's certificate is presented.
+func (m *Manager) ClientTLSConfig(origin, peerDomain string) *tls.Config {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	cfg := &tls.Config{
+		RootCAs:    m.peerRoots,
+		ServerName: peerDomain,
+		MinVersion: tls.VersionTLS12,
+	}
+	if m.mutualTLS {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := m.FederationCertificate(origin)
+			if err != nil {
+				log.Printf("WARN: no federation certificate for %s: %v", origin, err)
+				return &tls.Certificate{}, nil // continue without one
+			}
+			return cert, nil
+		}
+	}
+	return cfg
+}
+
+// FederationCertificate is the certificate domain presents to peers.
+func (m *Manager) FederationCertificate(domain string) (*tls.Certificate, error) {
+	m.mu.RLock()
+	d, ok := m.domains[domain]
+	acmeMgr := m.acme
+	var cert *tls.Certificate
+	switch {
+	case !ok:
+	case d.federation != nil:
+		cert = d.federation.cert
+	case d.serving != nil:
+		cert = d.serving.cert
+	}
+	m.mu.RUnlock()
+	switch {
+	case !ok:
+		return nil, fmt.Errorf("certs: %s is not hosted here", domain)
+	case cert != nil:
+		return cert, nil
+	case d.acme && acmeMgr != nil:
+		return acmeMgr.GetCertificate(&tls.ClientHelloInfo{ServerName: domain})
+	}
+	return nil, fmt.Errorf("certs: no certificate for %s", domain)
+}
+
+// VerifyPeer checks that a peer server's client certificate chains to a
+// trusted root and is valid for domain.
+func (m *Manager) VerifyPeer(state tls.ConnectionState, domain string) error {
+	m.mu.RLock()
+	roots, enabled := m.peerRoots, m.mutualTLS
+	m.mu.RUnlock()
+	if !enabled {
+		return ErrMutualTLSDisabled
+	}
+	if len(state.PeerCertificates) == 0 {
+		return ErrNoPeerCertificate
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range state.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	// Peers usually reuse their server certificate, so accept either usage.
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       domain,
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
+
+// Watch reloads certificates whose files change until ctx ends. Whole
+// directories are watched so that files replaced by rename, as renewal
+// tools and Kubernetes secrets do, are picked up too.
+func (m *Manager) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	watched := make(map[string]bool)
+	watchDirs := func() {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		for key := range m.pairs {
+			for _, f := range key {
+				dir := filepath.Dir(f)
+				if watched[dir] {
+					continue
+				}
+				if err := watcher.Add(dir); err != nil {
+					log.Printf("WARN: cannot watch %s for certificate changes: %v", dir, err)
+					continue
+				}
+				watched[dir] = true
+			}
+		}
+	}
+	watchDirs()
+
+	// Writers touch the certificate and key separately; wait for both.
+	const settle = time.Second
+	timer := time.NewTimer(settle)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if m.uses(ev.Name) {
+				timer.Reset(settle)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("WARN: certificate watcher: %v", err)
+		case <-timer.C:
+			m.reloadFiles()
+			watchDirs()
+		}
+	}
+}
+
+// uses reports whether file is one of the loaded certificate or key files.
+func (m *Manager) uses(file string) bool {
+	file = filepath.Clean(file)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for key := range m.pairs {
+		if filepath.Clean(key[0]) == file || filepath.Clean(key[1]) == file {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadFiles re-reads every certificate loaded from disk, keeping the old
+// one when the new files do not load.
+func (m *Manager) reloadFiles() {
+	m.mu.RLock()
+	pairs := make([]*keyPair, 0, len(m.pairs))
+	for _, p := range m.pairs {
+		pairs = append(pairs, p)
+	}
+	m.mu.RUnlock()
+
+	for _, p := range pairs {
+		cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+		if err != nil {
+			log.Printf("WARN: reloading %s failed, keeping the loaded certificate: %v", p.certFile, err)
+			continue
+		}
+		m.mu.Lock()
+		p.cert = &cert
+		m.mu.Unlock()
+		log.Printf("INFO: reloaded certificate %s", p.certFile)
+	}
+}
@@ -0,0 +1,240 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"quill/pkg/config"
+)
+
+// testCA issues certificates for the tests and writes them to dir.
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{t: t, dir: t.TempDir(), cert: cert, key: key}
+	ca.file = ca.write("ca.crt", "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) write(name, blockType string, der []byte) string {
+	path := filepath.Join(ca.dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		ca.t.Fatal(err)
+	}
+	return path
+}
+
+// issue writes a certificate for dnsName signed by ca, or by itself with
+// selfSigned, and returns its certificate and key files.
+func (ca *testCA) issue(name, dnsName string, selfSigned bool) (certFile, keyFile string) {
+	ca.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	parent, signer := ca.cert, ca.key
+	if selfSigned {
+		parent, signer = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return ca.write(name+".crt", "CERTIFICATE", der), ca.write(name+".key", "EC PRIVATE KEY", keyDER)
+}
+
+func leaf(t *testing.T, cert *tls.Certificate) *x509.Certificate {
+	t.Helper()
+	c, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func testConfig(ca *testCA) *config.Config {
+	cfg := config.Default()
+	cfg.TLS.CertFile, cfg.TLS.KeyFile = ca.issue("default", "example.com", false)
+	netCert, netKey := ca.issue("net", "example.net", false)
+	fedCert, fedKey := ca.issue("fed", "relay.example.net", false)
+	cfg.Domains = []config.DomainConfig{
+		{Name: "example.com"},
+		{Name: "example.net", CertFile: netCert, KeyFile: netKey, FederationCertFile: fedCert, FederationKeyFile: fedKey},
+	}
+	cfg.Federation.CAFile = ca.file
+	cfg.Federation.MutualTLS = true
+	return cfg
+}
+
+func TestGetCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	m, err := NewManager(testConfig(ca))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"example.com", "example.com"},
+		{"example.net", "example.net"},
+		{"EXAMPLE.net.", "example.net"},
+		{"", "example.com"},
+		{"example.org", "example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := leaf(t, cert).DNSNames[0]; got != tt.want {
+				t.Errorf("certificate for %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFederationCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	m, err := NewManager(testConfig(ca))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{"example.com", "example.com"},       // serving certificate
+		{"example.net", "relay.example.net"}, // dedicated federation certificate
+	}
+	for _, tt := range tests {
+		cert, err := m.FederationCertificate(tt.domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := leaf(t, cert).DNSNames[0]; got != tt.want {
+			t.Errorf("FederationCertificate(%s) is for %q, want %q", tt.domain, got, tt.want)
+		}
+	}
+	if _, err := m.FederationCertificate("example.org"); err == nil {
+		t.Error("certificate for a domain not hosted here")
+	}
+}
+
+func TestVerifyPeer(t *testing.T) {
+	ca := newTestCA(t)
+	m, err := NewManager(testConfig(ca))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerCert, peerKey := ca.issue("peer", "example.org", false)
+	selfCert, selfKey := ca.issue("self", "example.org", true)
+	state := func(certFile, keyFile string) tls.ConnectionState {
+		pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf(t, &pair)}}
+	}
+
+	tests := []struct {
+		name    string
+		state   tls.ConnectionState
+		domain  string
+		wantErr error
+		ok      bool
+	}{
+		{"valid for domain", state(peerCert, peerKey), "example.org", nil, true},
+		{"chain only", state(peerCert, peerKey), "", nil, true},
+		{"another domain", state(peerCert, peerKey), "example.info", nil, false},
+		{"untrusted", state(selfCert, selfKey), "example.org", nil, false},
+		{"no certificate", tls.ConnectionState{}, "example.org", ErrNoPeerCertificate, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := m.VerifyPeer(tt.state, tt.domain)
+			if tt.ok != (err == nil) {
+				t.Fatalf("VerifyPeer = %v, want ok %v", err, tt.ok)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifyPeer = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	cfg := testConfig(ca)
+	cfg.Federation.MutualTLS = false
+	if err := m.Configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.VerifyPeer(state(peerCert, peerKey), "example.org"); !errors.Is(err, ErrMutualTLSDisabled) {
+		t.Errorf("VerifyPeer without mutual TLS = %v, want ErrMutualTLSDisabled", err)
+	}
+}
+
+func TestConfigureKeepsPreviousOnError(t *testing.T) {
+	ca := newTestCA(t)
+	m, err := NewManager(testConfig(ca))
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := testConfig(ca)
+	broken.Domains = append(broken.Domains, config.DomainConfig{Name: "example.info", CertFile: "missing.crt", KeyFile: "missing.key"})
+	if err := m.Configure(broken); err == nil {
+		t.Fatal("Configure with a missing certificate succeeded")
+	}
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.net"})
+	if err != nil || leaf(t, cert).DNSNames[0] != "example.net" {
+		t.Errorf("previous certificates lost: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"quill/pkg/transport/quill"
+)
+
+// TokenSource returns a credential the server accepts in AUTH: a Firebase
+// ID token, a JWT, an API key or an app password. It is called to sign in,
+// and again whenever the session has ended and cannot be refreshed.
+type TokenSource func(ctx context.Context) (string, error)
+
+// StaticToken always returns token, e.g. an API key.
+func StaticToken(token string) TokenSource {
+	return func(context.Context) (string, error) {
+		return token, nil
+	}
+}
+
+// authState is the client's session. It is not bound to a connection, so
+// every pooled connection carries it in its packets.
+type authState struct {
+	mu        sync.Mutex
+	token     string
+	refreshAt time.Time
+	expiresAt time.Time
+}
+
+// sessionToken returns a live session token, signing in or refreshing the
+// session when it is missing or three quarters through its life.
+func (c *Client) sessionToken(ctx context.Context) (string, error) {
+	if c.opts.Token == nil {
+		return "", nil
+	}
+	a := &c.auth
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if a.token != "" && now.Before(a.refreshAt) {
+		return a.token, nil
+	}
+
+	var resp quill.AuthResponsePayload
+	refreshed := false
+	if a.token != "" && now.Before(a.expiresAt) {
+		// Refreshing fails when the server has dropped the session, e.g.
+		// after a restart; signing in again still works.
+		err := c.exchange(ctx, nil, quill.PacketTypeAuth, a.token, quill.AuthPayload{
+			Action: quill.AuthActionRefresh,
+			NoBind: true,
+		}, &resp)
+		refreshed = err == nil
+	}
+	if !refreshed {
+		credential, err := c.opts.Token(ctx)
+		if err != nil {
+			return "", err
+		}
+		resp = quill.AuthResponsePayload{}
+		if err := c.exchange(ctx, nil, quill.PacketTypeAuth, "", quill.AuthPayload{
+			Action: quill.AuthActionLogin,
+			Token:  credential,
+			NoBind: true,
+		}, &resp); err != nil {
+			return "", err
+		}
+	}
+
+	a.token = resp.SessionToken
+	a.expiresAt = resp.ExpiresAt
+	a.refreshAt = now.Add(resp.ExpiresAt.Sub(now) * 3 / 4)
+	c.sessionChanged()
+	return a.token, nil
+}
+
+// dropSession forgets token after the server rejected it, unless another
+// request has replaced it already.
+func (c *Client) dropSession(token string) {
+	c.auth.mu.Lock()
+	defer c.auth.mu.Unlock()
+	if c.auth.token == token {
+		c.auth.token = ""
+	}
+}
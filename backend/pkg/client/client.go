@@ -0,0 +1,318 @@
+// Package client talks to a Quill server over the Quill protocol. A Client
+// keeps a small pool of connections, signs in with a TokenSource and keeps
+// the session fresh, and reconnects when a connection drops:
+//
+//	c, err := client.New(client.Options{
+//		Addr:      "mail.example.com:9876",
+//		TLSConfig: &tls.Config{ServerName: "mail.example.com"},
+//		Token:     client.StaticToken(apiKey),
+//	})
+//	if err != nil { ... }
+//	defer c.Close()
+//	page, err := c.Fetch(ctx, &quill.FetchPayload{Mode: "folder", Folder: "inbox"})
+//
+// Requests and responses are the DTOs of package quill. Packet types
+// without a typed method can be sent with Do.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sync"
+	"time"
+
+	"quill/pkg/transport/quill"
+)
+
+const (
+	DefaultPoolSize       = 4
+	DefaultDialTimeout    = 10 * time.Second
+	DefaultRequestTimeout = 30 * time.Second
+
+	// maxAttempts bounds how often a request is tried on a fresh connection.
+	maxAttempts = 3
+	retryDelay  = 200 * time.Millisecond
+)
+
+// ErrClosed is returned for requests made after Close.
+var ErrClosed = errors.New("quill client closed")
+
+// Error is an ERROR_RESPONSE from the server.
+type Error struct {
+	Code    string // one of the quill.ErrorCode constants
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Options configures a Client. Only Addr is required.
+type Options struct {
+	// Addr is the host:port of the server's Quill listener.
+	Addr string
+	// TLSConfig is used to dial; nil dials plain TCP.
+	TLSConfig *tls.Config
+	// Token signs the client in. Without it only HELLO and packets carrying
+	// their own credentials can be sent.
+	Token TokenSource
+	// ClientName names the client software in HELLO, for server logs.
+	ClientName string
+
+	PoolSize    int
+	DialTimeout time.Duration
+	// RequestTimeout applies to requests whose context has no deadline.
+	RequestTimeout time.Duration
+}
+
+// Client is safe for concurrent use.
+type Client struct {
+	opts Options
+
+	mu       sync.Mutex
+	conns    []*conn
+	dialing  int
+	dialDone chan struct{} // closed when the dials in flight end
+	closed   bool
+	caps     *quill.CapabilitiesPayload
+
+	auth authState
+	push pusher
+}
+
+// New returns a client for opts. It connects lazily, on the first request.
+func New(opts Options) (*Client, error) {
+	if opts.Addr == "" {
+		return nil, errors.New("quill client needs an address")
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = DefaultPoolSize
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = DefaultDialTimeout
+	}
+	if opts.RequestTimeout <= 0 {
+		opts.RequestTimeout = DefaultRequestTimeout
+	}
+	return &Client{opts: opts}, nil
+}
+
+// Close ends every connection and subscription. Requests in flight fail.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	conns := c.conns
+	c.conns = nil
+	c.mu.Unlock()
+
+	for _, cn := range conns {
+		cn.close()
+	}
+	c.stopPush()
+	return nil
+}
+
+// Capabilities returns what the server announced in answer to HELLO, or
+// nil before the first connection or if the server predates HELLO.
+func (c *Client) Capabilities() *quill.CapabilitiesPayload {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.caps
+}
+
+// Send sends a message.
+func (c *Client) Send(ctx context.Context, req *quill.SendPayload) (*quill.SendResponsePayload, error) {
+	var resp quill.SendResponsePayload
+	if err := c.Do(ctx, quill.PacketTypeSend, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Fetch fetches a page of a folder, thread or label.
+func (c *Client) Fetch(ctx context.Context, req *quill.FetchPayload) (*quill.FetchResponsePayload, error) {
+	var resp quill.FetchResponsePayload
+	if err := c.Do(ctx, quill.PacketTypeFetch, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Ping checks that the server is up and the session is good.
+func (c *Client) Ping(ctx context.Context) (*quill.PingResponsePayload, error) {
+	var resp quill.PingResponsePayload
+	if err := c.Do(ctx, quill.PacketTypePing, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Do sends a packet of type packetType with req as its payload and decodes
+// the answer into resp, which may be nil. An ERROR_RESPONSE is returned as
+// *Error.
+func (c *Client) Do(ctx context.Context, packetType string, req, resp interface{}) error {
+	return c.do(ctx, nil, packetType, req, resp)
+}
+
+// retryable lists the packet types that may be sent twice. Others are
+// retried only when the first attempt never reached the server.
+var retryable = map[string]bool{
+	quill.PacketTypeHello:       true,
+	quill.PacketTypeAuth:        true,
+	quill.PacketTypePing:        true,
+	quill.PacketTypeFetch:       true,
+	quill.PacketTypeSync:        true,
+	quill.PacketTypeListFolders: true,
+	quill.PacketTypeQuota:       true,
+	quill.PacketTypeSubscribe:   true,
+}
+
+// do sends a request on fixed, or on a pooled connection when fixed is nil,
+// signing in first and once more if the session turns out to be gone.
+func (c *Client) do(ctx context.Context, fixed *conn, packetType string, req, resp interface{}) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	var token string
+	if packetType != quill.PacketTypeHello && packetType != quill.PacketTypeAuth {
+		var err error
+		if token, err = c.sessionToken(ctx); err != nil {
+			return err
+		}
+	}
+	err := c.exchange(ctx, fixed, packetType, token, req, resp)
+	var qe *Error
+	if token != "" && errors.As(err, &qe) && isSessionError(qe.Code) {
+		c.dropSession(token)
+		if token, err = c.sessionToken(ctx); err != nil {
+			return err
+		}
+		err = c.exchange(ctx, fixed, packetType, token, req, resp)
+	}
+	return err
+}
+
+// exchange sends a request with token, trying again on a fresh connection
+// when the connection fails and the request may be repeated.
+func (c *Client) exchange(ctx context.Context, fixed *conn, packetType, token string, req, resp interface{}) error {
+	for attempt := 1; ; attempt++ {
+		cn := fixed
+		var err error
+		if cn == nil {
+			cn, err = c.conn(ctx)
+		}
+		if err == nil {
+			err = cn.do(ctx, packetType, token, req, resp)
+		}
+		if err == nil || fixed != nil || attempt == maxAttempts || !c.mayRetry(err, packetType) {
+			return err
+		}
+		select {
+		case <-time.After(time.Duration(attempt) * retryDelay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (c *Client) mayRetry(err error, packetType string) bool {
+	if errors.Is(err, ErrClosed) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var ce *connError
+	if errors.As(err, &ce) {
+		return !ce.sent || retryable[packetType]
+	}
+	var qe *Error
+	if errors.As(err, &qe) {
+		// The server answered; asking again would get the same answer.
+		return false
+	}
+	// The connection could not be made.
+	return true
+}
+
+func isSessionError(code string) bool {
+	return code == quill.ErrorCodeSessionExpired || code == quill.ErrorCodeAuthFailed
+}
+
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.opts.RequestTimeout)
+}
+
+// conn picks the least busy pooled connection, dialing another while the
+// pool is not full and every connection has work.
+func (c *Client) conn(ctx context.Context) (*conn, error) {
+	c.mu.Lock()
+	var best *conn
+	for {
+		if c.closed {
+			c.mu.Unlock()
+			return nil, ErrClosed
+		}
+		live := c.conns[:0]
+		for _, cn := range c.conns {
+			if cn.alive() {
+				live = append(live, cn)
+			}
+		}
+		c.conns = live
+
+		best = nil
+		for _, cn := range live {
+			if best == nil || cn.load() < best.load() {
+				best = cn
+			}
+		}
+		full := len(live)+c.dialing >= c.opts.PoolSize
+		if best != nil && (best.load() == 0 || full) {
+			c.mu.Unlock()
+			return best, nil
+		}
+		if !full {
+			break
+		}
+		// Every slot is being dialled; wait for one of them.
+		done := c.dialDone
+		c.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		c.mu.Lock()
+	}
+	if c.dialing == 0 {
+		c.dialDone = make(chan struct{})
+	}
+	c.dialing++
+	c.mu.Unlock()
+
+	cn, caps, err := dial(ctx, &c.opts, nil)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dialing--
+	if c.dialing == 0 {
+		close(c.dialDone)
+	}
+	if err != nil {
+		if best != nil {
+			return best, nil
+		}
+		return nil, err
+	}
+	if c.closed {
+		cn.close()
+		return nil, ErrClosed
+	}
+	c.conns = append(c.conns, cn)
+	if caps != nil {
+		c.caps = caps
+	}
+	return cn, nil
+}
@@ -0,0 +1,403 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"quill/pkg/transport/quill"
+)
+
+// fakeServer speaks the JSON stream of the Quill protocol. answer decides
+// what each packet gets; returning false drops the connection instead.
+type fakeServer struct {
+	ln     net.Listener
+	answer func(p *quill.Packet, reply func(string, interface{})) bool
+
+	mu     sync.Mutex
+	seen   []string // "TYPE token" of every packet received
+	logins int
+	dials  int
+}
+
+func newFakeServer(t *testing.T, answer func(p *quill.Packet, reply func(string, interface{})) bool) *fakeServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{ln: ln, answer: answer}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.dials++
+			s.mu.Unlock()
+			go s.serve(nc)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) serve(nc net.Conn) {
+	defer nc.Close()
+	dec, enc := json.NewDecoder(nc), json.NewEncoder(nc)
+	var wmu sync.Mutex
+	reply := func(typ string, payload interface{}) {
+		data, _ := json.Marshal(payload)
+		wmu.Lock()
+		defer wmu.Unlock()
+		enc.Encode(quill.Packet{Protocol: quill.ProtocolName, Version: quill.ProtocolVersion, Type: typ, Payload: data})
+	}
+	for {
+		var p quill.Packet
+		if err := dec.Decode(&p); err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.seen = append(s.seen, p.Type+" "+p.SessionToken)
+		s.mu.Unlock()
+		if p.Type == quill.PacketTypeAuth {
+			var req quill.AuthPayload
+			json.Unmarshal(p.Payload, &req)
+			if req.Action == quill.AuthActionLogin && req.Token == "key" {
+				s.mu.Lock()
+				s.logins++
+				token := fmt.Sprintf("s%d", s.logins)
+				s.mu.Unlock()
+				reply(quill.PacketTypeAuthResponse, quill.AuthResponsePayload{
+					Status:       quill.StatusOK,
+					SessionToken: token,
+					ExpiresAt:    time.Now().Add(time.Hour),
+				})
+				continue
+			}
+		}
+		if !s.answer(&p, reply) {
+			return
+		}
+	}
+}
+
+func (s *fakeServer) packets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.seen...)
+}
+
+// standard answers HELLO and any other packet with its response type.
+func standard(p *quill.Packet, reply func(string, interface{})) bool {
+	switch p.Type {
+	case quill.PacketTypeHello:
+		reply(quill.PacketTypeCapabilities, quill.CapabilitiesPayload{Status: quill.StatusOK, Version: "1.2"})
+	case quill.PacketTypeAuth:
+		reply(quill.PacketTypeErrorResponse, quill.ErrorResponsePayload{Code: quill.ErrorCodeAuthFailed, Message: "bad token"})
+	default:
+		reply(p.Type+"_RESPONSE", quill.PingResponsePayload{Status: quill.StatusOK, ServerTime: "now"})
+	}
+	return true
+}
+
+func newTestClient(t *testing.T, s *fakeServer, token TokenSource) *Client {
+	t.Helper()
+	c, err := New(Options{Addr: s.ln.Addr().String(), Token: token, RequestTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(Options{}); err == nil {
+		t.Error("New accepted options without an address")
+	}
+	c, err := New(Options{Addr: "localhost:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.opts.PoolSize != DefaultPoolSize || c.opts.DialTimeout != DefaultDialTimeout || c.opts.RequestTimeout != DefaultRequestTimeout {
+		t.Errorf("defaults not applied: %+v", c.opts)
+	}
+}
+
+func TestDecodeAnswer(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  quill.Packet
+		want    string // Status decoded, or the *Error code
+		wantErr bool
+	}{
+		{"response", quill.Packet{Type: quill.PacketTypePingResponse, Payload: json.RawMessage(`{"status":"OK"}`)}, "OK", false},
+		{"empty payload", quill.Packet{Type: quill.PacketTypePingResponse}, "", false},
+		{"error response", quill.Packet{Type: quill.PacketTypeErrorResponse, Payload: json.RawMessage(`{"code":"NOT_FOUND","message":"gone"}`)}, quill.ErrorCodeNotFound, true},
+		{"broken error", quill.Packet{Type: quill.PacketTypeErrorResponse, Payload: json.RawMessage(`{`)}, "", true},
+		{"broken response", quill.Packet{Type: quill.PacketTypePingResponse, Payload: json.RawMessage(`[]`)}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp quill.PingResponsePayload
+			err := decodeAnswer(&tt.packet, &resp)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeAnswer() = %v, want error %v", err, tt.wantErr)
+			}
+			var qe *Error
+			switch {
+			case errors.As(err, &qe):
+				if qe.Code != tt.want {
+					t.Errorf("code = %q, want %q", qe.Code, tt.want)
+				}
+			case err == nil && resp.Status != tt.want:
+				t.Errorf("status = %q, want %q", resp.Status, tt.want)
+			}
+		})
+	}
+	if err := decodeAnswer(&quill.Packet{Type: quill.PacketTypePingResponse, Payload: json.RawMessage(`{}`)}, nil); err != nil {
+		t.Errorf("decodeAnswer without resp = %v", err)
+	}
+}
+
+func TestMayRetry(t *testing.T) {
+	c := &Client{}
+	tests := []struct {
+		name       string
+		err        error
+		packetType string
+		want       bool
+	}{
+		{"closed", ErrClosed, quill.PacketTypePing, false},
+		{"cancelled", context.Canceled, quill.PacketTypePing, false},
+		{"timed out", fmt.Errorf("wait: %w", context.DeadlineExceeded), quill.PacketTypePing, false},
+		{"never sent", &connError{err: net.ErrClosed}, quill.PacketTypeSend, true},
+		{"sent and repeatable", &connError{err: net.ErrClosed, sent: true}, quill.PacketTypeFetch, true},
+		{"sent and not repeatable", &connError{err: net.ErrClosed, sent: true}, quill.PacketTypeSend, false},
+		{"server answered", &Error{Code: quill.ErrorCodeSessionExpired}, quill.PacketTypePing, false},
+		{"dial failed", errors.New("connection refused"), quill.PacketTypeSend, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.mayRetry(tt.err, tt.packetType); got != tt.want {
+				t.Errorf("mayRetry(%v, %s) = %v, want %v", tt.err, tt.packetType, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignInAndRefresh(t *testing.T) {
+	expired := 1 // PINGs to answer with SESSION_EXPIRED
+	var mu sync.Mutex
+	s := newFakeServer(t, func(p *quill.Packet, reply func(string, interface{})) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if p.Type == quill.PacketTypePing && p.SessionToken == "s1" && expired > 0 {
+			expired--
+			reply(quill.PacketTypeErrorResponse, quill.ErrorResponsePayload{Code: quill.ErrorCodeSessionExpired})
+			return true
+		}
+		return standard(p, reply)
+	})
+	c := newTestClient(t, s, StaticToken("key"))
+
+	if _, err := c.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if caps := c.Capabilities(); caps == nil || caps.Version != "1.2" {
+		t.Errorf("Capabilities() = %+v, want version 1.2", caps)
+	}
+	if _, err := c.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"HELLO ", "AUTH ", "PING s1", "AUTH ", "PING s2", "PING s2"}
+	if got := s.packets(); !reflect.DeepEqual(got, want) {
+		t.Errorf("packets = %q, want %q", got, want)
+	}
+}
+
+func TestSignInFails(t *testing.T) {
+	s := newFakeServer(t, standard)
+	tokenErr := errors.New("no token")
+	tests := []struct {
+		name  string
+		token TokenSource
+		check func(error) bool
+	}{
+		{"token source fails", func(context.Context) (string, error) { return "", tokenErr }, func(err error) bool { return errors.Is(err, tokenErr) }},
+		{"server refuses", StaticToken("wrong"), func(err error) bool {
+			var qe *Error
+			return errors.As(err, &qe) && qe.Code == quill.ErrorCodeAuthFailed
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, s, tt.token)
+			if _, err := c.Ping(context.Background()); !tt.check(err) {
+				t.Errorf("Ping() = %v", err)
+			}
+		})
+	}
+}
+
+func TestLegacyServer(t *testing.T) {
+	s := newFakeServer(t, func(p *quill.Packet, reply func(string, interface{})) bool {
+		if p.Type == quill.PacketTypeHello {
+			reply(quill.PacketTypeErrorResponse, quill.ErrorResponsePayload{Code: quill.ErrorCodeUnknownType})
+			return true
+		}
+		if p.Version != "1.0" {
+			reply(quill.PacketTypeErrorResponse, quill.ErrorResponsePayload{Code: quill.ErrorCodeUnsupportedVersion})
+			return true
+		}
+		return standard(p, reply)
+	})
+	c := newTestClient(t, s, nil)
+	if _, err := c.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if caps := c.Capabilities(); caps != nil {
+		t.Errorf("Capabilities() = %+v from a server without HELLO", caps)
+	}
+}
+
+func TestRequestCorrelation(t *testing.T) {
+	// The server answers in order, however long each request takes.
+	s := newFakeServer(t, func(p *quill.Packet, reply func(string, interface{})) bool {
+		if p.Type != quill.PacketTypeFetch {
+			return standard(p, reply)
+		}
+		var req quill.FetchPayload
+		json.Unmarshal(p.Payload, &req)
+		reply(quill.PacketTypeFetchResponse, quill.FetchResponsePayload{Status: quill.StatusOK, NextCursor: req.Folder})
+		return true
+	})
+	c, err := New(Options{Addr: s.ln.Addr().String(), PoolSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(folder string) {
+			defer wg.Done()
+			resp, err := c.Fetch(context.Background(), &quill.FetchPayload{Mode: "folder", Folder: folder})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if resp.NextCursor != folder {
+				t.Errorf("fetch of %s answered for %s", folder, resp.NextCursor)
+			}
+		}(fmt.Sprintf("f%d", i))
+	}
+	wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dials != 1 {
+		t.Errorf("dialled %d connections, want 1 with a pool of 1", s.dials)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	var mu sync.Mutex
+	drops := map[string]int{quill.PacketTypePing: 1, quill.PacketTypeSend: 1}
+	s := newFakeServer(t, func(p *quill.Packet, reply func(string, interface{})) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if drops[p.Type] > 0 {
+			drops[p.Type]--
+			return false
+		}
+		return standard(p, reply)
+	})
+	c := newTestClient(t, s, nil)
+
+	if _, err := c.Ping(context.Background()); err != nil {
+		t.Fatalf("PING after a dropped connection: %v", err)
+	}
+	// SEND reached the server, so it is not sent again.
+	var ce *connError
+	if _, err := c.Send(context.Background(), &quill.SendPayload{}); !errors.As(err, &ce) {
+		t.Fatalf("Send() = %v, want a connection error", err)
+	}
+	if _, err := c.Send(context.Background(), &quill.SendPayload{}); err != nil {
+		t.Fatalf("SEND on a fresh connection: %v", err)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	s := newFakeServer(t, func(p *quill.Packet, reply func(string, interface{})) bool {
+		if p.Type == quill.PacketTypePing {
+			return true // never answered
+		}
+		return standard(p, reply)
+	})
+	c := newTestClient(t, s, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.Ping(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Ping() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	s := newFakeServer(t, standard)
+	c := newTestClient(t, s, nil)
+	c.Close()
+	if _, err := c.Ping(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Ping() = %v, want %v", err, ErrClosed)
+	}
+	if _, err := c.Subscribe(context.Background(), func(*quill.NewMailPayload) {}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Subscribe() = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	s := newFakeServer(t, func(p *quill.Packet, reply func(string, interface{})) bool {
+		if p.Type == quill.PacketTypeSubscribe {
+			reply(quill.PacketTypeSubscribeResponse, map[string]string{"status": quill.StatusOK})
+			reply(quill.PacketTypeNewMail, quill.NewMailPayload{Status: quill.StatusOK, Change: quill.ChangeDTO{MessageID: "m1"}})
+			return true
+		}
+		return standard(p, reply)
+	})
+	c := newTestClient(t, s, StaticToken("key"))
+
+	got := make(chan string, 1)
+	sub, err := c.Subscribe(context.Background(), func(m *quill.NewMailPayload) { got <- m.Change.MessageID })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	select {
+	case id := <-got:
+		if id != "m1" {
+			t.Errorf("pushed %q, want m1", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no NEW_MAIL delivered")
+	}
+	if packets := s.packets(); packets[len(packets)-1] != "SUBSCRIBE s1" {
+		t.Errorf("packets = %q, want a SUBSCRIBE with the session last", packets)
+	}
+
+	// A failed subscription leaves no handler behind.
+	s.ln.Close()
+	c2 := newTestClient(t, s, nil)
+	if _, err := c2.Subscribe(context.Background(), func(*quill.NewMailPayload) {}); err == nil {
+		t.Error("Subscribe() to an unreachable server succeeded")
+	}
+	if len(c2.push.handlers) != 0 {
+		t.Errorf("handlers left after a failed Subscribe: %d", len(c2.push.handlers))
+	}
+}
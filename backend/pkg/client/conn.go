@@ -0,0 +1,248 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"quill/pkg/transport/quill"
+)
+
+// conn is one connection to the server. The server answers the packets of
+// a connection in the order they arrive, so responses are matched to
+// requests first in, first out. Packets that answer nothing, NEW_MAIL and
+// the error that ends a subscription, go to push.
+type conn struct {
+	nc      net.Conn
+	version string // negotiated by HELLO
+	push    func(*quill.Packet)
+
+	wmu sync.Mutex // keeps the queue in the order packets are written
+	enc *json.Encoder
+
+	mu      sync.Mutex
+	pending []*call
+	err     error // why the connection broke, once it has
+	done    chan struct{}
+}
+
+type call struct {
+	// ch is buffered so that the reader never waits for a caller that has
+	// given up; it is closed if the connection breaks first.
+	ch chan *quill.Packet
+}
+
+// connError is a failure of the connection rather than an answer.
+type connError struct {
+	err error
+	// sent is false when the packet certainly never reached the server.
+	sent bool
+}
+
+func (e *connError) Error() string {
+	return "quill connection: " + e.err.Error()
+}
+
+func (e *connError) Unwrap() error {
+	return e.err
+}
+
+// dial connects and negotiates the protocol version. HELLO is optional for
+// servers that predate it, which are spoken to as 1.0.
+func dial(ctx context.Context, opts *Options, push func(*quill.Packet)) (*conn, *quill.CapabilitiesPayload, error) {
+	d := &net.Dialer{Timeout: opts.DialTimeout}
+	var (
+		nc  net.Conn
+		err error
+	)
+	if opts.TLSConfig != nil {
+		nc, err = (&tls.Dialer{NetDialer: d, Config: opts.TLSConfig}).DialContext(ctx, "tcp", opts.Addr)
+	} else {
+		nc, err = d.DialContext(ctx, "tcp", opts.Addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := &conn{nc: nc, version: quill.ProtocolVersion, push: push, enc: json.NewEncoder(nc), done: make(chan struct{})}
+	go c.readLoop(json.NewDecoder(nc))
+
+	var caps quill.CapabilitiesPayload
+	err = c.do(ctx, quill.PacketTypeHello, "", quill.HelloPayload{
+		Versions: []string{quill.ProtocolVersion},
+		Client:   opts.ClientName,
+	}, &caps)
+	var qe *Error
+	switch {
+	case err == nil:
+		c.version = caps.Version
+		return c, &caps, nil
+	case errors.As(err, &qe) && qe.Code == quill.ErrorCodeUnknownType:
+		c.version = "1.0"
+		return c, nil, nil
+	default:
+		c.close()
+		return nil, nil, err
+	}
+}
+
+func (c *conn) readLoop(dec *json.Decoder) {
+	for {
+		var p quill.Packet
+		if err := dec.Decode(&p); err != nil {
+			c.fail(err)
+			return
+		}
+		if p.Type == quill.PacketTypeNewMail {
+			if c.push != nil {
+				c.push(&p)
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		if len(c.pending) == 0 {
+			c.mu.Unlock()
+			if c.push != nil {
+				c.push(&p)
+			}
+			continue
+		}
+		next := c.pending[0]
+		c.pending = c.pending[1:]
+		c.mu.Unlock()
+		next.ch <- &p
+	}
+}
+
+// roundTrip writes p and waits for its answer. A caller that gives up
+// leaves its place in the queue, and the answer is dropped when it comes.
+func (c *conn) roundTrip(ctx context.Context, p *quill.Packet) (*quill.Packet, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cl := &call{ch: make(chan *quill.Packet, 1)}
+
+	c.wmu.Lock()
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		c.wmu.Unlock()
+		return nil, &connError{err: err}
+	}
+	c.pending = append(c.pending, cl)
+	c.mu.Unlock()
+	deadline, _ := ctx.Deadline()
+	_ = c.nc.SetWriteDeadline(deadline)
+	err := c.enc.Encode(p)
+	c.wmu.Unlock()
+	if err != nil {
+		// Part of the packet may have gone out, so the stream is lost.
+		c.fail(err)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &connError{err: err, sent: true}
+	}
+
+	select {
+	case resp, ok := <-cl.ch:
+		if !ok {
+			c.mu.Lock()
+			err := c.err
+			c.mu.Unlock()
+			return nil, &connError{err: err, sent: true}
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// do sends one request and decodes its answer into resp.
+func (c *conn) do(ctx context.Context, packetType, token string, req, resp interface{}) error {
+	p, err := newPacket(packetType, c.version, token, req)
+	if err != nil {
+		return err
+	}
+	answer, err := c.roundTrip(ctx, p)
+	if err != nil {
+		return err
+	}
+	return decodeAnswer(answer, resp)
+}
+
+func newPacket(packetType, version, token string, req interface{}) (*quill.Packet, error) {
+	p := &quill.Packet{
+		Protocol:     quill.ProtocolName,
+		Version:      version,
+		Type:         packetType,
+		SessionToken: token,
+		Timestamp:    time.Now().UTC(),
+	}
+	if req != nil {
+		payload, err := json.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		p.Payload = payload
+	}
+	return p, nil
+}
+
+// decodeAnswer turns an ERROR_RESPONSE into *Error and anything else into
+// resp, which may be nil.
+func decodeAnswer(p *quill.Packet, resp interface{}) error {
+	if p.Type == quill.PacketTypeErrorResponse {
+		var e quill.ErrorResponsePayload
+		if err := json.Unmarshal(p.Payload, &e); err != nil {
+			return err
+		}
+		return &Error{Code: e.Code, Message: e.Message}
+	}
+	if resp == nil || len(p.Payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(p.Payload, resp)
+}
+
+// fail breaks the connection and wakes everyone waiting on it.
+func (c *conn) fail(err error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	pending := c.pending
+	c.pending = nil
+	close(c.done)
+	c.mu.Unlock()
+
+	_ = c.nc.Close()
+	for _, cl := range pending {
+		close(cl.ch)
+	}
+}
+
+func (c *conn) close() {
+	c.fail(net.ErrClosed)
+}
+
+func (c *conn) alive() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err == nil
+}
+
+// load is the number of requests still waiting for an answer.
+func (c *conn) load() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
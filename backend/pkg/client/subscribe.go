@@ -0,0 +1,234 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"quill/pkg/transport/quill"
+)
+
+const (
+	// pushBuffer is how many pushed messages may wait for the handlers
+	// before the push connection stops reading.
+	pushBuffer = 64
+	// maxResubscribeDelay caps the wait between attempts to reconnect the
+	// push connection.
+	maxResubscribeDelay = 30 * time.Second
+)
+
+// pusher keeps one connection, outside the pool, subscribed to NEW_MAIL
+// while any handler is registered.
+type pusher struct {
+	start sync.Mutex // serializes starting and stopping
+
+	mu       sync.Mutex
+	handlers map[int]func(*quill.NewMailPayload)
+	nextID   int
+	cancel   context.CancelFunc // ends the running subscription; nil if none
+	poke     chan struct{}      // asks the running subscription to SUBSCRIBE again
+}
+
+// pushRun is one running subscription.
+type pushRun struct {
+	ctx    context.Context
+	events chan *quill.NewMailPayload
+	poke   chan struct{}
+}
+
+// Subscription is a handler registered with Subscribe.
+type Subscription struct {
+	c  *Client
+	id int
+}
+
+// Subscribe calls fn for each message that arrives in the signed-in user's
+// mailbox, one call at a time and in order of arrival. The subscription
+// survives dropped connections and session refreshes, but pushes are best
+// effort: mail arriving while it reconnects is not pushed, so clients that
+// need every message SYNC as well.
+func (c *Client) Subscribe(ctx context.Context, fn func(*quill.NewMailPayload)) (*Subscription, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+
+	p := &c.push
+	p.start.Lock()
+	defer p.start.Unlock()
+
+	p.mu.Lock()
+	if p.handlers == nil {
+		p.handlers = make(map[int]func(*quill.NewMailPayload))
+	}
+	p.nextID++
+	id := p.nextID
+	p.handlers[id] = fn
+	running := p.cancel != nil
+	p.mu.Unlock()
+	if running {
+		return &Subscription{c: c, id: id}, nil
+	}
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	run := &pushRun{
+		ctx:    runCtx,
+		events: make(chan *quill.NewMailPayload, pushBuffer),
+		poke:   make(chan struct{}, 1),
+	}
+	cn, err := c.subscribeConn(ctx, run)
+	if err != nil {
+		cancel()
+		p.mu.Lock()
+		delete(p.handlers, id)
+		p.mu.Unlock()
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.cancel = cancel
+	p.poke = run.poke
+	p.mu.Unlock()
+	go c.keepSubscribed(run, cn)
+	go c.deliver(run)
+	return &Subscription{c: c, id: id}, nil
+}
+
+// Close unregisters the handler. The push connection closes with the last
+// one.
+func (s *Subscription) Close() {
+	p := &s.c.push
+	p.start.Lock()
+	defer p.start.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.handlers, s.id)
+	if len(p.handlers) == 0 && p.cancel != nil {
+		p.cancel()
+		p.cancel, p.poke = nil, nil
+	}
+}
+
+func (c *Client) stopPush() {
+	p := &c.push
+	p.start.Lock()
+	defer p.start.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.handlers = nil
+	if p.cancel != nil {
+		p.cancel()
+		p.cancel, p.poke = nil, nil
+	}
+}
+
+// sessionChanged makes the running subscription use the new session, as
+// the server ends a subscription when its session is refreshed.
+func (c *Client) sessionChanged() {
+	p := &c.push
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.poke != nil {
+		select {
+		case p.poke <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// subscribeConn dials the push connection and subscribes on it.
+func (c *Client) subscribeConn(ctx context.Context, run *pushRun) (*conn, error) {
+	push := func(pk *quill.Packet) {
+		switch pk.Type {
+		case quill.PacketTypeNewMail:
+			var m quill.NewMailPayload
+			if err := json.Unmarshal(pk.Payload, &m); err != nil {
+				log.Printf("WARN: quill client cannot parse NEW_MAIL: %v", err)
+				return
+			}
+			select {
+			case run.events <- &m:
+			case <-run.ctx.Done():
+			}
+		case quill.PacketTypeErrorResponse:
+			// The server ended the subscription, e.g. because its session
+			// was revoked.
+			select {
+			case run.poke <- struct{}{}:
+			default:
+			}
+		}
+	}
+
+	cn, _, err := dial(ctx, &c.opts, push)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.do(ctx, cn, quill.PacketTypeSubscribe, quill.SubscribePayload{Action: quill.SubscribeActionStart}, nil); err != nil {
+		cn.close()
+		return nil, err
+	}
+	return cn, nil
+}
+
+// keepSubscribed subscribes again when asked to and reconnects when the
+// push connection drops, backing off while the server is unreachable.
+func (c *Client) keepSubscribed(run *pushRun, cn *conn) {
+	for {
+		select {
+		case <-run.ctx.Done():
+			cn.close()
+			return
+		case <-run.poke:
+			err := c.do(run.ctx, cn, quill.PacketTypeSubscribe, quill.SubscribePayload{Action: quill.SubscribeActionStart}, nil)
+			if err != nil && run.ctx.Err() == nil {
+				log.Printf("WARN: quill client could not renew its subscription: %v", err)
+				cn.close()
+			}
+		case <-cn.done:
+			for attempt := 1; ; attempt++ {
+				delay := time.Duration(attempt) * time.Second
+				if delay > maxResubscribeDelay {
+					delay = maxResubscribeDelay
+				}
+				select {
+				case <-time.After(delay):
+				case <-run.ctx.Done():
+					return
+				}
+				next, err := c.subscribeConn(run.ctx, run)
+				if err == nil {
+					cn = next
+					break
+				}
+				log.Printf("WARN: quill client could not resubscribe: %v", err)
+			}
+		}
+	}
+}
+
+// deliver calls the handlers for each pushed message.
+func (c *Client) deliver(run *pushRun) {
+	for {
+		select {
+		case <-run.ctx.Done():
+			return
+		case m := <-run.events:
+			c.push.mu.Lock()
+			handlers := make([]func(*quill.NewMailPayload), 0, len(c.push.handlers))
+			for _, fn := range c.push.handlers {
+				handlers = append(handlers, fn)
+			}
+			c.push.mu.Unlock()
+			for _, fn := range handlers {
+				fn(m)
+			}
+		}
+	}
+}
@@ -0,0 +1,309 @@
+// Package config loads the server configuration: a YAML file, overridden
+// by environment variables, validated before use.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the whole server configuration. Fields tagged env can be
+// overridden by that environment variable; lists are comma separated and
+// maps are comma separated key=value pairs.
+type Config struct {
+	Listen     ListenConfig     `yaml:"listen"`
+	TLS        TLSConfig        `yaml:"tls"`
+	Domains    []DomainConfig   `yaml:"domains" env:"QUILL_DOMAINS"` // the first one is the primary domain
+	Storage    StorageConfig    `yaml:"storage"`
+	Auth       AuthConfig       `yaml:"auth"`
+	Limits     LimitsConfig     `yaml:"limits"`
+	Federation FederationConfig `yaml:"federation"`
+	SMTP       SMTPConfig       `yaml:"smtp"`
+	IMAP       IMAPConfig       `yaml:"imap"`
+
+	// Admins are account IDs granted the admin role at startup.
+	Admins    []string `yaml:"admins" env:"QUILL_ADMINS"`
+	ExportDir string   `yaml:"export_dir" env:"QUILL_EXPORT_DIR"`
+	// WebSocketOrigins are the web origins besides the server's own whose
+	// pages may open /ws; "*" allows any.
+	WebSocketOrigins []string `yaml:"websocket_origins" env:"QUILL_WEBSOCKET_ORIGINS"`
+}
+
+type ListenConfig struct {
+	Quill string `yaml:"quill" env:"QUILL_LISTEN"`
+	HTTP  string `yaml:"http" env:"QUILL_HTTP_LISTEN"`
+}
+
+type TLSConfig struct {
+	CertFile string     `yaml:"cert_file" env:"QUILL_TLS_CERT"`
+	KeyFile  string     `yaml:"key_file" env:"QUILL_TLS_KEY"`
+	ACME     ACMEConfig `yaml:"acme"`
+}
+
+// ACMEConfig is the ACME account used for domains with acme set. Challenges
+// are answered with tls-alpn-01 on the TLS listeners and, when
+// HTTPChallengeListen is set, with http-01.
+type ACMEConfig struct {
+	DirectoryURL string `yaml:"directory_url" env:"QUILL_ACME_DIRECTORY"` // empty is Let's Encrypt
+	Email        string `yaml:"email" env:"QUILL_ACME_EMAIL"`
+	CacheDir     string `yaml:"cache_dir" env:"QUILL_ACME_CACHE"`
+	// RootCAFile is trusted for the directory in addition to the system
+	// roots, e.g. the certificate of a local Pebble test server.
+	RootCAFile          string `yaml:"root_ca_file" env:"QUILL_ACME_ROOT_CA"`
+	HTTPChallengeListen string `yaml:"http_challenge_listen" env:"QUILL_ACME_HTTP_LISTEN"`
+}
+
+// DomainConfig describes one hosted domain. In YAML and in QUILL_DOMAINS a
+// bare name stands for a domain with the default settings.
+type DomainConfig struct {
+	Name string `yaml:"name"`
+	// CertFile and KeyFile are served via SNI for this domain; empty uses
+	// the tls section's certificate. With ACME set the certificate is
+	// obtained and renewed automatically instead.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	ACME     bool   `yaml:"acme"`
+	// FederationCertFile and FederationKeyFile identify this domain to the
+	// servers it relays to; empty uses the domain's own certificate.
+	FederationCertFile string `yaml:"federation_cert_file"`
+	FederationKeyFile  string `yaml:"federation_key_file"`
+	// DKIMKeyFile holds the PEM-encoded RSA key signing the domain's
+	// outbound email; its public key is published in DNS at
+	// <DKIMSelector>._domainkey.<Name>.
+	DKIMSelector string       `yaml:"dkim_selector"`
+	DKIMKeyFile  string       `yaml:"dkim_key_file"`
+	Policy       DomainPolicy `yaml:"policy"`
+}
+
+// DomainPolicy holds per-domain rules. Zero limits keep the server limits.
+type DomainPolicy struct {
+	Signup            string `yaml:"signup"` // "open" (default) or "closed": only admins assign addresses
+	MaxMessageBytes   int64  `yaml:"max_message_bytes"`
+	DefaultQuotaBytes int64  `yaml:"default_quota_bytes"`
+}
+
+func (d *DomainConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&d.Name)
+	}
+	type plain DomainConfig
+	return node.Decode((*plain)(d))
+}
+
+func (d *DomainConfig) UnmarshalText(text []byte) error {
+	d.Name = string(text)
+	return nil
+}
+
+type StorageConfig struct {
+	Backend  string        `yaml:"backend" env:"QUILL_STORAGE"` // only "mongodb" for now
+	URI      string        `yaml:"uri" env:"MONGODB_URI"`
+	Password string        `yaml:"password" env:"mongodb_password"` // replaces <db_password> in URI
+	Database string        `yaml:"database" env:"MONGODB_DATABASE"`
+	Timeout  time.Duration `yaml:"timeout" env:"MONGODB_TIMEOUT"`
+}
+
+type AuthConfig struct {
+	Backends               []string `yaml:"backends" env:"QUILL_AUTH_BACKENDS"` // "firebase", "jwt", "credentials"
+	FirebaseServiceAccount string   `yaml:"firebase_service_account" env:"firebase_service_account_path"`
+	JWTKeys                string   `yaml:"jwt_keys" env:"QUILL_JWT_KEYS"`
+	JWTIssuer              string   `yaml:"jwt_issuer" env:"QUILL_JWT_ISSUER"`
+	JWTAudience            string   `yaml:"jwt_audience" env:"QUILL_JWT_AUDIENCE"`
+}
+
+// LimitsConfig bounds message sizes and storage. Zero keeps the server default.
+type LimitsConfig struct {
+	MaxMessageBytes   int64 `yaml:"max_message_bytes" env:"QUILL_MAX_MESSAGE_BYTES"`
+	MaxAttachments    int   `yaml:"max_attachments" env:"QUILL_MAX_ATTACHMENTS"`
+	DefaultQuotaBytes int64 `yaml:"default_quota_bytes" env:"QUILL_DEFAULT_QUOTA_BYTES"`
+}
+
+type FederationConfig struct {
+	// Peers maps a remote Quill domain to the host:port of its server.
+	// Domains not listed are reached at domain:DefaultPort.
+	Peers       map[string]string `yaml:"peers" env:"QUILL_FEDERATION_PEERS"`
+	DefaultPort string            `yaml:"default_port" env:"QUILL_FEDERATION_PORT"`
+	// CAFile holds certificates trusted for peer servers in addition to
+	// the system roots. Peers must present a certificate for their domain.
+	CAFile      string        `yaml:"ca_file" env:"QUILL_FEDERATION_CA"`
+	DialTimeout time.Duration `yaml:"dial_timeout" env:"QUILL_FEDERATION_DIAL_TIMEOUT"`
+	// MutualTLS presents the sending domain's certificate when relaying and
+	// accepts relayed mail from peers whose certificate covers the sending
+	// domain. Without it inbound relays are refused.
+	MutualTLS bool `yaml:"mutual_tls" env:"QUILL_FEDERATION_MTLS"`
+}
+
+// PeerAddress is where the Quill server for peerDomain listens: its
+// configured peer entry, or the domain itself on the default port.
+func (f *FederationConfig) PeerAddress(peerDomain string) string {
+	if addr, ok := f.Peers[peerDomain]; ok {
+		return addr
+	}
+	return net.JoinHostPort(peerDomain, f.DefaultPort)
+}
+
+// SMTPConfig is the exchange of mail with regular email servers: the
+// gateway accepting mail for the hosted domains and the outbound queue.
+type SMTPConfig struct {
+	Listen   string `yaml:"listen" env:"QUILL_SMTP_LISTEN"`     // empty disables the gateway
+	Hostname string `yaml:"hostname" env:"QUILL_SMTP_HOSTNAME"` // greeting name; empty is the primary domain
+	// RejectSPFFail refuses mail whose sender's SPF policy says the
+	// connecting server must not send for it. Other results are only logged.
+	RejectSPFFail bool `yaml:"reject_spf_fail" env:"QUILL_SMTP_REJECT_SPF_FAIL"`
+
+	// Smarthost (host:port) relays all outbound mail, authenticating with
+	// the username and password if set. Empty delivers straight to the
+	// recipient domains' MX hosts.
+	Smarthost         string `yaml:"smarthost" env:"QUILL_SMTP_SMARTHOST"`
+	SmarthostUsername string `yaml:"smarthost_username" env:"QUILL_SMTP_SMARTHOST_USERNAME"`
+	SmarthostPassword string `yaml:"smarthost_password" env:"QUILL_SMTP_SMARTHOST_PASSWORD"`
+	// QueueLifetime is how long undeliverable mail is retried before it is
+	// returned to the sender.
+	QueueLifetime time.Duration `yaml:"queue_lifetime" env:"QUILL_SMTP_QUEUE_LIFETIME"`
+}
+
+// IMAPConfig is the read-only IMAP access to mailboxes for standard mail
+// clients, which sign in with an app password.
+type IMAPConfig struct {
+	Listen string `yaml:"listen" env:"QUILL_IMAP_LISTEN"` // empty disables IMAP
+	// ImplicitTLS serves TLS from the first byte (port 993) instead of
+	// offering STARTTLS. Either way, logins are only accepted over TLS.
+	ImplicitTLS bool `yaml:"implicit_tls" env:"QUILL_IMAP_IMPLICIT_TLS"`
+}
+
+// Default is the configuration used for anything the file and the
+// environment leave unset. It matches what the server used to hardcode.
+func Default() *Config {
+	return &Config{
+		Listen: ListenConfig{
+			Quill: "localhost:9876",
+			HTTP:  "localhost:8080",
+		},
+		TLS: TLSConfig{
+			CertFile: "../certificate/quill.crt",
+			KeyFile:  "../certificate/quill.key",
+			ACME: ACMEConfig{
+				CacheDir: "../certificate/acme",
+			},
+		},
+		Domains: []DomainConfig{{Name: "quillmail.xyz"}},
+		Storage: StorageConfig{
+			Backend:  "mongodb",
+			URI:      "mongodb://localhost:27017",
+			Database: "quill",
+			Timeout:  10 * time.Second,
+		},
+		Auth: AuthConfig{
+			Backends: []string{"firebase"},
+		},
+		Federation: FederationConfig{
+			DefaultPort: "9876",
+			CAFile:      "../certificate/quill.crt",
+			DialTimeout: 10 * time.Second,
+		},
+		SMTP: SMTPConfig{
+			RejectSPFFail: true,
+			QueueLifetime: 72 * time.Hour,
+		},
+		ExportDir: "../exports",
+	}
+}
+
+// Load reads the YAML file at path on top of the defaults, applies the
+// environment and the .env file at envPath, and validates the result.
+// Missing files are not an error: environment variables alone are enough
+// for containers and CI. Load is called again on reload, so it reads both
+// files afresh and never modifies the process environment.
+func Load(path, envPath string) (*Config, error) {
+	var dotenv map[string]string
+	if envPath != "" {
+		var err error
+		dotenv, err = godotenv.Read(envPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("loading %s: %w", envPath, err)
+		}
+	}
+
+	cfg := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		switch {
+		case err == nil:
+			if err := yaml.Unmarshal(data, cfg); err != nil {
+				return nil, fmt.Errorf("parsing %s: %w", path, err)
+			}
+		case !errors.Is(err, fs.ErrNotExist):
+			return nil, err
+		}
+	}
+	if err := applyEnv(cfg, dotenv); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// RestartRequired lists the settings that differ from old but only take
+// effect on restart. Everything else is applied on reload.
+func (c *Config) RestartRequired(old *Config) []string {
+	var changed []string
+	if c.Listen != old.Listen {
+		changed = append(changed, "listen")
+	}
+	if c.TLS.ACME.HTTPChallengeListen != old.TLS.ACME.HTTPChallengeListen {
+		changed = append(changed, "tls.acme.http_challenge_listen")
+	}
+	if c.SMTP.Listen != old.SMTP.Listen || c.SMTP.Hostname != old.SMTP.Hostname || c.SMTP.RejectSPFFail != old.SMTP.RejectSPFFail {
+		changed = append(changed, "smtp")
+	}
+	if c.IMAP != old.IMAP {
+		changed = append(changed, "imap")
+	}
+	if c.Storage != old.Storage {
+		changed = append(changed, "storage")
+	}
+	if !equalStrings(c.Auth.Backends, old.Auth.Backends) ||
+		c.Auth.FirebaseServiceAccount != old.Auth.FirebaseServiceAccount ||
+		c.Auth.JWTKeys != old.Auth.JWTKeys ||
+		c.Auth.JWTIssuer != old.Auth.JWTIssuer ||
+		c.Auth.JWTAudience != old.Auth.JWTAudience {
+		changed = append(changed, "auth")
+	}
+	if c.ExportDir != old.ExportDir {
+		changed = append(changed, "export_dir")
+	}
+	if !equalStrings(c.WebSocketOrigins, old.WebSocketOrigins) {
+		changed = append(changed, "websocket_origins")
+	}
+	return changed
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ConnectionURI is URI with the <db_password> placeholder filled in.
+func (s StorageConfig) ConnectionURI() string {
+	if s.Password != "" && strings.Contains(s.URI, "<db_password>") {
+		return strings.Replace(s.URI, "<db_password>", s.Password, 1)
+	}
+	return s.URI
+}
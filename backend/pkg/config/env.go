@@ -0,0 +1,126 @@
+package config
+
+import (
+	"encoding"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	durationType        = reflect.TypeOf(time.Duration(0))
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// applyEnv overrides every field tagged env whose variable is set and
+// non-empty, descending into nested structs. The process environment wins
+// over dotenv, the contents of the .env file.
+func applyEnv(cfg *Config, dotenv map[string]string) error {
+	lookup := func(name string) string {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+		return dotenv[name]
+	}
+	return applyEnvStruct(reflect.ValueOf(cfg).Elem(), lookup)
+}
+
+func applyEnvStruct(v reflect.Value, lookup func(string) string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, value := t.Field(i), v.Field(i)
+		if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+			if err := applyEnvStruct(value, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		name := field.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		raw := strings.TrimSpace(lookup(name))
+		if raw == "" {
+			continue
+		}
+		if err := setFromString(value, raw); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setFromString(v reflect.Value, raw string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		items := splitList(raw)
+		elem := v.Type().Elem()
+		switch {
+		case elem.Kind() == reflect.String:
+			v.Set(reflect.ValueOf(items))
+		case reflect.PointerTo(elem).Implements(textUnmarshalerType):
+			list := reflect.MakeSlice(v.Type(), len(items), len(items))
+			for i, item := range items {
+				u := list.Index(i).Addr().Interface().(encoding.TextUnmarshaler)
+				if err := u.UnmarshalText([]byte(item)); err != nil {
+					return err
+				}
+			}
+			v.Set(list)
+		default:
+			return fmt.Errorf("unsupported list type %s", v.Type())
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String || v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported map type %s", v.Type())
+		}
+		m := make(map[string]string)
+		for _, pair := range splitList(raw) {
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("expected key=value, got %q", pair)
+			}
+			m[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+		v.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func splitList(raw string) []string {
+	var items []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+var domainPattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,}$`)
+
+var authBackends = []string{"firebase", "jwt", "credentials"}
+
+// Validate reports every problem with the configuration at once.
+func (c *Config) Validate() error {
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Listen.Quill); err != nil {
+		add("listen.quill: %q is not a host:port address", c.Listen.Quill)
+	}
+	if _, _, err := net.SplitHostPort(c.Listen.HTTP); err != nil {
+		add("listen.http: %q is not a host:port address", c.Listen.HTTP)
+	}
+	if c.SMTP.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.SMTP.Listen); err != nil {
+			add("smtp.listen: %q is not a host:port address", c.SMTP.Listen)
+		}
+	}
+	if c.SMTP.Smarthost != "" {
+		if _, _, err := net.SplitHostPort(c.SMTP.Smarthost); err != nil {
+			add("smtp.smarthost: %q is not a host:port address", c.SMTP.Smarthost)
+		}
+	}
+	if c.IMAP.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.IMAP.Listen); err != nil {
+			add("imap.listen: %q is not a host:port address", c.IMAP.Listen)
+		}
+	}
+	if c.SMTP.QueueLifetime <= 0 {
+		add("smtp.queue_lifetime must be positive")
+	}
+	if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+		add("tls: cert_file and key_file are required")
+	}
+	if c.TLS.ACME.HTTPChallengeListen != "" {
+		if _, _, err := net.SplitHostPort(c.TLS.ACME.HTTPChallengeListen); err != nil {
+			add("tls.acme.http_challenge_listen: %q is not a host:port address", c.TLS.ACME.HTTPChallengeListen)
+		}
+	}
+
+	if len(c.Domains) == 0 {
+		add("domains: at least one domain is required")
+	}
+	seen := make(map[string]bool)
+	for i := range c.Domains {
+		d := &c.Domains[i]
+		d.Name = strings.ToLower(strings.TrimSpace(d.Name))
+		if !domainPattern.MatchString(d.Name) {
+			add("domains: %q is not a domain name", d.Name)
+		}
+		if seen[d.Name] {
+			add("domains: %q is listed twice", d.Name)
+		}
+		seen[d.Name] = true
+		if (d.CertFile == "") != (d.KeyFile == "") {
+			add("domains: %s needs both cert_file and key_file", d.Name)
+		}
+		if d.ACME && d.CertFile != "" {
+			add("domains: %s sets both acme and cert_file", d.Name)
+		}
+		if (d.FederationCertFile == "") != (d.FederationKeyFile == "") {
+			add("domains: %s needs both federation_cert_file and federation_key_file", d.Name)
+		}
+		if (d.DKIMSelector == "") != (d.DKIMKeyFile == "") {
+			add("domains: %s needs both dkim_selector and dkim_key_file", d.Name)
+		}
+		switch d.Policy.Signup {
+		case "", "open", "closed":
+		default:
+			add("domains: %s: unknown signup policy %q", d.Name, d.Policy.Signup)
+		}
+		if d.Policy.MaxMessageBytes < 0 || d.Policy.DefaultQuotaBytes < 0 {
+			add("domains: %s: limits must not be negative", d.Name)
+		}
+	}
+
+	switch c.Storage.Backend {
+	case "mongodb":
+		if c.Storage.URI == "" {
+			add("storage.uri is required for mongodb")
+		}
+		if c.Storage.Database == "" {
+			add("storage.database is required for mongodb")
+		}
+	default:
+		add("storage.backend: unknown backend %q", c.Storage.Backend)
+	}
+	if c.Storage.Timeout <= 0 {
+		add("storage.timeout must be positive")
+	}
+
+	if len(c.Auth.Backends) == 0 {
+		add("auth.backends: at least one backend is required")
+	}
+	for _, b := range c.Auth.Backends {
+		switch b {
+		case "firebase":
+			if c.Auth.FirebaseServiceAccount == "" {
+				add("auth.firebase_service_account is required for the firebase backend")
+			}
+		case "jwt":
+			if c.Auth.JWTKeys == "" {
+				add("auth.jwt_keys is required for the jwt backend")
+			}
+		case "credentials":
+		default:
+			add("auth.backends: unknown backend %q, expected one of %s", b, strings.Join(authBackends, ", "))
+		}
+	}
+
+	if c.Limits.MaxMessageBytes < 0 || c.Limits.MaxAttachments < 0 || c.Limits.DefaultQuotaBytes < 0 {
+		add("limits must not be negative")
+	}
+
+	for domain, addr := range c.Federation.Peers {
+		if !domainPattern.MatchString(domain) {
+			add("federation.peers: %q is not a domain name", domain)
+		}
+		if seen[domain] {
+			add("federation.peers: %s is hosted here", domain)
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			add("federation.peers: %q for %s is not a host:port address", addr, domain)
+		}
+	}
+	if c.Federation.DefaultPort == "" {
+		add("federation.default_port is required")
+	}
+	if c.Federation.DialTimeout <= 0 {
+		add("federation.dial_timeout must be positive")
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration is one numbered change to the database layout. Applied
+// migrations are recorded in the schema_migrations collection and never run
+// again, so Up must not be edited once released; add a new migration
+// instead. Up must be safe to repeat, as a run may fail halfway.
+type Migration struct {
+	ID          int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+}
+
+// AppliedMigration is the record of a migration that has run.
+type AppliedMigration struct {
+	ID          int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+// Migrations are in ID order.
+var Migrations = []Migration{
+	{1, "unique Quill addresses", func(ctx context.Context, db *mongo.Database) error {
+		return createIndexes(ctx, db, "users", mongo.IndexModel{
+			Keys:    bson.D{{Key: "userQuillMail", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		})
+	}},
+	{2, "mailbox and message lookups", func(ctx context.Context, db *mongo.Database) error {
+		if err := createIndexes(ctx, db, "mailboxes",
+			mongo.IndexModel{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "folder", Value: 1}, {Key: "receivedAt", Value: -1}}},
+			mongo.IndexModel{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "threadId", Value: 1}}},
+			mongo.IndexModel{Keys: bson.D{{Key: "messageId", Value: 1}}},
+		); err != nil {
+			return err
+		}
+		return createIndexes(ctx, db, "messages", mongo.IndexModel{Keys: bson.D{{Key: "messageId", Value: 1}}})
+	}},
+	{3, "mailbox change log", func(ctx context.Context, db *mongo.Database) error {
+		return createIndexes(ctx, db, "changes",
+			mongo.IndexModel{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "modseq", Value: 1}}})
+	}},
+	{4, "outbound queue", func(ctx context.Context, db *mongo.Database) error {
+		return createIndexes(ctx, db, "outbound",
+			mongo.IndexModel{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttempt", Value: 1}}},
+			mongo.IndexModel{Keys: bson.D{{Key: "messageId", Value: 1}}})
+	}},
+	{5, "redirects, credentials and audit log", func(ctx context.Context, db *mongo.Database) error {
+		if err := createIndexes(ctx, db, "address_redirects",
+			mongo.IndexModel{Keys: bson.D{{Key: "target", Value: 1}}},
+			mongo.IndexModel{Keys: bson.D{{Key: "owner", Value: 1}}},
+		); err != nil {
+			return err
+		}
+		if err := createIndexes(ctx, db, "credentials",
+			mongo.IndexModel{Keys: bson.D{{Key: "owner", Value: 1}}}); err != nil {
+			return err
+		}
+		return createIndexes(ctx, db, "audit_log",
+			mongo.IndexModel{Keys: bson.D{{Key: "target", Value: 1}, {Key: "at", Value: -1}}},
+			mongo.IndexModel{Keys: bson.D{{Key: "at", Value: -1}}},
+		)
+	}},
+}
+
+func createIndexes(ctx context.Context, db *mongo.Database, collection string, models ...mongo.IndexModel) error {
+	if _, err := db.Collection(collection).Indexes().CreateMany(ctx, models); err != nil {
+		return fmt.Errorf("indexing %s: %w", collection, err)
+	}
+	return nil
+}
+
+// AppliedMigrations returns the migrations that have run, in ID order.
+func (m *MongoDB) AppliedMigrations(ctx context.Context) ([]AppliedMigration, error) {
+	cursor, err := m.database.Collection("schema_migrations").Find(ctx, bson.M{},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var applied []AppliedMigration
+	if err := cursor.All(ctx, &applied); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// PendingMigrations returns the migrations that have not run yet.
+func (m *MongoDB) PendingMigrations(ctx context.Context) ([]Migration, error) {
+	applied, err := m.AppliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[int]bool, len(applied))
+	for _, a := range applied {
+		done[a.ID] = true
+	}
+	var pending []Migration
+	for _, mig := range Migrations {
+		if !done[mig.ID] {
+			pending = append(pending, mig)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate runs the pending migrations in order and returns those it
+// applied. It stops at the first failure, which is not recorded.
+func (m *MongoDB) Migrate(ctx context.Context) ([]Migration, error) {
+	pending, err := m.PendingMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var applied []Migration
+	for _, mig := range pending {
+		if err := mig.Up(ctx, m.database); err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", mig.ID, mig.Description, err)
+		}
+		if _, err := m.database.Collection("schema_migrations").InsertOne(ctx, AppliedMigration{
+			ID:          mig.ID,
+			Description: mig.Description,
+			AppliedAt:   time.Now().UTC(),
+		}); err != nil {
+			return applied, fmt.Errorf("recording migration %d: %w", mig.ID, err)
+		}
+		applied = append(applied, mig)
+	}
+	return applied, nil
+}
@@ -0,0 +1,14 @@
+package db
+
+import "testing"
+
+func TestMigrationsInOrder(t *testing.T) {
+	for i, m := range Migrations {
+		if m.ID != i+1 {
+			t.Errorf("migration %d has ID %d; IDs must count up from 1", i, m.ID)
+		}
+		if m.Description == "" || m.Up == nil {
+			t.Errorf("migration %d lacks a description or an Up", m.ID)
+		}
+	}
+}
@@ -3,12 +3,11 @@ package db
 import (
 	"context"
 	"fmt"
+	"log"
+
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-
-	"quill/pkg/models"
-	"quill/pkg/transport/quill"
 )
 
 // EnsureUniqueUserIndexes sets up unique indexes for userQuillMail
@@ -64,55 +63,6 @@ func (m *MongoDB) MessageIDExists(ctx context.Context, messageID string) (bool,
 	return true, nil // Document exists
 }
 
-// CreateUserDoc creates a new user document in the users collection.
-// It leverages MongoDB's unique indexes for UsersUID (_id) and UserQuillMail.
-// It returns true if the user was created successfully, false if a user with
-// the same UsersUID or UserQuillMail already exists.
-// The provided authToken must be a valid Firebase ID token and match the user's UID.
-func (m *MongoDB) CreateUserDoc(ctx context.Context, user *models.User, authToken string, authSvc quill.AuthService) (bool, error) {
-	// Verify the auth token
-	authCtx, err := authSvc.Authenticate(ctx, authToken)
-	if err != nil {
-		return false, fmt.Errorf("error authenticating token: %w", err)
-	}
-
-	// Extract the user ID from the authenticated context
-	userID, ok := quill.UserIDFromContext(authCtx)
-	if !ok {
-		return false, fmt.Errorf("no user ID found in authenticated context")
-	}
-
-	// Verify that the token's user ID matches the provided user's UID.
-	// This is a crucial security and authorization check.
-	if userID != user.UsersUID {
-		return false, fmt.Errorf("token user ID '%s' does not match provided user ID '%s'", userID, user.UsersUID)
-	}
-
-	collection := m.GetUsersCollection()
-
-	// Attempt to insert the user document.
-	// MongoDB will automatically enforce uniqueness for:
-	// 1. `_id` (mapped from `user.UsersUID` in your `models.User` struct)
-	// 2. `userQuillMail` (due to the unique index we've configured)
-	// UserEmail uniqueness is handled by Firebase directly via the Firebase UID.
-	_, err = collection.InsertOne(ctx, user)
-	if err != nil {
-		// Check if the error is due to a duplicate key violation.
-		// This handles duplicates for _id or userQuillMail.
-		if mongo.IsDuplicateKeyError(err) {
-			// A duplicate key error means a user with that _id or Quill mail already exists.
-			// Log the specific error for debugging but return false (user already exists).
-			fmt.Printf("User creation failed: Duplicate key error. User already exists based on UID or QuillMail. Error: %v\n", err)
-			return false, nil // User already exists
-		}
-		// Handle any other types of insertion errors.
-		return false, fmt.Errorf("error inserting user document: %w", err)
-	}
-
-	// If no error, the user document was successfully inserted.
-	return true, nil
-}
-
 // GetQuillMailByUserID retrieves the userQuillMail address for a user by their document ID (UsersUID).
 func (m *MongoDB) GetQuillMailByUserID(ctx context.Context, userID string) (string, error) {
 	collection := m.GetUsersCollection()
@@ -0,0 +1,198 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"quill/pkg/models"
+)
+
+// accountDeletionGracePeriod is how long a deletion request can be withdrawn
+// before the account and its mail are purged.
+const accountDeletionGracePeriod = 14 * 24 * time.Hour
+
+var ErrDeletionNotRequested = error(errorString("account deletion has not been requested"))
+
+// DeleteAccount schedules the caller's account for deletion. Until the grace
+// period ends the account keeps working and the request can be withdrawn
+// with CancelAccountDeletion; PurgeExpiredAccounts does the actual removal.
+func (s *MongoUserService) DeleteAccount(ctx context.Context) (*models.User, error) {
+	p, err := callerPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !p.Interactive() {
+		return nil, ErrPermissionDenied
+	}
+	user, err := s.loadUser(ctx, p.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if !user.DeleteAfter.IsZero() {
+		return user, nil
+	}
+	now := time.Now().UTC()
+	return s.setFields(ctx, p.AccountID, bson.M{
+		"deletionRequestedAt": now,
+		"deleteAfter":         now.Add(accountDeletionGracePeriod),
+	})
+}
+
+func (s *MongoUserService) CancelAccountDeletion(ctx context.Context) (*models.User, error) {
+	p, err := callerPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.loadUser(ctx, p.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if user.DeleteAfter.IsZero() {
+		return nil, ErrDeletionNotRequested
+	}
+	return s.updateUser(ctx, p.AccountID, bson.M{
+		"$set":   bson.M{"updatedAt": time.Now().UTC()},
+		"$unset": bson.M{"deletionRequestedAt": "", "deleteAfter": ""},
+	})
+}
+
+// PurgeExpiredAccounts removes every account whose grace period has ended
+// and returns their IDs, so callers can end any sessions still open.
+func (s *MongoUserService) PurgeExpiredAccounts(ctx context.Context) ([]string, error) {
+	cursor, err := s.db.Collection("users").Find(ctx, bson.M{"deleteAfter": bson.M{"$lte": time.Now().UTC()}})
+	if err != nil {
+		return nil, err
+	}
+	var users []models.User
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+
+	var purged []string
+	for i := range users {
+		if err := s.purgeAccount(ctx, &users[i]); err != nil {
+			log.Printf("Failed to purge account %s: %v", users[i].UsersUID, err)
+			continue
+		}
+		purged = append(purged, users[i].UsersUID)
+	}
+	return purged, nil
+}
+
+// purgeAccount deletes the user document and everything stored under the
+// account, then drops the messages nobody else still references. The user
+// document goes last so that a failed purge is retried on the next sweep.
+func (s *MongoUserService) purgeAccount(ctx context.Context, user *models.User) error {
+	id, addr := user.UsersUID, user.UserQuillMail
+
+	var messageIDs []string
+	if addr != "" {
+		ids, err := s.db.Collection("mailboxes").Distinct(ctx, "messageId", bson.M{"userId": addr})
+		if err != nil {
+			return err
+		}
+		for _, v := range ids {
+			if messageID, ok := v.(string); ok {
+				messageIDs = append(messageIDs, messageID)
+			}
+		}
+
+		byAddress := []struct {
+			collection string
+			filter     bson.M
+		}{
+			{"mailboxes", bson.M{"userId": addr}},
+			{"changes", bson.M{"userId": addr}},
+			{"folders", bson.M{"owner": addr}},
+			{"labels", bson.M{"owner": addr}},
+			{"rules", bson.M{"owner": addr}},
+			{"vacation_replies", bson.M{"owner": addr}},
+			{"vacations", bson.M{"_id": addr}},
+			{"mailbox_seq", bson.M{"_id": addr}},
+			{"mailbox_usage", bson.M{"_id": addr}},
+		}
+		for _, d := range byAddress {
+			if _, err := s.db.Collection(d.collection).DeleteMany(ctx, d.filter); err != nil {
+				return fmt.Errorf("purging %s of %s: %w", d.collection, id, err)
+			}
+		}
+		_, err = s.db.Collection("lists").UpdateMany(ctx,
+			bson.M{"$or": bson.A{bson.M{"owners": addr}, bson.M{"members": addr}}},
+			bson.M{"$pull": bson.M{"owners": addr, "members": addr}})
+		if err != nil {
+			return fmt.Errorf("purging list memberships of %s: %w", id, err)
+		}
+	}
+
+	for _, collection := range []string{"credentials", "address_redirects"} {
+		if _, err := s.db.Collection(collection).DeleteMany(ctx, bson.M{"owner": id}); err != nil {
+			return fmt.Errorf("purging %s of %s: %w", collection, id, err)
+		}
+	}
+	if err := s.deleteExports(ctx, bson.M{"owner": id}); err != nil {
+		return err
+	}
+
+	collected, err := collectMessages(ctx, s.db, messageIDs)
+	if err != nil {
+		return fmt.Errorf("collecting messages of %s: %w", id, err)
+	}
+	if _, err := s.db.Collection("users").DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+		return err
+	}
+	log.Printf("Purged account %s (%s): %d mailbox messages, %d collected", id, addr, len(messageIDs), collected)
+	return nil
+}
+
+// collectMessages deletes those of messageIDs that no mailbox entry or held
+// list post refers to any more. Attachments are stored inline, so they go
+// with their message.
+func collectMessages(ctx context.Context, db *mongo.Database, messageIDs []string) (int, error) {
+	collected := 0
+	for start := 0; start < len(messageIDs); start += collectBatchSize {
+		batch := messageIDs[start:min(start+collectBatchSize, len(messageIDs))]
+		n, err := collectBatch(ctx, db, batch)
+		if err != nil {
+			return collected, err
+		}
+		collected += n
+	}
+	return collected, nil
+}
+
+const collectBatchSize = 500
+
+func collectBatch(ctx context.Context, db *mongo.Database, messageIDs []string) (int, error) {
+	inUse := make(map[string]bool)
+	for _, collection := range []string{"mailboxes", "list_pending"} {
+		ids, err := db.Collection(collection).Distinct(ctx, "messageId", bson.M{"messageId": bson.M{"$in": messageIDs}})
+		if err != nil {
+			return 0, err
+		}
+		for _, v := range ids {
+			if messageID, ok := v.(string); ok {
+				inUse[messageID] = true
+			}
+		}
+	}
+
+	var orphaned []string
+	for _, messageID := range messageIDs {
+		if !inUse[messageID] {
+			orphaned = append(orphaned, messageID)
+		}
+	}
+	if len(orphaned) == 0 {
+		return 0, nil
+	}
+	res, err := db.Collection("messages").DeleteMany(ctx, bson.M{"messageId": bson.M{"$in": orphaned}})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
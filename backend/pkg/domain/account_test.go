@@ -0,0 +1,82 @@
+package domain
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"quill/pkg/models"
+)
+
+func TestPurgeExpiredAccounts(t *testing.T) {
+	s := testUserService(t)
+	s.db = testDatabase(t)
+	s.exportDir = t.TempDir()
+	ctx := context.Background()
+	const ada, bob = "ada~example.com", "bob~example.com"
+	now := time.Now().UTC()
+	insert(t, s.db.Collection("users"),
+		models.User{UsersUID: "u1", UserQuillMail: ada, DeleteAfter: now.Add(-time.Hour)},
+		models.User{UsersUID: "u2", UserQuillMail: bob, DeleteAfter: now.Add(time.Hour)},
+		models.User{UsersUID: "u3", UserQuillMail: "carl~example.com"},
+	)
+	insert(t, s.db.Collection("mailboxes"),
+		mailboxEntry{UserID: ada, MessageID: "shared"},
+		mailboxEntry{UserID: bob, MessageID: "shared"},
+		mailboxEntry{UserID: ada, MessageID: "own"},
+		mailboxEntry{UserID: ada, MessageID: "held"},
+	)
+	insert(t, s.db.Collection("messages"),
+		bson.M{"messageId": "shared"}, bson.M{"messageId": "own"}, bson.M{"messageId": "held"})
+	insert(t, s.db.Collection("list_pending"), PendingPost{ListID: "team~example.com", MessageID: "held"})
+	insert(t, s.db.Collection("lists"), MailingList{Address: "team~example.com", Owners: []string{ada}, Members: []string{ada, bob}})
+	insert(t, s.db.Collection("rules"), Rule{ID: "r1", Owner: ada})
+	insert(t, s.db.Collection("credentials"), bson.M{"owner": "u1"})
+	insert(t, s.db.Collection("address_redirects"), AddressRedirect{Address: "old~example.com", Target: ada, Owner: "u1"})
+	insert(t, s.db.Collection("exports"), ExportJob{ID: "e1", Owner: "u1"})
+	if err := os.WriteFile(filepath.Join(s.exportDir, "e1.zip"), []byte("zip"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := s.PurgeExpiredAccounts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(purged, []string{"u1"}) {
+		t.Errorf("purged %v, want only the expired account", purged)
+	}
+	counts := []struct {
+		collection string
+		filter     bson.M
+		want       int64
+	}{
+		{"users", bson.M{}, 2},
+		{"mailboxes", bson.M{"userId": ada}, 0},
+		{"mailboxes", bson.M{"userId": bob}, 1},
+		{"messages", bson.M{"messageId": "shared"}, 1},
+		{"messages", bson.M{"messageId": "own"}, 0},
+		{"messages", bson.M{"messageId": "held"}, 1},
+		{"lists", bson.M{"owners": bson.A{}, "members": bson.A{bob}}, 1},
+		{"rules", bson.M{}, 0},
+		{"credentials", bson.M{}, 0},
+		{"address_redirects", bson.M{}, 0},
+		{"exports", bson.M{}, 0},
+	}
+	for _, c := range counts {
+		if n := count(t, s.db.Collection(c.collection), c.filter); n != c.want {
+			t.Errorf("%s matching %v: %d, want %d", c.collection, c.filter, n, c.want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(s.exportDir, "e1.zip")); !os.IsNotExist(err) {
+		t.Errorf("export archive left behind: %v", err)
+	}
+
+	if purged, err := s.PurgeExpiredAccounts(ctx); err != nil || len(purged) != 0 {
+		t.Errorf("second sweep purged %v, %v; want nothing", purged, err)
+	}
+}
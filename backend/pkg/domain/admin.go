@@ -0,0 +1,473 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"quill/pkg/identity"
+	"quill/pkg/models"
+)
+
+// assignableRoles are the roles an admin may grant. RoleUser is implicit.
+var assignableRoles = []string{identity.RoleAdmin}
+
+// UserQuery filters ListUsers.
+type UserQuery struct {
+	Search    string // prefix of the Quill address or email
+	Suspended *bool
+	Limit     int
+	Offset    int
+}
+
+// UserUpdate carries the fields an admin may change directly.
+type UserUpdate struct {
+	UserQuillMail *string
+	UserEmail     *string
+}
+
+// AuditEntry records one administrative action.
+type AuditEntry struct {
+	ID           string    `bson:"_id"`
+	Actor        string    `bson:"actor"` // account ID
+	ActorAddress string    `bson:"actorAddress,omitempty"`
+	Action       string    `bson:"action"`
+	Target       string    `bson:"target"` // account ID acted upon
+	Details      bson.M    `bson:"details,omitempty"`
+	At           time.Time `bson:"at"`
+}
+
+type AuditQuery struct {
+	Target string
+	Actor  string
+	Limit  int
+}
+
+const (
+	defaultUserPageSize  = 50
+	defaultAuditPageSize = 100
+)
+
+var quillAddressPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*~[a-z0-9.-]+$`)
+
+var ErrAliasNotFound = error(errorString("alias not found"))
+
+// requireAdmin returns the calling principal if it holds the admin role.
+func requireAdmin(ctx context.Context) (*identity.Principal, error) {
+	p, err := callerPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !p.HasRole(identity.RoleAdmin) {
+		return nil, ErrPermissionDenied
+	}
+	return p, nil
+}
+
+func (s *MongoUserService) ListUsers(ctx context.Context, q UserQuery) ([]models.User, int, error) {
+	if _, err := requireAdmin(ctx); err != nil {
+		return nil, 0, err
+	}
+
+	filter := bson.M{}
+	if q.Search != "" {
+		prefix := "^" + regexp.QuoteMeta(strings.ToLower(q.Search))
+		filter["$or"] = bson.A{
+			bson.M{"userQuillMail": bson.M{"$regex": prefix}},
+			bson.M{"userEmail": bson.M{"$regex": prefix, "$options": "i"}},
+		}
+	}
+	if q.Suspended != nil {
+		filter["suspended"] = *q.Suspended
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultUserPageSize
+	}
+
+	users := s.db.Collection("users")
+	total, err := users.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	cursor, err := users.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "userQuillMail", Value: 1}}).
+		SetSkip(int64(q.Offset)).
+		SetLimit(int64(limit)))
+	if err != nil {
+		return nil, 0, err
+	}
+	var result []models.User
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, 0, err
+	}
+	return result, int(total), nil
+}
+
+func (s *MongoUserService) GetUser(ctx context.Context, id string) (*models.User, error) {
+	if _, err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	return s.loadUser(ctx, id)
+}
+
+// AdminCreateUser provisions an account directly, e.g. for a JWT or
+// on-prem deployment where no Firebase sign-up happens.
+func (s *MongoUserService) AdminCreateUser(ctx context.Context, user models.User) (*models.User, error) {
+	admin, err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user.UserQuillMail = strings.ToLower(strings.TrimSpace(user.UserQuillMail))
+	if user.UsersUID == "" {
+		user.UsersUID = uuid.New().String()
+	}
+	if err := validateRoles(user.Roles); err != nil {
+		return nil, err
+	}
+	// Same rules as a rename: a hosted domain, and not a list or an
+	// address still redirecting to someone else.
+	if err := s.checkHandle(ctx, user.UserQuillMail, user.UsersUID); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	user.Suspended = false
+
+	if _, err := s.db.Collection("users").InsertOne(ctx, user); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrUserExists
+		}
+		return nil, err
+	}
+	s.audit(ctx, admin, "user.create", user.UsersUID, bson.M{"userQuillMail": user.UserQuillMail})
+	return &user, nil
+}
+
+func (s *MongoUserService) UpdateUser(ctx context.Context, id string, update UserUpdate) (*models.User, error) {
+	admin, err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	before, err := s.loadUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	set := bson.M{}
+	if update.UserQuillMail != nil {
+		addr := strings.ToLower(strings.TrimSpace(*update.UserQuillMail))
+		if addr != before.UserQuillMail {
+			if err := s.checkHandle(ctx, addr, id); err != nil {
+				return nil, err
+			}
+			set["userQuillMail"] = addr
+		}
+	}
+	if update.UserEmail != nil {
+		set["userEmail"] = strings.TrimSpace(*update.UserEmail)
+	}
+	if len(set) == 0 {
+		return before, nil
+	}
+
+	user, err := s.setFields(ctx, id, set)
+	if err != nil {
+		return nil, err
+	}
+	if addr, ok := set["userQuillMail"].(string); ok {
+		if err := s.migrateAddress(ctx, id, before.UserQuillMail, addr); err != nil {
+			return nil, err
+		}
+	}
+	s.audit(ctx, admin, "user.update", id, bson.M{
+		"before": bson.M{"userQuillMail": before.UserQuillMail, "userEmail": before.UserEmail},
+		"after":  set,
+	})
+	return user, nil
+}
+
+// DeleteUser purges the account at once, without the grace period a
+// self-service deletion gets.
+func (s *MongoUserService) DeleteUser(ctx context.Context, id string) error {
+	admin, err := requireAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	if admin.AccountID == id {
+		return fmt.Errorf("%w: admins cannot delete themselves", ErrInvalidUser)
+	}
+	user, err := s.loadUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := s.purgeAccount(ctx, user); err != nil {
+		return err
+	}
+	s.audit(ctx, admin, "user.delete", id, bson.M{"userQuillMail": user.UserQuillMail})
+	return nil
+}
+
+// SetSuspended blocks or restores sign-in. Callers holding live sessions
+// must revoke them; see quill.SessionStore.RevokeUser.
+func (s *MongoUserService) SetSuspended(ctx context.Context, id string, suspended bool, reason string) (*models.User, error) {
+	admin, err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if suspended && admin.AccountID == id {
+		return nil, fmt.Errorf("%w: admins cannot suspend themselves", ErrInvalidUser)
+	}
+
+	update := bson.M{"$set": bson.M{"suspended": suspended, "updatedAt": time.Now().UTC()}}
+	action := "user.unsuspend"
+	if suspended {
+		update["$set"].(bson.M)["suspendReason"] = reason
+		update["$set"].(bson.M)["suspendedAt"] = time.Now().UTC()
+		action = "user.suspend"
+	} else {
+		update["$unset"] = bson.M{"suspendReason": "", "suspendedAt": ""}
+	}
+	user, err := s.updateUser(ctx, id, update)
+	if err != nil {
+		return nil, err
+	}
+	s.audit(ctx, admin, action, id, bson.M{"reason": reason})
+	return user, nil
+}
+
+func (s *MongoUserService) SetRoles(ctx context.Context, id string, roles []string) (*models.User, error) {
+	admin, err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateRoles(roles); err != nil {
+		return nil, err
+	}
+	if admin.AccountID == id && !containsString(roles, identity.RoleAdmin) {
+		return nil, fmt.Errorf("%w: admins cannot drop their own admin role", ErrInvalidUser)
+	}
+	user, err := s.setFields(ctx, id, bson.M{"roles": uniqueStrings(roles)})
+	if err != nil {
+		return nil, err
+	}
+	s.audit(ctx, admin, "user.roles", id, bson.M{"roles": roles})
+	return user, nil
+}
+
+func (s *MongoUserService) SetQuota(ctx context.Context, id string, quotaBytes int64) (*models.User, error) {
+	admin, err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if quotaBytes < 0 {
+		return nil, fmt.Errorf("%w: quota cannot be negative", ErrInvalidUser)
+	}
+	user, err := s.setFields(ctx, id, bson.M{"quotaBytes": quotaBytes})
+	if err != nil {
+		return nil, err
+	}
+	s.audit(ctx, admin, "user.quota", id, bson.M{"quotaBytes": quotaBytes})
+	return user, nil
+}
+
+// ResetCredentials revokes every API key and app password of the account.
+func (s *MongoUserService) ResetCredentials(ctx context.Context, id string) (int, error) {
+	admin, err := requireAdmin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.loadUser(ctx, id); err != nil {
+		return 0, err
+	}
+	res, err := s.db.Collection("credentials").UpdateMany(ctx,
+		bson.M{"owner": id, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": time.Now().UTC()}})
+	if err != nil {
+		return 0, err
+	}
+	s.audit(ctx, admin, "user.reset_credentials", id, bson.M{"revoked": res.ModifiedCount})
+	return int(res.ModifiedCount), nil
+}
+
+func (s *MongoUserService) AuditLog(ctx context.Context, q AuditQuery) ([]AuditEntry, error) {
+	if _, err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	filter := bson.M{}
+	if q.Target != "" {
+		filter["target"] = q.Target
+	}
+	if q.Actor != "" {
+		filter["actor"] = q.Actor
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultAuditPageSize
+	}
+	cursor, err := s.db.Collection("audit_log").Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "at", Value: -1}}).
+		SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	var entries []AuditEntry
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// EnsureAdmins grants the admin role to the given accounts. It bootstraps
+// the first administrators from configuration and is not audited.
+func (s *MongoUserService) EnsureAdmins(ctx context.Context, accountIDs []string) error {
+	for _, id := range accountIDs {
+		_, err := s.db.Collection("users").UpdateOne(ctx,
+			bson.M{"_id": id},
+			bson.M{"$addToSet": bson.M{"roles": identity.RoleAdmin}})
+		if err != nil {
+			return fmt.Errorf("granting admin to %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// ListAliases returns the aliases of the account id, or of every account
+// when id is empty, ordered by address.
+func (s *MongoUserService) ListAliases(ctx context.Context, id string) ([]AddressRedirect, error) {
+	if _, err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	filter := bson.M{"alias": true}
+	if id != "" {
+		filter["owner"] = id
+	}
+	cursor, err := s.db.Collection("address_redirects").Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var aliases []AddressRedirect
+	if err := cursor.All(ctx, &aliases); err != nil {
+		return nil, err
+	}
+	return aliases, nil
+}
+
+// AddAlias delivers mail for address to the account id. Aliases only
+// receive; the account keeps sending from its own address. They follow the
+// account through handle changes and go with it when it is deleted.
+func (s *MongoUserService) AddAlias(ctx context.Context, id, address string) (*AddressRedirect, error) {
+	admin, err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.loadUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	address = strings.ToLower(strings.TrimSpace(address))
+	if err := s.checkHandle(ctx, address, id); err != nil {
+		return nil, err
+	}
+
+	// Replaces the account's own retired handle, or an expired redirect of
+	// someone else's.
+	alias := AddressRedirect{
+		Address:   address,
+		Target:    user.UserQuillMail,
+		Owner:     id,
+		Alias:     true,
+		CreatedAt: time.Now().UTC(),
+	}
+	if _, err := s.db.Collection("address_redirects").ReplaceOne(ctx, bson.M{"_id": address}, alias,
+		options.Replace().SetUpsert(true)); err != nil {
+		return nil, err
+	}
+	s.audit(ctx, admin, "user.alias.add", id, bson.M{"alias": address})
+	return &alias, nil
+}
+
+func (s *MongoUserService) RemoveAlias(ctx context.Context, address string) error {
+	admin, err := requireAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	address = strings.ToLower(strings.TrimSpace(address))
+	var alias AddressRedirect
+	err = s.db.Collection("address_redirects").FindOneAndDelete(ctx, bson.M{"_id": address, "alias": true}).Decode(&alias)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return ErrAliasNotFound
+		}
+		return err
+	}
+	s.audit(ctx, admin, "user.alias.remove", alias.Owner, bson.M{"alias": address})
+	return nil
+}
+
+func (s *MongoUserService) loadUser(ctx context.Context, id string) (*models.User, error) {
+	var user models.User
+	if err := s.db.Collection("users").FindOne(ctx, bson.M{"_id": id}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *MongoUserService) setFields(ctx context.Context, id string, set bson.M) (*models.User, error) {
+	set["updatedAt"] = time.Now().UTC()
+	return s.updateUser(ctx, id, bson.M{"$set": set})
+}
+
+func (s *MongoUserService) updateUser(ctx context.Context, id string, update bson.M) (*models.User, error) {
+	var user models.User
+	err := s.db.Collection("users").FindOneAndUpdate(ctx, bson.M{"_id": id}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrUserNotFound
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrUserExists
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// audit records an admin action. Failures are logged, not returned: the
+// action itself has already happened.
+func (s *MongoUserService) audit(ctx context.Context, actor *identity.Principal, action, target string, details bson.M) {
+	entry := AuditEntry{
+		ID:           uuid.New().String(),
+		Actor:        actor.AccountID,
+		ActorAddress: actor.Address(),
+		Action:       action,
+		Target:       target,
+		Details:      details,
+		At:           time.Now().UTC(),
+	}
+	if _, err := s.db.Collection("audit_log").InsertOne(ctx, entry); err != nil {
+		log.Printf("Failed to write audit entry %s on %s by %s: %v", action, target, actor.AccountID, err)
+	}
+}
+
+func validateRoles(roles []string) error {
+	for _, r := range roles {
+		if !containsString(assignableRoles, r) {
+			return fmt.Errorf("%w: unknown role %q", ErrInvalidUser, r)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"quill/pkg/hosting"
+	"quill/pkg/identity"
+	"quill/pkg/models"
+)
+
+// testUserService serves example.com without a database; only paths that
+// fail before touching the store can run.
+func testUserService(t *testing.T) *MongoUserService {
+	t.Helper()
+	hosts, err := hosting.NewRegistry(&hosting.Domain{Name: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewMongoUserService(nil, "", hosts)
+}
+
+func adminContext() context.Context {
+	return identity.WithPrincipal(context.Background(), &identity.Principal{
+		AccountID: "root",
+		Roles:     []string{identity.RoleUser, identity.RoleAdmin},
+		Method:    identity.AuthMethodJWT,
+	})
+}
+
+func TestAdminCreateUserRejects(t *testing.T) {
+	user := identity.WithPrincipal(context.Background(), &identity.Principal{
+		AccountID: "u1",
+		Roles:     []string{identity.RoleUser},
+		Method:    identity.AuthMethodJWT,
+	})
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		address string
+		roles   []string
+		want    error
+	}{
+		{"not signed in", context.Background(), "ada~example.com", nil, ErrUserNotAuthenticated},
+		{"not an admin", user, "ada~example.com", nil, ErrPermissionDenied},
+		{"malformed address", adminContext(), "ada@example.com", nil, ErrInvalidUser},
+		{"empty address", adminContext(), "  ", nil, ErrInvalidUser},
+		{"domain not hosted", adminContext(), "ada~example.org", nil, ErrInvalidUser},
+		{"unknown role", adminContext(), "ada~example.com", []string{"root"}, ErrInvalidUser},
+	}
+	s := testUserService(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.AdminCreateUser(tt.ctx, models.User{UserQuillMail: tt.address, Roles: tt.roles})
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// errOf drops a result, keeping only the error.
+func errOf(_ interface{}, err error) error {
+	return err
+}
+
+func TestAdminGuards(t *testing.T) {
+	user := identity.WithPrincipal(context.Background(), &identity.Principal{
+		AccountID: "u1",
+		Roles:     []string{identity.RoleUser},
+		Method:    identity.AuthMethodJWT,
+	})
+	s := testUserService(t)
+	ops := []struct {
+		name string
+		call func(ctx context.Context) error
+		// self is the error an admin gets when acting on their own account,
+		// or nil when that is allowed.
+		self error
+	}{
+		{"list users", func(ctx context.Context) error {
+			_, _, err := s.ListUsers(ctx, UserQuery{})
+			return err
+		}, nil},
+		{"delete", func(ctx context.Context) error { return s.DeleteUser(ctx, "root") }, ErrInvalidUser},
+		{"suspend", func(ctx context.Context) error { return errOf(s.SetSuspended(ctx, "root", true, "test")) }, ErrInvalidUser},
+		{"drop admin role", func(ctx context.Context) error { return errOf(s.SetRoles(ctx, "root", []string{identity.RoleUser})) }, ErrInvalidUser},
+		{"unknown role", func(ctx context.Context) error { return errOf(s.SetRoles(ctx, "u2", []string{"owner"})) }, ErrInvalidUser},
+		{"negative quota", func(ctx context.Context) error { return errOf(s.SetQuota(ctx, "u2", -1)) }, ErrInvalidUser},
+		{"reset credentials", func(ctx context.Context) error { return errOf(s.ResetCredentials(ctx, "u2")) }, nil},
+		{"audit log", func(ctx context.Context) error { return errOf(s.AuditLog(ctx, AuditQuery{})) }, nil},
+	}
+	for _, op := range ops {
+		t.Run(op.name, func(t *testing.T) {
+			if err := op.call(context.Background()); !errors.Is(err, ErrUserNotAuthenticated) {
+				t.Errorf("signed out: %v, want ErrUserNotAuthenticated", err)
+			}
+			if err := op.call(user); !errors.Is(err, ErrPermissionDenied) {
+				t.Errorf("as a user: %v, want ErrPermissionDenied", err)
+			}
+			if op.self != nil {
+				if err := op.call(adminContext()); !errors.Is(err, op.self) {
+					t.Errorf("as an admin: %v, want %v", err, op.self)
+				}
+			}
+		})
+	}
+}
+
+func TestAliasGuards(t *testing.T) {
+	user := identity.WithPrincipal(context.Background(), &identity.Principal{
+		AccountID: "u1",
+		Roles:     []string{identity.RoleUser},
+		Method:    identity.AuthMethodJWT,
+	})
+	s := testUserService(t)
+	ops := []struct {
+		name string
+		call func(ctx context.Context) error
+	}{
+		{"list", func(ctx context.Context) error { return errOf(s.ListAliases(ctx, "u2")) }},
+		{"add", func(ctx context.Context) error { return errOf(s.AddAlias(ctx, "u2", "ada2~example.com")) }},
+		{"remove", func(ctx context.Context) error { return s.RemoveAlias(ctx, "ada2~example.com") }},
+	}
+	for _, op := range ops {
+		t.Run(op.name, func(t *testing.T) {
+			if err := op.call(context.Background()); !errors.Is(err, ErrUserNotAuthenticated) {
+				t.Errorf("signed out: %v, want ErrUserNotAuthenticated", err)
+			}
+			if err := op.call(user); !errors.Is(err, ErrPermissionDenied) {
+				t.Errorf("as a user: %v, want ErrPermissionDenied", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package domain
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CredentialKind distinguishes the long-lived secrets a user can issue for
+// scripts, bots and clients that cannot do the interactive sign-in.
+type CredentialKind string
+
+const (
+	// CredentialKindAPIKey is presented on its own as "qk_<id>_<secret>".
+	CredentialKindAPIKey CredentialKind = "api_key"
+	// CredentialKindAppPassword is presented together with the owner's
+	// Quill address, like a regular password.
+	CredentialKindAppPassword CredentialKind = "app_password"
+)
+
+// APIKeyPrefix marks session tokens that are API keys.
+const APIKeyPrefix = "qk_"
+
+// Credential is an issued API key or app password. Only a hash of the
+// secret is stored; the plaintext is returned once, when it is created.
+type Credential struct {
+	ID         string         `bson:"_id"`
+	Owner      string         `bson:"owner"` // account ID
+	Address    string         `bson:"address"`
+	Kind       CredentialKind `bson:"kind"`
+	Name       string         `bson:"name"`
+	Hash       string         `bson:"hash"`
+	CreatedAt  time.Time      `bson:"createdAt"`
+	ExpiresAt  time.Time      `bson:"expiresAt,omitempty"`
+	LastUsedAt time.Time      `bson:"lastUsedAt,omitempty"`
+	RevokedAt  time.Time      `bson:"revokedAt,omitempty"`
+}
+
+type CredentialAction string
+
+const (
+	CredentialActionCreate CredentialAction = "create"
+	CredentialActionList   CredentialAction = "list"
+	CredentialActionRevoke CredentialAction = "revoke"
+)
+
+type DomainCredentialRequest struct {
+	Action       CredentialAction
+	Kind         CredentialKind
+	Name         string
+	CredentialID string
+	ExpiresAt    *time.Time
+}
+
+type DomainCredentialResult struct {
+	Credentials []Credential
+	// Secret is the plaintext of a newly created credential.
+	Secret string
+}
+
+var (
+	ErrCredentialNotFound = error(errorString("credential not found"))
+	ErrInvalidCredential  = error(errorString("invalid or revoked credential"))
+)
+
+// ManageCredentials issues, lists or revokes the caller's API keys and app passwords.
+func (m *MongoMessageService) ManageCredentials(ctx context.Context, req DomainCredentialRequest) (DomainCredentialResult, error) {
+	p, err := callerPrincipal(ctx)
+	if err != nil {
+		return DomainCredentialResult{}, err
+	}
+	// A leaked key must not be able to mint or revoke other keys.
+	if !p.Interactive() {
+		return DomainCredentialResult{}, ErrPermissionDenied
+	}
+	userID := p.AccountID
+	credentials := m.db.Collection("credentials")
+
+	switch req.Action {
+	case CredentialActionCreate:
+		if req.Kind != CredentialKindAPIKey && req.Kind != CredentialKindAppPassword {
+			return DomainCredentialResult{}, errorString(fmt.Sprintf("unknown credential kind %q", req.Kind))
+		}
+		address, err := m.callerAddress(ctx)
+		if err != nil {
+			return DomainCredentialResult{}, err
+		}
+		id, err := randomHex(6)
+		if err != nil {
+			return DomainCredentialResult{}, err
+		}
+		secret, err := randomHex(24)
+		if err != nil {
+			return DomainCredentialResult{}, err
+		}
+		cred := Credential{
+			ID:        id,
+			Owner:     userID,
+			Address:   address,
+			Kind:      req.Kind,
+			Name:      strings.TrimSpace(req.Name),
+			Hash:      hashSecret(secret),
+			CreatedAt: time.Now().UTC(),
+		}
+		if req.ExpiresAt != nil {
+			cred.ExpiresAt = req.ExpiresAt.UTC()
+		}
+		if _, err := credentials.InsertOne(ctx, cred); err != nil {
+			return DomainCredentialResult{}, err
+		}
+		if cred.Kind == CredentialKindAPIKey {
+			secret = APIKeyPrefix + id + "_" + secret
+		}
+		return DomainCredentialResult{Credentials: []Credential{cred}, Secret: secret}, nil
+	case CredentialActionList:
+		cursor, err := credentials.Find(ctx,
+			bson.M{"owner": userID, "revokedAt": bson.M{"$exists": false}},
+			options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}))
+		if err != nil {
+			return DomainCredentialResult{}, err
+		}
+		var creds []Credential
+		if err := cursor.All(ctx, &creds); err != nil {
+			return DomainCredentialResult{}, err
+		}
+		return DomainCredentialResult{Credentials: creds}, nil
+	case CredentialActionRevoke:
+		res, err := credentials.UpdateOne(ctx,
+			bson.M{"_id": req.CredentialID, "owner": userID, "revokedAt": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"revokedAt": time.Now().UTC()}})
+		if err != nil {
+			return DomainCredentialResult{}, err
+		}
+		if res.MatchedCount == 0 {
+			return DomainCredentialResult{}, ErrCredentialNotFound
+		}
+		return DomainCredentialResult{}, nil
+	default:
+		return DomainCredentialResult{}, errorString(fmt.Sprintf("unknown credential action %q", req.Action))
+	}
+}
+
+// VerifyAPIKey resolves an API key to the account that issued it.
+func (m *MongoMessageService) VerifyAPIKey(ctx context.Context, key string) (string, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(key, APIKeyPrefix), "_")
+	if !strings.HasPrefix(key, APIKeyPrefix) || !ok {
+		return "", ErrInvalidCredential
+	}
+	return m.useCredential(ctx, bson.M{"_id": id, "kind": CredentialKindAPIKey, "hash": hashSecret(secret)})
+}
+
+// VerifyAppPassword resolves an address and app password to the owning account.
+func (m *MongoMessageService) VerifyAppPassword(ctx context.Context, address, password string) (string, error) {
+	return m.useCredential(ctx, bson.M{
+		"address": address,
+		"kind":    CredentialKindAppPassword,
+		"hash":    hashSecret(password),
+	})
+}
+
+// useCredential finds a live credential matching filter and stamps its last use.
+func (m *MongoMessageService) useCredential(ctx context.Context, filter bson.M) (string, error) {
+	now := time.Now().UTC()
+	filter["revokedAt"] = bson.M{"$exists": false}
+	filter["$or"] = bson.A{
+		bson.M{"expiresAt": bson.M{"$exists": false}},
+		bson.M{"expiresAt": bson.M{"$gt": now}},
+	}
+
+	var cred Credential
+	err := m.db.Collection("credentials").FindOneAndUpdate(ctx, filter,
+		bson.M{"$set": bson.M{"lastUsedAt": now}}).Decode(&cred)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return "", ErrInvalidCredential
+		}
+		return "", err
+	}
+	return cred.Owner, nil
+}
+
+// hashSecret hashes a server-generated secret. The secrets carry 192 bits of
+// randomness, so a plain digest is enough and allows lookup by hash.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,502 @@
+package domain
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"quill/pkg/models"
+)
+
+// An export is a zip archive with the account's data in open formats:
+//
+//	profile.json   the user document
+//	rules.json     filtering rules
+//	vacation.json  auto-reply settings, when set
+//	messages.mbox  every mailbox entry as an RFC 5322 message (mboxrd)
+//	contacts.vcf   everyone the account has corresponded with (vCard 4.0)
+//
+// Archives are written in the background and kept for exportRetention.
+
+type ExportStatus string
+
+const (
+	ExportStatusPending ExportStatus = "pending"
+	ExportStatusReady   ExportStatus = "ready"
+	ExportStatusFailed  ExportStatus = "failed"
+)
+
+const (
+	exportRetention = 7 * 24 * time.Hour
+	exportTimeout   = 30 * time.Minute
+	exportBatchSize = 200
+)
+
+type ExportJob struct {
+	ID          string       `bson:"_id"`
+	Owner       string       `bson:"owner"` // account ID
+	Status      ExportStatus `bson:"status"`
+	Size        int64        `bson:"size,omitempty"`
+	Error       string       `bson:"error,omitempty"`
+	CreatedAt   time.Time    `bson:"createdAt"`
+	CompletedAt time.Time    `bson:"completedAt,omitempty"`
+	ExpiresAt   time.Time    `bson:"expiresAt,omitempty"`
+}
+
+var (
+	ErrExportNotFound = error(errorString("export not found"))
+	ErrExportNotReady = error(errorString("export is not ready"))
+)
+
+// StartExport queues an archive of the caller's data. A pending export is
+// returned as is rather than starting a second one.
+func (s *MongoUserService) StartExport(ctx context.Context) (*ExportJob, error) {
+	p, err := callerPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !p.Interactive() {
+		return nil, ErrPermissionDenied
+	}
+	user, err := s.loadUser(ctx, p.AccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending ExportJob
+	err = s.db.Collection("exports").FindOne(ctx, bson.M{"owner": p.AccountID, "status": ExportStatusPending}).Decode(&pending)
+	if err == nil {
+		return &pending, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	job := &ExportJob{
+		ID:        uuid.New().String(),
+		Owner:     p.AccountID,
+		Status:    ExportStatusPending,
+		CreatedAt: time.Now().UTC(),
+	}
+	if _, err := s.db.Collection("exports").InsertOne(ctx, job); err != nil {
+		return nil, err
+	}
+	go s.runExport(*job, user)
+	return job, nil
+}
+
+func (s *MongoUserService) GetExport(ctx context.Context, id string) (*ExportJob, error) {
+	p, err := callerPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var job ExportJob
+	err = s.db.Collection("exports").FindOne(ctx, bson.M{"_id": id, "owner": p.AccountID}).Decode(&job)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrExportNotFound
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// OpenExport opens a finished archive for download. The caller closes the file.
+func (s *MongoUserService) OpenExport(ctx context.Context, id string) (*os.File, *ExportJob, error) {
+	job, err := s.GetExport(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if job.Status != ExportStatusReady {
+		return nil, nil, ErrExportNotReady
+	}
+	f, err := os.Open(s.exportPath(job.ID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, ErrExportNotFound
+		}
+		return nil, nil, err
+	}
+	return f, job, nil
+}
+
+// PurgeExpiredExports removes archives past their retention.
+func (s *MongoUserService) PurgeExpiredExports(ctx context.Context) error {
+	return s.deleteExports(ctx, bson.M{"expiresAt": bson.M{"$lte": time.Now().UTC()}})
+}
+
+func (s *MongoUserService) deleteExports(ctx context.Context, filter bson.M) error {
+	cursor, err := s.db.Collection("exports").Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	var jobs []ExportJob
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if err := os.Remove(s.exportPath(job.ID)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing export %s: %w", job.ID, err)
+		}
+		if _, err := s.db.Collection("exports").DeleteOne(ctx, bson.M{"_id": job.ID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MongoUserService) exportPath(id string) string {
+	return filepath.Join(s.exportDir, id+".zip")
+}
+
+// runExport writes the archive for job and records the outcome. It runs
+// detached from the request that started it.
+func (s *MongoUserService) runExport(job ExportJob, user *models.User) {
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	size, err := s.writeExportFile(ctx, job.ID, user)
+	now := time.Now().UTC()
+	set := bson.M{"completedAt": now}
+	if err != nil {
+		log.Printf("Export %s for %s failed: %v", job.ID, job.Owner, err)
+		set["status"] = ExportStatusFailed
+		set["error"] = "export failed"
+		set["expiresAt"] = now.Add(exportRetention)
+	} else {
+		set["status"] = ExportStatusReady
+		set["size"] = size
+		set["expiresAt"] = now.Add(exportRetention)
+	}
+	if _, err := s.db.Collection("exports").UpdateOne(ctx, bson.M{"_id": job.ID}, bson.M{"$set": set}); err != nil {
+		log.Printf("Failed to record export %s: %v", job.ID, err)
+	}
+}
+
+// writeExportFile writes to a temporary file first so a download never
+// sees a partial archive.
+func (s *MongoUserService) writeExportFile(ctx context.Context, id string, user *models.User) (int64, error) {
+	if err := os.MkdirAll(s.exportDir, 0o700); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(s.exportDir, id+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := s.writeExport(ctx, tmp, user); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return info.Size(), os.Rename(tmp.Name(), s.exportPath(id))
+}
+
+func (s *MongoUserService) writeExport(ctx context.Context, w io.Writer, user *models.User) error {
+	zw := zip.NewWriter(w)
+	addr := user.UserQuillMail
+
+	if err := writeZipJSON(zw, "profile.json", user); err != nil {
+		return err
+	}
+
+	rules := []Rule{}
+	cursor, err := s.db.Collection("rules").Find(ctx, bson.M{"owner": addr}, options.Find().SetSort(bson.M{"priority": 1}))
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &rules); err != nil {
+		return err
+	}
+	if err := writeZipJSON(zw, "rules.json", rules); err != nil {
+		return err
+	}
+
+	var vacation VacationSettings
+	err = s.db.Collection("vacations").FindOne(ctx, bson.M{"_id": addr}).Decode(&vacation)
+	switch {
+	case err == nil:
+		if err := writeZipJSON(zw, "vacation.json", vacation); err != nil {
+			return err
+		}
+	case err != mongo.ErrNoDocuments:
+		return err
+	}
+
+	mbox, err := zw.Create("messages.mbox")
+	if err != nil {
+		return err
+	}
+	contacts, err := s.writeMbox(ctx, mbox, addr)
+	if err != nil {
+		return err
+	}
+
+	vcf, err := zw.Create("contacts.vcf")
+	if err != nil {
+		return err
+	}
+	if err := writeVCards(vcf, contacts); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// writeMbox writes every mailbox entry of owner, oldest first, and returns
+// the addresses seen on them.
+func (s *MongoUserService) writeMbox(ctx context.Context, w io.Writer, owner string) ([]string, error) {
+	cursor, err := s.db.Collection("mailboxes").Find(ctx, bson.M{"userId": owner},
+		options.Find().SetSort(bson.D{{Key: "receivedAt", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	bw := bufio.NewWriter(w)
+	seen := map[string]bool{owner: true}
+	var contacts []string
+	batch := make([]mailboxEntry, 0, exportBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		messages, err := s.loadMessages(ctx, batch)
+		if err != nil {
+			return err
+		}
+		for _, e := range batch {
+			raw, ok := messages[e.MessageID]
+			if !ok {
+				continue
+			}
+			msg := convertBsonToMessage(raw, e.Read)
+			msg.Folder, msg.Flags, msg.Labels = e.Folder, e.Flags, e.Labels
+			if err := writeMboxMessage(bw, &msg, e.ReceivedAt); err != nil {
+				return err
+			}
+			for _, a := range append(append([]string{msg.From}, msg.To...), msg.CC...) {
+				if a != "" && !seen[a] {
+					seen[a] = true
+					contacts = append(contacts, a)
+				}
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	for cursor.Next(ctx) {
+		var e mailboxEntry
+		if err := cursor.Decode(&e); err != nil {
+			return nil, err
+		}
+		batch = append(batch, e)
+		if len(batch) == exportBatchSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	sort.Strings(contacts)
+	return contacts, bw.Flush()
+}
+
+func (s *MongoUserService) loadMessages(ctx context.Context, entries []mailboxEntry) (map[string]bson.M, error) {
+	ids := make([]string, len(entries))
+	for i, e := range entries {
+		ids[i] = e.MessageID
+	}
+	cursor, err := s.db.Collection("messages").Find(ctx, bson.M{"messageId": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	var raw []bson.M
+	if err := cursor.All(ctx, &raw); err != nil {
+		return nil, err
+	}
+	messages := make(map[string]bson.M, len(raw))
+	for _, m := range raw {
+		if id, ok := m["messageId"].(string); ok {
+			messages[id] = m
+		}
+	}
+	return messages, nil
+}
+
+// writeMboxMessage renders msg as a MIME message in mboxrd format: body
+// lines starting with "From " (after any number of '>') get one more '>'.
+func writeMboxMessage(w io.Writer, msg *Message, receivedAt time.Time) error {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	for _, c := range msg.Body.Content {
+		ct := string(c.Type)
+		if ct == "" {
+			ct = string(ContentTypePlainText)
+		}
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {ct + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return err
+		}
+		qp := quotedprintable.NewWriter(part)
+		if _, err := qp.Write([]byte(c.Value)); err != nil {
+			return err
+		}
+		if err := qp.Close(); err != nil {
+			return err
+		}
+	}
+	for _, a := range msg.Attachments {
+		if err := writeAttachmentPart(mw, a); err != nil {
+			return err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	date := msg.SentAt
+	if date.IsZero() {
+		date = receivedAt
+	}
+	var out bytes.Buffer
+	header := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&out, "%s: %s\n", name, value)
+		}
+	}
+	fmt.Fprintf(&out, "From %s %s\n", mboxSender(msg.From), receivedAt.UTC().Format(time.ANSIC))
+	header("Message-ID", "<"+msg.MessageID+">")
+	header("Date", date.Format(time.RFC1123Z))
+	header("From", msg.From)
+	header("To", strings.Join(msg.To, ", "))
+	header("Cc", strings.Join(msg.CC, ", "))
+	header("Reply-To", msg.ReplyTo)
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Auto-Submitted", msg.AutoSubmitted)
+	header("List-Id", msg.ListID)
+	header("X-Quill-Thread-ID", msg.ThreadID)
+	header("X-Quill-Folder", msg.Folder)
+	header("X-Quill-Flags", strings.Join(msg.Flags, " "))
+	header("X-Quill-Labels", strings.Join(msg.Labels, ", "))
+	header("MIME-Version", "1.0")
+	header("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mw.Boundary()}))
+	out.WriteString("\n")
+
+	for _, line := range strings.Split(strings.ReplaceAll(body.String(), "\r\n", "\n"), "\n") {
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			out.WriteByte('>')
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// writeAttachmentPart embeds inline attachment data; attachments stored as
+// links are exported as a text/uri-list part pointing at them.
+func writeAttachmentPart(mw *multipart.Writer, a Attachment) error {
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})
+	data, err := base64.StdEncoding.DecodeString(a.URL)
+	if err != nil {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":        {"text/uri-list"},
+			"Content-Disposition": {disposition},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(part, a.URL+"\r\n")
+		return err
+	}
+
+	mimetype := a.Mimetype
+	if mimetype == "" {
+		mimetype = "application/octet-stream"
+	}
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mimetype},
+		"Content-Disposition":       {disposition},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err := io.WriteString(part, encoded[:76]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = io.WriteString(part, encoded+"\r\n")
+	return err
+}
+
+func mboxSender(from string) string {
+	if from == "" || strings.ContainsAny(from, " \t") {
+		return "MAILER-DAEMON"
+	}
+	return from
+}
+
+func writeVCards(w io.Writer, addresses []string) error {
+	bw := bufio.NewWriter(w)
+	for _, a := range addresses {
+		v := vcardEscape(a)
+		fmt.Fprintf(bw, "BEGIN:VCARD\r\nVERSION:4.0\r\nFN:%s\r\nEMAIL:%s\r\nEND:VCARD\r\n", v, v)
+	}
+	return bw.Flush()
+}
+
+func vcardEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,137 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMboxMessage(t *testing.T) {
+	received := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	msg := &Message{
+		MessageID: "m1",
+		ThreadID:  "t1",
+		From:      "ada~example.com",
+		To:        []string{"bob~example.com", "carl~example.com"},
+		Subject:   "Grüße",
+		Body: Body{Content: []Content{
+			{Type: ContentTypePlainText, Value: "From here\n>From there\nFromage"},
+		}},
+		Attachments: []Attachment{
+			{Filename: "note.txt", Mimetype: "text/plain", URL: base64.StdEncoding.EncodeToString([]byte("inline data"))},
+			{Filename: "big.bin", URL: "https://files.example.com/big.bin"},
+		},
+		Flags: []string{"important"},
+	}
+	var out bytes.Buffer
+	if err := writeMboxMessage(&out, msg, received); err != nil {
+		t.Fatal(err)
+	}
+
+	envelope, rest, _ := strings.Cut(out.String(), "\n")
+	if want := "From ada~example.com " + received.Format(time.ANSIC); envelope != want {
+		t.Errorf("envelope = %q, want %q", envelope, want)
+	}
+	for _, line := range []string{">From here", ">>From there", "Fromage"} {
+		if !strings.Contains(rest, "\n"+line+"\n") {
+			t.Errorf("body lacks line %q:\n%s", line, rest)
+		}
+	}
+
+	// Undo the mboxrd quoting to read the message back.
+	var unquoted strings.Builder
+	for _, line := range strings.Split(rest, "\n") {
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			line = line[1:]
+		}
+		unquoted.WriteString(line + "\n")
+	}
+	parsed, err := mail.ReadMessage(strings.NewReader(unquoted.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	headers := map[string]string{
+		"Message-Id":        "<m1>",
+		"To":                "bob~example.com, carl~example.com",
+		"X-Quill-Thread-Id": "t1",
+		"X-Quill-Flags":     "important",
+		"Date":              received.Format(time.RFC1123Z),
+	}
+	if subject != msg.Subject {
+		t.Errorf("Subject = %q, want %q", subject, msg.Subject)
+	}
+	for name, want := range headers {
+		if got := parsed.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if parsed.Header.Get("Cc") != "" {
+		t.Errorf("empty Cc written")
+	}
+
+	_, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(parsed.Body, params["boundary"])
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(p)
+		if p.Header.Get("Content-Transfer-Encoding") == "base64" {
+			data, _ = base64.StdEncoding.DecodeString(strings.ReplaceAll(string(data), "\r\n", ""))
+		}
+		parts = append(parts, p.Header.Get("Content-Type")+"|"+p.FileName()+"|"+strings.TrimSpace(string(data)))
+	}
+	want := []string{
+		"text/plain; charset=utf-8||From here\n>From there\nFromage",
+		"text/plain|note.txt|inline data",
+		"text/uri-list|big.bin|https://files.example.com/big.bin",
+	}
+	if len(parts) != len(want) {
+		t.Fatalf("parts = %q, want %q", parts, want)
+	}
+	for i := range want {
+		if parts[i] != want[i] {
+			t.Errorf("part %d = %q, want %q", i, parts[i], want[i])
+		}
+	}
+}
+
+func TestMboxSender(t *testing.T) {
+	tests := []struct{ from, want string }{
+		{"ada~example.com", "ada~example.com"},
+		{"", "MAILER-DAEMON"},
+		{"Ada Lovelace <ada@example.net>", "MAILER-DAEMON"},
+	}
+	for _, tt := range tests {
+		if got := mboxSender(tt.from); got != tt.want {
+			t.Errorf("mboxSender(%q) = %q, want %q", tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestWriteVCards(t *testing.T) {
+	var out bytes.Buffer
+	if err := writeVCards(&out, []string{"ada~example.com", "odd;name,\\x"}); err != nil {
+		t.Fatal(err)
+	}
+	want := "BEGIN:VCARD\r\nVERSION:4.0\r\nFN:ada~example.com\r\nEMAIL:ada~example.com\r\nEND:VCARD\r\n" +
+		"BEGIN:VCARD\r\nVERSION:4.0\r\nFN:" + `odd\;name\,\\x` + "\r\nEMAIL:" + `odd\;name\,\\x` + "\r\nEND:VCARD\r\n"
+	if out.String() != want {
+		t.Errorf("vCards = %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,601 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// System folders always exist and cannot be renamed, nested or deleted.
+const (
+	FolderInbox = "inbox"
+	FolderSent  = "sent"
+)
+
+// folderSeparator joins a nested folder's path, e.g. "Projects/Quill".
+// Mailbox entries store the full path in their folder field.
+const folderSeparator = "/"
+
+var systemFolders = []string{FolderInbox, FolderSent}
+
+// Folder is a user-created folder. A message lives in exactly one folder.
+type Folder struct {
+	ID        string    `bson:"_id"`
+	Owner     string    `bson:"owner"`
+	Name      string    `bson:"name"`
+	ParentID  string    `bson:"parentId,omitempty"`
+	Path      string    `bson:"path"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+// Label is a Gmail-style tag; a message may carry any number of them.
+type Label struct {
+	ID        string    `bson:"_id"`
+	Owner     string    `bson:"owner"`
+	Name      string    `bson:"name"`
+	Color     string    `bson:"color,omitempty"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+// FolderSummary is a folder or label with its message counts.
+type FolderSummary struct {
+	ID       string
+	Name     string
+	Path     string
+	ParentID string
+	Color    string
+	System   bool
+	Total    int
+	Unread   int
+}
+
+type DomainFolderList struct {
+	Folders []FolderSummary
+	Labels  []FolderSummary
+}
+
+type FolderAction string
+
+const (
+	FolderActionCreate FolderAction = "create"
+	FolderActionRename FolderAction = "rename"
+	FolderActionMove   FolderAction = "move"
+	FolderActionDelete FolderAction = "delete"
+)
+
+// DomainFolderRequest creates, renames, re-parents or deletes a folder.
+// ParentID is only used by create and move; an empty ParentID means top level.
+type DomainFolderRequest struct {
+	Action   FolderAction
+	FolderID string
+	Name     string
+	ParentID string
+}
+
+type LabelAction string
+
+const (
+	LabelActionCreate LabelAction = "create"
+	LabelActionRename LabelAction = "rename"
+	LabelActionDelete LabelAction = "delete"
+	LabelActionApply  LabelAction = "apply"
+	LabelActionRemove LabelAction = "remove"
+)
+
+type DomainLabelRequest struct {
+	Action     LabelAction
+	LabelID    string
+	Name       string
+	Color      *string
+	MessageIDs []string
+}
+
+type DomainMoveRequest struct {
+	MessageIDs []string
+	Folder     string
+}
+
+var (
+	ErrFolderNotFound = error(errorString("folder not found"))
+	ErrFolderExists   = error(errorString("a folder with this name already exists"))
+	ErrLabelNotFound  = error(errorString("label not found"))
+	ErrLabelExists    = error(errorString("a label with this name already exists"))
+	ErrInvalidFolder  = error(errorString("invalid folder"))
+)
+
+// ListFolders returns the caller's system and custom folders and labels with
+// total and unread counts. Folders that only exist because a rule filed mail
+// into them are listed too.
+func (m *MongoMessageService) ListFolders(ctx context.Context) (DomainFolderList, error) {
+	caller, err := m.callerAddress(ctx)
+	if err != nil {
+		return DomainFolderList{}, err
+	}
+
+	folderCounts, err := m.countBy(ctx, caller, "$folder", false)
+	if err != nil {
+		return DomainFolderList{}, err
+	}
+	labelCounts, err := m.countBy(ctx, caller, "$labels", true)
+	if err != nil {
+		return DomainFolderList{}, err
+	}
+
+	var result DomainFolderList
+	listed := make(map[string]bool)
+	for _, name := range systemFolders {
+		c := folderCounts[name]
+		result.Folders = append(result.Folders, FolderSummary{
+			ID: name, Name: name, Path: name, System: true, Total: c.total, Unread: c.unread,
+		})
+		listed[name] = true
+	}
+
+	folders, err := m.loadFolders(ctx, caller)
+	if err != nil {
+		return DomainFolderList{}, err
+	}
+	for _, f := range folders {
+		c := folderCounts[f.Path]
+		result.Folders = append(result.Folders, FolderSummary{
+			ID: f.ID, Name: f.Name, Path: f.Path, ParentID: f.ParentID, Total: c.total, Unread: c.unread,
+		})
+		listed[f.Path] = true
+	}
+
+	var implicit []string
+	for path := range folderCounts {
+		if !listed[path] && path != "" {
+			implicit = append(implicit, path)
+		}
+	}
+	sort.Strings(implicit)
+	for _, path := range implicit {
+		c := folderCounts[path]
+		result.Folders = append(result.Folders, FolderSummary{
+			ID: path, Name: path, Path: path, Total: c.total, Unread: c.unread,
+		})
+	}
+
+	labels, err := m.loadLabels(ctx, caller)
+	if err != nil {
+		return DomainFolderList{}, err
+	}
+	for _, l := range labels {
+		c := labelCounts[l.Name]
+		result.Labels = append(result.Labels, FolderSummary{
+			ID: l.ID, Name: l.Name, Path: l.Name, Color: l.Color, Total: c.total, Unread: c.unread,
+		})
+	}
+	return result, nil
+}
+
+type folderCount struct {
+	total  int
+	unread int
+}
+
+// countBy groups the caller's mailbox entries by field and counts them.
+func (m *MongoMessageService) countBy(ctx context.Context, owner, field string, unwind bool) (map[string]folderCount, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"userId": owner}}},
+	}
+	if unwind {
+		pipeline = append(pipeline, bson.D{{Key: "$unwind", Value: field}})
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$group", Value: bson.M{
+		"_id":   field,
+		"total": bson.M{"$sum": 1},
+		"unread": bson.M{"$sum": bson.M{
+			"$cond": bson.A{bson.M{"$eq": bson.A{"$read", false}}, 1, 0},
+		}},
+	}}})
+
+	cursor, err := m.db.Collection("mailboxes").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		ID     string `bson:"_id"`
+		Total  int    `bson:"total"`
+		Unread int    `bson:"unread"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]folderCount, len(rows))
+	for _, r := range rows {
+		counts[r.ID] = folderCount{total: r.Total, unread: r.Unread}
+	}
+	return counts, nil
+}
+
+// ManageFolder creates, renames, nests or deletes one of the caller's folders.
+func (m *MongoMessageService) ManageFolder(ctx context.Context, req DomainFolderRequest) (*Folder, error) {
+	caller, err := m.callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	switch req.Action {
+	case FolderActionCreate:
+		if err := validateFolderName(req.Name); err != nil {
+			return nil, err
+		}
+		parentPath, err := m.parentPath(ctx, caller, req.ParentID)
+		if err != nil {
+			return nil, err
+		}
+		folder := Folder{
+			ID:        uuid.New().String(),
+			Owner:     caller,
+			Name:      req.Name,
+			ParentID:  req.ParentID,
+			Path:      joinFolderPath(parentPath, req.Name),
+			CreatedAt: time.Now().UTC(),
+		}
+		if err := m.ensureFolderPathFree(ctx, caller, folder.Path); err != nil {
+			return nil, err
+		}
+		if _, err := m.db.Collection("folders").InsertOne(ctx, folder); err != nil {
+			return nil, err
+		}
+		return &folder, nil
+	case FolderActionRename, FolderActionMove:
+		folder, err := m.getFolder(ctx, caller, req.FolderID)
+		if err != nil {
+			return nil, err
+		}
+		name, parentID := folder.Name, folder.ParentID
+		if req.Action == FolderActionRename {
+			if err := validateFolderName(req.Name); err != nil {
+				return nil, err
+			}
+			name = req.Name
+		} else {
+			parentID = req.ParentID
+		}
+		return m.relocateFolder(ctx, caller, folder, name, parentID)
+	case FolderActionDelete:
+		folder, err := m.getFolder(ctx, caller, req.FolderID)
+		if err != nil {
+			return nil, err
+		}
+		return folder, m.deleteFolder(ctx, caller, folder)
+	default:
+		return nil, errorString(fmt.Sprintf("unknown folder action %q", req.Action))
+	}
+}
+
+// relocateFolder renames and/or re-parents a folder, rewriting the paths of
+// its subfolders and of every mailbox entry filed under any of them.
+func (m *MongoMessageService) relocateFolder(ctx context.Context, owner string, folder *Folder, name, parentID string) (*Folder, error) {
+	if parentID == folder.ID {
+		return nil, fmt.Errorf("%w: a folder cannot contain itself", ErrInvalidFolder)
+	}
+	parentPath, err := m.parentPath(ctx, owner, parentID)
+	if err != nil {
+		return nil, err
+	}
+	oldPath := folder.Path
+	newPath := joinFolderPath(parentPath, name)
+	if newPath == oldPath {
+		return folder, nil
+	}
+	if strings.HasPrefix(newPath, oldPath+folderSeparator) {
+		return nil, fmt.Errorf("%w: a folder cannot be moved into its own subfolder", ErrInvalidFolder)
+	}
+	if err := m.ensureFolderPathFree(ctx, owner, newPath); err != nil {
+		return nil, err
+	}
+
+	subtree, err := m.folderSubtree(ctx, owner, oldPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range subtree {
+		path := newPath + strings.TrimPrefix(f.Path, oldPath)
+		set := bson.M{"path": path}
+		if f.ID == folder.ID {
+			set["name"] = name
+			set["parentId"] = parentID
+		}
+		if _, err := m.db.Collection("folders").UpdateByID(ctx, f.ID, bson.M{"$set": set}); err != nil {
+			return nil, err
+		}
+		if err := m.refileEntries(ctx, owner, f.Path, path); err != nil {
+			return nil, err
+		}
+	}
+
+	folder.Name = name
+	folder.ParentID = parentID
+	folder.Path = newPath
+	return folder, nil
+}
+
+// deleteFolder removes a folder and its subfolders. Their messages are not
+// deleted; they go back to the inbox.
+func (m *MongoMessageService) deleteFolder(ctx context.Context, owner string, folder *Folder) error {
+	subtree, err := m.folderSubtree(ctx, owner, folder.Path)
+	if err != nil {
+		return err
+	}
+	for _, f := range subtree {
+		if err := m.refileEntries(ctx, owner, f.Path, FolderInbox); err != nil {
+			return err
+		}
+		if _, err := m.db.Collection("folders").DeleteOne(ctx, bson.M{"_id": f.ID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MongoMessageService) refileEntries(ctx context.Context, owner, from, to string) error {
+	_, err := m.updateEntries(ctx, owner,
+		bson.M{"userId": owner, "folder": from},
+		ChangeKindMove,
+		bson.M{"$set": bson.M{"folder": to}},
+	)
+	return err
+}
+
+// MoveMessages files messages from the caller's mailbox into a folder.
+func (m *MongoMessageService) MoveMessages(ctx context.Context, req DomainMoveRequest) (int, error) {
+	caller, err := m.callerAddress(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(req.MessageIDs) == 0 {
+		return 0, errorString("no messages given")
+	}
+	if err := m.checkFolder(ctx, caller, req.Folder); err != nil {
+		return 0, err
+	}
+
+	return m.updateEntries(ctx, caller,
+		bson.M{"userId": caller, "messageId": bson.M{"$in": req.MessageIDs}},
+		ChangeKindMove,
+		bson.M{"$set": bson.M{"folder": req.Folder}},
+	)
+}
+
+// checkFolder returns ErrFolderNotFound unless path is a system folder or
+// one of owner's folders.
+func (m *MongoMessageService) checkFolder(ctx context.Context, owner, path string) error {
+	if containsString(systemFolders, path) {
+		return nil
+	}
+	count, err := m.db.Collection("folders").CountDocuments(ctx, bson.M{"owner": owner, "path": path})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrFolderNotFound
+	}
+	return nil
+}
+
+// ManageLabel creates, renames or deletes a label, or applies it to or
+// removes it from messages.
+func (m *MongoMessageService) ManageLabel(ctx context.Context, req DomainLabelRequest) (*Label, error) {
+	caller, err := m.callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Action == LabelActionCreate {
+		if err := validateLabelName(req.Name); err != nil {
+			return nil, err
+		}
+		if err := m.ensureLabelFree(ctx, caller, req.Name); err != nil {
+			return nil, err
+		}
+		label := Label{
+			ID:        uuid.New().String(),
+			Owner:     caller,
+			Name:      req.Name,
+			CreatedAt: time.Now().UTC(),
+		}
+		if req.Color != nil {
+			label.Color = *req.Color
+		}
+		if _, err := m.db.Collection("labels").InsertOne(ctx, label); err != nil {
+			return nil, err
+		}
+		return &label, nil
+	}
+
+	var label Label
+	if err := m.db.Collection("labels").FindOne(ctx, bson.M{"_id": req.LabelID, "owner": caller}).Decode(&label); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrLabelNotFound
+		}
+		return nil, err
+	}
+
+	switch req.Action {
+	case LabelActionRename:
+		set := bson.M{}
+		if req.Name != "" && req.Name != label.Name {
+			if err := validateLabelName(req.Name); err != nil {
+				return nil, err
+			}
+			if err := m.ensureLabelFree(ctx, caller, req.Name); err != nil {
+				return nil, err
+			}
+			_, err := m.updateEntries(ctx, caller,
+				bson.M{"userId": caller, "labels": label.Name},
+				ChangeKindFlags,
+				bson.M{"$set": bson.M{"labels.$": req.Name}},
+			)
+			if err != nil {
+				return nil, err
+			}
+			set["name"] = req.Name
+			label.Name = req.Name
+		}
+		if req.Color != nil {
+			set["color"] = *req.Color
+			label.Color = *req.Color
+		}
+		if len(set) > 0 {
+			if _, err := m.db.Collection("labels").UpdateByID(ctx, label.ID, bson.M{"$set": set}); err != nil {
+				return nil, err
+			}
+		}
+	case LabelActionDelete:
+		_, err := m.updateEntries(ctx, caller,
+			bson.M{"userId": caller, "labels": label.Name},
+			ChangeKindFlags,
+			bson.M{"$pull": bson.M{"labels": label.Name}},
+		)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := m.db.Collection("labels").DeleteOne(ctx, bson.M{"_id": label.ID}); err != nil {
+			return nil, err
+		}
+	case LabelActionApply, LabelActionRemove:
+		if len(req.MessageIDs) == 0 {
+			return nil, errorString("no messages given")
+		}
+		update := bson.M{"$addToSet": bson.M{"labels": label.Name}}
+		if req.Action == LabelActionRemove {
+			update = bson.M{"$pull": bson.M{"labels": label.Name}}
+		}
+		_, err := m.updateEntries(ctx, caller,
+			bson.M{"userId": caller, "messageId": bson.M{"$in": req.MessageIDs}},
+			ChangeKindFlags,
+			update,
+		)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errorString(fmt.Sprintf("unknown label action %q", req.Action))
+	}
+	return &label, nil
+}
+
+func (m *MongoMessageService) getFolder(ctx context.Context, owner, id string) (*Folder, error) {
+	var folder Folder
+	if err := m.db.Collection("folders").FindOne(ctx, bson.M{"_id": id, "owner": owner}).Decode(&folder); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrFolderNotFound
+		}
+		return nil, fmt.Errorf("error retrieving folder: %w", err)
+	}
+	return &folder, nil
+}
+
+func (m *MongoMessageService) parentPath(ctx context.Context, owner, parentID string) (string, error) {
+	if parentID == "" {
+		return "", nil
+	}
+	parent, err := m.getFolder(ctx, owner, parentID)
+	if err != nil {
+		return "", err
+	}
+	return parent.Path, nil
+}
+
+func (m *MongoMessageService) loadFolders(ctx context.Context, owner string) ([]Folder, error) {
+	cursor, err := m.db.Collection("folders").Find(ctx, bson.M{"owner": owner})
+	if err != nil {
+		return nil, err
+	}
+	var folders []Folder
+	if err := cursor.All(ctx, &folders); err != nil {
+		return nil, err
+	}
+	sort.Slice(folders, func(i, j int) bool { return folders[i].Path < folders[j].Path })
+	return folders, nil
+}
+
+// folderSubtree returns the folder at path and all of its descendants.
+func (m *MongoMessageService) folderSubtree(ctx context.Context, owner, path string) ([]Folder, error) {
+	filter := bson.M{"owner": owner, "$or": bson.A{
+		bson.M{"path": path},
+		bson.M{"path": bson.M{"$regex": "^" + regexp.QuoteMeta(path+folderSeparator)}},
+	}}
+	cursor, err := m.db.Collection("folders").Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var folders []Folder
+	if err := cursor.All(ctx, &folders); err != nil {
+		return nil, err
+	}
+	return folders, nil
+}
+
+func (m *MongoMessageService) loadLabels(ctx context.Context, owner string) ([]Label, error) {
+	cursor, err := m.db.Collection("labels").Find(ctx, bson.M{"owner": owner})
+	if err != nil {
+		return nil, err
+	}
+	var labels []Label
+	if err := cursor.All(ctx, &labels); err != nil {
+		return nil, err
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels, nil
+}
+
+func (m *MongoMessageService) ensureFolderPathFree(ctx context.Context, owner, path string) error {
+	if containsString(systemFolders, path) {
+		return ErrFolderExists
+	}
+	count, err := m.db.Collection("folders").CountDocuments(ctx, bson.M{"owner": owner, "path": path})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrFolderExists
+	}
+	return nil
+}
+
+func (m *MongoMessageService) ensureLabelFree(ctx context.Context, owner, name string) error {
+	count, err := m.db.Collection("labels").CountDocuments(ctx, bson.M{"owner": owner, "name": name})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrLabelExists
+	}
+	return nil
+}
+
+func joinFolderPath(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + folderSeparator + name
+}
+
+func validateFolderName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidFolder)
+	}
+	if strings.Contains(name, folderSeparator) {
+		return fmt.Errorf("%w: name may not contain %q", ErrInvalidFolder, folderSeparator)
+	}
+	return nil
+}
+
+func validateLabelName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("%w: label name is required", ErrInvalidFolder)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"quill/pkg/identity"
+)
+
+func TestJoinFolderPath(t *testing.T) {
+	tests := []struct {
+		parent, name, want string
+	}{
+		{"", "Projects", "Projects"},
+		{"Projects", "Quill", "Projects/Quill"},
+		{"Projects/Quill", "Specs", "Projects/Quill/Specs"},
+	}
+	for _, tt := range tests {
+		if got := joinFolderPath(tt.parent, tt.name); got != tt.want {
+			t.Errorf("joinFolderPath(%q, %q) = %q, want %q", tt.parent, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateFolderName(t *testing.T) {
+	tests := []struct {
+		name   string
+		folder string
+		ok     bool
+	}{
+		{"plain", "Receipts", true},
+		{"with spaces", "Tax 2026", true},
+		{"empty", "", false},
+		{"blank", "   ", false},
+		{"separator", "a/b", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateFolderName(tt.folder)
+			if tt.ok && err != nil {
+				t.Errorf("validateFolderName(%q) = %v, want nil", tt.folder, err)
+			}
+			if !tt.ok && !errors.Is(err, ErrInvalidFolder) {
+				t.Errorf("validateFolderName(%q) = %v, want ErrInvalidFolder", tt.folder, err)
+			}
+		})
+	}
+	if err := validateLabelName("a/b"); err != nil {
+		t.Errorf("validateLabelName(%q) = %v, labels are not nested", "a/b", err)
+	}
+	if err := validateLabelName(" "); !errors.Is(err, ErrInvalidFolder) {
+		t.Errorf("validateLabelName(blank) = %v, want ErrInvalidFolder", err)
+	}
+}
+
+func TestFolderRequestsRejectedBeforeStore(t *testing.T) {
+	ctx := identity.WithPrincipal(context.Background(), &identity.Principal{
+		AccountID: "u1",
+		Addresses: []string{"ada~example.com"},
+		Method:    identity.AuthMethodJWT,
+	})
+	m := testMessageService(t)
+
+	if _, err := m.ManageFolder(ctx, DomainFolderRequest{Action: FolderActionCreate, Name: "a/b"}); !errors.Is(err, ErrInvalidFolder) {
+		t.Errorf("create with a separator: %v, want ErrInvalidFolder", err)
+	}
+	if _, err := m.ManageFolder(ctx, DomainFolderRequest{Action: "copy"}); err == nil {
+		t.Error("unknown folder action accepted")
+	}
+	if _, err := m.ManageLabel(ctx, DomainLabelRequest{Action: LabelActionCreate}); !errors.Is(err, ErrInvalidFolder) {
+		t.Errorf("label without a name: %v, want ErrInvalidFolder", err)
+	}
+	if _, err := m.MoveMessages(ctx, DomainMoveRequest{Folder: FolderInbox}); err == nil {
+		t.Error("move without messages accepted")
+	}
+	if _, err := m.MoveMessages(context.Background(), DomainMoveRequest{MessageIDs: []string{"m1"}, Folder: FolderInbox}); !errors.Is(err, ErrUserNotAuthenticated) {
+		t.Errorf("move without a caller: %v, want ErrUserNotAuthenticated", err)
+	}
+	for _, folder := range systemFolders {
+		if err := m.checkFolder(ctx, "ada~example.com", folder); err != nil {
+			t.Errorf("checkFolder(%q) = %v, system folders always exist", folder, err)
+		}
+	}
+}
@@ -0,0 +1,759 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"quill/pkg/hosting"
+)
+
+// PostingPolicy controls who is allowed to post to a mailing list.
+type PostingPolicy string
+
+const (
+	PostingPolicyMembersOnly PostingPolicy = "members_only"
+	PostingPolicyModerated   PostingPolicy = "moderated"
+	PostingPolicyAnyone      PostingPolicy = "anyone"
+)
+
+// ReplyToMode decides where replies to list traffic should go.
+type ReplyToMode string
+
+const (
+	ReplyToList   ReplyToMode = "list"
+	ReplyToSender ReplyToMode = "sender"
+)
+
+// ArchiveAccess decides who may read a list's archive.
+type ArchiveAccess string
+
+const (
+	ArchiveAccessOwners  ArchiveAccess = "owners"
+	ArchiveAccessMembers ArchiveAccess = "members"
+	ArchiveAccessPublic  ArchiveAccess = "public"
+)
+
+// Folder names used for list traffic.
+const (
+	folderListArchive = "archive"
+)
+
+// MailingList is a group address that fans out to its members.
+// The list address is stored as the document _id.
+type MailingList struct {
+	Address       string        `bson:"_id"`
+	Name          string        `bson:"name"`
+	Description   string        `bson:"description,omitempty"`
+	Owners        []string      `bson:"owners"`
+	Members       []string      `bson:"members"`
+	PostingPolicy PostingPolicy `bson:"postingPolicy"`
+	ReplyTo       ReplyToMode   `bson:"replyTo"`
+	ArchiveAccess ArchiveAccess `bson:"archiveAccess"`
+	CreatedAt     time.Time     `bson:"createdAt"`
+}
+
+// PendingPost is a message held for moderation by a moderated list.
+type PendingPost struct {
+	ListID    string    `bson:"listId"`
+	MessageID string    `bson:"messageId"`
+	ThreadID  string    `bson:"threadId"`
+	From      string    `bson:"from"`
+	Subject   string    `bson:"subject"`
+	HeldAt    time.Time `bson:"heldAt"`
+}
+
+// moderationLease is how long an approval may take to deliver a held post
+// before another approval can claim it.
+const moderationLease = 5 * time.Minute
+
+type ListAction string
+
+const (
+	ListActionCreate        ListAction = "create"
+	ListActionGet           ListAction = "get"
+	ListActionUpdate        ListAction = "update"
+	ListActionDelete        ListAction = "delete"
+	ListActionAddMembers    ListAction = "add_members"
+	ListActionRemoveMembers ListAction = "remove_members"
+	ListActionArchive       ListAction = "archive"
+	ListActionPending       ListAction = "pending"
+	ListActionApprove       ListAction = "approve"
+	ListActionReject        ListAction = "reject"
+)
+
+// DomainListRequest describes a mailing list management operation.
+// Optional scalar fields are pointers so "update" only touches what was sent.
+type DomainListRequest struct {
+	Action        ListAction
+	Address       string
+	Name          *string
+	Description   *string
+	Owners        []string
+	Members       []string
+	PostingPolicy *PostingPolicy
+	ReplyTo       *ReplyToMode
+	ArchiveAccess *ArchiveAccess
+	MessageID     *string
+	Limit         *int
+	Offset        *int
+}
+
+// DomainListResult carries whatever the requested action produced.
+type DomainListResult struct {
+	List    *MailingList
+	Archive *DomainFetchResult
+	Pending []PendingPost
+	// Approved is set when a held post was released; Delivery.Relays still has
+	// to be relayed by the transport layer.
+	Approved *Message
+	Delivery *DomainSendResult
+}
+
+var (
+	ErrListNotFound      = error(errorString("mailing list not found"))
+	ErrListExists        = error(errorString("address is already in use"))
+	ErrPermissionDenied  = error(errorString("permission denied"))
+	ErrListPostDenied    = error(errorString("sender is not allowed to post to this list"))
+	ErrPendingNotFound   = error(errorString("no held message with this ID"))
+	ErrInvalidListConfig = error(errorString("invalid mailing list configuration"))
+)
+
+// ManageList executes a mailing list management action on behalf of the
+// authenticated user.
+func (m *MongoMessageService) ManageList(ctx context.Context, req DomainListRequest) (DomainListResult, error) {
+	caller, err := m.callerAddress(ctx)
+	if err != nil {
+		return DomainListResult{}, err
+	}
+
+	if req.Action == ListActionCreate {
+		return m.createList(ctx, caller, req)
+	}
+
+	list, err := m.getList(ctx, req.Address)
+	if err != nil {
+		return DomainListResult{}, err
+	}
+	if list == nil {
+		return DomainListResult{}, ErrListNotFound
+	}
+
+	switch req.Action {
+	case ListActionGet:
+		if !list.isOwner(caller) && !list.isMember(caller) {
+			return DomainListResult{}, ErrPermissionDenied
+		}
+		return DomainListResult{List: list}, nil
+	case ListActionUpdate:
+		return m.updateList(ctx, caller, list, req)
+	case ListActionDelete:
+		if !list.isOwner(caller) {
+			return DomainListResult{}, ErrPermissionDenied
+		}
+		if _, err := m.db.Collection("lists").DeleteOne(ctx, bson.M{"_id": list.Address}); err != nil {
+			return DomainListResult{}, err
+		}
+		if _, err := m.db.Collection("list_pending").DeleteMany(ctx, bson.M{"listId": list.Address}); err != nil {
+			log.Printf("Failed to delete held posts for list %s: %v", list.Address, err)
+		}
+		return DomainListResult{List: list}, nil
+	case ListActionAddMembers, ListActionRemoveMembers:
+		return m.changeMembers(ctx, caller, list, req)
+	case ListActionArchive:
+		return m.listArchive(ctx, caller, list, req)
+	case ListActionPending:
+		if !list.isOwner(caller) {
+			return DomainListResult{}, ErrPermissionDenied
+		}
+		pending, err := m.pendingPosts(ctx, list.Address)
+		if err != nil {
+			return DomainListResult{}, err
+		}
+		return DomainListResult{List: list, Pending: pending}, nil
+	case ListActionApprove, ListActionReject:
+		return m.moderate(ctx, caller, list, req)
+	default:
+		return DomainListResult{}, errorString(fmt.Sprintf("unknown list action %q", req.Action))
+	}
+}
+
+func (m *MongoMessageService) createList(ctx context.Context, caller string, req DomainListRequest) (DomainListResult, error) {
+	if !m.hosts.IsLocal(req.Address) {
+		return DomainListResult{}, errorString("list address must belong to a domain hosted here: " + strings.Join(m.hosts.Names(), ", "))
+	}
+
+	// A list may not shadow an existing user.
+	count, err := m.db.Collection("users").CountDocuments(ctx, bson.M{"userQuillMail": req.Address})
+	if err != nil {
+		return DomainListResult{}, err
+	}
+	if count > 0 {
+		return DomainListResult{}, ErrListExists
+	}
+
+	list := MailingList{
+		Address:       req.Address,
+		Owners:        uniqueStrings(append([]string{caller}, req.Owners...)),
+		Members:       uniqueStrings(req.Members),
+		PostingPolicy: PostingPolicyMembersOnly,
+		ReplyTo:       ReplyToList,
+		ArchiveAccess: ArchiveAccessMembers,
+		CreatedAt:     time.Now().UTC(),
+	}
+	if list.Members == nil {
+		list.Members = []string{}
+	}
+	list.apply(req)
+	if err := list.validate(); err != nil {
+		return DomainListResult{}, err
+	}
+
+	if _, err := m.db.Collection("lists").InsertOne(ctx, list); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return DomainListResult{}, ErrListExists
+		}
+		return DomainListResult{}, err
+	}
+	return DomainListResult{List: &list}, nil
+}
+
+func (m *MongoMessageService) updateList(ctx context.Context, caller string, list *MailingList, req DomainListRequest) (DomainListResult, error) {
+	if !list.isOwner(caller) {
+		return DomainListResult{}, ErrPermissionDenied
+	}
+	list.apply(req)
+	if len(req.Owners) > 0 {
+		list.Owners = uniqueStrings(req.Owners)
+	}
+	if err := list.validate(); err != nil {
+		return DomainListResult{}, err
+	}
+
+	update := bson.M{"$set": bson.M{
+		"name":          list.Name,
+		"description":   list.Description,
+		"owners":        list.Owners,
+		"postingPolicy": list.PostingPolicy,
+		"replyTo":       list.ReplyTo,
+		"archiveAccess": list.ArchiveAccess,
+	}}
+	if _, err := m.db.Collection("lists").UpdateByID(ctx, list.Address, update); err != nil {
+		return DomainListResult{}, err
+	}
+	return DomainListResult{List: list}, nil
+}
+
+// changeMembers adds or removes members. Owners may change anyone; other
+// users may only unsubscribe themselves.
+func (m *MongoMessageService) changeMembers(ctx context.Context, caller string, list *MailingList, req DomainListRequest) (DomainListResult, error) {
+	members := uniqueStrings(req.Members)
+	if len(members) == 0 {
+		return DomainListResult{}, errorString("no members given")
+	}
+
+	selfRemoval := req.Action == ListActionRemoveMembers && len(members) == 1 && members[0] == caller
+	if !list.isOwner(caller) && !selfRemoval {
+		return DomainListResult{}, ErrPermissionDenied
+	}
+
+	var update bson.M
+	if req.Action == ListActionAddMembers {
+		update = bson.M{"$addToSet": bson.M{"members": bson.M{"$each": members}}}
+	} else {
+		update = bson.M{"$pullAll": bson.M{"members": members}}
+	}
+	if _, err := m.db.Collection("lists").UpdateByID(ctx, list.Address, update); err != nil {
+		return DomainListResult{}, err
+	}
+
+	updated, err := m.getList(ctx, list.Address)
+	if err != nil {
+		return DomainListResult{}, err
+	}
+	return DomainListResult{List: updated}, nil
+}
+
+func (m *MongoMessageService) listArchive(ctx context.Context, caller string, list *MailingList, req DomainListRequest) (DomainListResult, error) {
+	switch list.ArchiveAccess {
+	case ArchiveAccessPublic:
+	case ArchiveAccessMembers:
+		if !list.isOwner(caller) && !list.isMember(caller) {
+			return DomainListResult{}, ErrPermissionDenied
+		}
+	default:
+		if !list.isOwner(caller) {
+			return DomainListResult{}, ErrPermissionDenied
+		}
+	}
+
+	limit := 10
+	if req.Limit != nil {
+		limit = *req.Limit
+	}
+	offset := 0
+	if req.Offset != nil {
+		offset = *req.Offset
+	}
+
+	archive, err := m.fetchEntries(ctx, bson.M{"userId": list.Address, "folder": folderListArchive}, limit, offset, "")
+	if err != nil {
+		return DomainListResult{}, err
+	}
+	return DomainListResult{List: list, Archive: &archive}, nil
+}
+
+func (m *MongoMessageService) pendingPosts(ctx context.Context, listID string) ([]PendingPost, error) {
+	cursor, err := m.db.Collection("list_pending").Find(ctx, bson.M{"listId": listID})
+	if err != nil {
+		return nil, err
+	}
+	var pending []PendingPost
+	if err := cursor.All(ctx, &pending); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// moderate approves or rejects a held post. Approving fans the stored message
+// out to the list exactly as if it had been posted by an owner.
+func (m *MongoMessageService) moderate(ctx context.Context, caller string, list *MailingList, req DomainListRequest) (DomainListResult, error) {
+	if !list.isOwner(caller) {
+		return DomainListResult{}, ErrPermissionDenied
+	}
+	if req.MessageID == nil || *req.MessageID == "" {
+		return DomainListResult{}, errorString("message_id is required")
+	}
+
+	filter := bson.M{"listId": list.Address, "messageId": *req.MessageID}
+	pending := m.db.Collection("list_pending")
+	if req.Action == ListActionReject {
+		if err := pending.FindOneAndDelete(ctx, filter).Err(); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return DomainListResult{}, ErrPendingNotFound
+			}
+			return DomainListResult{}, err
+		}
+		return DomainListResult{List: list}, nil
+	}
+
+	// The post stays held until it is delivered, so a failed approval can
+	// be retried; the claim stops a second approval delivering it twice.
+	now := time.Now().UTC()
+	claim := bson.M{"$and": bson.A{filter, bson.M{"$or": bson.A{
+		bson.M{"claimedUntil": bson.M{"$exists": false}},
+		bson.M{"claimedUntil": bson.M{"$lte": now}},
+	}}}}
+	var post PendingPost
+	err := pending.FindOneAndUpdate(ctx, claim, bson.M{"$set": bson.M{"claimedUntil": now.Add(moderationLease)}}).Decode(&post)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return DomainListResult{}, ErrPendingNotFound
+		}
+		return DomainListResult{}, err
+	}
+	result, err := m.deliverApproved(ctx, list, post)
+	if err != nil {
+		if _, uerr := pending.UpdateOne(ctx, filter, bson.M{"$unset": bson.M{"claimedUntil": ""}}); uerr != nil {
+			log.Printf("Failed to release held post %s: %v", post.MessageID, uerr)
+		}
+		return DomainListResult{}, err
+	}
+	if _, err := pending.DeleteOne(ctx, filter); err != nil {
+		log.Printf("Failed to remove approved post %s from the queue: %v", post.MessageID, err)
+	}
+	return result, nil
+}
+
+// deliverApproved fans an approved post out to the list.
+func (m *MongoMessageService) deliverApproved(ctx context.Context, list *MailingList, post PendingPost) (DomainListResult, error) {
+	var rawMsg bson.M
+	if err := m.db.Collection("messages").FindOne(ctx, bson.M{"messageId": post.MessageID}).Decode(&rawMsg); err != nil {
+		return DomainListResult{}, fmt.Errorf("loading held message: %w", err)
+	}
+
+	msg := convertBsonToMessage(rawMsg, false)
+	msg.ListID = list.Address
+	msg.ReplyTo = list.replyAddress(post.From)
+
+	plan := newDeliveryPlan(m.hosts)
+	plan.fanOut(list, post.ThreadID, post.MessageID, time.Now().UTC())
+	if err := m.applyRules(ctx, ruleInputFromMessage(msg), plan); err != nil {
+		return DomainListResult{}, err
+	}
+	size, _ := rawMsg["size"].(int64)
+	if err := m.enforceQuotas(ctx, plan, size); err != nil {
+		return DomainListResult{}, err
+	}
+	if err := m.insertEntries(ctx, plan.entries); err != nil {
+		return DomainListResult{}, err
+	}
+	// Email members and forwards go out through the SMTP queue, as they
+	// would have had the post not been held.
+	if err := m.enqueueOutbound(ctx, sendRequestFromMessage(msg), post.MessageID, post.ThreadID, plan.emailBatches()); err != nil {
+		log.Printf("Failed to queue approved post %s for email delivery: %v", post.MessageID, err)
+	}
+	return DomainListResult{
+		List:     list,
+		Approved: &msg,
+		Delivery: &DomainSendResult{
+			MessageID:   post.MessageID,
+			ThreadID:    post.ThreadID,
+			DeliveredTo: []string{list.Address},
+			Bounced:     plan.bounced,
+			Relays:      plan.relayBatches(),
+		},
+	}, nil
+}
+
+// sendRequestFromMessage rebuilds the request a stored message was sent
+// with, for delivering it again.
+func sendRequestFromMessage(msg Message) DomainSendRequest {
+	return DomainSendRequest{
+		MessageID:     msg.MessageID,
+		From:          msg.From,
+		To:            msg.To,
+		CC:            msg.CC,
+		Subject:       msg.Subject,
+		Body:          msg.Body,
+		Attachments:   msg.Attachments,
+		ListID:        msg.ListID,
+		ReplyTo:       msg.ReplyTo,
+		AutoSubmitted: msg.AutoSubmitted,
+	}
+}
+
+// getList returns the list with the given address, or nil if there is none.
+func (m *MongoMessageService) getList(ctx context.Context, address string) (*MailingList, error) {
+	var list MailingList
+	err := m.db.Collection("lists").FindOne(ctx, bson.M{"_id": address}).Decode(&list)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error retrieving mailing list: %w", err)
+	}
+	return &list, nil
+}
+
+func (l *MailingList) apply(req DomainListRequest) {
+	if req.Name != nil {
+		l.Name = *req.Name
+	}
+	if req.Description != nil {
+		l.Description = *req.Description
+	}
+	if req.PostingPolicy != nil {
+		l.PostingPolicy = *req.PostingPolicy
+	}
+	if req.ReplyTo != nil {
+		l.ReplyTo = *req.ReplyTo
+	}
+	if req.ArchiveAccess != nil {
+		l.ArchiveAccess = *req.ArchiveAccess
+	}
+}
+
+func (l *MailingList) validate() error {
+	if len(l.Owners) == 0 {
+		return fmt.Errorf("%w: a list needs at least one owner", ErrInvalidListConfig)
+	}
+	switch l.PostingPolicy {
+	case PostingPolicyMembersOnly, PostingPolicyModerated, PostingPolicyAnyone:
+	default:
+		return fmt.Errorf("%w: unknown posting policy %q", ErrInvalidListConfig, l.PostingPolicy)
+	}
+	switch l.ReplyTo {
+	case ReplyToList, ReplyToSender:
+	default:
+		return fmt.Errorf("%w: unknown reply-to mode %q", ErrInvalidListConfig, l.ReplyTo)
+	}
+	switch l.ArchiveAccess {
+	case ArchiveAccessOwners, ArchiveAccessMembers, ArchiveAccessPublic:
+	default:
+		return fmt.Errorf("%w: unknown archive access %q", ErrInvalidListConfig, l.ArchiveAccess)
+	}
+	return nil
+}
+
+func (l *MailingList) isOwner(addr string) bool {
+	return containsString(l.Owners, addr)
+}
+
+func (l *MailingList) isMember(addr string) bool {
+	return containsString(l.Members, addr)
+}
+
+// canPost reports whether sender may post directly and, if not, whether the
+// post should be held for moderation instead of being rejected.
+func (l *MailingList) canPost(sender string) (allowed, hold bool) {
+	if l.isOwner(sender) {
+		return true, false
+	}
+	switch l.PostingPolicy {
+	case PostingPolicyAnyone:
+		return true, false
+	case PostingPolicyModerated:
+		return false, true
+	default:
+		return l.isMember(sender), false
+	}
+}
+
+func (l *MailingList) replyAddress(sender string) string {
+	if l.ReplyTo == ReplyToList {
+		return l.Address
+	}
+	return sender
+}
+
+// deliveryPlan is the result of expanding a message's recipients.
+type deliveryPlan struct {
+	hosts     *hosting.Registry
+	entries   []mailboxEntry
+	relays    map[relayKey][]string
+	replyTo   map[string]string
+	delivered []string
+	queued    []string
+	held      []PendingPost
+	bounced   []string
+	seen      map[string]bool
+}
+
+type relayKey struct {
+	domain      string
+	listID      string
+	forwardedBy string
+	email       bool // regular email, delivered over SMTP instead of relayed
+}
+
+func newDeliveryPlan(hosts *hosting.Registry) *deliveryPlan {
+	return &deliveryPlan{
+		hosts:   hosts,
+		relays:  make(map[relayKey][]string),
+		replyTo: make(map[string]string),
+		seen:    make(map[string]bool),
+	}
+}
+
+func (p *deliveryPlan) deliverLocal(entry mailboxEntry) {
+	if p.seen[entry.UserID] {
+		return
+	}
+	p.seen[entry.UserID] = true
+	p.entries = append(p.entries, entry)
+}
+
+func (p *deliveryPlan) relay(addr, listID string) {
+	p.addRelay(addr, relayKey{listID: listID})
+}
+
+// relayForward relays a copy sent on by forwarder's rule.
+func (p *deliveryPlan) relayForward(addr, forwarder string) {
+	p.addRelay(addr, relayKey{forwardedBy: forwarder})
+}
+
+func (p *deliveryPlan) addRelay(addr string, key relayKey) {
+	if p.seen[addr] {
+		return
+	}
+	p.seen[addr] = true
+	key.domain = extractDomain(addr)
+	if isEmailAddress(addr) {
+		key.domain, key.email = emailDomain(addr), true
+	}
+	p.relays[key] = append(p.relays[key], addr)
+}
+
+// relayBatches returns the relays to other Quill servers in a stable order:
+// by domain, then list.
+func (p *deliveryPlan) relayBatches() []Relay {
+	return p.batches(false)
+}
+
+// emailBatches returns the batches for the outbound SMTP queue, ordered
+// like relayBatches.
+func (p *deliveryPlan) emailBatches() []Relay {
+	return p.batches(true)
+}
+
+func (p *deliveryPlan) batches(email bool) []Relay {
+	keys := make([]relayKey, 0, len(p.relays))
+	for k := range p.relays {
+		if k.email == email {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].domain != keys[j].domain {
+			return keys[i].domain < keys[j].domain
+		}
+		if keys[i].listID != keys[j].listID {
+			return keys[i].listID < keys[j].listID
+		}
+		return keys[i].forwardedBy < keys[j].forwardedBy
+	})
+
+	batches := make([]Relay, 0, len(keys))
+	for _, k := range keys {
+		recipients := p.relays[k]
+		sort.Strings(recipients)
+		batches = append(batches, Relay{
+			Domain:      k.domain,
+			ListID:      k.listID,
+			ReplyTo:     p.replyTo[k.listID],
+			Recipients:  recipients,
+			ForwardedBy: k.forwardedBy,
+		})
+	}
+	return batches
+}
+
+// fanOut delivers to every list member plus the list archive. Remote members
+// are added to the relay set so they never show up in the sender's result.
+func (p *deliveryPlan) fanOut(list *MailingList, threadID, messageID string, now time.Time) {
+	replyTo := list.replyAddress("")
+	p.replyTo[list.Address] = replyTo
+	for _, member := range list.Members {
+		if p.hosts.IsLocal(member) {
+			p.deliverLocal(mailboxEntry{
+				UserID:     member,
+				MessageID:  messageID,
+				ThreadID:   threadID,
+				Folder:     "inbox",
+				Read:       false,
+				ReceivedAt: now,
+				ListID:     list.Address,
+				ReplyTo:    replyTo,
+			})
+		} else {
+			p.relay(member, list.Address)
+		}
+	}
+	p.deliverLocal(mailboxEntry{
+		UserID:     list.Address,
+		MessageID:  messageID,
+		ThreadID:   threadID,
+		Folder:     folderListArchive,
+		Read:       true,
+		ReceivedAt: now,
+		ListID:     list.Address,
+	})
+}
+
+// planDelivery expands recipients into mailbox entries, held posts and
+// relays. relayRemote is false for mail arriving from another server, whose
+// remote recipients are that server's business.
+func (m *MongoMessageService) planDelivery(
+	ctx context.Context,
+	req DomainSendRequest,
+	recipients []string,
+	relayRemote bool,
+	messageID, threadID string,
+	now time.Time,
+) (*deliveryPlan, error) {
+	plan := newDeliveryPlan(m.hosts)
+	for _, addr := range uniqueStrings(recipients) {
+		if !m.hosts.IsLocal(addr) {
+			if relayRemote {
+				plan.relay(addr, "")
+				plan.queued = append(plan.queued, addr)
+			}
+			continue
+		}
+
+		// Mail to a retired handle lands in the renamed mailbox.
+		addr, err := m.resolveRedirect(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		list, err := m.getList(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		// Do not re-expand a list's own traffic coming back to it.
+		if list == nil || req.ListID == list.Address {
+			plan.deliverLocal(mailboxEntry{
+				UserID:     addr,
+				MessageID:  messageID,
+				ThreadID:   threadID,
+				Folder:     "inbox",
+				Read:       false,
+				ReceivedAt: now,
+				ListID:     req.ListID,
+				ReplyTo:    req.ReplyTo,
+			})
+			plan.delivered = append(plan.delivered, addr)
+			continue
+		}
+
+		allowed, hold := list.canPost(req.From)
+		switch {
+		case allowed:
+			plan.fanOut(list, threadID, messageID, now)
+			plan.delivered = append(plan.delivered, addr)
+		case hold:
+			plan.held = append(plan.held, PendingPost{
+				ListID:    list.Address,
+				MessageID: messageID,
+				ThreadID:  threadID,
+				From:      req.From,
+				Subject:   req.Subject,
+				HeldAt:    now,
+			})
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrListPostDenied, list.Address)
+		}
+	}
+	return plan, nil
+}
+
+func (p *deliveryPlan) heldLists() []string {
+	lists := make([]string, 0, len(p.held))
+	for _, h := range p.held {
+		lists = append(lists, h.ListID)
+	}
+	return lists
+}
+
+// insertHeld stores posts awaiting moderation.
+func (m *MongoMessageService) insertHeld(ctx context.Context, held []PendingPost) error {
+	if len(held) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, len(held))
+	for i, h := range held {
+		docs[i] = h
+	}
+	_, err := m.db.Collection("list_pending").InsertMany(ctx, docs)
+	return err
+}
+
+func containsString(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func uniqueStrings(addrs []string) []string {
+	var out []string
+	seen := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		if a == "" || seen[a] {
+			continue
+		}
+		seen[a] = true
+		out = append(out, a)
+	}
+	return out
+}
@@ -0,0 +1,292 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"quill/pkg/hosting"
+)
+
+func TestFanOutSplitsMembers(t *testing.T) {
+	hosts, err := hosting.NewRegistry(&hosting.Domain{Name: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := &MailingList{
+		Address: "team~example.com",
+		Members: []string{
+			"ada~example.com",
+			"bob~example.org",
+			"eve@example.net",
+			"carl~example.org",
+			"dan@example.net",
+			"ada~example.com", // listed twice
+		},
+		ReplyTo: ReplyToList,
+	}
+
+	plan := newDeliveryPlan(hosts)
+	plan.fanOut(list, "thread", "message", time.Now())
+
+	var local []string
+	for _, e := range plan.entries {
+		local = append(local, e.UserID+"/"+e.Folder)
+	}
+	if want := []string{"ada~example.com/inbox", "team~example.com/" + folderListArchive}; !reflect.DeepEqual(local, want) {
+		t.Errorf("local entries = %v, want %v", local, want)
+	}
+	wantRelays := []Relay{{Domain: "example.org", ListID: list.Address, ReplyTo: list.Address, Recipients: []string{"bob~example.org", "carl~example.org"}}}
+	if got := plan.relayBatches(); !reflect.DeepEqual(got, wantRelays) {
+		t.Errorf("relayBatches = %+v, want %+v", got, wantRelays)
+	}
+	wantEmail := []Relay{{Domain: "example.net", ListID: list.Address, ReplyTo: list.Address, Recipients: []string{"dan@example.net", "eve@example.net"}}}
+	if got := plan.emailBatches(); !reflect.DeepEqual(got, wantEmail) {
+		t.Errorf("emailBatches = %+v, want %+v", got, wantEmail)
+	}
+}
+
+func TestSendRequestFromMessage(t *testing.T) {
+	msg := Message{
+		MessageID:     "m1",
+		ThreadID:      "t1",
+		From:          "ada~example.com",
+		To:            []string{"team~example.com"},
+		CC:            []string{"bob~example.org"},
+		BCC:           []string{"secret~example.com"},
+		Subject:       "Hello",
+		Body:          Body{Content: []Content{{Type: ContentTypePlainText, Value: "hi"}}},
+		ListID:        "team~example.com",
+		ReplyTo:       "team~example.com",
+		AutoSubmitted: "",
+	}
+	req := sendRequestFromMessage(msg)
+	if req.MessageID != msg.MessageID || req.From != msg.From || req.Subject != msg.Subject || req.ListID != msg.ListID {
+		t.Errorf("request %+v does not match message %+v", req, msg)
+	}
+	if len(req.BCC) != 0 {
+		t.Errorf("BCC %v carried into a redelivery", req.BCC)
+	}
+}
+
+func TestListCanPost(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    PostingPolicy
+		sender    string
+		wantAllow bool
+		wantHold  bool
+	}{
+		{"owner on moderated list", PostingPolicyModerated, "owner~example.com", true, false},
+		{"member on members-only list", PostingPolicyMembersOnly, "ada~example.com", true, false},
+		{"stranger on members-only list", PostingPolicyMembersOnly, "eve~example.org", false, false},
+		{"member on moderated list", PostingPolicyModerated, "ada~example.com", false, true},
+		{"stranger on moderated list", PostingPolicyModerated, "eve~example.org", false, true},
+		{"stranger on open list", PostingPolicyAnyone, "eve~example.org", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list := &MailingList{
+				Owners:        []string{"owner~example.com"},
+				Members:       []string{"ada~example.com"},
+				PostingPolicy: tt.policy,
+			}
+			allowed, hold := list.canPost(tt.sender)
+			if allowed != tt.wantAllow || hold != tt.wantHold {
+				t.Errorf("canPost(%q) = %v, %v, want %v, %v", tt.sender, allowed, hold, tt.wantAllow, tt.wantHold)
+			}
+		})
+	}
+}
+
+func TestListValidate(t *testing.T) {
+	valid := func() MailingList {
+		return MailingList{
+			Owners:        []string{"owner~example.com"},
+			PostingPolicy: PostingPolicyMembersOnly,
+			ReplyTo:       ReplyToList,
+			ArchiveAccess: ArchiveAccessMembers,
+		}
+	}
+	tests := []struct {
+		name   string
+		modify func(*MailingList)
+		ok     bool
+	}{
+		{"valid", func(*MailingList) {}, true},
+		{"no owners", func(l *MailingList) { l.Owners = nil }, false},
+		{"unknown posting policy", func(l *MailingList) { l.PostingPolicy = "open" }, false},
+		{"unknown reply-to", func(l *MailingList) { l.ReplyTo = "author" }, false},
+		{"unknown archive access", func(l *MailingList) { l.ArchiveAccess = "" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list := valid()
+			tt.modify(&list)
+			err := list.validate()
+			if tt.ok && err != nil {
+				t.Errorf("validate() = %v, want nil", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrInvalidListConfig) {
+				t.Errorf("validate() = %v, want ErrInvalidListConfig", err)
+			}
+		})
+	}
+}
+
+func TestListApplyOnlyTouchesSentFields(t *testing.T) {
+	name := "Team"
+	policy := PostingPolicyAnyone
+	list := MailingList{
+		Name:          "Old",
+		Description:   "kept",
+		PostingPolicy: PostingPolicyModerated,
+		ReplyTo:       ReplyToSender,
+	}
+	list.apply(DomainListRequest{Name: &name, PostingPolicy: &policy})
+	want := MailingList{
+		Name:          "Team",
+		Description:   "kept",
+		PostingPolicy: PostingPolicyAnyone,
+		ReplyTo:       ReplyToSender,
+	}
+	if !reflect.DeepEqual(list, want) {
+		t.Errorf("list = %+v, want %+v", list, want)
+	}
+}
+
+func TestListReplyAddress(t *testing.T) {
+	list := &MailingList{Address: "team~example.com", ReplyTo: ReplyToList}
+	if got := list.replyAddress("ada~example.com"); got != list.Address {
+		t.Errorf("replyAddress = %q, want the list", got)
+	}
+	list.ReplyTo = ReplyToSender
+	if got := list.replyAddress("ada~example.com"); got != "ada~example.com" {
+		t.Errorf("replyAddress = %q, want the sender", got)
+	}
+}
+
+func TestUniqueStrings(t *testing.T) {
+	got := uniqueStrings([]string{"b", "", "a", "b", "c", "a"})
+	if want := []string{"b", "a", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("uniqueStrings = %v, want %v", got, want)
+	}
+}
+
+func TestPlanDeliveryExpandsLists(t *testing.T) {
+	m := testStore(t)
+	insert(t, m.db.Collection("lists"),
+		MailingList{Address: "team~example.com", Members: []string{"ada~example.com", "eve~example.org"}, PostingPolicy: PostingPolicyAnyone, ReplyTo: ReplyToList},
+		MailingList{Address: "mods~example.com", Owners: []string{"ceo~example.com"}, PostingPolicy: PostingPolicyModerated},
+		MailingList{Address: "closed~example.com", Members: []string{"ada~example.com"}, PostingPolicy: PostingPolicyMembersOnly},
+	)
+	insert(t, m.db.Collection("address_redirects"),
+		AddressRedirect{Address: "old~example.com", Target: "dan~example.com", Alias: true})
+	ctx := context.Background()
+	now := time.Now().UTC()
+	req := DomainSendRequest{From: "bob~example.com", Subject: "hi"}
+
+	plan, err := m.planDelivery(ctx, req, []string{"team~example.com", "mods~example.com", "old~example.com", "carl~example.org"}, true, "message", "thread", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var local []string
+	for _, e := range plan.entries {
+		local = append(local, e.UserID+"/"+e.Folder+"/"+e.ListID)
+	}
+	wantLocal := []string{"ada~example.com/inbox/team~example.com", "team~example.com/" + folderListArchive + "/team~example.com", "dan~example.com/inbox/"}
+	if !reflect.DeepEqual(local, wantLocal) {
+		t.Errorf("local entries = %v, want %v", local, wantLocal)
+	}
+	if got := plan.heldLists(); !reflect.DeepEqual(got, []string{"mods~example.com"}) {
+		t.Errorf("held = %v, want the moderated list", got)
+	}
+	wantRelays := []Relay{
+		{Domain: "example.org", Recipients: []string{"carl~example.org"}},
+		{Domain: "example.org", ListID: "team~example.com", ReplyTo: "team~example.com", Recipients: []string{"eve~example.org"}},
+	}
+	if got := plan.relayBatches(); !reflect.DeepEqual(got, wantRelays) {
+		t.Errorf("relayBatches = %+v, want %+v", got, wantRelays)
+	}
+
+	if _, err := m.planDelivery(ctx, req, []string{"closed~example.com"}, true, "message", "thread", now); !errors.Is(err, ErrListPostDenied) {
+		t.Errorf("post to a closed list: got %v, want ErrListPostDenied", err)
+	}
+	plan, err = m.planDelivery(ctx, DomainSendRequest{From: "eve~example.org"}, []string{"carl~example.org"}, false, "message", "thread", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.relays) != 0 {
+		t.Errorf("relayed mail from another server onwards: %+v", plan.relayBatches())
+	}
+}
+
+func TestModerateDeliversBeforeRemovingPost(t *testing.T) {
+	m := testStore(t)
+	list := &MailingList{Address: "mods~example.com", Owners: []string{"ceo~example.com"}, Members: []string{"ada~example.com"}, PostingPolicy: PostingPolicyModerated, ReplyTo: ReplyToList}
+	insert(t, m.db.Collection("lists"), list)
+	insert(t, m.db.Collection("list_pending"),
+		PendingPost{ListID: list.Address, MessageID: "held", ThreadID: "thread", From: "bob~example.com"},
+		PendingPost{ListID: list.Address, MessageID: "spam", ThreadID: "thread", From: "eve~example.org"},
+	)
+	ctx := context.Background()
+	pending := m.db.Collection("list_pending")
+	approve := func(id string) (DomainListResult, error) {
+		return m.moderate(ctx, "ceo~example.com", list, DomainListRequest{Action: ListActionApprove, MessageID: &id})
+	}
+
+	if _, err := m.moderate(ctx, "ada~example.com", list, DomainListRequest{Action: ListActionApprove, MessageID: new(string)}); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("member moderating: got %v, want ErrPermissionDenied", err)
+	}
+
+	// The message is missing, so delivery fails and the post stays held.
+	if _, err := approve("held"); err == nil {
+		t.Fatal("approved a post whose message is missing")
+	}
+	if n := count(t, pending, bson.M{"messageId": "held", "claimedUntil": bson.M{"$exists": false}}); n != 1 {
+		t.Fatalf("failed approval left %d unclaimed posts, want 1", n)
+	}
+
+	insert(t, m.db.Collection("messages"), bson.M{
+		"messageId": "held",
+		"fromMail":  "bob~example.com",
+		"subject":   "hi",
+		"size":      int64(10),
+		"options":   bson.M{"threadID": "thread"},
+	})
+	res, err := approve("held")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Approved == nil || res.Approved.ListID != list.Address || res.Approved.ReplyTo != list.Address {
+		t.Errorf("approved = %+v", res.Approved)
+	}
+	if n := count(t, m.db.Collection("mailboxes"), bson.M{"userId": "ada~example.com", "messageId": "held"}); n != 1 {
+		t.Errorf("member has %d copies, want 1", n)
+	}
+	if n := count(t, pending, bson.M{"messageId": "held"}); n != 0 {
+		t.Errorf("approved post still held")
+	}
+	if _, err := approve("held"); !errors.Is(err, ErrPendingNotFound) {
+		t.Errorf("second approval: got %v, want ErrPendingNotFound", err)
+	}
+
+	// A post claimed by an approval in progress cannot be approved again.
+	if _, err := pending.UpdateOne(ctx, bson.M{"messageId": "spam"}, bson.M{"$set": bson.M{"claimedUntil": time.Now().Add(time.Minute)}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := approve("spam"); !errors.Is(err, ErrPendingNotFound) {
+		t.Errorf("approving a claimed post: got %v, want ErrPendingNotFound", err)
+	}
+	reject := "spam"
+	if _, err := m.moderate(ctx, "ceo~example.com", list, DomainListRequest{Action: ListActionReject, MessageID: &reject}); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, pending, bson.M{}); n != 0 {
+		t.Errorf("%d posts left after rejection", n)
+	}
+}
@@ -0,0 +1,135 @@
+package domain
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Operator tools work on the store directly, for any mailbox; none of the
+// methods in this file look at the caller.
+
+// MessageLookup is everything stored about one message ID.
+type MessageLookup struct {
+	// Message is nil when only mailbox entries or queue entries remain.
+	Message  *Message
+	Copies   []MessageCopy
+	Outbound []OutboundMessage
+}
+
+// MessageCopy is the message's entry in one mailbox.
+type MessageCopy struct {
+	Owner      string
+	Folder     string
+	Labels     []string
+	Flags      []string
+	Read       bool
+	ReceivedAt time.Time
+}
+
+// LookupMessage finds a message by ID in every mailbox and in the outbound
+// queue.
+func (m *MongoMessageService) LookupMessage(ctx context.Context, messageID string) (*MessageLookup, error) {
+	var lookup MessageLookup
+	var raw bson.M
+	err := m.db.Collection("messages").FindOne(ctx, bson.M{"messageId": messageID}).Decode(&raw)
+	switch {
+	case err == nil:
+		msg := convertBsonToMessage(raw, false)
+		lookup.Message = &msg
+	case err != mongo.ErrNoDocuments:
+		return nil, err
+	}
+
+	cursor, err := m.db.Collection("mailboxes").Find(ctx, bson.M{"messageId": messageID},
+		options.Find().SetSort(bson.D{{Key: "userId", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var entries []mailboxEntry
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		lookup.Copies = append(lookup.Copies, MessageCopy{
+			Owner:      e.UserID,
+			Folder:     e.Folder,
+			Labels:     e.Labels,
+			Flags:      e.Flags,
+			Read:       e.Read,
+			ReceivedAt: e.ReceivedAt,
+		})
+	}
+
+	cursor, err = m.db.Collection("outbound").Find(ctx, bson.M{"messageId": messageID})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &lookup.Outbound); err != nil {
+		return nil, err
+	}
+
+	if lookup.Message == nil && len(lookup.Copies) == 0 && len(lookup.Outbound) == 0 {
+		return nil, ErrMessageNotFound
+	}
+	return &lookup, nil
+}
+
+// MailboxReindex reports what ReindexMailbox rebuilt.
+type MailboxReindex struct {
+	Address  string
+	Bytes    int64
+	Messages int64
+	// Renumbered is the number of entries whose IMAP UIDs were dropped.
+	Renumbered int
+}
+
+// ReindexMailbox recounts the storage used by the mailbox at addr. With
+// renumber it also drops the mailbox's IMAP UIDs, so every folder is
+// numbered afresh under a new UIDVALIDITY the next time it is viewed and
+// IMAP clients download it again.
+func (m *MongoMessageService) ReindexMailbox(ctx context.Context, addr string, renumber bool) (MailboxReindex, error) {
+	// usage counts the mailbox when it has no running total; a delivery in
+	// between does the same, so nothing is counted twice.
+	if _, err := m.db.Collection("mailbox_usage").DeleteOne(ctx, bson.M{"_id": addr}); err != nil {
+		return MailboxReindex{}, err
+	}
+	usage, err := m.usage(ctx, addr)
+	if err != nil {
+		return MailboxReindex{}, err
+	}
+	result := MailboxReindex{Address: addr, Bytes: usage.Bytes, Messages: usage.Messages}
+	if !renumber {
+		return result, nil
+	}
+
+	// Drop the UIDs before moving the counters on: a folder viewed in
+	// between numbers its entries from the old counters, and those numbers
+	// stay valid under the new UIDVALIDITY since the counters keep counting
+	// up rather than starting again.
+	res, err := m.db.Collection("mailboxes").UpdateMany(ctx,
+		bson.M{"userId": addr, "uid": bson.M{"$exists": true}},
+		bson.M{"$unset": bson.M{"uid": "", "uidFolder": ""}})
+	if err != nil {
+		return result, err
+	}
+	result.Renumbered = int(res.ModifiedCount)
+	if _, err := m.db.Collection("folder_uids").UpdateMany(ctx,
+		bson.M{"owner": addr},
+		nextValidity(time.Now())); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// nextValidity is the update that gives a folder_uids counter a
+// UIDVALIDITY strictly greater than its current one, even when the counter
+// was created within the same second.
+func nextValidity(now time.Time) mongo.Pipeline {
+	return mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"validity": bson.M{"$max": bson.A{bson.M{"$add": bson.A{"$validity", 1}}, int64(uint32(now.Unix()))}},
+	}}}}
+}
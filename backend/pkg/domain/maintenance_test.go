@@ -0,0 +1,18 @@
+package domain
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestNextValidity(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	want := bson.M{"validity": bson.M{"$max": bson.A{bson.M{"$add": bson.A{"$validity", 1}}, int64(1_700_000_000)}}}
+	got := nextValidity(now)
+	if len(got) != 1 || len(got[0]) != 1 || got[0][0].Key != "$set" || !reflect.DeepEqual(got[0][0].Value, want) {
+		t.Errorf("nextValidity() = %v, want $set %v", got, want)
+	}
+}
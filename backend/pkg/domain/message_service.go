@@ -9,8 +9,10 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"log"
-	"quill/cmd/main/constants"
+	"quill/pkg/hosting"
+	"quill/pkg/identity"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -50,34 +52,92 @@ func (m *MockMessageService) Fetch(ctx context.Context, req DomainFetchRequest)
 
 // MongoMessageService implements the MessageService interface with MongoDB storage
 type MongoMessageService struct {
-	db *mongo.Database
+	db     *mongo.Database
+	hosts  *hosting.Registry
+	limits atomic.Pointer[Limits] // swapped on config reload
+	// watchers receive the changes recorded by this process; see Watch.
+	watchers changeWatchers
 }
 
 // NewMongoMessageService creates a new MongoDB-backed MessageService
-func NewMongoMessageService(db *mongo.Database) *MongoMessageService {
-	return &MongoMessageService{
-		db: db,
-	}
+// serving the domains in hosts.
+func NewMongoMessageService(db *mongo.Database, hosts *hosting.Registry) *MongoMessageService {
+	m := &MongoMessageService{db: db, hosts: hosts}
+	m.SetLimits(DefaultLimits)
+	return m
 }
 
 // mailboxEntry represents a reference to a message in a user's mailbox
 type mailboxEntry struct {
-	UserID     string    `bson:"userId"`
-	MessageID  string    `bson:"messageId"`
-	ThreadID   string    `bson:"threadId"`
-	Folder     string    `bson:"folder"`
-	Read       bool      `bson:"read"`
-	ReceivedAt time.Time `bson:"receivedAt"`
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	UserID     string             `bson:"userId"`
+	MessageID  string             `bson:"messageId"`
+	ThreadID   string             `bson:"threadId"`
+	Folder     string             `bson:"folder"`
+	Read       bool               `bson:"read"`
+	ReceivedAt time.Time          `bson:"receivedAt"`
+	ListID     string             `bson:"listId,omitempty"`
+	ReplyTo    string             `bson:"replyTo,omitempty"`
+	Flags      []string           `bson:"flags,omitempty"`
+	Labels     []string           `bson:"labels,omitempty"`
+	Size       int64              `bson:"size,omitempty"` // bytes counted against the owner's quota
+	// UID numbers the entry within UIDFolder for IMAP; see FolderView.
+	UID       uint32 `bson:"uid,omitempty"`
+	UIDFolder string `bson:"uidFolder,omitempty"`
 }
 
 // Send stores a message in MongoDB and adds entries to each recipient's mailbox
 func (m *MongoMessageService) Send(ctx context.Context, req DomainSendRequest) (DomainSendResult, error) {
-	if extractDomain(req.From) == constants.DOMAIN_NAME {
+	p, err := callerPrincipal(ctx)
+	if err != nil {
+		return DomainSendResult{}, err
+	}
+	if m.hosts.IsLocal(req.From) {
+		// Only the account owning the address sends as it; SendInternal
+		// files the copy and charges the quota of whoever From names.
+		if !p.HasAddress(req.From) {
+			return DomainSendResult{}, fmt.Errorf("%w: cannot send as %s", ErrPermissionDenied, req.From)
+		}
 		return m.SendInternal(ctx, req)
 	}
+	// Mail from other domains only arrives relayed by their servers or
+	// through the SMTP gateway.
+	if p.Method != identity.AuthMethodPeer && p.Method != identity.AuthMethodSMTP {
+		return DomainSendResult{}, fmt.Errorf("%w: %s is not hosted here", ErrPermissionDenied, extractDomain(req.From))
+	}
+	if p.Method == identity.AuthMethodPeer {
+		if req, err = checkRelayedSender(p.AccountID, req); err != nil {
+			return DomainSendResult{}, err
+		}
+	}
 	return m.SendExternal(ctx, req)
 }
 
+// checkRelayedSender makes sure a peer verified for peerDomain only relays
+// mail its own domain sends. A forwarded copy is sent on by its forwarder,
+// so the original author is never taken on the peer's word. List traffic
+// must come from a list on the peer's domain; a post whose author is
+// elsewhere is filed as sent by the list, which is all the peer vouches for.
+func checkRelayedSender(peerDomain string, req DomainSendRequest) (DomainSendRequest, error) {
+	peerDomain = strings.ToLower(peerDomain)
+	if req.ForwardedBy != "" && !strings.EqualFold(req.From, req.ForwardedBy) {
+		return req, fmt.Errorf("%w: forwarded copy from %s must be sent as its forwarder %s", ErrPermissionDenied, req.From, req.ForwardedBy)
+	}
+	if req.ListID != "" {
+		if hosting.DomainOf(req.ListID) != peerDomain {
+			return req, fmt.Errorf("%w: %s cannot relay list %s", ErrPermissionDenied, peerDomain, req.ListID)
+		}
+		if hosting.DomainOf(req.From) != peerDomain {
+			req.From = req.ListID
+		}
+		return req, nil
+	}
+	if hosting.DomainOf(req.From) != peerDomain {
+		return req, fmt.Errorf("%w: %s cannot relay mail from %s", ErrPermissionDenied, peerDomain, req.From)
+	}
+	return req, nil
+}
+
 func (m *MongoMessageService) SendInternal(ctx context.Context, req DomainSendRequest) (DomainSendResult, error) {
 	// 1. Validate or generate messageID
 	var messageID string
@@ -107,18 +167,28 @@ func (m *MongoMessageService) SendInternal(ctx context.Context, req DomainSendRe
 	userID := req.From
 	now := time.Now().UTC()
 
+	// The sender keeps a copy in "sent", so their own quota applies first.
+	size := MessageSize(req)
+	if ok, err := m.hasRoom(ctx, userID, size); err != nil {
+		return DomainSendResult{}, err
+	} else if !ok {
+		return DomainSendResult{}, ErrQuotaExceeded
+	}
+
 	// Prepare the message document
 	messageDoc := bson.M{
-		"messageId":   messageID,
-		"fromID":      userID,
-		"fromMail":    req.From,
-		"to":          req.To,
-		"cc":          req.CC,
-		"bcc":         req.BCC,
-		"subject":     req.Subject,
-		"body":        req.Body,
-		"attachments": req.Attachments,
-		"sentAt":      now,
+		"messageId":     messageID,
+		"fromID":        userID,
+		"fromMail":      req.From,
+		"to":            req.To,
+		"cc":            req.CC,
+		"bcc":           req.BCC,
+		"subject":       req.Subject,
+		"body":          req.Body,
+		"attachments":   req.Attachments,
+		"size":          size,
+		"sentAt":        now,
+		"autoSubmitted": req.AutoSubmitted,
 		"options": bson.M{
 			"expiresInSeconds": req.Options.ExpiresInSeconds,
 			"oneTime":          req.Options.OneTime,
@@ -126,6 +196,24 @@ func (m *MongoMessageService) SendInternal(ctx context.Context, req DomainSendRe
 		},
 	}
 
+	// Expand lists and split recipients before anything is written, so a
+	// rejected list post does not leave a half-delivered message behind.
+	allRecipients := make([]string, 0, len(req.To)+len(req.CC)+len(req.BCC))
+	allRecipients = append(append(append(allRecipients, req.To...), req.CC...), req.BCC...)
+	plan, err := m.planDelivery(ctx, req, allRecipients, true, messageID, threadID, now)
+	if err != nil {
+		return DomainSendResult{}, err
+	}
+	if err := m.applyRules(ctx, ruleInputFromRequest(req), plan); err != nil {
+		return DomainSendResult{}, err
+	}
+	if err := m.enforceQuotas(ctx, plan, size); err != nil {
+		return DomainSendResult{}, err
+	}
+	if plan.fullyBounced() {
+		return DomainSendResult{}, fmt.Errorf("%w: %s", ErrMailboxFull, strings.Join(plan.bounced, ", "))
+	}
+
 	// Insert into messages collection
 	if _, err := m.db.Collection("messages").
 		InsertOne(ctx, messageDoc); err != nil {
@@ -134,74 +222,49 @@ func (m *MongoMessageService) SendInternal(ctx context.Context, req DomainSendRe
 	}
 
 	// Build mailbox entries
-	entries := []interface{}{
-		mailboxEntry{
+	entries := append([]mailboxEntry{
+		{
 			UserID:     userID,
 			MessageID:  messageID,
 			ThreadID:   threadID,
 			Folder:     "sent",
 			Read:       true,
 			ReceivedAt: now,
+			Size:       size,
 		},
-	}
+	}, plan.entries...)
 
-	allRecipients := append(append(req.To, req.CC...), req.BCC...)
-	var internal, external []string
-	for _, addr := range allRecipients {
-		if strings.HasSuffix(addr, constants.DOMAIN_NAME) {
-			internal = append(internal, addr)
-			entries = append(entries, mailboxEntry{
-				UserID:     addr,
-				MessageID:  messageID,
-				ThreadID:   threadID,
-				Folder:     "inbox",
-				Read:       false,
-				ReceivedAt: now,
-			})
-		} else {
-			external = append(external, addr)
-		}
+	if err := m.insertEntries(ctx, entries); err != nil {
+		log.Printf("Failed to insert mailbox entries: %v", err)
+		// consider rollback of the message?
 	}
-
-	if len(entries) > 0 {
-		if _, err := m.db.Collection("mailboxes").
-			InsertMany(ctx, entries); err != nil {
-			log.Printf("Failed to insert mailbox entries: %v", err)
-			// consider rollback of the message?
-		}
+	if err := m.insertHeld(ctx, plan.held); err != nil {
+		log.Printf("Failed to hold message for moderation: %v", err)
+	}
+	if err := m.enqueueOutbound(ctx, req, messageID, threadID, plan.emailBatches()); err != nil {
+		log.Printf("Failed to queue message for email delivery: %v", err)
 	}
 
 	return DomainSendResult{
 		MessageID:   messageID,
 		ThreadID:    threadID,
-		DeliveredTo: internal,
-		QueuedFor:   external,
+		DeliveredTo: plan.delivered,
+		QueuedFor:   plan.queued,
+		Held:        plan.heldLists(),
+		Bounced:     plan.bounced,
+		Relays:      plan.relayBatches(),
+		AutoReplies: m.autoRespond(ctx, req, threadID, plan.entries),
 	}, nil
 }
 
 func (m *MongoMessageService) SendExternal(ctx context.Context, req DomainSendRequest) (DomainSendResult, error) {
-
-	// Generate new message ID and thread ID if not provided
-	myRecipients := []string{}
-	for _, addr := range req.To {
-		if extractDomain(addr) == constants.DOMAIN_NAME {
-			myRecipients = append(myRecipients, addr)
-		}
-	}
-	for _, addr := range req.CC {
-		if extractDomain(addr) == constants.DOMAIN_NAME {
-			myRecipients = append(myRecipients, addr)
-		}
-	}
-	for _, addr := range req.BCC {
-		if extractDomain(addr) == constants.DOMAIN_NAME {
-			myRecipients = append(myRecipients, addr)
-		}
+	// Relaying servers pick the thread; anything else is a malformed relay.
+	if req.Options.ThreadID == nil || *req.Options.ThreadID == "" {
+		return DomainSendResult{}, errorString("did not provide thread ID")
 	}
-
 	threadID := *req.Options.ThreadID
-	if !(req.Options.ThreadID != nil && *req.Options.ThreadID != "") || isUUID(*req.Options.ThreadID) == false {
-		return DomainSendResult{}, errorString("did not provide thread ID")
+	if !isUUID(threadID) {
+		return DomainSendResult{}, errorString("invalid thread ID: must be a UUID")
 	}
 	messageID := req.MessageID
 	if !(req.MessageID != "") {
@@ -220,15 +283,18 @@ func (m *MongoMessageService) SendExternal(ctx context.Context, req DomainSendRe
 
 	// Prepare message document
 	now := time.Now().UTC()
+	size := MessageSize(req)
 	messageDoc := bson.M{
-		"messageId":   messageID,
-		"fromMail":    req.From,
-		"to":          req.To,
-		"cc":          req.CC,
-		"subject":     req.Subject,
-		"body":        req.Body,
-		"attachments": req.Attachments,
-		"sentAt":      now,
+		"messageId":     messageID,
+		"fromMail":      req.From,
+		"to":            req.To,
+		"cc":            req.CC,
+		"subject":       req.Subject,
+		"body":          req.Body,
+		"attachments":   req.Attachments,
+		"size":          size,
+		"sentAt":        now,
+		"autoSubmitted": req.AutoSubmitted,
 		"options": bson.M{
 			"expiresInSeconds": req.Options.ExpiresInSeconds,
 			"oneTime":          req.Options.OneTime,
@@ -236,63 +302,65 @@ func (m *MongoMessageService) SendExternal(ctx context.Context, req DomainSendRe
 		},
 	}
 
+	// A relaying server names the recipients it wants delivered here;
+	// older servers only send headers, so fall back to those.
+	recipients := req.Envelope
+	if len(recipients) == 0 {
+		recipients = make([]string, 0, len(req.To)+len(req.CC)+len(req.BCC))
+		recipients = append(append(append(recipients, req.To...), req.CC...), req.BCC...)
+	}
+	plan, err := m.planDelivery(ctx, req, recipients, false, messageID, threadID, now)
+	if err != nil {
+		return DomainSendResult{}, err
+	}
+	if err := m.applyRules(ctx, ruleInputFromRequest(req), plan); err != nil {
+		return DomainSendResult{}, err
+	}
+	// With every recipient full the relaying server gets an error and can
+	// retry later; partial bounces are reported in the result.
+	if err := m.enforceQuotas(ctx, plan, size); err != nil {
+		return DomainSendResult{}, err
+	}
+	if plan.fullyBounced() {
+		return DomainSendResult{}, fmt.Errorf("%w: %s", ErrMailboxFull, strings.Join(plan.bounced, ", "))
+	}
+
 	// Insert message into messages collection
-	_, err := m.db.Collection("messages").InsertOne(ctx, messageDoc)
+	_, err = m.db.Collection("messages").InsertOne(ctx, messageDoc)
 	if err != nil {
 		log.Printf("Failed to insert message: %v", err)
 		return DomainSendResult{}, err
 	}
 
-	// Create mailbox entries for all recipients (including sender's sent folder)
-	var mailboxEntries []interface{}
-
-	for _, recipient := range myRecipients {
-		mailboxEntries = append(mailboxEntries, mailboxEntry{
-			UserID:     recipient,
-			MessageID:  messageID,
-			ThreadID:   threadID,
-			Folder:     "inbox",
-			Read:       false,
-			ReceivedAt: now,
-		})
-	}
 	// Insert all mailbox entries
-	if len(mailboxEntries) > 0 {
-		_, err = m.db.Collection("mailboxes").InsertMany(ctx, mailboxEntries)
-		if err != nil {
-			log.Printf("Failed to insert mailbox entries: %v", err)
-			// Consider handling this error (perhaps delete the message?)
-		}
+	if err := m.insertEntries(ctx, plan.entries); err != nil {
+		log.Printf("Failed to insert mailbox entries: %v", err)
+		// Consider handling this error (perhaps delete the message?)
+	}
+	if err := m.insertHeld(ctx, plan.held); err != nil {
+		log.Printf("Failed to hold message for moderation: %v", err)
+	}
+	if err := m.enqueueOutbound(ctx, req, messageID, threadID, plan.emailBatches()); err != nil {
+		log.Printf("Failed to queue message for email delivery: %v", err)
 	}
 
 	return DomainSendResult{
-		MessageID: messageID,
-		ThreadID:  threadID,
+		MessageID:   messageID,
+		ThreadID:    threadID,
+		DeliveredTo: plan.delivered,
+		Held:        plan.heldLists(),
+		Bounced:     plan.bounced,
+		Relays:      plan.relayBatches(),
+		AutoReplies: m.autoRespond(ctx, req, threadID, plan.entries),
 	}, nil
 }
 
 // Fetch retrieves messages based on the provided request
 func (m *MongoMessageService) Fetch(ctx context.Context, req DomainFetchRequest) (DomainFetchResult, error) {
-	// Extract user ID from context
-	userID, ok := ctx.Value("userID").(string)
-	if !ok {
-		return DomainFetchResult{}, ErrUserNotAuthenticated
-	}
-	// get users quillmail domain
-
-	collection := m.db.Collection("users")
-	filter := bson.M{"_id": userID}
-	var result struct {
-		UserQuillMail string `bson:"userQuillMail"`
-	}
-	err := collection.FindOne(ctx, filter).Decode(&result)
+	quillmail, err := m.callerAddress(ctx)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return DomainFetchResult{}, err
-		}
-		return DomainFetchResult{}, fmt.Errorf("error retrieving userQuillMail: %w", err)
+		return DomainFetchResult{}, err
 	}
-	quillmail := result.UserQuillMail
 
 	// Set default limit and offset if not provided
 	limit := 10
@@ -306,24 +374,49 @@ func (m *MongoMessageService) Fetch(ctx context.Context, req DomainFetchRequest)
 	}
 
 	// Build query based on fetch mode
+	var filter bson.M
 	if req.Mode == FetchModeThread && req.ThreadID != nil {
 		filter = bson.M{
-			"userId":           userID,
-			"options.threadID": *req.ThreadID,
+			"userId":   quillmail,
+			"threadId": *req.ThreadID,
 		}
 	} else if req.Mode == FetchModeFolder && req.Folder != nil {
 		filter = bson.M{
 			"userId": quillmail,
 			"folder": *req.Folder,
 		}
+	} else if req.Mode == FetchModeLabel && req.Label != nil {
+		filter = bson.M{
+			"userId": quillmail,
+			"labels": *req.Label,
+		}
+	} else if req.Mode == FetchModeMessage && req.MessageID != nil {
+		filter = bson.M{
+			"userId":    quillmail,
+			"messageId": *req.MessageID,
+		}
 	} else {
 		// Default to inbox if no valid mode/parameters provided
 		filter = bson.M{
-			"userId": userID,
+			"userId": quillmail,
 			"folder": "inbox",
 		}
 	}
 
+	result, err := m.fetchEntries(ctx, filter, limit, offset, req.Cursor)
+	if err != nil {
+		return DomainFetchResult{}, err
+	}
+	if result.ModSeq, err = m.stableModSeq(ctx, quillmail); err != nil {
+		return DomainFetchResult{}, err
+	}
+	return result, nil
+}
+
+// fetchEntries pages through the mailbox entries matching filter and joins
+// them with their messages, newest first. A non-empty after cursor takes
+// precedence over offset.
+func (m *MongoMessageService) fetchEntries(ctx context.Context, filter bson.M, limit, offset int, after string) (DomainFetchResult, error) {
 	// Get total count of matching messages
 	total, err := m.db.Collection("mailboxes").CountDocuments(ctx, filter)
 	if err != nil {
@@ -332,11 +425,21 @@ func (m *MongoMessageService) Fetch(ctx context.Context, req DomainFetchRequest)
 
 	// Find mailbox entries
 	findOptions := options.Find().
-		SetSort(bson.D{{Key: "receivedAt", Value: -1}}).
-		SetSkip(int64(offset)).
+		SetSort(bson.D{{Key: "receivedAt", Value: -1}, {Key: "_id", Value: -1}}).
 		SetLimit(int64(limit))
+	pageFilter := filter
+	if after != "" {
+		cf, err := cursorFilter(after)
+		if err != nil {
+			return DomainFetchResult{}, err
+		}
+		pageFilter = bson.M{"$and": bson.A{filter, cf}}
+		offset = 0
+	} else {
+		findOptions.SetSkip(int64(offset))
+	}
 
-	cursor, err := m.db.Collection("mailboxes").Find(ctx, filter, findOptions)
+	cursor, err := m.db.Collection("mailboxes").Find(ctx, pageFilter, findOptions)
 	if err != nil {
 		return DomainFetchResult{}, err
 	}
@@ -398,16 +501,107 @@ func (m *MongoMessageService) Fetch(ctx context.Context, req DomainFetchRequest)
 	for _, entry := range entries {
 		if rawMsg, found := messageMap[entry.MessageID]; found {
 			message := convertBsonToMessage(rawMsg, entry.Read)
+			message.ListID = entry.ListID
+			message.ReplyTo = entry.ReplyTo
+			message.Flags = entry.Flags
+			message.Labels = entry.Labels
+			message.Folder = entry.Folder
 			messages = append(messages, message)
 		}
 	}
 
-	return DomainFetchResult{
+	result := DomainFetchResult{
 		Total:    int(total),
 		Limit:    limit,
 		Offset:   offset,
 		Messages: messages,
-	}, nil
+	}
+	if len(entries) == limit {
+		result.NextCursor = encodeCursor(entries[len(entries)-1])
+	}
+	return result, nil
+}
+
+// ResolvePrincipal fills in the Quill addresses and roles of the principal
+// in ctx from the users collection. Accounts without a user document yet
+// (before /createUser) stay unresolved rather than failing authentication.
+func (m *MongoMessageService) ResolvePrincipal(ctx context.Context) (context.Context, error) {
+	p, ok := identity.FromContext(ctx)
+	if !ok {
+		return ctx, ErrUserNotAuthenticated
+	}
+	var user struct {
+		UserQuillMail string   `bson:"userQuillMail"`
+		Roles         []string `bson:"roles"`
+		Suspended     bool     `bson:"suspended"`
+	}
+	err := m.db.Collection("users").FindOne(ctx, bson.M{"_id": p.AccountID}).Decode(&user)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return ctx, fmt.Errorf("error resolving principal: %w", err)
+	}
+	if user.Suspended {
+		return ctx, ErrAccountSuspended
+	}
+
+	resolved := *p
+	resolved.Addresses = nil
+	if user.UserQuillMail != "" {
+		resolved.Addresses = []string{user.UserQuillMail}
+	}
+	resolved.Roles = append([]string{identity.RoleUser}, user.Roles...)
+	return identity.WithPrincipal(ctx, &resolved), nil
+}
+
+// callerPrincipal returns the authenticated principal in ctx.
+func callerPrincipal(ctx context.Context) (*identity.Principal, error) {
+	p, ok := identity.FromContext(ctx)
+	if !ok {
+		return nil, ErrUserNotAuthenticated
+	}
+	return p, nil
+}
+
+// callerAddress resolves the authenticated principal in ctx to their Quill address.
+func (m *MongoMessageService) callerAddress(ctx context.Context) (string, error) {
+	p, err := callerPrincipal(ctx)
+	if err != nil {
+		return "", err
+	}
+	if addr := p.Address(); addr != "" {
+		return addr, nil
+	}
+	return m.lookupQuillMail(ctx, p.AccountID)
+}
+
+func (m *MongoMessageService) lookupQuillMail(ctx context.Context, userID string) (string, error) {
+	var result struct {
+		UserQuillMail string `bson:"userQuillMail"`
+	}
+	err := m.db.Collection("users").FindOne(ctx, bson.M{"_id": userID}).Decode(&result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return "", err
+		}
+		return "", fmt.Errorf("error retrieving userQuillMail: %w", err)
+	}
+	return result.UserQuillMail, nil
+}
+
+// insertEntries writes mailbox entries in one batch.
+func (m *MongoMessageService) insertEntries(ctx context.Context, entries []mailboxEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, len(entries))
+	for i, e := range entries {
+		docs[i] = e
+	}
+	if _, err := m.db.Collection("mailboxes").InsertMany(ctx, docs); err != nil {
+		return err
+	}
+	m.recordInserts(ctx, entries)
+	m.adjustUsage(ctx, entries, 1)
+	return nil
 }
 
 // Helper function to convert BSON to Message domain object
@@ -417,10 +611,16 @@ func convertBsonToMessage(bsonMsg bson.M, read bool) Message {
 	msg := Message{
 		MessageID: bsonMsg["messageId"].(string),
 		ThreadID:  thredid,
-		From:      bsonMsg["fromID"].(string),
 		Read:      read,
 	}
 
+	// Messages relayed from other servers have no fromID, only fromMail.
+	if from, ok := bsonMsg["fromMail"].(string); ok {
+		msg.From = from
+	} else if from, ok := bsonMsg["fromID"].(string); ok {
+		msg.From = from
+	}
+
 	// Handle array fields
 	if pArr, ok := bsonMsg["to"].(primitive.A); ok {
 		// pArr is now of type primitive.A, which behaves exactly like []interface{}
@@ -444,6 +644,7 @@ func convertBsonToMessage(bsonMsg bson.M, read bool) Message {
 	if subj, ok := bsonMsg["subject"].(string); ok {
 		msg.Subject = subj
 	}
+	msg.AutoSubmitted, _ = bsonMsg["autoSubmitted"].(string)
 
 	// Handle sentAt
 	if sentAtDT, ok := bsonMsg["sentAt"].(primitive.DateTime); ok {
@@ -456,8 +657,8 @@ func convertBsonToMessage(bsonMsg bson.M, read bool) Message {
 			for _, c := range contentArr {
 				if contentMap, ok := c.(bson.M); ok {
 					var contentItem Content
-					if t, ok := contentMap["type"].(ContentType); ok {
-						contentItem.Type = t
+					if t, ok := contentMap["type"].(string); ok {
+						contentItem.Type = ContentType(t)
 					}
 					if v, ok := contentMap["value"].(string); ok {
 						contentItem.Value = v
@@ -468,6 +669,19 @@ func convertBsonToMessage(bsonMsg bson.M, read bool) Message {
 		}
 	}
 
+	// Handle attachments
+	if attArr, ok := bsonMsg["attachments"].(primitive.A); ok {
+		for _, a := range attArr {
+			if attMap, ok := a.(bson.M); ok {
+				var att Attachment
+				att.Filename, _ = attMap["filename"].(string)
+				att.Mimetype, _ = attMap["mimetype"].(string)
+				att.URL, _ = attMap["url"].(string)
+				msg.Attachments = append(msg.Attachments, att)
+			}
+		}
+	}
+
 	return msg
 }
 
@@ -0,0 +1,149 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"quill/pkg/hosting"
+	"quill/pkg/identity"
+)
+
+// testMessageService serves example.com and example.net without a
+// database; only paths that fail before touching the store can run.
+func testMessageService(t *testing.T) *MongoMessageService {
+	t.Helper()
+	hosts, err := hosting.NewRegistry(&hosting.Domain{Name: "example.com"}, &hosting.Domain{Name: "example.net"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewMongoMessageService(nil, hosts)
+}
+
+func TestSendChecksSender(t *testing.T) {
+	ada := &identity.Principal{AccountID: "u1", Addresses: []string{"ada~example.com"}, Method: identity.AuthMethodAPIKey}
+	unresolved := &identity.Principal{AccountID: "u2", Method: identity.AuthMethodJWT}
+	peer := &identity.Principal{AccountID: "example.org", Method: identity.AuthMethodPeer}
+	smtp := &identity.Principal{AccountID: "mail.example.org", Method: identity.AuthMethodSMTP}
+
+	tests := []struct {
+		name        string
+		principal   *identity.Principal
+		from        string
+		forwardedBy string
+		want        error
+	}{
+		{"no principal", nil, "ada~example.com", "", ErrUserNotAuthenticated},
+		{"another local user", ada, "bob~example.com", "", ErrPermissionDenied},
+		{"another hosted domain", ada, "ada~example.net", "", ErrPermissionDenied},
+		{"different case", ada, "Ada~example.com", "", ErrPermissionDenied},
+		{"account without an address", unresolved, "ada~example.com", "", ErrPermissionDenied},
+		{"user as a remote sender", ada, "eve~example.org", "", ErrPermissionDenied},
+		{"peer forging a local sender", peer, "ada~example.com", "", ErrPermissionDenied},
+		{"smtp forging a local sender", smtp, "ada~example.com", "", ErrPermissionDenied},
+		{"user claiming a forwarded copy", ada, "bob~example.com", "eve~example.org", ErrPermissionDenied},
+	}
+	m := testMessageService(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.principal != nil {
+				ctx = identity.WithPrincipal(ctx, tt.principal)
+			}
+			_, err := m.Send(ctx, DomainSendRequest{From: tt.from, To: []string{"bob~example.com"}, ForwardedBy: tt.forwardedBy})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Send from %s: got %v, want %v", tt.from, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendExternalRequiresThread(t *testing.T) {
+	valid := "0b6d3a4e-5f1c-4c8e-9a7b-2d3e4f5a6b7c"
+	empty, bad := "", "not-a-uuid"
+	tests := []struct {
+		name      string
+		threadID  *string
+		messageID string
+		want      string
+	}{
+		{"no thread", nil, valid, "did not provide thread ID"},
+		{"empty thread", &empty, valid, "did not provide thread ID"},
+		{"thread not a UUID", &bad, valid, "invalid thread ID: must be a UUID"},
+		{"no message ID", &valid, "", "did not provide message ID"},
+	}
+	m := testMessageService(t)
+	ctx := identity.WithPrincipal(context.Background(), &identity.Principal{AccountID: "example.org", Method: identity.AuthMethodPeer})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := DomainSendRequest{MessageID: tt.messageID, From: "eve~example.org", To: []string{"ada~example.com"}}
+			req.Options.ThreadID = tt.threadID
+			_, err := m.Send(ctx, req)
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendChecksRelayedSender(t *testing.T) {
+	tests := []struct {
+		name        string
+		from        string
+		forwardedBy string
+		listID      string
+		want        error // nil when the relay gets as far as its thread ID check
+	}{
+		{"peer's own sender", "eve~example.org", "", "", nil},
+		{"domain in another case", "eve~Example.ORG", "", "", nil},
+		{"forwarded by its sender", "bob~example.org", "bob~example.org", "", nil},
+		{"post to the peer's list", "eve~example.edu", "", "team~example.org", nil},
+		{"another domain's sender", "eve~example.edu", "", "", ErrPermissionDenied},
+		{"email sender", "eve@example.org", "", "", ErrPermissionDenied},
+		{"forwarded copy of local mail", "ceo~example.com", "bob~example.org", "", ErrPermissionDenied},
+		{"forwarded copy of another domain's mail", "eve~example.edu", "bob~example.org", "", ErrPermissionDenied},
+		{"forwarded copy naming another forwarder", "eve~example.org", "bob~example.org", "", ErrPermissionDenied},
+		{"another domain's list", "eve~example.org", "", "team~example.edu", ErrPermissionDenied},
+		{"local list", "ceo~example.com", "", "team~example.com", ErrPermissionDenied},
+	}
+	m := testMessageService(t)
+	ctx := identity.WithPrincipal(context.Background(), &identity.Principal{AccountID: "example.org", Method: identity.AuthMethodPeer})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := DomainSendRequest{From: tt.from, To: []string{"ada~example.com"}, ForwardedBy: tt.forwardedBy, ListID: tt.listID}
+			_, err := m.Send(ctx, req)
+			if tt.want == nil {
+				if err == nil || err.Error() != "did not provide thread ID" {
+					t.Fatalf("got %v, want the relay's thread ID check", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckRelayedSenderFilesListPosts(t *testing.T) {
+	tests := []struct {
+		name string
+		from string
+		want string
+	}{
+		{"author on the list's domain", "eve~example.org", "eve~example.org"},
+		{"author elsewhere", "ceo~example.com", "team~example.org"},
+		{"email author", "eve@example.edu", "team~example.org"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := checkRelayedSender("Example.ORG", DomainSendRequest{From: tt.from, ListID: "team~example.org"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.From != tt.want {
+				t.Errorf("From = %q, want %q", req.From, tt.want)
+			}
+		})
+	}
+}
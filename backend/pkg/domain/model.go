@@ -26,6 +26,20 @@ type DomainSendRequest struct {
 	Body        Body
 	Attachments []Attachment // Directly uses the 'Attachment' struct with GCS URL
 	Options     SendOptions
+	// Envelope lists the recipients a relaying server wants delivered on this
+	// server. When empty, the To/CC/BCC headers are used instead.
+	Envelope []string
+	// ListID is set when the message was fanned out by a mailing list, and
+	// ReplyTo when that list wants replies sent somewhere other than From.
+	ListID  string
+	ReplyTo string
+	// AutoSubmitted is non-empty for machine-generated mail, which must
+	// never trigger another automatic reply.
+	AutoSubmitted string
+	// ForwardedBy is set on a copy relayed by a forwarding rule: the user
+	// whose rule sent it on, who is also its sender. Such copies are not
+	// forwarded again.
+	ForwardedBy string
 }
 
 // Body holds one or more content parts.
@@ -59,6 +73,27 @@ type DomainSendResult struct {
 	ThreadID    string
 	DeliveredTo []string
 	QueuedFor   []string
+	Held        []string // list addresses holding the message for moderation
+	// Bounced are local recipients whose mailbox was full. Delivery to
+	// everyone else went ahead.
+	Bounced []string
+	// Relays are the batches that still have to be sent to other servers.
+	// Expanded list members only ever appear here, never in QueuedFor.
+	Relays []Relay
+	// AutoReplies are vacation replies triggered by this delivery.
+	AutoReplies []AutoReply
+}
+
+// Relay is a batch of recipients on one remote server. Recipients fanned out
+// by a list are batched per list so the receiving server can tag them.
+type Relay struct {
+	Domain     string
+	ListID     string
+	ReplyTo    string
+	Recipients []string
+	// ForwardedBy is the local user whose rule forwards the message; the
+	// batch is relayed as that user's domain rather than the sender's.
+	ForwardedBy string
 }
 
 // ----- FETCH Request and Result -----
@@ -68,6 +103,9 @@ type FetchMode string
 const (
 	FetchModeThread FetchMode = "thread"
 	FetchModeFolder FetchMode = "folder"
+	FetchModeLabel  FetchMode = "label"
+	// FetchModeMessage fetches one message by its ID.
+	FetchModeMessage FetchMode = "message"
 )
 
 // DomainFetchRequest specifies how messages should be fetched.
@@ -75,8 +113,13 @@ type DomainFetchRequest struct {
 	Mode     FetchMode
 	ThreadID *string
 	Folder   *string
-	Limit    *int
-	Offset   *int
+	Label    *string
+	// MessageID selects the message for FetchModeMessage.
+	MessageID *string
+	Limit     *int
+	Offset    *int
+	// Cursor resumes after the last entry of a previous page.
+	Cursor string
 }
 
 // DomainFetchResult contains the fetched messages and pagination info.
@@ -85,20 +128,29 @@ type DomainFetchResult struct {
 	Limit    int
 	Offset   int
 	Messages []Message
+	// NextCursor is set when more entries may follow.
+	NextCursor string
+	// ModSeq is the mailbox position at fetch time, usable as a sync token.
+	ModSeq int64
 }
 
 // Message is the full email structure returned during a fetch operation.
 type Message struct {
-	MessageID   string
-	ThreadID    string
-	From        string
-	To          []string
-	CC          []string
-	BCC         []string
-	Subject     string
-	Body        Body
-	Attachments []Attachment // Still uses the Attachment struct with the URL
-	SentAt      time.Time
-	Read        bool
-	Flags       []string
+	MessageID     string
+	ThreadID      string
+	From          string
+	To            []string
+	CC            []string
+	BCC           []string
+	Subject       string
+	Body          Body
+	Attachments   []Attachment // Still uses the Attachment struct with the URL
+	SentAt        time.Time
+	Read          bool
+	Flags         []string
+	Labels        []string
+	Folder        string
+	ListID        string
+	ReplyTo       string
+	AutoSubmitted string
 }
@@ -0,0 +1,285 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Mail to regular email addresses (user@domain) waits in the outbound
+// collection until the SMTP transport delivers it, one entry per recipient
+// domain. Entries survive restarts; a delivery claims an entry for a lease
+// so a crashed sender's work is picked up again once the lease runs out.
+
+type OutboundStatus string
+
+const (
+	OutboundStatusQueued  OutboundStatus = "queued"
+	OutboundStatusSending OutboundStatus = "sending"
+	// OutboundStatusFailed entries were bounced to the sender and are kept
+	// for inspection.
+	OutboundStatusFailed OutboundStatus = "failed"
+)
+
+// OutboundMessage is one queued delivery. Request is a snapshot of the
+// message, so deleting the sender's copy does not affect delivery.
+type OutboundMessage struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	MessageID   string             `bson:"messageId"`
+	ThreadID    string             `bson:"threadId"`
+	Domain      string             `bson:"domain"`
+	Recipients  []string           `bson:"recipients"`
+	Request     DomainSendRequest  `bson:"request"`
+	Status      OutboundStatus     `bson:"status"`
+	Attempts    int                `bson:"attempts"`
+	NextAttempt time.Time          `bson:"nextAttempt"`
+	LastError   string             `bson:"lastError,omitempty"`
+	CreatedAt   time.Time          `bson:"createdAt"`
+}
+
+// Sender is the envelope sender: the list for list traffic, otherwise the
+// author.
+func (o *OutboundMessage) Sender() string {
+	if o.Request.ListID != "" {
+		return o.Request.ListID
+	}
+	return o.Request.From
+}
+
+// isEmailAddress reports whether addr is a regular email address rather
+// than a Quill address.
+func isEmailAddress(addr string) bool {
+	return strings.Contains(addr, "@") && !strings.Contains(addr, "~")
+}
+
+func emailDomain(addr string) string {
+	return strings.ToLower(addr[strings.LastIndex(addr, "@")+1:])
+}
+
+// enqueueOutbound queues the email batches of a delivery.
+func (m *MongoMessageService) enqueueOutbound(ctx context.Context, req DomainSendRequest, messageID, threadID string, batches []Relay) error {
+	if len(batches) == 0 {
+		return nil
+	}
+	req.MessageID = messageID
+	req.BCC = nil // never disclosed to anyone
+	req.Envelope = nil
+	now := time.Now().UTC()
+	docs := make([]interface{}, len(batches))
+	for i, b := range batches {
+		msg := req
+		msg.ListID = b.ListID
+		if b.ListID != "" {
+			msg.ReplyTo = b.ReplyTo
+		}
+		docs[i] = OutboundMessage{
+			MessageID:   messageID,
+			ThreadID:    threadID,
+			Domain:      b.Domain,
+			Recipients:  b.Recipients,
+			Request:     msg,
+			Status:      OutboundStatusQueued,
+			NextAttempt: now,
+			CreatedAt:   now,
+		}
+	}
+	_, err := m.db.Collection("outbound").InsertMany(ctx, docs)
+	return err
+}
+
+// ClaimOutbound takes the next entry due for delivery and leases it until
+// now+lease. It returns nil when nothing is due.
+func (m *MongoMessageService) ClaimOutbound(ctx context.Context, now time.Time, lease time.Duration) (*OutboundMessage, error) {
+	filter := bson.M{
+		"status":      bson.M{"$in": bson.A{OutboundStatusQueued, OutboundStatusSending}},
+		"nextAttempt": bson.M{"$lte": now},
+	}
+	update := bson.M{
+		"$set": bson.M{"status": OutboundStatusSending, "nextAttempt": now.Add(lease)},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "nextAttempt", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	var msg OutboundMessage
+	err := m.db.Collection("outbound").FindOneAndUpdate(ctx, filter, update, opts).Decode(&msg)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// CompleteOutbound removes a delivered entry from the queue.
+func (m *MongoMessageService) CompleteOutbound(ctx context.Context, id primitive.ObjectID) error {
+	_, err := m.db.Collection("outbound").DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// DeferOutbound puts an entry back in the queue after a temporary failure.
+func (m *MongoMessageService) DeferOutbound(ctx context.Context, id primitive.ObjectID, reason string, next time.Time) error {
+	_, err := m.db.Collection("outbound").UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"status":      OutboundStatusQueued,
+		"nextAttempt": next,
+		"lastError":   reason,
+	}})
+	return err
+}
+
+// FailOutbound gives up on an entry and returns the message to its sender
+// with reason, the remote server's answer.
+func (m *MongoMessageService) FailOutbound(ctx context.Context, msg *OutboundMessage, reason string) error {
+	if _, err := m.db.Collection("outbound").UpdateOne(ctx, bson.M{"_id": msg.ID}, bson.M{"$set": bson.M{
+		"status":    OutboundStatusFailed,
+		"lastError": reason,
+	}}); err != nil {
+		return err
+	}
+	return m.bounce(ctx, msg, reason)
+}
+
+// OutboundQuery selects queue entries for inspection and maintenance. Empty
+// fields match everything.
+type OutboundQuery struct {
+	IDs    []primitive.ObjectID
+	Status OutboundStatus
+	Domain string
+	Limit  int // ListOutbound only; 0 is defaultOutboundPageSize
+}
+
+const defaultOutboundPageSize = 100
+
+func (q OutboundQuery) filter() bson.M {
+	filter := bson.M{}
+	if len(q.IDs) > 0 {
+		filter["_id"] = bson.M{"$in": q.IDs}
+	}
+	if q.Status != "" {
+		filter["status"] = q.Status
+	}
+	if q.Domain != "" {
+		filter["domain"] = strings.ToLower(q.Domain)
+	}
+	return filter
+}
+
+// ListOutbound returns the matching entries, those due first, and how many
+// match in all.
+func (m *MongoMessageService) ListOutbound(ctx context.Context, q OutboundQuery) ([]OutboundMessage, int, error) {
+	filter := q.filter()
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultOutboundPageSize
+	}
+	outbound := m.db.Collection("outbound")
+	total, err := outbound.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	cursor, err := outbound.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "nextAttempt", Value: 1}}).
+		SetLimit(int64(limit)))
+	if err != nil {
+		return nil, 0, err
+	}
+	var msgs []OutboundMessage
+	if err := cursor.All(ctx, &msgs); err != nil {
+		return nil, 0, err
+	}
+	return msgs, int(total), nil
+}
+
+// RetryOutbound makes the matching entries due now, with their attempts
+// and queue lifetime starting over. Failed entries are queued again too,
+// e.g. once the remote server is fixed; their senders already had a bounce.
+// Entries being delivered right now are left alone.
+func (m *MongoMessageService) RetryOutbound(ctx context.Context, q OutboundQuery) (int, error) {
+	now := time.Now().UTC()
+	filter := q.filter()
+	filter["$or"] = bson.A{
+		bson.M{"status": bson.M{"$ne": OutboundStatusSending}},
+		bson.M{"nextAttempt": bson.M{"$lte": now}}, // lease ran out
+	}
+	res, err := m.db.Collection("outbound").UpdateMany(ctx, filter, bson.M{"$set": bson.M{
+		"status":      OutboundStatusQueued,
+		"attempts":    0,
+		"nextAttempt": now,
+		"createdAt":   now,
+	}})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.ModifiedCount), nil
+}
+
+// PurgeOutbound drops the matching entries without delivering or bouncing
+// them.
+func (m *MongoMessageService) PurgeOutbound(ctx context.Context, q OutboundQuery) (int, error) {
+	res, err := m.db.Collection("outbound").DeleteMany(ctx, q.filter())
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
+
+// bounce delivers a non-delivery report to the sender's inbox, in the
+// thread of the failed message. Lists and automated senders get none, so
+// bounces are never bounced themselves.
+func (m *MongoMessageService) bounce(ctx context.Context, msg *OutboundMessage, reason string) error {
+	sender := msg.Sender()
+	if msg.Request.ListID != "" || !m.hosts.IsLocal(sender) || isAutomatedSender(sender) {
+		log.Printf("INFO: not bouncing message %s to %s", msg.MessageID, sender)
+		return nil
+	}
+
+	subject := "Undelivered Mail Returned to Sender"
+	if msg.Request.Subject != "" {
+		subject += ": " + msg.Request.Subject
+	}
+	text := fmt.Sprintf("Your message could not be delivered to:\n\n  %s\n\n"+
+		"The mail server for %s answered:\n\n  %s\n\nNo further attempts will be made.\n",
+		strings.Join(msg.Recipients, "\n  "), msg.Domain, reason)
+
+	messageID := uuid.New().String()
+	now := time.Now().UTC()
+	req := DomainSendRequest{
+		From:          "mailer-daemon~" + m.hosts.ForAddress(sender).Name,
+		To:            []string{sender},
+		Subject:       subject,
+		Body:          Body{Content: []Content{{Type: ContentTypePlainText, Value: text}}},
+		AutoSubmitted: AutoSubmittedAutoReplied,
+	}
+	size := MessageSize(req)
+	if _, err := m.db.Collection("messages").InsertOne(ctx, bson.M{
+		"messageId":     messageID,
+		"fromMail":      req.From,
+		"to":            req.To,
+		"subject":       req.Subject,
+		"body":          req.Body,
+		"size":          size,
+		"sentAt":        now,
+		"autoSubmitted": req.AutoSubmitted,
+		"options":       bson.M{"threadID": msg.ThreadID},
+	}); err != nil {
+		return err
+	}
+	return m.insertEntries(ctx, []mailboxEntry{{
+		UserID:     sender,
+		MessageID:  messageID,
+		ThreadID:   msg.ThreadID,
+		Folder:     "inbox",
+		ReceivedAt: now,
+		Size:       size,
+	}})
+}
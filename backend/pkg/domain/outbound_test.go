@@ -0,0 +1,211 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestOutboundSender(t *testing.T) {
+	msg := &OutboundMessage{Request: DomainSendRequest{From: "ada~example.com"}}
+	if got := msg.Sender(); got != "ada~example.com" {
+		t.Errorf("Sender() = %q, want the author", got)
+	}
+	msg.Request.ListID = "team~example.com"
+	if got := msg.Sender(); got != "team~example.com" {
+		t.Errorf("Sender() = %q, want the list", got)
+	}
+}
+
+func TestIsEmailAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"eve@example.net", true},
+		{"ada~example.com", false},
+		{"odd~name@example.net", false},
+		{"nobody", false},
+	}
+	for _, tt := range tests {
+		if got := isEmailAddress(tt.addr); got != tt.want {
+			t.Errorf("isEmailAddress(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+	if got := emailDomain("Eve@Mail.Example.NET"); got != "mail.example.net" {
+		t.Errorf("emailDomain = %q", got)
+	}
+}
+
+func TestDeliveryPlanSeparatesEmail(t *testing.T) {
+	m := testMessageService(t)
+	plan := newDeliveryPlan(m.hosts)
+	plan.relay("bob~example.org", "")
+	plan.relay("eve@example.org", "")
+	plan.relay("dan@Example.ORG", "")
+	plan.relay("eve@example.org", "") // already planned
+	plan.relayForward("fay@example.net", "ada~example.com")
+
+	wantRelays := []Relay{{Domain: "example.org", Recipients: []string{"bob~example.org"}}}
+	if got := plan.relayBatches(); !reflect.DeepEqual(got, wantRelays) {
+		t.Errorf("relayBatches = %+v, want %+v", got, wantRelays)
+	}
+	wantEmail := []Relay{
+		{Domain: "example.net", Recipients: []string{"fay@example.net"}, ForwardedBy: "ada~example.com"},
+		{Domain: "example.org", Recipients: []string{"dan@Example.ORG", "eve@example.org"}},
+	}
+	if got := plan.emailBatches(); !reflect.DeepEqual(got, wantEmail) {
+		t.Errorf("emailBatches = %+v, want %+v", got, wantEmail)
+	}
+}
+
+func TestOutboundQueryFilter(t *testing.T) {
+	id := primitive.NewObjectID()
+	tests := []struct {
+		name string
+		q    OutboundQuery
+		want bson.M
+	}{
+		{"everything", OutboundQuery{Limit: 5}, bson.M{}},
+		{"by id", OutboundQuery{IDs: []primitive.ObjectID{id}}, bson.M{"_id": bson.M{"$in": []primitive.ObjectID{id}}}},
+		{"status and domain", OutboundQuery{Status: OutboundStatusFailed, Domain: "Example.NET"},
+			bson.M{"status": OutboundStatusFailed, "domain": "example.net"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.q.filter(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Paths that must return before touching the store, which is nil here.
+func TestOutboundWithoutStore(t *testing.T) {
+	m := testMessageService(t)
+	ctx := context.Background()
+	if err := m.enqueueOutbound(ctx, DomainSendRequest{}, "m", "t", nil); err != nil {
+		t.Errorf("enqueueOutbound without batches = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		req  DomainSendRequest
+	}{
+		{"list traffic", DomainSendRequest{From: "ada~example.com", ListID: "team~example.com"}},
+		{"remote sender", DomainSendRequest{From: "eve~example.org"}},
+		{"automated sender", DomainSendRequest{From: "mailer-daemon~example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run("no bounce for "+tt.name, func(t *testing.T) {
+			msg := &OutboundMessage{MessageID: "m", Domain: "example.net", Request: tt.req}
+			if err := m.bounce(ctx, msg, "550 no such user"); err != nil {
+				t.Errorf("bounce() = %v", err)
+			}
+		})
+	}
+}
+
+func TestClaimOutbound(t *testing.T) {
+	m := testStore(t)
+	ctx := context.Background()
+	req := DomainSendRequest{From: "ada~example.com", BCC: []string{"bob@example.org"}, Subject: "hi"}
+	batches := []Relay{
+		{Domain: "example.org", Recipients: []string{"eve@example.org"}},
+		{Domain: "example.edu", Recipients: []string{"dan@example.edu"}},
+	}
+	if err := m.enqueueOutbound(ctx, req, "m1", "t1", batches); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	lease := time.Minute
+	outbound := m.db.Collection("outbound")
+	if _, err := outbound.UpdateOne(ctx, bson.M{"domain": "example.edu"}, bson.M{"$set": bson.M{"nextAttempt": now.Add(time.Hour)}}); err != nil {
+		t.Fatal(err)
+	}
+
+	claim := func(at time.Time) *OutboundMessage {
+		t.Helper()
+		msg, err := m.ClaimOutbound(ctx, at, lease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	msg := claim(now)
+	if msg == nil || msg.Domain != "example.org" || msg.Status != OutboundStatusSending || msg.Attempts != 1 {
+		t.Fatalf("claimed %+v, want the due example.org entry", msg)
+	}
+	if msg.Request.BCC != nil || msg.Request.MessageID != "m1" {
+		t.Errorf("queued request = %+v, want the message ID and no BCC", msg.Request)
+	}
+	if again := claim(now); again != nil {
+		t.Errorf("claimed %s while it is leased or not due", again.Domain)
+	}
+	// A sender that crashed loses its lease.
+	msg = claim(now.Add(2 * lease))
+	if msg == nil || msg.Domain != "example.org" || msg.Attempts != 2 {
+		t.Fatalf("claimed %+v after the lease ran out, want example.org again", msg)
+	}
+	if err := m.CompleteOutbound(ctx, msg.ID); err != nil {
+		t.Fatal(err)
+	}
+	if msg := claim(now.Add(2 * time.Hour)); msg == nil || msg.Domain != "example.edu" {
+		t.Fatalf("claimed %+v, want the deferred example.edu entry once due", msg)
+	}
+	if msg := claim(now.Add(3 * time.Hour)); msg == nil || msg.Domain != "example.edu" {
+		t.Fatalf("claimed %+v, want example.edu, whose lease ran out", msg)
+	}
+	if n := count(t, outbound, bson.M{}); n != 1 {
+		t.Errorf("%d entries queued, want the undelivered one", n)
+	}
+}
+
+func TestFailOutbound(t *testing.T) {
+	m := testStore(t)
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		req     DomainSendRequest
+		bounced bool
+	}{
+		{"local sender", DomainSendRequest{From: "ada~example.com", Subject: "hi"}, true},
+		{"list traffic", DomainSendRequest{From: "ada~example.com", ListID: "team~example.com"}, false},
+		{"automated sender", DomainSendRequest{From: "mailer-daemon~example.com"}, false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messageID := fmt.Sprintf("m%d", i)
+			if err := m.enqueueOutbound(ctx, tt.req, messageID, "t"+messageID, []Relay{{Domain: "example.org", Recipients: []string{"eve@example.org"}}}); err != nil {
+				t.Fatal(err)
+			}
+			msg, err := m.ClaimOutbound(ctx, time.Now(), time.Minute)
+			if err != nil || msg == nil {
+				t.Fatalf("ClaimOutbound = %+v, %v", msg, err)
+			}
+			if err := m.FailOutbound(ctx, msg, "550 no such user"); err != nil {
+				t.Fatal(err)
+			}
+			failed := bson.M{"_id": msg.ID, "status": OutboundStatusFailed, "lastError": "550 no such user"}
+			if n := count(t, m.db.Collection("outbound"), failed); n != 1 {
+				t.Error("entry not marked failed")
+			}
+			bounces := count(t, m.db.Collection("mailboxes"), bson.M{"userId": tt.req.From, "threadId": "t" + messageID, "folder": "inbox"})
+			if got := bounces == 1; got != tt.bounced {
+				t.Errorf("%d bounces in the sender's inbox, want bounced %v", bounces, tt.bounced)
+			}
+		})
+	}
+	var report bson.M
+	if err := m.db.Collection("messages").FindOne(ctx, bson.M{"options.threadID": "tm0"}).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report["fromMail"] != "mailer-daemon~example.com" || report["autoSubmitted"] != AutoSubmittedAutoReplied {
+		t.Errorf("bounce = %v, want an automated report from the mailer daemon", report)
+	}
+}
@@ -0,0 +1,321 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"quill/pkg/hosting"
+	"quill/pkg/models"
+)
+
+// handleRedirectPeriod is how long mail to a previous Quill handle keeps
+// being delivered to the new one.
+const handleRedirectPeriod = 30 * 24 * time.Hour
+
+const (
+	maxDisplayNameLength = 64
+	maxSignatureLength   = 2000
+	maxAvatarLength      = 256 << 10
+)
+
+// ProfileUpdate carries the profile fields a user may change. Nil fields
+// are left alone; an empty string clears the field.
+type ProfileUpdate struct {
+	DisplayName *string
+	Signature   *string
+	Avatar      *string
+}
+
+// AddressRedirect forwards mail for a retired handle to its successor, or
+// for an alias to the account's address. Aliases do not expire.
+type AddressRedirect struct {
+	Address   string    `bson:"_id"`
+	Target    string    `bson:"target"`
+	Owner     string    `bson:"owner"` // account ID
+	Alias     bool      `bson:"alias,omitempty"`
+	CreatedAt time.Time `bson:"createdAt"`
+	ExpiresAt time.Time `bson:"expiresAt,omitempty"`
+}
+
+// liveRedirect is the $or clause matching the redirects still in force
+// at now.
+func liveRedirect(now time.Time) bson.A {
+	return bson.A{
+		bson.M{"alias": true},
+		bson.M{"expiresAt": bson.M{"$gt": now}},
+	}
+}
+
+var ErrAddressTaken = error(errorString("Quill address is already taken"))
+
+// CreateUser registers the calling principal. The principal's account ID
+// must match request.UsersUID, so nobody can claim another account.
+func (s *MongoUserService) CreateUser(ctx context.Context, request models.CreateUserRequest) (models.CreateUserResponse, error) {
+	p, err := callerPrincipal(ctx)
+	if err != nil {
+		return models.CreateUserResponse{}, err
+	}
+	if p.AccountID != request.UsersUID {
+		return models.CreateUserResponse{}, fmt.Errorf("%w: token user ID does not match usersUID", ErrPermissionDenied)
+	}
+	address := strings.ToLower(strings.TrimSpace(request.UserQuillMail))
+	if err := s.checkSignup(address); err != nil {
+		return models.CreateUserResponse{}, err
+	}
+	if err := s.checkHandle(ctx, address, ""); err != nil {
+		if err == ErrAddressTaken {
+			return models.CreateUserResponse{Success: false, Message: "User with this UID, email, or Quill mail already exists"}, nil
+		}
+		return models.CreateUserResponse{}, err
+	}
+
+	now := time.Now().UTC()
+	user := models.User{
+		UsersUID:      request.UsersUID,
+		UserQuillMail: address,
+		UserEmail:     request.UserEmail,
+		CreatedAt:     now,
+		LastLogin:     now,
+	}
+	if _, err := s.db.Collection("users").InsertOne(ctx, user); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return models.CreateUserResponse{Success: false, Message: "User with this UID, email, or Quill mail already exists"}, nil
+		}
+		return models.CreateUserResponse{}, fmt.Errorf("error inserting user document: %w", err)
+	}
+	return models.CreateUserResponse{Success: true, Message: "User created successfully", UserID: user.UsersUID}, nil
+}
+
+func (s *MongoUserService) GetProfile(ctx context.Context) (*models.User, error) {
+	p, err := callerPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.loadUser(ctx, p.AccountID)
+}
+
+func (s *MongoUserService) UpdateProfile(ctx context.Context, update ProfileUpdate) (*models.User, error) {
+	p, err := callerPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	set := bson.M{}
+	if update.DisplayName != nil {
+		name := strings.TrimSpace(*update.DisplayName)
+		if len(name) > maxDisplayNameLength || strings.ContainsAny(name, "\r\n") {
+			return nil, fmt.Errorf("%w: display name must be a single line of at most %d bytes", ErrInvalidUser, maxDisplayNameLength)
+		}
+		set["displayName"] = name
+	}
+	if update.Signature != nil {
+		if len(*update.Signature) > maxSignatureLength {
+			return nil, fmt.Errorf("%w: signature exceeds %d bytes", ErrInvalidUser, maxSignatureLength)
+		}
+		set["signature"] = *update.Signature
+	}
+	if update.Avatar != nil {
+		if err := validateAvatar(*update.Avatar); err != nil {
+			return nil, err
+		}
+		set["avatar"] = *update.Avatar
+	}
+	if len(set) == 0 {
+		return s.loadUser(ctx, p.AccountID)
+	}
+	return s.setFields(ctx, p.AccountID, set)
+}
+
+// ChangeHandle moves the caller to a new Quill address. Everything stored
+// under the old address follows, and mail to the old address is redirected
+// for handleRedirectPeriod.
+func (s *MongoUserService) ChangeHandle(ctx context.Context, newAddress string) (*models.User, error) {
+	p, err := callerPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.loadUser(ctx, p.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	newAddress = strings.ToLower(strings.TrimSpace(newAddress))
+	if newAddress == user.UserQuillMail {
+		return user, nil
+	}
+	if err := s.checkSignup(newAddress); err != nil {
+		return nil, err
+	}
+	if err := s.checkHandle(ctx, newAddress, p.AccountID); err != nil {
+		return nil, err
+	}
+
+	updated, err := s.setFields(ctx, p.AccountID, bson.M{"userQuillMail": newAddress})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.migrateAddress(ctx, p.AccountID, user.UserQuillMail, newAddress); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// TouchLastLogin records a successful interactive sign-in.
+func (s *MongoUserService) TouchLastLogin(ctx context.Context) error {
+	p, err := callerPrincipal(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Collection("users").UpdateOne(ctx,
+		bson.M{"_id": p.AccountID},
+		bson.M{"$set": bson.M{"lastLogin": time.Now().UTC()}})
+	return err
+}
+
+// checkHandle verifies that address is a well-formed local address not used
+// by another account, a mailing list, or someone else's live redirect.
+func (s *MongoUserService) checkHandle(ctx context.Context, address, owner string) error {
+	if !quillAddressPattern.MatchString(address) || !s.hosts.IsLocal(address) {
+		return fmt.Errorf("%w: %q is not an address on %s", ErrInvalidUser, address, strings.Join(s.hosts.Names(), ", "))
+	}
+	checks := []struct {
+		collection string
+		filter     bson.M
+	}{
+		{"users", bson.M{"userQuillMail": address}},
+		{"lists", bson.M{"_id": address}},
+		{"address_redirects", bson.M{
+			"_id":   address,
+			"owner": bson.M{"$ne": owner},
+			"$or":   liveRedirect(time.Now().UTC()),
+		}},
+	}
+	for _, c := range checks {
+		n, err := s.db.Collection(c.collection).CountDocuments(ctx, c.filter)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrAddressTaken
+		}
+	}
+	return nil
+}
+
+// checkSignup enforces the domain's signup policy on self-service address
+// choices; admins assign addresses on closed domains.
+func (s *MongoUserService) checkSignup(address string) error {
+	d, ok := s.hosts.Lookup(hosting.DomainOf(address))
+	if ok && d.Policy.ClosedSignup {
+		return fmt.Errorf("%w: signup on %s is closed", ErrPermissionDenied, d.Name)
+	}
+	return nil
+}
+
+// migrateAddress rewrites everything keyed by the old address and leaves a
+// redirect behind. Redirects that pointed at the old address are re-aimed
+// so chains of renames resolve in one hop.
+func (s *MongoUserService) migrateAddress(ctx context.Context, owner, from, to string) error {
+	now := time.Now().UTC()
+	redirects := s.db.Collection("address_redirects")
+	if _, err := redirects.DeleteOne(ctx, bson.M{"_id": to}); err != nil {
+		return err
+	}
+	if _, err := redirects.UpdateMany(ctx, bson.M{"target": from}, bson.M{"$set": bson.M{"target": to}}); err != nil {
+		return err
+	}
+	if _, err := redirects.InsertOne(ctx, AddressRedirect{
+		Address:   from,
+		Target:    to,
+		Owner:     owner,
+		CreatedAt: now,
+		ExpiresAt: now.Add(handleRedirectPeriod),
+	}); err != nil {
+		return err
+	}
+
+	moves := []struct {
+		collection, field string
+	}{
+		{"mailboxes", "userId"},
+		{"changes", "userId"},
+		{"folders", "owner"},
+		{"labels", "owner"},
+		{"rules", "owner"},
+		{"vacation_replies", "owner"},
+		{"credentials", "address"},
+	}
+	for _, mv := range moves {
+		_, err := s.db.Collection(mv.collection).UpdateMany(ctx,
+			bson.M{mv.field: from}, bson.M{"$set": bson.M{mv.field: to}})
+		if err != nil {
+			return fmt.Errorf("moving %s to %s: %w", mv.collection, to, err)
+		}
+	}
+	for _, field := range []string{"owners", "members"} {
+		_, err := s.db.Collection("lists").UpdateMany(ctx,
+			bson.M{field: from}, bson.M{"$set": bson.M{field + ".$": to}})
+		if err != nil {
+			return fmt.Errorf("moving list %s to %s: %w", field, to, err)
+		}
+	}
+
+	// Documents keyed by address need a new _id.
+	for _, collection := range []string{"vacations", "mailbox_seq", "mailbox_usage"} {
+		var doc bson.M
+		err := s.db.Collection(collection).FindOne(ctx, bson.M{"_id": from}).Decode(&doc)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		doc["_id"] = to
+		if _, err := s.db.Collection(collection).InsertOne(ctx, doc); err != nil {
+			return fmt.Errorf("moving %s to %s: %w", collection, to, err)
+		}
+		if _, err := s.db.Collection(collection).DeleteOne(ctx, bson.M{"_id": from}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveRedirect returns the current address for a retired handle or an
+// alias, or addr itself when no live redirect exists.
+func (m *MongoMessageService) resolveRedirect(ctx context.Context, addr string) (string, error) {
+	var redirect AddressRedirect
+	err := m.db.Collection("address_redirects").FindOne(ctx, bson.M{
+		"_id": addr,
+		"$or": liveRedirect(time.Now().UTC()),
+	}).Decode(&redirect)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return addr, nil
+		}
+		return "", err
+	}
+	return redirect.Target, nil
+}
+
+func validateAvatar(avatar string) error {
+	switch {
+	case avatar == "":
+		return nil
+	case len(avatar) > maxAvatarLength:
+		return fmt.Errorf("%w: avatar exceeds %d bytes", ErrInvalidUser, maxAvatarLength)
+	case strings.HasPrefix(avatar, "https://"):
+		return nil
+	case strings.HasPrefix(avatar, "data:image/png;base64,"),
+		strings.HasPrefix(avatar, "data:image/jpeg;base64,"),
+		strings.HasPrefix(avatar, "data:image/gif;base64,"),
+		strings.HasPrefix(avatar, "data:image/webp;base64,"):
+		return nil
+	default:
+		return fmt.Errorf("%w: avatar must be an https URL or a base64 PNG, JPEG, GIF or WebP data URI", ErrInvalidUser)
+	}
+}
@@ -0,0 +1,150 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"quill/pkg/hosting"
+	"quill/pkg/identity"
+	"quill/pkg/models"
+)
+
+func TestValidateAvatar(t *testing.T) {
+	tests := []struct {
+		name   string
+		avatar string
+		ok     bool
+	}{
+		{"cleared", "", true},
+		{"https", "https://cdn.example.com/a.png", true},
+		{"png data", "data:image/png;base64,iVBORw0KGgo=", true},
+		{"webp data", "data:image/webp;base64,UklGR", true},
+		{"http", "http://cdn.example.com/a.png", false},
+		{"svg data", "data:image/svg+xml;base64,PHN2Zz4=", false},
+		{"javascript", "javascript:alert(1)", false},
+		{"too large", "https://" + strings.Repeat("a", maxAvatarLength), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAvatar(tt.avatar)
+			if tt.ok && err != nil {
+				t.Errorf("validateAvatar = %v, want nil", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrInvalidUser) {
+				t.Errorf("validateAvatar = %v, want ErrInvalidUser", err)
+			}
+		})
+	}
+}
+
+func TestUpdateProfileRejects(t *testing.T) {
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		name   string
+		update ProfileUpdate
+	}{
+		{"multi-line name", ProfileUpdate{DisplayName: str("Ada\nLovelace")}},
+		{"long name", ProfileUpdate{DisplayName: str(strings.Repeat("a", maxDisplayNameLength+1))}},
+		{"long signature", ProfileUpdate{Signature: str(strings.Repeat("-", maxSignatureLength+1))}},
+		{"bad avatar", ProfileUpdate{Avatar: str("ftp://example.com/a.png")}},
+	}
+	ctx := identity.WithPrincipal(context.Background(), &identity.Principal{AccountID: "u1", Method: identity.AuthMethodJWT})
+	s := testUserService(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.UpdateProfile(ctx, tt.update); !errors.Is(err, ErrInvalidUser) {
+				t.Errorf("UpdateProfile = %v, want ErrInvalidUser", err)
+			}
+		})
+	}
+}
+
+func TestCreateUserRejects(t *testing.T) {
+	hosts, err := hosting.NewRegistry(
+		&hosting.Domain{Name: "example.com"},
+		&hosting.Domain{Name: "staff.example.com", Policy: hosting.Policy{ClosedSignup: true}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewMongoUserService(nil, "", hosts)
+	ctx := identity.WithPrincipal(context.Background(), &identity.Principal{AccountID: "u1", Method: identity.AuthMethodJWT})
+	tests := []struct {
+		name    string
+		uid     string
+		address string
+		want    error
+	}{
+		{"another account", "u2", "ada~example.com", ErrPermissionDenied},
+		{"closed signup", "u1", "ada~staff.example.com", ErrPermissionDenied},
+		{"not hosted", "u1", "ada~example.org", ErrInvalidUser},
+		{"email address", "u1", "ada@example.com", ErrInvalidUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.CreateUser(ctx, models.CreateUserRequest{UsersUID: tt.uid, UserQuillMail: tt.address})
+			if !errors.Is(err, tt.want) {
+				t.Errorf("CreateUser = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMigrateAddress(t *testing.T) {
+	s := testUserService(t)
+	s.db = testDatabase(t)
+	ctx := context.Background()
+	const ada, ada2 = "ada~example.com", "ada2~example.com"
+	future := time.Now().Add(time.Hour)
+	insert(t, s.db.Collection("address_redirects"),
+		AddressRedirect{Address: "older~example.com", Target: ada, Owner: "u1", ExpiresAt: future},
+		AddressRedirect{Address: ada2, Target: "gone~example.com", Owner: "u1", ExpiresAt: future},
+	)
+	insert(t, s.db.Collection("mailboxes"),
+		mailboxEntry{UserID: ada, MessageID: "m1", Folder: "inbox"},
+		mailboxEntry{UserID: "bob~example.com", MessageID: "m1", Folder: "inbox"},
+	)
+	insert(t, s.db.Collection("rules"), Rule{ID: "r1", Owner: ada})
+	insert(t, s.db.Collection("lists"), MailingList{Address: "team~example.com", Owners: []string{ada}, Members: []string{"bob~example.com", ada}})
+	insert(t, s.db.Collection("vacations"), VacationSettings{Owner: ada, Subject: "away"})
+	insert(t, s.db.Collection("mailbox_seq"), bson.M{"_id": ada, "seq": int64(5)})
+	insert(t, s.db.Collection("mailbox_usage"), bson.M{"_id": ada, "bytes": int64(100)})
+
+	if err := s.migrateAddress(ctx, "u1", ada, ada2); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMongoMessageService(s.db, s.hosts)
+	for _, addr := range []string{ada, "older~example.com", ada2} {
+		if got, err := m.resolveRedirect(ctx, addr); err != nil || got != ada2 {
+			t.Errorf("resolveRedirect(%s) = %q, %v; want %s", addr, got, err, ada2)
+		}
+	}
+	counts := []struct {
+		collection string
+		filter     bson.M
+		want       int64
+	}{
+		{"mailboxes", bson.M{"userId": ada}, 0},
+		{"mailboxes", bson.M{"userId": ada2}, 1},
+		{"mailboxes", bson.M{"userId": "bob~example.com"}, 1},
+		{"rules", bson.M{"owner": ada2}, 1},
+		{"lists", bson.M{"owners": []string{ada2}, "members": []string{"bob~example.com", ada2}}, 1},
+		{"vacations", bson.M{"_id": ada2, "subject": "away"}, 1},
+		{"mailbox_seq", bson.M{"_id": ada2, "seq": int64(5)}, 1},
+		{"mailbox_usage", bson.M{"_id": ada2, "bytes": int64(100)}, 1},
+		{"vacations", bson.M{"_id": ada}, 0},
+		{"mailbox_seq", bson.M{"_id": ada}, 0},
+		{"mailbox_usage", bson.M{"_id": ada}, 0},
+	}
+	for _, c := range counts {
+		if n := count(t, s.db.Collection(c.collection), c.filter); n != c.want {
+			t.Errorf("%s matching %v: %d, want %d", c.collection, c.filter, n, c.want)
+		}
+	}
+}
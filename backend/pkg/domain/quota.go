@@ -0,0 +1,268 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"quill/pkg/hosting"
+)
+
+// Limits bounds what a single message and a single mailbox may hold.
+// Attachments are stored inline, so they count toward both.
+type Limits struct {
+	MaxMessageBytes   int64
+	MaxAttachments    int
+	DefaultQuotaBytes int64 // for accounts without models.User.QuotaBytes
+}
+
+var DefaultLimits = Limits{
+	MaxMessageBytes:   25 << 20,
+	MaxAttachments:    20,
+	DefaultQuotaBytes: 1 << 30,
+}
+
+var (
+	ErrMessageTooLarge    = error(errorString("message exceeds the maximum size"))
+	ErrTooManyAttachments = error(errorString("message has too many attachments"))
+	ErrQuotaExceeded      = error(errorString("storage quota exceeded"))
+	ErrMailboxFull        = error(errorString("recipient mailbox is full"))
+)
+
+// QuotaUsage reports a mailbox's storage against its quota.
+type QuotaUsage struct {
+	Address    string
+	UsedBytes  int64
+	Messages   int64
+	QuotaBytes int64
+	Limits     Limits
+}
+
+// mailboxUsage is the running total kept per mailbox in "mailbox_usage".
+// Every insert and delete of a mailbox entry adjusts it.
+type mailboxUsage struct {
+	Address  string `bson:"_id"`
+	Bytes    int64  `bson:"bytes"`
+	Messages int64  `bson:"messages"`
+}
+
+// MessageSize is the number of bytes a message counts for: headers, body
+// parts and inline attachment data.
+func MessageSize(req DomainSendRequest) int64 {
+	size := len(req.From) + len(req.Subject) + len(req.ReplyTo) + len(req.ListID)
+	for _, list := range [][]string{req.To, req.CC, req.BCC} {
+		for _, a := range list {
+			size += len(a)
+		}
+	}
+	for _, c := range req.Body.Content {
+		size += len(c.Type) + len(c.Value)
+	}
+	for _, a := range req.Attachments {
+		size += len(a.Filename) + len(a.Mimetype) + len(a.URL)
+	}
+	return int64(size)
+}
+
+// Check enforces the per-message limits.
+func (l Limits) Check(req DomainSendRequest) error {
+	if l.MaxAttachments > 0 && len(req.Attachments) > l.MaxAttachments {
+		return fmt.Errorf("%w: %d attachments, at most %d allowed", ErrTooManyAttachments, len(req.Attachments), l.MaxAttachments)
+	}
+	if size := MessageSize(req); l.MaxMessageBytes > 0 && size > l.MaxMessageBytes {
+		return fmt.Errorf("%w: %d bytes, at most %d allowed", ErrMessageTooLarge, size, l.MaxMessageBytes)
+	}
+	return nil
+}
+
+func (m *MongoMessageService) Limits() Limits {
+	return *m.limits.Load()
+}
+
+// SetLimits replaces the limits; safe while messages are being sent.
+func (m *MongoMessageService) SetLimits(l Limits) {
+	m.limits.Store(&l)
+}
+
+// LimitsFor returns the limits for mail from addr: the server limits with
+// any overrides from the policy of addr's domain.
+func (m *MongoMessageService) LimitsFor(addr string) Limits {
+	l := m.Limits()
+	if d, ok := m.hosts.Lookup(hosting.DomainOf(addr)); ok {
+		if d.Policy.MaxMessageBytes > 0 {
+			l.MaxMessageBytes = d.Policy.MaxMessageBytes
+		}
+		if d.Policy.DefaultQuotaBytes > 0 {
+			l.DefaultQuotaBytes = d.Policy.DefaultQuotaBytes
+		}
+	}
+	return l
+}
+
+// GetQuota reports the caller's storage usage.
+func (m *MongoMessageService) GetQuota(ctx context.Context) (QuotaUsage, error) {
+	caller, err := m.callerAddress(ctx)
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	usage, err := m.usage(ctx, caller)
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	quota, _, err := m.quotaFor(ctx, caller)
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	return QuotaUsage{
+		Address:    caller,
+		UsedBytes:  usage.Bytes,
+		Messages:   usage.Messages,
+		QuotaBytes: quota,
+		Limits:     m.LimitsFor(caller),
+	}, nil
+}
+
+// usage returns the running total for addr, computing it from the mailbox
+// when there is none yet (mailboxes that predate quota accounting).
+func (m *MongoMessageService) usage(ctx context.Context, addr string) (mailboxUsage, error) {
+	var usage mailboxUsage
+	err := m.db.Collection("mailbox_usage").FindOne(ctx, bson.M{"_id": addr}).Decode(&usage)
+	if err == nil {
+		return usage, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return usage, err
+	}
+
+	cursor, err := m.db.Collection("mailboxes").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"userId": addr}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":      addr,
+			"bytes":    bson.M{"$sum": "$size"},
+			"messages": bson.M{"$sum": 1},
+		}}},
+	})
+	if err != nil {
+		return usage, err
+	}
+	var totals []mailboxUsage
+	if err := cursor.All(ctx, &totals); err != nil {
+		return usage, err
+	}
+	usage = mailboxUsage{Address: addr}
+	if len(totals) > 0 {
+		usage.Bytes, usage.Messages = totals[0].Bytes, totals[0].Messages
+	}
+	// Another delivery may have created the document meanwhile; keep it.
+	_, err = m.db.Collection("mailbox_usage").UpdateOne(ctx,
+		bson.M{"_id": addr},
+		bson.M{"$setOnInsert": bson.M{"bytes": usage.Bytes, "messages": usage.Messages}},
+		options.Update().SetUpsert(true))
+	return usage, err
+}
+
+// quotaFor returns the quota of the account owning addr. Addresses without
+// an account, such as mailing list archives, are not limited.
+func (m *MongoMessageService) quotaFor(ctx context.Context, addr string) (int64, bool, error) {
+	var user struct {
+		QuotaBytes int64 `bson:"quotaBytes"`
+	}
+	err := m.db.Collection("users").FindOne(ctx, bson.M{"userQuillMail": addr},
+		options.FindOne().SetProjection(bson.M{"quotaBytes": 1})).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	if user.QuotaBytes > 0 {
+		return user.QuotaBytes, true, nil
+	}
+	return m.LimitsFor(addr).DefaultQuotaBytes, true, nil
+}
+
+// hasRoom reports whether addr can take another size bytes.
+func (m *MongoMessageService) hasRoom(ctx context.Context, addr string, size int64) (bool, error) {
+	quota, limited, err := m.quotaFor(ctx, addr)
+	if err != nil || !limited || quota <= 0 {
+		return true, err
+	}
+	usage, err := m.usage(ctx, addr)
+	if err != nil {
+		return false, err
+	}
+	return usage.Bytes+size <= quota, nil
+}
+
+// enforceQuotas sizes the planned entries and drops those whose mailbox is
+// full. Dropped recipients are soft-bounced: reported back to the sender
+// rather than failing the whole delivery.
+func (m *MongoMessageService) enforceQuotas(ctx context.Context, plan *deliveryPlan, size int64) error {
+	kept := plan.entries[:0]
+	for _, e := range plan.entries {
+		ok, err := m.hasRoom(ctx, e.UserID, size)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			plan.bounce(e.UserID)
+			continue
+		}
+		e.Size = size
+		kept = append(kept, e)
+	}
+	plan.entries = kept
+	return nil
+}
+
+// fullyBounced reports whether every recipient of plan bounced, in which
+// case there is nothing to store.
+func (p *deliveryPlan) fullyBounced() bool {
+	return len(p.bounced) > 0 && len(p.entries) == 0 && len(p.held) == 0 && len(p.relays) == 0
+}
+
+func (p *deliveryPlan) bounce(addr string) {
+	p.bounced = append(p.bounced, addr)
+	delivered := p.delivered[:0]
+	for _, d := range p.delivered {
+		if d != addr {
+			delivered = append(delivered, d)
+		}
+	}
+	p.delivered = delivered
+}
+
+// adjustUsage adds (sign 1) or removes (sign -1) entries from their
+// mailboxes' running totals.
+func (m *MongoMessageService) adjustUsage(ctx context.Context, entries []mailboxEntry, sign int64) {
+	type total struct{ bytes, messages int64 }
+	byOwner := make(map[string]*total)
+	var owners []string
+	for _, e := range entries {
+		t, ok := byOwner[e.UserID]
+		if !ok {
+			t = &total{}
+			byOwner[e.UserID] = t
+			owners = append(owners, e.UserID)
+		}
+		t.bytes += e.Size
+		t.messages++
+	}
+	for _, owner := range owners {
+		t := byOwner[owner]
+		res, err := m.db.Collection("mailbox_usage").UpdateOne(ctx,
+			bson.M{"_id": owner},
+			bson.M{"$inc": bson.M{"bytes": sign * t.bytes, "messages": sign * t.messages}})
+		if err == nil && res.MatchedCount == 0 {
+			// No total yet: counting the mailbox now already reflects this change.
+			_, err = m.usage(ctx, owner)
+		}
+		if err != nil {
+			log.Printf("Failed to update mailbox usage of %s: %v", owner, err)
+		}
+	}
+}
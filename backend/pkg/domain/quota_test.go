@@ -0,0 +1,76 @@
+package domain
+
+import (
+	"errors"
+	"testing"
+
+	"quill/pkg/hosting"
+)
+
+func TestMessageSize(t *testing.T) {
+	req := DomainSendRequest{
+		From:        "ada~example.com",            // 15
+		To:          []string{"bob~example.com"},  // 15
+		CC:          []string{"carl~example.com"}, // 16
+		BCC:         []string{"dan~example.com"},  // 15
+		Subject:     "Hello",                      // 5
+		Body:        Body{Content: []Content{{Type: ContentTypePlainText, Value: "hi"}}},
+		Attachments: []Attachment{{Filename: "a.txt", Mimetype: "text/plain", URL: "aGk="}}, // 5+10+4
+	}
+	want := int64(15+15+16+15+5) + int64(len(ContentTypePlainText)+2) + 19
+	if got := MessageSize(req); got != want {
+		t.Errorf("MessageSize = %d, want %d", got, want)
+	}
+}
+
+func TestLimitsCheck(t *testing.T) {
+	limits := Limits{MaxMessageBytes: 100, MaxAttachments: 1}
+	tests := []struct {
+		name string
+		req  DomainSendRequest
+		want error
+	}{
+		{"within limits", DomainSendRequest{Subject: "hi", Attachments: []Attachment{{URL: "x"}}}, nil},
+		{"too large", DomainSendRequest{Body: Body{Content: []Content{{Value: string(make([]byte, 101))}}}}, ErrMessageTooLarge},
+		{"too many attachments", DomainSendRequest{Attachments: []Attachment{{}, {}}}, ErrTooManyAttachments},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := limits.Check(tt.req); !errors.Is(err, tt.want) {
+				t.Errorf("Check = %v, want %v", err, tt.want)
+			}
+		})
+	}
+	unlimited := Limits{}
+	if err := unlimited.Check(DomainSendRequest{Attachments: make([]Attachment, 1000)}); err != nil {
+		t.Errorf("zero limits enforced: %v", err)
+	}
+}
+
+func TestLimitsFor(t *testing.T) {
+	hosts, err := hosting.NewRegistry(
+		&hosting.Domain{Name: "example.com"},
+		&hosting.Domain{Name: "example.net", Policy: hosting.Policy{MaxMessageBytes: 1 << 20, DefaultQuotaBytes: 5 << 20}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMongoMessageService(nil, hosts)
+	m.SetLimits(Limits{MaxMessageBytes: 10 << 20, MaxAttachments: 5, DefaultQuotaBytes: 1 << 30})
+
+	tests := []struct {
+		addr string
+		want Limits
+	}{
+		{"ada~example.com", Limits{MaxMessageBytes: 10 << 20, MaxAttachments: 5, DefaultQuotaBytes: 1 << 30}},
+		{"ada~example.net", Limits{MaxMessageBytes: 1 << 20, MaxAttachments: 5, DefaultQuotaBytes: 5 << 20}},
+		{"eve~example.org", Limits{MaxMessageBytes: 10 << 20, MaxAttachments: 5, DefaultQuotaBytes: 1 << 30}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := m.LimitsFor(tt.addr); got != tt.want {
+				t.Errorf("LimitsFor = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
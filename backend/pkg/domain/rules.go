@@ -0,0 +1,529 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RuleField is the part of a message a rule condition looks at.
+type RuleField string
+
+const (
+	RuleFieldFrom          RuleField = "from"
+	RuleFieldTo            RuleField = "to"
+	RuleFieldSubject       RuleField = "subject"
+	RuleFieldBody          RuleField = "body"
+	RuleFieldHasAttachment RuleField = "has_attachment"
+	RuleFieldListID        RuleField = "list_id"
+)
+
+// RuleOperator compares a field with a condition value. Comparisons are
+// case-insensitive.
+type RuleOperator string
+
+const (
+	RuleOperatorContains    RuleOperator = "contains"
+	RuleOperatorNotContains RuleOperator = "not_contains"
+	RuleOperatorEquals      RuleOperator = "equals"
+)
+
+// RuleActionType is what a matching rule does with the delivery.
+type RuleActionType string
+
+const (
+	RuleActionMove     RuleActionType = "move"
+	RuleActionFlag     RuleActionType = "flag"
+	RuleActionMarkRead RuleActionType = "mark_read"
+	RuleActionForward  RuleActionType = "forward"
+	RuleActionDiscard  RuleActionType = "discard"
+)
+
+type RuleCondition struct {
+	Field    RuleField    `bson:"field"`
+	Operator RuleOperator `bson:"operator,omitempty"`
+	Value    string       `bson:"value,omitempty"`
+}
+
+type RuleAction struct {
+	Type  RuleActionType `bson:"type"`
+	Value string         `bson:"value,omitempty"` // folder, flag or forward address
+}
+
+// Rule is a user-defined filter evaluated when mail is delivered to Owner.
+// Rules run in ascending Priority order until one with StopProcessing matches.
+type Rule struct {
+	ID             string          `bson:"_id"`
+	Owner          string          `bson:"owner"`
+	Name           string          `bson:"name"`
+	Enabled        bool            `bson:"enabled"`
+	Priority       int             `bson:"priority"`
+	MatchAll       bool            `bson:"matchAll"` // false: any condition is enough
+	Conditions     []RuleCondition `bson:"conditions"`
+	Actions        []RuleAction    `bson:"actions"`
+	StopProcessing bool            `bson:"stopProcessing"`
+	CreatedAt      time.Time       `bson:"createdAt"`
+}
+
+type RuleOperation string
+
+const (
+	RuleOperationList   RuleOperation = "list"
+	RuleOperationCreate RuleOperation = "create"
+	RuleOperationUpdate RuleOperation = "update"
+	RuleOperationDelete RuleOperation = "delete"
+	RuleOperationTest   RuleOperation = "test"
+)
+
+// DomainRuleRequest describes a rule management operation. Test takes either
+// RuleID or an unsaved Rule and runs it against MessageID without side effects.
+type DomainRuleRequest struct {
+	Operation RuleOperation
+	Rule      *Rule
+	RuleID    string
+	MessageID string
+}
+
+type DomainRuleResult struct {
+	Rules []Rule
+	Rule  *Rule
+	Test  *RuleTestResult
+}
+
+// RuleTestResult is what a rule would have done to a message.
+type RuleTestResult struct {
+	Matched   bool
+	Folder    string
+	Flags     []string
+	Read      bool
+	Discarded bool
+	ForwardTo []string
+}
+
+var (
+	ErrRuleNotFound    = error(errorString("rule not found"))
+	ErrInvalidRule     = error(errorString("invalid rule"))
+	ErrMessageNotFound = error(errorString("message not found"))
+)
+
+// ManageRules executes a rule management operation for the authenticated user.
+func (m *MongoMessageService) ManageRules(ctx context.Context, req DomainRuleRequest) (DomainRuleResult, error) {
+	caller, err := m.callerAddress(ctx)
+	if err != nil {
+		return DomainRuleResult{}, err
+	}
+
+	switch req.Operation {
+	case RuleOperationList:
+		rules, err := m.loadRules(ctx, caller, false)
+		if err != nil {
+			return DomainRuleResult{}, err
+		}
+		return DomainRuleResult{Rules: rules}, nil
+	case RuleOperationCreate:
+		if req.Rule == nil {
+			return DomainRuleResult{}, fmt.Errorf("%w: no rule given", ErrInvalidRule)
+		}
+		rule := *req.Rule
+		rule.ID = uuid.New().String()
+		rule.Owner = caller
+		rule.CreatedAt = time.Now().UTC()
+		if err := rule.validate(); err != nil {
+			return DomainRuleResult{}, err
+		}
+		if err := m.checkRuleFolders(ctx, &rule); err != nil {
+			return DomainRuleResult{}, err
+		}
+		if _, err := m.db.Collection("rules").InsertOne(ctx, rule); err != nil {
+			return DomainRuleResult{}, err
+		}
+		return DomainRuleResult{Rule: &rule}, nil
+	case RuleOperationUpdate:
+		if req.Rule == nil {
+			return DomainRuleResult{}, fmt.Errorf("%w: no rule given", ErrInvalidRule)
+		}
+		existing, err := m.getRule(ctx, caller, req.RuleID)
+		if err != nil {
+			return DomainRuleResult{}, err
+		}
+		rule := *req.Rule
+		rule.ID = existing.ID
+		rule.Owner = existing.Owner
+		rule.CreatedAt = existing.CreatedAt
+		if err := rule.validate(); err != nil {
+			return DomainRuleResult{}, err
+		}
+		if err := m.checkRuleFolders(ctx, &rule); err != nil {
+			return DomainRuleResult{}, err
+		}
+		if _, err := m.db.Collection("rules").ReplaceOne(ctx, bson.M{"_id": rule.ID, "owner": caller}, rule); err != nil {
+			return DomainRuleResult{}, err
+		}
+		return DomainRuleResult{Rule: &rule}, nil
+	case RuleOperationDelete:
+		res, err := m.db.Collection("rules").DeleteOne(ctx, bson.M{"_id": req.RuleID, "owner": caller})
+		if err != nil {
+			return DomainRuleResult{}, err
+		}
+		if res.DeletedCount == 0 {
+			return DomainRuleResult{}, ErrRuleNotFound
+		}
+		return DomainRuleResult{}, nil
+	case RuleOperationTest:
+		return m.testRule(ctx, caller, req)
+	default:
+		return DomainRuleResult{}, errorString(fmt.Sprintf("unknown rule operation %q", req.Operation))
+	}
+}
+
+// testRule is a dry-run: it evaluates one rule against a message already in
+// the caller's mailbox and reports the outcome without changing anything.
+func (m *MongoMessageService) testRule(ctx context.Context, caller string, req DomainRuleRequest) (DomainRuleResult, error) {
+	var rule Rule
+	if req.Rule != nil {
+		rule = *req.Rule
+		rule.Owner = caller
+		if err := rule.validate(); err != nil {
+			return DomainRuleResult{}, err
+		}
+	} else {
+		existing, err := m.getRule(ctx, caller, req.RuleID)
+		if err != nil {
+			return DomainRuleResult{}, err
+		}
+		rule = *existing
+	}
+	// A disabled rule can still be tried out before switching it on.
+	rule.Enabled = true
+
+	var entry mailboxEntry
+	err := m.db.Collection("mailboxes").FindOne(ctx, bson.M{"userId": caller, "messageId": req.MessageID}).Decode(&entry)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return DomainRuleResult{}, ErrMessageNotFound
+		}
+		return DomainRuleResult{}, err
+	}
+	var rawMsg bson.M
+	if err := m.db.Collection("messages").FindOne(ctx, bson.M{"messageId": req.MessageID}).Decode(&rawMsg); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return DomainRuleResult{}, ErrMessageNotFound
+		}
+		return DomainRuleResult{}, err
+	}
+	msg := convertBsonToMessage(rawMsg, entry.Read)
+	in := ruleInputFromMessage(msg)
+	in.listID = entry.ListID
+
+	out := newRuleOutcome(entry.Folder, entry.Read)
+	matched := out.evaluate([]Rule{rule}, in)
+	return DomainRuleResult{
+		Rule: &rule,
+		Test: &RuleTestResult{
+			Matched:   matched,
+			Folder:    out.folder,
+			Flags:     out.flags,
+			Read:      out.read,
+			Discarded: out.discard,
+			ForwardTo: out.forwardTo,
+		},
+	}, nil
+}
+
+// checkRuleFolders makes sure every folder the rule moves mail to exists,
+// so deliveries are not filed where the owner cannot see them.
+func (m *MongoMessageService) checkRuleFolders(ctx context.Context, rule *Rule) error {
+	for _, a := range rule.Actions {
+		if a.Type != RuleActionMove {
+			continue
+		}
+		if err := m.checkFolder(ctx, rule.Owner, a.Value); err != nil {
+			if err == ErrFolderNotFound {
+				return fmt.Errorf("%w: no folder %q to move to", ErrInvalidRule, a.Value)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MongoMessageService) getRule(ctx context.Context, owner, id string) (*Rule, error) {
+	var rule Rule
+	if err := m.db.Collection("rules").FindOne(ctx, bson.M{"_id": id, "owner": owner}).Decode(&rule); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrRuleNotFound
+		}
+		return nil, fmt.Errorf("error retrieving rule: %w", err)
+	}
+	return &rule, nil
+}
+
+// loadRules returns owner's rules in evaluation order.
+func (m *MongoMessageService) loadRules(ctx context.Context, owner string, enabledOnly bool) ([]Rule, error) {
+	filter := bson.M{"owner": owner}
+	if enabledOnly {
+		filter["enabled"] = true
+	}
+	findOptions := options.Find().SetSort(bson.D{{Key: "priority", Value: 1}, {Key: "createdAt", Value: 1}})
+	cursor, err := m.db.Collection("rules").Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err := cursor.All(ctx, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// applyRules runs each recipient's rules over their inbox deliveries in the
+// plan. Forward targets are added as extra recipients of the same message;
+// their copies skip rule evaluation so two users cannot forward in a loop.
+// A copy that was itself forwarded is filed by the rules but never forwarded
+// again, which stops loops between servers.
+func (m *MongoMessageService) applyRules(ctx context.Context, in ruleInput, plan *deliveryPlan) error {
+	cache := make(map[string][]Rule)
+	kept := make([]mailboxEntry, 0, len(plan.entries))
+	type forward struct {
+		entry mailboxEntry
+		by    string
+	}
+	var forwards []forward
+
+	for _, e := range plan.entries {
+		if e.Folder != "inbox" {
+			kept = append(kept, e)
+			continue
+		}
+		rules, ok := cache[e.UserID]
+		if !ok {
+			var err error
+			if rules, err = m.loadRules(ctx, e.UserID, true); err != nil {
+				return err
+			}
+			cache[e.UserID] = rules
+		}
+		if len(rules) == 0 {
+			kept = append(kept, e)
+			continue
+		}
+
+		in.listID = e.ListID
+		out := newRuleOutcome(e.Folder, e.Read)
+		out.evaluate(rules, in)
+		if !in.forwarded {
+			for _, addr := range out.forwardTo {
+				forwards = append(forwards, forward{entry: mailboxEntry{
+					UserID:     addr,
+					MessageID:  e.MessageID,
+					ThreadID:   e.ThreadID,
+					Folder:     "inbox",
+					ReceivedAt: e.ReceivedAt,
+				}, by: e.UserID})
+			}
+		}
+		if out.discard {
+			continue
+		}
+		e.Folder = out.folder
+		e.Read = out.read
+		e.Flags = append(e.Flags, out.flags...)
+		kept = append(kept, e)
+	}
+
+	plan.entries = kept
+	for _, f := range forwards {
+		if m.hosts.IsLocal(f.entry.UserID) {
+			plan.deliverLocal(f.entry)
+		} else {
+			// The sender is usually on neither server; the receiving
+			// server checks the copy against the forwarder's domain.
+			plan.relayForward(f.entry.UserID, f.by)
+		}
+	}
+	return nil
+}
+
+// ruleInput is the view of a message that rule conditions are matched against.
+type ruleInput struct {
+	from        string
+	to          []string
+	subject     string
+	body        []Content
+	attachments int
+	listID      string
+	forwarded   bool // a copy sent on by another user's forward rule
+}
+
+func ruleInputFromRequest(req DomainSendRequest) ruleInput {
+	return ruleInput{
+		from:        req.From,
+		to:          append(append([]string{}, req.To...), req.CC...),
+		subject:     req.Subject,
+		body:        req.Body.Content,
+		attachments: len(req.Attachments),
+		listID:      req.ListID,
+		forwarded:   req.ForwardedBy != "",
+	}
+}
+
+func ruleInputFromMessage(msg Message) ruleInput {
+	return ruleInput{
+		from:        msg.From,
+		to:          append(append([]string{}, msg.To...), msg.CC...),
+		subject:     msg.Subject,
+		body:        msg.Body.Content,
+		attachments: len(msg.Attachments),
+		listID:      msg.ListID,
+	}
+}
+
+// ruleOutcome accumulates the effect of every matching rule on one delivery.
+type ruleOutcome struct {
+	folder    string
+	flags     []string
+	read      bool
+	discard   bool
+	forwardTo []string
+}
+
+func newRuleOutcome(folder string, read bool) *ruleOutcome {
+	return &ruleOutcome{folder: folder, read: read}
+}
+
+// evaluate applies the actions of each matching rule and reports whether any
+// rule matched.
+func (o *ruleOutcome) evaluate(rules []Rule, in ruleInput) bool {
+	matched := false
+	for _, r := range rules {
+		if !r.Enabled || !r.matches(in) {
+			continue
+		}
+		matched = true
+		for _, a := range r.Actions {
+			switch a.Type {
+			case RuleActionMove:
+				o.folder = a.Value
+			case RuleActionFlag:
+				if !containsString(o.flags, a.Value) {
+					o.flags = append(o.flags, a.Value)
+				}
+			case RuleActionMarkRead:
+				o.read = true
+			case RuleActionForward:
+				o.forwardTo = append(o.forwardTo, a.Value)
+			case RuleActionDiscard:
+				o.discard = true
+			}
+		}
+		if r.StopProcessing {
+			break
+		}
+	}
+	return matched
+}
+
+func (r *Rule) matches(in ruleInput) bool {
+	for _, c := range r.Conditions {
+		ok := c.matches(in)
+		if ok && !r.MatchAll {
+			return true
+		}
+		if !ok && r.MatchAll {
+			return false
+		}
+	}
+	return r.MatchAll
+}
+
+func (c RuleCondition) matches(in ruleInput) bool {
+	switch c.Field {
+	case RuleFieldFrom:
+		return c.compare(in.from)
+	case RuleFieldSubject:
+		return c.compare(in.subject)
+	case RuleFieldListID:
+		return c.compare(in.listID)
+	case RuleFieldTo:
+		if c.Operator == RuleOperatorNotContains {
+			return c.compare(strings.Join(in.to, " "))
+		}
+		for _, addr := range in.to {
+			if c.compare(addr) {
+				return true
+			}
+		}
+		return false
+	case RuleFieldBody:
+		parts := make([]string, len(in.body))
+		for i, p := range in.body {
+			parts[i] = p.Value
+		}
+		return c.compare(strings.Join(parts, "\n"))
+	case RuleFieldHasAttachment:
+		want := c.Value == "" || strings.EqualFold(c.Value, "true")
+		return (in.attachments > 0) == want
+	default:
+		return false
+	}
+}
+
+func (c RuleCondition) compare(field string) bool {
+	field = strings.ToLower(field)
+	value := strings.ToLower(c.Value)
+	switch c.Operator {
+	case RuleOperatorEquals:
+		return field == value
+	case RuleOperatorNotContains:
+		return !strings.Contains(field, value)
+	default:
+		return strings.Contains(field, value)
+	}
+}
+
+func (r *Rule) validate() error {
+	if len(r.Conditions) == 0 {
+		return fmt.Errorf("%w: at least one condition is required", ErrInvalidRule)
+	}
+	if len(r.Actions) == 0 {
+		return fmt.Errorf("%w: at least one action is required", ErrInvalidRule)
+	}
+	for _, c := range r.Conditions {
+		switch c.Field {
+		case RuleFieldFrom, RuleFieldTo, RuleFieldSubject, RuleFieldBody, RuleFieldListID:
+			if c.Value == "" {
+				return fmt.Errorf("%w: condition on %q needs a value", ErrInvalidRule, c.Field)
+			}
+		case RuleFieldHasAttachment:
+		default:
+			return fmt.Errorf("%w: unknown condition field %q", ErrInvalidRule, c.Field)
+		}
+		switch c.Operator {
+		case "", RuleOperatorContains, RuleOperatorNotContains, RuleOperatorEquals:
+		default:
+			return fmt.Errorf("%w: unknown operator %q", ErrInvalidRule, c.Operator)
+		}
+	}
+	for _, a := range r.Actions {
+		switch a.Type {
+		case RuleActionMove, RuleActionFlag:
+			if a.Value == "" {
+				return fmt.Errorf("%w: %q needs a value", ErrInvalidRule, a.Type)
+			}
+		case RuleActionForward:
+			if extractDomain(a.Value) == "" || a.Value == r.Owner {
+				return fmt.Errorf("%w: invalid forward address %q", ErrInvalidRule, a.Value)
+			}
+		case RuleActionMarkRead, RuleActionDiscard:
+		default:
+			return fmt.Errorf("%w: unknown action %q", ErrInvalidRule, a.Type)
+		}
+	}
+	return nil
+}
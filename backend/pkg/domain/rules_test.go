@@ -0,0 +1,213 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"quill/pkg/hosting"
+)
+
+func TestRuleConditionMatches(t *testing.T) {
+	in := ruleInput{
+		from:        "Ada~Example.com",
+		to:          []string{"bob~example.com", "team~example.com"},
+		subject:     "Quarterly Report",
+		body:        []Content{{Type: ContentTypePlainText, Value: "see attached"}, {Type: ContentTypeHTML, Value: "<p>numbers</p>"}},
+		attachments: 1,
+		listID:      "team~example.com",
+	}
+	tests := []struct {
+		name string
+		cond RuleCondition
+		want bool
+	}{
+		{"from contains, any case", RuleCondition{Field: RuleFieldFrom, Value: "ada~"}, true},
+		{"from equals", RuleCondition{Field: RuleFieldFrom, Operator: RuleOperatorEquals, Value: "ada~example.com"}, true},
+		{"from equals is exact", RuleCondition{Field: RuleFieldFrom, Operator: RuleOperatorEquals, Value: "ada"}, false},
+		{"subject not contains", RuleCondition{Field: RuleFieldSubject, Operator: RuleOperatorNotContains, Value: "invoice"}, true},
+		{"to matches any recipient", RuleCondition{Field: RuleFieldTo, Operator: RuleOperatorEquals, Value: "team~example.com"}, true},
+		{"to not contains checks all", RuleCondition{Field: RuleFieldTo, Operator: RuleOperatorNotContains, Value: "bob"}, false},
+		{"body spans parts", RuleCondition{Field: RuleFieldBody, Value: "numbers"}, true},
+		{"has attachment", RuleCondition{Field: RuleFieldHasAttachment}, true},
+		{"has no attachment", RuleCondition{Field: RuleFieldHasAttachment, Value: "false"}, false},
+		{"list id", RuleCondition{Field: RuleFieldListID, Operator: RuleOperatorEquals, Value: "team~example.com"}, true},
+		{"unknown field", RuleCondition{Field: "header", Value: "x"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cond.matches(in); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleOutcomeEvaluate(t *testing.T) {
+	fromAda := RuleCondition{Field: RuleFieldFrom, Value: "ada"}
+	fromEve := RuleCondition{Field: RuleFieldFrom, Value: "eve"}
+	in := ruleInput{from: "ada~example.com", subject: "hello"}
+	tests := []struct {
+		name  string
+		rules []Rule
+		want  ruleOutcome
+	}{
+		{"no match", []Rule{
+			{Enabled: true, Conditions: []RuleCondition{fromEve}, Actions: []RuleAction{{Type: RuleActionDiscard}}},
+		}, ruleOutcome{folder: "inbox"}},
+		{"disabled rule", []Rule{
+			{Conditions: []RuleCondition{fromAda}, Actions: []RuleAction{{Type: RuleActionDiscard}}},
+		}, ruleOutcome{folder: "inbox"}},
+		{"actions accumulate", []Rule{
+			{Enabled: true, Conditions: []RuleCondition{fromAda}, Actions: []RuleAction{{Type: RuleActionMove, Value: "Work"}, {Type: RuleActionFlag, Value: "important"}}},
+			{Enabled: true, Conditions: []RuleCondition{fromAda}, Actions: []RuleAction{{Type: RuleActionMarkRead}, {Type: RuleActionFlag, Value: "important"}}},
+		}, ruleOutcome{folder: "Work", flags: []string{"important"}, read: true}},
+		{"stop processing", []Rule{
+			{Enabled: true, Conditions: []RuleCondition{fromAda}, Actions: []RuleAction{{Type: RuleActionForward, Value: "bob~example.org"}}, StopProcessing: true},
+			{Enabled: true, Conditions: []RuleCondition{fromAda}, Actions: []RuleAction{{Type: RuleActionDiscard}}},
+		}, ruleOutcome{folder: "inbox", forwardTo: []string{"bob~example.org"}}},
+		{"match all needs every condition", []Rule{
+			{Enabled: true, MatchAll: true, Conditions: []RuleCondition{fromAda, fromEve}, Actions: []RuleAction{{Type: RuleActionDiscard}}},
+		}, ruleOutcome{folder: "inbox"}},
+		{"match any needs one condition", []Rule{
+			{Enabled: true, Conditions: []RuleCondition{fromEve, fromAda}, Actions: []RuleAction{{Type: RuleActionDiscard}}},
+		}, ruleOutcome{folder: "inbox", discard: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := newRuleOutcome("inbox", false)
+			out.evaluate(tt.rules, in)
+			if !reflect.DeepEqual(*out, tt.want) {
+				t.Errorf("outcome = %+v, want %+v", *out, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	cond := []RuleCondition{{Field: RuleFieldSubject, Value: "x"}}
+	tests := []struct {
+		name string
+		rule Rule
+		ok   bool
+	}{
+		{"valid", Rule{Conditions: cond, Actions: []RuleAction{{Type: RuleActionMove, Value: "Work"}}}, true},
+		{"no conditions", Rule{Actions: []RuleAction{{Type: RuleActionDiscard}}}, false},
+		{"no actions", Rule{Conditions: cond}, false},
+		{"condition without value", Rule{Conditions: []RuleCondition{{Field: RuleFieldFrom}}, Actions: []RuleAction{{Type: RuleActionDiscard}}}, false},
+		{"unknown operator", Rule{Conditions: []RuleCondition{{Field: RuleFieldFrom, Operator: "regex", Value: "x"}}, Actions: []RuleAction{{Type: RuleActionDiscard}}}, false},
+		{"move without folder", Rule{Conditions: cond, Actions: []RuleAction{{Type: RuleActionMove}}}, false},
+		{"forward to self", Rule{Owner: "ada~example.com", Conditions: cond, Actions: []RuleAction{{Type: RuleActionForward, Value: "ada~example.com"}}}, false},
+		{"forward without domain", Rule{Conditions: cond, Actions: []RuleAction{{Type: RuleActionForward, Value: "bob"}}}, false},
+		{"unknown action", Rule{Conditions: cond, Actions: []RuleAction{{Type: "reply"}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.validate()
+			if tt.ok && err != nil {
+				t.Errorf("validate() = %v, want nil", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrInvalidRule) {
+				t.Errorf("validate() = %v, want ErrInvalidRule", err)
+			}
+		})
+	}
+}
+
+func TestForwardedRelaysKeepTheirForwarder(t *testing.T) {
+	hosts, err := hosting.NewRegistry(&hosting.Domain{Name: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := newDeliveryPlan(hosts)
+	plan.relay("carl~example.org", "")
+	plan.relayForward("bob~example.org", "ada~example.com")
+	plan.relayForward("dan~example.org", "eve~example.com")
+	plan.relayForward("carl~example.org", "ada~example.com") // already relayed
+
+	want := []Relay{
+		{Domain: "example.org", Recipients: []string{"carl~example.org"}},
+		{Domain: "example.org", Recipients: []string{"bob~example.org"}, ForwardedBy: "ada~example.com"},
+		{Domain: "example.org", Recipients: []string{"dan~example.org"}, ForwardedBy: "eve~example.com"},
+	}
+	if got := plan.relayBatches(); !reflect.DeepEqual(got, want) {
+		t.Errorf("relayBatches = %+v, want %+v", got, want)
+	}
+}
+
+func TestRuleInputFromRequest(t *testing.T) {
+	in := ruleInputFromRequest(DomainSendRequest{
+		From:        "ada~example.com",
+		To:          []string{"bob~example.com"},
+		CC:          []string{"carl~example.com"},
+		BCC:         []string{"dan~example.com"},
+		Subject:     "hi",
+		Attachments: []Attachment{{}, {}},
+		ListID:      "team~example.com",
+	})
+	want := ruleInput{
+		from:        "ada~example.com",
+		to:          []string{"bob~example.com", "carl~example.com"},
+		subject:     "hi",
+		attachments: 2,
+		listID:      "team~example.com",
+	}
+	if !reflect.DeepEqual(in, want) {
+		t.Errorf("ruleInput = %+v, want %+v", in, want)
+	}
+}
+
+func TestApplyRules(t *testing.T) {
+	m := testStore(t)
+	fromBoss := []RuleCondition{{Field: RuleFieldFrom, Value: "boss"}}
+	insert(t, m.db.Collection("rules"),
+		Rule{ID: "r1", Owner: "ada~example.com", Enabled: true, Conditions: fromBoss, Actions: []RuleAction{
+			{Type: RuleActionMove, Value: "Work"},
+			{Type: RuleActionFlag, Value: "important"},
+			{Type: RuleActionForward, Value: "bob~example.org"},
+			{Type: RuleActionForward, Value: "carl~example.com"},
+		}},
+		Rule{ID: "r2", Owner: "carl~example.com", Enabled: true, Conditions: fromBoss, Actions: []RuleAction{{Type: RuleActionDiscard}}},
+		Rule{ID: "r3", Owner: "eve~example.com", Conditions: fromBoss, Actions: []RuleAction{{Type: RuleActionDiscard}}},
+		Rule{ID: "r4", Owner: "eve~example.com", Enabled: true, Priority: 1, Conditions: []RuleCondition{{Field: RuleFieldSubject, Value: "spam"}}, Actions: []RuleAction{{Type: RuleActionDiscard}}},
+	)
+	tests := []struct {
+		name    string
+		in      ruleInput
+		entries []string
+		relays  []Relay
+	}{
+		{"direct delivery", ruleInput{from: "boss~example.org", subject: "report"},
+			[]string{"ada~example.com/Work/[important]", "eve~example.com/inbox/[]", "ada~example.com/archive/[]", "carl~example.com/inbox/[]"},
+			[]Relay{{Domain: "example.org", Recipients: []string{"bob~example.org"}, ForwardedBy: "ada~example.com"}}},
+		{"forwarded copy is filed but not forwarded", ruleInput{from: "boss~example.org", subject: "report", forwarded: true},
+			[]string{"ada~example.com/Work/[important]", "eve~example.com/inbox/[]", "ada~example.com/archive/[]"},
+			[]Relay{}},
+		{"discard", ruleInput{from: "dan~example.org", subject: "spam"},
+			[]string{"ada~example.com/inbox/[]", "ada~example.com/archive/[]"},
+			[]Relay{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := newDeliveryPlan(m.hosts)
+			plan.deliverLocal(mailboxEntry{UserID: "ada~example.com", MessageID: "m", Folder: "inbox"})
+			plan.deliverLocal(mailboxEntry{UserID: "eve~example.com", MessageID: "m", Folder: "inbox"})
+			plan.entries = append(plan.entries, mailboxEntry{UserID: "ada~example.com", MessageID: "m", Folder: "archive"})
+			if err := m.applyRules(context.Background(), tt.in, plan); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range plan.entries {
+				got = append(got, fmt.Sprintf("%s/%s/%v", e.UserID, e.Folder, e.Flags))
+			}
+			if !reflect.DeepEqual(got, tt.entries) {
+				t.Errorf("entries = %v, want %v", got, tt.entries)
+			}
+			if relays := plan.relayBatches(); !reflect.DeepEqual(relays, tt.relays) {
+				t.Errorf("relayBatches = %+v, want %+v", relays, tt.relays)
+			}
+		})
+	}
+}
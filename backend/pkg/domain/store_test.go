@@ -0,0 +1,69 @@
+package domain
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testDatabase returns a fresh database on the MongoDB server named by
+// QUILL_TEST_MONGODB_URI, dropped when the test ends. Tests that need the
+// store are skipped when the variable is unset.
+func testDatabase(t *testing.T) *mongo.Database {
+	t.Helper()
+	uri := os.Getenv("QUILL_TEST_MONGODB_URI")
+	if uri == "" {
+		t.Skip("QUILL_TEST_MONGODB_URI not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	db := client.Database("quill_test_" + hex.EncodeToString(suffix))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		db.Drop(ctx)
+		client.Disconnect(ctx)
+	})
+	return db
+}
+
+// testStore is testMessageService backed by a test database.
+func testStore(t *testing.T) *MongoMessageService {
+	t.Helper()
+	m := testMessageService(t)
+	m.db = testDatabase(t)
+	return m
+}
+
+// insert stores docs in collection, failing the test on error.
+func insert(t *testing.T, coll *mongo.Collection, docs ...interface{}) {
+	t.Helper()
+	if _, err := coll.InsertMany(context.Background(), docs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// count returns the number of documents in collection matching filter.
+func count(t *testing.T, coll *mongo.Collection, filter interface{}) int64 {
+	t.Helper()
+	n, err := coll.CountDocuments(context.Background(), filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
@@ -0,0 +1,496 @@
+package domain
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ChangeKind is the type of a mailbox change log record.
+type ChangeKind string
+
+const (
+	ChangeKindInsert ChangeKind = "insert"
+	ChangeKindMove   ChangeKind = "move"
+	ChangeKindFlags  ChangeKind = "flags"
+	ChangeKindDelete ChangeKind = "delete"
+)
+
+const (
+	defaultSyncLimit = 100
+	maxSyncLimit     = 1000
+	// modSeqLease is how long an allocation may take to write its changes
+	// before readers stop waiting for it, e.g. after a crash.
+	modSeqLease = time.Minute
+)
+
+// MailboxChange is one record of a user's mailbox change log. ModSeq is
+// strictly increasing per mailbox, so a client that remembers the highest
+// ModSeq it has seen can ask for everything after it.
+type MailboxChange struct {
+	UserID    string     `bson:"userId"`
+	ModSeq    int64      `bson:"modseq"`
+	Kind      ChangeKind `bson:"kind"`
+	MessageID string     `bson:"messageId"`
+	ThreadID  string     `bson:"threadId"`
+	Folder    string     `bson:"folder,omitempty"`
+	Read      bool       `bson:"read"`
+	Flags     []string   `bson:"flags,omitempty"`
+	Labels    []string   `bson:"labels,omitempty"`
+	At        time.Time  `bson:"at"`
+	// Message is filled in for inserts when returned by Sync.
+	Message *Message `bson:"-"`
+}
+
+// DomainSyncRequest asks for changes with a ModSeq greater than Since.
+type DomainSyncRequest struct {
+	Since int64
+	Limit *int
+}
+
+type DomainSyncResult struct {
+	Changes []MailboxChange
+	// ModSeq is the position to resume from: the last change returned, or
+	// when nothing more changed, the position below any change still being
+	// written.
+	ModSeq int64
+	More   bool
+}
+
+type DomainFlagRequest struct {
+	MessageIDs  []string
+	Read        *bool
+	AddFlags    []string
+	RemoveFlags []string
+}
+
+var (
+	ErrInvalidSyncToken = error(errorString("sync token is not valid for this mailbox"))
+	ErrInvalidCursor    = error(errorString("invalid pagination cursor"))
+)
+
+// Sync returns the caller's mailbox changes since req.Since.
+func (m *MongoMessageService) Sync(ctx context.Context, req DomainSyncRequest) (DomainSyncResult, error) {
+	caller, err := m.callerAddress(ctx)
+	if err != nil {
+		return DomainSyncResult{}, err
+	}
+
+	state, err := m.modSeqState(ctx, caller)
+	if err != nil {
+		return DomainSyncResult{}, err
+	}
+	if req.Since < 0 || req.Since > state.Seq {
+		return DomainSyncResult{}, ErrInvalidSyncToken
+	}
+	// Changes past upTo may still be arriving out of order; the client
+	// picks them up next time.
+	upTo := state.stable(time.Now())
+	if upTo < req.Since {
+		upTo = req.Since
+	}
+
+	limit := defaultSyncLimit
+	if req.Limit != nil && *req.Limit > 0 {
+		limit = *req.Limit
+	}
+	if limit > maxSyncLimit {
+		limit = maxSyncLimit
+	}
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "modseq", Value: 1}}).
+		SetLimit(int64(limit + 1))
+	cursor, err := m.db.Collection("changes").Find(ctx,
+		bson.M{"userId": caller, "modseq": bson.M{"$gt": req.Since, "$lte": upTo}}, findOptions)
+	if err != nil {
+		return DomainSyncResult{}, err
+	}
+	var changes []MailboxChange
+	if err := cursor.All(ctx, &changes); err != nil {
+		return DomainSyncResult{}, err
+	}
+
+	result := DomainSyncResult{ModSeq: upTo}
+	if len(changes) > limit {
+		changes = changes[:limit]
+		result.More = true
+	}
+	if len(changes) > 0 && result.More {
+		result.ModSeq = changes[len(changes)-1].ModSeq
+	}
+
+	if err := m.attachInsertedMessages(ctx, caller, changes); err != nil {
+		return DomainSyncResult{}, err
+	}
+	result.Changes = changes
+	return result, nil
+}
+
+// attachInsertedMessages loads the message for each insert that is still in
+// the mailbox, so one SYNC is enough to render new mail.
+func (m *MongoMessageService) attachInsertedMessages(ctx context.Context, owner string, changes []MailboxChange) error {
+	var ids []string
+	for _, c := range changes {
+		if c.Kind == ChangeKindInsert {
+			ids = append(ids, c.MessageID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	cursor, err := m.db.Collection("messages").Find(ctx, bson.M{"messageId": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	var rawMessages []bson.M
+	if err := cursor.All(ctx, &rawMessages); err != nil {
+		return err
+	}
+	byID := make(map[string]bson.M, len(rawMessages))
+	for _, raw := range rawMessages {
+		if id, ok := raw["messageId"].(string); ok {
+			byID[id] = raw
+		}
+	}
+
+	for i := range changes {
+		c := &changes[i]
+		raw, ok := byID[c.MessageID]
+		if c.Kind != ChangeKindInsert || !ok {
+			continue
+		}
+		msg := convertBsonToMessage(raw, c.Read)
+		msg.Folder = c.Folder
+		msg.Flags = c.Flags
+		msg.Labels = c.Labels
+		c.Message = &msg
+	}
+	return nil
+}
+
+// UpdateFlags changes the read state and flags of messages in the caller's mailbox.
+func (m *MongoMessageService) UpdateFlags(ctx context.Context, req DomainFlagRequest) (int, error) {
+	caller, err := m.callerAddress(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(req.MessageIDs) == 0 {
+		return 0, errorString("no messages given")
+	}
+
+	var updates []bson.M
+	set := bson.M{}
+	if req.Read != nil {
+		set["read"] = *req.Read
+	}
+	add := bson.M{}
+	if len(req.AddFlags) > 0 {
+		add["flags"] = bson.M{"$each": req.AddFlags}
+	}
+	if len(set) > 0 || len(add) > 0 {
+		u := bson.M{}
+		if len(set) > 0 {
+			u["$set"] = set
+		}
+		if len(add) > 0 {
+			u["$addToSet"] = add
+		}
+		updates = append(updates, u)
+	}
+	// $addToSet and $pullAll cannot touch the same field in one update.
+	if len(req.RemoveFlags) > 0 {
+		updates = append(updates, bson.M{"$pullAll": bson.M{"flags": req.RemoveFlags}})
+	}
+	if len(updates) == 0 {
+		return 0, errorString("nothing to update")
+	}
+
+	filter := bson.M{"userId": caller, "messageId": bson.M{"$in": req.MessageIDs}}
+	return m.updateEntries(ctx, caller, filter, ChangeKindFlags, updates...)
+}
+
+// DeleteMessages removes messages from the caller's mailbox.
+func (m *MongoMessageService) DeleteMessages(ctx context.Context, messageIDs []string) (int, error) {
+	caller, err := m.callerAddress(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(messageIDs) == 0 {
+		return 0, errorString("no messages given")
+	}
+	return m.deleteEntries(ctx, caller, bson.M{"userId": caller, "messageId": bson.M{"$in": messageIDs}})
+}
+
+// updateEntries applies updates to the owner's entries matching filter and
+// records the resulting state of each one in the change log.
+func (m *MongoMessageService) updateEntries(ctx context.Context, owner string, filter bson.M, kind ChangeKind, updates ...bson.M) (int, error) {
+	mailboxes := m.db.Collection("mailboxes")
+	ids, err := m.matchingEntryIDs(ctx, filter)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	// Pin the update to the entries found so that the change log matches
+	// what was written; filter stays in place for positional operators.
+	byID := bson.M{"_id": bson.M{"$in": ids}}
+	pinned := bson.M{"_id": byID["_id"]}
+	for k, v := range filter {
+		pinned[k] = v
+	}
+	for _, u := range updates {
+		if _, err := mailboxes.UpdateMany(ctx, pinned, u); err != nil {
+			return 0, err
+		}
+	}
+
+	// Read back by _id alone: the update may change the fields filter matched on.
+	cursor, err := mailboxes.Find(ctx, byID)
+	if err != nil {
+		return 0, err
+	}
+	var entries []mailboxEntry
+	if err := cursor.All(ctx, &entries); err != nil {
+		return 0, err
+	}
+	if err := m.recordChanges(ctx, owner, kind, entries); err != nil {
+		log.Printf("Failed to record %s changes for %s: %v", kind, owner, err)
+	}
+	return len(entries), nil
+}
+
+// deleteEntries removes the owner's entries matching filter and records the deletions.
+func (m *MongoMessageService) deleteEntries(ctx context.Context, owner string, filter bson.M) (int, error) {
+	mailboxes := m.db.Collection("mailboxes")
+	cursor, err := mailboxes.Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	var entries []mailboxEntry
+	if err := cursor.All(ctx, &entries); err != nil {
+		return 0, err
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	ids := make(bson.A, len(entries))
+	for i, e := range entries {
+		ids[i] = e.ID
+	}
+	if _, err := mailboxes.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+		return 0, err
+	}
+	if err := m.recordChanges(ctx, owner, ChangeKindDelete, entries); err != nil {
+		log.Printf("Failed to record deletions for %s: %v", owner, err)
+	}
+	m.adjustUsage(ctx, entries, -1)
+	messageIDs := make([]string, len(entries))
+	for i, e := range entries {
+		messageIDs[i] = e.MessageID
+	}
+	if _, err := collectMessages(ctx, m.db, messageIDs); err != nil {
+		log.Printf("Failed to collect deleted messages of %s: %v", owner, err)
+	}
+	return len(entries), nil
+}
+
+func (m *MongoMessageService) matchingEntryIDs(ctx context.Context, filter bson.M) (bson.A, error) {
+	cursor, err := m.db.Collection("mailboxes").Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	ids := make(bson.A, len(rows))
+	for i, r := range rows {
+		ids[i] = r.ID
+	}
+	return ids, nil
+}
+
+// recordChanges appends one change per entry to owner's change log.
+func (m *MongoMessageService) recordChanges(ctx context.Context, owner string, kind ChangeKind, entries []mailboxEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	first, err := m.allocateModSeq(ctx, owner, len(entries))
+	if err != nil {
+		return err
+	}
+	defer m.releaseModSeq(owner, first)
+
+	now := time.Now().UTC()
+	changes := make([]MailboxChange, len(entries))
+	docs := make([]interface{}, len(entries))
+	for i, e := range entries {
+		changes[i] = MailboxChange{
+			UserID:    owner,
+			ModSeq:    first + int64(i),
+			Kind:      kind,
+			MessageID: e.MessageID,
+			ThreadID:  e.ThreadID,
+			Folder:    e.Folder,
+			Read:      e.Read,
+			Flags:     e.Flags,
+			Labels:    e.Labels,
+			At:        now,
+		}
+		docs[i] = changes[i]
+	}
+	if _, err = m.db.Collection("changes").InsertMany(ctx, docs); err != nil {
+		return err
+	}
+	m.watchers.publish(owner, changes)
+	return nil
+}
+
+// recordInserts logs freshly inserted entries, grouped by mailbox owner.
+func (m *MongoMessageService) recordInserts(ctx context.Context, entries []mailboxEntry) {
+	byOwner := make(map[string][]mailboxEntry)
+	var owners []string
+	for _, e := range entries {
+		if _, ok := byOwner[e.UserID]; !ok {
+			owners = append(owners, e.UserID)
+		}
+		byOwner[e.UserID] = append(byOwner[e.UserID], e)
+	}
+	for _, owner := range owners {
+		if err := m.recordChanges(ctx, owner, ChangeKindInsert, byOwner[owner]); err != nil {
+			log.Printf("Failed to record inserts for %s: %v", owner, err)
+		}
+	}
+}
+
+// modSeqState is a mailbox's mailbox_seq document: the last sequence
+// number allocated, and the allocations whose changes are still being
+// written.
+type modSeqState struct {
+	Seq     int64           `bson:"seq"`
+	Pending []pendingModSeq `bson:"pending,omitempty"`
+}
+
+type pendingModSeq struct {
+	First int64     `bson:"first"`
+	At    time.Time `bson:"at"`
+}
+
+// stable returns the highest ModSeq at or below which every change has been
+// written. Allocations older than modSeqLease are given up on.
+func (s modSeqState) stable(now time.Time) int64 {
+	stable := s.Seq
+	for _, p := range s.Pending {
+		if now.Sub(p.At) < modSeqLease && p.First-1 < stable {
+			stable = p.First - 1
+		}
+	}
+	return stable
+}
+
+// allocateModSeq reserves n consecutive sequence numbers for owner's mailbox
+// and returns the first one. The allocation stays pending, holding back
+// readers, until releaseModSeq.
+func (m *MongoMessageService) allocateModSeq(ctx context.Context, owner string, n int) (int64, error) {
+	now := time.Now().UTC()
+	// One pipeline update, so no reader sees the counter advanced without
+	// the pending allocation; it also drops allocations past their lease.
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"seq": bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$seq", 0}}, int64(n)}}}}},
+		{{Key: "$set", Value: bson.M{"pending": bson.M{"$concatArrays": bson.A{
+			bson.M{"$filter": bson.M{
+				"input": bson.M{"$ifNull": bson.A{"$pending", bson.A{}}},
+				"cond":  bson.M{"$gt": bson.A{"$$this.at", now.Add(-modSeqLease)}},
+			}},
+			bson.A{bson.M{"first": bson.M{"$subtract": bson.A{"$seq", int64(n - 1)}}, "at": now}},
+		}}}}},
+	}
+	var doc modSeqState
+	err := m.db.Collection("mailbox_seq").FindOneAndUpdate(ctx,
+		bson.M{"_id": owner},
+		update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&doc)
+	if err != nil {
+		return 0, err
+	}
+	return doc.Seq - int64(n) + 1, nil
+}
+
+// releaseModSeq ends the allocation starting at first, whether or not its
+// changes were written.
+func (m *MongoMessageService) releaseModSeq(owner string, first int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := m.db.Collection("mailbox_seq").UpdateOne(ctx,
+		bson.M{"_id": owner},
+		bson.M{"$pull": bson.M{"pending": bson.M{"first": first}}})
+	if err != nil {
+		log.Printf("Failed to release modseq %d of %s: %v", first, owner, err)
+	}
+}
+
+func (m *MongoMessageService) modSeqState(ctx context.Context, owner string) (modSeqState, error) {
+	var doc modSeqState
+	err := m.db.Collection("mailbox_seq").FindOne(ctx, bson.M{"_id": owner}).Decode(&doc)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return modSeqState{}, err
+	}
+	return doc, nil
+}
+
+// stableModSeq is the position a client can resume syncing from without
+// missing a change still being written.
+func (m *MongoMessageService) stableModSeq(ctx context.Context, owner string) (int64, error) {
+	state, err := m.modSeqState(ctx, owner)
+	if err != nil {
+		return 0, err
+	}
+	return state.stable(time.Now()), nil
+}
+
+// Pagination cursors point just past the last entry of a page, ordered by
+// receivedAt then _id, so pages stay stable while new mail arrives.
+
+func encodeCursor(e mailboxEntry) string {
+	raw := strconv.FormatInt(e.ReceivedAt.UnixNano(), 10) + ":" + e.ID.Hex()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// cursorFilter returns the filter selecting entries after cursor.
+func cursorFilter(cursor string) (bson.M, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	nanos, hexID, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	id, err := primitive.ObjectIDFromHex(hexID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	at := time.Unix(0, n).UTC()
+	return bson.M{"$or": bson.A{
+		bson.M{"receivedAt": bson.M{"$lt": at}},
+		bson.M{"receivedAt": at, "_id": bson.M{"$lt": id}},
+	}}, nil
+}
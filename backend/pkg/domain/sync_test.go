@@ -0,0 +1,196 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestModSeqStable(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		state modSeqState
+		want  int64
+	}{
+		{"empty mailbox", modSeqState{}, 0},
+		{"nothing pending", modSeqState{Seq: 7}, 7},
+		{"latest allocation pending", modSeqState{Seq: 7, Pending: []pendingModSeq{{First: 6, At: now}}}, 5},
+		{"oldest allocation wins", modSeqState{Seq: 9, Pending: []pendingModSeq{
+			{First: 8, At: now},
+			{First: 3, At: now.Add(-time.Second)},
+		}}, 2},
+		{"allocation past its lease", modSeqState{Seq: 9, Pending: []pendingModSeq{
+			{First: 3, At: now.Add(-modSeqLease)},
+			{First: 8, At: now},
+		}}, 7},
+		{"first allocation pending", modSeqState{Seq: 2, Pending: []pendingModSeq{{First: 1, At: now}}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.state.stable(now); got != tt.want {
+				t.Errorf("stable() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	e := mailboxEntry{
+		ID:         primitive.NewObjectID(),
+		ReceivedAt: time.Date(2026, 10, 19, 12, 0, 0, 123456789, time.UTC),
+	}
+	filter, err := cursorFilter(encodeCursor(e))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.M{"$or": bson.A{
+		bson.M{"receivedAt": bson.M{"$lt": e.ReceivedAt}},
+		bson.M{"receivedAt": e.ReceivedAt, "_id": bson.M{"$lt": e.ID}},
+	}}
+	if !reflect.DeepEqual(filter, want) {
+		t.Errorf("cursorFilter = %v, want %v", filter, want)
+	}
+}
+
+func TestCursorFilterRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"not base64", "!!!"},
+		{"no separator", "MTIzNDU"},
+		{"bad time", "eDphYmM"},
+		{"bad object ID", "MTIzOnh5eg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := cursorFilter(tt.cursor); !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("cursorFilter(%q) = %v, want ErrInvalidCursor", tt.cursor, err)
+			}
+		})
+	}
+}
+
+func TestAllocateModSeq(t *testing.T) {
+	m := testStore(t)
+	ctx := context.Background()
+	allocate := func(owner string, n int) int64 {
+		t.Helper()
+		first, err := m.allocateModSeq(ctx, owner, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return first
+	}
+	stable := func(owner string) int64 {
+		t.Helper()
+		s, err := m.stableModSeq(ctx, owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	if first := allocate("ada~example.com", 3); first != 1 {
+		t.Errorf("first allocation starts at %d, want 1", first)
+	}
+	if first := allocate("ada~example.com", 2); first != 4 {
+		t.Errorf("second allocation starts at %d, want 4", first)
+	}
+	if first := allocate("bob~example.com", 1); first != 1 {
+		t.Errorf("another mailbox starts at %d, want 1", first)
+	}
+	if s := stable("ada~example.com"); s != 0 {
+		t.Errorf("stable = %d with both allocations pending, want 0", s)
+	}
+	m.releaseModSeq("ada~example.com", 1)
+	if s := stable("ada~example.com"); s != 3 {
+		t.Errorf("stable = %d after releasing the first allocation, want 3", s)
+	}
+	m.releaseModSeq("ada~example.com", 4)
+	if s := stable("ada~example.com"); s != 5 {
+		t.Errorf("stable = %d after releasing both, want 5", s)
+	}
+
+	// An allocation past its lease is dropped by the next one.
+	_, err := m.db.Collection("mailbox_seq").UpdateOne(ctx, bson.M{"_id": "ada~example.com"},
+		bson.M{"$push": bson.M{"pending": pendingModSeq{First: 3, At: time.Now().Add(-2 * modSeqLease)}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocate("ada~example.com", 1)
+	state, err := m.modSeqState(ctx, "ada~example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Pending) != 1 || state.Pending[0].First != 6 {
+		t.Errorf("pending = %+v, want only the new allocation", state.Pending)
+	}
+
+	// Concurrent allocations never overlap.
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	seen := make(map[int64]bool)
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			first, err := m.allocateModSeq(ctx, "carl~example.com", 2)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for seq := first; seq < first+2; seq++ {
+				if seen[seq] {
+					t.Errorf("modseq %d allocated twice", seq)
+				}
+				seen[seq] = true
+			}
+		}()
+	}
+	wg.Wait()
+	if len(seen) != 32 {
+		t.Errorf("%d modseqs allocated, want 32", len(seen))
+	}
+}
+
+func TestRecordChangesNumbersEntries(t *testing.T) {
+	m := testStore(t)
+	ctx := context.Background()
+	entries := []mailboxEntry{{UserID: "ada~example.com", MessageID: "m1"}, {UserID: "ada~example.com", MessageID: "m2"}}
+	if err := m.recordChanges(ctx, "ada~example.com", ChangeKindInsert, entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.recordChanges(ctx, "ada~example.com", ChangeKindFlags, entries[:1]); err != nil {
+		t.Fatal(err)
+	}
+	cursor, err := m.db.Collection("changes").Find(ctx, bson.M{"userId": "ada~example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changes []MailboxChange
+	if err := cursor.All(ctx, &changes); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range changes {
+		got = append(got, fmt.Sprintf("%d:%s:%s", c.ModSeq, c.Kind, c.MessageID))
+	}
+	want := []string{"1:" + string(ChangeKindInsert) + ":m1", "2:" + string(ChangeKindInsert) + ":m2", "3:" + string(ChangeKindFlags) + ":m1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("changes = %v, want %v", got, want)
+	}
+	if s, err := m.stableModSeq(ctx, "ada~example.com"); err != nil || s != 3 {
+		t.Errorf("stableModSeq = %d, %v; want 3 once every change is written", s, err)
+	}
+}
@@ -0,0 +1,168 @@
+package domain
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IMAP clients address messages by UID: a number per folder that never
+// changes while the message stays there and grows with every arrival.
+// Entries get theirs lazily, the first time their folder is viewed, from a
+// per-folder counter in the folder_uids collection. An entry that has been
+// moved since carries the UID of its old folder and is numbered again.
+
+// FolderView is one folder of the caller's mailbox with its entries in
+// ascending UID order.
+type FolderView struct {
+	Folder string
+	// UIDValidity changes only if UIDs of the folder are ever reused.
+	UIDValidity uint32
+	UIDNext     uint32
+	Entries     []FolderViewEntry
+}
+
+type FolderViewEntry struct {
+	UID        uint32
+	MessageID  string
+	ThreadID   string
+	Read       bool
+	Flags      []string
+	Labels     []string
+	ReceivedAt time.Time
+}
+
+type folderUIDs struct {
+	ID       string `bson:"_id"`
+	Owner    string `bson:"owner"`
+	Folder   string `bson:"folder"`
+	Validity uint32 `bson:"validity"`
+	// Last is the highest UID handed out so far.
+	Last uint32 `bson:"last"`
+}
+
+// FolderView lists the caller's entries in folder, numbering those that
+// have no UID in it yet.
+func (m *MongoMessageService) FolderView(ctx context.Context, folder string) (FolderView, error) {
+	caller, err := m.callerAddress(ctx)
+	if err != nil {
+		return FolderView{}, err
+	}
+
+	entries, err := m.folderEntries(ctx, caller, folder)
+	if err != nil {
+		return FolderView{}, err
+	}
+	var unnumbered []mailboxEntry
+	for _, e := range entries {
+		if e.UID == 0 || e.UIDFolder != folder {
+			unnumbered = append(unnumbered, e)
+		}
+	}
+
+	counter, err := m.allocateUIDs(ctx, caller, folder, len(unnumbered))
+	if err != nil {
+		return FolderView{}, err
+	}
+	if len(unnumbered) > 0 {
+		// Number in arrival order. An entry moved or numbered by another
+		// session in the meantime is left alone and read back below; its
+		// reserved UID is simply never used.
+		first := counter.Last - uint32(len(unnumbered)) + 1
+		models := make([]mongo.WriteModel, len(unnumbered))
+		for i, e := range unnumbered {
+			filter := bson.M{"_id": e.ID, "folder": folder, "uid": e.UID, "uidFolder": e.UIDFolder}
+			if e.UID == 0 {
+				filter["uid"] = bson.M{"$exists": false}
+				filter["uidFolder"] = bson.M{"$exists": false}
+			}
+			models[i] = mongo.NewUpdateOneModel().
+				SetFilter(filter).
+				SetUpdate(bson.M{"$set": bson.M{"uid": first + uint32(i), "uidFolder": folder}})
+		}
+		if _, err := m.db.Collection("mailboxes").BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+			return FolderView{}, err
+		}
+		if entries, err = m.folderEntries(ctx, caller, folder); err != nil {
+			return FolderView{}, err
+		}
+	}
+
+	view := FolderView{
+		Folder:      folder,
+		UIDValidity: counter.Validity,
+		UIDNext:     counter.Last + 1,
+		Entries:     make([]FolderViewEntry, 0, len(entries)),
+	}
+	for _, e := range entries {
+		if e.UID == 0 || e.UIDFolder != folder {
+			continue // moved again while being numbered
+		}
+		view.Entries = append(view.Entries, FolderViewEntry{
+			UID:        e.UID,
+			MessageID:  e.MessageID,
+			ThreadID:   e.ThreadID,
+			Read:       e.Read,
+			Flags:      e.Flags,
+			Labels:     e.Labels,
+			ReceivedAt: e.ReceivedAt,
+		})
+	}
+	sort.Slice(view.Entries, func(i, j int) bool { return view.Entries[i].UID < view.Entries[j].UID })
+	return view, nil
+}
+
+// GetMessages returns the messages of the caller's mailbox with the given
+// IDs. IDs not in the mailbox are skipped.
+func (m *MongoMessageService) GetMessages(ctx context.Context, messageIDs []string) ([]Message, error) {
+	caller, err := m.callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(messageIDs) == 0 {
+		return nil, nil
+	}
+	result, err := m.fetchEntries(ctx, bson.M{"userId": caller, "messageId": bson.M{"$in": messageIDs}}, len(messageIDs), 0, "")
+	if err != nil {
+		return nil, err
+	}
+	return result.Messages, nil
+}
+
+func (m *MongoMessageService) folderEntries(ctx context.Context, owner, folder string) ([]mailboxEntry, error) {
+	cursor, err := m.db.Collection("mailboxes").Find(ctx,
+		bson.M{"userId": owner, "folder": folder},
+		options.Find().SetSort(bson.D{{Key: "receivedAt", Value: 1}, {Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var entries []mailboxEntry
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// allocateUIDs reserves n UIDs in owner's folder, creating its counter on
+// first use, and returns the counter after the reservation.
+func (m *MongoMessageService) allocateUIDs(ctx context.Context, owner, folder string, n int) (folderUIDs, error) {
+	var counter folderUIDs
+	err := m.db.Collection("folder_uids").FindOneAndUpdate(ctx,
+		bson.M{"_id": owner + "\x00" + folder},
+		bson.M{
+			"$inc": bson.M{"last": n},
+			"$setOnInsert": bson.M{
+				"owner":    owner,
+				"folder":   folder,
+				"validity": uint32(time.Now().Unix()),
+			},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	return counter, err
+}
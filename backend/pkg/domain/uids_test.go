@@ -0,0 +1,25 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"quill/pkg/identity"
+)
+
+func TestFolderViewRequiresCaller(t *testing.T) {
+	m := testMessageService(t)
+	ctx := context.Background()
+	if _, err := m.FolderView(ctx, FolderInbox); !errors.Is(err, ErrUserNotAuthenticated) {
+		t.Errorf("FolderView() = %v, want %v", err, ErrUserNotAuthenticated)
+	}
+	if _, err := m.GetMessages(ctx, []string{"m1"}); !errors.Is(err, ErrUserNotAuthenticated) {
+		t.Errorf("GetMessages() = %v, want %v", err, ErrUserNotAuthenticated)
+	}
+
+	ctx = identity.WithPrincipal(ctx, &identity.Principal{AccountID: "u1", Addresses: []string{"ada~example.com"}})
+	if msgs, err := m.GetMessages(ctx, nil); err != nil || msgs != nil {
+		t.Errorf("GetMessages(nil) = %v, %v, want nothing", msgs, err)
+	}
+}
@@ -1,6 +1,12 @@
 package domain
 
 import (
+	"context"
+	"os"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"quill/pkg/hosting"
 	"quill/pkg/models"
 )
 
@@ -9,6 +15,49 @@ import (
 
 // UserService defines the interface for user-related operations
 type UserService interface {
-	CreateUser(request models.CreateUserRequest) (models.CreateUserResponse, error)
-	// Add other user operations as needed
+	// Self-service for the authenticated principal.
+	CreateUser(ctx context.Context, request models.CreateUserRequest) (models.CreateUserResponse, error)
+	GetProfile(ctx context.Context) (*models.User, error)
+	UpdateProfile(ctx context.Context, update ProfileUpdate) (*models.User, error)
+	ChangeHandle(ctx context.Context, newAddress string) (*models.User, error)
+	TouchLastLogin(ctx context.Context) error
+	DeleteAccount(ctx context.Context) (*models.User, error)
+	CancelAccountDeletion(ctx context.Context) (*models.User, error)
+	StartExport(ctx context.Context) (*ExportJob, error)
+	GetExport(ctx context.Context, id string) (*ExportJob, error)
+	OpenExport(ctx context.Context, id string) (*os.File, *ExportJob, error)
+
+	// Administration; every method requires the admin role.
+	ListUsers(ctx context.Context, q UserQuery) ([]models.User, int, error)
+	GetUser(ctx context.Context, id string) (*models.User, error)
+	AdminCreateUser(ctx context.Context, user models.User) (*models.User, error)
+	UpdateUser(ctx context.Context, id string, update UserUpdate) (*models.User, error)
+	DeleteUser(ctx context.Context, id string) error
+	SetSuspended(ctx context.Context, id string, suspended bool, reason string) (*models.User, error)
+	SetRoles(ctx context.Context, id string, roles []string) (*models.User, error)
+	SetQuota(ctx context.Context, id string, quotaBytes int64) (*models.User, error)
+	ResetCredentials(ctx context.Context, id string) (int, error)
+	ListAliases(ctx context.Context, id string) ([]AddressRedirect, error)
+	AddAlias(ctx context.Context, id, address string) (*AddressRedirect, error)
+	RemoveAlias(ctx context.Context, address string) error
+	AuditLog(ctx context.Context, q AuditQuery) ([]AuditEntry, error)
+}
+
+// MongoUserService implements UserService on the users collection. Data
+// exports are written below exportDir.
+type MongoUserService struct {
+	db        *mongo.Database
+	exportDir string
+	hosts     *hosting.Registry
 }
+
+func NewMongoUserService(db *mongo.Database, exportDir string, hosts *hosting.Registry) *MongoUserService {
+	return &MongoUserService{db: db, exportDir: exportDir, hosts: hosts}
+}
+
+var (
+	ErrUserNotFound     = error(errorString("user not found"))
+	ErrUserExists       = error(errorString("a user with this ID, email or Quill address already exists"))
+	ErrInvalidUser      = error(errorString("invalid user"))
+	ErrAccountSuspended = error(errorString("account is suspended"))
+)
@@ -0,0 +1,258 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AutoSubmittedAutoReplied marks messages generated by the vacation
+// responder, following the Auto-Submitted header of RFC 3834. Any message
+// carrying an AutoSubmitted value is never answered automatically.
+const AutoSubmittedAutoReplied = "auto-replied"
+
+const defaultVacationIntervalDays = 7
+
+// VacationSettings configures a user's out-of-office reply.
+type VacationSettings struct {
+	Owner        string    `bson:"_id"`
+	Enabled      bool      `bson:"enabled"`
+	Start        time.Time `bson:"start,omitempty"`
+	End          time.Time `bson:"end,omitempty"`
+	Subject      string    `bson:"subject"`
+	Body         string    `bson:"body"`
+	Exclude      []string  `bson:"exclude,omitempty"` // addresses or bare domains
+	IntervalDays int       `bson:"intervalDays"`
+	UpdatedAt    time.Time `bson:"updatedAt"`
+}
+
+type VacationOperation string
+
+const (
+	VacationOperationGet     VacationOperation = "get"
+	VacationOperationSet     VacationOperation = "set"
+	VacationOperationDisable VacationOperation = "disable"
+)
+
+type DomainVacationRequest struct {
+	Operation VacationOperation
+	Settings  *VacationSettings
+}
+
+// AutoReply is a vacation reply generated during delivery. Result.Relays
+// still has to be sent when the original sender is on another server.
+type AutoReply struct {
+	Request DomainSendRequest
+	Result  DomainSendResult
+}
+
+var ErrInvalidVacation = error(errorString("invalid vacation settings"))
+
+// ManageVacation reads or changes the authenticated user's auto-responder.
+func (m *MongoMessageService) ManageVacation(ctx context.Context, req DomainVacationRequest) (VacationSettings, error) {
+	caller, err := m.callerAddress(ctx)
+	if err != nil {
+		return VacationSettings{}, err
+	}
+
+	switch req.Operation {
+	case VacationOperationGet:
+		settings, err := m.getVacation(ctx, caller)
+		if err != nil {
+			return VacationSettings{}, err
+		}
+		if settings == nil {
+			return VacationSettings{Owner: caller, IntervalDays: defaultVacationIntervalDays}, nil
+		}
+		return *settings, nil
+	case VacationOperationSet:
+		if req.Settings == nil {
+			return VacationSettings{}, fmt.Errorf("%w: no settings given", ErrInvalidVacation)
+		}
+		settings := *req.Settings
+		settings.Owner = caller
+		settings.UpdatedAt = time.Now().UTC()
+		if settings.IntervalDays <= 0 {
+			settings.IntervalDays = defaultVacationIntervalDays
+		}
+		if !settings.End.IsZero() && settings.End.Before(settings.Start) {
+			return VacationSettings{}, fmt.Errorf("%w: end is before start", ErrInvalidVacation)
+		}
+		if strings.TrimSpace(settings.Body) == "" {
+			return VacationSettings{}, fmt.Errorf("%w: body is required", ErrInvalidVacation)
+		}
+		_, err := m.db.Collection("vacations").ReplaceOne(ctx, bson.M{"_id": caller}, settings, options.Replace().SetUpsert(true))
+		if err != nil {
+			return VacationSettings{}, err
+		}
+		// A fresh configuration starts a fresh reply history.
+		if _, err := m.db.Collection("vacation_replies").DeleteMany(ctx, bson.M{"owner": caller}); err != nil {
+			log.Printf("Failed to reset vacation reply history for %s: %v", caller, err)
+		}
+		return settings, nil
+	case VacationOperationDisable:
+		_, err := m.db.Collection("vacations").UpdateByID(ctx, caller, bson.M{"$set": bson.M{"enabled": false, "updatedAt": time.Now().UTC()}})
+		if err != nil {
+			return VacationSettings{}, err
+		}
+		settings, err := m.getVacation(ctx, caller)
+		if err != nil || settings == nil {
+			return VacationSettings{Owner: caller}, err
+		}
+		return *settings, nil
+	default:
+		return VacationSettings{}, errorString(fmt.Sprintf("unknown vacation operation %q", req.Operation))
+	}
+}
+
+func (m *MongoMessageService) getVacation(ctx context.Context, owner string) (*VacationSettings, error) {
+	var settings VacationSettings
+	if err := m.db.Collection("vacations").FindOne(ctx, bson.M{"_id": owner}).Decode(&settings); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error retrieving vacation settings: %w", err)
+	}
+	return &settings, nil
+}
+
+// autoRespond sends vacation replies for a freshly delivered message.
+// Only recipients named directly in To or CC answer, and only when the
+// message is neither list traffic nor itself automated.
+func (m *MongoMessageService) autoRespond(ctx context.Context, req DomainSendRequest, threadID string, entries []mailboxEntry) []AutoReply {
+	if req.AutoSubmitted != "" || req.ListID != "" || isAutomatedSender(req.From) {
+		return nil
+	}
+
+	direct := append(append([]string{}, req.To...), req.CC...)
+	now := time.Now().UTC()
+	var replies []AutoReply
+	for _, e := range entries {
+		if e.ListID != "" || e.UserID == req.From || !containsString(direct, e.UserID) {
+			continue
+		}
+
+		settings, err := m.getVacation(ctx, e.UserID)
+		if err != nil {
+			log.Printf("Failed to load vacation settings for %s: %v", e.UserID, err)
+			continue
+		}
+		if settings == nil || !settings.active(now) || settings.excludes(req.From) {
+			continue
+		}
+
+		ok, err := m.claimVacationReply(ctx, settings, req.From, now)
+		if err != nil {
+			log.Printf("Failed to record vacation reply for %s: %v", e.UserID, err)
+			continue
+		}
+		if !ok {
+			continue // already answered this sender recently
+		}
+
+		reply := settings.reply(req, threadID)
+		result, err := m.SendInternal(ctx, reply)
+		if err != nil {
+			log.Printf("Failed to send vacation reply from %s to %s: %v", e.UserID, req.From, err)
+			continue
+		}
+		replies = append(replies, AutoReply{Request: reply, Result: result})
+	}
+	return replies
+}
+
+// claimVacationReply records that owner is answering sender now. It returns
+// false when a reply was already sent within the configured interval.
+func (m *MongoMessageService) claimVacationReply(ctx context.Context, settings *VacationSettings, sender string, now time.Time) (bool, error) {
+	cutoff := now.AddDate(0, 0, -settings.IntervalDays)
+	filter := bson.M{
+		"owner":     settings.Owner,
+		"sender":    sender,
+		"repliedAt": bson.M{"$lt": cutoff},
+	}
+	update := bson.M{"$set": bson.M{"repliedAt": now}}
+	res, err := m.db.Collection("vacation_replies").UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	if res.ModifiedCount > 0 {
+		return true, nil
+	}
+
+	// No stale record to refresh: either we replied recently, or never.
+	_, err = m.db.Collection("vacation_replies").InsertOne(ctx, bson.M{
+		"_id":       settings.Owner + "|" + sender,
+		"owner":     settings.Owner,
+		"sender":    sender,
+		"repliedAt": now,
+	})
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *VacationSettings) active(now time.Time) bool {
+	if !s.Enabled {
+		return false
+	}
+	if !s.Start.IsZero() && now.Before(s.Start) {
+		return false
+	}
+	if !s.End.IsZero() && now.After(s.End) {
+		return false
+	}
+	return true
+}
+
+// excludes reports whether sender matches an excluded address or domain.
+func (s *VacationSettings) excludes(sender string) bool {
+	senderDomain := extractDomain(sender)
+	for _, x := range s.Exclude {
+		x = strings.TrimPrefix(x, "~")
+		if strings.EqualFold(x, sender) || strings.EqualFold(x, senderDomain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *VacationSettings) reply(original DomainSendRequest, threadID string) DomainSendRequest {
+	subject := s.Subject
+	if subject == "" {
+		subject = "Auto: " + original.Subject
+	}
+	return DomainSendRequest{
+		From:    s.Owner,
+		To:      []string{original.From},
+		Subject: subject,
+		Body: Body{Content: []Content{
+			{Type: ContentTypePlainText, Value: s.Body},
+		}},
+		Options:       SendOptions{ThreadID: &threadID},
+		AutoSubmitted: AutoSubmittedAutoReplied,
+	}
+}
+
+// isAutomatedSender catches bounce and no-reply mailboxes that predate the
+// AutoSubmitted marker.
+func isAutomatedSender(addr string) bool {
+	local := strings.ToLower(addr)
+	if i := strings.LastIndexAny(local, "~@"); i != -1 {
+		local = local[:i]
+	}
+	switch local {
+	case "noreply", "no-reply", "donotreply", "mailer-daemon", "postmaster":
+		return true
+	}
+	return false
+}
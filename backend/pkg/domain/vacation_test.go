@@ -0,0 +1,206 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"quill/pkg/identity"
+)
+
+func TestVacationActive(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		settings VacationSettings
+		want     bool
+	}{
+		{"disabled", VacationSettings{}, false},
+		{"open-ended", VacationSettings{Enabled: true}, true},
+		{"not started", VacationSettings{Enabled: true, Start: now.Add(time.Hour)}, false},
+		{"started", VacationSettings{Enabled: true, Start: now.Add(-time.Hour)}, true},
+		{"ended", VacationSettings{Enabled: true, End: now.Add(-time.Hour)}, false},
+		{"within window", VacationSettings{Enabled: true, Start: now.Add(-time.Hour), End: now.Add(time.Hour)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.settings.active(now); got != tt.want {
+				t.Errorf("active() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVacationExcludes(t *testing.T) {
+	settings := VacationSettings{Exclude: []string{"boss~example.com", "~Example.org"}}
+	tests := []struct {
+		sender string
+		want   bool
+	}{
+		{"boss~example.com", true},
+		{"Boss~Example.com", true},
+		{"ada~example.com", false},
+		{"eve~example.org", true},
+		{"eve~sub.example.org", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sender, func(t *testing.T) {
+			if got := settings.excludes(tt.sender); got != tt.want {
+				t.Errorf("excludes(%q) = %v, want %v", tt.sender, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVacationReply(t *testing.T) {
+	original := DomainSendRequest{From: "eve~example.org", To: []string{"ada~example.com"}, Subject: "Lunch?"}
+	tests := []struct {
+		name        string
+		subject     string
+		wantSubject string
+	}{
+		{"default subject", "", "Auto: Lunch?"},
+		{"own subject", "Away", "Away"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := VacationSettings{Owner: "ada~example.com", Subject: tt.subject, Body: "Back Monday"}
+			reply := settings.reply(original, "thread")
+			if reply.Subject != tt.wantSubject {
+				t.Errorf("subject = %q, want %q", reply.Subject, tt.wantSubject)
+			}
+			if reply.From != settings.Owner || !reflect.DeepEqual(reply.To, []string{original.From}) {
+				t.Errorf("reply goes %s -> %v, want %s -> %s", reply.From, reply.To, settings.Owner, original.From)
+			}
+			if reply.AutoSubmitted != AutoSubmittedAutoReplied {
+				t.Errorf("AutoSubmitted = %q, want %q", reply.AutoSubmitted, AutoSubmittedAutoReplied)
+			}
+			if reply.Options.ThreadID == nil || *reply.Options.ThreadID != "thread" {
+				t.Errorf("reply is not in the original thread")
+			}
+		})
+	}
+}
+
+func TestIsAutomatedSender(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"noreply~example.com", true},
+		{"No-Reply@example.net", true},
+		{"MAILER-DAEMON@example.net", true},
+		{"postmaster~example.com", true},
+		{"ada~example.com", false},
+		{"noreply.ada~example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := isAutomatedSender(tt.addr); got != tt.want {
+				t.Errorf("isAutomatedSender(%q) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAutoRespondSkipsAutomatedMail(t *testing.T) {
+	entries := []mailboxEntry{{UserID: "ada~example.com"}}
+	tests := []struct {
+		name string
+		req  DomainSendRequest
+	}{
+		{"auto-submitted", DomainSendRequest{From: "eve~example.org", To: []string{"ada~example.com"}, AutoSubmitted: AutoSubmittedAutoReplied}},
+		{"list traffic", DomainSendRequest{From: "eve~example.org", To: []string{"ada~example.com"}, ListID: "team~example.com"}},
+		{"automated sender", DomainSendRequest{From: "noreply~example.org", To: []string{"ada~example.com"}}},
+		{"not addressed directly", DomainSendRequest{From: "eve~example.org", To: []string{"team~example.com"}}},
+	}
+	m := testMessageService(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if replies := m.autoRespond(context.Background(), tt.req, "thread", entries); replies != nil {
+				t.Errorf("autoRespond = %+v, want no replies", replies)
+			}
+		})
+	}
+}
+
+func TestManageVacationRejects(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		settings *VacationSettings
+	}{
+		{"no settings", nil},
+		{"end before start", &VacationSettings{Body: "away", Start: now, End: now.Add(-time.Hour)}},
+		{"blank body", &VacationSettings{Body: "  "}},
+	}
+	ctx := identity.WithPrincipal(context.Background(), &identity.Principal{
+		AccountID: "u1",
+		Addresses: []string{"ada~example.com"},
+		Method:    identity.AuthMethodJWT,
+	})
+	m := testMessageService(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := m.ManageVacation(ctx, DomainVacationRequest{Operation: VacationOperationSet, Settings: tt.settings})
+			if !errors.Is(err, ErrInvalidVacation) {
+				t.Errorf("ManageVacation = %v, want ErrInvalidVacation", err)
+			}
+		})
+	}
+}
+
+func TestClaimVacationReply(t *testing.T) {
+	m := testStore(t)
+	ctx := context.Background()
+	ada := &VacationSettings{Owner: "ada~example.com", IntervalDays: 7}
+	bob := &VacationSettings{Owner: "bob~example.com", IntervalDays: 7}
+	start := time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	tests := []struct {
+		name     string
+		settings *VacationSettings
+		sender   string
+		at       time.Time
+		want     bool
+	}{
+		{"first message", ada, "eve~example.org", start, true},
+		{"within the interval", ada, "eve~example.org", start.Add(day), false},
+		{"another sender", ada, "dan~example.org", start.Add(day), true},
+		{"another owner", bob, "eve~example.org", start.Add(day), true},
+		{"after the interval", ada, "eve~example.org", start.Add(8 * day), true},
+		{"within the new interval", ada, "eve~example.org", start.Add(9 * day), false},
+	}
+	for _, tt := range tests {
+		got, err := m.claimVacationReply(ctx, tt.settings, tt.sender, tt.at)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: claimVacationReply() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Deliveries racing for the same sender send one reply between them.
+	var claimed atomic.Int32
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, err := m.claimVacationReply(ctx, ada, "carl~example.org", start); err != nil {
+				t.Error(err)
+			} else if ok {
+				claimed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := claimed.Load(); n != 1 {
+		t.Errorf("%d concurrent claims succeeded, want 1", n)
+	}
+}
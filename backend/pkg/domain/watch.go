@@ -0,0 +1,73 @@
+package domain
+
+import (
+	"context"
+	"sync"
+)
+
+// watchBuffer is how many changes a watcher may fall behind before further
+// changes are dropped for it. Watchers catch up with Sync.
+const watchBuffer = 64
+
+// Watch streams the caller's mailbox changes as they are recorded, until ctx
+// ends. Only changes recorded by this process are seen, and a slow watcher
+// misses changes rather than holding up delivery, so watchers treat them as
+// hints and use the ModSeq to Sync.
+func (m *MongoMessageService) Watch(ctx context.Context) (<-chan MailboxChange, error) {
+	caller, err := m.callerAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan MailboxChange, watchBuffer)
+	id := m.watchers.add(caller, ch)
+	go func() {
+		<-ctx.Done()
+		m.watchers.remove(caller, id)
+		close(ch)
+	}()
+	return ch, nil
+}
+
+// changeWatchers fans recorded changes out to the watchers of each mailbox.
+// The zero value is ready to use.
+type changeWatchers struct {
+	mu     sync.Mutex
+	nextID int
+	byUser map[string]map[int]chan MailboxChange
+}
+
+func (w *changeWatchers) add(owner string, ch chan MailboxChange) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.byUser == nil {
+		w.byUser = make(map[string]map[int]chan MailboxChange)
+	}
+	if w.byUser[owner] == nil {
+		w.byUser[owner] = make(map[int]chan MailboxChange)
+	}
+	w.nextID++
+	w.byUser[owner][w.nextID] = ch
+	return w.nextID
+}
+
+func (w *changeWatchers) remove(owner string, id int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.byUser[owner], id)
+	if len(w.byUser[owner]) == 0 {
+		delete(w.byUser, owner)
+	}
+}
+
+func (w *changeWatchers) publish(owner string, changes []MailboxChange) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, ch := range w.byUser[owner] {
+		for _, c := range changes {
+			select {
+			case ch <- c:
+			default:
+			}
+		}
+	}
+}
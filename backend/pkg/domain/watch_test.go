@@ -0,0 +1,77 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"quill/pkg/identity"
+)
+
+func TestChangeWatchers(t *testing.T) {
+	var w changeWatchers
+	ada1 := make(chan MailboxChange, 1)
+	ada2 := make(chan MailboxChange, 1)
+	bob := make(chan MailboxChange, 1)
+	id1 := w.add("ada~example.com", ada1)
+	w.add("ada~example.com", ada2)
+	w.add("bob~example.com", bob)
+
+	w.publish("ada~example.com", []MailboxChange{{MessageID: "m1"}, {MessageID: "m2"}})
+	for name, ch := range map[string]chan MailboxChange{"first": ada1, "second": ada2} {
+		// The buffer holds one change; the other is dropped, not blocking.
+		if c := <-ch; c.MessageID != "m1" {
+			t.Errorf("%s watcher got %s, want m1", name, c.MessageID)
+		}
+		if len(ch) != 0 {
+			t.Errorf("%s watcher holds %d more changes", name, len(ch))
+		}
+	}
+	if len(bob) != 0 {
+		t.Error("another mailbox's watcher saw the change")
+	}
+
+	w.remove("ada~example.com", id1)
+	w.publish("ada~example.com", []MailboxChange{{MessageID: "m3"}})
+	if len(ada1) != 0 || len(ada2) != 1 {
+		t.Errorf("after remove: removed has %d, remaining has %d changes", len(ada1), len(ada2))
+	}
+	w.remove("bob~example.com", 3)
+	if _, ok := w.byUser["bob~example.com"]; ok {
+		t.Error("mailbox without watchers left in the map")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	m := testMessageService(t)
+	if _, err := m.Watch(context.Background()); !errors.Is(err, ErrUserNotAuthenticated) {
+		t.Fatalf("Watch() = %v, want %v", err, ErrUserNotAuthenticated)
+	}
+
+	ctx, cancel := context.WithCancel(identity.WithPrincipal(context.Background(),
+		&identity.Principal{AccountID: "u1", Addresses: []string{"ada~example.com"}}))
+	ch, err := m.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.watchers.publish("ada~example.com", []MailboxChange{{MessageID: "m1", Kind: ChangeKindInsert}})
+	if c := <-ch; c.MessageID != "m1" {
+		t.Errorf("watched %+v", c)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Error("change delivered after the watch ended")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel not closed when the context ended")
+	}
+	m.watchers.mu.Lock()
+	defer m.watchers.mu.Unlock()
+	if len(m.watchers.byUser) != 0 {
+		t.Errorf("watchers left after the watch ended: %v", m.watchers.byUser)
+	}
+}
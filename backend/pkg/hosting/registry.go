@@ -0,0 +1,139 @@
+// Package hosting keeps the registry of domains this server hosts. Each
+// domain has its own namespace of addresses and its own policy; its
+// certificates are kept by package certs.
+package hosting
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"quill/pkg/config"
+)
+
+// Policy holds the per-domain rules. Zero limits keep the server limits.
+type Policy struct {
+	// ClosedSignup reserves the domain's addresses for admins to assign.
+	ClosedSignup      bool
+	MaxMessageBytes   int64
+	DefaultQuotaBytes int64
+}
+
+// Domain is one hosted domain.
+type Domain struct {
+	Name   string
+	Policy Policy
+}
+
+// Registry is the set of hosted domains. It is safe for concurrent use and
+// can be replaced wholesale on reload.
+type Registry struct {
+	mu      sync.RWMutex
+	primary string
+	domains map[string]*Domain
+}
+
+// NewRegistry hosts domains; the first one is the primary domain.
+func NewRegistry(domains ...*Domain) (*Registry, error) {
+	r := &Registry{}
+	if err := r.Replace(domains...); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Replace swaps the hosted domains for domains, the first one primary.
+func (r *Registry) Replace(domains ...*Domain) error {
+	if len(domains) == 0 {
+		return fmt.Errorf("hosting: no domains")
+	}
+	byName := make(map[string]*Domain, len(domains))
+	for _, d := range domains {
+		name := strings.ToLower(d.Name)
+		if _, dup := byName[name]; dup {
+			return fmt.Errorf("hosting: domain %s registered twice", name)
+		}
+		byName[name] = d
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.primary = strings.ToLower(domains[0].Name)
+	r.domains = byName
+	return nil
+}
+
+// Primary is the domain used when no other one applies.
+func (r *Registry) Primary() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.primary
+}
+
+// Names lists the hosted domains, primary first and the rest sorted.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.domains))
+	for name := range r.domains {
+		if name != r.primary {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return append([]string{r.primary}, names...)
+}
+
+// Lookup returns the hosted domain called name.
+func (r *Registry) Lookup(name string) (*Domain, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	d, ok := r.domains[strings.ToLower(name)]
+	return d, ok
+}
+
+// Hosts reports whether name is hosted here.
+func (r *Registry) Hosts(name string) bool {
+	_, ok := r.Lookup(name)
+	return ok
+}
+
+// IsLocal reports whether addr belongs to a domain hosted here.
+func (r *Registry) IsLocal(addr string) bool {
+	return r.Hosts(DomainOf(addr))
+}
+
+// ForAddress returns the hosted domain of addr, falling back to the
+// primary domain for addresses hosted elsewhere.
+func (r *Registry) ForAddress(addr string) *Domain {
+	if d, ok := r.Lookup(DomainOf(addr)); ok {
+		return d
+	}
+	d, _ := r.Lookup(r.Primary())
+	return d
+}
+
+// DomainOf returns the domain part of a Quill address (name~domain).
+func DomainOf(addr string) string {
+	if i := strings.LastIndex(addr, "~"); i != -1 {
+		return strings.ToLower(addr[i+1:])
+	}
+	return ""
+}
+
+// FromConfig builds the hosted domains of the configuration.
+func FromConfig(domains []config.DomainConfig) []*Domain {
+	result := make([]*Domain, 0, len(domains))
+	for _, dc := range domains {
+		result = append(result, &Domain{
+			Name: dc.Name,
+			Policy: Policy{
+				ClosedSignup:      dc.Policy.Signup == "closed",
+				MaxMessageBytes:   dc.Policy.MaxMessageBytes,
+				DefaultQuotaBytes: dc.Policy.DefaultQuotaBytes,
+			},
+		})
+	}
+	return result
+}
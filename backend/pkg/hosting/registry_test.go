@@ -0,0 +1,77 @@
+package hosting
+
+import (
+	"reflect"
+	"testing"
+
+	"quill/pkg/config"
+)
+
+func TestRegistry(t *testing.T) {
+	r, err := NewRegistry(&Domain{Name: "Example.com"}, &Domain{Name: "zeta.example"}, &Domain{Name: "alpha.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.Names(), []string{"example.com", "alpha.example", "zeta.example"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Names = %v, want %v", got, want)
+	}
+	tests := []struct {
+		addr       string
+		local      bool
+		forAddress string
+	}{
+		{"ada~example.com", true, "Example.com"},
+		{"ada~EXAMPLE.com", true, "Example.com"},
+		{"ada~alpha.example", true, "alpha.example"},
+		{"odd~name~zeta.example", true, "zeta.example"},
+		{"eve~example.org", false, "Example.com"},
+		{"ada@example.com", false, "Example.com"},
+		{"example.com", false, "Example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := r.IsLocal(tt.addr); got != tt.local {
+				t.Errorf("IsLocal = %v, want %v", got, tt.local)
+			}
+			if got := r.ForAddress(tt.addr).Name; got != tt.forAddress {
+				t.Errorf("ForAddress = %q, want %q", got, tt.forAddress)
+			}
+		})
+	}
+}
+
+func TestRegistryReplace(t *testing.T) {
+	r, err := NewRegistry(&Domain{Name: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Replace(); err == nil {
+		t.Error("Replace with no domains succeeded")
+	}
+	if err := r.Replace(&Domain{Name: "example.net"}, &Domain{Name: "EXAMPLE.net"}); err == nil {
+		t.Error("Replace with a duplicate succeeded")
+	}
+	if r.Primary() != "example.com" || !r.Hosts("example.com") {
+		t.Error("a failed Replace changed the registry")
+	}
+	if err := r.Replace(&Domain{Name: "example.net"}); err != nil {
+		t.Fatal(err)
+	}
+	if r.Primary() != "example.net" || r.Hosts("example.com") {
+		t.Errorf("after Replace: primary %q, still hosting example.com: %v", r.Primary(), r.Hosts("example.com"))
+	}
+}
+
+func TestFromConfig(t *testing.T) {
+	got := FromConfig([]config.DomainConfig{
+		{Name: "example.com"},
+		{Name: "example.net", Policy: config.DomainPolicy{Signup: "closed", MaxMessageBytes: 10, DefaultQuotaBytes: 20}},
+	})
+	want := []*Domain{
+		{Name: "example.com"},
+		{Name: "example.net", Policy: Policy{ClosedSignup: true, MaxMessageBytes: 10, DefaultQuotaBytes: 20}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FromConfig = %+v, want %+v", got, want)
+	}
+}
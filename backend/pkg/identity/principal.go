@@ -0,0 +1,113 @@
+// Package identity carries the authenticated caller through a request.
+// Transports establish the Principal; services only ever read it.
+package identity
+
+import (
+	"context"
+	"time"
+)
+
+// AuthMethod records how a Principal proved its identity.
+type AuthMethod string
+
+const (
+	AuthMethodFirebase    AuthMethod = "firebase"
+	AuthMethodJWT         AuthMethod = "jwt"
+	AuthMethodAPIKey      AuthMethod = "api_key"
+	AuthMethodAppPassword AuthMethod = "app_password"
+	// AuthMethodPeer is another Quill server relaying mail, identified by
+	// its client certificate. AccountID holds the peer's domain.
+	AuthMethodPeer AuthMethod = "peer"
+	// AuthMethodSMTP is mail received by the SMTP gateway. AccountID holds
+	// the sender's domain, which only SPF and DKIM vouch for.
+	AuthMethodSMTP AuthMethod = "smtp"
+	// AuthMethodLocal is an operator working on the store directly from
+	// the server host, e.g. with quill-admin.
+	AuthMethodLocal AuthMethod = "local"
+)
+
+// Roles understood by the services. Every account has RoleUser.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Principal is the authenticated account behind a request.
+type Principal struct {
+	// AccountID is the users collection _id (the Firebase UID for
+	// Firebase accounts, the "sub" claim for JWTs).
+	AccountID string
+	// Addresses are the account's Quill addresses, primary first. Empty
+	// until the account is resolved against the user store.
+	Addresses []string
+	Roles     []string
+	Method    AuthMethod
+	// ExpiresAt is when the credential used expires; zero if it does not.
+	ExpiresAt time.Time
+}
+
+// Address returns the primary Quill address, or "" if unresolved.
+func (p *Principal) Address() string {
+	if len(p.Addresses) == 0 {
+		return ""
+	}
+	return p.Addresses[0]
+}
+
+// HasAddress reports whether addr belongs to the account.
+func (p *Principal) HasAddress(addr string) bool {
+	for _, a := range p.Addresses {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Interactive reports whether the principal signed in as a person rather
+// than with a long-lived secret handed to a script.
+func (p *Principal) Interactive() bool {
+	switch p.Method {
+	case AuthMethodAPIKey, AuthMethodAppPassword, AuthMethodPeer, AuthMethodSMTP:
+		return false
+	}
+	return true
+}
+
+// Relayed reports whether the principal is a server handing on mail it
+// did not write, whose list headers and Auto-Submitted marker are taken
+// as sent.
+func (p *Principal) Relayed() bool {
+	return p.Method == AuthMethodPeer || p.Method == AuthMethodSMTP
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying p.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the Principal stored in ctx, if any.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// AccountID is a shorthand for callers that only need the account ID.
+func AccountID(ctx context.Context) (string, bool) {
+	p, ok := FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	return p.AccountID, true
+}
@@ -0,0 +1,90 @@
+package identity
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPrincipalAddresses(t *testing.T) {
+	p := &Principal{Addresses: []string{"ada~example.com", "ada.l~example.com"}}
+	if got := p.Address(); got != "ada~example.com" {
+		t.Errorf("Address() = %q, want the primary address", got)
+	}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"ada~example.com", true},
+		{"ada.l~example.com", true},
+		{"Ada~example.com", false},
+		{"bob~example.com", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := p.HasAddress(tt.addr); got != tt.want {
+			t.Errorf("HasAddress(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+	if got := (&Principal{}).Address(); got != "" {
+		t.Errorf("unresolved Address() = %q, want empty", got)
+	}
+}
+
+func TestPrincipalInteractive(t *testing.T) {
+	tests := []struct {
+		method AuthMethod
+		want   bool
+	}{
+		{AuthMethodFirebase, true},
+		{AuthMethodJWT, true},
+		{AuthMethodLocal, true},
+		{AuthMethodAPIKey, false},
+		{AuthMethodAppPassword, false},
+		{AuthMethodPeer, false},
+		{AuthMethodSMTP, false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.method), func(t *testing.T) {
+			if got := (&Principal{Method: tt.method}).Interactive(); got != tt.want {
+				t.Errorf("Interactive() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrincipalRelayed(t *testing.T) {
+	tests := []struct {
+		method AuthMethod
+		want   bool
+	}{
+		{AuthMethodFirebase, false},
+		{AuthMethodAPIKey, false},
+		{AuthMethodLocal, false},
+		{AuthMethodPeer, true},
+		{AuthMethodSMTP, true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.method), func(t *testing.T) {
+			if got := (&Principal{Method: tt.method}).Relayed(); got != tt.want {
+				t.Errorf("Relayed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrincipalContext(t *testing.T) {
+	if _, ok := FromContext(context.Background()); ok {
+		t.Error("principal found in an empty context")
+	}
+	if _, ok := FromContext(WithPrincipal(context.Background(), nil)); ok {
+		t.Error("nil principal reported as present")
+	}
+	ctx := WithPrincipal(context.Background(), &Principal{AccountID: "u1", Roles: []string{RoleUser, RoleAdmin}})
+	p, ok := FromContext(ctx)
+	if !ok || !p.HasRole(RoleAdmin) {
+		t.Errorf("FromContext = %+v, %v", p, ok)
+	}
+	if id, ok := AccountID(ctx); !ok || id != "u1" {
+		t.Errorf("AccountID = %q, %v, want u1", id, ok)
+	}
+}
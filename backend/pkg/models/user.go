@@ -14,6 +14,24 @@ type User struct {
 	UserEmail     string    `bson:"userEmail" json:"userEmail"`
 	CreatedAt     time.Time `bson:"createdAt" json:"createdAt"` // Corrected "CreatedAt" to "createdAt" for common JSON/BSON convention
 	LastLogin     time.Time `bson:"lastLogin" json:"lastLogin"` // Corrected "LastLogin" to "lastLogin"
+
+	// Profile, editable by the user.
+	DisplayName string `bson:"displayName,omitempty" json:"displayName,omitempty"`
+	Signature   string `bson:"signature,omitempty" json:"signature,omitempty"`
+	Avatar      string `bson:"avatar,omitempty" json:"avatar,omitempty"` // https URL or data:image/... URI
+
+	// Deletion requested by the user; the account is purged after DeleteAfter
+	// unless the request is withdrawn first.
+	DeletionRequestedAt time.Time `bson:"deletionRequestedAt,omitempty" json:"deletionRequestedAt,omitempty"`
+	DeleteAfter         time.Time `bson:"deleteAfter,omitempty" json:"deleteAfter,omitempty"`
+
+	// Administrative state, managed through the admin API.
+	Roles         []string  `bson:"roles,omitempty" json:"roles,omitempty"` // in addition to the implicit "user"
+	Suspended     bool      `bson:"suspended" json:"suspended"`
+	SuspendReason string    `bson:"suspendReason,omitempty" json:"suspendReason,omitempty"`
+	SuspendedAt   time.Time `bson:"suspendedAt,omitempty" json:"suspendedAt,omitempty"`
+	QuotaBytes    int64     `bson:"quotaBytes,omitempty" json:"quotaBytes,omitempty"` // 0 means the server default
+	UpdatedAt     time.Time `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
 }
 
 // CreateUserRequest represents the request data for creating a new user
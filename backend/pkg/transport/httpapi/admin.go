@@ -0,0 +1,389 @@
+// Package httpapi serves Quill's HTTP endpoints next to the Quill protocol.
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"quill/pkg/domain"
+	"quill/pkg/models"
+)
+
+type authenticator interface {
+	Authenticate(ctx context.Context, token string) (context.Context, error)
+}
+
+type principalResolver interface {
+	ResolvePrincipal(ctx context.Context) (context.Context, error)
+}
+
+// sessionRevoker ends live protocol sessions, so suspension and credential
+// resets take effect immediately rather than at session expiry.
+type sessionRevoker interface {
+	RevokeUser(userID string)
+}
+
+// AdminHandler serves /admin/. Every route requires a bearer token of an
+// account with the admin role; the role itself is checked by the service.
+type AdminHandler struct {
+	auth     authenticator
+	resolver principalResolver
+	users    domain.UserService
+	sessions sessionRevoker
+	mux      *http.ServeMux
+}
+
+func NewAdminHandler(auth authenticator, resolver principalResolver, users domain.UserService, sessions sessionRevoker) *AdminHandler {
+	h := &AdminHandler{
+		auth:     auth,
+		resolver: resolver,
+		users:    users,
+		sessions: sessions,
+		mux:      http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /admin/users", h.listUsers)
+	h.mux.HandleFunc("POST /admin/users", h.createUser)
+	h.mux.HandleFunc("GET /admin/users/{id}", h.getUser)
+	h.mux.HandleFunc("PATCH /admin/users/{id}", h.updateUser)
+	h.mux.HandleFunc("DELETE /admin/users/{id}", h.deleteUser)
+	h.mux.HandleFunc("POST /admin/users/{id}/suspend", h.suspendUser)
+	h.mux.HandleFunc("POST /admin/users/{id}/unsuspend", h.unsuspendUser)
+	h.mux.HandleFunc("PUT /admin/users/{id}/roles", h.setRoles)
+	h.mux.HandleFunc("PUT /admin/users/{id}/quota", h.setQuota)
+	h.mux.HandleFunc("POST /admin/users/{id}/reset", h.resetCredentials)
+	h.mux.HandleFunc("GET /admin/users/{id}/aliases", h.listAliases)
+	h.mux.HandleFunc("POST /admin/users/{id}/aliases", h.addAlias)
+	h.mux.HandleFunc("GET /admin/aliases", h.listAliases)
+	h.mux.HandleFunc("DELETE /admin/aliases/{address}", h.removeAlias)
+	h.mux.HandleFunc("GET /admin/audit", h.auditLog)
+	return h
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, err := authenticateRequest(r, h.auth, h.resolver)
+	if err != nil {
+		log.Printf("[admin] authentication failed for %s: %v", r.RemoteAddr, err)
+		writeError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+	h.mux.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// authenticateRequest verifies the Authorization header and resolves the principal.
+func authenticateRequest(r *http.Request, auth authenticator, resolver principalResolver) (context.Context, error) {
+	token := strings.TrimSpace(r.Header.Get("Authorization"))
+	if token == "" {
+		return nil, errors.New("no Authorization header")
+	}
+	ctx, err := auth.Authenticate(r.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+	return resolver.ResolvePrincipal(ctx)
+}
+
+type userQueryResponse struct {
+	Users  []models.User `json:"users"`
+	Total  int           `json:"total"`
+	Limit  int           `json:"limit"`
+	Offset int           `json:"offset"`
+}
+
+func (h *AdminHandler) listUsers(w http.ResponseWriter, r *http.Request) {
+	q := domain.UserQuery{
+		Search: r.URL.Query().Get("q"),
+		Limit:  queryInt(r, "limit"),
+		Offset: queryInt(r, "offset"),
+	}
+	if v := r.URL.Query().Get("suspended"); v != "" {
+		suspended := v == "true"
+		q.Suspended = &suspended
+	}
+	users, total, err := h.users.ListUsers(r.Context(), q)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if users == nil {
+		users = []models.User{}
+	}
+	writeJSON(w, http.StatusOK, userQueryResponse{Users: users, Total: total, Limit: q.Limit, Offset: q.Offset})
+}
+
+func (h *AdminHandler) createUser(w http.ResponseWriter, r *http.Request) {
+	var req models.User
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	user, err := h.users.AdminCreateUser(r.Context(), req)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, user)
+}
+
+func (h *AdminHandler) getUser(w http.ResponseWriter, r *http.Request) {
+	user, err := h.users.GetUser(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+type updateUserRequest struct {
+	UserQuillMail *string `json:"userQuillMail"`
+	UserEmail     *string `json:"userEmail"`
+}
+
+func (h *AdminHandler) updateUser(w http.ResponseWriter, r *http.Request) {
+	var req updateUserRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	id := r.PathValue("id")
+	user, err := h.users.UpdateUser(r.Context(), id, domain.UserUpdate{
+		UserQuillMail: req.UserQuillMail,
+		UserEmail:     req.UserEmail,
+	})
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if req.UserQuillMail != nil {
+		// Sessions cache the addresses the user may send from.
+		h.sessions.RevokeUser(id)
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+func (h *AdminHandler) deleteUser(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := h.users.DeleteUser(r.Context(), id); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	h.sessions.RevokeUser(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type suspendRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (h *AdminHandler) suspendUser(w http.ResponseWriter, r *http.Request) {
+	var req suspendRequest
+	if r.ContentLength != 0 && !decodeBody(w, r, &req) {
+		return
+	}
+	id := r.PathValue("id")
+	user, err := h.users.SetSuspended(r.Context(), id, true, req.Reason)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	h.sessions.RevokeUser(id)
+	writeJSON(w, http.StatusOK, user)
+}
+
+func (h *AdminHandler) unsuspendUser(w http.ResponseWriter, r *http.Request) {
+	user, err := h.users.SetSuspended(r.Context(), r.PathValue("id"), false, "")
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+type rolesRequest struct {
+	Roles []string `json:"roles"`
+}
+
+func (h *AdminHandler) setRoles(w http.ResponseWriter, r *http.Request) {
+	var req rolesRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	id := r.PathValue("id")
+	user, err := h.users.SetRoles(r.Context(), id, req.Roles)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	// Sessions cache the roles they were created with.
+	h.sessions.RevokeUser(id)
+	writeJSON(w, http.StatusOK, user)
+}
+
+type quotaRequest struct {
+	QuotaBytes int64 `json:"quotaBytes"`
+}
+
+func (h *AdminHandler) setQuota(w http.ResponseWriter, r *http.Request) {
+	var req quotaRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	user, err := h.users.SetQuota(r.Context(), r.PathValue("id"), req.QuotaBytes)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+func (h *AdminHandler) resetCredentials(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	revoked, err := h.users.ResetCredentials(r.Context(), id)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	h.sessions.RevokeUser(id)
+	writeJSON(w, http.StatusOK, map[string]int{"revoked": revoked})
+}
+
+type aliasResponse struct {
+	Address   string    `json:"address"`
+	Target    string    `json:"target"`
+	Owner     string    `json:"owner"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func newAliasResponse(a domain.AddressRedirect) aliasResponse {
+	return aliasResponse{Address: a.Address, Target: a.Target, Owner: a.Owner, CreatedAt: a.CreatedAt}
+}
+
+// listAliases serves both the aliases of one user and, without {id}, all.
+func (h *AdminHandler) listAliases(w http.ResponseWriter, r *http.Request) {
+	aliases, err := h.users.ListAliases(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	resp := make([]aliasResponse, len(aliases))
+	for i, a := range aliases {
+		resp[i] = newAliasResponse(a)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"aliases": resp})
+}
+
+type aliasRequest struct {
+	Address string `json:"address"`
+}
+
+func (h *AdminHandler) addAlias(w http.ResponseWriter, r *http.Request) {
+	var req aliasRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	alias, err := h.users.AddAlias(r.Context(), r.PathValue("id"), req.Address)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newAliasResponse(*alias))
+}
+
+func (h *AdminHandler) removeAlias(w http.ResponseWriter, r *http.Request) {
+	if err := h.users.RemoveAlias(r.Context(), r.PathValue("address")); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type auditEntryResponse struct {
+	ID           string                 `json:"id"`
+	Actor        string                 `json:"actor"`
+	ActorAddress string                 `json:"actorAddress,omitempty"`
+	Action       string                 `json:"action"`
+	Target       string                 `json:"target"`
+	Details      map[string]interface{} `json:"details,omitempty"`
+	At           time.Time              `json:"at"`
+}
+
+func (h *AdminHandler) auditLog(w http.ResponseWriter, r *http.Request) {
+	entries, err := h.users.AuditLog(r.Context(), domain.AuditQuery{
+		Target: r.URL.Query().Get("target"),
+		Actor:  r.URL.Query().Get("actor"),
+		Limit:  queryInt(r, "limit"),
+	})
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	resp := make([]auditEntryResponse, len(entries))
+	for i, e := range entries {
+		resp[i] = auditEntryResponse{
+			ID:           e.ID,
+			Actor:        e.Actor,
+			ActorAddress: e.ActorAddress,
+			Action:       e.Action,
+			Target:       e.Target,
+			Details:      e.Details,
+			At:           e.At,
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"entries": resp})
+}
+
+// --- helpers --- //
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[httpapi] Error encoding response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// writeServiceError maps domain errors to HTTP status codes.
+func writeServiceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, domain.ErrUserNotAuthenticated):
+		writeError(w, http.StatusUnauthorized, err.Error())
+	case errors.Is(err, domain.ErrPermissionDenied):
+		writeError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, domain.ErrUserNotFound), errors.Is(err, domain.ErrExportNotFound),
+		errors.Is(err, domain.ErrDeletionNotRequested), errors.Is(err, domain.ErrAliasNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, domain.ErrExportNotReady):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, domain.ErrAccountSuspended):
+		writeError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, domain.ErrUserExists), errors.Is(err, domain.ErrAddressTaken):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, domain.ErrInvalidUser):
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		log.Printf("[httpapi] service error: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+	}
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func queryInt(r *http.Request, key string) int {
+	n, _ := strconv.Atoi(r.URL.Query().Get(key))
+	return n
+}
@@ -0,0 +1,182 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"quill/pkg/domain"
+	"quill/pkg/models"
+)
+
+// staticAuth accepts only the token "good".
+type staticAuth struct{}
+
+func (staticAuth) Authenticate(ctx context.Context, token string) (context.Context, error) {
+	if token != "Bearer good" {
+		return ctx, errors.New("bad token")
+	}
+	return ctx, nil
+}
+
+func (staticAuth) ResolvePrincipal(ctx context.Context) (context.Context, error) {
+	return ctx, nil
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	h := NewAdminHandler(staticAuth{}, staticAuth{}, nil, nil)
+	for _, header := range []string{"", "Bearer bad"} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: status %d, want %d", header, rec.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestWriteServiceError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{domain.ErrUserNotAuthenticated, http.StatusUnauthorized},
+		{domain.ErrPermissionDenied, http.StatusForbidden},
+		{domain.ErrAccountSuspended, http.StatusForbidden},
+		{domain.ErrUserNotFound, http.StatusNotFound},
+		{domain.ErrAliasNotFound, http.StatusNotFound},
+		{domain.ErrExportNotReady, http.StatusConflict},
+		{domain.ErrAddressTaken, http.StatusConflict},
+		{fmt.Errorf("%w: unknown role", domain.ErrInvalidUser), http.StatusBadRequest},
+		{errors.New("connection refused"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			writeServiceError(rec, tt.err)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+// aliasUsers keeps aliases in memory; other UserService methods panic.
+type aliasUsers struct {
+	domain.UserService
+	aliases map[string]domain.AddressRedirect
+}
+
+func (u *aliasUsers) ListAliases(_ context.Context, id string) ([]domain.AddressRedirect, error) {
+	var out []domain.AddressRedirect
+	for _, a := range u.aliases {
+		if id == "" || a.Owner == id {
+			out = append(out, a)
+		}
+	}
+	return out, nil
+}
+
+func (u *aliasUsers) AddAlias(_ context.Context, id, address string) (*domain.AddressRedirect, error) {
+	if _, ok := u.aliases[address]; ok {
+		return nil, domain.ErrAddressTaken
+	}
+	a := domain.AddressRedirect{Address: address, Target: id + "~example.com", Owner: id, Alias: true}
+	u.aliases[address] = a
+	return &a, nil
+}
+
+func (u *aliasUsers) RemoveAlias(_ context.Context, address string) error {
+	if _, ok := u.aliases[address]; !ok {
+		return domain.ErrAliasNotFound
+	}
+	delete(u.aliases, address)
+	return nil
+}
+
+func TestAdminAliases(t *testing.T) {
+	users := &aliasUsers{aliases: map[string]domain.AddressRedirect{
+		"ada2~example.com": {Address: "ada2~example.com", Target: "ada~example.com", Owner: "ada", Alias: true},
+	}}
+	h := NewAdminHandler(staticAuth{}, staticAuth{}, users, nil)
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"list all", http.MethodGet, "/admin/aliases", "", http.StatusOK},
+		{"list one user's", http.MethodGet, "/admin/users/ada/aliases", "", http.StatusOK},
+		{"add", http.MethodPost, "/admin/users/bob/aliases", `{"address":"bob2~example.com"}`, http.StatusCreated},
+		{"add taken", http.MethodPost, "/admin/users/bob/aliases", `{"address":"ada2~example.com"}`, http.StatusConflict},
+		{"add with unknown field", http.MethodPost, "/admin/users/bob/aliases", `{"alias":"bob3~example.com"}`, http.StatusBadRequest},
+		{"remove", http.MethodDelete, "/admin/aliases/bob2~example.com", "", http.StatusNoContent},
+		{"remove missing", http.MethodDelete, "/admin/aliases/bob2~example.com", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer good")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d (%s)", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+// updatingUsers accepts every update; other UserService methods panic.
+type updatingUsers struct {
+	domain.UserService
+}
+
+func (updatingUsers) UpdateUser(_ context.Context, id string, _ domain.UserUpdate) (*models.User, error) {
+	if id == "missing" {
+		return nil, domain.ErrUserNotFound
+	}
+	return &models.User{UsersUID: id}, nil
+}
+
+// recordRevoker records the users whose sessions were revoked.
+type recordRevoker struct {
+	revoked []string
+}
+
+func (r *recordRevoker) RevokeUser(userID string) {
+	r.revoked = append(r.revoked, userID)
+}
+
+func TestAdminUpdateUserRevokesOnAddressChange(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		body string
+		want []string
+	}{
+		{"address", "/admin/users/ada", `{"userQuillMail":"ada2~example.com"}`, []string{"ada"}},
+		{"email only", "/admin/users/ada", `{"userEmail":"ada@example.org"}`, nil},
+		{"failed update", "/admin/users/missing", `{"userQuillMail":"ada2~example.com"}`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessions := &recordRevoker{}
+			h := NewAdminHandler(staticAuth{}, staticAuth{}, updatingUsers{}, sessions)
+			req := httptest.NewRequest(http.MethodPatch, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer good")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			if !reflect.DeepEqual(sessions.revoked, tt.want) {
+				t.Errorf("revoked = %v, want %v", sessions.revoked, tt.want)
+			}
+		})
+	}
+}
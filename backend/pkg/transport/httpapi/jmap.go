@@ -0,0 +1,426 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"quill/pkg/domain"
+	"quill/pkg/identity"
+)
+
+// The JMAP-style API lets browsers use the mail operations of the Quill
+// protocol over plain HTTPS. Requests follow the JMAP envelope (RFC 8620):
+// a POST to /jmap carries a list of method calls, answered in order, and
+// arguments may refer to the results of earlier calls. The account is the
+// caller's Quill address; tokens are the same as for the Quill protocol.
+
+const (
+	jmapCapabilityCore = "urn:ietf:params:jmap:core"
+	jmapCapabilityMail = "urn:ietf:params:jmap:mail"
+
+	jmapMaxSizeRequest    = 50 << 20
+	jmapMaxCallsInRequest = 16
+	jmapMaxObjectsInGet   = 500
+	jmapMaxObjectsInSet   = 100
+)
+
+type jmapMessageService interface {
+	principalResolver
+	Send(ctx context.Context, req domain.DomainSendRequest) (domain.DomainSendResult, error)
+	Fetch(ctx context.Context, req domain.DomainFetchRequest) (domain.DomainFetchResult, error)
+	GetMessages(ctx context.Context, messageIDs []string) ([]domain.Message, error)
+	ListFolders(ctx context.Context) (domain.DomainFolderList, error)
+	MoveMessages(ctx context.Context, req domain.DomainMoveRequest) (int, error)
+	UpdateFlags(ctx context.Context, req domain.DomainFlagRequest) (int, error)
+	DeleteMessages(ctx context.Context, messageIDs []string) (int, error)
+	LimitsFor(addr string) domain.Limits
+}
+
+// relayer forwards the parts of a delivery addressed to other Quill servers.
+type relayer interface {
+	Relay(req domain.DomainSendRequest, result domain.DomainSendResult) error
+}
+
+// JMAPHandler serves the session resource at /.well-known/jmap and the API
+// at /jmap.
+type JMAPHandler struct {
+	auth     authenticator
+	messages jmapMessageService
+	relay    relayer
+	methods  map[string]jmapMethod
+	mux      *http.ServeMux
+}
+
+type jmapMethod func(st *jmapState, args json.RawMessage) (interface{}, *jmapError)
+
+func NewJMAPHandler(auth authenticator, messages jmapMessageService, relay relayer) *JMAPHandler {
+	h := &JMAPHandler{
+		auth:     auth,
+		messages: messages,
+		relay:    relay,
+		mux:      http.NewServeMux(),
+	}
+	h.methods = map[string]jmapMethod{
+		"Core/echo":   h.coreEcho,
+		"Mailbox/get": h.mailboxGet,
+		"Thread/get":  h.threadGet,
+		"Email/query": h.emailQuery,
+		"Email/get":   h.emailGet,
+		"Email/set":   h.emailSet,
+	}
+	h.mux.HandleFunc("GET /.well-known/jmap", h.session)
+	h.mux.HandleFunc("POST /jmap", h.api)
+	return h
+}
+
+func (h *JMAPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, err := authenticateRequest(r, h.auth, h.messages)
+	if err != nil {
+		log.Printf("[jmap] authentication failed for %s: %v", r.RemoteAddr, err)
+		writeError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+	h.mux.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// accountID is the caller's Quill address, which names their only account.
+func accountID(ctx context.Context) string {
+	if p, ok := identity.FromContext(ctx); ok {
+		return p.Address()
+	}
+	return ""
+}
+
+func (h *JMAPHandler) session(w http.ResponseWriter, r *http.Request) {
+	account := accountID(r.Context())
+	if account == "" {
+		writeError(w, http.StatusForbidden, "account has no Quill address yet")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"capabilities": map[string]interface{}{
+			jmapCapabilityCore: map[string]interface{}{
+				"maxSizeRequest":        jmapMaxSizeRequest,
+				"maxCallsInRequest":     jmapMaxCallsInRequest,
+				"maxObjectsInGet":       jmapMaxObjectsInGet,
+				"maxObjectsInSet":       jmapMaxObjectsInSet,
+				"maxConcurrentRequests": 4,
+				"collationAlgorithms":   []string{},
+			},
+			jmapCapabilityMail: map[string]interface{}{},
+		},
+		"accounts": map[string]interface{}{
+			account: map[string]interface{}{
+				"name":       account,
+				"isPersonal": true,
+				"isReadOnly": false,
+				"accountCapabilities": map[string]interface{}{
+					jmapCapabilityMail: map[string]interface{}{},
+				},
+			},
+		},
+		"primaryAccounts": map[string]string{jmapCapabilityMail: account},
+		"username":        account,
+		"apiUrl":          "/jmap",
+		"state":           "0",
+	})
+}
+
+// jmapInvocation is a method call or response: [name, arguments, call ID].
+type jmapInvocation struct {
+	Name   string
+	Args   json.RawMessage
+	CallID string
+}
+
+func (inv *jmapInvocation) UnmarshalJSON(data []byte) error {
+	var parts []json.RawMessage
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	if len(parts) != 3 {
+		return fmt.Errorf("invocation must have 3 elements, not %d", len(parts))
+	}
+	if err := json.Unmarshal(parts[0], &inv.Name); err != nil {
+		return err
+	}
+	inv.Args = parts[1]
+	return json.Unmarshal(parts[2], &inv.CallID)
+}
+
+func (inv jmapInvocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{inv.Name, inv.Args, inv.CallID})
+}
+
+type jmapRequest struct {
+	Using       []string          `json:"using"`
+	MethodCalls []jmapInvocation  `json:"methodCalls"`
+	CreatedIDs  map[string]string `json:"createdIds,omitempty"`
+}
+
+type jmapResponse struct {
+	MethodResponses []jmapInvocation  `json:"methodResponses"`
+	CreatedIDs      map[string]string `json:"createdIds,omitempty"`
+	SessionState    string            `json:"sessionState"`
+}
+
+// jmapError is a method-level error or a SetError.
+type jmapError struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Properties  []string `json:"properties,omitempty"`
+}
+
+func invalidArguments(format string, a ...interface{}) *jmapError {
+	return &jmapError{Type: "invalidArguments", Description: fmt.Sprintf(format, a...)}
+}
+
+// writeProblem answers a request that could not be processed at all with
+// an RFC 7807 problem.
+func writeProblem(w http.ResponseWriter, kind, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusBadRequest)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":   "urn:ietf:params:jmap:error:" + kind,
+		"status": http.StatusBadRequest,
+		"detail": detail,
+	}); err != nil {
+		log.Printf("[jmap] Error encoding problem: %v", err)
+	}
+}
+
+// jmapState is what the calls of one request share: the caller, the
+// messages loaded so far and the IDs of messages created by Email/set.
+type jmapState struct {
+	ctx       context.Context
+	account   string
+	messages  map[string]domain.Message
+	folders   *domain.DomainFolderList
+	created   map[string]string
+	responses []jmapInvocation
+}
+
+func (h *JMAPHandler) api(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, jmapMaxSizeRequest)
+	var req jmapRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, "notRequest", "invalid request body: "+err.Error())
+		return
+	}
+	for _, c := range []string{jmapCapabilityCore, jmapCapabilityMail} {
+		if !containsString(req.Using, c) {
+			writeProblem(w, "unknownCapability", fmt.Sprintf("using must include %q", c))
+			return
+		}
+	}
+	if len(req.MethodCalls) > jmapMaxCallsInRequest {
+		writeProblem(w, "limit", fmt.Sprintf("at most %d method calls per request", jmapMaxCallsInRequest))
+		return
+	}
+
+	st := &jmapState{
+		ctx:      r.Context(),
+		account:  accountID(r.Context()),
+		messages: make(map[string]domain.Message),
+		created:  make(map[string]string),
+	}
+	for k, v := range req.CreatedIDs {
+		st.created[k] = v
+	}
+	if st.account == "" {
+		writeError(w, http.StatusForbidden, "account has no Quill address yet")
+		return
+	}
+
+	for _, call := range req.MethodCalls {
+		result, jerr := h.call(st, call)
+		if jerr != nil {
+			st.respond("error", jerr, call.CallID)
+			continue
+		}
+		st.respond(call.Name, result, call.CallID)
+	}
+
+	resp := jmapResponse{
+		MethodResponses: st.responses,
+		SessionState:    "0",
+	}
+	if len(req.CreatedIDs) > 0 || len(st.created) > 0 {
+		resp.CreatedIDs = st.created
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *JMAPHandler) call(st *jmapState, call jmapInvocation) (interface{}, *jmapError) {
+	method, ok := h.methods[call.Name]
+	if !ok {
+		return nil, &jmapError{Type: "unknownMethod", Description: call.Name}
+	}
+	args, jerr := st.resolveReferences(call.Args)
+	if jerr != nil {
+		return nil, jerr
+	}
+	var common struct {
+		AccountID string `json:"accountId"`
+	}
+	if err := json.Unmarshal(args, &common); err != nil {
+		return nil, invalidArguments("%v", err)
+	}
+	if common.AccountID != "" && common.AccountID != st.account && call.Name != "Core/echo" {
+		return nil, &jmapError{Type: "accountNotFound"}
+	}
+	return method(st, args)
+}
+
+func (st *jmapState) respond(name string, result interface{}, callID string) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("[jmap] Error encoding %s response: %v", name, err)
+		name = "error"
+		data, _ = json.Marshal(jmapError{Type: "serverFail"})
+	}
+	st.responses = append(st.responses, jmapInvocation{Name: name, Args: data, CallID: callID})
+}
+
+// jmapResultReference points into the response of an earlier call.
+type jmapResultReference struct {
+	ResultOf string `json:"resultOf"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+// resolveReferences replaces every "#name" argument with the value its
+// result reference points at.
+func (st *jmapState) resolveReferences(raw json.RawMessage) (json.RawMessage, *jmapError) {
+	var args map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("arguments must be an object")
+	}
+	changed := false
+	for key, value := range args {
+		if !strings.HasPrefix(key, "#") {
+			continue
+		}
+		name := key[1:]
+		if _, ok := args[name]; ok {
+			return nil, invalidArguments("both %q and %q given", name, key)
+		}
+		var ref jmapResultReference
+		if err := json.Unmarshal(value, &ref); err != nil {
+			return nil, &jmapError{Type: "invalidResultReference", Description: err.Error()}
+		}
+		resolved, err := st.lookupReference(ref)
+		if err != nil {
+			return nil, &jmapError{Type: "invalidResultReference", Description: err.Error()}
+		}
+		delete(args, key)
+		args[name] = resolved
+		changed = true
+	}
+	if !changed {
+		return raw, nil
+	}
+	resolved, err := json.Marshal(args)
+	if err != nil {
+		return nil, invalidArguments("%v", err)
+	}
+	return resolved, nil
+}
+
+func (st *jmapState) lookupReference(ref jmapResultReference) (json.RawMessage, error) {
+	for _, resp := range st.responses {
+		if resp.CallID != ref.ResultOf {
+			continue
+		}
+		if resp.Name != ref.Name {
+			return nil, fmt.Errorf("call %s answered %s, not %s", ref.ResultOf, resp.Name, ref.Name)
+		}
+		var doc interface{}
+		if err := json.Unmarshal(resp.Args, &doc); err != nil {
+			return nil, err
+		}
+		value, err := evalPointer(doc, ref.Path)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(value)
+	}
+	return nil, fmt.Errorf("no response for call %q", ref.ResultOf)
+}
+
+// evalPointer evaluates a JSON pointer (RFC 6901) extended with "*", which
+// applies the rest of the path to every element of an array and flattens
+// the results (RFC 8620 section 3.7).
+func evalPointer(doc interface{}, path string) (interface{}, error) {
+	if path == "" {
+		return doc, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("path %q must start with /", path)
+	}
+	return walkPointer(doc, strings.Split(path[1:], "/"))
+}
+
+func walkPointer(v interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return v, nil
+	}
+	token := strings.ReplaceAll(strings.ReplaceAll(tokens[0], "~1", "/"), "~0", "~")
+	switch node := v.(type) {
+	case map[string]interface{}:
+		child, ok := node[token]
+		if !ok {
+			return nil, fmt.Errorf("no property %q", token)
+		}
+		return walkPointer(child, tokens[1:])
+	case []interface{}:
+		if token == "*" {
+			out := []interface{}{}
+			for _, item := range node {
+				r, err := walkPointer(item, tokens[1:])
+				if err != nil {
+					return nil, err
+				}
+				if list, ok := r.([]interface{}); ok {
+					out = append(out, list...)
+				} else {
+					out = append(out, r)
+				}
+			}
+			return out, nil
+		}
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i >= len(node) {
+			return nil, fmt.Errorf("no array element %q", token)
+		}
+		return walkPointer(node[i], tokens[1:])
+	}
+	return nil, fmt.Errorf("cannot descend into %q", token)
+}
+
+// resolveID maps a "#creationId" to the ID of the message created under it.
+func (st *jmapState) resolveID(id string) (string, bool) {
+	if !strings.HasPrefix(id, "#") {
+		return id, true
+	}
+	created, ok := st.created[id[1:]]
+	return created, ok
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *JMAPHandler) coreEcho(st *jmapState, args json.RawMessage) (interface{}, *jmapError) {
+	return args, nil
+}
@@ -0,0 +1,868 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"quill/pkg/domain"
+)
+
+// Quill flags and the JMAP keywords they are shown as. Read state is the
+// $seen keyword; other flags appear under their own name.
+var keywordFlags = map[string]string{
+	"$flagged":  "starred",
+	"$answered": "answered",
+	"$draft":    "draft",
+}
+
+const keywordSeen = "$seen"
+
+func keywordsOf(m domain.Message) map[string]bool {
+	keywords := make(map[string]bool)
+	if m.Read {
+		keywords[keywordSeen] = true
+	}
+	for _, f := range m.Flags {
+		keywords[flagKeyword(f)] = true
+	}
+	return keywords
+}
+
+func flagKeyword(flag string) string {
+	for k, f := range keywordFlags {
+		if strings.EqualFold(flag, f) {
+			return k
+		}
+	}
+	return flag
+}
+
+func keywordFlag(keyword string) string {
+	if f, ok := keywordFlags[strings.ToLower(keyword)]; ok {
+		return f
+	}
+	return keyword
+}
+
+// loadFolders lists the caller's folders once per request.
+func (h *JMAPHandler) loadFolders(st *jmapState) (*domain.DomainFolderList, error) {
+	if st.folders != nil {
+		return st.folders, nil
+	}
+	list, err := h.messages.ListFolders(st.ctx)
+	if err != nil {
+		return nil, err
+	}
+	st.folders = &list
+	return st.folders, nil
+}
+
+// mailboxIDs maps folder paths to mailbox IDs.
+func (h *JMAPHandler) mailboxIDs(st *jmapState) (map[string]string, error) {
+	list, err := h.loadFolders(st)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]string, len(list.Folders))
+	for _, f := range list.Folders {
+		ids[f.Path] = f.ID
+	}
+	return ids, nil
+}
+
+// folderOf returns the folder path of a mailbox ID.
+func (h *JMAPHandler) folderOf(st *jmapState, mailboxID string) (string, bool, error) {
+	list, err := h.loadFolders(st)
+	if err != nil {
+		return "", false, err
+	}
+	for _, f := range list.Folders {
+		if f.ID == mailboxID {
+			return f.Path, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// loadMessages returns the caller's messages among ids, loading those not
+// seen earlier in the request.
+func (h *JMAPHandler) loadMessages(st *jmapState, ids []string) (map[string]domain.Message, error) {
+	var missing []string
+	for _, id := range ids {
+		if _, ok := st.messages[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		messages, err := h.messages.GetMessages(st.ctx, missing)
+		if err != nil {
+			return nil, err
+		}
+		st.remember(messages)
+	}
+	found := make(map[string]domain.Message, len(ids))
+	for _, id := range ids {
+		if m, ok := st.messages[id]; ok {
+			found[id] = m
+		}
+	}
+	return found, nil
+}
+
+func (st *jmapState) remember(messages []domain.Message) {
+	for _, m := range messages {
+		st.messages[m.MessageID] = m
+	}
+}
+
+// unique drops repeated IDs: a /get answers each ID only once.
+func unique(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	out := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+func serverFail(err error) *jmapError {
+	log.Printf("[jmap] ERROR: %v", err)
+	return &jmapError{Type: "serverFail"}
+}
+
+// Mailbox/get
+
+type mailboxGetArgs struct {
+	AccountID  string   `json:"accountId"`
+	IDs        []string `json:"ids"`
+	Properties []string `json:"properties"`
+}
+
+type jmapMailbox struct {
+	ID           string  `json:"id"`
+	Name         string  `json:"name"`
+	ParentID     *string `json:"parentId"`
+	Role         *string `json:"role"`
+	SortOrder    int     `json:"sortOrder"`
+	TotalEmails  int     `json:"totalEmails"`
+	UnreadEmails int     `json:"unreadEmails"`
+	IsSubscribed bool    `json:"isSubscribed"`
+}
+
+func (h *JMAPHandler) mailboxGet(st *jmapState, raw json.RawMessage) (interface{}, *jmapError) {
+	var args mailboxGetArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("%v", err)
+	}
+	list, err := h.loadFolders(st)
+	if err != nil {
+		return nil, serverFail(err)
+	}
+
+	byID := make(map[string]jmapMailbox, len(list.Folders))
+	all := make([]jmapMailbox, 0, len(list.Folders))
+	for i, f := range list.Folders {
+		mb := jmapMailbox{
+			ID:           f.ID,
+			Name:         f.Name,
+			SortOrder:    i,
+			TotalEmails:  f.Total,
+			UnreadEmails: f.Unread,
+			IsSubscribed: true,
+		}
+		if f.ParentID != "" {
+			parent := f.ParentID
+			mb.ParentID = &parent
+		}
+		switch f.Path {
+		case domain.FolderInbox, domain.FolderSent:
+			role := f.Path
+			mb.Role = &role
+		}
+		byID[f.ID] = mb
+		all = append(all, mb)
+	}
+
+	resp := map[string]interface{}{
+		"accountId": st.account,
+		"state":     "0",
+		"notFound":  []string{},
+	}
+	if args.IDs == nil {
+		resp["list"] = all
+		return resp, nil
+	}
+	if len(args.IDs) > jmapMaxObjectsInGet {
+		return nil, &jmapError{Type: "requestTooLarge"}
+	}
+	found := []jmapMailbox{}
+	notFound := []string{}
+	for _, id := range unique(args.IDs) {
+		if mb, ok := byID[id]; ok {
+			found = append(found, mb)
+		} else {
+			notFound = append(notFound, id)
+		}
+	}
+	resp["list"] = found
+	resp["notFound"] = notFound
+	return resp, nil
+}
+
+// Email/query
+
+type emailQueryArgs struct {
+	AccountID string `json:"accountId"`
+	Filter    *struct {
+		InMailbox string `json:"inMailbox"`
+		InThread  string `json:"inThread"`
+		HasLabel  string `json:"hasLabel"`
+	} `json:"filter"`
+	Position       int  `json:"position"`
+	Limit          *int `json:"limit"`
+	CalculateTotal bool `json:"calculateTotal"`
+}
+
+// emailQuery lists message IDs newest first. It filters on one mailbox,
+// thread or label at a time; without a filter it lists the inbox.
+func (h *JMAPHandler) emailQuery(st *jmapState, raw json.RawMessage) (interface{}, *jmapError) {
+	var args emailQueryArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("%v", err)
+	}
+	if args.Position < 0 {
+		return nil, invalidArguments("negative positions are not supported")
+	}
+	limit := 50
+	if args.Limit != nil {
+		if *args.Limit < 0 {
+			return nil, invalidArguments("limit must not be negative")
+		}
+		limit = min(*args.Limit, jmapMaxObjectsInGet)
+	}
+
+	folder := domain.FolderInbox
+	req := domain.DomainFetchRequest{Mode: domain.FetchModeFolder, Folder: &folder, Limit: &limit, Offset: &args.Position}
+	if f := args.Filter; f != nil {
+		set := 0
+		for _, v := range []string{f.InMailbox, f.InThread, f.HasLabel} {
+			if v != "" {
+				set++
+			}
+		}
+		if set > 1 {
+			return nil, &jmapError{Type: "unsupportedFilter", Description: "filter on one of inMailbox, inThread or hasLabel"}
+		}
+		switch {
+		case f.InMailbox != "":
+			path, ok, err := h.folderOf(st, f.InMailbox)
+			if err != nil {
+				return nil, serverFail(err)
+			}
+			if !ok {
+				return nil, &jmapError{Type: "unsupportedFilter", Description: "no mailbox " + f.InMailbox}
+			}
+			folder = path
+		case f.InThread != "":
+			thread := f.InThread
+			req = domain.DomainFetchRequest{Mode: domain.FetchModeThread, ThreadID: &thread, Limit: &limit, Offset: &args.Position}
+		case f.HasLabel != "":
+			label := f.HasLabel
+			req = domain.DomainFetchRequest{Mode: domain.FetchModeLabel, Label: &label, Limit: &limit, Offset: &args.Position}
+		}
+	}
+
+	result, err := h.messages.Fetch(st.ctx, req)
+	if err != nil {
+		return nil, serverFail(err)
+	}
+	st.remember(result.Messages)
+	ids := make([]string, 0, len(result.Messages))
+	for _, m := range result.Messages {
+		ids = append(ids, m.MessageID)
+	}
+	resp := map[string]interface{}{
+		"accountId":           st.account,
+		"queryState":          strconv.FormatInt(result.ModSeq, 10),
+		"canCalculateChanges": false,
+		"position":            args.Position,
+		"ids":                 ids,
+	}
+	if args.CalculateTotal {
+		resp["total"] = result.Total
+	}
+	return resp, nil
+}
+
+// Email/get
+
+type emailGetArgs struct {
+	AccountID  string   `json:"accountId"`
+	IDs        []string `json:"ids"`
+	Properties []string `json:"properties"`
+}
+
+type jmapAddress struct {
+	Name  *string `json:"name"`
+	Email string  `json:"email"`
+}
+
+type jmapBodyPart struct {
+	PartID string `json:"partId"`
+	Type   string `json:"type"`
+}
+
+type jmapBodyValue struct {
+	Value             string `json:"value"`
+	IsEncodingProblem bool   `json:"isEncodingProblem"`
+	IsTruncated       bool   `json:"isTruncated"`
+}
+
+type jmapAttachment struct {
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	ContentBase64 string `json:"contentBase64"`
+}
+
+func addresses(list ...string) []jmapAddress {
+	out := make([]jmapAddress, 0, len(list))
+	for _, a := range list {
+		if a != "" {
+			out = append(out, jmapAddress{Email: a})
+		}
+	}
+	return out
+}
+
+// previewLength bounds the plain-text preview, as RFC 8621 does.
+const previewLength = 256
+
+// emailObject renders a message with all Email properties.
+func emailObject(m domain.Message, mailboxIDs map[string]string, owner string) map[string]interface{} {
+	mailboxes := map[string]bool{}
+	if id, ok := mailboxIDs[m.Folder]; ok {
+		mailboxes[id] = true
+	}
+	labels := m.Labels
+	if labels == nil {
+		labels = []string{}
+	}
+
+	textBody := []jmapBodyPart{}
+	htmlBody := []jmapBodyPart{}
+	values := map[string]jmapBodyValue{}
+	preview := ""
+	for i, c := range m.Body.Content {
+		part := jmapBodyPart{PartID: strconv.Itoa(i + 1), Type: string(c.Type)}
+		values[part.PartID] = jmapBodyValue{Value: c.Value}
+		if c.Type == domain.ContentTypeHTML {
+			htmlBody = append(htmlBody, part)
+			continue
+		}
+		textBody = append(textBody, part)
+		if preview == "" {
+			preview = strings.Join(strings.Fields(c.Value), " ")
+			if r := []rune(preview); len(r) > previewLength {
+				preview = string(r[:previewLength])
+			}
+		}
+	}
+	attachments := make([]jmapAttachment, 0, len(m.Attachments))
+	for _, a := range m.Attachments {
+		attachments = append(attachments, jmapAttachment{Name: a.Filename, Type: a.Mimetype, ContentBase64: a.URL})
+	}
+
+	email := map[string]interface{}{
+		"id":            m.MessageID,
+		"threadId":      m.ThreadID,
+		"mailboxIds":    mailboxes,
+		"keywords":      keywordsOf(m),
+		"labels":        labels,
+		"from":          addresses(m.From),
+		"to":            addresses(m.To...),
+		"cc":            addresses(m.CC...),
+		"bcc":           []jmapAddress{},
+		"replyTo":       addresses(m.ReplyTo),
+		"subject":       m.Subject,
+		"sentAt":        m.SentAt.UTC().Format(time.RFC3339),
+		"receivedAt":    m.SentAt.UTC().Format(time.RFC3339),
+		"preview":       preview,
+		"bodyValues":    values,
+		"textBody":      textBody,
+		"htmlBody":      htmlBody,
+		"attachments":   attachments,
+		"hasAttachment": len(attachments) > 0,
+	}
+	// Bcc recipients are only shown in the sender's own copy.
+	if m.From == owner {
+		email["bcc"] = addresses(m.BCC...)
+	}
+	if m.ListID != "" {
+		email["listId"] = m.ListID
+	}
+	return email
+}
+
+func (h *JMAPHandler) emailGet(st *jmapState, raw json.RawMessage) (interface{}, *jmapError) {
+	var args emailGetArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("%v", err)
+	}
+	if args.IDs == nil {
+		return nil, &jmapError{Type: "requestTooLarge", Description: "ids must be given"}
+	}
+	if len(args.IDs) > jmapMaxObjectsInGet {
+		return nil, &jmapError{Type: "requestTooLarge"}
+	}
+
+	ids := make([]string, 0, len(args.IDs))
+	notFound := []string{}
+	for _, id := range unique(args.IDs) {
+		if resolved, ok := st.resolveID(id); ok {
+			ids = append(ids, resolved)
+		} else {
+			notFound = append(notFound, id)
+		}
+	}
+	messages, err := h.loadMessages(st, ids)
+	if err != nil {
+		return nil, serverFail(err)
+	}
+	mailboxIDs, err := h.mailboxIDs(st)
+	if err != nil {
+		return nil, serverFail(err)
+	}
+
+	list := []map[string]interface{}{}
+	for _, id := range ids {
+		m, ok := messages[id]
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+		email := emailObject(m, mailboxIDs, st.account)
+		if args.Properties != nil {
+			picked := map[string]interface{}{"id": email["id"]}
+			for _, p := range args.Properties {
+				if v, ok := email[p]; ok {
+					picked[p] = v
+				}
+			}
+			email = picked
+		}
+		list = append(list, email)
+	}
+	return map[string]interface{}{
+		"accountId": st.account,
+		"state":     "0",
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+// Thread/get
+
+type threadGetArgs struct {
+	AccountID string   `json:"accountId"`
+	IDs       []string `json:"ids"`
+}
+
+func (h *JMAPHandler) threadGet(st *jmapState, raw json.RawMessage) (interface{}, *jmapError) {
+	var args threadGetArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("%v", err)
+	}
+	if args.IDs == nil {
+		return nil, &jmapError{Type: "requestTooLarge", Description: "ids must be given"}
+	}
+	if len(args.IDs) > jmapMaxObjectsInGet {
+		return nil, &jmapError{Type: "requestTooLarge"}
+	}
+
+	list := []map[string]interface{}{}
+	notFound := []string{}
+	for _, id := range unique(args.IDs) {
+		thread := id
+		limit := jmapMaxObjectsInGet
+		result, err := h.messages.Fetch(st.ctx, domain.DomainFetchRequest{Mode: domain.FetchModeThread, ThreadID: &thread, Limit: &limit})
+		if err != nil {
+			return nil, serverFail(err)
+		}
+		if len(result.Messages) == 0 {
+			notFound = append(notFound, id)
+			continue
+		}
+		st.remember(result.Messages)
+		// Oldest first; a message to oneself is in the thread only once.
+		messages := result.Messages
+		sort.SliceStable(messages, func(i, j int) bool { return messages[i].SentAt.Before(messages[j].SentAt) })
+		seen := make(map[string]bool, len(messages))
+		emailIDs := make([]string, 0, len(messages))
+		for _, m := range messages {
+			if !seen[m.MessageID] {
+				seen[m.MessageID] = true
+				emailIDs = append(emailIDs, m.MessageID)
+			}
+		}
+		list = append(list, map[string]interface{}{"id": id, "emailIds": emailIDs})
+	}
+	return map[string]interface{}{
+		"accountId": st.account,
+		"state":     "0",
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+// Email/set
+
+type emailSetArgs struct {
+	AccountID string                                `json:"accountId"`
+	Create    map[string]emailCreate                `json:"create"`
+	Update    map[string]map[string]json.RawMessage `json:"update"`
+	Destroy   []string                              `json:"destroy"`
+}
+
+// emailCreate is a message to send. Quill has no drafts, so creating an
+// email sends it; threadId continues an existing thread.
+type emailCreate struct {
+	From        []jmapAddress            `json:"from"`
+	To          []jmapAddress            `json:"to"`
+	CC          []jmapAddress            `json:"cc"`
+	BCC         []jmapAddress            `json:"bcc"`
+	Subject     string                   `json:"subject"`
+	ThreadID    string                   `json:"threadId"`
+	BodyValues  map[string]jmapBodyValue `json:"bodyValues"`
+	TextBody    []jmapBodyPart           `json:"textBody"`
+	HTMLBody    []jmapBodyPart           `json:"htmlBody"`
+	Attachments []jmapAttachment         `json:"attachments"`
+	// Quill message options.
+	ExpiresInSeconds int  `json:"expiresInSeconds"`
+	OneTime          bool `json:"oneTime"`
+}
+
+func emails(list []jmapAddress) []string {
+	out := make([]string, 0, len(list))
+	for _, a := range list {
+		out = append(out, a.Email)
+	}
+	return out
+}
+
+func (h *JMAPHandler) emailSet(st *jmapState, raw json.RawMessage) (interface{}, *jmapError) {
+	var args emailSetArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, invalidArguments("%v", err)
+	}
+	if len(args.Create)+len(args.Update)+len(args.Destroy) > jmapMaxObjectsInSet {
+		return nil, &jmapError{Type: "requestTooLarge"}
+	}
+
+	resp := map[string]interface{}{
+		"accountId":    st.account,
+		"newState":     "0",
+		"created":      nil,
+		"notCreated":   nil,
+		"updated":      nil,
+		"notUpdated":   nil,
+		"destroyed":    nil,
+		"notDestroyed": nil,
+	}
+
+	// Create in a stable order so sends are reproducible.
+	creationIDs := make([]string, 0, len(args.Create))
+	for cid := range args.Create {
+		creationIDs = append(creationIDs, cid)
+	}
+	sort.Strings(creationIDs)
+	created := map[string]interface{}{}
+	notCreated := map[string]*jmapError{}
+	for _, cid := range creationIDs {
+		obj, serr := h.createEmail(st, args.Create[cid])
+		if serr != nil {
+			notCreated[cid] = serr
+			continue
+		}
+		st.created[cid] = obj["id"].(string)
+		created[cid] = obj
+	}
+	if len(created) > 0 {
+		resp["created"] = created
+	}
+	if len(notCreated) > 0 {
+		resp["notCreated"] = notCreated
+	}
+
+	if len(args.Update) > 0 {
+		updated := map[string]interface{}{}
+		notUpdated := map[string]*jmapError{}
+		ids := make([]string, 0, len(args.Update))
+		for id := range args.Update {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			resolved, ok := st.resolveID(id)
+			if !ok {
+				notUpdated[id] = &jmapError{Type: "notFound"}
+				continue
+			}
+			if serr := h.updateEmail(st, resolved, args.Update[id]); serr != nil {
+				notUpdated[id] = serr
+				continue
+			}
+			updated[id] = nil
+		}
+		if len(updated) > 0 {
+			resp["updated"] = updated
+		}
+		if len(notUpdated) > 0 {
+			resp["notUpdated"] = notUpdated
+		}
+	}
+
+	if len(args.Destroy) > 0 {
+		destroyed, notDestroyed, jerr := h.destroyEmails(st, args.Destroy)
+		if jerr != nil {
+			return nil, jerr
+		}
+		if len(destroyed) > 0 {
+			resp["destroyed"] = destroyed
+		}
+		if len(notDestroyed) > 0 {
+			resp["notDestroyed"] = notDestroyed
+		}
+	}
+	return resp, nil
+}
+
+// createEmail sends a message from the caller and relays it to recipients
+// on other Quill servers.
+func (h *JMAPHandler) createEmail(st *jmapState, c emailCreate) (map[string]interface{}, *jmapError) {
+	if len(c.From) > 1 || (len(c.From) == 1 && c.From[0].Email != st.account) {
+		return nil, &jmapError{Type: "invalidProperties", Description: "mail can only be sent from " + st.account, Properties: []string{"from"}}
+	}
+	if len(c.To)+len(c.CC)+len(c.BCC) == 0 {
+		return nil, &jmapError{Type: "invalidProperties", Description: "no recipients", Properties: []string{"to"}}
+	}
+
+	var contents []domain.Content
+	for _, parts := range []struct {
+		property string
+		list     []jmapBodyPart
+		kind     domain.ContentType
+	}{
+		{"textBody", c.TextBody, domain.ContentTypePlainText},
+		{"htmlBody", c.HTMLBody, domain.ContentTypeHTML},
+	} {
+		for _, p := range parts.list {
+			value, ok := c.BodyValues[p.PartID]
+			if !ok {
+				return nil, &jmapError{Type: "invalidProperties", Description: "no body value for part " + p.PartID, Properties: []string{parts.property}}
+			}
+			contents = append(contents, domain.Content{Type: parts.kind, Value: value.Value})
+		}
+	}
+	atts := make([]domain.Attachment, 0, len(c.Attachments))
+	for _, a := range c.Attachments {
+		atts = append(atts, domain.Attachment{Filename: a.Name, Mimetype: a.Type, URL: a.ContentBase64})
+	}
+
+	req := domain.DomainSendRequest{
+		From:        st.account,
+		To:          emails(c.To),
+		CC:          emails(c.CC),
+		BCC:         emails(c.BCC),
+		Subject:     c.Subject,
+		Body:        domain.Body{Content: contents},
+		Attachments: atts,
+	}
+	if c.ThreadID != "" {
+		req.Options.ThreadID = &c.ThreadID
+	}
+	if c.ExpiresInSeconds > 0 {
+		req.Options.ExpiresInSeconds = &c.ExpiresInSeconds
+	}
+	if c.OneTime {
+		req.Options.OneTime = &c.OneTime
+	}
+
+	if err := h.messages.LimitsFor(req.From).Check(req); err != nil {
+		return nil, &jmapError{Type: "tooLarge", Description: err.Error()}
+	}
+	result, err := h.messages.Send(st.ctx, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrQuotaExceeded):
+			return nil, &jmapError{Type: "overQuota", Description: err.Error()}
+		case errors.Is(err, domain.ErrListPostDenied), errors.Is(err, domain.ErrPermissionDenied):
+			return nil, &jmapError{Type: "forbiddenToSend", Description: err.Error()}
+		default:
+			log.Printf("[jmap] ERROR: sending for %s: %v", st.account, err)
+			return nil, &jmapError{Type: "serverFail", Description: "Failed to send the message."}
+		}
+	}
+	req.MessageID = result.MessageID
+	if err := h.relay.Relay(req, result); err != nil {
+		log.Printf("[jmap] WARN: message %s not relayed everywhere: %v", result.MessageID, err)
+	}
+
+	return map[string]interface{}{
+		"id":          result.MessageID,
+		"threadId":    result.ThreadID,
+		"deliveredTo": result.DeliveredTo,
+		"queuedFor":   result.QueuedFor,
+		"heldFor":     result.Held,
+		"bouncedFor":  result.Bounced,
+	}, nil
+}
+
+// updateEmail applies a patch to keywords and mailboxIds, the only
+// properties that can change after sending.
+func (h *JMAPHandler) updateEmail(st *jmapState, id string, patch map[string]json.RawMessage) *jmapError {
+	messages, err := h.loadMessages(st, []string{id})
+	if err != nil {
+		return serverFail(err)
+	}
+	m, ok := messages[id]
+	if !ok {
+		return &jmapError{Type: "notFound"}
+	}
+
+	keywords := keywordsOf(m)
+	target := ""
+	for path, value := range patch {
+		var set bool
+		switch {
+		case path == "keywords":
+			keywords = map[string]bool{}
+			if err := json.Unmarshal(value, &keywords); err != nil {
+				return invalidProperty(path)
+			}
+		case strings.HasPrefix(path, "keywords/"):
+			if err := json.Unmarshal(value, &set); err != nil && string(value) != "null" {
+				return invalidProperty(path)
+			}
+			keyword := strings.TrimPrefix(path, "keywords/")
+			if set {
+				keywords[keyword] = true
+			} else {
+				delete(keywords, keyword)
+			}
+		case path == "mailboxIds":
+			var mailboxes map[string]bool
+			if err := json.Unmarshal(value, &mailboxes); err != nil || len(mailboxes) != 1 {
+				return &jmapError{Type: "invalidProperties", Description: "an email is in exactly one mailbox", Properties: []string{path}}
+			}
+			for mb := range mailboxes {
+				target = mb
+			}
+		case strings.HasPrefix(path, "mailboxIds/"):
+			if err := json.Unmarshal(value, &set); err != nil || !set {
+				// Removing the only mailbox would leave the email nowhere.
+				return &jmapError{Type: "invalidProperties", Description: "an email is in exactly one mailbox", Properties: []string{path}}
+			}
+			if target != "" {
+				return &jmapError{Type: "invalidProperties", Description: "an email is in exactly one mailbox", Properties: []string{path}}
+			}
+			target = strings.TrimPrefix(path, "mailboxIds/")
+		default:
+			return invalidProperty(path)
+		}
+	}
+
+	if target != "" {
+		folder, ok, err := h.folderOf(st, target)
+		if err != nil {
+			return serverFail(err)
+		}
+		if !ok {
+			return &jmapError{Type: "invalidProperties", Description: "no mailbox " + target, Properties: []string{"mailboxIds"}}
+		}
+		if folder != m.Folder {
+			if _, err := h.messages.MoveMessages(st.ctx, domain.DomainMoveRequest{MessageIDs: []string{id}, Folder: folder}); err != nil {
+				if errors.Is(err, domain.ErrInvalidFolder) || errors.Is(err, domain.ErrFolderNotFound) {
+					return &jmapError{Type: "invalidProperties", Description: err.Error(), Properties: []string{"mailboxIds"}}
+				}
+				return serverFail(err)
+			}
+		}
+	}
+
+	flags := domain.DomainFlagRequest{MessageIDs: []string{id}}
+	current := keywordsOf(m)
+	if read := keywords[keywordSeen]; read != current[keywordSeen] {
+		flags.Read = &read
+	}
+	for k := range keywords {
+		if k != keywordSeen && !current[k] {
+			flags.AddFlags = append(flags.AddFlags, keywordFlag(k))
+		}
+	}
+	for k := range current {
+		if k != keywordSeen && !keywords[k] {
+			flags.RemoveFlags = append(flags.RemoveFlags, keywordFlag(k))
+		}
+	}
+	if flags.Read != nil || len(flags.AddFlags) > 0 || len(flags.RemoveFlags) > 0 {
+		if _, err := h.messages.UpdateFlags(st.ctx, flags); err != nil {
+			return serverFail(err)
+		}
+	}
+	delete(st.messages, id)
+	return nil
+}
+
+func invalidProperty(path string) *jmapError {
+	return &jmapError{Type: "invalidProperties", Properties: []string{path}}
+}
+
+// destroyEmails deletes the caller's copies of the messages.
+func (h *JMAPHandler) destroyEmails(st *jmapState, ids []string) ([]string, map[string]*jmapError, *jmapError) {
+	notDestroyed := map[string]*jmapError{}
+	resolved := make(map[string]string, len(ids))
+	var lookup []string
+	for _, id := range ids {
+		if r, ok := st.resolveID(id); ok {
+			resolved[id] = r
+			lookup = append(lookup, r)
+		} else {
+			notDestroyed[id] = &jmapError{Type: "notFound"}
+		}
+	}
+	messages, err := h.loadMessages(st, lookup)
+	if err != nil {
+		return nil, nil, serverFail(err)
+	}
+
+	var destroyed, doomed []string
+	for _, id := range ids {
+		r, ok := resolved[id]
+		if !ok {
+			continue
+		}
+		if _, ok := messages[r]; !ok {
+			notDestroyed[id] = &jmapError{Type: "notFound"}
+			continue
+		}
+		destroyed = append(destroyed, id)
+		doomed = append(doomed, r)
+	}
+	if len(doomed) > 0 {
+		if _, err := h.messages.DeleteMessages(st.ctx, doomed); err != nil {
+			return nil, nil, serverFail(err)
+		}
+		for _, r := range doomed {
+			delete(st.messages, r)
+		}
+	}
+	return destroyed, notDestroyed, nil
+}
@@ -0,0 +1,556 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"quill/pkg/domain"
+	"quill/pkg/identity"
+)
+
+func TestEvalPointer(t *testing.T) {
+	var doc interface{}
+	json.Unmarshal([]byte(`{
+		"ids": ["m1", "m2"],
+		"list": [
+			{"id": "m1", "threadId": "t1", "to": [{"email": "a"}, {"email": "b"}]},
+			{"id": "m2", "threadId": "t2", "to": [{"email": "c"}]}
+		],
+		"a/b": {"m~n": 1}
+	}`), &doc)
+
+	tests := []struct {
+		path string
+		want string // JSON, or "" for an error
+	}{
+		{"", ""},
+		{"/ids", `["m1","m2"]`},
+		{"/ids/1", `"m2"`},
+		{"/list/*/threadId", `["t1","t2"]`},
+		{"/list/*/to/*/email", `["a","b","c"]`},
+		{"/list/*/to", `[{"email":"a"},{"email":"b"},{"email":"c"}]`},
+		{"/a~1b/m~0n", `1`},
+		{"ids", ""},
+		{"/missing", ""},
+		{"/ids/2", ""},
+		{"/ids/-1", ""},
+		{"/ids/x", ""},
+		{"/ids/0/deeper", ""},
+		{"/list/*/missing", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := evalPointer(doc, tt.path)
+			if tt.path == "" {
+				if !reflect.DeepEqual(got, doc) {
+					t.Errorf("empty path = %v, want the document", got)
+				}
+				return
+			}
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("evalPointer = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := json.Marshal(got); string(data) != tt.want {
+				t.Errorf("evalPointer = %s, want %s", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveReferences(t *testing.T) {
+	st := &jmapState{responses: []jmapInvocation{
+		{Name: "Email/query", Args: json.RawMessage(`{"ids":["m1","m2"]}`), CallID: "q"},
+	}}
+	tests := []struct {
+		name    string
+		args    string
+		want    string
+		errType string
+	}{
+		{"no reference", `{"ids":["x"]}`, `{"ids":["x"]}`, ""},
+		{"reference", `{"#ids":{"resultOf":"q","name":"Email/query","path":"/ids"},"accountId":"a"}`, `{"accountId":"a","ids":["m1","m2"]}`, ""},
+		{"both forms", `{"ids":[],"#ids":{"resultOf":"q","name":"Email/query","path":"/ids"}}`, "", "invalidArguments"},
+		{"unknown call", `{"#ids":{"resultOf":"z","name":"Email/query","path":"/ids"}}`, "", "invalidResultReference"},
+		{"wrong method", `{"#ids":{"resultOf":"q","name":"Email/get","path":"/ids"}}`, "", "invalidResultReference"},
+		{"bad path", `{"#ids":{"resultOf":"q","name":"Email/query","path":"/list"}}`, "", "invalidResultReference"},
+		{"not a reference", `{"#ids":"q"}`, "", "invalidResultReference"},
+		{"not an object", `["ids"]`, "", "invalidArguments"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, jerr := st.resolveReferences(json.RawMessage(tt.args))
+			if tt.errType != "" {
+				if jerr == nil || jerr.Type != tt.errType {
+					t.Fatalf("resolveReferences = %s, %+v, want %s", got, jerr, tt.errType)
+				}
+				return
+			}
+			if jerr != nil {
+				t.Fatal(jerr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("resolveReferences = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeywords(t *testing.T) {
+	m := domain.Message{Read: true, Flags: []string{"Starred", "answered", "work"}}
+	want := map[string]bool{"$seen": true, "$flagged": true, "$answered": true, "work": true}
+	if got := keywordsOf(m); !reflect.DeepEqual(got, want) {
+		t.Errorf("keywordsOf = %v, want %v", got, want)
+	}
+	for keyword, flag := range map[string]string{"$flagged": "starred", "$Draft": "draft", "work": "work"} {
+		if got := keywordFlag(keyword); got != flag {
+			t.Errorf("keywordFlag(%q) = %q, want %q", keyword, got, flag)
+		}
+	}
+	if got := unique([]string{"a", "b", "a", "c", "b"}); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("unique = %v", got)
+	}
+}
+
+func TestEmailObject(t *testing.T) {
+	m := domain.Message{
+		MessageID: "m1",
+		ThreadID:  "t1",
+		From:      "ada~example.com",
+		To:        []string{"bob~example.com"},
+		BCC:       []string{"eve~example.com"},
+		Folder:    domain.FolderSent,
+		SentAt:    time.Date(2026, 10, 19, 9, 0, 0, 0, time.FixedZone("CEST", 7200)),
+		Body: domain.Body{Content: []domain.Content{
+			{Type: domain.ContentTypeHTML, Value: "<b>hi</b>"},
+			{Type: domain.ContentTypePlainText, Value: "  hello\n\n  there " + strings.Repeat("x", 300)},
+		}},
+		Attachments: []domain.Attachment{{Filename: "a.txt", Mimetype: "text/plain", URL: "aGk="}},
+	}
+	email := emailObject(m, map[string]string{domain.FolderSent: "f-sent"}, "ada~example.com")
+	if !reflect.DeepEqual(email["mailboxIds"], map[string]bool{"f-sent": true}) {
+		t.Errorf("mailboxIds = %v", email["mailboxIds"])
+	}
+	if email["sentAt"] != "2026-10-19T07:00:00Z" {
+		t.Errorf("sentAt = %v", email["sentAt"])
+	}
+	preview := email["preview"].(string)
+	if !strings.HasPrefix(preview, "hello there xxx") || len([]rune(preview)) != previewLength {
+		t.Errorf("preview = %q", preview)
+	}
+	if !reflect.DeepEqual(email["htmlBody"], []jmapBodyPart{{PartID: "1", Type: "text/html"}}) ||
+		!reflect.DeepEqual(email["textBody"], []jmapBodyPart{{PartID: "2", Type: "text/plain"}}) {
+		t.Errorf("bodies = %v, %v", email["htmlBody"], email["textBody"])
+	}
+	if email["hasAttachment"] != true || !reflect.DeepEqual(email["bcc"], []jmapAddress{{Email: "eve~example.com"}}) {
+		t.Errorf("sender's copy: hasAttachment %v, bcc %v", email["hasAttachment"], email["bcc"])
+	}
+	if _, ok := email["listId"]; ok {
+		t.Error("listId set for a direct message")
+	}
+
+	m.ListID = "team~example.com"
+	email = emailObject(m, nil, "bob~example.com")
+	if !reflect.DeepEqual(email["bcc"], []jmapAddress{}) || email["listId"] != "team~example.com" {
+		t.Errorf("recipient's copy: bcc %v, listId %v", email["bcc"], email["listId"])
+	}
+	if !reflect.DeepEqual(email["mailboxIds"], map[string]bool{}) {
+		t.Errorf("mailboxIds without a known folder = %v", email["mailboxIds"])
+	}
+}
+
+// jmapAuth accepts "Bearer ada" as ada~example.com and "Bearer new" as an
+// account without an address.
+type jmapAuth struct{}
+
+func (jmapAuth) Authenticate(ctx context.Context, token string) (context.Context, error) {
+	switch token {
+	case "Bearer ada":
+		return identity.WithPrincipal(ctx, &identity.Principal{AccountID: "u1", Addresses: []string{"ada~example.com"}}), nil
+	case "Bearer new":
+		return identity.WithPrincipal(ctx, &identity.Principal{AccountID: "u2"}), nil
+	}
+	return ctx, errors.New("bad token")
+}
+
+// fakeMail is a mailbox in memory recording what was asked of it.
+type fakeMail struct {
+	folders  []domain.FolderSummary
+	messages []domain.Message
+	sent     []domain.DomainSendRequest
+	moved    []domain.DomainMoveRequest
+	flagged  []domain.DomainFlagRequest
+	deleted  []string
+	sendErr  error
+	gets     int
+}
+
+func (f *fakeMail) ResolvePrincipal(ctx context.Context) (context.Context, error) {
+	return ctx, nil
+}
+
+func (f *fakeMail) Send(ctx context.Context, req domain.DomainSendRequest) (domain.DomainSendResult, error) {
+	if f.sendErr != nil {
+		return domain.DomainSendResult{}, f.sendErr
+	}
+	f.sent = append(f.sent, req)
+	id := fmt.Sprintf("new%d", len(f.sent))
+	thread := id
+	if req.Options.ThreadID != nil {
+		thread = *req.Options.ThreadID
+	}
+	f.messages = append(f.messages, domain.Message{MessageID: id, ThreadID: thread, From: req.From, To: req.To, Folder: domain.FolderSent})
+	return domain.DomainSendResult{MessageID: id, ThreadID: thread, DeliveredTo: req.To}, nil
+}
+
+func (f *fakeMail) Fetch(ctx context.Context, req domain.DomainFetchRequest) (domain.DomainFetchResult, error) {
+	var out []domain.Message
+	for _, m := range f.messages {
+		switch {
+		case req.Mode == domain.FetchModeFolder && m.Folder == *req.Folder,
+			req.Mode == domain.FetchModeThread && m.ThreadID == *req.ThreadID:
+			out = append(out, m)
+		}
+	}
+	total := len(out)
+	start := 0
+	if req.Offset != nil {
+		start = min(*req.Offset, len(out))
+	}
+	out = out[start:min(start+*req.Limit, len(out))]
+	return domain.DomainFetchResult{Total: total, Messages: out, ModSeq: 42}, nil
+}
+
+func (f *fakeMail) GetMessages(ctx context.Context, ids []string) ([]domain.Message, error) {
+	f.gets++
+	var out []domain.Message
+	for _, m := range f.messages {
+		for _, id := range ids {
+			if m.MessageID == id {
+				out = append(out, m)
+			}
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeMail) ListFolders(ctx context.Context) (domain.DomainFolderList, error) {
+	return domain.DomainFolderList{Folders: f.folders}, nil
+}
+
+func (f *fakeMail) MoveMessages(ctx context.Context, req domain.DomainMoveRequest) (int, error) {
+	f.moved = append(f.moved, req)
+	return len(req.MessageIDs), nil
+}
+
+func (f *fakeMail) UpdateFlags(ctx context.Context, req domain.DomainFlagRequest) (int, error) {
+	sort.Strings(req.AddFlags)
+	sort.Strings(req.RemoveFlags)
+	f.flagged = append(f.flagged, req)
+	return len(req.MessageIDs), nil
+}
+
+func (f *fakeMail) DeleteMessages(ctx context.Context, ids []string) (int, error) {
+	f.deleted = append(f.deleted, ids...)
+	return len(ids), nil
+}
+
+func (f *fakeMail) LimitsFor(addr string) domain.Limits {
+	return domain.Limits{MaxAttachments: 1}
+}
+
+type noRelay struct{}
+
+func (noRelay) Relay(domain.DomainSendRequest, domain.DomainSendResult) error { return nil }
+
+func testMail() *fakeMail {
+	at := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+	return &fakeMail{
+		folders: []domain.FolderSummary{
+			{ID: "f-inbox", Name: "Inbox", Path: domain.FolderInbox, Total: 2, Unread: 1},
+			{ID: "f-sent", Name: "Sent", Path: domain.FolderSent},
+			{ID: "f-work", Name: "Work", Path: "work"},
+			{ID: "f-old", Name: "Old", Path: "work/old", ParentID: "f-work"},
+		},
+		messages: []domain.Message{
+			{MessageID: "m1", ThreadID: "t1", From: "bob~example.com", Subject: "First", Folder: domain.FolderInbox, Read: true, SentAt: at.Add(time.Hour)},
+			{MessageID: "m2", ThreadID: "t1", From: "bob~example.com", Subject: "Second", Folder: domain.FolderInbox, Flags: []string{"starred"}, SentAt: at},
+		},
+	}
+}
+
+// jmapCall posts the method calls and returns the method responses.
+func jmapCall(t *testing.T, h http.Handler, token string, calls string) (int, []jmapInvocation) {
+	t.Helper()
+	body := `{"using":["urn:ietf:params:jmap:core","urn:ietf:params:jmap:mail"],"methodCalls":` + calls + `}`
+	req := httptest.NewRequest(http.MethodPost, "/jmap", strings.NewReader(body))
+	req.Header.Set("Authorization", token)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		return rec.Code, nil
+	}
+	var resp jmapResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, resp.MethodResponses
+}
+
+func TestJMAPRequestErrors(t *testing.T) {
+	h := NewJMAPHandler(jmapAuth{}, testMail(), noRelay{})
+	post := func(token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/jmap", strings.NewReader(body))
+		req.Header.Set("Authorization", token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	tooMany := strings.TrimSuffix(strings.Repeat(`["Core/echo",{},"c"],`, jmapMaxCallsInRequest+1), ",")
+	tests := []struct {
+		name    string
+		token   string
+		body    string
+		status  int
+		problem string
+	}{
+		{"no token", "", `{}`, http.StatusUnauthorized, ""},
+		{"bad token", "Bearer bad", `{}`, http.StatusUnauthorized, ""},
+		{"not json", "Bearer ada", `{`, http.StatusBadRequest, "notRequest"},
+		{"bad invocation", "Bearer ada", `{"using":[],"methodCalls":[["Core/echo",{}]]}`, http.StatusBadRequest, "notRequest"},
+		{"missing capability", "Bearer ada", `{"using":["urn:ietf:params:jmap:core"],"methodCalls":[]}`, http.StatusBadRequest, "unknownCapability"},
+		{"too many calls", "Bearer ada", `{"using":["urn:ietf:params:jmap:core","urn:ietf:params:jmap:mail"],"methodCalls":[` + tooMany + `]}`, http.StatusBadRequest, "limit"},
+		{"no address yet", "Bearer new", `{"using":["urn:ietf:params:jmap:core","urn:ietf:params:jmap:mail"],"methodCalls":[]}`, http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := post(tt.token, tt.body)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.problem != "" && !strings.Contains(rec.Body.String(), "urn:ietf:params:jmap:error:"+tt.problem) {
+				t.Errorf("problem = %s, want %s", rec.Body, tt.problem)
+			}
+		})
+	}
+}
+
+func TestJMAPSession(t *testing.T) {
+	h := NewJMAPHandler(jmapAuth{}, testMail(), noRelay{})
+	for token, want := range map[string]int{"Bearer ada": http.StatusOK, "Bearer new": http.StatusForbidden} {
+		req := httptest.NewRequest(http.MethodGet, "/.well-known/jmap", nil)
+		req.Header.Set("Authorization", token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s: status %d, want %d", token, rec.Code, want)
+		}
+		if want == http.StatusOK && !strings.Contains(rec.Body.String(), `"primaryAccounts":{"urn:ietf:params:jmap:mail":"ada~example.com"}`) {
+			t.Errorf("session = %s", rec.Body)
+		}
+	}
+}
+
+// args decodes a method response.
+func args(t *testing.T, inv jmapInvocation) map[string]interface{} {
+	t.Helper()
+	var out map[string]interface{}
+	if err := json.Unmarshal(inv.Args, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestJMAPMethodErrors(t *testing.T) {
+	h := NewJMAPHandler(jmapAuth{}, testMail(), noRelay{})
+	_, resps := jmapCall(t, h, "Bearer ada", `[
+		["Email/import", {}, "a"],
+		["Email/get", {"accountId": "bob~example.com", "ids": []}, "b"],
+		["Core/echo", {"accountId": "anything", "hello": true}, "c"],
+		["Email/get", {}, "d"],
+		["Email/query", {"limit": -1}, "e"],
+		["Email/query", {"filter": {"inMailbox": "f-work", "inThread": "t1"}}, "f"],
+		["Email/query", {"filter": {"inMailbox": "f-none"}}, "g"],
+		["Email/get", {"#ids": {"resultOf": "a", "name": "Email/query", "path": "/ids"}}, "h"],
+		["Mailbox/get", {"ids": "f-inbox"}, "i"]
+	]`)
+	want := []string{"unknownMethod", "accountNotFound", "", "requestTooLarge", "invalidArguments",
+		"unsupportedFilter", "unsupportedFilter", "invalidResultReference", "invalidArguments"}
+	if len(resps) != len(want) {
+		t.Fatalf("got %d responses, want %d", len(resps), len(want))
+	}
+	for i, resp := range resps {
+		if want[i] == "" {
+			if resp.Name != "Core/echo" || args(t, resp)["hello"] != true {
+				t.Errorf("%s: %s %s, want an echo", resp.CallID, resp.Name, resp.Args)
+			}
+			continue
+		}
+		if resp.Name != "error" || args(t, resp)["type"] != want[i] {
+			t.Errorf("%s: %s %s, want error %s", resp.CallID, resp.Name, resp.Args, want[i])
+		}
+	}
+}
+
+func TestJMAPQueryAndGet(t *testing.T) {
+	mail := testMail()
+	h := NewJMAPHandler(jmapAuth{}, mail, noRelay{})
+	_, resps := jmapCall(t, h, "Bearer ada", `[
+		["Email/query", {"accountId": "ada~example.com", "filter": {"inMailbox": "f-inbox"}, "limit": 1, "calculateTotal": true}, "q"],
+		["Email/get", {"#ids": {"resultOf": "q", "name": "Email/query", "path": "/ids"}, "properties": ["subject", "keywords", "threadId"]}, "g"],
+		["Thread/get", {"#ids": {"resultOf": "g", "name": "Email/get", "path": "/list/*/threadId"}}, "t"],
+		["Email/get", {"ids": ["m2", "m2", "nope"], "properties": ["mailboxIds"]}, "g2"],
+		["Mailbox/get", {"ids": ["f-old", "f-none"]}, "mb"]
+	]`)
+	if len(resps) != 5 {
+		t.Fatalf("got %d responses: %v", len(resps), resps)
+	}
+
+	q := args(t, resps[0])
+	if !reflect.DeepEqual(q["ids"], []interface{}{"m1"}) || q["total"] != 2.0 || q["queryState"] != "42" {
+		t.Errorf("Email/query = %v", q)
+	}
+	list := args(t, resps[1])["list"].([]interface{})
+	wantEmail := map[string]interface{}{"id": "m1", "subject": "First", "threadId": "t1", "keywords": map[string]interface{}{"$seen": true}}
+	if len(list) != 1 || !reflect.DeepEqual(list[0], wantEmail) {
+		t.Errorf("Email/get list = %v, want [%v]", list, wantEmail)
+	}
+	// Only the unknown ID of g2 is looked up: the others were loaded by
+	// Email/query and Thread/get.
+	if mail.gets != 1 {
+		t.Errorf("messages loaded %d times, want once", mail.gets)
+	}
+	threads := args(t, resps[2])["list"].([]interface{})
+	wantThread := map[string]interface{}{"id": "t1", "emailIds": []interface{}{"m2", "m1"}}
+	if len(threads) != 1 || !reflect.DeepEqual(threads[0], wantThread) {
+		t.Errorf("Thread/get list = %v, want oldest first %v", threads, wantThread)
+	}
+	g2 := args(t, resps[3])
+	if l := g2["list"].([]interface{}); len(l) != 1 || !reflect.DeepEqual(g2["notFound"], []interface{}{"nope"}) {
+		t.Errorf("Email/get with repeats = %v", g2)
+	}
+	mb := args(t, resps[4])
+	boxes := mb["list"].([]interface{})
+	if len(boxes) != 1 || boxes[0].(map[string]interface{})["parentId"] != "f-work" || !reflect.DeepEqual(mb["notFound"], []interface{}{"f-none"}) {
+		t.Errorf("Mailbox/get = %v", mb)
+	}
+}
+
+func TestJMAPSet(t *testing.T) {
+	mail := testMail()
+	h := NewJMAPHandler(jmapAuth{}, mail, noRelay{})
+	_, resps := jmapCall(t, h, "Bearer ada", `[
+		["Email/set", {
+			"create": {
+				"k1": {"to": [{"email": "bob~example.com"}], "subject": "Hi", "threadId": "t1",
+					"textBody": [{"partId": "a"}], "bodyValues": {"a": {"value": "hello"}}},
+				"k2": {"from": [{"email": "bob~example.com"}], "to": [{"email": "ada~example.com"}]},
+				"k3": {"subject": "nobody"},
+				"k4": {"to": [{"email": "bob~example.com"}], "textBody": [{"partId": "x"}]},
+				"k5": {"to": [{"email": "bob~example.com"}], "attachments": [{"name": "a"}, {"name": "b"}]}
+			},
+			"update": {
+				"m1": {"keywords/$seen": null, "keywords/$flagged": true, "mailboxIds": {"f-work": true}},
+				"m2": {"keywords": {"todo": true}},
+				"#k1": {"keywords/$seen": true},
+				"#k9": {"keywords/$seen": true},
+				"nope": {"keywords/$seen": true}
+			},
+			"destroy": ["#k1", "nope"]
+		}, "s"],
+		["Email/set", {"update": {
+			"m1": {"subject": "changed"},
+			"m2": {"mailboxIds/f-work": false}
+		}}, "bad"]
+	]`)
+	if len(resps) != 2 {
+		t.Fatalf("got %d responses", len(resps))
+	}
+	set := args(t, resps[0])
+
+	created := set["created"].(map[string]interface{})
+	if k1 := created["k1"].(map[string]interface{}); len(created) != 1 || k1["id"] != "new1" || k1["threadId"] != "t1" {
+		t.Errorf("created = %v", created)
+	}
+	notCreated := set["notCreated"].(map[string]interface{})
+	for cid, want := range map[string]string{"k2": "invalidProperties", "k3": "invalidProperties", "k4": "invalidProperties", "k5": "tooLarge"} {
+		if e, ok := notCreated[cid].(map[string]interface{}); !ok || e["type"] != want {
+			t.Errorf("notCreated[%s] = %v, want %s", cid, notCreated[cid], want)
+		}
+	}
+	if len(mail.sent) != 1 || mail.sent[0].From != "ada~example.com" || mail.sent[0].Body.Content[0].Value != "hello" {
+		t.Errorf("sent = %+v", mail.sent)
+	}
+
+	if updated := set["updated"].(map[string]interface{}); len(updated) != 3 {
+		t.Errorf("updated = %v, want m1, m2 and #k1", updated)
+	}
+	notUpdated := set["notUpdated"].(map[string]interface{})
+	if len(notUpdated) != 2 || notUpdated["#k9"] == nil || notUpdated["nope"] == nil {
+		t.Errorf("notUpdated = %v", notUpdated)
+	}
+	if want := []domain.DomainMoveRequest{{MessageIDs: []string{"m1"}, Folder: "work"}}; !reflect.DeepEqual(mail.moved, want) {
+		t.Errorf("moved = %+v, want %+v", mail.moved, want)
+	}
+	read, unread := true, false
+	wantFlags := []domain.DomainFlagRequest{
+		{MessageIDs: []string{"new1"}, Read: &read},
+		{MessageIDs: []string{"m1"}, Read: &unread, AddFlags: []string{"starred"}},
+		{MessageIDs: []string{"m2"}, AddFlags: []string{"todo"}, RemoveFlags: []string{"starred"}},
+	}
+	if !reflect.DeepEqual(mail.flagged, wantFlags) {
+		t.Errorf("flag updates = %+v, want %+v", mail.flagged, wantFlags)
+	}
+
+	if !reflect.DeepEqual(set["destroyed"], []interface{}{"#k1"}) || set["notDestroyed"].(map[string]interface{})["nope"] == nil {
+		t.Errorf("destroyed = %v, notDestroyed = %v", set["destroyed"], set["notDestroyed"])
+	}
+	if !reflect.DeepEqual(mail.deleted, []string{"new1"}) {
+		t.Errorf("deleted = %v", mail.deleted)
+	}
+
+	bad := args(t, resps[1])["notUpdated"].(map[string]interface{})
+	for _, id := range []string{"m1", "m2"} {
+		if e, ok := bad[id].(map[string]interface{}); !ok || e["type"] != "invalidProperties" {
+			t.Errorf("notUpdated[%s] = %v, want invalidProperties", id, bad[id])
+		}
+	}
+}
+
+func TestJMAPSendErrors(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("%w: mailbox full", domain.ErrQuotaExceeded), "overQuota"},
+		{domain.ErrListPostDenied, "forbiddenToSend"},
+		{domain.ErrPermissionDenied, "forbiddenToSend"},
+		{errors.New("connection reset"), "serverFail"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			mail := testMail()
+			mail.sendErr = tt.err
+			h := NewJMAPHandler(jmapAuth{}, mail, noRelay{})
+			_, resps := jmapCall(t, h, "Bearer ada", `[["Email/set", {"create": {"k": {"to": [{"email": "bob~example.com"}]}}}, "s"]]`)
+			e := args(t, resps[0])["notCreated"].(map[string]interface{})["k"].(map[string]interface{})
+			if e["type"] != tt.want {
+				t.Errorf("notCreated = %v, want %s", e, tt.want)
+			}
+		})
+	}
+}
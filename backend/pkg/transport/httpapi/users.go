@@ -0,0 +1,229 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"quill/pkg/domain"
+	"quill/pkg/models"
+)
+
+// UserHandler serves sign-up at /createUser and self-service profile
+// management under /me.
+type UserHandler struct {
+	auth     authenticator
+	resolver principalResolver
+	users    domain.UserService
+	sessions sessionRevoker
+	mux      *http.ServeMux
+}
+
+func NewUserHandler(auth authenticator, resolver principalResolver, users domain.UserService, sessions sessionRevoker) *UserHandler {
+	h := &UserHandler{
+		auth:     auth,
+		resolver: resolver,
+		users:    users,
+		sessions: sessions,
+		mux:      http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /me", h.getProfile)
+	h.mux.HandleFunc("PATCH /me", h.updateProfile)
+	h.mux.HandleFunc("POST /me/handle", h.changeHandle)
+	h.mux.HandleFunc("DELETE /me", h.deleteAccount)
+	h.mux.HandleFunc("POST /me/restore", h.cancelDeletion)
+	h.mux.HandleFunc("POST /me/exports", h.startExport)
+	h.mux.HandleFunc("GET /me/exports/{id}", h.getExport)
+	h.mux.HandleFunc("GET /me/exports/{id}/archive", h.downloadExport)
+	return h
+}
+
+// ServeHTTP handles /createUser, whose token travels in the body for
+// compatibility with existing clients, and every /me route.
+func (h *UserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/createUser" {
+		h.createUser(w, r)
+		return
+	}
+	ctx, err := authenticateRequest(r, h.auth, h.resolver)
+	if err != nil {
+		log.Printf("[users] authentication failed for %s: %v", r.RemoteAddr, err)
+		writeError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+	h.mux.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func (h *UserHandler) createUser(w http.ResponseWriter, r *http.Request) {
+	log.Println("[/createUser] Received request")
+	if r.Method != http.MethodPost {
+		log.Printf("[/createUser] Invalid method: %s", r.Method)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	// Older clients send extra fields, so unknown ones are tolerated here.
+	var req models.CreateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if req.UserQuillMail == "" || req.UserEmail == "" || req.UsersUID == "" {
+		log.Printf("[/createUser] Missing required fields: UserQuillMail=%q, UserEmail=%q, UsersUID=%q", req.UserQuillMail, req.UserEmail, req.UsersUID)
+		writeError(w, http.StatusBadRequest, "missing required fields")
+		return
+	}
+	if req.AuthToken != "" && r.Header.Get("Authorization") == "" {
+		r.Header.Set("Authorization", req.AuthToken)
+	}
+	ctx, err := authenticateRequest(r, h.auth, h.resolver)
+	if err != nil {
+		log.Printf("[/createUser] Error authenticating token: %v", err)
+		writeError(w, http.StatusUnauthorized, "invalid or missing auth token")
+		return
+	}
+
+	resp, err := h.users.CreateUser(ctx, req)
+	if err != nil {
+		log.Printf("[/createUser] Error creating user: %v", err)
+		writeServiceError(w, err)
+		return
+	}
+	status := http.StatusOK
+	if !resp.Success {
+		status = http.StatusConflict
+	}
+	log.Printf("[/createUser] UID=%s QuillMail=%s success=%t", req.UsersUID, req.UserQuillMail, resp.Success)
+	writeJSON(w, status, resp)
+}
+
+func (h *UserHandler) getProfile(w http.ResponseWriter, r *http.Request) {
+	user, err := h.users.GetProfile(r.Context())
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+type profileRequest struct {
+	DisplayName *string `json:"displayName"`
+	Signature   *string `json:"signature"`
+	Avatar      *string `json:"avatar"`
+}
+
+func (h *UserHandler) updateProfile(w http.ResponseWriter, r *http.Request) {
+	var req profileRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	user, err := h.users.UpdateProfile(r.Context(), domain.ProfileUpdate{
+		DisplayName: req.DisplayName,
+		Signature:   req.Signature,
+		Avatar:      req.Avatar,
+	})
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+type handleRequest struct {
+	UserQuillMail string `json:"userQuillMail"`
+}
+
+func (h *UserHandler) changeHandle(w http.ResponseWriter, r *http.Request) {
+	var req handleRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	user, err := h.users.ChangeHandle(r.Context(), req.UserQuillMail)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	// Sessions carry the old address in their principal.
+	h.sessions.RevokeUser(user.UsersUID)
+	writeJSON(w, http.StatusOK, user)
+}
+
+// deleteAccount schedules deletion; the account is purged once the grace
+// period in the returned deleteAfter has passed.
+func (h *UserHandler) deleteAccount(w http.ResponseWriter, r *http.Request) {
+	user, err := h.users.DeleteAccount(r.Context())
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, user)
+}
+
+func (h *UserHandler) cancelDeletion(w http.ResponseWriter, r *http.Request) {
+	user, err := h.users.CancelAccountDeletion(r.Context())
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+func (h *UserHandler) startExport(w http.ResponseWriter, r *http.Request) {
+	job, err := h.users.StartExport(r.Context())
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, exportResponse(job))
+}
+
+func (h *UserHandler) getExport(w http.ResponseWriter, r *http.Request) {
+	job, err := h.users.GetExport(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, exportResponse(job))
+}
+
+func (h *UserHandler) downloadExport(w http.ResponseWriter, r *http.Request) {
+	f, job, err := h.users.OpenExport(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="quill-export-%s.zip"`, job.CreatedAt.Format("2006-01-02")))
+	http.ServeContent(w, r, "", job.CompletedAt, f)
+}
+
+type exportJobResponse struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	Size        int64      `json:"size,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	Download    string     `json:"download,omitempty"`
+}
+
+func exportResponse(job *domain.ExportJob) exportJobResponse {
+	resp := exportJobResponse{
+		ID:        job.ID,
+		Status:    string(job.Status),
+		Size:      job.Size,
+		CreatedAt: job.CreatedAt,
+	}
+	if !job.CompletedAt.IsZero() {
+		resp.CompletedAt = &job.CompletedAt
+	}
+	if !job.ExpiresAt.IsZero() {
+		resp.ExpiresAt = &job.ExpiresAt
+	}
+	if job.Status == domain.ExportStatusReady {
+		resp.Download = "/me/exports/" + job.ID + "/archive"
+	}
+	return resp
+}
@@ -0,0 +1,203 @@
+// Package imap gives standard mail clients read-only access to Quill
+// mailboxes over IMAP4rev1. Folders are IMAP mailboxes, mailbox entries are
+// messages numbered by the stable UIDs of domain.FolderView, and each
+// message is rendered to MIME when it is fetched. Users sign in with their
+// address and an app password.
+package imap
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	goimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+
+	"quill/pkg/domain"
+	"quill/pkg/hosting"
+	"quill/pkg/identity"
+)
+
+// opTimeout bounds the storage work behind a single IMAP command.
+const opTimeout = 30 * time.Second
+
+type authenticator interface {
+	Authenticate(ctx context.Context, token string) (context.Context, error)
+}
+
+type messageService interface {
+	ResolvePrincipal(ctx context.Context) (context.Context, error)
+	ListFolders(ctx context.Context) (domain.DomainFolderList, error)
+	FolderView(ctx context.Context, folder string) (domain.FolderView, error)
+	GetMessages(ctx context.Context, messageIDs []string) ([]domain.Message, error)
+}
+
+// errReadOnly answers every command that would change the mailbox.
+var errReadOnly = errors.New("Quill IMAP access is read-only")
+
+// Backend is the go-imap backend serving Quill mailboxes.
+type Backend struct {
+	auth       authenticator
+	messageSvc messageService
+	hosts      *hosting.Registry
+}
+
+// NewBackend checks logins with auth, which must accept app passwords, and
+// reads mailboxes through ms.
+func NewBackend(auth authenticator, ms messageService, hosts *hosting.Registry) *Backend {
+	return &Backend{auth: auth, messageSvc: ms, hosts: hosts}
+}
+
+// NewServer returns an IMAP server on addr. Logins are refused until the
+// connection is encrypted, with STARTTLS or, when the listener is wrapped
+// in TLS by the caller, from the start.
+func NewServer(addr string, tlsCfg *tls.Config, b *Backend) *server.Server {
+	s := server.New(b)
+	s.Addr = addr
+	s.TLSConfig = tlsCfg
+	s.AllowInsecureAuth = false
+	s.ErrorLog = log.Default()
+	return s
+}
+
+// Login accepts the address as name~domain or as the name@domain form mail
+// clients expect, and an app password.
+func (b *Backend) Login(connInfo *goimap.ConnInfo, username, password string) (backend.User, error) {
+	address := strings.ToLower(strings.TrimSpace(username))
+	if i := strings.LastIndex(address, "@"); i != -1 && !strings.Contains(address, "~") {
+		address = address[:i] + "~" + address[i+1:]
+	}
+	if !b.hosts.IsLocal(address) {
+		return nil, backend.ErrInvalidCredentials
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+	token := "Basic " + base64.StdEncoding.EncodeToString([]byte(address+":"+password))
+	authCtx, err := b.auth.Authenticate(ctx, token)
+	if err == nil {
+		authCtx, err = b.messageSvc.ResolvePrincipal(authCtx)
+	}
+	if err != nil {
+		log.Printf("WARN: imap login of %s from %s failed: %v", address, connInfo.RemoteAddr, err)
+		return nil, backend.ErrInvalidCredentials
+	}
+	p, _ := identity.FromContext(authCtx)
+	if p.Method != identity.AuthMethodAppPassword || p.Address() == "" {
+		return nil, backend.ErrInvalidCredentials
+	}
+
+	log.Printf("INFO: imap login of %s from %s", p.Address(), connInfo.RemoteAddr)
+	return &user{
+		backend:   b,
+		principal: p,
+	}, nil
+}
+
+// user is one signed-in connection.
+type user struct {
+	backend   *Backend
+	principal *identity.Principal
+}
+
+func (u *user) Username() string {
+	return u.principal.Address()
+}
+
+// context returns a context carrying the user for one command.
+func (u *user) context() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	return identity.WithPrincipal(ctx, u.principal), cancel
+}
+
+// ListMailboxes lists every folder; all of them count as subscribed.
+func (u *user) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	folders, err := u.folders()
+	if err != nil {
+		return nil, err
+	}
+	mailboxes := make([]backend.Mailbox, 0, len(folders))
+	for _, f := range folders {
+		mailboxes = append(mailboxes, &mailbox{user: u, name: f.name, folder: f.path, attributes: f.attributes})
+	}
+	return mailboxes, nil
+}
+
+// GetMailbox selects a folder and takes its view, which stays fixed until
+// the folder is selected again.
+func (u *user) GetMailbox(name string) (backend.Mailbox, error) {
+	folders, err := u.folders()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range folders {
+		if f.name == name || (f.path == domain.FolderInbox && strings.EqualFold(name, "INBOX")) {
+			mbox := &mailbox{user: u, name: f.name, folder: f.path, attributes: f.attributes}
+			if err := mbox.load(); err != nil {
+				return nil, err
+			}
+			return mbox, nil
+		}
+	}
+	return nil, backend.ErrNoSuchMailbox
+}
+
+func (u *user) CreateMailbox(name string) error {
+	return errReadOnly
+}
+
+func (u *user) DeleteMailbox(name string) error {
+	return errReadOnly
+}
+
+func (u *user) RenameMailbox(existingName, newName string) error {
+	return errReadOnly
+}
+
+func (u *user) Logout() error {
+	return nil
+}
+
+type folderInfo struct {
+	name       string
+	path       string
+	attributes []string
+}
+
+// folders maps the user's folders to IMAP mailbox names: the inbox is
+// INBOX, the sent folder Sent, and nested folders keep their path.
+func (u *user) folders() ([]folderInfo, error) {
+	ctx, cancel := u.context()
+	defer cancel()
+	list, err := u.backend.messageSvc.ListFolders(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	folders := make([]folderInfo, 0, len(list.Folders))
+	for _, f := range list.Folders {
+		info := folderInfo{name: f.Path, path: f.Path}
+		switch f.Path {
+		case domain.FolderInbox:
+			info.name = "INBOX"
+		case domain.FolderSent:
+			info.name = "Sent"
+			info.attributes = append(info.attributes, goimap.SentAttr)
+		}
+		children := goimap.HasNoChildrenAttr
+		for _, other := range list.Folders {
+			if strings.HasPrefix(other.Path, f.Path+delimiter) {
+				children = goimap.HasChildrenAttr
+				break
+			}
+		}
+		info.attributes = append(info.attributes, children)
+		folders = append(folders, info)
+	}
+	return folders, nil
+}
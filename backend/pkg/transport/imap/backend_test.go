@@ -0,0 +1,381 @@
+package imap
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	goimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+
+	"quill/pkg/domain"
+	"quill/pkg/hosting"
+	"quill/pkg/identity"
+)
+
+// fakeAuth accepts one address and password, as the given method.
+type fakeAuth struct {
+	address, password string
+	method            identity.AuthMethod
+}
+
+func (a fakeAuth) Authenticate(ctx context.Context, token string) (context.Context, error) {
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte(a.address+":"+a.password))
+	if token != want {
+		return nil, errors.New("invalid credentials")
+	}
+	return identity.WithPrincipal(ctx, &identity.Principal{AccountID: "u1", Method: a.method}), nil
+}
+
+// fakeStore serves a fixed mailbox to the principal it resolves.
+type fakeStore struct {
+	address  string
+	folders  []string
+	views    map[string]domain.FolderView
+	messages map[string]domain.Message
+	fetched  [][]string
+}
+
+func (s *fakeStore) ResolvePrincipal(ctx context.Context) (context.Context, error) {
+	p, _ := identity.FromContext(ctx)
+	resolved := *p
+	resolved.Addresses = []string{s.address}
+	return identity.WithPrincipal(ctx, &resolved), nil
+}
+
+func (s *fakeStore) ListFolders(ctx context.Context) (domain.DomainFolderList, error) {
+	var list domain.DomainFolderList
+	for _, f := range s.folders {
+		list.Folders = append(list.Folders, domain.FolderSummary{Path: f})
+	}
+	return list, nil
+}
+
+func (s *fakeStore) FolderView(ctx context.Context, folder string) (domain.FolderView, error) {
+	return s.views[folder], nil
+}
+
+func (s *fakeStore) GetMessages(ctx context.Context, ids []string) ([]domain.Message, error) {
+	s.fetched = append(s.fetched, ids)
+	var msgs []domain.Message
+	for _, id := range ids {
+		if m, ok := s.messages[id]; ok {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs, nil
+}
+
+var received = time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+
+func testStore() *fakeStore {
+	msg := func(id, from, subject string) domain.Message {
+		return domain.Message{
+			MessageID: id,
+			ThreadID:  id,
+			From:      from,
+			To:        []string{"ada~example.com"},
+			BCC:       []string{"secret~example.com"},
+			Subject:   subject,
+			Body:      domain.Body{Content: []domain.Content{{Type: domain.ContentTypePlainText, Value: "Body of " + subject}}},
+			SentAt:    received,
+		}
+	}
+	return &fakeStore{
+		address: "ada~example.com",
+		folders: []string{domain.FolderInbox, domain.FolderSent, "projects", "projects/quill"},
+		views: map[string]domain.FolderView{
+			domain.FolderInbox: {
+				Folder:      domain.FolderInbox,
+				UIDValidity: 1700000000,
+				UIDNext:     12,
+				Entries: []domain.FolderViewEntry{
+					{UID: 3, MessageID: "m1", Read: true, Flags: []string{"starred"}, ReceivedAt: received},
+					{UID: 7, MessageID: "m2", Flags: []string{"todo list"}, ReceivedAt: received.Add(time.Hour)},
+					{UID: 11, MessageID: "gone", ReceivedAt: received.Add(2 * time.Hour)},
+				},
+			},
+		},
+		messages: map[string]domain.Message{
+			"m1": msg("m1", "bob~example.com", "Lunch"),
+			"m2": msg("m2", "eve@example.net", "Invoice"),
+		},
+	}
+}
+
+func testBackend(store *fakeStore, method identity.AuthMethod) *Backend {
+	hosts, _ := hosting.NewRegistry(&hosting.Domain{Name: "example.com"})
+	return NewBackend(fakeAuth{address: "ada~example.com", password: "app-secret", method: method}, store, hosts)
+}
+
+func TestLogin(t *testing.T) {
+	conn := &goimap.ConnInfo{}
+	tests := []struct {
+		name     string
+		method   identity.AuthMethod
+		username string
+		password string
+		ok       bool
+	}{
+		{"quill address", identity.AuthMethodAppPassword, "ada~example.com", "app-secret", true},
+		{"email form", identity.AuthMethodAppPassword, " Ada@Example.com ", "app-secret", true},
+		{"wrong password", identity.AuthMethodAppPassword, "ada~example.com", "nope", false},
+		{"not hosted", identity.AuthMethodAppPassword, "ada@example.org", "app-secret", false},
+		{"not an app password", identity.AuthMethodAPIKey, "ada~example.com", "app-secret", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := testBackend(testStore(), tt.method).Login(conn, tt.username, tt.password)
+			if !tt.ok {
+				if err != backend.ErrInvalidCredentials {
+					t.Fatalf("Login() = %v, want %v", err, backend.ErrInvalidCredentials)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Username() != "ada~example.com" {
+				t.Errorf("Username() = %q", u.Username())
+			}
+		})
+	}
+}
+
+func login(t *testing.T, store *fakeStore) backend.User {
+	t.Helper()
+	u, err := testBackend(store, identity.AuthMethodAppPassword).Login(&goimap.ConnInfo{}, "ada~example.com", "app-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestListMailboxes(t *testing.T) {
+	mailboxes, err := login(t, testStore()).ListMailboxes(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]string)
+	for _, mb := range mailboxes {
+		info, _ := mb.Info()
+		if info.Delimiter != delimiter {
+			t.Errorf("%s: delimiter %q", info.Name, info.Delimiter)
+		}
+		got[info.Name] = info.Attributes
+	}
+	want := map[string][]string{
+		"INBOX":          {goimap.HasNoChildrenAttr},
+		"Sent":           {goimap.SentAttr, goimap.HasNoChildrenAttr},
+		"projects":       {goimap.HasChildrenAttr},
+		"projects/quill": {goimap.HasNoChildrenAttr},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mailboxes = %v, want %v", got, want)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	u := login(t, testStore())
+	mb, err := u.GetMailbox("inbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.GetMailbox("Archive"); err != backend.ErrNoSuchMailbox {
+		t.Errorf("GetMailbox(Archive) = %v, want %v", err, backend.ErrNoSuchMailbox)
+	}
+	all, _ := goimap.ParseSeqSet("1:*")
+	writes := map[string]error{
+		"CREATE":  u.CreateMailbox("new"),
+		"DELETE":  u.DeleteMailbox("projects"),
+		"RENAME":  u.RenameMailbox("projects", "old"),
+		"APPEND":  mb.CreateMessage(nil, time.Now(), strings.NewReader("")),
+		"STORE":   mb.UpdateMessagesFlags(false, all, goimap.AddFlags, []string{goimap.SeenFlag}),
+		"COPY":    mb.CopyMessages(false, all, "Sent"),
+		"EXPUNGE": mb.Expunge(),
+	}
+	for cmd, err := range writes {
+		if err != errReadOnly {
+			t.Errorf("%s = %v, want %v", cmd, err, errReadOnly)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	mb, err := login(t, testStore()).GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := []goimap.StatusItem{goimap.StatusMessages, goimap.StatusUidNext, goimap.StatusUidValidity, goimap.StatusUnseen, goimap.StatusRecent}
+	status, err := mb.Status(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.ReadOnly || len(status.PermanentFlags) != 0 {
+		t.Errorf("ReadOnly = %v, PermanentFlags = %v, want a read-only mailbox", status.ReadOnly, status.PermanentFlags)
+	}
+	if status.Messages != 3 || status.UidNext != 12 || status.UidValidity != 1700000000 || status.Unseen != 2 || status.UnseenSeqNum != 2 {
+		t.Errorf("status = %+v", status)
+	}
+	wantFlags := []string{goimap.SeenFlag, goimap.AnsweredFlag, goimap.FlaggedFlag, goimap.DraftFlag, "todo_list"}
+	if !reflect.DeepEqual(status.Flags, wantFlags) {
+		t.Errorf("Flags = %v, want %v", status.Flags, wantFlags)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	mb := &mailbox{view: testStore().views[domain.FolderInbox]}
+	tests := []struct {
+		set  string
+		uid  bool
+		want []uint32 // sequence numbers
+	}{
+		{"1", false, []uint32{1}},
+		{"2:3", false, []uint32{2, 3}},
+		{"*", false, []uint32{3}},
+		{"5:*", false, []uint32{3}},
+		{"4", false, nil},
+		{"7", true, []uint32{2}},
+		{"1:6", true, []uint32{1}},
+		{"8:*", true, []uint32{3}},
+		{"20:*", true, []uint32{3}},
+		{"4:6", true, nil},
+	}
+	for _, tt := range tests {
+		set, err := goimap.ParseSeqSet(tt.set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []uint32
+		for _, s := range mb.match(tt.uid, set) {
+			got = append(got, s.seq)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("match(uid %v, %s) = %v, want %v", tt.uid, tt.set, got, tt.want)
+		}
+	}
+	if got := (&mailbox{}).match(false, &goimap.SeqSet{}); got != nil {
+		t.Errorf("match on an empty mailbox = %v", got)
+	}
+}
+
+func listMessages(t *testing.T, mb backend.Mailbox, uid bool, set string, items ...goimap.FetchItem) []*goimap.Message {
+	t.Helper()
+	seqset, _ := goimap.ParseSeqSet(set)
+	ch := make(chan *goimap.Message, 10)
+	if err := mb.ListMessages(uid, seqset, items, ch); err != nil {
+		t.Fatal(err)
+	}
+	var msgs []*goimap.Message
+	for m := range ch {
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+func TestListMessagesWithoutContent(t *testing.T) {
+	store := testStore()
+	mb, _ := login(t, store).GetMailbox("INBOX")
+	msgs := listMessages(t, mb, true, "1:*", goimap.FetchUid, goimap.FetchFlags, goimap.FetchInternalDate)
+	if len(store.fetched) != 0 {
+		t.Errorf("flags only fetch loaded messages %v", store.fetched)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("got %d messages, want 3", len(msgs))
+	}
+	if m := msgs[0]; m.SeqNum != 1 || m.Uid != 3 || !m.InternalDate.Equal(received) ||
+		!reflect.DeepEqual(m.Flags, []string{goimap.SeenFlag, goimap.FlaggedFlag}) {
+		t.Errorf("first message = %+v", m)
+	}
+}
+
+func TestListMessagesWithContent(t *testing.T) {
+	store := testStore()
+	mb, _ := login(t, store).GetMailbox("INBOX")
+	header, _ := goimap.ParseBodySectionName("BODY[HEADER.FIELDS (SUBJECT)]")
+	text, _ := goimap.ParseBodySectionName("BODY[1]")
+	missing, _ := goimap.ParseBodySectionName("BODY[4]")
+	msgs := listMessages(t, mb, false, "1:*",
+		goimap.FetchEnvelope, goimap.FetchRFC822Size, goimap.FetchBodyStructure,
+		header.FetchItem(), text.FetchItem(), missing.FetchItem())
+
+	// The message deleted since the folder was selected is left out.
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages, want 2", len(msgs))
+	}
+	if !reflect.DeepEqual(store.fetched, [][]string{{"m1", "m2", "gone"}}) {
+		t.Errorf("loaded %v, want one batch of the selection", store.fetched)
+	}
+	m := msgs[1]
+	if m.SeqNum != 2 || m.Envelope.Subject != "Invoice" || m.Size == 0 {
+		t.Errorf("message = %+v", m)
+	}
+	if from := m.Envelope.From[0]; from.MailboxName != "eve" || from.HostName != "example.net" {
+		t.Errorf("From = %+v", from)
+	}
+	if bs := m.BodyStructure; bs.MIMEType != "multipart" || len(bs.Parts) != 1 || bs.Parts[0].MIMESubType != "plain" {
+		t.Errorf("body structure = %+v", bs)
+	}
+	read := func(l goimap.Literal) string {
+		if l == nil {
+			return "<nil>"
+		}
+		b, _ := io.ReadAll(l)
+		return string(b)
+	}
+	if got := read(m.GetBody(header)); got != "Subject: Invoice\r\n\r\n" {
+		t.Errorf("header section = %q", got)
+	}
+	if got := read(m.GetBody(text)); got != "Body of Invoice" {
+		t.Errorf("first part = %q", got)
+	}
+	answered := false
+	for section, literal := range m.Body {
+		if section.Equal(missing) {
+			answered = true
+			if literal != nil {
+				t.Errorf("missing part = %q, want NIL", read(literal))
+			}
+		}
+	}
+	if !answered {
+		t.Error("missing part was not answered")
+	}
+}
+
+func TestSearchMessages(t *testing.T) {
+	tests := []struct {
+		name     string
+		criteria *goimap.SearchCriteria
+		uid      bool
+		want     []uint32
+		loads    bool
+	}{
+		{"seen", &goimap.SearchCriteria{WithFlags: []string{goimap.SeenFlag}}, false, []uint32{1}, false},
+		{"unseen by uid", &goimap.SearchCriteria{WithoutFlags: []string{goimap.SeenFlag}}, true, []uint32{7, 11}, false},
+		{"keyword", &goimap.SearchCriteria{WithFlags: []string{"todo_list"}}, false, []uint32{2}, false},
+		{"subject", &goimap.SearchCriteria{Header: map[string][]string{"Subject": {"lunch"}}}, true, []uint32{3}, true},
+		{"not body", &goimap.SearchCriteria{Not: []*goimap.SearchCriteria{{Body: []string{"Invoice"}}}}, false, []uint32{1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := testStore()
+			mb, _ := login(t, store).GetMailbox("INBOX")
+			got, err := mb.SearchMessages(tt.uid, tt.criteria)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SearchMessages = %v, want %v", got, tt.want)
+			}
+			if loaded := len(store.fetched) > 0; loaded != tt.loads {
+				t.Errorf("loaded messages = %v, want %v", loaded, tt.loads)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package imap
+
+import (
+	"bytes"
+	"time"
+
+	goimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message"
+
+	"quill/pkg/domain"
+)
+
+// delimiter separates the levels of nested folder paths.
+const delimiter = "/"
+
+// mailbox is a folder as selected by one connection. Sequence numbers are
+// positions in view, so they only change when the folder is selected again.
+type mailbox struct {
+	user       *user
+	name       string
+	folder     string
+	attributes []string
+	view       domain.FolderView
+	loaded     bool
+}
+
+func (mb *mailbox) load() error {
+	ctx, cancel := mb.user.context()
+	defer cancel()
+	view, err := mb.user.backend.messageSvc.FolderView(ctx, mb.folder)
+	if err != nil {
+		return err
+	}
+	mb.view = view
+	mb.loaded = true
+	return nil
+}
+
+func (mb *mailbox) Name() string {
+	return mb.name
+}
+
+func (mb *mailbox) Info() (*goimap.MailboxInfo, error) {
+	return &goimap.MailboxInfo{
+		Attributes: mb.attributes,
+		Delimiter:  delimiter,
+		Name:       mb.name,
+	}, nil
+}
+
+// Status always reports the mailbox read-only, so SELECT behaves like
+// EXAMINE and fetching a body never tries to set \Seen.
+func (mb *mailbox) Status(items []goimap.StatusItem) (*goimap.MailboxStatus, error) {
+	if !mb.loaded {
+		if err := mb.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	status := goimap.NewMailboxStatus(mb.name, items)
+	status.ReadOnly = true
+	status.Flags = mailboxFlags(mb.view.Entries)
+	status.PermanentFlags = []string{}
+
+	var unseen uint32
+	for i, e := range mb.view.Entries {
+		if !e.Read {
+			if unseen == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+			unseen++
+		}
+	}
+
+	for _, item := range items {
+		switch item {
+		case goimap.StatusMessages:
+			status.Messages = uint32(len(mb.view.Entries))
+		case goimap.StatusUidNext:
+			status.UidNext = mb.view.UIDNext
+		case goimap.StatusUidValidity:
+			status.UidValidity = mb.view.UIDValidity
+		case goimap.StatusRecent:
+			status.Recent = 0
+		case goimap.StatusUnseen:
+			status.Unseen = unseen
+		}
+	}
+	return status, nil
+}
+
+// SetSubscribed succeeds without effect: every folder is subscribed.
+func (mb *mailbox) SetSubscribed(subscribed bool) error {
+	return nil
+}
+
+func (mb *mailbox) Check() error {
+	return nil
+}
+
+// selected is an entry of the view with its sequence number.
+type selected struct {
+	seq   uint32
+	entry domain.FolderViewEntry
+}
+
+// match returns the entries in seqset, read as UIDs if uid is set.
+func (mb *mailbox) match(uid bool, seqset *goimap.SeqSet) []selected {
+	entries := mb.view.Entries
+	if len(entries) == 0 {
+		return nil
+	}
+	last := uint32(len(entries))
+	if uid {
+		last = entries[len(entries)-1].UID
+	}
+
+	// "*" is the last message, also when a range "n:*" starts beyond it.
+	star := false
+	for _, s := range seqset.Set {
+		if s.Stop == 0 {
+			star = true
+		}
+	}
+
+	var result []selected
+	for i, e := range entries {
+		id := uint32(i + 1)
+		if uid {
+			id = e.UID
+		}
+		if seqset.Contains(id) || (star && id == last) {
+			result = append(result, selected{seq: uint32(i + 1), entry: e})
+		}
+	}
+	return result
+}
+
+func (mb *mailbox) ListMessages(uid bool, seqset *goimap.SeqSet, items []goimap.FetchItem, ch chan<- *goimap.Message) error {
+	defer close(ch)
+
+	matched := mb.match(uid, seqset)
+	var rendered map[string][]byte
+	if fetchNeedsContent(items) {
+		var err error
+		if rendered, err = mb.render(matched); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range matched {
+		var raw []byte
+		if rendered != nil {
+			var ok bool
+			if raw, ok = rendered[s.entry.MessageID]; !ok {
+				continue // deleted since the folder was selected
+			}
+		}
+		msg, err := fetch(s.seq, s.entry, raw, items)
+		if err != nil {
+			return err
+		}
+		ch <- msg
+	}
+	return nil
+}
+
+func (mb *mailbox) SearchMessages(uid bool, criteria *goimap.SearchCriteria) ([]uint32, error) {
+	all := make([]selected, len(mb.view.Entries))
+	for i, e := range mb.view.Entries {
+		all[i] = selected{seq: uint32(i + 1), entry: e}
+	}
+	var rendered map[string][]byte
+	if searchNeedsContent(criteria) {
+		var err error
+		if rendered, err = mb.render(all); err != nil {
+			return nil, err
+		}
+	}
+
+	var ids []uint32
+	for _, s := range all {
+		entity := &message.Entity{}
+		if rendered != nil {
+			raw, ok := rendered[s.entry.MessageID]
+			if !ok {
+				continue
+			}
+			var err error
+			if entity, err = message.Read(bytes.NewReader(raw)); err != nil && !message.IsUnknownCharset(err) {
+				continue
+			}
+		}
+		ok, err := backendutil.Match(entity, s.seq, s.entry.UID, s.entry.ReceivedAt, imapFlags(s.entry), criteria)
+		if err != nil || !ok {
+			continue
+		}
+		if uid {
+			ids = append(ids, s.entry.UID)
+		} else {
+			ids = append(ids, s.seq)
+		}
+	}
+	return ids, nil
+}
+
+func (mb *mailbox) CreateMessage(flags []string, date time.Time, body goimap.Literal) error {
+	return errReadOnly
+}
+
+func (mb *mailbox) UpdateMessagesFlags(uid bool, seqset *goimap.SeqSet, operation goimap.FlagsOp, flags []string) error {
+	return errReadOnly
+}
+
+func (mb *mailbox) CopyMessages(uid bool, seqset *goimap.SeqSet, dest string) error {
+	return errReadOnly
+}
+
+func (mb *mailbox) Expunge() error {
+	return errReadOnly
+}
@@ -0,0 +1,226 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"sort"
+	"strings"
+
+	goimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message/textproto"
+
+	"quill/pkg/domain"
+	"quill/pkg/transport/smtp"
+)
+
+// renderBatch is how many messages are loaded from storage at a time.
+const renderBatch = 100
+
+// systemFlags maps Quill flags to the IMAP flags clients know. Other
+// flags become keywords.
+var systemFlags = map[string]string{
+	"starred":   goimap.FlaggedFlag,
+	"flagged":   goimap.FlaggedFlag,
+	"answered":  goimap.AnsweredFlag,
+	"draft":     goimap.DraftFlag,
+	"important": goimap.ImportantFlag,
+}
+
+// imapFlags returns the IMAP flags of an entry: \Seen for read entries and
+// one flag or keyword per Quill flag.
+func imapFlags(e domain.FolderViewEntry) []string {
+	var flags []string
+	seen := make(map[string]bool)
+	add := func(f string) {
+		if f != "" && !seen[f] {
+			seen[f] = true
+			flags = append(flags, f)
+		}
+	}
+	if e.Read {
+		add(goimap.SeenFlag)
+	}
+	for _, f := range e.Flags {
+		if mapped, ok := systemFlags[strings.ToLower(f)]; ok {
+			add(mapped)
+		} else {
+			add(keyword(f))
+		}
+	}
+	return flags
+}
+
+// keyword turns a Quill flag into an IMAP atom by replacing the characters
+// an atom may not contain.
+func keyword(flag string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(`(){%*"\]`, r) {
+			return '_'
+		}
+		return r
+	}, flag)
+}
+
+// mailboxFlags lists the standard flags and every keyword in use.
+func mailboxFlags(entries []domain.FolderViewEntry) []string {
+	flags := []string{goimap.SeenFlag, goimap.AnsweredFlag, goimap.FlaggedFlag, goimap.DraftFlag}
+	known := make(map[string]bool)
+	for _, f := range flags {
+		known[f] = true
+	}
+	var keywords []string
+	for _, e := range entries {
+		for _, f := range imapFlags(e) {
+			if !known[f] {
+				known[f] = true
+				keywords = append(keywords, f)
+			}
+		}
+	}
+	sort.Strings(keywords)
+	return append(flags, keywords...)
+}
+
+// fetchNeedsContent reports whether any item needs the rendered message.
+func fetchNeedsContent(items []goimap.FetchItem) bool {
+	for _, item := range items {
+		switch item {
+		case goimap.FetchFlags, goimap.FetchInternalDate, goimap.FetchUid:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// searchNeedsContent reports whether criteria look at headers or bodies
+// rather than only at flags, dates and numbers.
+func searchNeedsContent(c *goimap.SearchCriteria) bool {
+	if len(c.Header) > 0 || len(c.Body) > 0 || len(c.Text) > 0 ||
+		c.Larger > 0 || c.Smaller > 0 || !c.SentBefore.IsZero() || !c.SentSince.IsZero() {
+		return true
+	}
+	for _, not := range c.Not {
+		if searchNeedsContent(not) {
+			return true
+		}
+	}
+	for _, or := range c.Or {
+		if searchNeedsContent(or[0]) || searchNeedsContent(or[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// render loads the selected messages and renders them to MIME, keyed by
+// message ID. Messages deleted since the view was taken are missing.
+func (mb *mailbox) render(sel []selected) (map[string][]byte, error) {
+	ctx, cancel := mb.user.context()
+	defer cancel()
+
+	owner := mb.user.principal.Address()
+	rendered := make(map[string][]byte, len(sel))
+	for start := 0; start < len(sel); start += renderBatch {
+		end := min(start+renderBatch, len(sel))
+		ids := make([]string, 0, end-start)
+		for _, s := range sel[start:end] {
+			ids = append(ids, s.entry.MessageID)
+		}
+		messages, err := mb.user.backend.messageSvc.GetMessages(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range messages {
+			raw, err := smtp.RenderMessage(outboundOf(m, owner))
+			if err != nil {
+				return nil, err
+			}
+			rendered[m.MessageID] = raw
+		}
+	}
+	return rendered, nil
+}
+
+// outboundOf wraps a stored message for rendering. Bcc recipients are only
+// shown in the sender's own copy.
+func outboundOf(m domain.Message, owner string) *domain.OutboundMessage {
+	req := domain.DomainSendRequest{
+		From:          m.From,
+		To:            m.To,
+		CC:            m.CC,
+		Subject:       m.Subject,
+		Body:          m.Body,
+		Attachments:   m.Attachments,
+		ListID:        m.ListID,
+		ReplyTo:       m.ReplyTo,
+		AutoSubmitted: m.AutoSubmitted,
+	}
+	if m.From == owner {
+		req.BCC = m.BCC
+	}
+	return &domain.OutboundMessage{
+		MessageID: m.MessageID,
+		ThreadID:  m.ThreadID,
+		Request:   req,
+		CreatedAt: m.SentAt,
+	}
+}
+
+// fetch answers the FETCH items for one entry. raw is the rendered message,
+// nil when no item needs it.
+func fetch(seq uint32, e domain.FolderViewEntry, raw []byte, items []goimap.FetchItem) (*goimap.Message, error) {
+	msg := goimap.NewMessage(seq, items)
+	for _, item := range items {
+		switch item {
+		case goimap.FetchEnvelope:
+			hdr, _, err := split(raw)
+			if err != nil {
+				return nil, err
+			}
+			if msg.Envelope, err = backendutil.FetchEnvelope(hdr); err != nil {
+				return nil, err
+			}
+		case goimap.FetchBody, goimap.FetchBodyStructure:
+			hdr, body, err := split(raw)
+			if err != nil {
+				return nil, err
+			}
+			if msg.BodyStructure, err = backendutil.FetchBodyStructure(hdr, body, item == goimap.FetchBodyStructure); err != nil {
+				return nil, err
+			}
+		case goimap.FetchFlags:
+			msg.Flags = imapFlags(e)
+		case goimap.FetchInternalDate:
+			msg.InternalDate = e.ReceivedAt
+		case goimap.FetchRFC822Size:
+			msg.Size = uint32(len(raw))
+		case goimap.FetchUid:
+			msg.Uid = e.UID
+		default:
+			section, err := goimap.ParseBodySectionName(item)
+			if err != nil {
+				continue
+			}
+			hdr, body, err := split(raw)
+			if err != nil {
+				return nil, err
+			}
+			literal, err := backendutil.FetchBodySection(hdr, body, section)
+			if err != nil {
+				// A missing part is answered with NIL, not an error.
+				literal = nil
+			}
+			msg.Body[section] = literal
+		}
+	}
+	return msg, nil
+}
+
+// split parses the header of a rendered message and returns the rest.
+func split(raw []byte) (textproto.Header, *bufio.Reader, error) {
+	body := bufio.NewReader(bytes.NewReader(raw))
+	hdr, err := textproto.ReadHeader(body)
+	return hdr, body, err
+}
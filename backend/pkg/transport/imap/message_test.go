@@ -0,0 +1,91 @@
+package imap
+
+import (
+	"reflect"
+	"testing"
+
+	goimap "github.com/emersion/go-imap"
+
+	"quill/pkg/domain"
+)
+
+func TestIMAPFlags(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry domain.FolderViewEntry
+		want  []string
+	}{
+		{"unread", domain.FolderViewEntry{}, nil},
+		{"read", domain.FolderViewEntry{Read: true}, []string{goimap.SeenFlag}},
+		{"system flags", domain.FolderViewEntry{Flags: []string{"Starred", "answered", "draft", "important"}},
+			[]string{goimap.FlaggedFlag, goimap.AnsweredFlag, goimap.DraftFlag, goimap.ImportantFlag}},
+		{"duplicates", domain.FolderViewEntry{Flags: []string{"starred", "flagged"}}, []string{goimap.FlaggedFlag}},
+		{"keywords", domain.FolderViewEntry{Read: true, Flags: []string{"to do", "a(b)*%\"c\\]", "ünï"}},
+			[]string{goimap.SeenFlag, "to_do", "a_b____c__", "_n_"}},
+		{"empty flag", domain.FolderViewEntry{Flags: []string{""}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := imapFlags(tt.entry); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("imapFlags = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMailboxFlags(t *testing.T) {
+	entries := []domain.FolderViewEntry{
+		{Read: true, Flags: []string{"zeta", "starred"}},
+		{Flags: []string{"alpha", "zeta"}},
+	}
+	want := []string{goimap.SeenFlag, goimap.AnsweredFlag, goimap.FlaggedFlag, goimap.DraftFlag, "alpha", "zeta"}
+	if got := mailboxFlags(entries); !reflect.DeepEqual(got, want) {
+		t.Errorf("mailboxFlags = %q, want %q", got, want)
+	}
+}
+
+func TestNeedsContent(t *testing.T) {
+	fetches := []struct {
+		items []goimap.FetchItem
+		want  bool
+	}{
+		{[]goimap.FetchItem{goimap.FetchUid, goimap.FetchFlags, goimap.FetchInternalDate}, false},
+		{[]goimap.FetchItem{goimap.FetchUid, goimap.FetchRFC822Size}, true},
+		{[]goimap.FetchItem{goimap.FetchEnvelope}, true},
+		{[]goimap.FetchItem{"BODY.PEEK[HEADER]"}, true},
+	}
+	for _, tt := range fetches {
+		if got := fetchNeedsContent(tt.items); got != tt.want {
+			t.Errorf("fetchNeedsContent(%v) = %v, want %v", tt.items, got, tt.want)
+		}
+	}
+
+	searches := []struct {
+		name string
+		c    *goimap.SearchCriteria
+		want bool
+	}{
+		{"flags", &goimap.SearchCriteria{WithFlags: []string{goimap.SeenFlag}}, false},
+		{"uid", &goimap.SearchCriteria{Uid: &goimap.SeqSet{}}, false},
+		{"header", &goimap.SearchCriteria{Header: map[string][]string{"From": {"ada"}}}, true},
+		{"larger", &goimap.SearchCriteria{Larger: 100}, true},
+		{"text in not", &goimap.SearchCriteria{Not: []*goimap.SearchCriteria{{Text: []string{"x"}}}}, true},
+		{"body in or", &goimap.SearchCriteria{Or: [][2]*goimap.SearchCriteria{{{}, {Body: []string{"x"}}}}}, true},
+		{"flags in or", &goimap.SearchCriteria{Or: [][2]*goimap.SearchCriteria{{{}, {WithFlags: []string{"x"}}}}}, false},
+	}
+	for _, tt := range searches {
+		if got := searchNeedsContent(tt.c); got != tt.want {
+			t.Errorf("searchNeedsContent(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOutboundOfShowsBccToSender(t *testing.T) {
+	m := domain.Message{MessageID: "m1", ThreadID: "t1", From: "ada~example.com", BCC: []string{"eve~example.com"}}
+	if got := outboundOf(m, "ada~example.com").Request.BCC; !reflect.DeepEqual(got, m.BCC) {
+		t.Errorf("sender's copy Bcc = %q, want %q", got, m.BCC)
+	}
+	if got := outboundOf(m, "bob~example.com").Request.BCC; got != nil {
+		t.Errorf("recipient's copy Bcc = %q, want none", got)
+	}
+}
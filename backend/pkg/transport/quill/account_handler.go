@@ -0,0 +1,124 @@
+package quill
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"quill/pkg/domain"
+	"quill/pkg/models"
+)
+
+// exportDownloadPath is where the HTTPS API serves a finished archive.
+const exportDownloadPath = "/me/exports/%s/archive"
+
+func (h *MessageHandler) handleDeleteAccount(ctx context.Context, conn PacketConn, payload json.RawMessage) {
+	var req DeleteAccountPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "Cannot parse DELETE_ACCOUNT payload: "+err.Error())
+		return
+	}
+
+	// 1) Call service for the requested action
+	var (
+		user *models.User
+		err  error
+	)
+	switch req.Action {
+	case DeleteAccountActionRequest:
+		user, err = h.userSvc.DeleteAccount(ctx)
+	case DeleteAccountActionCancel:
+		user, err = h.userSvc.CancelAccountDeletion(ctx)
+	default:
+		h.writeErrorResponse(conn, ErrorCodeInvalidAction, fmt.Sprintf("Invalid delete account action %q", req.Action))
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: service call to %s account deletion failed: %v", req.Action, err)
+		switch {
+		case errors.Is(err, domain.ErrUserNotFound):
+			h.writeErrorResponse(conn, ErrorCodeNotFound, err.Error())
+		case errors.Is(err, domain.ErrDeletionNotRequested):
+			h.writeErrorResponse(conn, ErrorCodeNotFound, err.Error())
+		case errors.Is(err, domain.ErrPermissionDenied):
+			h.writeErrorResponse(conn, ErrorCodePermissionDenied, "Account deletion requires an interactive sign-in.")
+		default:
+			h.writeErrorResponse(conn, ErrorCodeServiceError, "Failed to manage account deletion.")
+		}
+		return
+	}
+
+	// 2) Construct and send response
+	resp := DeleteAccountResponsePayload{Status: StatusOK, Action: req.Action}
+	if !user.DeleteAfter.IsZero() {
+		resp.DeleteAfter = &user.DeleteAfter
+	}
+	h.writeResponse(conn, PacketTypeDeleteAccountResponse, resp)
+}
+
+func (h *MessageHandler) handleExport(ctx context.Context, conn PacketConn, payload json.RawMessage) {
+	var req ExportPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "Cannot parse EXPORT payload: "+err.Error())
+		return
+	}
+
+	// 1) Call service for the requested action
+	var (
+		job *domain.ExportJob
+		err error
+	)
+	switch req.Action {
+	case ExportActionStart:
+		job, err = h.userSvc.StartExport(ctx)
+	case ExportActionStatus:
+		if req.ExportID == "" {
+			h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "status requires export_id")
+			return
+		}
+		job, err = h.userSvc.GetExport(ctx, req.ExportID)
+	default:
+		h.writeErrorResponse(conn, ErrorCodeInvalidAction, fmt.Sprintf("Invalid export action %q", req.Action))
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: service call to %s export failed: %v", req.Action, err)
+		switch {
+		case errors.Is(err, domain.ErrExportNotFound), errors.Is(err, domain.ErrUserNotFound):
+			h.writeErrorResponse(conn, ErrorCodeNotFound, err.Error())
+		case errors.Is(err, domain.ErrPermissionDenied):
+			h.writeErrorResponse(conn, ErrorCodePermissionDenied, "Data export requires an interactive sign-in.")
+		default:
+			h.writeErrorResponse(conn, ErrorCodeServiceError, "Failed to manage export.")
+		}
+		return
+	}
+
+	// 2) Construct and send response
+	h.writeResponse(conn, PacketTypeExportResponse, ExportResponsePayload{
+		Status: StatusOK,
+		Action: req.Action,
+		Export: exportToDTO(job),
+	})
+}
+
+func exportToDTO(job *domain.ExportJob) ExportDTO {
+	dto := ExportDTO{
+		ID:        job.ID,
+		State:     string(job.Status),
+		Size:      job.Size,
+		CreatedAt: job.CreatedAt,
+	}
+	if !job.CompletedAt.IsZero() {
+		dto.CompletedAt = &job.CompletedAt
+	}
+	if !job.ExpiresAt.IsZero() {
+		dto.ExpiresAt = &job.ExpiresAt
+	}
+	if job.Status == domain.ExportStatusReady {
+		dto.DownloadPath = fmt.Sprintf(exportDownloadPath, job.ID)
+	}
+	return dto
+}
@@ -3,13 +3,15 @@ package quill
 import (
 	"context"
 	"fmt"
-	"os"
 	"strings"
+	"time"
 
 	firebase "firebase.google.com/go"
 	"firebase.google.com/go/auth"
-	"github.com/joho/godotenv"
 	"google.golang.org/api/option"
+
+	"quill/pkg/config"
+	"quill/pkg/identity"
 )
 
 type AuthService interface {
@@ -21,10 +23,6 @@ type firebaseAuthService struct {
 	firebaseAuthClient *auth.Client
 }
 
-type userContextKey struct{}
-
-var userKey = userContextKey{}
-
 func NewFirebaseAuthService(client *auth.Client) AuthService {
 	return &firebaseAuthService{firebaseAuthClient: client}
 }
@@ -40,13 +38,16 @@ func (s *firebaseAuthService) Authenticate(
 	}
 
 	// Token is valid. Attach the Firebase User ID (UID) to the context.
-	return context.WithValue(ctx, "userID", token.UID), nil
+	return identity.WithPrincipal(ctx, &identity.Principal{
+		AccountID: token.UID,
+		Method:    identity.AuthMethodFirebase,
+		ExpiresAt: time.Unix(token.Expires, 0).UTC(),
+	}), nil
 }
 
+// UserIDFromContext returns the account ID of the authenticated principal.
 func UserIDFromContext(ctx context.Context) (string, bool) {
-	v := ctx.Value("userID")
-	id, ok := v.(string)
-	return id, ok
+	return identity.AccountID(ctx)
 }
 
 func InitAuthService(ctx context.Context, credPath string) (AuthService, error) {
@@ -62,16 +63,56 @@ func InitAuthService(ctx context.Context, credPath string) (AuthService, error)
 	return &firebaseAuthService{firebaseAuthClient: client}, nil
 }
 
-func InitAuthServiceFromEnv(ctx context.Context, envPath string) (AuthService, error) {
-	if err := godotenv.Load(envPath); err != nil {
-		return nil, fmt.Errorf("loading .env: %w", err)
+// InitAuthServiceFromConfig builds the auth backends named in cfg.Backends
+// ("firebase", "jwt", "credentials"). creds backs the "credentials" backend
+// and may be nil when it is not selected.
+func InitAuthServiceFromConfig(ctx context.Context, cfg config.AuthConfig, creds CredentialVerifier) (AuthService, error) {
+	var services []AuthService
+	for _, name := range cfg.Backends {
+		switch name {
+		case "firebase":
+			if cfg.FirebaseServiceAccount == "" {
+				return nil, fmt.Errorf("auth.firebase_service_account not set")
+			}
+			svc, err := InitAuthService(ctx, cfg.FirebaseServiceAccount)
+			if err != nil {
+				return nil, err
+			}
+			services = append(services, svc)
+		case "jwt":
+			if cfg.JWTKeys == "" {
+				return nil, fmt.Errorf("auth.jwt_keys not set")
+			}
+			jwtCfg, err := LoadJWTConfig(cfg.JWTKeys)
+			if err != nil {
+				return nil, err
+			}
+			if cfg.JWTIssuer != "" {
+				jwtCfg.Issuer = cfg.JWTIssuer
+			}
+			if cfg.JWTAudience != "" {
+				jwtCfg.Audience = cfg.JWTAudience
+			}
+			svc, err := NewJWTAuthService(jwtCfg)
+			if err != nil {
+				return nil, err
+			}
+			services = append(services, svc)
+		case "credentials":
+			if creds == nil {
+				return nil, fmt.Errorf("credentials backend selected but no credential store given")
+			}
+			services = append(services, NewCredentialAuthService(creds))
+		default:
+			return nil, fmt.Errorf("unknown auth backend %q", name)
+		}
 	}
-
-	credPath := os.Getenv("firebase_service_account_path")
-	if credPath == "" {
-		return nil, fmt.Errorf("firebase_service_account_path not set")
+	if len(services) == 0 {
+		return nil, fmt.Errorf("no auth backend configured")
 	}
 
-	// now call your existing InitAuthService
-	return InitAuthService(ctx, credPath)
+	if len(services) == 1 {
+		return services[0], nil
+	}
+	return NewChainAuthService(services...), nil
 }
@@ -0,0 +1,87 @@
+package quill
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"quill/pkg/domain"
+	"quill/pkg/identity"
+)
+
+// CredentialVerifier resolves API keys and app passwords to account IDs.
+type CredentialVerifier interface {
+	VerifyAPIKey(ctx context.Context, key string) (string, error)
+	VerifyAppPassword(ctx context.Context, address, password string) (string, error)
+}
+
+type credentialAuthService struct {
+	creds CredentialVerifier
+}
+
+// NewCredentialAuthService accepts API keys ("qk_...") and app passwords
+// sent as "Basic base64(address:password)".
+func NewCredentialAuthService(creds CredentialVerifier) AuthService {
+	return &credentialAuthService{creds: creds}
+}
+
+var errNotCredential = errors.New("token is not an API key or app password")
+
+func (s *credentialAuthService) Authenticate(ctx context.Context, token string) (context.Context, error) {
+	var (
+		userID string
+		method identity.AuthMethod
+		err    error
+	)
+	switch {
+	case strings.HasPrefix(token, domain.APIKeyPrefix):
+		method = identity.AuthMethodAPIKey
+		userID, err = s.creds.VerifyAPIKey(ctx, token)
+	case strings.HasPrefix(token, "Basic "):
+		raw, decodeErr := base64.StdEncoding.DecodeString(strings.TrimPrefix(token, "Basic "))
+		if decodeErr != nil {
+			return ctx, fmt.Errorf("malformed basic credentials: %w", decodeErr)
+		}
+		address, password, ok := strings.Cut(string(raw), ":")
+		if !ok {
+			return ctx, errors.New("malformed basic credentials")
+		}
+		method = identity.AuthMethodAppPassword
+		userID, err = s.creds.VerifyAppPassword(ctx, address, password)
+	default:
+		return ctx, errNotCredential
+	}
+	if err != nil {
+		return ctx, fmt.Errorf("credential rejected: %w", err)
+	}
+	return identity.WithPrincipal(ctx, &identity.Principal{AccountID: userID, Method: method}), nil
+}
+
+type chainAuthService struct {
+	services []AuthService
+}
+
+// NewChainAuthService tries each backend in order and accepts the first
+// that authenticates the token.
+func NewChainAuthService(services ...AuthService) AuthService {
+	return &chainAuthService{services: services}
+}
+
+func (s *chainAuthService) Authenticate(ctx context.Context, token string) (context.Context, error) {
+	var errs []error
+	for _, svc := range s.services {
+		authCtx, err := svc.Authenticate(ctx, token)
+		if err == nil {
+			return authCtx, nil
+		}
+		if !errors.Is(err, errNotCredential) {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return ctx, errNotCredential
+	}
+	return ctx, errors.Join(errs...)
+}
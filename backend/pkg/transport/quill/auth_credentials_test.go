@@ -0,0 +1,101 @@
+package quill
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"quill/pkg/identity"
+)
+
+// fakeCredentials accepts one API key and one app password.
+type fakeCredentials struct{}
+
+func (fakeCredentials) VerifyAPIKey(_ context.Context, key string) (string, error) {
+	if key == "qk_id_secret" {
+		return "u1", nil
+	}
+	return "", errors.New("unknown key")
+}
+
+func (fakeCredentials) VerifyAppPassword(_ context.Context, address, password string) (string, error) {
+	if address == "ada~example.com" && password == "pass:word" {
+		return "u2", nil
+	}
+	return "", errors.New("wrong password")
+}
+
+func basic(s string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestCredentialAuthenticate(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		wantUser   string
+		wantMethod identity.AuthMethod
+		notCred    bool
+	}{
+		{"api key", "qk_id_secret", "u1", identity.AuthMethodAPIKey, false},
+		{"app password with colon", basic("ada~example.com:pass:word"), "u2", identity.AuthMethodAppPassword, false},
+		{"wrong api key", "qk_id_other", "", "", false},
+		{"wrong password", basic("ada~example.com:nope"), "", "", false},
+		{"basic without colon", basic("ada~example.com"), "", "", false},
+		{"basic not base64", "Basic !!", "", "", false},
+		{"bearer token", "Bearer eyJ", "", "", true},
+	}
+	svc := NewCredentialAuthService(fakeCredentials{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, err := svc.Authenticate(context.Background(), tt.token)
+			if tt.wantUser == "" {
+				if err == nil {
+					t.Fatal("token accepted, want an error")
+				}
+				if got := errors.Is(err, errNotCredential); got != tt.notCred {
+					t.Errorf("errNotCredential = %v, want %v (err %v)", got, tt.notCred, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, _ := identity.FromContext(ctx)
+			if p == nil || p.AccountID != tt.wantUser || p.Method != tt.wantMethod {
+				t.Errorf("principal = %+v, want %s by %s", p, tt.wantUser, tt.wantMethod)
+			}
+		})
+	}
+}
+
+// authFunc adapts a function to AuthService.
+type authFunc func(ctx context.Context, token string) (context.Context, error)
+
+func (f authFunc) Authenticate(ctx context.Context, token string) (context.Context, error) {
+	return f(ctx, token)
+}
+
+func TestChainAuthenticate(t *testing.T) {
+	rejects := authFunc(func(ctx context.Context, _ string) (context.Context, error) {
+		return ctx, errors.New("bad signature")
+	})
+	declines := authFunc(func(ctx context.Context, _ string) (context.Context, error) {
+		return ctx, errNotCredential
+	})
+	accepts := authFunc(func(ctx context.Context, _ string) (context.Context, error) {
+		return identity.WithPrincipal(ctx, &identity.Principal{AccountID: "u1"}), nil
+	})
+
+	if _, err := NewChainAuthService(rejects, accepts).Authenticate(context.Background(), "t"); err != nil {
+		t.Errorf("a later backend accepting: %v", err)
+	}
+	if _, err := NewChainAuthService(declines, declines).Authenticate(context.Background(), "t"); !errors.Is(err, errNotCredential) {
+		t.Errorf("every backend declining: %v, want errNotCredential", err)
+	}
+	_, err := NewChainAuthService(declines, rejects).Authenticate(context.Background(), "t")
+	if err == nil || errors.Is(err, errNotCredential) {
+		t.Errorf("a backend rejecting: %v, want its error alone", err)
+	}
+}
@@ -0,0 +1,258 @@
+package quill
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+	"time"
+
+	"quill/pkg/identity"
+)
+
+// jwtLeeway tolerates clock skew between the token issuer and this server.
+const jwtLeeway = 30 * time.Second
+
+// JWTKey is one entry of a JWT key set file. HS* keys carry a base64
+// secret, RS* and EdDSA keys a PEM-encoded public key.
+type JWTKey struct {
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Secret    string `json:"secret,omitempty"`
+	PublicKey string `json:"public_key,omitempty"`
+
+	key interface{}
+}
+
+// JWTConfig configures verification of locally signed tokens.
+type JWTConfig struct {
+	Keys     []JWTKey `json:"keys"`
+	Issuer   string   `json:"issuer,omitempty"`
+	Audience string   `json:"audience,omitempty"`
+}
+
+type jwtAuthService struct {
+	cfg JWTConfig
+}
+
+// NewJWTAuthService verifies JWTs signed with one of cfg.Keys. The token's
+// "sub" claim is the account ID.
+func NewJWTAuthService(cfg JWTConfig) (AuthService, error) {
+	if len(cfg.Keys) == 0 {
+		return nil, errors.New("jwt: no keys configured")
+	}
+	for i := range cfg.Keys {
+		if err := cfg.Keys[i].parse(); err != nil {
+			return nil, fmt.Errorf("jwt: key %q: %w", cfg.Keys[i].KeyID, err)
+		}
+	}
+	return &jwtAuthService{cfg: cfg}, nil
+}
+
+// LoadJWTConfig reads a key set file in the JWTConfig JSON format.
+func LoadJWTConfig(path string) (JWTConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return JWTConfig{}, fmt.Errorf("reading jwt key set: %w", err)
+	}
+	var cfg JWTConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return JWTConfig{}, fmt.Errorf("parsing jwt key set: %w", err)
+	}
+	return cfg, nil
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+}
+
+func (s *jwtAuthService) Authenticate(ctx context.Context, token string) (context.Context, error) {
+	token = strings.TrimPrefix(token, "Bearer ")
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ctx, errors.New("jwt: malformed token")
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return ctx, fmt.Errorf("jwt: header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ctx, fmt.Errorf("jwt: signature: %w", err)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for i := range s.cfg.Keys {
+		k := &s.cfg.Keys[i]
+		if k.Algorithm != header.Algorithm || (header.KeyID != "" && k.KeyID != header.KeyID) {
+			continue
+		}
+		if k.verify(signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return ctx, errors.New("jwt: signature verification failed")
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return ctx, fmt.Errorf("jwt: claims: %w", err)
+	}
+	if err := s.checkClaims(claims, time.Now()); err != nil {
+		return ctx, err
+	}
+
+	return identity.WithPrincipal(ctx, &identity.Principal{
+		AccountID: claims.Subject,
+		Method:    identity.AuthMethodJWT,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC(),
+	}), nil
+}
+
+func (s *jwtAuthService) checkClaims(c jwtClaims, now time.Time) error {
+	if c.Subject == "" {
+		return errors.New("jwt: missing sub claim")
+	}
+	if c.ExpiresAt == 0 {
+		return errors.New("jwt: missing exp claim")
+	}
+	if now.Add(-jwtLeeway).After(time.Unix(c.ExpiresAt, 0)) {
+		return errors.New("jwt: token expired")
+	}
+	if c.NotBefore != 0 && now.Add(jwtLeeway).Before(time.Unix(c.NotBefore, 0)) {
+		return errors.New("jwt: token not yet valid")
+	}
+	if s.cfg.Issuer != "" && c.Issuer != s.cfg.Issuer {
+		return fmt.Errorf("jwt: unexpected issuer %q", c.Issuer)
+	}
+	if s.cfg.Audience != "" && !audienceContains(c.Audience, s.cfg.Audience) {
+		return errors.New("jwt: token not issued for this audience")
+	}
+	return nil
+}
+
+// audienceContains handles "aud" as either a string or an array of strings.
+func audienceContains(raw json.RawMessage, want string) bool {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return single == want
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return false
+	}
+	for _, a := range list {
+		if a == want {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (k *JWTKey) parse() error {
+	switch k.Algorithm {
+	case "HS256", "HS384", "HS512":
+		secret, err := base64.StdEncoding.DecodeString(k.Secret)
+		if err != nil {
+			return fmt.Errorf("secret: %w", err)
+		}
+		if len(secret) < 32 {
+			return errors.New("secret must be at least 32 bytes")
+		}
+		k.key = secret
+	case "RS256", "RS384", "RS512", "EdDSA":
+		block, _ := pem.Decode([]byte(k.PublicKey))
+		if block == nil {
+			return errors.New("public_key is not PEM encoded")
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("public_key: %w", err)
+		}
+		switch pub.(type) {
+		case *rsa.PublicKey:
+			if k.Algorithm == "EdDSA" {
+				return errors.New("EdDSA needs an Ed25519 key")
+			}
+		case ed25519.PublicKey:
+			if k.Algorithm != "EdDSA" {
+				return fmt.Errorf("%s needs an RSA key", k.Algorithm)
+			}
+		default:
+			return fmt.Errorf("unsupported public key type %T", pub)
+		}
+		k.key = pub
+	default:
+		return fmt.Errorf("unsupported algorithm %q", k.Algorithm)
+	}
+	return nil
+}
+
+func (k *JWTKey) verify(signed, sig []byte) bool {
+	switch key := k.key.(type) {
+	case []byte:
+		mac := hmac.New(jwtHash(k.Algorithm), key)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case *rsa.PublicKey:
+		var h crypto.Hash
+		switch k.Algorithm {
+		case "RS256":
+			h = crypto.SHA256
+		case "RS384":
+			h = crypto.SHA384
+		default:
+			h = crypto.SHA512
+		}
+		d := h.New()
+		d.Write(signed)
+		return rsa.VerifyPKCS1v15(key, h, d.Sum(nil), sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, signed, sig)
+	}
+	return false
+}
+
+func jwtHash(alg string) func() hash.Hash {
+	switch alg {
+	case "HS384":
+		return sha512.New384
+	case "HS512":
+		return sha512.New
+	default:
+		return sha256.New
+	}
+}
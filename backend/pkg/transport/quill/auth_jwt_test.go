@@ -0,0 +1,162 @@
+package quill
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"quill/pkg/identity"
+)
+
+func jwtPart(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func pemPublicKey(t *testing.T, pub interface{}) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	secret := []byte(strings.Repeat("k", 32))
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := NewJWTAuthService(JWTConfig{
+		Keys: []JWTKey{
+			{KeyID: "hs", Algorithm: "HS256", Secret: base64.StdEncoding.EncodeToString(secret)},
+			{KeyID: "ed", Algorithm: "EdDSA", PublicKey: pemPublicKey(t, edPub)},
+			{KeyID: "rs", Algorithm: "RS256", PublicKey: pemPublicKey(t, &rsaKey.PublicKey)},
+		},
+		Issuer:   "https://id.example.com",
+		Audience: "quill",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := map[string]func([]byte) []byte{
+		"HS256": func(b []byte) []byte {
+			mac := hmac.New(sha256.New, secret)
+			mac.Write(b)
+			return mac.Sum(nil)
+		},
+		"EdDSA": func(b []byte) []byte { return ed25519.Sign(edPriv, b) },
+		"RS256": func(b []byte) []byte {
+			d := sha256.Sum256(b)
+			sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, d[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return sig
+		},
+	}
+	now := time.Now().Unix()
+	claims := func(modify func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{"sub": "u1", "iss": "https://id.example.com", "aud": "quill", "exp": now + 60}
+		if modify != nil {
+			modify(c)
+		}
+		return c
+	}
+	token := func(alg, kid string, c map[string]interface{}) string {
+		signed := jwtPart(t, jwtHeader{Algorithm: alg, KeyID: kid}) + "." + jwtPart(t, c)
+		signer := sign[alg]
+		if signer == nil {
+			return signed + "."
+		}
+		return signed + "." + base64.RawURLEncoding.EncodeToString(signer([]byte(signed)))
+	}
+	parts := strings.Split(token("HS256", "hs", claims(nil)), ".")
+	parts[1] = jwtPart(t, claims(func(c map[string]interface{}) { c["sub"] = "root" }))
+	tampered := strings.Join(parts, ".")
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"HS256", token("HS256", "hs", claims(nil)), true},
+		{"EdDSA", token("EdDSA", "ed", claims(nil)), true},
+		{"RS256", token("RS256", "rs", claims(nil)), true},
+		{"bearer prefix", "Bearer " + token("HS256", "hs", claims(nil)), true},
+		{"no key ID", token("EdDSA", "", claims(nil)), true},
+		{"audience list", token("HS256", "hs", claims(func(c map[string]interface{}) { c["aud"] = []string{"other", "quill"} })), true},
+		{"expired within leeway", token("HS256", "hs", claims(func(c map[string]interface{}) { c["exp"] = now - 5 })), true},
+		{"expired", token("HS256", "hs", claims(func(c map[string]interface{}) { c["exp"] = now - 120 })), false},
+		{"no expiry", token("HS256", "hs", claims(func(c map[string]interface{}) { delete(c, "exp") })), false},
+		{"not yet valid", token("HS256", "hs", claims(func(c map[string]interface{}) { c["nbf"] = now + 120 })), false},
+		{"no subject", token("HS256", "hs", claims(func(c map[string]interface{}) { delete(c, "sub") })), false},
+		{"wrong issuer", token("HS256", "hs", claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example" })), false},
+		{"wrong audience", token("HS256", "hs", claims(func(c map[string]interface{}) { c["aud"] = []string{"other"} })), false},
+		{"alg none", token("none", "", claims(nil)), false},
+		{"key ID for another key", token("HS256", "ed", claims(nil)), false},
+		{"tampered claims", tampered, false},
+		{"malformed", "not-a-jwt", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, err := svc.Authenticate(context.Background(), tt.token)
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("token accepted, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, ok := identity.FromContext(ctx)
+			if !ok || p.AccountID != "u1" || p.Method != identity.AuthMethodJWT {
+				t.Errorf("principal = %+v, want u1 by JWT", p)
+			}
+		})
+	}
+}
+
+func TestNewJWTAuthServiceRejectsKeys(t *testing.T) {
+	edPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	tests := []struct {
+		name string
+		keys []JWTKey
+	}{
+		{"no keys", nil},
+		{"short secret", []JWTKey{{Algorithm: "HS256", Secret: base64.StdEncoding.EncodeToString([]byte("short"))}}},
+		{"secret not base64", []JWTKey{{Algorithm: "HS256", Secret: "!!"}}},
+		{"not PEM", []JWTKey{{Algorithm: "EdDSA", PublicKey: "key"}}},
+		{"Ed25519 key for RS256", []JWTKey{{Algorithm: "RS256", PublicKey: pemPublicKey(t, edPub)}}},
+		{"unknown algorithm", []JWTKey{{Algorithm: "none"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewJWTAuthService(JWTConfig{Keys: tt.keys}); err == nil {
+				t.Error("NewJWTAuthService accepted the key set")
+			}
+		})
+	}
+}
@@ -4,16 +4,55 @@ package quill
 const (
 	// Protocol identification
 	ProtocolName    = "quill"
-	ProtocolVersion = "1.0"
+	ProtocolVersion = "1.3" // see version.go for the compatibility policy
 
 	// Packet types
-	PacketTypeSend          = "SEND"
-	PacketTypeFetch         = "FETCH"
-	PacketTypeSendResponse  = "SEND_RESPONSE"
-	PacketTypeFetchResponse = "FETCH_RESPONSE"
-	PacketTypeErrorResponse = "ERROR_RESPONSE"
-	PacketTypePing          = "PING"
-	PacketTypePingResponse  = "PING_RESPONSE"
+	PacketTypeSend                  = "SEND"
+	PacketTypeFetch                 = "FETCH"
+	PacketTypeSendResponse          = "SEND_RESPONSE"
+	PacketTypeFetchResponse         = "FETCH_RESPONSE"
+	PacketTypeErrorResponse         = "ERROR_RESPONSE"
+	PacketTypePing                  = "PING"
+	PacketTypePingResponse          = "PING_RESPONSE"
+	PacketTypeList                  = "LIST"
+	PacketTypeListResponse          = "LIST_RESPONSE"
+	PacketTypeRule                  = "RULE"
+	PacketTypeRuleResponse          = "RULE_RESPONSE"
+	PacketTypeVacation              = "VACATION"
+	PacketTypeVacationResponse      = "VACATION_RESPONSE"
+	PacketTypeListFolders           = "LIST_FOLDERS"
+	PacketTypeListFoldersResponse   = "LIST_FOLDERS_RESPONSE"
+	PacketTypeFolder                = "FOLDER"
+	PacketTypeFolderResponse        = "FOLDER_RESPONSE"
+	PacketTypeLabel                 = "LABEL"
+	PacketTypeLabelResponse         = "LABEL_RESPONSE"
+	PacketTypeMove                  = "MOVE"
+	PacketTypeMoveResponse          = "MOVE_RESPONSE"
+	PacketTypeSync                  = "SYNC"
+	PacketTypeSyncResponse          = "SYNC_RESPONSE"
+	PacketTypeFlag                  = "FLAG"
+	PacketTypeFlagResponse          = "FLAG_RESPONSE"
+	PacketTypeDelete                = "DELETE"
+	PacketTypeDeleteResponse        = "DELETE_RESPONSE"
+	PacketTypeCredential            = "CREDENTIAL"
+	PacketTypeCredentialResponse    = "CREDENTIAL_RESPONSE"
+	PacketTypeAuth                  = "AUTH"
+	PacketTypeAuthResponse          = "AUTH_RESPONSE"
+	PacketTypeLogout                = "LOGOUT"
+	PacketTypeLogoutResponse        = "LOGOUT_RESPONSE"
+	PacketTypeProfile               = "PROFILE"
+	PacketTypeProfileResponse       = "PROFILE_RESPONSE"
+	PacketTypeDeleteAccount         = "DELETE_ACCOUNT"
+	PacketTypeDeleteAccountResponse = "DELETE_ACCOUNT_RESPONSE"
+	PacketTypeExport                = "EXPORT"
+	PacketTypeExportResponse        = "EXPORT_RESPONSE"
+	PacketTypeQuota                 = "QUOTA"
+	PacketTypeQuotaResponse         = "QUOTA_RESPONSE"
+	PacketTypeSubscribe             = "SUBSCRIBE"
+	PacketTypeSubscribeResponse     = "SUBSCRIBE_RESPONSE"
+	PacketTypeNewMail               = "NEW_MAIL" // pushed, never requested
+	PacketTypeHello                 = "HELLO"
+	PacketTypeCapabilities          = "CAPABILITIES"
 
 	// Error-response payload “status”
 	StatusOK    = "OK"
@@ -28,4 +67,38 @@ const (
 	ErrorCodeInvalidMode        = "INVALID_MODE"
 	ErrorCodeDeliveryFailed     = "DELIVERY_FAILED"
 	ErrInvalidDomain            = "INVALID_DOMAIN"
+	ErrorCodeNotFound           = "NOT_FOUND"
+	ErrorCodePermissionDenied   = "PERMISSION_DENIED"
+	ErrorCodeAlreadyExists      = "ALREADY_EXISTS"
+	ErrorCodeListPostDenied     = "LIST_POST_DENIED"
+	ErrorCodeInvalidAction      = "INVALID_ACTION"
+	ErrorCodeInvalidSyncToken   = "INVALID_SYNC_TOKEN"
+	ErrorCodeInvalidCursor      = "INVALID_CURSOR"
+	ErrorCodeSessionExpired     = "SESSION_EXPIRED"
+	ErrorCodeMessageTooLarge    = "MESSAGE_TOO_LARGE"
+	ErrorCodeTooManyAttachments = "TOO_MANY_ATTACHMENTS"
+	ErrorCodeQuotaExceeded      = "QUOTA_EXCEEDED" // the sender's own mailbox is full
+	ErrorCodeMailboxFull        = "MAILBOX_FULL"   // every recipient's mailbox is full
+	ErrorCodeUnsupportedVersion = "UNSUPPORTED_VERSION"
+
+	// AUTH actions
+	AuthActionLogin   = "login"
+	AuthActionRefresh = "refresh"
+
+	// PROFILE actions
+	ProfileActionGet          = "get"
+	ProfileActionUpdate       = "update"
+	ProfileActionChangeHandle = "change_handle"
+
+	// DELETE_ACCOUNT actions
+	DeleteAccountActionRequest = "request"
+	DeleteAccountActionCancel  = "cancel"
+
+	// SUBSCRIBE actions
+	SubscribeActionStart = "start"
+	SubscribeActionStop  = "stop"
+
+	// EXPORT actions
+	ExportActionStart  = "start"
+	ExportActionStatus = "status"
 )
@@ -0,0 +1,84 @@
+package quill
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"quill/pkg/domain"
+)
+
+func (h *MessageHandler) handleCredential(ctx context.Context, conn PacketConn, payload json.RawMessage) {
+	var req CredentialPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "Cannot parse CREDENTIAL payload: "+err.Error())
+		return
+	}
+
+	// 1) DTO → Domain
+	action := domain.CredentialAction(req.Action)
+	domainReq := domain.DomainCredentialRequest{Action: action}
+	switch action {
+	case domain.CredentialActionCreate:
+		kind := domain.CredentialKind(req.Kind)
+		if kind != domain.CredentialKindAPIKey && kind != domain.CredentialKindAppPassword {
+			h.writeErrorResponse(conn, ErrorCodeInvalidPayload, fmt.Sprintf(
+				"Invalid credential kind %q; must be %q or %q", req.Kind,
+				domain.CredentialKindAPIKey, domain.CredentialKindAppPassword))
+			return
+		}
+		domainReq.Kind = kind
+		domainReq.Name = req.Name
+		domainReq.ExpiresAt = req.ExpiresAt
+	case domain.CredentialActionList:
+	case domain.CredentialActionRevoke:
+		if req.CredentialID == "" {
+			h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "revoke requires credential_id")
+			return
+		}
+		domainReq.CredentialID = req.CredentialID
+	default:
+		h.writeErrorResponse(conn, ErrorCodeInvalidAction, fmt.Sprintf("Invalid credential action %q", req.Action))
+		return
+	}
+
+	// 2) Call service
+	result, err := h.messageSvc.ManageCredentials(ctx, domainReq)
+	if err != nil {
+		log.Printf("ERROR: service call to ManageCredentials failed: %v", err)
+		switch {
+		case errors.Is(err, domain.ErrCredentialNotFound):
+			h.writeErrorResponse(conn, ErrorCodeNotFound, err.Error())
+		case errors.Is(err, domain.ErrPermissionDenied):
+			h.writeErrorResponse(conn, ErrorCodePermissionDenied, "Credentials can only be managed from an interactive sign-in.")
+		default:
+			h.writeErrorResponse(conn, ErrorCodeServiceError, "Failed to manage credentials.")
+		}
+		return
+	}
+
+	// 3) Construct and send response
+	resp := CredentialResponsePayload{
+		Status: StatusOK,
+		Action: req.Action,
+		Secret: result.Secret,
+	}
+	for _, c := range result.Credentials {
+		dto := CredentialDTO{
+			ID:        c.ID,
+			Kind:      string(c.Kind),
+			Name:      c.Name,
+			CreatedAt: c.CreatedAt,
+		}
+		if !c.ExpiresAt.IsZero() {
+			dto.ExpiresAt = &c.ExpiresAt
+		}
+		if !c.LastUsedAt.IsZero() {
+			dto.LastUsedAt = &c.LastUsedAt
+		}
+		resp.Credentials = append(resp.Credentials, dto)
+	}
+	h.writeResponse(conn, PacketTypeCredentialResponse, resp)
+}
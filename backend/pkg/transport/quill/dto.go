@@ -28,6 +28,16 @@ type SendPayload struct {
 	Body        BodyPayload  `json:"body"`
 	Attachments []Attachment `json:"attachments,omitempty"`
 	Options     SendOptions  `json:"options"`
+	// Set by relaying servers only: the recipients to deliver on the
+	// receiving server, and the list the message was fanned out by.
+	EnvelopeTo []string `json:"envelope_to,omitempty"`
+	ListID     string   `json:"list_id,omitempty"`
+	ReplyTo    string   `json:"reply_to,omitempty"`
+	// Non-empty on machine-generated mail such as vacation replies.
+	AutoSubmitted string `json:"auto_submitted,omitempty"`
+	// Set by relaying servers on a copy sent on by a user's forwarding
+	// rule: that user, whose domain the relay is checked against.
+	ForwardedBy string `json:"forwarded_by,omitempty"`
 }
 
 type BodyPayload struct {
@@ -56,14 +66,192 @@ type FetchPayload struct {
 	Mode     string `json:"mode"`
 	ThreadID string `json:"thread_id,omitempty"`
 	Folder   string `json:"folder,omitempty"`
-	Limit    int    `json:"limit,omitempty"`
-	Offset   int    `json:"offset,omitempty"`
+	Label    string `json:"label,omitempty"`
+	// MessageID selects the message in "message" mode.
+	MessageID string `json:"message_id,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+	Offset    int    `json:"offset,omitempty"` // deprecated: use cursor
+	Cursor    string `json:"cursor,omitempty"`
 }
 
 // PING
 
 type PingPayload struct{}
 
+// LIST
+type ListPayload struct {
+	Action        string   `json:"action"`
+	Address       string   `json:"address"`
+	Name          *string  `json:"name,omitempty"`
+	Description   *string  `json:"description,omitempty"`
+	Owners        []string `json:"owners,omitempty"`
+	Members       []string `json:"members,omitempty"`
+	PostingPolicy string   `json:"posting_policy,omitempty"`
+	ReplyTo       string   `json:"reply_to,omitempty"`
+	ArchiveAccess string   `json:"archive_access,omitempty"`
+	MessageID     string   `json:"message_id,omitempty"`
+	Limit         int      `json:"limit,omitempty"`
+	Offset        int      `json:"offset,omitempty"`
+}
+
+// RULE
+type RulePayload struct {
+	Action    string   `json:"action"`
+	RuleID    string   `json:"rule_id,omitempty"`
+	Rule      *RuleDTO `json:"rule,omitempty"`
+	MessageID string   `json:"message_id,omitempty"` // for "test"
+}
+
+type RuleDTO struct {
+	ID             string             `json:"id,omitempty"`
+	Name           string             `json:"name"`
+	Enabled        bool               `json:"enabled"`
+	Priority       int                `json:"priority"`
+	MatchAll       bool               `json:"match_all"`
+	Conditions     []RuleConditionDTO `json:"conditions"`
+	Actions        []RuleActionDTO    `json:"actions"`
+	StopProcessing bool               `json:"stop_processing,omitempty"`
+}
+
+type RuleConditionDTO struct {
+	Field    string `json:"field"`
+	Operator string `json:"operator,omitempty"`
+	Value    string `json:"value,omitempty"`
+}
+
+type RuleActionDTO struct {
+	Type  string `json:"type"`
+	Value string `json:"value,omitempty"`
+}
+
+// VACATION
+type VacationPayload struct {
+	Action       string     `json:"action"`
+	Enabled      bool       `json:"enabled,omitempty"`
+	Start        *time.Time `json:"start,omitempty"`
+	End          *time.Time `json:"end,omitempty"`
+	Subject      string     `json:"subject,omitempty"`
+	Body         string     `json:"body,omitempty"`
+	Exclude      []string   `json:"exclude,omitempty"`
+	IntervalDays int        `json:"interval_days,omitempty"`
+}
+
+// LIST_FOLDERS
+
+type ListFoldersPayload struct{}
+
+// FOLDER
+type FolderPayload struct {
+	Action   string `json:"action"`
+	FolderID string `json:"folder_id,omitempty"`
+	Name     string `json:"name,omitempty"`
+	ParentID string `json:"parent_id,omitempty"`
+}
+
+// LABEL
+type LabelPayload struct {
+	Action     string   `json:"action"`
+	LabelID    string   `json:"label_id,omitempty"`
+	Name       string   `json:"name,omitempty"`
+	Color      *string  `json:"color,omitempty"`
+	MessageIDs []string `json:"message_ids,omitempty"`
+}
+
+// MOVE
+type MovePayload struct {
+	MessageIDs []string `json:"message_ids"`
+	Folder     string   `json:"folder"`
+}
+
+// SYNC
+// An empty sync_token asks for the whole change log.
+type SyncPayload struct {
+	SyncToken string `json:"sync_token,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+}
+
+// FLAG
+type FlagPayload struct {
+	MessageIDs  []string `json:"message_ids"`
+	Read        *bool    `json:"read,omitempty"`
+	AddFlags    []string `json:"add_flags,omitempty"`
+	RemoveFlags []string `json:"remove_flags,omitempty"`
+}
+
+// DELETE
+type DeletePayload struct {
+	MessageIDs []string `json:"message_ids"`
+}
+
+// AUTH
+// "login" verifies token (or the packet's session_token) once and issues a
+// session; "refresh" swaps a live session token for a fresh one. Unless
+// no_bind is set the session is bound to the connection, so later packets
+// may leave session_token empty.
+type AuthPayload struct {
+	Action string `json:"action,omitempty"`
+	Token  string `json:"token,omitempty"`
+	NoBind bool   `json:"no_bind,omitempty"`
+}
+
+// LOGOUT
+// all ends every session of the user, not just this one.
+type LogoutPayload struct {
+	All bool `json:"all,omitempty"`
+}
+
+// HELLO
+// versions lists the protocol versions the client speaks, e.g. ["1.0",
+// "1.1"]; when empty, the packet's own version is used. client names the
+// client software, for logs.
+type HelloPayload struct {
+	Versions []string `json:"versions,omitempty"`
+	Client   string   `json:"client,omitempty"`
+}
+
+// SUBSCRIBE
+// action: "start" (the default) pushes a NEW_MAIL packet for every message
+// that arrives in the caller's mailbox while the connection stays open;
+// "stop" ends that.
+type SubscribePayload struct {
+	Action string `json:"action,omitempty"`
+}
+
+// CREDENTIAL
+// action: "create" (kind, name, expires_at), "list" or "revoke" (credential_id).
+type CredentialPayload struct {
+	Action       string     `json:"action"`
+	Kind         string     `json:"kind,omitempty"` // "api_key" or "app_password"
+	Name         string     `json:"name,omitempty"`
+	CredentialID string     `json:"credential_id,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+}
+
+// PROFILE
+// action: "get", "update" (display_name, signature, avatar; omitted fields
+// are kept, "" clears) or "change_handle" (quill_mail).
+type ProfilePayload struct {
+	Action      string  `json:"action"`
+	DisplayName *string `json:"display_name,omitempty"`
+	Signature   *string `json:"signature,omitempty"`
+	Avatar      *string `json:"avatar,omitempty"`
+	QuillMail   string  `json:"quill_mail,omitempty"`
+}
+
+// DELETE_ACCOUNT
+// action: "request" schedules deletion after the grace period, "cancel"
+// withdraws the request.
+type DeleteAccountPayload struct {
+	Action string `json:"action"`
+}
+
+// EXPORT
+// action: "start" or "status" (export_id).
+type ExportPayload struct {
+	Action   string `json:"action"`
+	ExportID string `json:"export_id,omitempty"`
+}
+
 // --- Payload definitions for server responses --- //
 
 // generic error reply
@@ -80,6 +268,9 @@ type SendResponsePayload struct {
 	ThreadID    string   `json:"thread_id"`
 	DeliveredTo []string `json:"delivered_to,omitempty"`
 	QueuedFor   []string `json:"queued_for,omitempty"`
+	HeldFor     []string `json:"held_for,omitempty"`
+	// BouncedFor lists recipients whose mailbox was full.
+	BouncedFor []string `json:"bounced_for,omitempty"`
 }
 
 // For FETCH_RESPONSE on success.
@@ -90,21 +281,30 @@ type FetchResponsePayload struct {
 	Total    int          `json:"total,omitempty"`
 	Limit    int          `json:"limit,omitempty"`
 	Offset   int          `json:"offset,omitempty"`
+	// NextCursor fetches the following page; SyncToken starts a SYNC from
+	// the state this page reflects.
+	NextCursor string `json:"next_cursor,omitempty"`
+	SyncToken  string `json:"sync_token"`
 }
 
 type MessageDTO struct {
-	MessageID   string       `json:"id"`
-	ThreadID    string       `json:"thread_id"`
-	From        string       `json:"from"`
-	To          []string     `json:"to"`
-	CC          []string     `json:"cc,omitempty"`
-	BCC         []string     `json:"bcc,omitempty"`
-	Subject     string       `json:"subject"`
-	Body        BodyPayload  `json:"body"`
-	Attachments []Attachment `json:"attachments,omitempty"`
-	SentAt      time.Time    `json:"timestamp"`
-	Read        bool         `json:"read"`
-	Flags       []string     `json:"flags,omitempty"`
+	MessageID     string       `json:"id"`
+	ThreadID      string       `json:"thread_id"`
+	From          string       `json:"from"`
+	To            []string     `json:"to"`
+	CC            []string     `json:"cc,omitempty"`
+	BCC           []string     `json:"bcc,omitempty"`
+	Subject       string       `json:"subject"`
+	Body          BodyPayload  `json:"body"`
+	Attachments   []Attachment `json:"attachments,omitempty"`
+	SentAt        time.Time    `json:"timestamp"`
+	Read          bool         `json:"read"`
+	Flags         []string     `json:"flags,omitempty"`
+	Labels        []string     `json:"labels,omitempty"`
+	Folder        string       `json:"folder,omitempty"`
+	ListID        string       `json:"list_id,omitempty"`
+	ReplyTo       string       `json:"reply_to,omitempty"`
+	AutoSubmitted string       `json:"auto_submitted,omitempty"`
 }
 
 // PING response
@@ -113,3 +313,260 @@ type PingResponsePayload struct {
 	Status     string `json:"status"`
 	ServerTime string `json:"server_time"`
 }
+
+// LIST_RESPONSE
+type ListResponsePayload struct {
+	Status   string           `json:"status"`
+	Action   string           `json:"action"`
+	List     *MailingListDTO  `json:"list,omitempty"`
+	Messages []MessageDTO     `json:"messages,omitempty"`
+	Pending  []PendingPostDTO `json:"pending,omitempty"`
+	Total    int              `json:"total,omitempty"`
+	Limit    int              `json:"limit,omitempty"`
+	Offset   int              `json:"offset,omitempty"`
+}
+
+type MailingListDTO struct {
+	Address       string    `json:"address"`
+	Name          string    `json:"name,omitempty"`
+	Description   string    `json:"description,omitempty"`
+	Owners        []string  `json:"owners"`
+	Members       []string  `json:"members"`
+	PostingPolicy string    `json:"posting_policy"`
+	ReplyTo       string    `json:"reply_to"`
+	ArchiveAccess string    `json:"archive_access"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type PendingPostDTO struct {
+	MessageID string    `json:"message_id"`
+	ThreadID  string    `json:"thread_id"`
+	From      string    `json:"from"`
+	Subject   string    `json:"subject"`
+	HeldAt    time.Time `json:"held_at"`
+}
+
+// RULE_RESPONSE
+type RuleResponsePayload struct {
+	Status string          `json:"status"`
+	Action string          `json:"action"`
+	Rules  []RuleDTO       `json:"rules,omitempty"`
+	Rule   *RuleDTO        `json:"rule,omitempty"`
+	Test   *RuleTestResult `json:"test,omitempty"`
+}
+
+// RuleTestResult is the outcome of a dry-run rule test.
+type RuleTestResult struct {
+	Matched   bool     `json:"matched"`
+	Folder    string   `json:"folder"`
+	Flags     []string `json:"flags,omitempty"`
+	Read      bool     `json:"read"`
+	Discarded bool     `json:"discarded"`
+	ForwardTo []string `json:"forward_to,omitempty"`
+}
+
+// VACATION_RESPONSE
+type VacationResponsePayload struct {
+	Status       string     `json:"status"`
+	Enabled      bool       `json:"enabled"`
+	Start        *time.Time `json:"start,omitempty"`
+	End          *time.Time `json:"end,omitempty"`
+	Subject      string     `json:"subject,omitempty"`
+	Body         string     `json:"body,omitempty"`
+	Exclude      []string   `json:"exclude,omitempty"`
+	IntervalDays int        `json:"interval_days"`
+}
+
+// LIST_FOLDERS_RESPONSE
+type ListFoldersResponsePayload struct {
+	Status  string      `json:"status"`
+	Folders []FolderDTO `json:"folders"`
+	Labels  []FolderDTO `json:"labels"`
+}
+
+// FolderDTO describes a folder or a label together with its counts.
+type FolderDTO struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	ParentID string `json:"parent_id,omitempty"`
+	Color    string `json:"color,omitempty"`
+	System   bool   `json:"system,omitempty"`
+	Total    int    `json:"total"`
+	Unread   int    `json:"unread"`
+}
+
+// FOLDER_RESPONSE and LABEL_RESPONSE
+type FolderResponsePayload struct {
+	Status string     `json:"status"`
+	Action string     `json:"action"`
+	Folder *FolderDTO `json:"folder,omitempty"`
+}
+
+// MOVE_RESPONSE
+type MoveResponsePayload struct {
+	Status string `json:"status"`
+	Folder string `json:"folder"`
+	Moved  int    `json:"moved"`
+}
+
+// SYNC_RESPONSE
+type SyncResponsePayload struct {
+	Status    string      `json:"status"`
+	SyncToken string      `json:"sync_token"`
+	More      bool        `json:"more"`
+	Changes   []ChangeDTO `json:"changes"`
+}
+
+type ChangeDTO struct {
+	ModSeq    int64       `json:"modseq"`
+	Kind      string      `json:"kind"`
+	MessageID string      `json:"message_id"`
+	ThreadID  string      `json:"thread_id"`
+	Folder    string      `json:"folder,omitempty"`
+	Read      bool        `json:"read"`
+	Flags     []string    `json:"flags,omitempty"`
+	Labels    []string    `json:"labels,omitempty"`
+	At        time.Time   `json:"at"`
+	Message   *MessageDTO `json:"message,omitempty"` // inserts only
+}
+
+// CAPABILITIES answers HELLO with the negotiated version and what this
+// server supports. Limits are those of the caller's domain when HELLO is
+// authenticated, otherwise the server's.
+type CapabilitiesPayload struct {
+	Status        string            `json:"status"`
+	Version       string            `json:"version"`
+	ServerVersion string            `json:"server_version"`
+	PacketTypes   []string          `json:"packet_types"`
+	FetchModes    []string          `json:"fetch_modes"`
+	ContentTypes  []string          `json:"content_types"`
+	AuthMethods   []string          `json:"auth_methods"`
+	Limits        CapabilityLimits  `json:"limits"`
+	Framing       CapabilityFraming `json:"framing"`
+}
+
+type CapabilityLimits struct {
+	MaxMessageBytes int64 `json:"max_message_bytes"`
+	MaxAttachments  int   `json:"max_attachments"`
+}
+
+// CapabilityFraming lists what a framed connection can use on this server;
+// framing itself is chosen by the preface before the first packet.
+type CapabilityFraming struct {
+	Encodings    []string `json:"encodings"`
+	Compressions []string `json:"compressions"`
+}
+
+// SUBSCRIBE_RESPONSE
+type SubscribeResponsePayload struct {
+	Status     string `json:"status"`
+	Subscribed bool   `json:"subscribed"`
+}
+
+// NEW_MAIL is pushed with the insert change of the arriving message, which
+// includes the message when it could be loaded. Pushes are best effort: a
+// client that needs every change SYNCs from the last modseq it saw.
+type NewMailPayload struct {
+	Status string    `json:"status"`
+	Change ChangeDTO `json:"change"`
+}
+
+// FLAG_RESPONSE
+type FlagResponsePayload struct {
+	Status  string `json:"status"`
+	Updated int    `json:"updated"`
+}
+
+// DELETE_RESPONSE
+type DeleteResponsePayload struct {
+	Status  string `json:"status"`
+	Deleted int    `json:"deleted"`
+}
+
+// CREDENTIAL_RESPONSE
+// Secret is only present right after "create" and is never shown again.
+type CredentialResponsePayload struct {
+	Status      string          `json:"status"`
+	Action      string          `json:"action"`
+	Secret      string          `json:"secret,omitempty"`
+	Credentials []CredentialDTO `json:"credentials,omitempty"`
+}
+
+type CredentialDTO struct {
+	ID         string     `json:"id"`
+	Kind       string     `json:"kind"`
+	Name       string     `json:"name,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// AUTH_RESPONSE
+type AuthResponsePayload struct {
+	Status       string    `json:"status"`
+	SessionToken string    `json:"session_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	UserID       string    `json:"user_id"`
+	Bound        bool      `json:"bound"`
+}
+
+// LOGOUT_RESPONSE
+type LogoutResponsePayload struct {
+	Status string `json:"status"`
+}
+
+// PROFILE_RESPONSE
+type ProfileResponsePayload struct {
+	Status  string     `json:"status"`
+	Action  string     `json:"action"`
+	Profile ProfileDTO `json:"profile"`
+}
+
+type ProfileDTO struct {
+	UserID      string    `json:"user_id"`
+	QuillMail   string    `json:"quill_mail"`
+	Email       string    `json:"email"`
+	DisplayName string    `json:"display_name,omitempty"`
+	Signature   string    `json:"signature,omitempty"`
+	Avatar      string    `json:"avatar,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastLogin   time.Time `json:"last_login"`
+}
+
+// DELETE_ACCOUNT_RESPONSE
+// delete_after is omitted once a request has been cancelled.
+type DeleteAccountResponsePayload struct {
+	Status      string     `json:"status"`
+	Action      string     `json:"action"`
+	DeleteAfter *time.Time `json:"delete_after,omitempty"`
+}
+
+// EXPORT_RESPONSE
+type ExportResponsePayload struct {
+	Status string    `json:"status"`
+	Action string    `json:"action"`
+	Export ExportDTO `json:"export"`
+}
+
+// ExportDTO describes an export job. download_path is relative to the HTTPS
+// API and set once the archive is ready.
+type ExportDTO struct {
+	ID           string     `json:"id"`
+	State        string     `json:"state"` // "pending", "ready" or "failed"
+	Size         int64      `json:"size,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	CompletedAt  *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	DownloadPath string     `json:"download_path,omitempty"`
+}
+
+// QUOTA_RESPONSE
+type QuotaResponsePayload struct {
+	Status          string `json:"status"`
+	UsedBytes       int64  `json:"used_bytes"`
+	QuotaBytes      int64  `json:"quota_bytes"`
+	MessageCount    int64  `json:"message_count"`
+	MaxMessageBytes int64  `json:"max_message_bytes"`
+	MaxAttachments  int    `json:"max_attachments"`
+}
@@ -0,0 +1,74 @@
+package quill
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"quill/pkg/domain"
+)
+
+// recordConn keeps the packets written to it.
+type recordConn struct {
+	panicConn
+	written []*Packet
+}
+
+func (c *recordConn) WritePacket(p *Packet) error {
+	c.written = append(c.written, p)
+	return nil
+}
+
+// fetchMessages records the fetch it is asked for.
+type fetchMessages struct {
+	messageService
+	got *domain.DomainFetchRequest
+}
+
+func (m *fetchMessages) Fetch(_ context.Context, req domain.DomainFetchRequest) (domain.DomainFetchResult, error) {
+	m.got = &req
+	return domain.DomainFetchResult{Messages: []domain.Message{{MessageID: *req.MessageID}}, Total: 1}, nil
+}
+
+func TestFetchMessageMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		wantType string
+		wantCode string
+	}{
+		{"by message id", `{"mode":"message","message_id":"m1"}`, PacketTypeFetchResponse, ""},
+		{"without message id", `{"mode":"message"}`, PacketTypeErrorResponse, ErrorCodeInvalidPayload},
+		{"unknown mode", `{"mode":"everything"}`, PacketTypeErrorResponse, ErrorCodeInvalidMode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs := &fetchMessages{}
+			h := NewMessageHandler(nil, msgs, nil, nil, nil)
+			conn := &recordConn{}
+			h.handleFetch(context.Background(), conn, json.RawMessage(tt.payload))
+			if len(conn.written) != 1 || conn.written[0].Type != tt.wantType {
+				t.Fatalf("written %+v, want one %s", conn.written, tt.wantType)
+			}
+			if tt.wantCode != "" {
+				var e ErrorResponsePayload
+				json.Unmarshal(conn.written[0].Payload, &e)
+				if e.Code != tt.wantCode {
+					t.Errorf("code = %q, want %q", e.Code, tt.wantCode)
+				}
+				if msgs.got != nil {
+					t.Error("service called for a rejected FETCH")
+				}
+				return
+			}
+			if msgs.got.Mode != domain.FetchModeMessage || *msgs.got.MessageID != "m1" {
+				t.Errorf("service asked for %+v", msgs.got)
+			}
+			var resp FetchResponsePayload
+			json.Unmarshal(conn.written[0].Payload, &resp)
+			if len(resp.Messages) != 1 || resp.Messages[0].MessageID != "m1" {
+				t.Errorf("response = %+v", resp)
+			}
+		})
+	}
+}
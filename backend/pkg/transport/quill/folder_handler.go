@@ -0,0 +1,166 @@
+package quill
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"quill/pkg/domain"
+)
+
+func (h *MessageHandler) handleListFolders(ctx context.Context, conn PacketConn) {
+	result, err := h.messageSvc.ListFolders(ctx)
+	if err != nil {
+		log.Printf("ERROR: service call to ListFolders failed: %v", err)
+		h.writeErrorResponse(conn, ErrorCodeServiceError, "Failed to list folders.")
+		return
+	}
+
+	resp := ListFoldersResponsePayload{
+		Status:  StatusOK,
+		Folders: make([]FolderDTO, len(result.Folders)),
+		Labels:  make([]FolderDTO, len(result.Labels)),
+	}
+	for i, f := range result.Folders {
+		resp.Folders[i] = folderSummaryToDTO(f)
+	}
+	for i, l := range result.Labels {
+		resp.Labels[i] = folderSummaryToDTO(l)
+	}
+	h.writeResponse(conn, PacketTypeListFoldersResponse, resp)
+}
+
+func (h *MessageHandler) handleFolder(ctx context.Context, conn PacketConn, payload json.RawMessage) {
+	var req FolderPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "Cannot parse FOLDER payload: "+err.Error())
+		return
+	}
+
+	action := domain.FolderAction(req.Action)
+	switch action {
+	case domain.FolderActionCreate:
+	case domain.FolderActionRename, domain.FolderActionMove, domain.FolderActionDelete:
+		if req.FolderID == "" {
+			h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "FOLDER "+req.Action+" requires folder_id")
+			return
+		}
+	default:
+		h.writeErrorResponse(conn, ErrorCodeInvalidAction, fmt.Sprintf("Invalid folder action %q", req.Action))
+		return
+	}
+
+	folder, err := h.messageSvc.ManageFolder(ctx, domain.DomainFolderRequest{
+		Action:   action,
+		FolderID: req.FolderID,
+		Name:     req.Name,
+		ParentID: req.ParentID,
+	})
+	if err != nil {
+		log.Printf("ERROR: service call to ManageFolder failed: %v", err)
+		h.writeFolderError(conn, err)
+		return
+	}
+
+	resp := FolderResponsePayload{Status: StatusOK, Action: req.Action}
+	if folder != nil {
+		resp.Folder = &FolderDTO{ID: folder.ID, Name: folder.Name, Path: folder.Path, ParentID: folder.ParentID}
+	}
+	h.writeResponse(conn, PacketTypeFolderResponse, resp)
+}
+
+func (h *MessageHandler) handleLabel(ctx context.Context, conn PacketConn, payload json.RawMessage) {
+	var req LabelPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "Cannot parse LABEL payload: "+err.Error())
+		return
+	}
+
+	action := domain.LabelAction(req.Action)
+	switch action {
+	case domain.LabelActionCreate:
+	case domain.LabelActionRename, domain.LabelActionDelete, domain.LabelActionApply, domain.LabelActionRemove:
+		if req.LabelID == "" {
+			h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "LABEL "+req.Action+" requires label_id")
+			return
+		}
+	default:
+		h.writeErrorResponse(conn, ErrorCodeInvalidAction, fmt.Sprintf("Invalid label action %q", req.Action))
+		return
+	}
+
+	label, err := h.messageSvc.ManageLabel(ctx, domain.DomainLabelRequest{
+		Action:     action,
+		LabelID:    req.LabelID,
+		Name:       req.Name,
+		Color:      req.Color,
+		MessageIDs: req.MessageIDs,
+	})
+	if err != nil {
+		log.Printf("ERROR: service call to ManageLabel failed: %v", err)
+		h.writeFolderError(conn, err)
+		return
+	}
+
+	resp := FolderResponsePayload{Status: StatusOK, Action: req.Action}
+	if label != nil {
+		resp.Folder = &FolderDTO{ID: label.ID, Name: label.Name, Path: label.Name, Color: label.Color}
+	}
+	h.writeResponse(conn, PacketTypeLabelResponse, resp)
+}
+
+func (h *MessageHandler) handleMove(ctx context.Context, conn PacketConn, payload json.RawMessage) {
+	var req MovePayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "Cannot parse MOVE payload: "+err.Error())
+		return
+	}
+	if len(req.MessageIDs) == 0 || req.Folder == "" {
+		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "MOVE requires message_ids and folder")
+		return
+	}
+
+	moved, err := h.messageSvc.MoveMessages(ctx, domain.DomainMoveRequest{
+		MessageIDs: req.MessageIDs,
+		Folder:     req.Folder,
+	})
+	if err != nil {
+		log.Printf("ERROR: service call to MoveMessages failed: %v", err)
+		h.writeFolderError(conn, err)
+		return
+	}
+
+	h.writeResponse(conn, PacketTypeMoveResponse, MoveResponsePayload{
+		Status: StatusOK,
+		Folder: req.Folder,
+		Moved:  moved,
+	})
+}
+
+func (h *MessageHandler) writeFolderError(conn PacketConn, err error) {
+	switch {
+	case errors.Is(err, domain.ErrFolderNotFound), errors.Is(err, domain.ErrLabelNotFound):
+		h.writeErrorResponse(conn, ErrorCodeNotFound, err.Error())
+	case errors.Is(err, domain.ErrFolderExists), errors.Is(err, domain.ErrLabelExists):
+		h.writeErrorResponse(conn, ErrorCodeAlreadyExists, err.Error())
+	case errors.Is(err, domain.ErrInvalidFolder):
+		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, err.Error())
+	default:
+		h.writeErrorResponse(conn, ErrorCodeServiceError, "Failed to update folders.")
+	}
+}
+
+func folderSummaryToDTO(f domain.FolderSummary) FolderDTO {
+	return FolderDTO{
+		ID:       f.ID,
+		Name:     f.Name,
+		Path:     f.Path,
+		ParentID: f.ParentID,
+		Color:    f.Color,
+		System:   f.System,
+		Total:    f.Total,
+		Unread:   f.Unread,
+	}
+}
@@ -0,0 +1,390 @@
+package quill
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Framed connections
+//
+// By default a connection carries concatenated JSON packets, which cannot
+// be resynchronized after a malformed byte. A client may instead open the
+// connection with a preface, before its first packet, to switch to
+// length-prefixed frames:
+//
+//	preface: "\x00QFR" | version (1) | encoding | compressions
+//
+// encoding is what the client sends and wants back (0 JSON, 1 CBOR) and
+// compressions is a bit mask of what it can decompress (1 gzip, 2 zstd).
+// The server answers with its own preface: the encoding it will use, JSON
+// if the one asked for is unknown, and what it can decompress. A JSON
+// stream never starts with a zero byte, so old clients are unaffected.
+//
+// Every packet then travels in one frame:
+//
+//	frame: length (uint32, big endian) | flags | body
+//
+// length counts the body only. The low four bits of flags give the body's
+// encoding and the high four bits its compression (0 none, 1 gzip, 2 zstd),
+// so each frame can be read on its own. A frame that does not decode is
+// answered with INVALID_PAYLOAD and the connection goes on.
+//
+// In CBOR the payload is a CBOR map rather than embedded JSON, and byte
+// strings are accepted wherever the JSON form has base64, such as
+// attachment content.
+
+const (
+	framingMagic   = "\x00QFR"
+	framingVersion = 1
+	prefaceLen     = len(framingMagic) + 3
+	frameHeaderLen = 5
+
+	// maxPacketBytes bounds one incoming packet, framed or on a WebSocket,
+	// after decompression: enough for a message at the largest configurable
+	// size once base64-encoded.
+	maxPacketBytes = 64 << 20
+	// maxUnauthenticatedBytes bounds packets before the client has
+	// authenticated: enough for HELLO, AUTH and their tokens.
+	maxUnauthenticatedBytes = 64 << 10
+	// readChunkBytes is how much of a frame body is buffered ahead of the
+	// data arriving, so a large announced length costs nothing up front.
+	readChunkBytes = 32 << 10
+	// compressMinBytes is the smallest body worth compressing.
+	compressMinBytes = 1024
+)
+
+// Packet encodings.
+const (
+	encodingJSON byte = 0
+	encodingCBOR byte = 1
+)
+
+// Frame compressions; in a preface they combine into a mask.
+const (
+	compressionNone byte = 0
+	compressionGzip byte = 1
+	compressionZstd byte = 2
+
+	supportedCompressions = compressionGzip | compressionZstd
+)
+
+var encodingNames = map[byte]string{encodingJSON: "json", encodingCBOR: "cbor"}
+
+var compressionNames = map[byte]string{compressionGzip: "gzip", compressionZstd: "zstd"}
+
+// sortedNames lists the names of a code table in code order.
+func sortedNames(names map[byte]string) []string {
+	codes := make([]byte, 0, len(names))
+	for c := range names {
+		codes = append(codes, c)
+	}
+	slices.Sort(codes)
+	out := make([]string, len(codes))
+	for i, c := range codes {
+		out[i] = names[c]
+	}
+	return out
+}
+
+var (
+	cborEnc, _ = cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	cborDec, _ = cbor.DecOptions{
+		DefaultMapType:   reflect.TypeOf(map[string]interface{}{}),
+		MaxArrayElements: 1 << 20,
+		MaxMapPairs:      1 << 20,
+	}.DecMode()
+
+	zstdEncoder, _ = zstd.NewWriter(nil)
+)
+
+// negotiateFraming reads how the client wants to talk: a preface selects
+// framed packets, anything else is the original JSON stream.
+func negotiateFraming(conn net.Conn) (PacketConn, error) {
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] != framingMagic[0] {
+		return newStreamConn(conn, br), nil
+	}
+
+	var preface [prefaceLen]byte
+	if _, err := io.ReadFull(br, preface[:]); err != nil {
+		return nil, err
+	}
+	if string(preface[:len(framingMagic)]) != framingMagic {
+		return nil, errors.New("invalid framing preface")
+	}
+	version, encoding, accepts := preface[4], preface[5], preface[6]
+	if _, ok := encodingNames[encoding]; !ok {
+		encoding = encodingJSON
+	}
+	reply := []byte(framingMagic + string([]byte{framingVersion, encoding, supportedCompressions}))
+	if _, err := conn.Write(reply); err != nil {
+		return nil, err
+	}
+	if version != framingVersion {
+		return nil, fmt.Errorf("framing version %d is not supported", version)
+	}
+	return &framedConn{
+		netConn:  netConn{conn: conn},
+		r:        br,
+		encoding: encoding,
+		accepts:  accepts & supportedCompressions,
+		limit:    maxUnauthenticatedBytes,
+	}, nil
+}
+
+// framedConn carries one packet per length-prefixed frame.
+type framedConn struct {
+	netConn
+	r        *bufio.Reader
+	encoding byte // used for the frames we send
+	accepts  byte // compressions the client can read
+	limit    int  // largest packet read, before and after decompression
+
+	mu sync.Mutex
+}
+
+func (c *framedConn) SetReadLimit(n int) {
+	c.limit = n
+}
+
+func (c *framedConn) ReadPacket() (*Packet, error) {
+	var header [frameHeaderLen]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return nil, err
+	}
+	n := int64(binary.BigEndian.Uint32(header[:4]))
+	if n > maxPacketBytes {
+		// The length cannot be trusted, so neither can what follows.
+		return nil, fmt.Errorf("frame of %d bytes exceeds the limit of %d", n, maxPacketBytes)
+	}
+	if n > int64(c.limit) {
+		// Skip the body without keeping it; the next frame follows.
+		if _, err := io.CopyN(io.Discard, c.r, n); err != nil {
+			return nil, noEOF(err)
+		}
+		return nil, &malformedPacketError{err: fmt.Errorf("frame of %d bytes exceeds the limit of %d before authentication", n, c.limit)}
+	}
+	// Grow the buffer as the body arrives rather than trusting the length.
+	var body bytes.Buffer
+	body.Grow(int(min(n, readChunkBytes)))
+	if _, err := io.CopyN(&body, c.r, n); err != nil {
+		return nil, noEOF(err)
+	}
+	p, err := decodeFrame(header[4], body.Bytes(), c.limit)
+	if err != nil {
+		return nil, &malformedPacketError{err: err}
+	}
+	return p, nil
+}
+
+// noEOF reports a stream ending inside a frame as unexpected.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (c *framedConn) WritePacket(p *Packet) error {
+	frame, err := encodeFrame(p, c.encoding, c.accepts)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err = c.conn.Write(frame)
+	return err
+}
+
+// encodeFrame encodes p and compresses it with the best compression the
+// reader accepts, if that is worth it.
+func encodeFrame(p *Packet, encoding, accepts byte) ([]byte, error) {
+	var body []byte
+	var err error
+	switch encoding {
+	case encodingCBOR:
+		body, err = encodeCBOR(p)
+	default:
+		body, err = json.Marshal(p)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	compression := compressionNone
+	if len(body) >= compressMinBytes {
+		switch {
+		case accepts&compressionZstd != 0:
+			compression = compressionZstd
+			body = zstdEncoder.EncodeAll(body, nil)
+		case accepts&compressionGzip != 0:
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			if _, err := zw.Write(body); err != nil {
+				return nil, err
+			}
+			if err := zw.Close(); err != nil {
+				return nil, err
+			}
+			compression = compressionGzip
+			body = buf.Bytes()
+		}
+	}
+
+	frame := make([]byte, frameHeaderLen, frameHeaderLen+len(body))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(body)))
+	frame[4] = compression<<4 | encoding
+	return append(frame, body...), nil
+}
+
+// decodeFrame decodes a frame body, refusing to decompress it to more than
+// limit bytes.
+func decodeFrame(flags byte, body []byte, limit int) (*Packet, error) {
+	encoding, compression := flags&0x0f, flags>>4
+	switch compression {
+	case compressionNone:
+	case compressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body, err = readLimited(zr, limit); err != nil {
+			return nil, err
+		}
+	case compressionZstd:
+		// Decode as a stream so memory follows the read limit rather than
+		// the size the frame claims; the window is capped the same way.
+		zr, err := zstd.NewReader(bytes.NewReader(body),
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderMaxWindow(uint64(max(limit, zstd.MinWindowSize))))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		if body, err = readLimited(zr, limit); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown compression %d", compression)
+	}
+
+	var p Packet
+	switch encoding {
+	case encodingJSON:
+		if err := json.Unmarshal(body, &p); err != nil {
+			return nil, err
+		}
+	case encodingCBOR:
+		return decodeCBOR(body)
+	default:
+		return nil, fmt.Errorf("unknown encoding %d", encoding)
+	}
+	return &p, nil
+}
+
+// readLimited reads a decompressed body of at most limit bytes.
+func readLimited(r io.Reader, limit int) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > limit {
+		return nil, fmt.Errorf("packet exceeds %d bytes", limit)
+	}
+	return body, nil
+}
+
+// cborPacket is Packet with a payload CBOR can encode natively.
+type cborPacket struct {
+	Protocol     string      `cbor:"protocol"`
+	Version      string      `cbor:"version"`
+	Type         string      `cbor:"type"`
+	SessionToken string      `cbor:"session_token,omitempty"`
+	Timestamp    time.Time   `cbor:"timestamp"`
+	Payload      interface{} `cbor:"payload"`
+}
+
+func encodeCBOR(p *Packet) ([]byte, error) {
+	wire := cborPacket{
+		Protocol:     p.Protocol,
+		Version:      p.Version,
+		Type:         p.Type,
+		SessionToken: p.SessionToken,
+		Timestamp:    p.Timestamp,
+	}
+	if len(p.Payload) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(p.Payload))
+		dec.UseNumber()
+		var payload interface{}
+		if err := dec.Decode(&payload); err != nil {
+			return nil, err
+		}
+		wire.Payload = exactNumbers(payload)
+	}
+	return cborEnc.Marshal(wire)
+}
+
+// exactNumbers turns JSON numbers into integers where they are integers,
+// so that large counts and sizes survive the trip to CBOR.
+func exactNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(t.String(), 10, 64); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = exactNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = exactNumbers(e)
+		}
+	}
+	return v
+}
+
+func decodeCBOR(body []byte) (*Packet, error) {
+	var wire cborPacket
+	if err := cborDec.Unmarshal(body, &wire); err != nil {
+		return nil, err
+	}
+	p := &Packet{
+		Protocol:     wire.Protocol,
+		Version:      wire.Version,
+		Type:         wire.Type,
+		SessionToken: wire.SessionToken,
+		Timestamp:    wire.Timestamp,
+	}
+	if wire.Payload != nil {
+		// Byte strings become base64, as handlers expect.
+		payload, err := json.Marshal(wire.Payload)
+		if err != nil {
+			return nil, err
+		}
+		p.Payload = payload
+	}
+	return p, nil
+}
@@ -0,0 +1,321 @@
+package quill
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func testPacket(bodyLen int) *Packet {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"subject": "hello",
+		"body":    strings.Repeat("quill ", bodyLen/6),
+		"count":   3,
+	})
+	return &Packet{
+		Protocol:  "QUILL",
+		Version:   "1.0",
+		Type:      "SEND",
+		Timestamp: time.Date(2026, 10, 19, 12, 0, 0, 5, time.UTC),
+		Payload:   payload,
+	}
+}
+
+// readerConn reads frames from data as a client would have sent them.
+func readerConn(data []byte, limit int) *framedConn {
+	return &framedConn{r: bufio.NewReader(bytes.NewReader(data)), limit: limit}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding byte
+		accepts  byte
+		size     int
+		want     byte // compression used
+	}{
+		{"json small", encodingJSON, supportedCompressions, 10, compressionNone},
+		{"json gzip", encodingJSON, compressionGzip, 4096, compressionGzip},
+		{"json zstd", encodingJSON, supportedCompressions, 4096, compressionZstd},
+		{"json uncompressed", encodingJSON, 0, 4096, compressionNone},
+		{"cbor small", encodingCBOR, supportedCompressions, 10, compressionNone},
+		{"cbor gzip", encodingCBOR, compressionGzip, 4096, compressionGzip},
+		{"cbor zstd", encodingCBOR, compressionZstd, 4096, compressionZstd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := testPacket(tt.size)
+			frame, err := encodeFrame(sent, tt.encoding, tt.accepts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := frame[4] >> 4; got != tt.want {
+				t.Errorf("compression = %d, want %d", got, tt.want)
+			}
+			if n := binary.BigEndian.Uint32(frame[:4]); int(n) != len(frame)-frameHeaderLen {
+				t.Errorf("length %d does not match body of %d bytes", n, len(frame)-frameHeaderLen)
+			}
+
+			got, err := readerConn(frame, maxPacketBytes).ReadPacket()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Type != sent.Type || got.Version != sent.Version || !got.Timestamp.Equal(sent.Timestamp) {
+				t.Errorf("packet = %+v, want %+v", got, sent)
+			}
+			var gotPayload, wantPayload map[string]interface{}
+			if err := json.Unmarshal(got.Payload, &gotPayload); err != nil {
+				t.Fatal(err)
+			}
+			json.Unmarshal(sent.Payload, &wantPayload)
+			if !reflect.DeepEqual(gotPayload, wantPayload) {
+				t.Errorf("payload = %s, want %s", got.Payload, sent.Payload)
+			}
+		})
+	}
+}
+
+func TestReadPacketRejects(t *testing.T) {
+	small, _ := encodeFrame(testPacket(10), encodingJSON, 0)
+	large, _ := encodeFrame(testPacket(4096), encodingJSON, 0)
+	zipped, _ := encodeFrame(testPacket(8192), encodingJSON, compressionZstd)
+	gzipped, _ := encodeFrame(testPacket(8192), encodingJSON, compressionGzip)
+	var oversized [frameHeaderLen]byte
+	binary.BigEndian.PutUint32(oversized[:4], maxPacketBytes+1)
+	withFlags := func(frame []byte, flags byte) []byte {
+		out := bytes.Clone(frame)
+		out[4] = flags
+		return out
+	}
+
+	tests := []struct {
+		name      string
+		data      []byte
+		limit     int
+		malformed bool  // reported, and the connection goes on
+		want      error // otherwise the read error, if known
+	}{
+		{"empty stream", nil, maxPacketBytes, false, io.EOF},
+		{"truncated header", small[:3], maxPacketBytes, false, io.ErrUnexpectedEOF},
+		{"truncated body", small[:len(small)-1], maxPacketBytes, false, io.ErrUnexpectedEOF},
+		{"header only", small[:frameHeaderLen], maxPacketBytes, false, io.ErrUnexpectedEOF},
+		{"oversized length", oversized[:], maxPacketBytes, false, nil},
+		{"over the limit", large, 1024, true, nil},
+		{"truncated over the limit", large[:len(large)-1], 1024, false, io.ErrUnexpectedEOF},
+		{"decompresses over the limit", zipped, 1024, true, nil},
+		{"gunzips over the limit", gzipped, 1024, true, nil},
+		{"unknown compression", withFlags(small, 3<<4), maxPacketBytes, true, nil},
+		{"unknown encoding", withFlags(small, 7), maxPacketBytes, true, nil},
+		{"bad gzip", withFlags(small, compressionGzip<<4), maxPacketBytes, true, nil},
+		{"bad cbor", withFlags(small, encodingCBOR), maxPacketBytes, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := readerConn(tt.data, tt.limit).ReadPacket()
+			if err == nil {
+				t.Fatalf("ReadPacket() = %+v, want an error", p)
+			}
+			var mp *malformedPacketError
+			if got := errors.As(err, &mp); got != tt.malformed {
+				t.Errorf("malformed = %v, want %v (err %v)", got, tt.malformed, err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCBORPayload(t *testing.T) {
+	sent := &Packet{Type: "SEND", Payload: json.RawMessage(`{"size":9007199254740993,"ratio":0.5,"tags":[1,"a"]}`)}
+	body, err := encodeCBOR(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeCBOR(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"ratio":0.5,"size":9007199254740993,"tags":[1,"a"]}`; string(got.Payload) != want {
+		t.Errorf("payload = %s, want %s", got.Payload, want)
+	}
+
+	// A byte string reaches handlers as base64, like attachment content.
+	body, _ = cborEnc.Marshal(map[string]interface{}{"type": "SEND", "payload": map[string]interface{}{"content": []byte("hi")}})
+	if got, err = decodeCBOR(body); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"content":"aGk="}`; string(got.Payload) != want {
+		t.Errorf("payload = %s, want %s", got.Payload, want)
+	}
+
+	if _, err := encodeCBOR(&Packet{Payload: json.RawMessage(`{`)}); err == nil {
+		t.Error("encodeCBOR accepted a broken JSON payload")
+	}
+}
+
+func TestDecodeFrameBoundsZstdMemory(t *testing.T) {
+	zeros := make([]byte, maxPacketBytes)
+	var streamed bytes.Buffer
+	zw, err := zstd.NewWriter(&streamed, zstd.WithWindowSize(maxUnauthenticatedBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(zeros)
+	zw.Close()
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{"one segment", zstdEncoder.EncodeAll(zeros, nil)},
+		{"small window", streamed.Bytes()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			p, err := decodeFrame(compressionZstd<<4|encodingJSON, tt.body, maxUnauthenticatedBytes)
+			runtime.ReadMemStats(&after)
+			if err == nil {
+				t.Fatalf("decodeFrame() = %+v, want an error", p)
+			}
+			if grown := after.TotalAlloc - before.TotalAlloc; grown > 8<<20 {
+				t.Errorf("decoding a %d-byte bomb allocated %d bytes", len(tt.body), grown)
+			}
+		})
+	}
+}
+
+func TestReadPacketSkipsFrameOverLimit(t *testing.T) {
+	large, _ := encodeFrame(testPacket(4096), encodingJSON, 0)
+	small, _ := encodeFrame(testPacket(10), encodingJSON, 0)
+	c := readerConn(append(large, small...), 1024)
+
+	var mp *malformedPacketError
+	if _, err := c.ReadPacket(); !errors.As(err, &mp) {
+		t.Fatalf("first ReadPacket() = %v, want a malformed packet", err)
+	}
+	if _, err := c.ReadPacket(); err != nil {
+		t.Fatalf("frame after a skipped one: %v", err)
+	}
+
+	c = readerConn(large, 1024)
+	c.SetReadLimit(maxPacketBytes)
+	if _, err := c.ReadPacket(); err != nil {
+		t.Errorf("ReadPacket() after raising the limit = %v", err)
+	}
+}
+
+func TestNegotiateFraming(t *testing.T) {
+	tests := []struct {
+		name     string
+		preface  string
+		framed   bool
+		encoding byte
+		accepts  byte
+		fails    bool
+	}{
+		{"json stream", `{"protocol":"QUILL"}` + "\n", false, 0, 0, false},
+		{"cbor with zstd", framingMagic + "\x01\x01\x02", true, encodingCBOR, compressionZstd, false},
+		{"unknown encoding falls back", framingMagic + "\x01\x09\x07", true, encodingJSON, supportedCompressions, false},
+		{"unsupported version", framingMagic + "\x02\x00\x00", false, 0, 0, true},
+		{"bad magic", "\x00QFX\x01\x00\x00", false, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+			go func() {
+				client.Write([]byte(tt.preface))
+				io.Copy(io.Discard, client)
+			}()
+
+			conn, err := negotiateFraming(server)
+			if tt.fails {
+				if err == nil {
+					t.Fatal("negotiateFraming succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			fc, ok := conn.(*framedConn)
+			if ok != tt.framed {
+				t.Fatalf("framed = %v, want %v", ok, tt.framed)
+			}
+			if !ok {
+				return
+			}
+			if fc.encoding != tt.encoding || fc.accepts != tt.accepts {
+				t.Errorf("encoding, accepts = %d, %d, want %d, %d", fc.encoding, fc.accepts, tt.encoding, tt.accepts)
+			}
+			if fc.limit != maxUnauthenticatedBytes {
+				t.Errorf("limit = %d, want %d before authentication", fc.limit, maxUnauthenticatedBytes)
+			}
+		})
+	}
+}
+
+func TestHandleFramedConnection(t *testing.T) {
+	h := NewMessageHandler(nil, &pushMessages{}, nil, nil, nil)
+	server, client := net.Pipe()
+	defer client.Close()
+	go h.Handle(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := client.Write([]byte(framingMagic + "\x01\x01\x02")); err != nil {
+		t.Fatal(err)
+	}
+	var reply [prefaceLen]byte
+	if _, err := io.ReadFull(client, reply[:]); err != nil {
+		t.Fatal(err)
+	}
+	if want := framingMagic + "\x01\x01\x03"; string(reply[:]) != want {
+		t.Fatalf("server preface = %q, want %q", reply[:], want)
+	}
+	peer := readerConn(nil, maxPacketBytes)
+	peer.r = bufio.NewReader(client)
+	read := func() *Packet {
+		t.Helper()
+		p, err := peer.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	// A frame that does not decode is answered, and the next one served.
+	if _, err := client.Write([]byte{0, 0, 0, 1, encodingCBOR, 0xff}); err != nil {
+		t.Fatal(err)
+	}
+	var e ErrorResponsePayload
+	if p := read(); p.Type != PacketTypeErrorResponse || json.Unmarshal(p.Payload, &e) != nil || e.Code != ErrorCodeInvalidPayload {
+		t.Fatalf("bad frame answered with %s %s", p.Type, p.Payload)
+	}
+
+	hello, _ := encodeFrame(&Packet{Protocol: ProtocolName, Type: PacketTypeHello}, encodingCBOR, 0)
+	if _, err := client.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	var caps CapabilitiesPayload
+	if p := read(); p.Type != PacketTypeCapabilities || json.Unmarshal(p.Payload, &caps) != nil || caps.Version != "1.0" {
+		t.Fatalf("HELLO answered with %s %s", p.Type, p.Payload)
+	}
+	if want := []string{"json", "cbor"}; !reflect.DeepEqual(caps.Framing.Encodings, want) {
+		t.Errorf("encodings = %v, want %v", caps.Framing.Encodings, want)
+	}
+}
@@ -3,15 +3,20 @@ package quill
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"os"
+	"quill/pkg/config"
 	"quill/pkg/domain"
+	"quill/pkg/hosting"
+	"quill/pkg/identity"
+	"quill/pkg/models"
+	"runtime/debug"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,35 +26,128 @@ type authService interface {
 
 type messageService interface {
 	// The service layer works with Domain objects, not transport DTOs.
+	ResolvePrincipal(ctx context.Context) (context.Context, error)
 	Send(ctx context.Context, req domain.DomainSendRequest) (domain.DomainSendResult, error)
 	Fetch(ctx context.Context, req domain.DomainFetchRequest) (domain.DomainFetchResult, error)
+	ManageList(ctx context.Context, req domain.DomainListRequest) (domain.DomainListResult, error)
+	ManageRules(ctx context.Context, req domain.DomainRuleRequest) (domain.DomainRuleResult, error)
+	ManageVacation(ctx context.Context, req domain.DomainVacationRequest) (domain.VacationSettings, error)
+	ListFolders(ctx context.Context) (domain.DomainFolderList, error)
+	ManageFolder(ctx context.Context, req domain.DomainFolderRequest) (*domain.Folder, error)
+	ManageLabel(ctx context.Context, req domain.DomainLabelRequest) (*domain.Label, error)
+	MoveMessages(ctx context.Context, req domain.DomainMoveRequest) (int, error)
+	Sync(ctx context.Context, req domain.DomainSyncRequest) (domain.DomainSyncResult, error)
+	UpdateFlags(ctx context.Context, req domain.DomainFlagRequest) (int, error)
+	DeleteMessages(ctx context.Context, messageIDs []string) (int, error)
+	ManageCredentials(ctx context.Context, req domain.DomainCredentialRequest) (domain.DomainCredentialResult, error)
+	GetQuota(ctx context.Context) (domain.QuotaUsage, error)
+	LimitsFor(addr string) domain.Limits
+	GetMessages(ctx context.Context, messageIDs []string) ([]domain.Message, error)
+	Watch(ctx context.Context) (<-chan domain.MailboxChange, error)
+}
+
+// certManager supplies the certificates mail is relayed with and checks
+// those of relaying servers; *certs.Manager implements it.
+type certManager interface {
+	ClientTLSConfig(origin, peerDomain string) *tls.Config
+	VerifyPeer(state tls.ConnectionState, domain string) error
+}
+
+// userService is the self-service part of domain.UserService.
+type userService interface {
+	GetProfile(ctx context.Context) (*models.User, error)
+	UpdateProfile(ctx context.Context, update domain.ProfileUpdate) (*models.User, error)
+	ChangeHandle(ctx context.Context, newAddress string) (*models.User, error)
+	TouchLastLogin(ctx context.Context) error
+	DeleteAccount(ctx context.Context) (*models.User, error)
+	CancelAccountDeletion(ctx context.Context) (*models.User, error)
+	StartExport(ctx context.Context) (*domain.ExportJob, error)
+	GetExport(ctx context.Context, id string) (*domain.ExportJob, error)
 }
 
 type MessageHandler struct {
 	authSvc    authService
 	messageSvc messageService
+	userSvc    userService
+	sessions   SessionStore
+	hosts      *hosting.Registry
+	certs      certManager
+	federation atomic.Pointer[config.FederationConfig] // swapped on config reload
+	// authMethods are advertised by HELLO; see SetAuthBackends.
+	authMethods []string
 }
 
-func NewMessageHandler(as authService, ms messageService) *MessageHandler {
-	return &MessageHandler{
+func NewMessageHandler(as authService, ms messageService, us userService, hosts *hosting.Registry, cm certManager) *MessageHandler {
+	h := &MessageHandler{
 		authSvc:    as,
 		messageSvc: ms,
+		userSvc:    us,
+		sessions:   NewMemorySessionStore(DefaultSessionTTL),
+		hosts:      hosts,
+		certs:      cm,
 	}
+	h.SetFederation(config.Default().Federation)
+	return h
+}
+
+// SetFederation replaces how other Quill servers are reached; safe while
+// messages are being relayed.
+func (h *MessageHandler) SetFederation(f config.FederationConfig) {
+	h.federation.Store(&f)
 }
 
+// Sessions exposes the session store, e.g. to revoke a user's sessions.
+func (h *MessageHandler) Sessions() SessionStore {
+	return h.sessions
+}
+
+// Handle serves a TCP or TLS connection in the framing its client opens
+// with.
 func (h *MessageHandler) Handle(conn net.Conn) {
-	defer func(conn net.Conn) {
+	pc, err := negotiateFraming(conn)
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			log.Printf("WARN: framing negotiation with %s failed: %v", conn.RemoteAddr(), err)
+		}
+		_ = conn.Close()
+		return
+	}
+	h.Serve(pc)
+}
+
+// Serve answers the packets of one client connection, whatever its
+// transport, until the client goes away.
+func (h *MessageHandler) Serve(conn PacketConn) {
+	defer func(conn PacketConn) {
 		err := conn.Close()
 		if err != nil {
 
 		}
 	}(conn)
+	// A bug handling one client must not take the server down with it.
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ERROR: panic serving %s: %v\n%s", conn.RemoteAddr(), r, debug.Stack())
+		}
+	}()
 	log.Printf("INFO: new client connected: %s", conn.RemoteAddr())
+	// A relaying server counts as authenticated only once its certificate
+	// has been checked for the domain its first packet comes from.
+	limiter, limited := conn.(readLimiter)
 
-	decoder := json.NewDecoder(conn)
+	state := &connState{}
+	defer state.unsubscribe()
 	for {
-		var packet Packet
-		if err := decoder.Decode(&packet); err != nil {
+		packet, err := conn.ReadPacket()
+		if err != nil {
+			var malformed *malformedPacketError
+			if errors.As(err, &malformed) {
+				// The transport found where the packet ended, so the
+				// connection can go on.
+				log.Printf("WARN: malformed packet from %s: %v", conn.RemoteAddr(), malformed.err)
+				h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "Cannot parse packet: "+malformed.err.Error())
+				continue
+			}
 			if err == io.EOF {
 				log.Printf("INFO: client disconnected cleanly: %s", conn.RemoteAddr())
 			} else {
@@ -58,22 +156,56 @@ func (h *MessageHandler) Handle(conn net.Conn) {
 			return
 		}
 
-		h.dispatch(conn, &packet)
+		h.dispatch(conn, state, packet)
+		if limited && state.authenticated {
+			limiter.SetReadLimit(maxPacketBytes)
+			limited = false
+		}
 	}
 }
 
 // dispatch validates the packet and routes it to the correct specific handler.
-func (h *MessageHandler) dispatch(conn net.Conn, packet *Packet) {
+func (h *MessageHandler) dispatch(conn PacketConn, state *connState, packet *Packet) {
 	ctx := context.Background()
 
-	//The `packet.SessionToken` is the Firebase ID Token.
+	if err := checkPacketVersion(packet); err != nil {
+		log.Printf("WARN: rejected %s packet from %s: %v", packet.Type, conn.RemoteAddr(), err)
+		h.writeErrorResponse(conn, ErrorCodeUnsupportedVersion, err.Error())
+		return
+	}
+
+	// HELLO needs no session; AUTH and LOGOUT manage it themselves.
+	switch packet.Type {
+	case PacketTypeHello:
+		h.handleHello(conn, state, packet)
+		return
+	case PacketTypeAuth:
+		h.handleAuth(conn, state, packet)
+		return
+	case PacketTypeLogout:
+		h.handleLogout(conn, state, packet)
+		return
+	}
+
+	// Servers relaying mail carry no token; their client certificate
+	// identifies them instead.
+	if packet.Type == PacketTypeSend && packet.SessionToken == "" && state.session == "" {
+		if tlsState, ok := conn.PeerTLS(); ok {
+			h.handlePeerSend(ctx, conn, state, tlsState, packet.Payload)
+			return
+		}
+	}
+
+	// `packet.SessionToken` is a session token from AUTH or an identity
+	// token (Firebase ID token, JWT, API key) verified on every packet.
 	var err error
-	ctx, err = h.authSvc.Authenticate(ctx, packet.SessionToken)
+	ctx, err = h.authenticate(ctx, state, packet.SessionToken)
 	if err != nil {
 		log.Printf("WARN: authentication failed for client %s: %v", conn.RemoteAddr(), err)
-		h.writeErrorResponse(conn, ErrorCodeAuthFailed, "Invalid or expired session token.")
+		h.writeAuthError(conn, err)
 		return
 	}
+	state.authenticated = true
 
 	if userID, ok := UserIDFromContext(ctx); ok {
 		log.Printf("INFO: client %s authenticated as user '%s'. Received packet type '%s'",
@@ -89,13 +221,45 @@ func (h *MessageHandler) dispatch(conn net.Conn, packet *Packet) {
 		h.handleFetch(ctx, conn, packet.Payload)
 	case PacketTypePing:
 		h.handlePing(conn)
+	case PacketTypeList:
+		h.handleList(ctx, conn, packet.Payload)
+	case PacketTypeRule:
+		h.handleRule(ctx, conn, packet.Payload)
+	case PacketTypeVacation:
+		h.handleVacation(ctx, conn, packet.Payload)
+	case PacketTypeListFolders:
+		h.handleListFolders(ctx, conn)
+	case PacketTypeFolder:
+		h.handleFolder(ctx, conn, packet.Payload)
+	case PacketTypeLabel:
+		h.handleLabel(ctx, conn, packet.Payload)
+	case PacketTypeMove:
+		h.handleMove(ctx, conn, packet.Payload)
+	case PacketTypeSync:
+		h.handleSync(ctx, conn, packet.Payload)
+	case PacketTypeFlag:
+		h.handleFlag(ctx, conn, packet.Payload)
+	case PacketTypeDelete:
+		h.handleDelete(ctx, conn, packet.Payload)
+	case PacketTypeCredential:
+		h.handleCredential(ctx, conn, packet.Payload)
+	case PacketTypeProfile:
+		h.handleProfile(ctx, conn, packet.Payload)
+	case PacketTypeDeleteAccount:
+		h.handleDeleteAccount(ctx, conn, packet.Payload)
+	case PacketTypeExport:
+		h.handleExport(ctx, conn, packet.Payload)
+	case PacketTypeQuota:
+		h.handleQuota(ctx, conn)
+	case PacketTypeSubscribe:
+		h.handleSubscribe(ctx, conn, state, packet)
 	default:
 		log.Printf("WARN: unknown packet type: '%s'", packet.Type)
 		h.writeErrorResponse(conn, ErrorCodeUnknownType, "The packet type is not supported.")
 	}
 }
 
-func (h *MessageHandler) handleSend(ctx context.Context, conn net.Conn, payload json.RawMessage) {
+func (h *MessageHandler) handleSend(ctx context.Context, conn PacketConn, payload json.RawMessage) {
 	var req SendPayload
 	if err := json.Unmarshal(payload, &req); err != nil {
 		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "Cannot parse SEND payload: "+err.Error())
@@ -144,6 +308,7 @@ func (h *MessageHandler) handleSend(ctx context.Context, conn net.Conn, payload
 
 	// 4) Build domain request
 	domainReq := domain.DomainSendRequest{
+		MessageID:   req.MessageID,
 		From:        req.From,
 		To:          req.To,
 		CC:          req.CC,
@@ -152,23 +317,54 @@ func (h *MessageHandler) handleSend(ctx context.Context, conn net.Conn, payload
 		Body:        domain.Body{Content: contents},
 		Attachments: atts,
 		Options:     domain.SendOptions{ExpiresInSeconds: expiresPtr, OneTime: oneTimePtr, ThreadID: threadIDPtr},
+		Envelope:    req.EnvelopeTo,
+		ListID:      req.ListID,
+		ForwardedBy: req.ForwardedBy,
+		ReplyTo:     req.ReplyTo,
+		// Keep the marker so automated mail from other servers is not answered.
+		AutoSubmitted: req.AutoSubmitted,
+	}
+	// List headers and the automation marker are set by servers; a client
+	// cannot claim them.
+	if p, ok := identity.FromContext(ctx); !ok || !p.Relayed() {
+		domainReq.ListID, domainReq.ReplyTo, domainReq.AutoSubmitted = "", "", ""
+	}
+
+	// 5) Enforce size limits before anything is stored
+	if err := h.messageSvc.LimitsFor(domainReq.From).Check(domainReq); err != nil {
+		if errors.Is(err, domain.ErrTooManyAttachments) {
+			h.writeErrorResponse(conn, ErrorCodeTooManyAttachments, err.Error())
+		} else {
+			h.writeErrorResponse(conn, ErrorCodeMessageTooLarge, err.Error())
+		}
+		return
 	}
 
-	// 5) Call service
+	// 6) Call service
 	result, err := h.messageSvc.Send(ctx, domainReq)
 	if err != nil {
 		log.Printf("ERROR: service call to Send failed: %v", err)
-		h.writeErrorResponse(conn, ErrorCodeServiceError, "Failed to send the message.")
+		switch {
+		case errors.Is(err, domain.ErrListPostDenied):
+			h.writeErrorResponse(conn, ErrorCodeListPostDenied, err.Error())
+		case errors.Is(err, domain.ErrQuotaExceeded):
+			h.writeErrorResponse(conn, ErrorCodeQuotaExceeded, "Your mailbox is full; delete messages to send again.")
+		case errors.Is(err, domain.ErrMailboxFull):
+			h.writeErrorResponse(conn, ErrorCodeMailboxFull, err.Error())
+		case errors.Is(err, domain.ErrPermissionDenied):
+			h.writeErrorResponse(conn, ErrorCodePermissionDenied, err.Error())
+		default:
+			h.writeErrorResponse(conn, ErrorCodeServiceError, "Failed to send the message.")
+		}
 		return
 	}
-	// 6) send packet to non Quill users
-	if len(result.QueuedFor) > 0 {
+	// 7) send packet to non Quill users
+	if len(result.Relays) > 0 {
 		sendReq := SendPayload{
 			MessageID:   result.MessageID,
 			From:        req.From,
 			To:          req.To,
 			CC:          req.CC,
-			BCC:         req.BCC,
 			Subject:     req.Subject,
 			Body:        req.Body,
 			Attachments: req.Attachments,
@@ -177,35 +373,84 @@ func (h *MessageHandler) handleSend(ctx context.Context, conn net.Conn, payload
 				OneTime:          req.Options.OneTime,
 				ThreadID:         result.ThreadID,
 			},
+			AutoSubmitted: domainReq.AutoSubmitted,
 		}
-		for _, addr := range result.QueuedFor {
-			if addr == "" {
-				continue // skip empty addresses
-			}
-			addr = extractDomain(addr)
-			sendResult, err := sendQuillMessage(addr, sendReq)
-			if err != nil {
-				log.Printf("ERROR: failed to send message to %s: %v", addr, err)
-				h.writeErrorResponse(conn, ErrorCodeDeliveryFailed, fmt.Sprintf("Failed to queue message for %s: %v", addr, err))
-				continue
-			}
-			log.Printf("INFO: queued message %s for external delivery to %s", sendResult, addr)
-
-			log.Printf("INFO: Queued message %s for external delivery to %s", result.MessageID, addr)
+		h.relay(conn, sendReq, result.Relays)
+	}
+	// Vacation replies to senders on other servers
+	for _, ar := range result.AutoReplies {
+		if len(ar.Result.Relays) > 0 {
+			h.relay(conn, sendPayloadFromDomain(ar.Request, ar.Result), ar.Result.Relays)
 		}
 	}
-	// 7) Construct and send response
+	// 8) Construct and send response
 	resp := SendResponsePayload{
 		Status:      StatusOK,
 		MessageID:   result.MessageID,
 		ThreadID:    result.ThreadID,
 		DeliveredTo: result.DeliveredTo,
 		QueuedFor:   result.QueuedFor,
+		HeldFor:     result.Held,
+		BouncedFor:  result.Bounced,
 	}
 	h.writeResponse(conn, PacketTypeSendResponse, resp)
 }
 
-func (h *MessageHandler) handleFetch(ctx context.Context, conn net.Conn, payload json.RawMessage) {
+// relay forwards a message to other Quill servers. Each batch becomes one
+// SEND whose envelope names only the recipients on that server, so list
+// members and BCC recipients never appear in the relayed headers.
+func (h *MessageHandler) relay(conn PacketConn, payload SendPayload, relays []domain.Relay) {
+	h.forward(payload, relays, func(dom string, err error) {
+		h.writeErrorResponse(conn, ErrorCodeDeliveryFailed, fmt.Sprintf("Failed to queue message for %s: %v", dom, err))
+	})
+}
+
+// Relay forwards the batches of a delivery made outside the Quill protocol,
+// and those of the vacation replies it triggered, to other Quill servers.
+func (h *MessageHandler) Relay(req domain.DomainSendRequest, result domain.DomainSendResult) error {
+	var errs []error
+	failed := func(dom string, err error) {
+		errs = append(errs, fmt.Errorf("relaying to %s: %w", dom, err))
+	}
+	h.forward(sendPayloadFromDomain(req, result), result.Relays, failed)
+	for _, ar := range result.AutoReplies {
+		if len(ar.Result.Relays) > 0 {
+			h.forward(sendPayloadFromDomain(ar.Request, ar.Result), ar.Result.Relays, failed)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// forward sends one SEND per relay batch and reports each failed batch.
+func (h *MessageHandler) forward(payload SendPayload, relays []domain.Relay, failed func(dom string, err error)) {
+	for _, r := range relays {
+		if r.Domain == "" {
+			continue // skip addresses without a domain
+		}
+		batch := payload
+		batch.EnvelopeTo = r.Recipients
+		batch.ListID = r.ListID
+		batch.ReplyTo = r.ReplyTo
+		batch.ForwardedBy = r.ForwardedBy
+		if r.ForwardedBy != "" {
+			// The forwarder sends the copy on; the receiving server does
+			// not take the original sender on our word.
+			batch.From = r.ForwardedBy
+		}
+		origin := relayOrigin(batch)
+		tlsCfg := h.certs.ClientTLSConfig(h.hosts.ForAddress(origin).Name, r.Domain)
+		sendResult, err := sendQuillMessage(h.federation.Load(), tlsCfg, r.Domain, batch)
+		if err != nil {
+			log.Printf("ERROR: failed to send message to %s: %v", r.Domain, err)
+			failed(r.Domain, err)
+			continue
+		}
+		log.Printf("INFO: queued message %s for external delivery to %s (%d recipients): %s",
+			batch.MessageID, r.Domain, len(r.Recipients), sendResult.Type)
+	}
+}
+
+func (h *MessageHandler) handleFetch(ctx context.Context, conn PacketConn, payload json.RawMessage) {
 	var req FetchPayload
 	if err := json.Unmarshal(payload, &req); err != nil {
 		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "Cannot parse FETCH payload: "+err.Error())
@@ -219,10 +464,19 @@ func (h *MessageHandler) handleFetch(ctx context.Context, conn net.Conn, payload
 		mode = domain.FetchModeThread
 	case string(domain.FetchModeFolder):
 		mode = domain.FetchModeFolder
+	case string(domain.FetchModeLabel):
+		mode = domain.FetchModeLabel
+	case string(domain.FetchModeMessage):
+		if req.MessageID == "" {
+			h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "FETCH in message mode needs message_id")
+			return
+		}
+		mode = domain.FetchModeMessage
 	default:
 		h.writeErrorResponse(conn, ErrorCodeInvalidMode, fmt.Sprintf(
-			"Invalid fetch mode %q; must be %q or %q", req.Mode,
-			string(domain.FetchModeThread), string(domain.FetchModeFolder),
+			"Invalid fetch mode %q; must be %q, %q, %q or %q", req.Mode,
+			string(domain.FetchModeThread), string(domain.FetchModeFolder), string(domain.FetchModeLabel),
+			string(domain.FetchModeMessage),
 		))
 		return
 	}
@@ -235,6 +489,14 @@ func (h *MessageHandler) handleFetch(ctx context.Context, conn net.Conn, payload
 	if req.Folder != "" {
 		folderPtr = &req.Folder
 	}
+	var labelPtr *string
+	if req.Label != "" {
+		labelPtr = &req.Label
+	}
+	var messageIDPtr *string
+	if req.MessageID != "" {
+		messageIDPtr = &req.MessageID
+	}
 	var limitPtr *int
 	if req.Limit > 0 {
 		limitPtr = &req.Limit
@@ -246,24 +508,79 @@ func (h *MessageHandler) handleFetch(ctx context.Context, conn net.Conn, payload
 
 	// 2) Build domain request
 	domainReq := domain.DomainFetchRequest{
-		Mode:     mode,
-		ThreadID: threadIDPtr,
-		Folder:   folderPtr,
-		Limit:    limitPtr,
-		Offset:   offsetPtr,
+		Mode:      mode,
+		ThreadID:  threadIDPtr,
+		Folder:    folderPtr,
+		Label:     labelPtr,
+		MessageID: messageIDPtr,
+		Limit:     limitPtr,
+		Offset:    offsetPtr,
+		Cursor:    req.Cursor,
 	}
 
 	// 3) Call business layer
 	result, err := h.messageSvc.Fetch(ctx, domainReq)
 	if err != nil {
 		log.Printf("ERROR: service call to Fetch failed: %v", err)
+		if errors.Is(err, domain.ErrInvalidCursor) {
+			h.writeErrorResponse(conn, ErrorCodeInvalidCursor, err.Error())
+			return
+		}
 		h.writeErrorResponse(conn, ErrorCodeServiceError, "Failed to fetch messages.")
 		return
 	}
 
 	// 4) Map domain messages to DTOs
-	dtos := make([]MessageDTO, len(result.Messages))
-	for i, m := range result.Messages {
+	dtos := messagesToDTO(result.Messages)
+
+	// 5) Construct and send response
+	resp := FetchResponsePayload{
+		Status:     StatusOK,
+		Mode:       req.Mode,
+		Messages:   dtos,
+		Total:      result.Total,
+		Limit:      result.Limit,
+		Offset:     result.Offset,
+		NextCursor: result.NextCursor,
+		SyncToken:  formatSyncToken(result.ModSeq),
+	}
+	h.writeResponse(conn, PacketTypeFetchResponse, resp)
+}
+
+// sendPayloadFromDomain builds the SEND payload relaying a message that did
+// not arrive as a SEND packet, such as an auto-reply. BCC is left out.
+func sendPayloadFromDomain(req domain.DomainSendRequest, result domain.DomainSendResult) SendPayload {
+	body := BodyPayload{Content: make([]ContentPart, len(req.Body.Content))}
+	for i, c := range req.Body.Content {
+		body.Content[i] = ContentPart{Type: string(c.Type), Value: c.Value}
+	}
+	var atts []Attachment
+	for _, a := range req.Attachments {
+		atts = append(atts, Attachment{Filename: a.Filename, Mimetype: a.Mimetype, ContentBase64: a.URL})
+	}
+	opts := SendOptions{ThreadID: result.ThreadID}
+	if req.Options.ExpiresInSeconds != nil {
+		opts.ExpiresInSeconds = *req.Options.ExpiresInSeconds
+	}
+	if req.Options.OneTime != nil {
+		opts.OneTime = *req.Options.OneTime
+	}
+	return SendPayload{
+		MessageID:     result.MessageID,
+		From:          req.From,
+		To:            req.To,
+		CC:            req.CC,
+		Subject:       req.Subject,
+		Body:          body,
+		Attachments:   atts,
+		Options:       opts,
+		AutoSubmitted: req.AutoSubmitted,
+	}
+}
+
+func messagesToDTO(messages []domain.Message) []MessageDTO {
+	dtos := make([]MessageDTO, len(messages))
+	for i, m := range messages {
 		// map body parts
 		bp := BodyPayload{Content: make([]ContentPart, len(m.Body.Content))}
 		for j, c := range m.Body.Content {
@@ -277,34 +594,29 @@ func (h *MessageHandler) handleFetch(ctx context.Context, conn net.Conn, payload
 		}
 
 		dtos[i] = MessageDTO{
-			MessageID:   m.MessageID,
-			ThreadID:    m.ThreadID,
-			From:        m.From,
-			To:          m.To,
-			CC:          m.CC,
-			BCC:         m.BCC,
-			Subject:     m.Subject,
-			Body:        bp,
-			Attachments: atts,
-			SentAt:      m.SentAt,
-			Read:        m.Read,
-			Flags:       m.Flags,
+			MessageID:     m.MessageID,
+			ThreadID:      m.ThreadID,
+			From:          m.From,
+			To:            m.To,
+			CC:            m.CC,
+			BCC:           m.BCC,
+			Subject:       m.Subject,
+			Body:          bp,
+			Attachments:   atts,
+			SentAt:        m.SentAt,
+			Read:          m.Read,
+			Flags:         m.Flags,
+			Labels:        m.Labels,
+			Folder:        m.Folder,
+			ListID:        m.ListID,
+			ReplyTo:       m.ReplyTo,
+			AutoSubmitted: m.AutoSubmitted,
 		}
 	}
-
-	// 5) Construct and send response
-	resp := FetchResponsePayload{
-		Status:   StatusOK,
-		Mode:     req.Mode,
-		Messages: dtos,
-		Total:    result.Total,
-		Limit:    result.Limit,
-		Offset:   result.Offset,
-	}
-	h.writeResponse(conn, PacketTypeFetchResponse, resp)
+	return dtos
 }
 
-func (h *MessageHandler) handlePing(conn net.Conn) {
+func (h *MessageHandler) handlePing(conn PacketConn) {
 	respPayload := PingResponsePayload{
 		Status:     StatusOK,
 		ServerTime: time.Now().UTC().Format(time.RFC3339),
@@ -312,7 +624,7 @@ func (h *MessageHandler) handlePing(conn net.Conn) {
 	h.writeResponse(conn, PacketTypePingResponse, respPayload)
 }
 
-func (h *MessageHandler) writeResponse(conn net.Conn, packetType string, payload interface{}) {
+func (h *MessageHandler) writeResponse(conn PacketConn, packetType string, payload interface{}) {
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
 		log.Printf("FATAL: could not marshal response payload: %v", err)
@@ -327,12 +639,12 @@ func (h *MessageHandler) writeResponse(conn net.Conn, packetType string, payload
 		Payload:   payloadBytes,
 	}
 
-	if err := json.NewEncoder(conn).Encode(responsePacket); err != nil {
+	if err := conn.WritePacket(&responsePacket); err != nil {
 		log.Printf("ERROR: failed to write response to client %s: %v", conn.RemoteAddr(), err)
 	}
 }
 
-func (h *MessageHandler) writeErrorResponse(conn net.Conn, code, message string) {
+func (h *MessageHandler) writeErrorResponse(conn PacketConn, code, message string) {
 	errorPayload := ErrorResponsePayload{
 		Status:  StatusError,
 		Code:    code,
@@ -342,7 +654,9 @@ func (h *MessageHandler) writeErrorResponse(conn net.Conn, code, message string)
 }
 
 func sendQuillMessage(
-	addr string,
+	fed *config.FederationConfig,
+	tlsCfg *tls.Config,
+	peerDomain string,
 	payload SendPayload,
 ) (*Packet, error) {
 	// Marshall the SendPayload into a raw JSON message.
@@ -363,30 +677,15 @@ func sendQuillMessage(
 
 	// Use your existing sendAndReceiveTLS function.
 	fmt.Println("Attempting to send Quill message...")
-	return sendAndReceiveTLS(addr, &pkt)
+	return sendAndReceiveTLS(fed.PeerAddress(peerDomain), tlsCfg, fed.DialTimeout, &pkt)
 }
 
-func sendAndReceiveTLS(addr string, pkt *Packet) (*Packet, error) {
-	// 1) Load the self-signed cert so we can trust it
-	caPath := "../certificate/quill.crt"
-	caPEM, err := os.ReadFile(caPath)
-	if err != nil {
-		return nil, fmt.Errorf("could not read CA file %s: %w", caPath, err)
-	}
-	roots := x509.NewCertPool()
-	if !roots.AppendCertsFromPEM(caPEM) {
-		return nil, fmt.Errorf("failed to append CA cert")
-	}
-
-	// 2) Build a TLS config that trusts that cert
-	tlsCfg := &tls.Config{
-		RootCAs:            roots,
-		ServerName:         "localhost", // must match the CN in quill.crt
-		InsecureSkipVerify: true,
-	}
-
-	// 3) Dial via TLS instead of plain TCP
-	conn, err := tls.Dial("tcp", addr, tlsCfg)
+// sendAndReceiveTLS sends pkt to the peer at addr and returns its reply.
+// tlsCfg verifies the peer's certificate against its domain.
+func sendAndReceiveTLS(addr string, tlsCfg *tls.Config, timeout time.Duration, pkt *Packet) (*Packet, error) {
+	// 1) Dial via TLS instead of plain TCP
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, tlsCfg)
 	if err != nil {
 		return nil, fmt.Errorf("tls.Dial(%q) failed: %w", addr, err)
 	}
@@ -397,12 +696,12 @@ func sendAndReceiveTLS(addr string, pkt *Packet) (*Packet, error) {
 		}
 	}(conn)
 
-	// 4) Send your Packet as JSON
+	// 2) Send your Packet as JSON
 	if err := json.NewEncoder(conn).Encode(pkt); err != nil {
 		return nil, fmt.Errorf("failed to send packet: %w", err)
 	}
 
-	// 5) Read and decode the JSON response
+	// 3) Read and decode the JSON response
 	var resp Packet
 	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
 		if err == io.EOF {
@@ -0,0 +1,76 @@
+package quill
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"quill/pkg/domain"
+	"quill/pkg/identity"
+)
+
+// panicConn panics on the first read, standing in for a handler bug.
+type panicConn struct{ closed bool }
+
+func (c *panicConn) ReadPacket() (*Packet, error) { panic("boom") }
+func (c *panicConn) WritePacket(*Packet) error    { return nil }
+func (c *panicConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+}
+func (c *panicConn) PeerTLS() (tls.ConnectionState, bool) { return tls.ConnectionState{}, false }
+func (c *panicConn) Close() error                         { c.closed = true; return nil }
+
+func TestServeRecoversFromPanic(t *testing.T) {
+	conn := &panicConn{}
+	(&MessageHandler{}).Serve(conn)
+	if !conn.closed {
+		t.Fatal("connection left open after a panic")
+	}
+}
+
+// sendMessages records the send it is asked for.
+type sendMessages struct {
+	messageService
+	got *domain.DomainSendRequest
+}
+
+func (m *sendMessages) LimitsFor(string) domain.Limits { return domain.Limits{} }
+
+func (m *sendMessages) Send(_ context.Context, req domain.DomainSendRequest) (domain.DomainSendResult, error) {
+	m.got = &req
+	return domain.DomainSendResult{MessageID: req.MessageID}, nil
+}
+
+func TestSendTrustsServerHeadersFromServersOnly(t *testing.T) {
+	payload := `{"from":"eve~example.org","to":["ada~example.com"],"body":{"content":[{"type":"text/plain","value":"hi"}]},` +
+		`"list_id":"team~example.org","reply_to":"team~example.org","auto_submitted":"auto-generated"}`
+	tests := []struct {
+		method identity.AuthMethod
+		want   string
+		auto   string
+	}{
+		{identity.AuthMethodFirebase, "", ""},
+		{identity.AuthMethodAPIKey, "", ""},
+		{identity.AuthMethodPeer, "team~example.org", "auto-generated"},
+		{identity.AuthMethodSMTP, "team~example.org", "auto-generated"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.method), func(t *testing.T) {
+			msgs := &sendMessages{}
+			h := NewMessageHandler(nil, msgs, nil, nil, nil)
+			ctx := identity.WithPrincipal(context.Background(), &identity.Principal{AccountID: "example.org", Method: tt.method})
+			h.handleSend(ctx, &recordConn{}, json.RawMessage(payload))
+			if msgs.got == nil {
+				t.Fatal("service not called")
+			}
+			if msgs.got.ListID != tt.want || msgs.got.ReplyTo != tt.want {
+				t.Errorf("list %q, reply-to %q; want %q", msgs.got.ListID, msgs.got.ReplyTo, tt.want)
+			}
+			if msgs.got.AutoSubmitted != tt.auto {
+				t.Errorf("auto-submitted %q, want %q", msgs.got.AutoSubmitted, tt.auto)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package quill
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"quill/pkg/domain"
+	"quill/pkg/identity"
+)
+
+// requestTypes are the packet types clients may send, as advertised in
+// CAPABILITIES. Keep in step with dispatch.
+var requestTypes = []string{
+	PacketTypeHello,
+	PacketTypeAuth,
+	PacketTypeLogout,
+	PacketTypePing,
+	PacketTypeSend,
+	PacketTypeFetch,
+	PacketTypeSync,
+	PacketTypeFlag,
+	PacketTypeDelete,
+	PacketTypeMove,
+	PacketTypeListFolders,
+	PacketTypeFolder,
+	PacketTypeLabel,
+	PacketTypeList,
+	PacketTypeRule,
+	PacketTypeVacation,
+	PacketTypeCredential,
+	PacketTypeProfile,
+	PacketTypeDeleteAccount,
+	PacketTypeExport,
+	PacketTypeQuota,
+	PacketTypeSubscribe,
+}
+
+// authBackendMethods maps the auth backends of the configuration to the
+// kinds of token they accept.
+var authBackendMethods = map[string][]identity.AuthMethod{
+	"firebase":    {identity.AuthMethodFirebase},
+	"jwt":         {identity.AuthMethodJWT},
+	"credentials": {identity.AuthMethodAPIKey, identity.AuthMethodAppPassword},
+}
+
+// SetAuthBackends records which auth backends are configured, so HELLO can
+// tell clients which tokens to present. Sessions from AUTH always work.
+func (h *MessageHandler) SetAuthBackends(backends []string) {
+	methods := []string{"session"}
+	for _, b := range backends {
+		for _, m := range authBackendMethods[b] {
+			methods = append(methods, string(m))
+		}
+	}
+	h.authMethods = methods
+}
+
+// HELLO
+
+// handleHello negotiates the protocol version and describes the server. It
+// needs no authentication; with a token, limits are the caller's.
+func (h *MessageHandler) handleHello(conn PacketConn, state *connState, packet *Packet) {
+	var req HelloPayload
+	if len(packet.Payload) > 0 {
+		if err := json.Unmarshal(packet.Payload, &req); err != nil {
+			h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "Cannot parse HELLO payload: "+err.Error())
+			return
+		}
+	}
+
+	offered := req.Versions
+	if len(offered) == 0 {
+		offered = []string{packet.Version}
+		if packet.Version == "" {
+			offered = []string{"1.0"}
+		}
+	}
+	version, err := negotiateVersion(offered)
+	if err != nil {
+		h.writeErrorResponse(conn, ErrorCodeUnsupportedVersion, err.Error())
+		return
+	}
+	state.version = version.String()
+	log.Printf("INFO: client %s (%s) speaks protocol %s", conn.RemoteAddr(), req.Client, state.version)
+
+	limitsFor := ""
+	if packet.SessionToken != "" || state.session != "" {
+		if ctx, err := h.authenticate(context.Background(), state, packet.SessionToken); err == nil {
+			if p, ok := identity.FromContext(ctx); ok {
+				limitsFor = p.Address()
+			}
+		}
+	}
+	limits := h.messageSvc.LimitsFor(limitsFor)
+
+	authMethods := h.authMethods
+	if authMethods == nil {
+		authMethods = []string{"session"}
+	}
+	h.writeResponse(conn, PacketTypeCapabilities, CapabilitiesPayload{
+		Status:        StatusOK,
+		Version:       state.version,
+		ServerVersion: ProtocolVersion,
+		PacketTypes:   requestTypes,
+		FetchModes: []string{
+			string(domain.FetchModeFolder),
+			string(domain.FetchModeThread),
+			string(domain.FetchModeLabel),
+			string(domain.FetchModeMessage),
+		},
+		ContentTypes: []string{
+			string(domain.ContentTypePlainText),
+			string(domain.ContentTypeHTML),
+		},
+		AuthMethods: authMethods,
+		Limits: CapabilityLimits{
+			MaxMessageBytes: limits.MaxMessageBytes,
+			MaxAttachments:  limits.MaxAttachments,
+		},
+		Framing: CapabilityFraming{
+			Encodings:    sortedNames(encodingNames),
+			Compressions: sortedNames(compressionNames),
+		},
+	})
+}
@@ -0,0 +1,142 @@
+package quill
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"quill/pkg/domain"
+)
+
+func (h *MessageHandler) handleList(ctx context.Context, conn PacketConn, payload json.RawMessage) {
+	var req ListPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "Cannot parse LIST payload: "+err.Error())
+		return
+	}
+
+	// 1) DTO → Domain: validate the action and optional settings
+	action := domain.ListAction(req.Action)
+	switch action {
+	case domain.ListActionCreate, domain.ListActionGet, domain.ListActionUpdate, domain.ListActionDelete,
+		domain.ListActionAddMembers, domain.ListActionRemoveMembers, domain.ListActionArchive,
+		domain.ListActionPending, domain.ListActionApprove, domain.ListActionReject:
+		// valid
+	default:
+		h.writeErrorResponse(conn, ErrorCodeInvalidAction, fmt.Sprintf("Invalid list action %q", req.Action))
+		return
+	}
+	if req.Address == "" {
+		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "LIST requires an address")
+		return
+	}
+
+	domainReq := domain.DomainListRequest{
+		Action:      action,
+		Address:     req.Address,
+		Name:        req.Name,
+		Description: req.Description,
+		Owners:      req.Owners,
+		Members:     req.Members,
+	}
+	if req.PostingPolicy != "" {
+		p := domain.PostingPolicy(req.PostingPolicy)
+		domainReq.PostingPolicy = &p
+	}
+	if req.ReplyTo != "" {
+		r := domain.ReplyToMode(req.ReplyTo)
+		domainReq.ReplyTo = &r
+	}
+	if req.ArchiveAccess != "" {
+		a := domain.ArchiveAccess(req.ArchiveAccess)
+		domainReq.ArchiveAccess = &a
+	}
+	if req.MessageID != "" {
+		domainReq.MessageID = &req.MessageID
+	}
+	if req.Limit > 0 {
+		domainReq.Limit = &req.Limit
+	}
+	if req.Offset > 0 {
+		domainReq.Offset = &req.Offset
+	}
+
+	// 2) Call service
+	result, err := h.messageSvc.ManageList(ctx, domainReq)
+	if err != nil {
+		log.Printf("ERROR: service call to ManageList failed: %v", err)
+		h.writeListError(conn, err)
+		return
+	}
+
+	// 3) An approved post still has to reach remote members
+	if result.Approved != nil && result.Delivery != nil && len(result.Delivery.Relays) > 0 {
+		dto := messagesToDTO([]domain.Message{*result.Approved})[0]
+		h.relay(conn, SendPayload{
+			MessageID:   dto.MessageID,
+			From:        dto.From,
+			To:          dto.To,
+			CC:          dto.CC,
+			Subject:     dto.Subject,
+			Body:        dto.Body,
+			Attachments: dto.Attachments,
+			Options:     SendOptions{ThreadID: dto.ThreadID},
+		}, result.Delivery.Relays)
+	}
+
+	// 4) Construct and send response
+	resp := ListResponsePayload{
+		Status: StatusOK,
+		Action: req.Action,
+	}
+	if result.List != nil {
+		resp.List = mailingListToDTO(result.List)
+	}
+	if result.Archive != nil {
+		resp.Messages = messagesToDTO(result.Archive.Messages)
+		resp.Total = result.Archive.Total
+		resp.Limit = result.Archive.Limit
+		resp.Offset = result.Archive.Offset
+	}
+	for _, p := range result.Pending {
+		resp.Pending = append(resp.Pending, PendingPostDTO{
+			MessageID: p.MessageID,
+			ThreadID:  p.ThreadID,
+			From:      p.From,
+			Subject:   p.Subject,
+			HeldAt:    p.HeldAt,
+		})
+	}
+	h.writeResponse(conn, PacketTypeListResponse, resp)
+}
+
+func (h *MessageHandler) writeListError(conn PacketConn, err error) {
+	switch {
+	case errors.Is(err, domain.ErrListNotFound), errors.Is(err, domain.ErrPendingNotFound):
+		h.writeErrorResponse(conn, ErrorCodeNotFound, err.Error())
+	case errors.Is(err, domain.ErrPermissionDenied):
+		h.writeErrorResponse(conn, ErrorCodePermissionDenied, err.Error())
+	case errors.Is(err, domain.ErrListExists):
+		h.writeErrorResponse(conn, ErrorCodeAlreadyExists, err.Error())
+	case errors.Is(err, domain.ErrInvalidListConfig):
+		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, err.Error())
+	default:
+		h.writeErrorResponse(conn, ErrorCodeServiceError, "Failed to manage the mailing list.")
+	}
+}
+
+func mailingListToDTO(l *domain.MailingList) *MailingListDTO {
+	return &MailingListDTO{
+		Address:       l.Address,
+		Name:          l.Name,
+		Description:   l.Description,
+		Owners:        l.Owners,
+		Members:       l.Members,
+		PostingPolicy: string(l.PostingPolicy),
+		ReplyTo:       string(l.ReplyTo),
+		ArchiveAccess: string(l.ArchiveAccess),
+		CreatedAt:     l.CreatedAt,
+	}
+}
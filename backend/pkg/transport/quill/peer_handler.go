@@ -0,0 +1,61 @@
+package quill
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"log"
+
+	"quill/pkg/hosting"
+	"quill/pkg/identity"
+)
+
+// handlePeerSend accepts mail relayed by another Quill server. The server's
+// client certificate must be valid for the domain the mail comes from; see
+// relayOrigin. Once it is, the connection counts as authenticated.
+func (h *MessageHandler) handlePeerSend(ctx context.Context, conn PacketConn, state *connState, tlsState tls.ConnectionState, payload json.RawMessage) {
+	var req SendPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "Cannot parse SEND payload: "+err.Error())
+		return
+	}
+
+	// 1) Work out which domain the peer speaks for
+	origin := relayOrigin(req)
+	peerDomain := hosting.DomainOf(origin)
+	if peerDomain == "" || h.hosts.Hosts(peerDomain) {
+		log.Printf("WARN: peer %s relayed mail from %q, which it cannot speak for", conn.RemoteAddr(), origin)
+		h.writeErrorResponse(conn, ErrorCodePermissionDenied, "Relayed mail must come from the peer's own domain.")
+		return
+	}
+
+	// 2) Verify the certificate against that domain
+	if err := h.certs.VerifyPeer(tlsState, peerDomain); err != nil {
+		log.Printf("WARN: peer %s failed verification for %s: %v", conn.RemoteAddr(), peerDomain, err)
+		h.writeErrorResponse(conn, ErrorCodeAuthFailed, "Peer certificate is not valid for "+peerDomain+".")
+		return
+	}
+	log.Printf("INFO: peer %s verified for %s", conn.RemoteAddr(), peerDomain)
+	state.authenticated = true
+
+	// 3) Deliver like any other SEND, as the peer
+	ctx = identity.WithPrincipal(ctx, &identity.Principal{
+		AccountID: peerDomain,
+		Method:    identity.AuthMethodPeer,
+	})
+	h.handleSend(ctx, conn, payload)
+}
+
+// relayOrigin is the address a relayed message is sent on behalf of: the
+// list's for list traffic, the forwarding user's for a forwarded copy,
+// otherwise the sender's.
+func relayOrigin(req SendPayload) string {
+	switch {
+	case req.ListID != "":
+		return req.ListID
+	case req.ForwardedBy != "":
+		return req.ForwardedBy
+	default:
+		return req.From
+	}
+}
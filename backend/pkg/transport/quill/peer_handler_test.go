@@ -0,0 +1,97 @@
+package quill
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+
+	"quill/pkg/hosting"
+)
+
+func TestRelayOrigin(t *testing.T) {
+	tests := []struct {
+		name string
+		req  SendPayload
+		want string
+	}{
+		{"sender", SendPayload{From: "ada~example.com"}, "ada~example.com"},
+		{"list traffic", SendPayload{From: "ada~example.com", ListID: "team~example.org"}, "team~example.org"},
+		{"forwarded copy", SendPayload{From: "eve@example.net", ForwardedBy: "bob~example.org"}, "bob~example.org"},
+		{"list wins over forward", SendPayload{From: "eve@example.net", ListID: "team~example.org", ForwardedBy: "bob~example.org"}, "team~example.org"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := relayOrigin(tt.req); got != tt.want {
+				t.Errorf("relayOrigin() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// peerCerts trusts any certificate, but only for example.org.
+type peerCerts struct{ certManager }
+
+func (peerCerts) VerifyPeer(_ tls.ConnectionState, domain string) error {
+	if domain != "" && domain != "example.org" {
+		return errors.New("certificate not valid for " + domain)
+	}
+	return nil
+}
+
+// peerConn plays back packets from a relaying server over TLS and records
+// the read limit each packet was read under.
+type peerConn struct {
+	recordConn
+	packets []*Packet
+	limit   int
+	limits  []int
+}
+
+func (c *peerConn) ReadPacket() (*Packet, error) {
+	if len(c.packets) == 0 {
+		return nil, io.EOF
+	}
+	c.limits = append(c.limits, c.limit)
+	p := c.packets[0]
+	c.packets = c.packets[1:]
+	return p, nil
+}
+
+func (c *peerConn) PeerTLS() (tls.ConnectionState, bool) { return tls.ConnectionState{}, true }
+func (c *peerConn) SetReadLimit(n int)                   { c.limit = n }
+func (c *peerConn) Close() error                         { return nil }
+
+func TestServeRaisesLimitForVerifiedPeers(t *testing.T) {
+	hosts, err := hosting.NewRegistry(&hosting.Domain{Name: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(from string) *Packet {
+		payload, _ := json.Marshal(SendPayload{
+			From: from,
+			To:   []string{"ada~example.com"},
+			Body: BodyPayload{Content: []ContentPart{{Type: "text/plain", Value: "hi"}}},
+		})
+		return &Packet{Protocol: ProtocolName, Version: ProtocolVersion, Type: PacketTypeSend, Payload: payload}
+	}
+	tests := []struct {
+		name string
+		from string
+		want int // limit for the packet after the SEND
+	}{
+		{"verified for the sender's domain", "eve~example.org", maxPacketBytes},
+		{"certificate for another domain", "eve~example.edu", maxUnauthenticatedBytes},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewMessageHandler(nil, &sendMessages{}, nil, hosts, peerCerts{})
+			conn := &peerConn{packets: []*Packet{send(tt.from), send(tt.from)}, limit: maxUnauthenticatedBytes}
+			h.Serve(conn)
+			if want := []int{maxUnauthenticatedBytes, tt.want}; len(conn.limits) != 2 || conn.limits[0] != want[0] || conn.limits[1] != want[1] {
+				t.Errorf("read limits = %v, want %v", conn.limits, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package quill
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"quill/pkg/domain"
+	"quill/pkg/identity"
+	"quill/pkg/models"
+)
+
+func (h *MessageHandler) handleProfile(ctx context.Context, conn PacketConn, payload json.RawMessage) {
+	var req ProfilePayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "Cannot parse PROFILE payload: "+err.Error())
+		return
+	}
+
+	// 1) Call service for the requested action
+	var (
+		user *models.User
+		err  error
+	)
+	switch req.Action {
+	case ProfileActionGet:
+		user, err = h.userSvc.GetProfile(ctx)
+	case ProfileActionUpdate:
+		user, err = h.userSvc.UpdateProfile(ctx, domain.ProfileUpdate{
+			DisplayName: req.DisplayName,
+			Signature:   req.Signature,
+			Avatar:      req.Avatar,
+		})
+	case ProfileActionChangeHandle:
+		if req.QuillMail == "" {
+			h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "change_handle requires quill_mail")
+			return
+		}
+		user, err = h.userSvc.ChangeHandle(ctx, req.QuillMail)
+	default:
+		h.writeErrorResponse(conn, ErrorCodeInvalidAction, fmt.Sprintf("Invalid profile action %q", req.Action))
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: service call to %s profile failed: %v", req.Action, err)
+		switch {
+		case errors.Is(err, domain.ErrUserNotFound):
+			h.writeErrorResponse(conn, ErrorCodeNotFound, "No account exists for this user; call /createUser first.")
+		case errors.Is(err, domain.ErrPermissionDenied):
+			h.writeErrorResponse(conn, ErrorCodePermissionDenied, err.Error())
+		case errors.Is(err, domain.ErrAddressTaken):
+			h.writeErrorResponse(conn, ErrorCodeAlreadyExists, err.Error())
+		case errors.Is(err, domain.ErrInvalidUser):
+			h.writeErrorResponse(conn, ErrorCodeInvalidPayload, err.Error())
+		default:
+			h.writeErrorResponse(conn, ErrorCodeServiceError, "Failed to manage profile.")
+		}
+		return
+	}
+
+	// 2) Sessions carry the old address in their principal.
+	if req.Action == ProfileActionChangeHandle {
+		if id, ok := identity.AccountID(ctx); ok {
+			h.sessions.RevokeUser(id)
+		}
+	}
+
+	// 3) Construct and send response
+	h.writeResponse(conn, PacketTypeProfileResponse, ProfileResponsePayload{
+		Status: StatusOK,
+		Action: req.Action,
+		Profile: ProfileDTO{
+			UserID:      user.UsersUID,
+			QuillMail:   user.UserQuillMail,
+			Email:       user.UserEmail,
+			DisplayName: user.DisplayName,
+			Signature:   user.Signature,
+			Avatar:      user.Avatar,
+			CreatedAt:   user.CreatedAt,
+			LastLogin:   user.LastLogin,
+		},
+	})
+}
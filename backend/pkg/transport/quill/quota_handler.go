@@ -0,0 +1,26 @@
+package quill
+
+import (
+	"context"
+	"log"
+)
+
+func (h *MessageHandler) handleQuota(ctx context.Context, conn PacketConn) {
+	// 1) Call service
+	usage, err := h.messageSvc.GetQuota(ctx)
+	if err != nil {
+		log.Printf("ERROR: service call to GetQuota failed: %v", err)
+		h.writeErrorResponse(conn, ErrorCodeServiceError, "Failed to read quota.")
+		return
+	}
+
+	// 2) Construct and send response
+	h.writeResponse(conn, PacketTypeQuotaResponse, QuotaResponsePayload{
+		Status:          StatusOK,
+		UsedBytes:       usage.UsedBytes,
+		QuotaBytes:      usage.QuotaBytes,
+		MessageCount:    usage.Messages,
+		MaxMessageBytes: usage.Limits.MaxMessageBytes,
+		MaxAttachments:  usage.Limits.MaxAttachments,
+	})
+}
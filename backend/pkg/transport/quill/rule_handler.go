@@ -0,0 +1,139 @@
+package quill
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"quill/pkg/domain"
+)
+
+func (h *MessageHandler) handleRule(ctx context.Context, conn PacketConn, payload json.RawMessage) {
+	var req RulePayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "Cannot parse RULE payload: "+err.Error())
+		return
+	}
+
+	// 1) DTO → Domain: validate the action and its required fields
+	op := domain.RuleOperation(req.Action)
+	switch op {
+	case domain.RuleOperationList:
+	case domain.RuleOperationCreate:
+		if req.Rule == nil {
+			h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "RULE create requires a rule")
+			return
+		}
+	case domain.RuleOperationUpdate:
+		if req.Rule == nil || req.RuleID == "" {
+			h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "RULE update requires rule_id and a rule")
+			return
+		}
+	case domain.RuleOperationDelete:
+		if req.RuleID == "" {
+			h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "RULE delete requires rule_id")
+			return
+		}
+	case domain.RuleOperationTest:
+		if req.MessageID == "" || (req.Rule == nil && req.RuleID == "") {
+			h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "RULE test requires message_id and either rule_id or a rule")
+			return
+		}
+	default:
+		h.writeErrorResponse(conn, ErrorCodeInvalidAction, fmt.Sprintf("Invalid rule action %q", req.Action))
+		return
+	}
+
+	domainReq := domain.DomainRuleRequest{
+		Operation: op,
+		RuleID:    req.RuleID,
+		MessageID: req.MessageID,
+	}
+	if req.Rule != nil {
+		domainReq.Rule = ruleFromDTO(req.Rule)
+	}
+
+	// 2) Call service
+	result, err := h.messageSvc.ManageRules(ctx, domainReq)
+	if err != nil {
+		log.Printf("ERROR: service call to ManageRules failed: %v", err)
+		switch {
+		case errors.Is(err, domain.ErrRuleNotFound), errors.Is(err, domain.ErrMessageNotFound):
+			h.writeErrorResponse(conn, ErrorCodeNotFound, err.Error())
+		case errors.Is(err, domain.ErrInvalidRule):
+			h.writeErrorResponse(conn, ErrorCodeInvalidPayload, err.Error())
+		default:
+			h.writeErrorResponse(conn, ErrorCodeServiceError, "Failed to manage rules.")
+		}
+		return
+	}
+
+	// 3) Construct and send response
+	resp := RuleResponsePayload{
+		Status: StatusOK,
+		Action: req.Action,
+	}
+	for i := range result.Rules {
+		resp.Rules = append(resp.Rules, *ruleToDTO(&result.Rules[i]))
+	}
+	if result.Rule != nil {
+		resp.Rule = ruleToDTO(result.Rule)
+	}
+	if t := result.Test; t != nil {
+		resp.Test = &RuleTestResult{
+			Matched:   t.Matched,
+			Folder:    t.Folder,
+			Flags:     t.Flags,
+			Read:      t.Read,
+			Discarded: t.Discarded,
+			ForwardTo: t.ForwardTo,
+		}
+	}
+	h.writeResponse(conn, PacketTypeRuleResponse, resp)
+}
+
+func ruleFromDTO(d *RuleDTO) *domain.Rule {
+	r := &domain.Rule{
+		Name:           d.Name,
+		Enabled:        d.Enabled,
+		Priority:       d.Priority,
+		MatchAll:       d.MatchAll,
+		StopProcessing: d.StopProcessing,
+	}
+	for _, c := range d.Conditions {
+		r.Conditions = append(r.Conditions, domain.RuleCondition{
+			Field:    domain.RuleField(c.Field),
+			Operator: domain.RuleOperator(c.Operator),
+			Value:    c.Value,
+		})
+	}
+	for _, a := range d.Actions {
+		r.Actions = append(r.Actions, domain.RuleAction{
+			Type:  domain.RuleActionType(a.Type),
+			Value: a.Value,
+		})
+	}
+	return r
+}
+
+func ruleToDTO(r *domain.Rule) *RuleDTO {
+	d := &RuleDTO{
+		ID:             r.ID,
+		Name:           r.Name,
+		Enabled:        r.Enabled,
+		Priority:       r.Priority,
+		MatchAll:       r.MatchAll,
+		StopProcessing: r.StopProcessing,
+		Conditions:     make([]RuleConditionDTO, len(r.Conditions)),
+		Actions:        make([]RuleActionDTO, len(r.Actions)),
+	}
+	for i, c := range r.Conditions {
+		d.Conditions[i] = RuleConditionDTO{Field: string(c.Field), Operator: string(c.Operator), Value: c.Value}
+	}
+	for i, a := range r.Actions {
+		d.Actions[i] = RuleActionDTO{Type: string(a.Type), Value: a.Value}
+	}
+	return d
+}
@@ -45,19 +45,9 @@ func (s *Server) Start() error {
 	}
 }
 
-func (s *Server) StartTLS(certFile, keyFile string) error {
-	// Load your X.509 certificate and private key
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		log.Printf("ERROR: failed to load cert/key pair: %v", err)
-		return err
-	}
-
-	// Configure TLS settings (e.g. require at least TLS1.2)
-	tlsCfg := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS12,
-	}
+// StartTLS serves TLS with tlsCfg, which picks each hosted domain's
+// certificate via SNI.
+func (s *Server) StartTLS(tlsCfg *tls.Config) error {
 
 	// Create a TLS listener instead of a plain TCP one
 	listener, err := tls.Listen("tcp", s.addr, tlsCfg)
@@ -0,0 +1,143 @@
+package quill
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"quill/pkg/identity"
+)
+
+// DefaultSessionTTL is how long a session token issued by AUTH stays valid
+// unless refreshed.
+const DefaultSessionTTL = time.Hour
+
+// SessionTokenPrefix marks server-issued session tokens, so they can be told
+// apart from identity tokens without a lookup.
+const SessionTokenPrefix = "qs_"
+
+// Session is an identity verified once by AUTH.
+type Session struct {
+	Token     string
+	Principal identity.Principal
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// SessionStore issues and revokes session tokens.
+type SessionStore interface {
+	Create(p identity.Principal) (Session, error)
+	// Lookup returns the session for token if it is neither expired nor revoked.
+	Lookup(token string) (Session, bool)
+	// Refresh replaces a live session with a new one and revokes the old token.
+	Refresh(token string) (Session, bool, error)
+	Revoke(token string)
+	// RevokeUser ends every session of userID, e.g. after suspension or a
+	// password change.
+	RevokeUser(userID string)
+}
+
+type memorySessionStore struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	sessions  map[string]Session
+	lastSweep time.Time
+}
+
+// NewMemorySessionStore keeps sessions in process memory. Tokens do not
+// survive a restart, after which clients simply AUTH again.
+func NewMemorySessionStore(ttl time.Duration) SessionStore {
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+	return &memorySessionStore{
+		ttl:      ttl,
+		sessions: make(map[string]Session),
+	}
+}
+
+func (s *memorySessionStore) Create(p identity.Principal) (Session, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return Session{}, err
+	}
+	now := time.Now().UTC()
+	sess := Session{
+		Token:     token,
+		Principal: p,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ttl),
+	}
+	sess.Principal.ExpiresAt = sess.ExpiresAt
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+	s.sessions[token] = sess
+	return sess, nil
+}
+
+func (s *memorySessionStore) Lookup(token string) (Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[token]
+	if !ok {
+		return Session{}, false
+	}
+	if time.Now().After(sess.ExpiresAt) {
+		delete(s.sessions, token)
+		return Session{}, false
+	}
+	return sess, true
+}
+
+func (s *memorySessionStore) Refresh(token string) (Session, bool, error) {
+	old, ok := s.Lookup(token)
+	if !ok {
+		return Session{}, false, nil
+	}
+	sess, err := s.Create(old.Principal)
+	if err != nil {
+		return Session{}, true, err
+	}
+	s.Revoke(token)
+	return sess, true, nil
+}
+
+func (s *memorySessionStore) Revoke(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, token)
+}
+
+func (s *memorySessionStore) RevokeUser(userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token, sess := range s.sessions {
+		if sess.Principal.AccountID == userID {
+			delete(s.sessions, token)
+		}
+	}
+}
+
+// sweep drops expired sessions at most once a minute. Callers hold s.mu.
+func (s *memorySessionStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for token, sess := range s.sessions {
+		if now.After(sess.ExpiresAt) {
+			delete(s.sessions, token)
+		}
+	}
+}
+
+func newSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return SessionTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,177 @@
+package quill
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"quill/pkg/identity"
+)
+
+// connState is what a single connection remembers between packets.
+type connState struct {
+	// session is the token bound by AUTH; packets on this connection are
+	// attributed to it without presenting any token.
+	session string
+	// version is the protocol version agreed by HELLO, if any.
+	version string
+	// watching ends the connection's SUBSCRIBE push, if one is running.
+	watching context.CancelFunc
+	// authenticated is set once a packet on the connection authenticated;
+	// until then only small packets are read.
+	authenticated bool
+}
+
+func (s *connState) unsubscribe() {
+	if s.watching != nil {
+		s.watching()
+		s.watching = nil
+	}
+}
+
+var errSessionExpired = errors.New("session expired or revoked")
+
+// authenticate resolves the principal behind a packet. A session bound to
+// the connection wins; otherwise a server-issued session token is looked
+// up, and anything else goes through full verification by authSvc and is
+// resolved against the user store.
+func (h *MessageHandler) authenticate(ctx context.Context, state *connState, token string) (context.Context, error) {
+	if state.session != "" && (token == "" || token == state.session) {
+		sess, ok := h.sessions.Lookup(state.session)
+		if !ok {
+			state.session = ""
+			return ctx, errSessionExpired
+		}
+		return identity.WithPrincipal(ctx, &sess.Principal), nil
+	}
+	if strings.HasPrefix(token, SessionTokenPrefix) {
+		sess, ok := h.sessions.Lookup(token)
+		if !ok {
+			return ctx, errSessionExpired
+		}
+		return identity.WithPrincipal(ctx, &sess.Principal), nil
+	}
+
+	ctx, err := h.authSvc.Authenticate(ctx, token)
+	if err != nil {
+		return ctx, err
+	}
+	return h.messageSvc.ResolvePrincipal(ctx)
+}
+
+// writeAuthError tells clients whether to refresh a session or sign in again.
+func (h *MessageHandler) writeAuthError(conn PacketConn, err error) {
+	if errors.Is(err, errSessionExpired) {
+		h.writeErrorResponse(conn, ErrorCodeSessionExpired, "Session expired or revoked; send AUTH again.")
+		return
+	}
+	h.writeErrorResponse(conn, ErrorCodeAuthFailed, "Invalid or expired session token.")
+}
+
+// AUTH
+
+func (h *MessageHandler) handleAuth(conn PacketConn, state *connState, packet *Packet) {
+	var req AuthPayload
+	if len(packet.Payload) > 0 {
+		if err := json.Unmarshal(packet.Payload, &req); err != nil {
+			h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "Cannot parse AUTH payload: "+err.Error())
+			return
+		}
+	}
+
+	var (
+		sess Session
+		err  error
+	)
+	switch req.Action {
+	case "", AuthActionLogin:
+		token := req.Token
+		if token == "" {
+			token = packet.SessionToken
+		}
+		var ctx context.Context
+		ctx, err = h.authSvc.Authenticate(context.Background(), token)
+		if err == nil {
+			ctx, err = h.messageSvc.ResolvePrincipal(ctx)
+		}
+		if err != nil {
+			log.Printf("WARN: AUTH failed for client %s: %v", conn.RemoteAddr(), err)
+			h.writeErrorResponse(conn, ErrorCodeAuthFailed, "Invalid or expired identity token.")
+			return
+		}
+		if err := h.userSvc.TouchLastLogin(ctx); err != nil {
+			log.Printf("WARN: could not record last login for client %s: %v", conn.RemoteAddr(), err)
+		}
+		p, _ := identity.FromContext(ctx)
+		sess, err = h.sessions.Create(*p)
+	case AuthActionRefresh:
+		current := packet.SessionToken
+		if current == "" {
+			current = state.session
+		}
+		var ok bool
+		sess, ok, err = h.sessions.Refresh(current)
+		if !ok {
+			h.writeAuthError(conn, errSessionExpired)
+			return
+		}
+	default:
+		h.writeErrorResponse(conn, ErrorCodeInvalidAction, fmt.Sprintf("Invalid auth action %q", req.Action))
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: could not issue session for client %s: %v", conn.RemoteAddr(), err)
+		h.writeErrorResponse(conn, ErrorCodeServiceError, "Failed to create session.")
+		return
+	}
+
+	state.authenticated = true
+	if !req.NoBind {
+		state.session = sess.Token
+	}
+	log.Printf("INFO: client %s started session for user '%s'", conn.RemoteAddr(), sess.Principal.AccountID)
+
+	h.writeResponse(conn, PacketTypeAuthResponse, AuthResponsePayload{
+		Status:       StatusOK,
+		SessionToken: sess.Token,
+		ExpiresAt:    sess.ExpiresAt,
+		UserID:       sess.Principal.AccountID,
+		Bound:        !req.NoBind,
+	})
+}
+
+// LOGOUT
+
+func (h *MessageHandler) handleLogout(conn PacketConn, state *connState, packet *Packet) {
+	var req LogoutPayload
+	if len(packet.Payload) > 0 {
+		if err := json.Unmarshal(packet.Payload, &req); err != nil {
+			h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "Cannot parse LOGOUT payload: "+err.Error())
+			return
+		}
+	}
+
+	token := packet.SessionToken
+	if token == "" {
+		token = state.session
+	}
+	sess, ok := h.sessions.Lookup(token)
+	if !ok {
+		h.writeAuthError(conn, errSessionExpired)
+		return
+	}
+
+	if req.All {
+		h.sessions.RevokeUser(sess.Principal.AccountID)
+	} else {
+		h.sessions.Revoke(sess.Token)
+	}
+	if state.session == sess.Token || req.All {
+		state.session = ""
+	}
+
+	h.writeResponse(conn, PacketTypeLogoutResponse, LogoutResponsePayload{Status: StatusOK})
+}
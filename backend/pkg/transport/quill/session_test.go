@@ -0,0 +1,114 @@
+package quill
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"quill/pkg/identity"
+)
+
+func TestMemorySessionStore(t *testing.T) {
+	store := NewMemorySessionStore(time.Hour)
+	ada := identity.Principal{AccountID: "u1", Method: identity.AuthMethodJWT}
+
+	first, err := store.Create(ada)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(first.Token, SessionTokenPrefix) {
+		t.Errorf("token %q lacks the %q prefix", first.Token, SessionTokenPrefix)
+	}
+	if !first.Principal.ExpiresAt.Equal(first.ExpiresAt) {
+		t.Errorf("principal expires %v, session %v", first.Principal.ExpiresAt, first.ExpiresAt)
+	}
+	if _, ok := store.Lookup(first.Token); !ok {
+		t.Fatal("new session not found")
+	}
+
+	refreshed, ok, err := store.Refresh(first.Token)
+	if err != nil || !ok {
+		t.Fatalf("Refresh = %v, %v", ok, err)
+	}
+	if refreshed.Token == first.Token || refreshed.Principal.AccountID != "u1" {
+		t.Errorf("refreshed session = %+v", refreshed)
+	}
+	if _, ok := store.Lookup(first.Token); ok {
+		t.Error("refreshed token still valid")
+	}
+	if _, ok, _ := store.Refresh(first.Token); ok {
+		t.Error("revoked token refreshed")
+	}
+
+	second, _ := store.Create(ada)
+	other, _ := store.Create(identity.Principal{AccountID: "u2"})
+	store.RevokeUser("u1")
+	for _, token := range []string{refreshed.Token, second.Token} {
+		if _, ok := store.Lookup(token); ok {
+			t.Errorf("session %s of a revoked user still valid", token)
+		}
+	}
+	if _, ok := store.Lookup(other.Token); !ok {
+		t.Error("another user's session revoked")
+	}
+	store.Revoke(other.Token)
+	if _, ok := store.Lookup(other.Token); ok {
+		t.Error("revoked session still valid")
+	}
+}
+
+func TestMemorySessionStoreExpiry(t *testing.T) {
+	store := NewMemorySessionStore(time.Hour).(*memorySessionStore)
+	sess, _ := store.Create(identity.Principal{AccountID: "u1"})
+	expired := store.sessions[sess.Token]
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+	store.sessions[sess.Token] = expired
+
+	if _, ok := store.Lookup(sess.Token); ok {
+		t.Error("expired session still valid")
+	}
+	if _, ok, _ := store.Refresh(sess.Token); ok {
+		t.Error("expired session refreshed")
+	}
+}
+
+func TestAuthenticateWithSession(t *testing.T) {
+	h := &MessageHandler{sessions: NewMemorySessionStore(time.Hour)}
+	sess, _ := h.sessions.Create(identity.Principal{AccountID: "u1"})
+	other, _ := h.sessions.Create(identity.Principal{AccountID: "u2"})
+
+	tests := []struct {
+		name     string
+		bound    string
+		token    string
+		wantUser string
+		wantErr  error
+	}{
+		{"bound session, no token", sess.Token, "", "u1", nil},
+		{"bound session, same token", sess.Token, sess.Token, "u1", nil},
+		{"unbound session token", "", other.Token, "u2", nil},
+		{"other session on a bound connection", sess.Token, other.Token, "u2", nil},
+		{"unknown session token", "", SessionTokenPrefix + "gone", "", errSessionExpired},
+		{"bound session revoked", SessionTokenPrefix + "gone", "", "", errSessionExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &connState{session: tt.bound}
+			ctx, err := h.authenticate(context.Background(), state, tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("authenticate = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if tt.bound != "" && state.session != "" {
+					t.Error("dead session left bound to the connection")
+				}
+				return
+			}
+			if id, _ := identity.AccountID(ctx); id != tt.wantUser {
+				t.Errorf("account = %q, want %q", id, tt.wantUser)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package quill
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"quill/pkg/domain"
+	"quill/pkg/identity"
+)
+
+// SUBSCRIBE
+
+// handleSubscribe starts or stops pushing NEW_MAIL packets for the caller's
+// mailbox on this connection. A connection has at most one subscription;
+// starting again replaces it, e.g. after signing in as someone else.
+func (h *MessageHandler) handleSubscribe(ctx context.Context, conn PacketConn, state *connState, packet *Packet) {
+	var req SubscribePayload
+	if len(packet.Payload) > 0 {
+		if err := json.Unmarshal(packet.Payload, &req); err != nil {
+			h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "Cannot parse SUBSCRIBE payload: "+err.Error())
+			return
+		}
+	}
+
+	switch req.Action {
+	case "", SubscribeActionStart:
+	case SubscribeActionStop:
+		state.unsubscribe()
+		h.writeResponse(conn, PacketTypeSubscribeResponse, SubscribeResponsePayload{Status: StatusOK})
+		return
+	default:
+		h.writeErrorResponse(conn, ErrorCodeInvalidAction, fmt.Sprintf("Invalid subscribe action %q", req.Action))
+		return
+	}
+
+	state.unsubscribe()
+	watchCtx, cancel := context.WithCancel(ctx)
+	changes, err := h.messageSvc.Watch(watchCtx)
+	if err != nil {
+		cancel()
+		log.Printf("ERROR: service call to Watch failed: %v", err)
+		h.writeErrorResponse(conn, ErrorCodeServiceError, "Failed to subscribe.")
+		return
+	}
+	state.watching = cancel
+
+	// The subscription lasts as long as the credential it was started with.
+	token := packet.SessionToken
+	if token == "" {
+		token = state.session
+	}
+	p, _ := identity.FromContext(ctx)
+
+	h.writeResponse(conn, PacketTypeSubscribeResponse, SubscribeResponsePayload{Status: StatusOK, Subscribed: true})
+	go h.push(watchCtx, cancel, conn, token, p, changes)
+}
+
+// push forwards arriving mail until the subscription ends or the
+// credential behind it expires or is revoked.
+func (h *MessageHandler) push(ctx context.Context, cancel context.CancelFunc, conn PacketConn, token string, p *identity.Principal, changes <-chan domain.MailboxChange) {
+	defer cancel()
+	for c := range changes {
+		if c.Kind != domain.ChangeKindInsert || c.Folder == domain.FolderSent {
+			continue
+		}
+		if !h.credentialLive(token, p) {
+			h.writeAuthError(conn, errSessionExpired)
+			return
+		}
+
+		dto := changeToDTO(c)
+		if messages, err := h.messageSvc.GetMessages(ctx, []string{c.MessageID}); err != nil {
+			log.Printf("WARN: could not load pushed message %s: %v", c.MessageID, err)
+		} else if len(messages) > 0 {
+			dto.Message = &messagesToDTO(messages)[0]
+		}
+		h.writeResponse(conn, PacketTypeNewMail, NewMailPayload{Status: StatusOK, Change: dto})
+	}
+}
+
+// credentialLive reports whether a subscription's credential is still good:
+// its session not revoked and the identity token behind it not expired.
+func (h *MessageHandler) credentialLive(token string, p *identity.Principal) bool {
+	if strings.HasPrefix(token, SessionTokenPrefix) {
+		if _, ok := h.sessions.Lookup(token); !ok {
+			return false
+		}
+	}
+	return p == nil || p.ExpiresAt.IsZero() || time.Now().Before(p.ExpiresAt)
+}
@@ -0,0 +1,149 @@
+package quill
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+
+	"quill/pkg/domain"
+)
+
+// SYNC
+
+func (h *MessageHandler) handleSync(ctx context.Context, conn PacketConn, payload json.RawMessage) {
+	var req SyncPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "Cannot parse SYNC payload: "+err.Error())
+		return
+	}
+
+	// 1) DTO → Domain
+	since, err := parseSyncToken(req.SyncToken)
+	if err != nil {
+		h.writeErrorResponse(conn, ErrorCodeInvalidSyncToken, "Malformed sync_token")
+		return
+	}
+	domainReq := domain.DomainSyncRequest{Since: since}
+	if req.Limit > 0 {
+		domainReq.Limit = &req.Limit
+	}
+
+	// 2) Call service
+	result, err := h.messageSvc.Sync(ctx, domainReq)
+	if err != nil {
+		log.Printf("ERROR: service call to Sync failed: %v", err)
+		if errors.Is(err, domain.ErrInvalidSyncToken) {
+			h.writeErrorResponse(conn, ErrorCodeInvalidSyncToken, err.Error())
+			return
+		}
+		h.writeErrorResponse(conn, ErrorCodeServiceError, "Failed to sync mailbox.")
+		return
+	}
+
+	// 3) Domain → DTO
+	changes := make([]ChangeDTO, len(result.Changes))
+	for i, c := range result.Changes {
+		changes[i] = changeToDTO(c)
+	}
+
+	h.writeResponse(conn, PacketTypeSyncResponse, SyncResponsePayload{
+		Status:    StatusOK,
+		SyncToken: formatSyncToken(result.ModSeq),
+		More:      result.More,
+		Changes:   changes,
+	})
+}
+
+// FLAG
+
+func (h *MessageHandler) handleFlag(ctx context.Context, conn PacketConn, payload json.RawMessage) {
+	var req FlagPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "Cannot parse FLAG payload: "+err.Error())
+		return
+	}
+	if len(req.MessageIDs) == 0 {
+		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "FLAG requires message_ids")
+		return
+	}
+	if req.Read == nil && len(req.AddFlags) == 0 && len(req.RemoveFlags) == 0 {
+		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "FLAG requires read, add_flags or remove_flags")
+		return
+	}
+
+	updated, err := h.messageSvc.UpdateFlags(ctx, domain.DomainFlagRequest{
+		MessageIDs:  req.MessageIDs,
+		Read:        req.Read,
+		AddFlags:    req.AddFlags,
+		RemoveFlags: req.RemoveFlags,
+	})
+	if err != nil {
+		log.Printf("ERROR: service call to UpdateFlags failed: %v", err)
+		h.writeErrorResponse(conn, ErrorCodeServiceError, "Failed to update flags.")
+		return
+	}
+
+	h.writeResponse(conn, PacketTypeFlagResponse, FlagResponsePayload{
+		Status:  StatusOK,
+		Updated: updated,
+	})
+}
+
+// DELETE
+
+func (h *MessageHandler) handleDelete(ctx context.Context, conn PacketConn, payload json.RawMessage) {
+	var req DeletePayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "Cannot parse DELETE payload: "+err.Error())
+		return
+	}
+	if len(req.MessageIDs) == 0 {
+		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "DELETE requires message_ids")
+		return
+	}
+
+	deleted, err := h.messageSvc.DeleteMessages(ctx, req.MessageIDs)
+	if err != nil {
+		log.Printf("ERROR: service call to DeleteMessages failed: %v", err)
+		h.writeErrorResponse(conn, ErrorCodeServiceError, "Failed to delete messages.")
+		return
+	}
+
+	h.writeResponse(conn, PacketTypeDeleteResponse, DeleteResponsePayload{
+		Status:  StatusOK,
+		Deleted: deleted,
+	})
+}
+
+// Sync tokens are the mailbox modseq in decimal; clients treat them as opaque.
+
+func changeToDTO(c domain.MailboxChange) ChangeDTO {
+	dto := ChangeDTO{
+		ModSeq:    c.ModSeq,
+		Kind:      string(c.Kind),
+		MessageID: c.MessageID,
+		ThreadID:  c.ThreadID,
+		Folder:    c.Folder,
+		Read:      c.Read,
+		Flags:     c.Flags,
+		Labels:    c.Labels,
+		At:        c.At,
+	}
+	if c.Message != nil {
+		dto.Message = &messagesToDTO([]domain.Message{*c.Message})[0]
+	}
+	return dto
+}
+
+func formatSyncToken(modSeq int64) string {
+	return strconv.FormatInt(modSeq, 10)
+}
+
+func parseSyncToken(token string) (int64, error) {
+	if token == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(token, 10, 64)
+}
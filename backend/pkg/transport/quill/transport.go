@@ -0,0 +1,100 @@
+package quill
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+)
+
+// PacketConn is a connection that carries whole packets, whatever the
+// transport underneath: concatenated JSON or length-prefixed frames on a TCP
+// or TLS stream, or one packet per WebSocket message. Writes may come from the request loop and
+// from push notifications at the same time, so implementations serialize
+// them.
+type PacketConn interface {
+	ReadPacket() (*Packet, error)
+	WritePacket(p *Packet) error
+	RemoteAddr() net.Addr
+	// PeerTLS returns the TLS state when the client presented a
+	// certificate on this connection, for servers relaying mail.
+	PeerTLS() (tls.ConnectionState, bool)
+	Close() error
+}
+
+// readLimiter is implemented by connections that bound the size of the
+// packets they read. They start at maxUnauthenticatedBytes; Serve raises
+// the bound to maxPacketBytes once the client has authenticated.
+type readLimiter interface {
+	SetReadLimit(n int)
+}
+
+// malformedPacketError is returned by ReadPacket for a frame that arrived
+// whole but did not parse. Unlike a broken stream, the connection can go on.
+type malformedPacketError struct {
+	err error
+}
+
+func (e *malformedPacketError) Error() string {
+	return "malformed packet: " + e.err.Error()
+}
+
+func (e *malformedPacketError) Unwrap() error {
+	return e.err
+}
+
+// netConn provides the parts of PacketConn that come from the socket.
+type netConn struct {
+	conn net.Conn
+}
+
+func (c netConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c netConn) PeerTLS() (tls.ConnectionState, bool) {
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	state := tlsConn.ConnectionState()
+	return state, len(state.PeerCertificates) > 0
+}
+
+func (c netConn) Close() error {
+	return c.conn.Close()
+}
+
+// streamConn reads and writes packets as concatenated JSON values, the
+// framing of the original TCP protocol. Reads go through r, which may hold
+// bytes already taken from conn.
+type streamConn struct {
+	netConn
+	dec *json.Decoder
+
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newStreamConn(conn net.Conn, r io.Reader) *streamConn {
+	return &streamConn{
+		netConn: netConn{conn: conn},
+		dec:     json.NewDecoder(r),
+		enc:     json.NewEncoder(conn),
+	}
+}
+
+func (c *streamConn) ReadPacket() (*Packet, error) {
+	var p Packet
+	if err := c.dec.Decode(&p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (c *streamConn) WritePacket(p *Packet) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.enc.Encode(p)
+}
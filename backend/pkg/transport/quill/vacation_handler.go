@@ -0,0 +1,73 @@
+package quill
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"quill/pkg/domain"
+)
+
+func (h *MessageHandler) handleVacation(ctx context.Context, conn PacketConn, payload json.RawMessage) {
+	var req VacationPayload
+	if err := json.Unmarshal(payload, &req); err != nil {
+		h.writeErrorResponse(conn, ErrorCodeInvalidPayload, "Cannot parse VACATION payload: "+err.Error())
+		return
+	}
+
+	// 1) DTO → Domain
+	op := domain.VacationOperation(req.Action)
+	domainReq := domain.DomainVacationRequest{Operation: op}
+	switch op {
+	case domain.VacationOperationGet, domain.VacationOperationDisable:
+	case domain.VacationOperationSet:
+		settings := &domain.VacationSettings{
+			Enabled:      req.Enabled,
+			Subject:      req.Subject,
+			Body:         req.Body,
+			Exclude:      req.Exclude,
+			IntervalDays: req.IntervalDays,
+		}
+		if req.Start != nil {
+			settings.Start = req.Start.UTC()
+		}
+		if req.End != nil {
+			settings.End = req.End.UTC()
+		}
+		domainReq.Settings = settings
+	default:
+		h.writeErrorResponse(conn, ErrorCodeInvalidAction, fmt.Sprintf("Invalid vacation action %q", req.Action))
+		return
+	}
+
+	// 2) Call service
+	settings, err := h.messageSvc.ManageVacation(ctx, domainReq)
+	if err != nil {
+		log.Printf("ERROR: service call to ManageVacation failed: %v", err)
+		if errors.Is(err, domain.ErrInvalidVacation) {
+			h.writeErrorResponse(conn, ErrorCodeInvalidPayload, err.Error())
+			return
+		}
+		h.writeErrorResponse(conn, ErrorCodeServiceError, "Failed to manage the auto-responder.")
+		return
+	}
+
+	// 3) Construct and send response
+	resp := VacationResponsePayload{
+		Status:       StatusOK,
+		Enabled:      settings.Enabled,
+		Subject:      settings.Subject,
+		Body:         settings.Body,
+		Exclude:      settings.Exclude,
+		IntervalDays: settings.IntervalDays,
+	}
+	if !settings.Start.IsZero() {
+		resp.Start = &settings.Start
+	}
+	if !settings.End.IsZero() {
+		resp.End = &settings.End
+	}
+	h.writeResponse(conn, PacketTypeVacationResponse, resp)
+}
@@ -0,0 +1,111 @@
+package quill
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Compatibility policy for protocol versions 1.x
+//
+// Every 1.x version can talk to every other. A minor version only ever adds:
+// packet types, optional payload fields, actions, fetch modes, error codes
+// and capabilities. Nothing is removed, renamed or given a new meaning, and
+// a field that used to be optional never becomes required. In return, both
+// sides ignore payload fields they do not know, and clients treat unknown
+// error codes like SERVICE_ERROR and skip pushed packets of unknown types.
+//
+// Servers accept packets stamped with any 1.x version, including minors
+// newer than their own; a packet type they do not know yet is answered with
+// UNKNOWN_TYPE. Packets without a version are read as 1.0, for clients that
+// predate versioning. Any other major version is rejected with
+// UNSUPPORTED_VERSION. Breaking changes would start version 2.0.
+//
+// Clients should send HELLO first to learn the negotiated version and what
+// the server supports instead of probing with packets.
+//
+// Version history:
+//   - 1.0: the original protocol.
+//   - 1.1: HELLO/CAPABILITIES, SUBSCRIBE and pushed NEW_MAIL packets.
+//   - 1.2: length-prefixed framing with compression and CBOR, negotiated
+//     before the first packet (see framing.go), and the framing field of
+//     CAPABILITIES.
+//   - 1.3: FETCH in "message" mode, by message_id.
+
+// protocolMajor is the major version every supported version shares.
+const protocolMajor = 1
+
+type protocolVersion struct {
+	major, minor int
+}
+
+func parseVersion(s string) (protocolVersion, error) {
+	majorStr, minorStr, ok := strings.Cut(s, ".")
+	if !ok {
+		minorStr = "0"
+	}
+	major, err := strconv.Atoi(majorStr)
+	if err != nil || major < 0 {
+		return protocolVersion{}, fmt.Errorf("invalid protocol version %q", s)
+	}
+	minor, err := strconv.Atoi(minorStr)
+	if err != nil || minor < 0 {
+		return protocolVersion{}, fmt.Errorf("invalid protocol version %q", s)
+	}
+	return protocolVersion{major: major, minor: minor}, nil
+}
+
+func (v protocolVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+func (v protocolVersion) less(o protocolVersion) bool {
+	return v.major < o.major || (v.major == o.major && v.minor < o.minor)
+}
+
+// serverVersion is ProtocolVersion parsed.
+var serverVersion, _ = parseVersion(ProtocolVersion)
+
+// checkPacketVersion reports why a packet cannot be served, if it cannot.
+func checkPacketVersion(p *Packet) error {
+	if p.Protocol != "" && p.Protocol != ProtocolName {
+		return fmt.Errorf("unknown protocol %q; this server speaks %s", p.Protocol, ProtocolName)
+	}
+	if p.Version == "" {
+		return nil
+	}
+	v, err := parseVersion(p.Version)
+	if err != nil {
+		return err
+	}
+	if v.major != protocolMajor {
+		return fmt.Errorf("protocol version %s is not supported; this server speaks %d.0 to %s", v, protocolMajor, serverVersion)
+	}
+	return nil
+}
+
+// negotiateVersion picks the highest version both sides speak: the
+// client's best 1.x version, capped at the server's own.
+func negotiateVersion(offered []string) (protocolVersion, error) {
+	var (
+		best  protocolVersion
+		found bool
+	)
+	for _, s := range offered {
+		v, err := parseVersion(s)
+		if err != nil || v.major != protocolMajor {
+			continue
+		}
+		if serverVersion.less(v) {
+			v = serverVersion
+		}
+		if !found || best.less(v) {
+			best, found = v, true
+		}
+	}
+	if !found {
+		return protocolVersion{}, fmt.Errorf("none of the versions %s is supported; this server speaks %d.0 to %s",
+			strings.Join(offered, ", "), protocolMajor, serverVersion)
+	}
+	return best, nil
+}
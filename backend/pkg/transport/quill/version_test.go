@@ -0,0 +1,144 @@
+package quill
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		in   string
+		want protocolVersion
+		ok   bool
+	}{
+		{"1.3", protocolVersion{1, 3}, true},
+		{"2", protocolVersion{2, 0}, true},
+		{"1.10", protocolVersion{1, 10}, true},
+		{"", protocolVersion{}, false},
+		{"one.two", protocolVersion{}, false},
+		{"1.x", protocolVersion{}, false},
+		{"-1.0", protocolVersion{}, false},
+		{"1.-2", protocolVersion{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseVersion(tt.in)
+			if (err == nil) != tt.ok {
+				t.Fatalf("parseVersion(%q) error = %v, want ok %v", tt.in, err, tt.ok)
+			}
+			if got != tt.want {
+				t.Errorf("parseVersion(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPacketVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		version  string
+		ok       bool
+	}{
+		{"unversioned", "", "", true},
+		{"current", ProtocolName, ProtocolVersion, true},
+		{"older minor", ProtocolName, "1.0", true},
+		{"newer minor", ProtocolName, "1.99", true},
+		{"next major", ProtocolName, "2.0", false},
+		{"garbage version", ProtocolName, "latest", false},
+		{"other protocol", "SMTP", "1.0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPacketVersion(&Packet{Protocol: tt.protocol, Version: tt.version})
+			if (err == nil) != tt.ok {
+				t.Errorf("checkPacketVersion(%q, %q) = %v, want ok %v", tt.protocol, tt.version, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		offered []string
+		want    string
+		ok      bool
+	}{
+		{"exact", []string{ProtocolVersion}, ProtocolVersion, true},
+		{"older", []string{"1.0"}, "1.0", true},
+		{"highest common", []string{"1.0", "1.1", "2.0"}, "1.1", true},
+		{"newer minor capped", []string{"1.99"}, ProtocolVersion, true},
+		{"garbage skipped", []string{"x", "1.2"}, "1.2", true},
+		{"other major only", []string{"2.0", "0.9"}, "", false},
+		{"nothing offered", nil, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := negotiateVersion(tt.offered)
+			if (err == nil) != tt.ok {
+				t.Fatalf("negotiateVersion(%v) error = %v, want ok %v", tt.offered, err, tt.ok)
+			}
+			if tt.ok && got.String() != tt.want {
+				t.Errorf("negotiateVersion(%v) = %s, want %s", tt.offered, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetAuthBackends(t *testing.T) {
+	h := NewMessageHandler(nil, nil, nil, nil, nil)
+	h.SetAuthBackends([]string{"jwt", "unknown", "credentials"})
+	if want := []string{"session", "jwt", "api_key", "app_password"}; !reflect.DeepEqual(h.authMethods, want) {
+		t.Errorf("authMethods = %v, want %v", h.authMethods, want)
+	}
+}
+
+func TestHello(t *testing.T) {
+	tests := []struct {
+		name     string
+		packet   Packet
+		wantType string
+		want     string // negotiated version or error code
+	}{
+		{"offered versions", Packet{Type: PacketTypeHello, Payload: json.RawMessage(`{"versions":["1.0","1.1"]}`)}, PacketTypeCapabilities, "1.1"},
+		{"packet version", Packet{Type: PacketTypeHello, Version: "1.2"}, PacketTypeCapabilities, "1.2"},
+		{"unversioned", Packet{Type: PacketTypeHello}, PacketTypeCapabilities, "1.0"},
+		{"no common version", Packet{Type: PacketTypeHello, Payload: json.RawMessage(`{"versions":["2.0"]}`)}, PacketTypeErrorResponse, ErrorCodeUnsupportedVersion},
+		{"bad payload", Packet{Type: PacketTypeHello, Payload: json.RawMessage(`{"versions":"1.1"}`)}, PacketTypeErrorResponse, ErrorCodeInvalidPayload},
+		{"unsupported packet version", Packet{Type: PacketTypePing, Version: "2.0"}, PacketTypeErrorResponse, ErrorCodeUnsupportedVersion},
+		{"other protocol", Packet{Type: PacketTypeHello, Protocol: "SMTP"}, PacketTypeErrorResponse, ErrorCodeUnsupportedVersion},
+	}
+	srv, _ := wsServer(t, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, _, err := wsDial(t, srv, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			wsSend(t, conn, tt.packet)
+			var payload struct {
+				CapabilitiesPayload
+				Code string `json:"code"`
+			}
+			typ := wsRead(t, conn, &payload)
+			if typ != tt.wantType {
+				t.Fatalf("answered with %s %+v, want %s", typ, payload, tt.wantType)
+			}
+			if typ == PacketTypeCapabilities {
+				if payload.Version != tt.want {
+					t.Errorf("version = %q, want %q", payload.Version, tt.want)
+				}
+				if payload.ServerVersion != ProtocolVersion || !reflect.DeepEqual(payload.PacketTypes, requestTypes) {
+					t.Errorf("capabilities = %+v", payload.CapabilitiesPayload)
+				}
+				if payload.Limits.MaxMessageBytes == 0 || len(payload.Framing.Encodings) == 0 {
+					t.Errorf("limits or framing missing: %+v", payload.CapabilitiesPayload)
+				}
+			} else if payload.Code != tt.want {
+				t.Errorf("code = %q, want %q", payload.Code, tt.want)
+			}
+		})
+	}
+}
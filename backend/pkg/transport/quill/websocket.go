@@ -0,0 +1,158 @@
+package quill
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	// wsPingInterval keeps idle connections open through proxies; a client
+	// that does not answer within wsPongTimeout is dropped.
+	wsPingInterval = 30 * time.Second
+	wsPongTimeout  = 2 * wsPingInterval
+)
+
+// WebSocketHandler lets browsers, which cannot open TLS sockets, speak the
+// Quill protocol: each text message of the WebSocket is one packet, and
+// packets are answered and pushed exactly as on the TCP listener.
+type WebSocketHandler struct {
+	handler  *MessageHandler
+	upgrader websocket.Upgrader
+}
+
+// NewWebSocketHandler serves h over WebSocket. Browsers may connect from the
+// server's own origin and from allowedOrigins, where "*" allows any.
+func NewWebSocketHandler(h *MessageHandler, allowedOrigins []string) *WebSocketHandler {
+	ws := &WebSocketHandler{handler: h}
+	ws.upgrader = websocket.Upgrader{
+		HandshakeTimeout: 10 * time.Second,
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" || slices.Contains(allowedOrigins, "*") || slices.Contains(allowedOrigins, origin) {
+				return true
+			}
+			return sameOrigin(r)
+		},
+	}
+	return ws
+}
+
+func (ws *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := ws.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already answered the request.
+		log.Printf("WARN: websocket upgrade from %s failed: %v", r.RemoteAddr, err)
+		return
+	}
+	ws.handler.Serve(newWSConn(conn))
+}
+
+// sameOrigin is the check the upgrader makes when none is configured.
+func sameOrigin(r *http.Request) bool {
+	u, err := url.Parse(r.Header.Get("Origin"))
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// wsConn carries one packet per text message.
+type wsConn struct {
+	ws   *websocket.Conn
+	done chan struct{}
+	once sync.Once
+
+	mu sync.Mutex // gorilla allows one writer at a time
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+	c := &wsConn{ws: ws, done: make(chan struct{})}
+	ws.SetReadLimit(maxUnauthenticatedBytes)
+	_ = ws.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+	go c.keepAlive()
+	return c
+}
+
+func (c *wsConn) keepAlive() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+			c.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *wsConn) SetReadLimit(n int) {
+	c.ws.SetReadLimit(int64(n))
+}
+
+func (c *wsConn) ReadPacket() (*Packet, error) {
+	kind, data, err := c.ws.ReadMessage()
+	if err != nil {
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	// Any message shows the client is alive.
+	_ = c.ws.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	if kind != websocket.TextMessage {
+		return nil, &malformedPacketError{err: errors.New("packets are sent as text messages")}
+	}
+
+	var p Packet
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, &malformedPacketError{err: err}
+	}
+	return &p, nil
+}
+
+func (c *wsConn) WritePacket(p *Packet) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout)); err != nil {
+		return err
+	}
+	return c.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+// PeerTLS reports no certificate: servers relay mail over the TCP listener,
+// never over WebSocket.
+func (c *wsConn) PeerTLS() (tls.ConnectionState, bool) {
+	return tls.ConnectionState{}, false
+}
+
+func (c *wsConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.ws.Close()
+}
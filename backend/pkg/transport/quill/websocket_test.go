@@ -0,0 +1,253 @@
+package quill
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"quill/pkg/domain"
+	"quill/pkg/identity"
+)
+
+// pushMessages serves the parts of the message service a WebSocket client
+// touches; anything else panics through the nil embedded interface.
+type pushMessages struct {
+	messageService
+	changes chan domain.MailboxChange
+}
+
+func (m *pushMessages) ResolvePrincipal(ctx context.Context) (context.Context, error) {
+	p, _ := identity.FromContext(ctx)
+	resolved := *p
+	resolved.Addresses = []string{"ada~example.com"}
+	return identity.WithPrincipal(ctx, &resolved), nil
+}
+
+func (m *pushMessages) LimitsFor(string) domain.Limits {
+	return domain.DefaultLimits
+}
+
+func (m *pushMessages) Watch(ctx context.Context) (<-chan domain.MailboxChange, error) {
+	out := make(chan domain.MailboxChange)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case c := <-m.changes:
+				select {
+				case out <- c:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (m *pushMessages) GetMessages(_ context.Context, ids []string) ([]domain.Message, error) {
+	return []domain.Message{{MessageID: ids[0], ThreadID: "t1", From: "bob~example.com", Subject: "Hello"}}, nil
+}
+
+// wsServer serves a handler accepting the token "good" over WebSocket.
+func wsServer(t *testing.T, origins []string) (*httptest.Server, *pushMessages) {
+	t.Helper()
+	msgs := &pushMessages{changes: make(chan domain.MailboxChange)}
+	auth := authFunc(func(ctx context.Context, token string) (context.Context, error) {
+		if token != "good" {
+			return ctx, errors.New("bad token")
+		}
+		return identity.WithPrincipal(ctx, &identity.Principal{AccountID: "u1", Method: identity.AuthMethodJWT}), nil
+	})
+	h := NewMessageHandler(auth, msgs, nil, nil, nil)
+	srv := httptest.NewServer(NewWebSocketHandler(h, origins))
+	t.Cleanup(srv.Close)
+	return srv, msgs
+}
+
+func wsDial(t *testing.T, srv *httptest.Server, origin string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	header := http.Header{}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+	if err == nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+func TestWebSocketOrigins(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string // "self" is the server's own origin
+		ok      bool
+	}{
+		{"no origin", nil, "", true},
+		{"same origin", nil, "self", true},
+		{"listed", []string{"https://app.example.com"}, "https://app.example.com", true},
+		{"any", []string{"*"}, "https://evil.example", true},
+		{"not listed", []string{"https://app.example.com"}, "https://evil.example", false},
+		{"unparsable", nil, "::", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := wsServer(t, tt.allowed)
+			origin := tt.origin
+			if origin == "self" {
+				origin = srv.URL
+			}
+			_, resp, err := wsDial(t, srv, origin)
+			if tt.ok && err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			if !tt.ok && (err == nil || resp == nil || resp.StatusCode != http.StatusForbidden) {
+				t.Fatalf("dial from %q = %v, want 403", origin, err)
+			}
+		})
+	}
+}
+
+func wsSend(t *testing.T, conn *websocket.Conn, p Packet) {
+	t.Helper()
+	data, _ := json.Marshal(p)
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// wsRead reads the next packet and decodes its payload into payload.
+func wsRead(t *testing.T, conn *websocket.Conn, payload interface{}) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var p Packet
+	if err := conn.ReadJSON(&p); err != nil {
+		t.Fatal(err)
+	}
+	if payload != nil {
+		if err := json.Unmarshal(p.Payload, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p.Type
+}
+
+func TestWebSocketMalformedPackets(t *testing.T) {
+	srv, _ := wsServer(t, nil)
+	conn, _, err := wsDial(t, srv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []struct {
+		kind int
+		data string
+	}{
+		{websocket.BinaryMessage, `{"type":"HELLO"}`},
+		{websocket.TextMessage, `{"type":`},
+	} {
+		if err := conn.WriteMessage(msg.kind, []byte(msg.data)); err != nil {
+			t.Fatal(err)
+		}
+		var e ErrorResponsePayload
+		if typ := wsRead(t, conn, &e); typ != PacketTypeErrorResponse || e.Code != ErrorCodeInvalidPayload {
+			t.Fatalf("%q answered with %s %+v, want %s", msg.data, typ, e, ErrorCodeInvalidPayload)
+		}
+	}
+
+	// The connection goes on after a malformed packet.
+	wsSend(t, conn, Packet{Protocol: ProtocolName, Type: PacketTypeHello, Payload: json.RawMessage(`{"versions":["1.9","1.1"]}`)})
+	var caps CapabilitiesPayload
+	if typ := wsRead(t, conn, &caps); typ != PacketTypeCapabilities || caps.Version != ProtocolVersion {
+		t.Fatalf("HELLO answered with %s %+v", typ, caps)
+	}
+}
+
+func TestWebSocketLimitBeforeAuth(t *testing.T) {
+	srv, _ := wsServer(t, nil)
+	big := Packet{Type: PacketTypePing, SessionToken: "good", Payload: json.RawMessage(`"` + strings.Repeat("x", maxUnauthenticatedBytes) + `"`)}
+
+	conn, _, err := wsDial(t, srv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsSend(t, conn, big)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("oversized packet before authentication was answered")
+	}
+
+	conn, _, err = wsDial(t, srv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsSend(t, conn, Packet{Type: PacketTypePing, SessionToken: "good"})
+	if typ := wsRead(t, conn, nil); typ != PacketTypePingResponse {
+		t.Fatalf("PING answered with %s", typ)
+	}
+	wsSend(t, conn, big)
+	if typ := wsRead(t, conn, nil); typ != PacketTypePingResponse {
+		t.Fatalf("large PING after authentication answered with %s", typ)
+	}
+}
+
+func TestWebSocketSubscribe(t *testing.T) {
+	srv, msgs := wsServer(t, nil)
+	conn, _, err := wsDial(t, srv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wsSend(t, conn, Packet{Type: PacketTypeSubscribe, SessionToken: "bad"})
+	var e ErrorResponsePayload
+	if typ := wsRead(t, conn, &e); typ != PacketTypeErrorResponse || e.Code != ErrorCodeAuthFailed {
+		t.Fatalf("SUBSCRIBE with a bad token answered with %s %+v", typ, e)
+	}
+
+	wsSend(t, conn, Packet{Type: PacketTypeSubscribe, SessionToken: "good"})
+	var sub SubscribeResponsePayload
+	if typ := wsRead(t, conn, &sub); typ != PacketTypeSubscribeResponse || !sub.Subscribed {
+		t.Fatalf("SUBSCRIBE answered with %s %+v", typ, sub)
+	}
+
+	// Sent copies and changes other than arrivals are not pushed.
+	msgs.changes <- domain.MailboxChange{Kind: domain.ChangeKindInsert, MessageID: "m0", Folder: domain.FolderSent}
+	msgs.changes <- domain.MailboxChange{Kind: domain.ChangeKindFlags, MessageID: "m1", Folder: domain.FolderInbox}
+	msgs.changes <- domain.MailboxChange{Kind: domain.ChangeKindInsert, MessageID: "m2", Folder: domain.FolderInbox, ModSeq: 7}
+	var push struct {
+		Change struct {
+			MessageID string `json:"message_id"`
+			ModSeq    int64  `json:"modseq"`
+			Message   *struct {
+				Subject string `json:"subject"`
+			} `json:"message"`
+		} `json:"change"`
+	}
+	if typ := wsRead(t, conn, &push); typ != PacketTypeNewMail {
+		t.Fatalf("pushed %s, want %s", typ, PacketTypeNewMail)
+	}
+	if c := push.Change; c.MessageID != "m2" || c.ModSeq != 7 || c.Message == nil || c.Message.Subject != "Hello" {
+		t.Errorf("pushed change = %+v", c)
+	}
+
+	wsSend(t, conn, Packet{Type: PacketTypeSubscribe, SessionToken: "good", Payload: json.RawMessage(`{"action":"stop"}`)})
+	if typ := wsRead(t, conn, &sub); typ != PacketTypeSubscribeResponse || sub.Subscribed {
+		t.Fatalf("SUBSCRIBE stop answered with %s %+v", typ, sub)
+	}
+	select {
+	case msgs.changes <- domain.MailboxChange{Kind: domain.ChangeKindInsert, MessageID: "m3", Folder: domain.FolderInbox}:
+		t.Error("change still watched after SUBSCRIBE stop")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,154 @@
+package smtp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset" // decode non-UTF-8 parts
+	"github.com/emersion/go-message/mail"
+	"github.com/google/uuid"
+
+	"quill/pkg/domain"
+	"quill/pkg/hosting"
+)
+
+// toQuillAddress maps user@domain to user~domain for hosted domains, whose
+// addresses are lowercase. Addresses elsewhere keep their email form.
+func toQuillAddress(hosts *hosting.Registry, addr string) string {
+	i := strings.LastIndex(addr, "@")
+	if i == -1 {
+		return addr
+	}
+	local, dom := addr[:i], strings.ToLower(addr[i+1:])
+	if hosts.Hosts(dom) {
+		return strings.ToLower(local) + "~" + dom
+	}
+	return local + "@" + dom
+}
+
+// domainOfEmail returns the domain part of an email address.
+func domainOfEmail(addr string) string {
+	if i := strings.LastIndex(addr, "@"); i != -1 {
+		return strings.ToLower(addr[i+1:])
+	}
+	return ""
+}
+
+// parseMessage turns an RFC 5322 message into a send request. The text/plain
+// and text/html parts become the body, everything else an attachment.
+// Envelope and From are left to the caller.
+func parseMessage(hosts *hosting.Registry, r io.Reader) (domain.DomainSendRequest, mail.Header, error) {
+	var req domain.DomainSendRequest
+
+	mr, err := mail.CreateReader(r)
+	if err != nil && !message.IsUnknownCharset(err) {
+		return req, mail.Header{}, err
+	}
+	header := mr.Header
+
+	req.Subject, _ = header.Subject()
+	req.To = headerAddresses(hosts, header, "To")
+	req.CC = headerAddresses(hosts, header, "Cc")
+	if replyTo := headerAddresses(hosts, header, "Reply-To"); len(replyTo) > 0 {
+		req.ReplyTo = replyTo[0]
+	}
+	if v := header.Get("Auto-Submitted"); v != "" && !strings.EqualFold(v, "no") {
+		req.AutoSubmitted = v
+	}
+	threadID := threadIDOf(hosts, header)
+	req.Options.ThreadID = &threadID
+
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil && !message.IsUnknownCharset(err) {
+			return req, header, err
+		}
+
+		switch h := p.Header.(type) {
+		case *mail.InlineHeader:
+			data, err := io.ReadAll(p.Body)
+			if err != nil {
+				return req, header, err
+			}
+			ct, _, _ := h.ContentType()
+			switch ct {
+			case "text/plain", "":
+				req.Body.Content = append(req.Body.Content, domain.Content{Type: domain.ContentTypePlainText, Value: string(data)})
+			case "text/html":
+				req.Body.Content = append(req.Body.Content, domain.Content{Type: domain.ContentTypeHTML, Value: string(data)})
+			default:
+				// Inline images and the like are kept as attachments.
+				req.Attachments = append(req.Attachments, attachment("", ct, data))
+			}
+		case *mail.AttachmentHeader:
+			data, err := io.ReadAll(p.Body)
+			if err != nil {
+				return req, header, err
+			}
+			name, _ := h.Filename()
+			ct, _, _ := h.ContentType()
+			req.Attachments = append(req.Attachments, attachment(name, ct, data))
+		}
+	}
+	return req, header, nil
+}
+
+func attachment(name, ct string, data []byte) domain.Attachment {
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	if name == "" {
+		name = "attachment"
+		if exts, _ := mime.ExtensionsByType(ct); len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	return domain.Attachment{
+		Filename: name,
+		Mimetype: ct,
+		URL:      base64.StdEncoding.EncodeToString(data),
+	}
+}
+
+func headerAddresses(hosts *hosting.Registry, header mail.Header, key string) []string {
+	list, err := header.AddressList(key)
+	if err != nil {
+		return nil
+	}
+	addrs := make([]string, 0, len(list))
+	for _, a := range list {
+		addrs = append(addrs, toQuillAddress(hosts, a.Address))
+	}
+	return addrs
+}
+
+// threadIDOf places the message in a Quill thread. Replies to mail sent
+// from here reference <threadID@domain>, which is used as is; other
+// conversations get a stable ID derived from their first Message-ID.
+func threadIDOf(hosts *hosting.Registry, header mail.Header) string {
+	var root string
+	if refs, err := header.MsgIDList("References"); err == nil && len(refs) > 0 {
+		root = refs[0]
+	} else if ids, err := header.MsgIDList("In-Reply-To"); err == nil && len(ids) > 0 {
+		root = ids[0]
+	} else if id, err := header.MessageID(); err == nil && id != "" {
+		root = id
+	}
+	if root == "" {
+		return uuid.New().String()
+	}
+
+	if left, right, ok := strings.Cut(root, "@"); ok && hosts.Hosts(right) {
+		if id, err := uuid.Parse(left); err == nil {
+			return id.String()
+		}
+	}
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(fmt.Sprintf("mid:%s", root))).String()
+}
@@ -0,0 +1,187 @@
+package smtp
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/google/uuid"
+
+	"quill/pkg/domain"
+	"quill/pkg/hosting"
+)
+
+func testHosts(t *testing.T) *hosting.Registry {
+	t.Helper()
+	hosts, err := hosting.NewRegistry(&hosting.Domain{Name: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hosts
+}
+
+func TestToQuillAddress(t *testing.T) {
+	hosts := testHosts(t)
+	tests := []struct {
+		addr, want string
+	}{
+		{"Alice@Example.COM", "alice~example.com"},
+		{"bob@example.com", "bob~example.com"},
+		{"Carol@Elsewhere.ORG", "Carol@elsewhere.org"},
+		{"dave~example.com", "dave~example.com"},
+	}
+	for _, tt := range tests {
+		if got := toQuillAddress(hosts, tt.addr); got != tt.want {
+			t.Errorf("toQuillAddress(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	hosts := testHosts(t)
+	raw := strings.ReplaceAll(`From: Carol <carol@elsewhere.org>
+To: Alice <Alice@example.com>, dave@elsewhere.org
+Cc: bob@example.com
+Reply-To: list@elsewhere.org
+Subject: Quarterly report
+Auto-Submitted: auto-generated
+Message-ID: <root@elsewhere.org>
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary=outer
+
+--outer
+Content-Type: multipart/alternative; boundary=inner
+
+--inner
+Content-Type: text/plain; charset=utf-8
+
+Numbers attached.
+--inner
+Content-Type: text/html; charset=utf-8
+
+<p>Numbers attached.</p>
+--inner--
+--outer
+Content-Type: image/png
+Content-Disposition: inline
+
+PNG
+--outer
+Content-Type: text/csv
+Content-Disposition: attachment; filename="q3.csv"
+
+a,b
+--outer--
+`, "\n", "\r\n")
+
+	req, header, err := parseMessage(hosts, strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Subject != "Quarterly report" {
+		t.Errorf("Subject = %q", req.Subject)
+	}
+	if want := []string{"alice~example.com", "dave@elsewhere.org"}; !reflect.DeepEqual(req.To, want) {
+		t.Errorf("To = %q, want %q", req.To, want)
+	}
+	if want := []string{"bob~example.com"}; !reflect.DeepEqual(req.CC, want) {
+		t.Errorf("CC = %q, want %q", req.CC, want)
+	}
+	if req.ReplyTo != "list@elsewhere.org" {
+		t.Errorf("ReplyTo = %q", req.ReplyTo)
+	}
+	if req.AutoSubmitted != "auto-generated" {
+		t.Errorf("AutoSubmitted = %q", req.AutoSubmitted)
+	}
+	if req.Options.ThreadID == nil || *req.Options.ThreadID != threadIDOf(hosts, header) {
+		t.Errorf("ThreadID = %v, want the one derived from the headers", req.Options.ThreadID)
+	}
+
+	wantBody := []domain.Content{
+		{Type: domain.ContentTypePlainText, Value: "Numbers attached."},
+		{Type: domain.ContentTypeHTML, Value: "<p>Numbers attached.</p>"},
+	}
+	if !reflect.DeepEqual(req.Body.Content, wantBody) {
+		t.Errorf("Body = %+v, want %+v", req.Body.Content, wantBody)
+	}
+	wantAttachments := []domain.Attachment{
+		{Filename: "attachment.png", Mimetype: "image/png", URL: base64.StdEncoding.EncodeToString([]byte("PNG"))},
+		{Filename: "q3.csv", Mimetype: "text/csv", URL: base64.StdEncoding.EncodeToString([]byte("a,b"))},
+	}
+	if !reflect.DeepEqual(req.Attachments, wantAttachments) {
+		t.Errorf("Attachments = %+v, want %+v", req.Attachments, wantAttachments)
+	}
+}
+
+func TestParseMessageAutoSubmittedNo(t *testing.T) {
+	raw := "From: a@elsewhere.org\r\nTo: b@example.com\r\nAuto-Submitted: no\r\n\r\nhi\r\n"
+	req, _, err := parseMessage(testHosts(t), strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.AutoSubmitted != "" {
+		t.Errorf("AutoSubmitted = %q, want empty for \"no\"", req.AutoSubmitted)
+	}
+	if len(req.Body.Content) != 1 || req.Body.Content[0].Value != "hi\r\n" {
+		t.Errorf("Body = %+v", req.Body.Content)
+	}
+}
+
+func TestAttachmentName(t *testing.T) {
+	tests := []struct {
+		name, ct         string
+		wantName, wantCT string
+	}{
+		{"report.pdf", "application/pdf", "report.pdf", "application/pdf"},
+		{"", "image/png", "attachment.png", "image/png"},
+		{"", "", "attachment", "application/octet-stream"}, // plus whatever extension the system knows
+		{"", "application/x-unknown-thing", "attachment", "application/x-unknown-thing"},
+	}
+	if a := attachment("", "application/x-unknown-thing", nil); a.Filename != "attachment" {
+		t.Errorf("name for an unknown type = %q, want %q", a.Filename, "attachment")
+	}
+	for _, tt := range tests {
+		a := attachment(tt.name, tt.ct, []byte("x"))
+		if !strings.HasPrefix(a.Filename, tt.wantName) || a.Mimetype != tt.wantCT {
+			t.Errorf("attachment(%q, %q) = %q, %q, want %q, %q", tt.name, tt.ct, a.Filename, a.Mimetype, tt.wantName, tt.wantCT)
+		}
+	}
+}
+
+func TestThreadIDOf(t *testing.T) {
+	hosts := testHosts(t)
+	local := uuid.New().String()
+	derived := func(root string) string {
+		return uuid.NewSHA1(uuid.NameSpaceURL, []byte("mid:"+root)).String()
+	}
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   string
+	}{
+		{"reply to our thread", map[string]string{"References": "<" + local + "@example.com> <x@elsewhere.org>"}, local},
+		{"foreign root", map[string]string{"References": "<root@elsewhere.org> <" + local + "@example.com>"}, derived("root@elsewhere.org")},
+		{"not a uuid here", map[string]string{"References": "<abc@example.com>"}, derived("abc@example.com")},
+		{"in-reply-to", map[string]string{"In-Reply-To": "<parent@elsewhere.org>"}, derived("parent@elsewhere.org")},
+		{"own message id", map[string]string{"Message-ID": "<first@elsewhere.org>"}, derived("first@elsewhere.org")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h mail.Header
+			for k, v := range tt.header {
+				h.Set(k, v)
+			}
+			if got := threadIDOf(hosts, h); got != tt.want {
+				t.Errorf("threadIDOf = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	var empty mail.Header
+	a, b := threadIDOf(hosts, empty), threadIDOf(hosts, empty)
+	if _, err := uuid.Parse(a); err != nil || a == b {
+		t.Errorf("without references got %q and %q, want two fresh UUIDs", a, b)
+	}
+}
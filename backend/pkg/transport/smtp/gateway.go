@@ -0,0 +1,270 @@
+// Package smtp is the gateway between regular email and Quill. Mail for
+// the hosted domains arrives over SMTP, user@domain is mapped to the Quill
+// address user~domain, and the message is delivered like one relayed by
+// another Quill server.
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	gosmtp "github.com/emersion/go-smtp"
+	"github.com/google/uuid"
+	"github.com/toorop/go-dkim"
+
+	"quill/pkg/domain"
+	"quill/pkg/hosting"
+	"quill/pkg/identity"
+)
+
+// checkTimeout bounds the DNS lookups of an SPF check.
+const checkTimeout = 10 * time.Second
+
+type messageService interface {
+	Send(ctx context.Context, req domain.DomainSendRequest) (domain.DomainSendResult, error)
+	LimitsFor(addr string) domain.Limits
+}
+
+// Gateway is the go-smtp backend delivering inbound mail to Quill.
+type Gateway struct {
+	messageSvc    messageService
+	hosts         *hosting.Registry
+	resolver      resolver
+	rejectSPFFail bool
+}
+
+// NewGateway delivers mail for the domains in hosts through ms. With
+// rejectSPFFail, senders whose domain's SPF policy fails are refused.
+func NewGateway(ms messageService, hosts *hosting.Registry, rejectSPFFail bool) *Gateway {
+	return &Gateway{
+		messageSvc:    ms,
+		hosts:         hosts,
+		resolver:      net.DefaultResolver,
+		rejectSPFFail: rejectSPFFail,
+	}
+}
+
+// NewServer returns an SMTP server on addr greeting as hostname. STARTTLS is
+// offered when tlsCfg is not nil.
+func NewServer(addr, hostname string, tlsCfg *tls.Config, g *Gateway) *gosmtp.Server {
+	s := gosmtp.NewServer(g)
+	s.Addr = addr
+	s.Domain = hostname
+	s.TLSConfig = tlsCfg
+	s.AuthDisabled = true
+	s.MaxRecipients = 100
+	s.ReadTimeout = time.Minute
+	s.WriteTimeout = time.Minute
+	s.ErrorLog = log.Default()
+
+	// The exact limit is checked once the message is decoded; allow for
+	// the base64 overhead of attachments on the wire.
+	var limit int64
+	for _, name := range g.hosts.Names() {
+		if l := g.messageSvc.LimitsFor("~" + name).MaxMessageBytes; l > limit {
+			limit = l
+		}
+	}
+	s.MaxMessageBytes = int(2 * limit)
+	return s
+}
+
+// Login refuses authentication: the gateway only accepts mail for local
+// delivery, never for relaying.
+func (g *Gateway) Login(state *gosmtp.ConnectionState, username, password string) (gosmtp.Session, error) {
+	return nil, gosmtp.ErrAuthUnsupported
+}
+
+func (g *Gateway) AnonymousLogin(state *gosmtp.ConnectionState) (gosmtp.Session, error) {
+	s := &session{gateway: g, helo: state.Hostname}
+	if addr, ok := state.RemoteAddr.(*net.TCPAddr); ok {
+		s.remoteIP = addr.IP
+	}
+	return s, nil
+}
+
+// session is one SMTP connection.
+type session struct {
+	gateway  *Gateway
+	remoteIP net.IP
+	helo     string
+
+	// Per transaction, cleared by Reset.
+	from  string
+	spf   SPFResult
+	rcpts []string
+}
+
+var (
+	errSpoofed = &gosmtp.SMTPError{
+		Code:         550,
+		EnhancedCode: gosmtp.EnhancedCode{5, 7, 1},
+		Message:      "Mail from hosted domains must be sent through Quill",
+	}
+	errRelayDenied = &gosmtp.SMTPError{
+		Code:         550,
+		EnhancedCode: gosmtp.EnhancedCode{5, 7, 1},
+		Message:      "Relaying denied",
+	}
+	errSPFFail = &gosmtp.SMTPError{
+		Code:         550,
+		EnhancedCode: gosmtp.EnhancedCode{5, 7, 23},
+		Message:      "SPF check failed",
+	}
+)
+
+func (s *session) Mail(from string, opts gosmtp.MailOptions) error {
+	// 1) Hosted domains never send through the gateway
+	senderDomain := domainOfEmail(from)
+	if s.gateway.hosts.Hosts(senderDomain) {
+		log.Printf("WARN: smtp %s claimed hosted sender %s", s.remoteIP, from)
+		return errSpoofed
+	}
+
+	// 2) Check the sender's SPF policy; bounces are checked against HELO
+	if senderDomain == "" {
+		senderDomain = s.helo
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	result, err := CheckSPF(ctx, s.gateway.resolver, s.remoteIP, senderDomain)
+	if err != nil {
+		log.Printf("WARN: smtp SPF check of %s for %s: %s (%v)", senderDomain, s.remoteIP, result, err)
+	}
+	if result == SPFFail && s.gateway.rejectSPFFail {
+		log.Printf("INFO: smtp rejected %s from %s: SPF fail", from, s.remoteIP)
+		return errSPFFail
+	}
+
+	s.from = from
+	s.spf = result
+	return nil
+}
+
+func (s *session) Rcpt(to string) error {
+	if !s.gateway.hosts.Hosts(domainOfEmail(to)) {
+		return errRelayDenied
+	}
+	s.rcpts = append(s.rcpts, toQuillAddress(s.gateway.hosts, to))
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	// 1) Parse the message
+	req, header, err := parseMessage(s.gateway.hosts, bytes.NewReader(raw))
+	if err != nil {
+		return &gosmtp.SMTPError{
+			Code:         554,
+			EnhancedCode: gosmtp.EnhancedCode{5, 6, 0},
+			Message:      "Cannot parse message: " + err.Error(),
+		}
+	}
+
+	// 2) The visible sender, which must not pose as a hosted address
+	req.From = s.from
+	if list, err := header.AddressList("From"); err == nil && len(list) > 0 {
+		req.From = strings.ToLower(list[0].Address)
+	}
+	if domainOfEmail(req.From) == "" {
+		return &gosmtp.SMTPError{
+			Code:         550,
+			EnhancedCode: gosmtp.EnhancedCode{5, 1, 7},
+			Message:      "Message has no valid sender",
+		}
+	}
+	if s.gateway.hosts.Hosts(domainOfEmail(req.From)) {
+		log.Printf("WARN: smtp %s sent mail with hosted From %s", s.remoteIP, req.From)
+		return errSpoofed
+	}
+	dkimResult := checkDKIM(raw)
+	log.Printf("INFO: smtp message from %s (envelope %q, %s): spf=%s dkim=%s",
+		req.From, s.from, s.remoteIP, s.spf, dkimResult)
+
+	req.MessageID = uuid.New().String()
+	req.Envelope = s.rcpts
+
+	// 3) Enforce the recipients' size limits
+	for _, rcpt := range s.rcpts {
+		if err := s.gateway.messageSvc.LimitsFor(rcpt).Check(req); err != nil {
+			return &gosmtp.SMTPError{
+				Code:         552,
+				EnhancedCode: gosmtp.EnhancedCode{5, 3, 4},
+				Message:      err.Error(),
+			}
+		}
+	}
+
+	// 4) Deliver as the sending domain
+	ctx := identity.WithPrincipal(context.Background(), &identity.Principal{
+		AccountID: domainOfEmail(req.From),
+		Method:    identity.AuthMethodSMTP,
+	})
+	result, err := s.gateway.messageSvc.Send(ctx, req)
+	if err != nil {
+		log.Printf("ERROR: smtp delivery of message from %s failed: %v", req.From, err)
+		return smtpError(err)
+	}
+	log.Printf("INFO: smtp delivered %s from %s to %s", result.MessageID, req.From, strings.Join(result.DeliveredTo, ", "))
+	if len(result.Bounced) > 0 {
+		log.Printf("WARN: smtp message %s bounced for full mailboxes: %s", result.MessageID, strings.Join(result.Bounced, ", "))
+	}
+	for _, r := range result.Relays {
+		log.Printf("WARN: smtp message %s not relayed to %d recipients on %s", result.MessageID, len(r.Recipients), r.Domain)
+	}
+	return nil
+}
+
+func (s *session) Reset() {
+	s.from = ""
+	s.spf = ""
+	s.rcpts = nil
+}
+
+func (s *session) Logout() error {
+	return nil
+}
+
+// smtpError maps a delivery error to an SMTP reply. Full mailboxes are
+// temporary so the sending server retries later.
+func smtpError(err error) error {
+	switch {
+	case errors.Is(err, domain.ErrMailboxFull):
+		return &gosmtp.SMTPError{Code: 452, EnhancedCode: gosmtp.EnhancedCode{4, 2, 2}, Message: err.Error()}
+	case errors.Is(err, domain.ErrMessageTooLarge), errors.Is(err, domain.ErrTooManyAttachments):
+		return &gosmtp.SMTPError{Code: 552, EnhancedCode: gosmtp.EnhancedCode{5, 3, 4}, Message: err.Error()}
+	case errors.Is(err, domain.ErrPermissionDenied), errors.Is(err, domain.ErrListPostDenied):
+		return &gosmtp.SMTPError{Code: 550, EnhancedCode: gosmtp.EnhancedCode{5, 7, 1}, Message: err.Error()}
+	}
+	return &gosmtp.SMTPError{Code: 451, EnhancedCode: gosmtp.EnhancedCode{4, 3, 0}, Message: "Failed to deliver the message"}
+}
+
+// checkDKIM verifies the message's DKIM signature. The result is only
+// logged for now.
+func checkDKIM(raw []byte) string {
+	email := append([]byte(nil), raw...)
+	status, err := dkim.Verify(&email)
+	switch status {
+	case dkim.SUCCESS:
+		return "pass"
+	case dkim.NOTSIGNED:
+		return "none"
+	case dkim.TEMPFAIL:
+		return "temperror"
+	}
+	if err != nil {
+		return "fail (" + err.Error() + ")"
+	}
+	return "fail"
+}
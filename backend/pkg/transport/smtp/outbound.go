@@ -0,0 +1,387 @@
+package smtp
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	gosmtp "github.com/emersion/go-smtp"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"quill/pkg/config"
+	"quill/pkg/domain"
+	"quill/pkg/hosting"
+)
+
+const (
+	outboundWorkers = 4
+	outboundPoll    = 10 * time.Second
+	// outboundLease is how long a claimed entry is left alone; it bounds a
+	// whole delivery attempt across every MX host.
+	outboundLease = 10 * time.Minute
+	dialTimeout   = 30 * time.Second
+	// sessionTimeout bounds one SMTP transaction with one host.
+	sessionTimeout = 5 * time.Minute
+)
+
+// retryDelays spaces out the attempts after temporary failures; the last
+// delay repeats until the queue lifetime is up.
+var retryDelays = []time.Duration{
+	time.Minute, 5 * time.Minute, 15 * time.Minute, 30 * time.Minute,
+	time.Hour, 2 * time.Hour, 4 * time.Hour,
+}
+
+type outboundQueue interface {
+	ClaimOutbound(ctx context.Context, now time.Time, lease time.Duration) (*domain.OutboundMessage, error)
+	CompleteOutbound(ctx context.Context, id primitive.ObjectID) error
+	DeferOutbound(ctx context.Context, id primitive.ObjectID, reason string, next time.Time) error
+	FailOutbound(ctx context.Context, msg *domain.OutboundMessage, reason string) error
+}
+
+type mxResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+type dkimKey struct {
+	selector string
+	pem      []byte
+}
+
+// Sender delivers the outbound queue to regular email servers, DKIM-signed
+// for the sending domain.
+type Sender struct {
+	queue    outboundQueue
+	resolver mxResolver
+
+	mu       sync.RWMutex
+	cfg      config.SMTPConfig
+	hostname string
+	keys     map[string]dkimKey // by hosted domain
+}
+
+// NewSender returns a sender for queue; Configure must be called before Run.
+func NewSender(queue outboundQueue) *Sender {
+	return &Sender{
+		queue:    queue,
+		resolver: net.DefaultResolver,
+		keys:     make(map[string]dkimKey),
+	}
+}
+
+// Configure applies the smtp section and loads the domains' DKIM keys. On
+// error the previous settings stay in place.
+func (s *Sender) Configure(cfg *config.Config) error {
+	keys := make(map[string]dkimKey)
+	for _, d := range cfg.Domains {
+		if d.DKIMKeyFile == "" {
+			continue
+		}
+		data, err := os.ReadFile(d.DKIMKeyFile)
+		if err != nil {
+			return fmt.Errorf("dkim key for %s: %w", d.Name, err)
+		}
+		if err := checkRSAKey(data); err != nil {
+			return fmt.Errorf("dkim key for %s: %w", d.Name, err)
+		}
+		keys[strings.ToLower(d.Name)] = dkimKey{selector: d.DKIMSelector, pem: data}
+	}
+
+	hostname := cfg.SMTP.Hostname
+	if hostname == "" && len(cfg.Domains) > 0 {
+		hostname = cfg.Domains[0].Name
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg = cfg.SMTP
+	s.hostname = hostname
+	s.keys = keys
+	return nil
+}
+
+// checkRSAKey makes sure the signer will accept data: an RSA key in PKCS#1
+// or PKCS#8 PEM.
+func checkRSAKey(data []byte) error {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return errors.New("no PEM data")
+	}
+	if _, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	if _, ok := key.(*rsa.PrivateKey); !ok {
+		return errors.New("not an RSA key")
+	}
+	return nil
+}
+
+func (s *Sender) settings() (config.SMTPConfig, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cfg, s.hostname
+}
+
+func (s *Sender) key(domain string) (dkimKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.keys[domain]
+	return k, ok
+}
+
+// Run delivers queued mail until ctx ends.
+func (s *Sender) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < outboundWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *Sender) work(ctx context.Context) {
+	ticker := time.NewTicker(outboundPoll)
+	defer ticker.Stop()
+	for {
+		// Drain everything that is due, then wait for the next poll.
+		for ctx.Err() == nil {
+			msg, err := s.queue.ClaimOutbound(ctx, time.Now().UTC(), outboundLease)
+			if err != nil {
+				log.Printf("ERROR: claiming outbound mail failed: %v", err)
+				break
+			}
+			if msg == nil {
+				break
+			}
+			s.process(ctx, msg)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// process makes one delivery attempt and records its outcome.
+func (s *Sender) process(ctx context.Context, msg *domain.OutboundMessage) {
+	rejected, err := s.deliver(ctx, msg)
+
+	switch {
+	case err == nil:
+		log.Printf("INFO: delivered %s to %s", msg.MessageID, strings.Join(msg.Recipients, ", "))
+		if len(rejected) > 0 {
+			s.bounceRejected(ctx, msg, rejected)
+		}
+		if err := s.queue.CompleteOutbound(ctx, msg.ID); err != nil {
+			log.Printf("ERROR: removing delivered message %s from the queue failed: %v", msg.MessageID, err)
+		}
+		return
+
+	case isPermanent(err):
+		log.Printf("INFO: %s rejected %s: %v", msg.Domain, msg.MessageID, err)
+		if err := s.queue.FailOutbound(ctx, msg, err.Error()); err != nil {
+			log.Printf("ERROR: bouncing message %s failed: %v", msg.MessageID, err)
+		}
+		return
+	}
+
+	cfg, _ := s.settings()
+	delay := retryDelays[len(retryDelays)-1]
+	if msg.Attempts <= len(retryDelays) {
+		delay = retryDelays[msg.Attempts-1]
+	}
+	next := time.Now().UTC().Add(delay)
+	if next.Sub(msg.CreatedAt) > cfg.QueueLifetime {
+		log.Printf("INFO: giving up on %s to %s after %d attempts: %v", msg.MessageID, msg.Domain, msg.Attempts, err)
+		reason := fmt.Sprintf("%v (gave up after %d attempts)", err, msg.Attempts)
+		if err := s.queue.FailOutbound(ctx, msg, reason); err != nil {
+			log.Printf("ERROR: bouncing message %s failed: %v", msg.MessageID, err)
+		}
+		return
+	}
+	log.Printf("WARN: delivery of %s to %s deferred until %s: %v", msg.MessageID, msg.Domain, next.Format(time.RFC3339), err)
+	if err := s.queue.DeferOutbound(ctx, msg.ID, err.Error(), next); err != nil {
+		log.Printf("ERROR: deferring message %s failed: %v", msg.MessageID, err)
+	}
+}
+
+// bounceRejected returns the message to its sender for the recipients the
+// server refused while accepting the others.
+func (s *Sender) bounceRejected(ctx context.Context, msg *domain.OutboundMessage, rejected map[string]error) {
+	addrs := make([]string, 0, len(rejected))
+	reasons := make([]string, 0, len(rejected))
+	for addr := range rejected {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		reasons = append(reasons, addr+": "+rejected[addr].Error())
+	}
+	partial := *msg
+	partial.Recipients = addrs
+	if err := s.queue.FailOutbound(ctx, &partial, strings.Join(reasons, "; ")); err != nil {
+		log.Printf("ERROR: bouncing message %s failed: %v", msg.MessageID, err)
+	}
+}
+
+// deliver renders, signs and sends msg, to the smarthost or to the first
+// MX host that takes it. It returns the recipients refused outright.
+func (s *Sender) deliver(ctx context.Context, msg *domain.OutboundMessage) (map[string]error, error) {
+	data, err := RenderMessage(msg)
+	if err != nil {
+		return nil, permanentError{fmt.Errorf("rendering message: %w", err)}
+	}
+	sender := msg.Sender()
+	senderDomain := hosting.DomainOf(sender)
+	if k, ok := s.key(senderDomain); ok {
+		if data, err = signMessage(data, senderDomain, k.selector, k.pem); err != nil {
+			return nil, fmt.Errorf("dkim signing: %w", err)
+		}
+	}
+
+	cfg, hostname := s.settings()
+	from := toEmailAddress(sender)
+	if cfg.Smarthost != "" {
+		return s.send(cfg.Smarthost, hostname, true, cfg, from, msg.Recipients, data)
+	}
+
+	hosts, err := s.mxHosts(ctx, msg.Domain)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, host := range hosts {
+		rejected, err := s.send(net.JoinHostPort(host, "25"), hostname, false, cfg, from, msg.Recipients, data)
+		if err == nil || isPermanent(err) {
+			return rejected, err
+		}
+		log.Printf("WARN: delivery of %s via %s failed: %v", msg.MessageID, host, err)
+		lastErr = err
+	}
+	return nil, fmt.Errorf("no MX host of %s accepted the message: %w", msg.Domain, lastErr)
+}
+
+// mxHosts lists the domain's mail servers by preference, falling back to
+// the domain itself when it has no MX records (RFC 5321 5.1).
+func (s *Sender) mxHosts(ctx context.Context, domainName string) ([]string, error) {
+	mxs, err := s.resolver.LookupMX(ctx, domainName)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return []string{domainName}, nil
+		}
+		return nil, err
+	}
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			// A null MX (RFC 7505) means the domain takes no mail.
+			return nil, permanentError{fmt.Errorf("%s does not accept mail", domainName)}
+		}
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		return []string{domainName}, nil
+	}
+	return hosts, nil
+}
+
+// send runs one SMTP transaction with addr. The smarthost's certificate is
+// verified and its credentials are used; MX hosts get opportunistic
+// STARTTLS (RFC 7435) since few of them have certificates for their names.
+func (s *Sender) send(addr, hostname string, smarthost bool, cfg config.SMTPConfig, from string, rcpts []string, data []byte) (map[string]error, error) {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(sessionTimeout))
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := gosmtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	defer c.Close()
+
+	if err := c.Hello(hostname); err != nil {
+		return nil, err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		tlsCfg := &tls.Config{ServerName: host, InsecureSkipVerify: !smarthost}
+		if err := c.StartTLS(tlsCfg); err != nil {
+			return nil, err
+		}
+	}
+	if smarthost && cfg.SmarthostUsername != "" {
+		if err := c.Auth(sasl.NewPlainClient("", cfg.SmarthostUsername, cfg.SmarthostPassword)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.Mail(from, nil); err != nil {
+		return nil, err
+	}
+	rejected := make(map[string]error)
+	for _, rcpt := range rcpts {
+		if err := c.Rcpt(toEmailAddress(rcpt)); err != nil {
+			if !isPermanent(err) {
+				// Retry the whole batch later rather than split it.
+				return nil, err
+			}
+			rejected[rcpt] = err
+		}
+	}
+	if len(rejected) == len(rcpts) {
+		return nil, rejected[rcpts[0]]
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	// The message is accepted; a failed QUIT must not cause a resend.
+	c.Quit()
+	return rejected, nil
+}
+
+// permanentError marks failures that retrying cannot fix.
+type permanentError struct{ error }
+
+func (e permanentError) Unwrap() error { return e.error }
+
+// isPermanent reports whether err is a 5xx reply or otherwise final.
+func isPermanent(err error) bool {
+	var smtpErr *gosmtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code >= 500
+	}
+	var perm permanentError
+	return errors.As(err, &perm)
+}
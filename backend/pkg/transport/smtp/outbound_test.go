@@ -0,0 +1,379 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gosmtp "github.com/emersion/go-smtp"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"quill/pkg/config"
+	"quill/pkg/domain"
+)
+
+func TestCheckRSAKey(t *testing.T) {
+	ec, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecDER, _ := x509.MarshalPKCS8PrivateKey(ec)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		valid bool
+	}{
+		{"pkcs1", testRSAKey(t, false), true},
+		{"pkcs8", testRSAKey(t, true), true},
+		{"not pem", []byte("-----BEGIN nothing"), false},
+		{"garbage in pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("junk")}), false},
+		{"ecdsa", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: ecDER}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkRSAKey(tt.data); (err == nil) != tt.valid {
+				t.Errorf("checkRSAKey() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestSenderConfigure(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "dkim.pem")
+	if err := os.WriteFile(keyFile, testRSAKey(t, true), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	badFile := filepath.Join(dir, "bad.pem")
+	os.WriteFile(badFile, []byte("nope"), 0o600)
+
+	s := NewSender(nil)
+	good := &config.Config{Domains: []config.DomainConfig{
+		{Name: "Example.COM", DKIMKeyFile: keyFile, DKIMSelector: "mail"},
+		{Name: "example.net"},
+	}}
+	if err := s.Configure(good); err != nil {
+		t.Fatal(err)
+	}
+	if _, hostname := s.settings(); hostname != "Example.COM" {
+		t.Errorf("hostname = %q, want the first domain", hostname)
+	}
+	if k, ok := s.key("example.com"); !ok || k.selector != "mail" {
+		t.Errorf("key(example.com) = %+v, %v", k, ok)
+	}
+	if _, ok := s.key("example.net"); ok {
+		t.Error("example.net has a key without a key file")
+	}
+
+	for name, file := range map[string]string{"missing": filepath.Join(dir, "none.pem"), "invalid": badFile} {
+		cfg := &config.Config{
+			SMTP:    config.SMTPConfig{Hostname: "mx.example.com"},
+			Domains: []config.DomainConfig{{Name: "example.com", DKIMKeyFile: file}},
+		}
+		if err := s.Configure(cfg); err == nil {
+			t.Errorf("Configure with a %s key succeeded", name)
+		}
+	}
+	if _, hostname := s.settings(); hostname != "Example.COM" {
+		t.Errorf("hostname = %q after failed reloads, want the previous one", hostname)
+	}
+	if _, ok := s.key("example.com"); !ok {
+		t.Error("a failed reload dropped the previous keys")
+	}
+}
+
+func TestMXHosts(t *testing.T) {
+	s := NewSender(nil)
+	s.resolver = fakeDNS{
+		mx: map[string][]string{
+			"example.net":    {"mx1.example.net", "mx2.example.net"},
+			"nomail.example": {""},
+			"empty.example":  {},
+		},
+		fail: map[string]bool{"down.example": true},
+	}
+	tests := []struct {
+		domain    string
+		want      []string
+		permanent bool
+	}{
+		{"example.net", []string{"mx1.example.net", "mx2.example.net"}, false},
+		{"nomx.example", []string{"nomx.example"}, false},
+		{"empty.example", []string{"empty.example"}, false},
+		{"nomail.example", nil, true},
+		{"down.example", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			got, err := s.mxHosts(context.Background(), tt.domain)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mxHosts = %q, want %q", got, tt.want)
+			}
+			if tt.want == nil && err == nil {
+				t.Fatal("mxHosts succeeded, want an error")
+			}
+			if isPermanent(err) != tt.permanent {
+				t.Errorf("error %v permanent = %v, want %v", err, !tt.permanent, tt.permanent)
+			}
+		})
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&gosmtp.SMTPError{Code: 550}, true},
+		{fmt.Errorf("rcpt: %w", &gosmtp.SMTPError{Code: 554}), true},
+		{&gosmtp.SMTPError{Code: 451}, false},
+		{permanentError{errors.New("null MX")}, true},
+		{errors.New("connection refused"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := isPermanent(tt.err); got != tt.want {
+			t.Errorf("isPermanent(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// fakeQueue records what the sender did with each message.
+type fakeQueue struct {
+	mu        sync.Mutex
+	completed []primitive.ObjectID
+	deferred  []time.Time
+	failed    []*domain.OutboundMessage
+	reasons   []string
+}
+
+func (q *fakeQueue) ClaimOutbound(context.Context, time.Time, time.Duration) (*domain.OutboundMessage, error) {
+	return nil, nil
+}
+
+func (q *fakeQueue) CompleteOutbound(_ context.Context, id primitive.ObjectID) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.completed = append(q.completed, id)
+	return nil
+}
+
+func (q *fakeQueue) DeferOutbound(_ context.Context, _ primitive.ObjectID, reason string, next time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.deferred = append(q.deferred, next)
+	q.reasons = append(q.reasons, reason)
+	return nil
+}
+
+func (q *fakeQueue) FailOutbound(_ context.Context, msg *domain.OutboundMessage, reason string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.failed = append(q.failed, msg)
+	q.reasons = append(q.reasons, reason)
+	return nil
+}
+
+// relayBackend is an SMTP server standing in for a smarthost: it refuses
+// the recipients in reject with a 550 and tempfail with a 451.
+type relayBackend struct {
+	user, password string
+	reject         map[string]bool
+	tempfail       map[string]bool
+
+	mu       sync.Mutex
+	from     string
+	rcpts    []string
+	data     []byte
+	loggedIn bool
+}
+
+func (b *relayBackend) Login(_ *gosmtp.ConnectionState, user, password string) (gosmtp.Session, error) {
+	if user != b.user || password != b.password {
+		return nil, &gosmtp.SMTPError{Code: 535, Message: "bad credentials"}
+	}
+	b.mu.Lock()
+	b.loggedIn = true
+	b.mu.Unlock()
+	return relaySession{b}, nil
+}
+
+func (b *relayBackend) AnonymousLogin(*gosmtp.ConnectionState) (gosmtp.Session, error) {
+	if b.user != "" {
+		return nil, gosmtp.ErrAuthRequired
+	}
+	return relaySession{b}, nil
+}
+
+type relaySession struct{ b *relayBackend }
+
+func (s relaySession) Reset()        {}
+func (s relaySession) Logout() error { return nil }
+
+func (s relaySession) Mail(from string, _ gosmtp.MailOptions) error {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	s.b.from = from
+	return nil
+}
+
+func (s relaySession) Rcpt(to string) error {
+	switch {
+	case s.b.reject[to]:
+		return &gosmtp.SMTPError{Code: 550, Message: "no such user"}
+	case s.b.tempfail[to]:
+		return &gosmtp.SMTPError{Code: 451, Message: "try again later"}
+	}
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	s.b.rcpts = append(s.b.rcpts, to)
+	return nil
+}
+
+func (s relaySession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	s.b.data = data
+	return err
+}
+
+// startRelay serves b on a local port and returns its address.
+func startRelay(t *testing.T, b *relayBackend) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := gosmtp.NewServer(b)
+	srv.Domain = "relay.test"
+	srv.AllowInsecureAuth = true
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+func testSender(t *testing.T, q *fakeQueue, smarthost string) *Sender {
+	t.Helper()
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "dkim.pem")
+	if err := os.WriteFile(keyFile, testRSAKey(t, false), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := NewSender(q)
+	err := s.Configure(&config.Config{
+		SMTP: config.SMTPConfig{
+			Smarthost:         smarthost,
+			SmarthostUsername: "quill",
+			SmarthostPassword: "secret",
+			QueueLifetime:     24 * time.Hour,
+		},
+		Domains: []config.DomainConfig{{Name: "example.com", DKIMKeyFile: keyFile, DKIMSelector: "mail"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestProcessDeliversThroughSmarthost(t *testing.T) {
+	relay := &relayBackend{user: "quill", password: "secret", reject: map[string]bool{"gone@example.net": true}}
+	q := &fakeQueue{}
+	s := testSender(t, q, startRelay(t, relay))
+
+	msg := testOutbound()
+	msg.ID = primitive.NewObjectID()
+	msg.Attempts = 1
+	msg.CreatedAt = time.Now().UTC()
+	msg.Recipients = []string{"eve@example.net", "gone@example.net"}
+	s.process(context.Background(), msg)
+
+	if !relay.loggedIn {
+		t.Error("sender did not authenticate to the smarthost")
+	}
+	if relay.from != "ada@example.com" || !reflect.DeepEqual(relay.rcpts, []string{"eve@example.net"}) {
+		t.Errorf("envelope = %s -> %q", relay.from, relay.rcpts)
+	}
+	if !bytes.HasPrefix(relay.data, []byte("DKIM-Signature:")) || !bytes.Contains(relay.data, []byte("d=example.com")) {
+		t.Errorf("message is not signed for example.com:\n%.200s", relay.data)
+	}
+	if !reflect.DeepEqual(q.completed, []primitive.ObjectID{msg.ID}) {
+		t.Errorf("completed = %v, want the message", q.completed)
+	}
+	if len(q.failed) != 1 || !reflect.DeepEqual(q.failed[0].Recipients, []string{"gone@example.net"}) {
+		t.Fatalf("bounced = %+v, want only the refused recipient", q.failed)
+	}
+	if !strings.Contains(q.reasons[0], "gone@example.net: ") || !strings.Contains(q.reasons[0], "no such user") {
+		t.Errorf("bounce reason = %q", q.reasons[0])
+	}
+}
+
+func TestProcessOutcomes(t *testing.T) {
+	relay := &relayBackend{
+		user:     "quill",
+		password: "secret",
+		reject:   map[string]bool{"gone@example.net": true},
+		tempfail: map[string]bool{"busy@example.net": true},
+	}
+	addr := startRelay(t, relay)
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	tests := []struct {
+		name       string
+		smarthost  string
+		recipients []string
+		attempts   int
+		age        time.Duration
+		want       string // completed, deferred or failed
+		delay      time.Duration
+	}{
+		{"all refused", addr, []string{"gone@example.net"}, 1, 0, "failed", 0},
+		{"temporary refusal", addr, []string{"eve@example.net", "busy@example.net"}, 1, 0, "deferred", time.Minute},
+		{"unreachable", closedAddr, []string{"eve@example.net"}, 3, time.Hour, "deferred", 15 * time.Minute},
+		{"last delay repeats", closedAddr, []string{"eve@example.net"}, 20, time.Hour, "deferred", 4 * time.Hour},
+		{"lifetime over", closedAddr, []string{"eve@example.net"}, 9, 23 * time.Hour, "failed", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &fakeQueue{}
+			s := testSender(t, q, tt.smarthost)
+			msg := testOutbound()
+			msg.ID = primitive.NewObjectID()
+			msg.Attempts = tt.attempts
+			msg.CreatedAt = time.Now().UTC().Add(-tt.age)
+			msg.Recipients = tt.recipients
+
+			start := time.Now().UTC()
+			s.process(context.Background(), msg)
+			got := map[bool]string{true: "completed"}[len(q.completed) > 0] +
+				map[bool]string{true: "deferred"}[len(q.deferred) > 0] +
+				map[bool]string{true: "failed"}[len(q.failed) > 0]
+			if got != tt.want {
+				t.Fatalf("outcome = %q (%q), want %s", got, q.reasons, tt.want)
+			}
+			if tt.want == "failed" && !reflect.DeepEqual(q.failed[0].Recipients, tt.recipients) {
+				t.Errorf("bounced recipients = %q, want %q", q.failed[0].Recipients, tt.recipients)
+			}
+			if tt.delay != 0 {
+				if d := q.deferred[0].Sub(start); d < tt.delay || d > tt.delay+time.Minute {
+					t.Errorf("deferred by %v, want %v", d, tt.delay)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/toorop/go-dkim"
+
+	"quill/pkg/domain"
+	"quill/pkg/hosting"
+)
+
+// dkimHeaders are the header fields covered by outbound signatures.
+var dkimHeaders = []string{
+	"from", "to", "cc", "reply-to", "subject", "date", "message-id",
+	"in-reply-to", "references", "list-id", "auto-submitted",
+	"mime-version", "content-type",
+}
+
+// toEmailAddress maps a Quill address name~domain to name@domain. Email
+// addresses are returned unchanged.
+func toEmailAddress(addr string) string {
+	if i := strings.LastIndex(addr, "~"); i != -1 && !strings.Contains(addr, "@") {
+		return addr[:i] + "@" + addr[i+1:]
+	}
+	return addr
+}
+
+func emailAddresses(addrs []string) []*mail.Address {
+	list := make([]*mail.Address, 0, len(addrs))
+	for _, a := range addrs {
+		list = append(list, &mail.Address{Address: toEmailAddress(a)})
+	}
+	return list
+}
+
+// RenderMessage writes a message as RFC 5322 with CRLF line endings. The
+// text and HTML parts form a multipart/alternative, wrapped in a
+// multipart/mixed when there are attachments. Message-ID and References
+// carry the Quill IDs so replies land in the same thread.
+func RenderMessage(msg *domain.OutboundMessage) ([]byte, error) {
+	req := msg.Request
+	idDomain := hosting.DomainOf(msg.Sender())
+	if idDomain == "" {
+		idDomain = domainOfEmail(msg.Sender())
+	}
+
+	var h mail.Header
+	h.SetAddressList("From", emailAddresses([]string{req.From}))
+	h.SetAddressList("To", emailAddresses(req.To))
+	if len(req.CC) > 0 {
+		h.SetAddressList("Cc", emailAddresses(req.CC))
+	}
+	if len(req.BCC) > 0 {
+		h.SetAddressList("Bcc", emailAddresses(req.BCC))
+	}
+	if req.ReplyTo != "" {
+		h.SetAddressList("Reply-To", emailAddresses([]string{req.ReplyTo}))
+	}
+	h.SetSubject(req.Subject)
+	h.SetDate(msg.CreatedAt)
+	h.SetMessageID(msg.MessageID + "@" + idDomain)
+	if msg.ThreadID != "" && msg.ThreadID != msg.MessageID {
+		h.SetMsgIDList("References", []string{msg.ThreadID + "@" + idDomain})
+	}
+	if req.ListID != "" {
+		h.Set("List-Id", "<"+strings.ReplaceAll(req.ListID, "~", ".")+">")
+	}
+	if req.AutoSubmitted != "" {
+		h.Set("Auto-Submitted", req.AutoSubmitted)
+	}
+	h.Set("MIME-Version", "1.0")
+
+	var buf bytes.Buffer
+	if len(req.Attachments) == 0 {
+		iw, err := mail.CreateInlineWriter(&buf, h)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeAlternatives(iw, req.Body); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	mw, err := mail.CreateWriter(&buf, h)
+	if err != nil {
+		return nil, err
+	}
+	iw, err := mw.CreateInline()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeAlternatives(iw, req.Body); err != nil {
+		return nil, err
+	}
+	for _, a := range req.Attachments {
+		if err := writeAttachment(mw, a); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeAlternatives writes the plain text parts before the HTML ones, as
+// readers pick the last alternative they can display.
+func writeAlternatives(iw *mail.InlineWriter, body domain.Body) error {
+	parts := make([]domain.Content, 0, len(body.Content))
+	for _, c := range body.Content {
+		if c.Type != domain.ContentTypeHTML {
+			parts = append(parts, c)
+		}
+	}
+	for _, c := range body.Content {
+		if c.Type == domain.ContentTypeHTML {
+			parts = append(parts, c)
+		}
+	}
+	if len(parts) == 0 {
+		parts = append(parts, domain.Content{Type: domain.ContentTypePlainText})
+	}
+
+	for _, c := range parts {
+		ct := string(c.Type)
+		if ct == "" {
+			ct = string(domain.ContentTypePlainText)
+		}
+		var h mail.InlineHeader
+		h.SetContentType(ct, map[string]string{"charset": "utf-8"})
+		w, err := iw.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, c.Value); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	return iw.Close()
+}
+
+// writeAttachment embeds inline attachment data; attachments stored as
+// links are sent as a text/uri-list part pointing at them.
+func writeAttachment(mw *mail.Writer, a domain.Attachment) error {
+	var h mail.AttachmentHeader
+	h.SetFilename(a.Filename)
+
+	data, err := base64.StdEncoding.DecodeString(a.URL)
+	if err != nil {
+		h.SetContentType("text/uri-list", nil)
+		data = []byte(a.URL + "\r\n")
+	} else {
+		mimetype := a.Mimetype
+		if mimetype == "" {
+			mimetype = "application/octet-stream"
+		}
+		h.SetContentType(mimetype, nil)
+	}
+
+	w, err := mw.CreateAttachment(h)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// signMessage adds a DKIM-Signature for domain with the PEM-encoded RSA key.
+func signMessage(data []byte, domain, selector string, key []byte) ([]byte, error) {
+	opts := dkim.NewSigOptions()
+	opts.PrivateKey = key
+	opts.Domain = domain
+	opts.Selector = selector
+	opts.Headers = dkimHeaders
+	opts.Canonicalization = "relaxed/relaxed"
+	if err := dkim.Sign(&data, opts); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
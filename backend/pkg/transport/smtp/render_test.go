@@ -0,0 +1,226 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+
+	"quill/pkg/domain"
+)
+
+func TestToEmailAddress(t *testing.T) {
+	tests := []struct {
+		addr, want string
+	}{
+		{"ada~example.com", "ada@example.com"},
+		{"eve@example.net", "eve@example.net"},
+		{"odd~name@example.net", "odd~name@example.net"},
+		{"plain", "plain"},
+	}
+	for _, tt := range tests {
+		if got := toEmailAddress(tt.addr); got != tt.want {
+			t.Errorf("toEmailAddress(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func testOutbound(attachments ...domain.Attachment) *domain.OutboundMessage {
+	return &domain.OutboundMessage{
+		MessageID:  "8e5a9d5c-2f6e-4a55-9a4a-0f1f3d2f9b10",
+		ThreadID:   "1c0f6a8e-5b8e-4d8f-8d43-2a1c9e0b7a21",
+		Domain:     "example.net",
+		Recipients: []string{"eve@example.net"},
+		CreatedAt:  time.Date(2026, 10, 19, 9, 30, 0, 0, time.UTC),
+		Request: domain.DomainSendRequest{
+			From:    "ada~example.com",
+			To:      []string{"eve@example.net", "bob~example.org"},
+			CC:      []string{"carl~example.com"},
+			Subject: "Café plans",
+			Body: domain.Body{Content: []domain.Content{
+				{Type: domain.ContentTypeHTML, Value: "<p>See you</p>"},
+				{Type: domain.ContentTypePlainText, Value: "See you"},
+			}},
+			Attachments: attachments,
+		},
+	}
+}
+
+// readParts parses data and returns its header and each leaf part as
+// "content-type:body".
+func readParts(t *testing.T, data []byte) (mail.Header, []string) {
+	t.Helper()
+	mr, err := mail.CreateReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(p.Body)
+		var ct string
+		switch h := p.Header.(type) {
+		case *mail.InlineHeader:
+			ct, _, _ = h.ContentType()
+		case *mail.AttachmentHeader:
+			ct, _, _ = h.ContentType()
+			name, _ := h.Filename()
+			ct += ";" + name
+		}
+		parts = append(parts, ct+":"+string(body))
+	}
+	return mr.Header, parts
+}
+
+func TestRenderMessage(t *testing.T) {
+	msg := testOutbound()
+	data, err := RenderMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(bytes.ReplaceAll(data, []byte("\r\n"), nil), []byte("\n")) {
+		t.Error("message has bare LF line endings")
+	}
+
+	h, parts := readParts(t, data)
+	checks := map[string]string{
+		"From":       "<ada@example.com>",
+		"To":         "<eve@example.net>, <bob@example.org>",
+		"Cc":         "<carl@example.com>",
+		"Message-Id": "<" + msg.MessageID + "@example.com>",
+		"References": "<" + msg.ThreadID + "@example.com>",
+		"Date":       "Mon, 19 Oct 2026 09:30:00 +0000",
+	}
+	for key, want := range checks {
+		if got := h.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	if subject, _ := h.Subject(); subject != "Café plans" {
+		t.Errorf("Subject = %q", subject)
+	}
+	for _, key := range []string{"Bcc", "Reply-To", "List-Id", "Auto-Submitted"} {
+		if h.Has(key) {
+			t.Errorf("unexpected %s: %q", key, h.Get(key))
+		}
+	}
+	if ct, _, _ := h.ContentType(); ct != "multipart/alternative" {
+		t.Errorf("Content-Type = %q, want multipart/alternative", ct)
+	}
+	want := []string{"text/plain:See you", "text/html:<p>See you</p>"}
+	if strings.Join(parts, "|") != strings.Join(want, "|") {
+		t.Errorf("parts = %q, want %q", parts, want)
+	}
+}
+
+func TestRenderMessageListAndThreadStart(t *testing.T) {
+	msg := testOutbound()
+	msg.ThreadID = msg.MessageID
+	msg.Request.ListID = "team~example.com"
+	msg.Request.ReplyTo = "team~example.com"
+	msg.Request.AutoSubmitted = "auto-replied"
+	msg.Request.Body.Content = nil
+
+	data, err := RenderMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, parts := readParts(t, data)
+	if h.Has("References") {
+		t.Errorf("first message of a thread has References %q", h.Get("References"))
+	}
+	checks := map[string]string{
+		"List-Id":        "<team.example.com>",
+		"Reply-To":       "<team@example.com>",
+		"Auto-Submitted": "auto-replied",
+	}
+	for key, want := range checks {
+		if got := h.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	if len(parts) != 1 || parts[0] != "text/plain:" {
+		t.Errorf("parts = %q, want one empty text part", parts)
+	}
+}
+
+func TestRenderMessageAttachments(t *testing.T) {
+	msg := testOutbound(
+		domain.Attachment{Filename: "notes.txt", Mimetype: "text/plain", URL: base64.StdEncoding.EncodeToString([]byte("bring snacks"))},
+		domain.Attachment{Filename: "blob", URL: base64.StdEncoding.EncodeToString([]byte{0, 1, 2})},
+		domain.Attachment{Filename: "big.zip", Mimetype: "application/zip", URL: "https://files.example.com/big.zip"},
+	)
+	data, err := RenderMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, parts := readParts(t, data)
+	if ct, _, _ := h.ContentType(); ct != "multipart/mixed" {
+		t.Errorf("Content-Type = %q, want multipart/mixed", ct)
+	}
+	want := []string{
+		"text/plain:See you",
+		"text/html:<p>See you</p>",
+		"text/plain;notes.txt:bring snacks",
+		"application/octet-stream;blob:\x00\x01\x02",
+		"text/uri-list;big.zip:https://files.example.com/big.zip\r\n",
+	}
+	if strings.Join(parts, "|") != strings.Join(want, "|") {
+		t.Errorf("parts = %q, want %q", parts, want)
+	}
+}
+
+func testRSAKey(t *testing.T, pkcs8 bool) []byte {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pkcs8 {
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func TestSignMessage(t *testing.T) {
+	data, err := RenderMessage(testOutbound())
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signMessage(data, "example.com", "mail", testRSAKey(t, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _ := readParts(t, signed)
+	sig := h.Get("Dkim-Signature")
+	for _, tag := range []string{"d=example.com", "s=mail", "c=relaxed/relaxed", "h=from:to:cc:"} {
+		if !strings.Contains(strings.ReplaceAll(sig, " ", ""), tag) {
+			t.Errorf("DKIM-Signature %q lacks %s", sig, tag)
+		}
+	}
+	if !bytes.HasSuffix(signed, data) {
+		t.Error("signing changed the message itself")
+	}
+
+	if _, err := signMessage(data, "example.com", "mail", []byte("not a key")); err == nil {
+		t.Error("signMessage with a bad key succeeded")
+	}
+}
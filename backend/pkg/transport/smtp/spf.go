@@ -0,0 +1,251 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SPFResult is the outcome of an SPF check (RFC 7208 section 2.6).
+type SPFResult string
+
+const (
+	SPFNone      SPFResult = "none"
+	SPFNeutral   SPFResult = "neutral"
+	SPFPass      SPFResult = "pass"
+	SPFFail      SPFResult = "fail"
+	SPFSoftFail  SPFResult = "softfail"
+	SPFTempError SPFResult = "temperror"
+	SPFPermError SPFResult = "permerror"
+)
+
+// spfLookupLimit caps the DNS-querying terms per check (RFC 7208 4.6.4).
+const spfLookupLimit = 10
+
+var errSPFLookupLimit = errors.New("too many DNS lookups")
+
+// resolver is the part of net.Resolver the SPF check needs.
+type resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+type spfCheck struct {
+	ctx      context.Context
+	resolver resolver
+	ip       net.IP
+	lookups  int
+}
+
+// CheckSPF evaluates whether ip may send mail for domain. The ptr and
+// exists mechanisms and macros are not supported and never match.
+func CheckSPF(ctx context.Context, r resolver, ip net.IP, domain string) (SPFResult, error) {
+	c := &spfCheck{ctx: ctx, resolver: r, ip: ip}
+	return c.checkHost(strings.ToLower(strings.TrimSuffix(domain, ".")))
+}
+
+func (c *spfCheck) checkHost(domain string) (SPFResult, error) {
+	record, err := c.record(domain)
+	if err != nil || record == "" {
+		if err != nil && isTemporary(err) {
+			return SPFTempError, err
+		}
+		if err != nil {
+			return SPFPermError, err
+		}
+		return SPFNone, nil
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		term = strings.ToLower(term)
+		if strings.HasPrefix(term, "redirect=") {
+			redirect = strings.TrimPrefix(term, "redirect=")
+			continue
+		}
+		if strings.Contains(term, "=") {
+			continue // unknown modifiers are ignored
+		}
+
+		result := SPFPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			result, term = SPFFail, term[1:]
+		case '~':
+			result, term = SPFSoftFail, term[1:]
+		case '?':
+			result, term = SPFNeutral, term[1:]
+		}
+
+		match, err := c.matches(term, domain)
+		if err != nil {
+			if errors.Is(err, errSPFLookupLimit) || !isTemporary(err) {
+				return SPFPermError, err
+			}
+			return SPFTempError, err
+		}
+		if match {
+			return result, nil
+		}
+	}
+
+	if redirect != "" {
+		if err := c.countLookup(); err != nil {
+			return SPFPermError, err
+		}
+		result, err := c.checkHost(redirect)
+		if result == SPFNone {
+			return SPFPermError, fmt.Errorf("redirect to %s has no SPF record", redirect)
+		}
+		return result, err
+	}
+	return SPFNeutral, nil
+}
+
+// record returns the domain's SPF record, or "" if it has none.
+func (c *spfCheck) record(domain string) (string, error) {
+	txts, err := c.resolver.LookupTXT(c.ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	var found []string
+	for _, txt := range txts {
+		if txt == "v=spf1" || strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+			found = append(found, txt)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", nil
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("%s publishes %d SPF records", domain, len(found))
+}
+
+func (c *spfCheck) matches(term, domain string) (bool, error) {
+	name, arg, _ := strings.Cut(term, ":")
+	target, cidr := domain, ""
+	if arg != "" {
+		target = arg
+	}
+	if i := strings.Index(name, "/"); i != -1 {
+		name, cidr = name[:i], name[i:]
+	} else if i := strings.Index(target, "/"); i != -1 && name != "ip4" && name != "ip6" {
+		target, cidr = target[:i], target[i:]
+	}
+
+	switch name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		if !strings.Contains(arg, "/") {
+			if ip := net.ParseIP(arg); ip != nil {
+				return ip.Equal(c.ip), nil
+			}
+			return false, fmt.Errorf("bad address %q", arg)
+		}
+		_, network, err := net.ParseCIDR(arg)
+		if err != nil {
+			return false, err
+		}
+		return network.Contains(c.ip), nil
+	case "a":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		return c.hostMatches(target, cidr)
+	case "mx":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		mxs, err := c.resolver.LookupMX(c.ctx, target)
+		if err != nil {
+			return false, ignoreNotFound(err)
+		}
+		for _, mx := range mxs {
+			if ok, err := c.hostMatches(strings.TrimSuffix(mx.Host, "."), cidr); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	case "include":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		result, err := c.checkHost(target)
+		switch result {
+		case SPFPass:
+			return true, nil
+		case SPFTempError, SPFPermError:
+			return false, err
+		case SPFNone:
+			return false, fmt.Errorf("include of %s without SPF record", target)
+		}
+		return false, nil
+	case "ptr", "exists":
+		return false, c.countLookup()
+	}
+	return false, fmt.Errorf("unknown mechanism %q", name)
+}
+
+// hostMatches reports whether the client IP is one of host's addresses,
+// widened to the network given by a "/len" or "/len4//len6" suffix.
+func (c *spfCheck) hostMatches(host, cidr string) (bool, error) {
+	addrs, err := c.resolver.LookupIPAddr(c.ctx, host)
+	if err != nil {
+		return false, ignoreNotFound(err)
+	}
+	ones4, ones6 := 32, 128
+	if cidr != "" {
+		v4, v6, _ := strings.Cut(strings.TrimPrefix(cidr, "/"), "//")
+		if v4 != "" {
+			ones4, _ = strconv.Atoi(v4)
+		}
+		if v6 != "" {
+			ones6, _ = strconv.Atoi(v6)
+		}
+	}
+	for _, a := range addrs {
+		bits, ones := 128, ones6
+		if a.IP.To4() != nil {
+			bits, ones = 32, ones4
+		}
+		network := net.IPNet{IP: a.IP, Mask: net.CIDRMask(ones, bits)}
+		if network.Contains(c.ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *spfCheck) countLookup() error {
+	c.lookups++
+	if c.lookups > spfLookupLimit {
+		return errSPFLookupLimit
+	}
+	return nil
+}
+
+func isTemporary(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && (dnsErr.IsTemporary || dnsErr.IsTimeout)
+}
+
+func ignoreNotFound(err error) error {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil
+	}
+	return err
+}
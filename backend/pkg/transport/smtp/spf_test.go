@@ -0,0 +1,121 @@
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// fakeDNS answers from fixed tables; names missing from a table do not
+// exist, and names in fail return a temporary error.
+type fakeDNS struct {
+	txt  map[string][]string
+	ip   map[string][]string
+	mx   map[string][]string
+	fail map[string]bool
+}
+
+func (d fakeDNS) lookup(name string) error {
+	if d.fail[name] {
+		return &net.DNSError{Err: "timeout", Name: name, IsTimeout: true}
+	}
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (d fakeDNS) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if txt, ok := d.txt[name]; ok {
+		return txt, nil
+	}
+	return nil, d.lookup(name)
+}
+
+func (d fakeDNS) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := d.ip[host]
+	if !ok {
+		return nil, d.lookup(host)
+	}
+	addrs := make([]net.IPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.IPAddr{IP: net.ParseIP(ip)}
+	}
+	return addrs, nil
+}
+
+func (d fakeDNS) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	hosts, ok := d.mx[name]
+	if !ok {
+		return nil, d.lookup(name)
+	}
+	mxs := make([]*net.MX, len(hosts))
+	for i, h := range hosts {
+		mxs[i] = &net.MX{Host: h + ".", Pref: uint16(10 * i)}
+	}
+	return mxs, nil
+}
+
+func TestCheckSPF(t *testing.T) {
+	loop := map[string][]string{}
+	for i := 0; i <= spfLookupLimit; i++ {
+		loop[fmt.Sprintf("l%d.example", i)] = []string{fmt.Sprintf("v=spf1 include:l%d.example -all", i+1)}
+	}
+	loop[fmt.Sprintf("l%d.example", spfLookupLimit+1)] = []string{"v=spf1 +all"}
+	dns := fakeDNS{
+		txt: map[string][]string{
+			"example.com":      {"some-verification=abc", "v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::1 mx a:relay.example.com/28 -all"},
+			"soft.example":     {"v=spf1 ~all"},
+			"neutral.example":  {"v=spf1 ip4:198.51.100.1"},
+			"include.example":  {"v=spf1 include:example.com include:soft.example -all"},
+			"redirect.example": {"v=spf1 redirect=example.com"},
+			"nowhere.example":  {"v=spf1 redirect=none.example"},
+			"twice.example":    {"v=spf1 -all", "v=spf1 +all"},
+			"unknown.example":  {"v=spf1 foo:bar -all"},
+			"ptr.example":      {"v=spf1 ptr -all"},
+			"broken.example":   {"v=spf1 include:down.example -all"},
+		},
+		ip: map[string][]string{
+			"mail.example.com":  {"203.0.113.25"},
+			"relay.example.com": {"203.0.113.64"},
+		},
+		mx:   map[string][]string{"example.com": {"mail.example.com"}},
+		fail: map[string]bool{"down.example": true},
+	}
+	for name, txt := range loop {
+		dns.txt[name] = txt
+	}
+
+	tests := []struct {
+		name   string
+		ip     string
+		domain string
+		want   SPFResult
+	}{
+		{"ip4 network", "192.0.2.7", "example.com", SPFPass},
+		{"ip6 address", "2001:db8::1", "example.com", SPFPass},
+		{"mx host", "203.0.113.25", "example.com", SPFPass},
+		{"a with prefix", "203.0.113.70", "example.com", SPFPass},
+		{"outside a prefix", "203.0.113.90", "example.com", SPFFail},
+		{"trailing dot and case", "192.0.2.7", "Example.COM.", SPFPass},
+		{"softfail", "192.0.2.7", "soft.example", SPFSoftFail},
+		{"no match is neutral", "192.0.2.7", "neutral.example", SPFNeutral},
+		{"include passes", "192.0.2.7", "include.example", SPFPass},
+		{"include softfail does not match", "198.51.100.9", "include.example", SPFFail},
+		{"redirect", "203.0.113.90", "redirect.example", SPFFail},
+		{"redirect without record", "192.0.2.7", "nowhere.example", SPFPermError},
+		{"no record", "192.0.2.7", "none.example", SPFNone},
+		{"two records", "192.0.2.7", "twice.example", SPFPermError},
+		{"unknown mechanism", "192.0.2.7", "unknown.example", SPFPermError},
+		{"ptr never matches", "192.0.2.7", "ptr.example", SPFFail},
+		{"temporary failure", "192.0.2.7", "down.example", SPFTempError},
+		{"temporary failure in include", "192.0.2.7", "broken.example", SPFTempError},
+		{"lookup limit", "192.0.2.7", "l0.example", SPFPermError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CheckSPF(context.Background(), dns, net.ParseIP(tt.ip), tt.domain)
+			if got != tt.want {
+				t.Errorf("CheckSPF(%s, %s) = %s (%v), want %s", tt.ip, tt.domain, got, err, tt.want)
+			}
+		})
+	}
+}
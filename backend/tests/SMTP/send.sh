@@ -0,0 +1,12 @@
+#!/bin/sh
+# Sends inbound.eml to a local SMTP gateway (smtp.listen) with curl.
+#   ./send.sh [host:port] [recipient]
+# sender.test never resolves, so SPF finds no policy and the message is accepted.
+set -e
+ADDR=${1:-localhost:2525}
+RCPT=${2:-bob@quillmail.xyz}
+cd "$(dirname "$0")"
+curl --silent --show-error "smtp://$ADDR" \
+  --mail-from alice@sender.test \
+  --mail-rcpt "$RCPT" \
+  --upload-file inbound.eml
@@ -2,29 +2,21 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net"
 	"os"
 	"path/filepath"
 	"strings"
-	"time"
-)
 
-// Packet mirrors the server's transport packet structure.
-type Packet struct {
-	Protocol     string          `json:"protocol"`
-	Version      string          `json:"version"`
-	Type         string          `json:"type"`
-	SessionToken string          `json:"session_token,omitempty"`
-	Timestamp    time.Time       `json:"timestamp"`
-	Payload      json.RawMessage `json:"payload"`
-}
+	"quill/pkg/client"
+	"quill/pkg/transport/quill"
+)
 
 func main() {
 	// Hardcoded JSON directory relative to this file's location
@@ -62,6 +54,21 @@ func main() {
 	addr := flag.String("addr", "localhost:9876", "server address (host:port)")
 	flag.Parse()
 
+	tlsCfg, err := loadTLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	c, err := client.New(client.Options{
+		Addr:       *addr,
+		TLSConfig:  tlsCfg,
+		Token:      client.StaticToken(token),
+		ClientName: "quill-tester",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+
 	// Send each packet file
 	for _, file := range files {
 		fmt.Printf("=== Sending %s ===\n", filepath.Base(file))
@@ -71,55 +78,31 @@ func main() {
 			log.Fatalf("Error reading %s: %v", file, err)
 		}
 
-		var pkt Packet
+		var pkt quill.Packet
 		if err := json.Unmarshal(raw, &pkt); err != nil {
 			log.Fatalf("Invalid JSON in %s: %v", file, err)
 		}
 
-		// Override session token and timestamp
-		pkt.SessionToken = token
-		pkt.Timestamp = time.Now().UTC()
-
-		prettyPrint("Request", pkt)
+		prettyPrint("Request", pkt.Payload)
 
-		// Send packet and receive response
-		resp, err := sendAndReceiveTLS(*addr, &pkt)
-		if err != nil {
+		// The client signs in and stamps the packet itself
+		var resp json.RawMessage
+		err = c.Do(context.Background(), pkt.Type, pkt.Payload, &resp)
+		var qe *client.Error
+		switch {
+		case errors.As(err, &qe):
+			fmt.Printf("Error Response: %s\n", qe)
+		case err != nil:
 			log.Fatalf("Error during send/receive: %v", err)
+		default:
+			prettyPrint("Response", resp)
 		}
-
-		prettyPrint("Response", *resp)
 		fmt.Println()
 	}
 }
 
-// sendAndReceive connects to the server, sends the packet, and decodes the response.
-func sendAndReceive(addr string, pkt *Packet) (*Packet, error) {
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
-	}
-	defer conn.Close()
-
-	encoder := json.NewEncoder(conn)
-	if err := encoder.Encode(pkt); err != nil {
-		return nil, fmt.Errorf("failed to send packet: %w", err)
-	}
-
-	decoder := json.NewDecoder(conn)
-	var resp Packet
-	if err := decoder.Decode(&resp); err != nil {
-		if err == io.EOF {
-			return nil, fmt.Errorf("connection closed by server")
-		}
-		return nil, fmt.Errorf("failed to decode response: %w", err)
-	}
-	return &resp, nil
-}
-
-// sendAndReceiveTLS connects over TLS, sends pkt, and returns the decoded response.
-func sendAndReceiveTLS(addr string, pkt *Packet) (*Packet, error) {
-	// 1) Load the self-signed cert so we can trust it
+// loadTLSConfig trusts the self-signed certificate of a local server.
+func loadTLSConfig() (*tls.Config, error) {
 	caPath := "../certificate/quill.crt"
 	caPEM, err := os.ReadFile(caPath)
 	if err != nil {
@@ -129,44 +112,19 @@ func sendAndReceiveTLS(addr string, pkt *Packet) (*Packet, error) {
 	if !roots.AppendCertsFromPEM(caPEM) {
 		return nil, fmt.Errorf("failed to append CA cert")
 	}
-
-	// 2) Build a TLS config that trusts that cert
-	tlsCfg := &tls.Config{
+	return &tls.Config{
 		RootCAs:            roots,
 		ServerName:         "localhost", // must match the CN in quill.crt
 		InsecureSkipVerify: true,
-	}
-
-	// 3) Dial via TLS instead of plain TCP
-	conn, err := tls.Dial("tcp", addr, tlsCfg)
-	if err != nil {
-		return nil, fmt.Errorf("tls.Dial(%q) failed: %w", addr, err)
-	}
-	defer conn.Close()
-
-	// 4) Send your Packet as JSON
-	if err := json.NewEncoder(conn).Encode(pkt); err != nil {
-		return nil, fmt.Errorf("failed to send packet: %w", err)
-	}
-
-	// 5) Read and decode the JSON response
-	var resp Packet
-	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
-		if err == io.EOF {
-			return nil, fmt.Errorf("connection closed by server")
-		}
-		return nil, fmt.Errorf("failed to decode response: %w", err)
-	}
-
-	return &resp, nil
+	}, nil
 }
 
-// prettyPrint logs a packet with JSON indentation.
-func prettyPrint(title string, pkt Packet) {
-	fmt.Printf("%s Packet:\n", title)
-	b, err := json.MarshalIndent(pkt, "", "  ")
+// prettyPrint prints a payload with JSON indentation.
+func prettyPrint(title string, payload json.RawMessage) {
+	fmt.Printf("%s Payload:\n", title)
+	b, err := json.MarshalIndent(payload, "", "  ")
 	if err != nil {
-		fmt.Printf("  <error marshalling packet>: %v\n", err)
+		fmt.Printf("  <error marshalling payload>: %v\n", err)
 		return
 	}
 	fmt.Println(string(b))